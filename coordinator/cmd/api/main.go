@@ -2,8 +2,10 @@ package main
 
 import (
 	"context"
+	"encoding/hex"
+	"flag"
 	"fmt"
-	"log"
+	"io"
 	"net/http"
 	"os"
 	"os/signal"
@@ -13,14 +15,37 @@ import (
 
 	"github.com/federated-storage/coordinator/internal/config"
 	"github.com/federated-storage/coordinator/internal/handlers"
+	"github.com/federated-storage/coordinator/internal/logging"
 	"github.com/federated-storage/coordinator/internal/middleware"
 	"github.com/federated-storage/coordinator/internal/p2p"
+	"github.com/federated-storage/coordinator/internal/selftest"
 	"github.com/federated-storage/coordinator/internal/services"
 	"github.com/federated-storage/coordinator/internal/storage"
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 )
 
 func main() {
+	migrateMode := flag.String("migrate", "", "up applies pending schema migrations before serving; dry-run lists them and exits. By default the coordinator refuses to serve while any are pending")
+	rotateIdentity := flag.String("rotate-identity", "", "replace the coordinator's P2P key before serving if its peer ID is still this one; nodes pick up the new ID with their next heartbeat")
+	flag.Parse()
+	// "migrate" runs on its own: it lists pending migrations, or applies them
+	// with "migrate up", and exits without serving
+	standalone := flag.Arg(0) == "migrate"
+	if standalone {
+		switch flag.Arg(1) {
+		case "":
+			*migrateMode = "dry-run"
+		case "up":
+			*migrateMode = "up"
+		default:
+			logging.Fatalf("Unknown migrate command %q (want migrate or migrate up)", flag.Arg(1))
+		}
+	}
+	if *migrateMode != "" && *migrateMode != "up" && *migrateMode != "dry-run" {
+		logging.Fatalf("Invalid --migrate %q (want up or dry-run)", *migrateMode)
+	}
+
 	// Load configuration
 	configPath := os.Getenv("CONFIG_PATH")
 	if configPath == "" {
@@ -29,15 +54,39 @@ func main() {
 
 	cfg, err := config.Load(configPath)
 	if err != nil {
-		log.Printf("Warning: failed to load config from %s: %v", configPath, err)
-		log.Println("Using default configuration")
+		logging.Warnf("Failed to load config from %s: %v", configPath, err)
+		logging.Infof("Using default configuration")
 		cfg = config.DefaultConfig()
 	}
 
+	logCloser, err := logging.Setup(cfg.Server.LogLevel, cfg.Server.LogFile, cfg.Server.LogMaxSizeMB)
+	if err != nil {
+		logging.Fatalf("Failed to set up logging: %v", err)
+	}
+	defer logCloser.Close()
+
+	// "selftest [url]" checks a running coordinator, by default this one,
+	// instead of serving
+	if flag.Arg(0) == "selftest" {
+		baseURL := flag.Arg(1)
+		if baseURL == "" {
+			baseURL = fmt.Sprintf("http://127.0.0.1:%d", cfg.Server.Port)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		report := selftest.Run(ctx, &http.Client{}, baseURL, selftest.DefaultSizeBytes)
+		cancel()
+		printSelftestReport(os.Stdout, baseURL, report)
+		if !report.Passed {
+			logCloser.Close()
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Initialize database
 	db, err := storage.New(cfg.Database.DatabaseURL())
 	if err != nil {
-		log.Fatalf("Failed to connect to database: %v", err)
+		logging.Fatalf("Failed to connect to database: %v", err)
 	}
 	defer db.Close()
 
@@ -53,38 +102,427 @@ func main() {
 			migrationsPath = "./migrations"
 		}
 	}
-	if err := db.Migrate(migrationsPath); err != nil {
-		log.Printf("Warning: migrations failed: %v", err)
+	status, err := db.MigrationStatus(migrationsPath)
+	if err != nil && *migrateMode != "" {
+		logging.Fatalf("Failed to check migrations: %v", err)
+	}
+	switch {
+	case err != nil:
+		logging.Warnf("Failed to check migrations: %v", err)
+	case *migrateMode == "dry-run":
+		printMigrationStatus(os.Stdout, status)
+		return
+	case *migrateMode == "up":
+		if err := db.Migrate(migrationsPath); err != nil {
+			logging.Fatalf("Migrations failed: %v", err)
+		}
+		logging.Infof("Applied %d migrations", len(status.Pending))
+		if standalone {
+			return
+		}
+	case status.Dirty:
+		logging.Fatalf("Migration %d failed partway; repair the schema by hand before serving", status.Version)
+	case len(status.Pending) > 0:
+		// Applying them is left to the operator, who may want to review them
+		// first, but queries written for the new schema must not run on the old one
+		logging.Fatalf("Schema is at version %d with %d pending migrations; start with --migrate=up to apply them, or --migrate=dry-run to list them",
+			status.Version, len(status.Pending))
 	}
 
 	// Initialize services
-	authService := services.NewAuthService(db)
-	nodeService := services.NewNodeService(db)
-	fileService := services.NewFileService(db, cfg.Storage.ChunkSizeBytes, cfg.Storage.StorageCreditPerGBMonth)
-	chunkService := services.NewChunkService(db, nodeService)
-	uploadService := services.NewUploadService(db, cfg.Storage.ChunkSizeBytes, cfg.Storage.DefaultReplicas)
-	// Initialize proof service (for background proof challenges)
-	_ = services.NewProofService(db, cfg.Storage.ProofDifficulty)
+	store := storage.NewPgStore(db)
+	tiers := make([]services.PricingTier, len(cfg.Pricing.Tiers))
+	for i, t := range cfg.Pricing.Tiers {
+		tiers[i] = services.PricingTier{MinUSD: t.MinUSD, CreditsPerUSD: t.CreditsPerUSD}
+	}
+	pricing := services.NewPricing(cfg.Pricing.DefaultCreditsPerUSD, tiers)
+	authService := services.NewAuthService(store, pricing)
+	authService.SetLoginLockout(cfg.Auth.MaxFailedLogins, time.Duration(cfg.Auth.LockoutMinutes)*time.Minute)
+	nodeService := services.NewNodeService(db, cfg.Nodes.MinNodeVersion)
+	nodeService.SetUnverifiedCapacity(int64(cfg.Nodes.UnverifiedCapacityGB) * 1024 * 1024 * 1024)
+	nodeService.SetEarningsRates(services.EarningsRates{
+		CreditsPerGBMonth:  cfg.Nodes.EarningsCreditPerGBMonth,
+		MissedProofPenalty: cfg.Nodes.MissedProofPenaltyCredits,
+	})
+	if cfg.Nodes.LeaderboardSecret != "" {
+		secret, err := hex.DecodeString(cfg.Nodes.LeaderboardSecret)
+		if err != nil {
+			logging.Fatalf("Invalid nodes.leaderboard_secret: %v", err)
+		}
+		nodeService.SetLeaderboardSecret(secret)
+	}
+	fileService := services.NewFileService(store, cfg.Storage.ChunkSizeBytes, cfg.Storage.StorageCreditPerGBMonth)
+	fileService.SetDefaultMimeType(cfg.Storage.DefaultMimeType)
+	var chunkCache *services.ChunkCache
+	if cfg.Storage.ChunkCacheMB > 0 {
+		chunkCache = services.NewChunkCache(int64(cfg.Storage.ChunkCacheMB) * 1024 * 1024)
+	}
+	chunkService := services.NewChunkService(store, nodeService, chunkCache)
+	chunkService.SetMinOperators(cfg.Storage.MinDistinctOperators)
+	chunkService.SetMinReplicas(cfg.Storage.MinReplicas)
+	placement, err := services.ParsePlacement(cfg.Storage.Placement)
+	if err != nil {
+		logging.Fatalf("Invalid storage.placement: %v", err)
+	}
+	chunkService.SetPlacement(placement, cfg.Storage.PlacementVirtualNodes)
+	chunkService.SetMaintenanceLead(time.Duration(max(cfg.Nodes.MaintenanceLeadMinutes, 0)) * time.Minute)
+	chunkService.SetOfflineAfter(time.Duration(cfg.Nodes.OfflineAfterSeconds) * time.Second)
+	nodeService.SetOfflineAfter(time.Duration(cfg.Nodes.OfflineAfterSeconds) * time.Second)
+	uploadService := services.NewUploadService(store, cfg.Storage.ChunkSizeBytes, cfg.Storage.DefaultReplicas, cfg.Storage.MaxChunksPerFile)
+	uploadService.SetMaxActiveSessions(cfg.Storage.MaxActiveUploadsPerUser)
+	uploadService.SetChunkSizeRange(cfg.Storage.MinChunkSizeBytes, cfg.Storage.MaxChunkSizeBytes)
+	chunkSizeTiers := make([]services.ChunkSizeTier, len(cfg.Storage.ChunkSizeTiers))
+	for i, t := range cfg.Storage.ChunkSizeTiers {
+		chunkSizeTiers[i] = services.ChunkSizeTier{MinFileBytes: t.MinFileBytes, ChunkSizeBytes: t.ChunkSizeBytes}
+	}
+	uploadService.SetChunkSizeSchedule(chunkSizeTiers)
+	uploadCipher, err := services.ParseCipher(cfg.Storage.Cipher)
+	if err != nil {
+		logging.Fatalf("Invalid storage.cipher: %v", err)
+	}
+	uploadService.SetCipher(uploadCipher)
+	keyProvider, err := services.ParseKeyProvider(cfg.Storage.KeyProvider, cfg.Storage.MasterKey)
+	if err != nil {
+		logging.Fatalf("Invalid storage.key_provider: %v", err)
+	}
+	uploadService.SetKeyProvider(keyProvider)
+	fileService.SetKeyProvider(keyProvider)
+	webhookService := services.NewWebhookService(store)
+	webhookService.SetRetries(cfg.Webhooks.MaxAttempts, time.Duration(cfg.Webhooks.BackoffSeconds)*time.Second)
+	webhookService.SetLimits(cfg.Webhooks.MaxPerUser, time.Duration(cfg.Webhooks.RetentionDays)*24*time.Hour)
+	webhookService.AllowPrivateTargets(cfg.Webhooks.AllowPrivateTargets)
+	fileService.SetWebhooks(webhookService)
 
 	// Initialize P2P node
 	p2pNode, err := p2p.NewNode(cfg.P2P.ListenAddresses, cfg.P2P.EnableTCP, cfg.P2P.EnableQUIC)
 	if err != nil {
-		log.Fatalf("Failed to create P2P node: %v", err)
+		logging.Fatalf("Failed to create P2P node: %v", err)
 	}
 	defer p2pNode.Close()
+	identity, err := p2p.LoadIdentity(cfg.P2P.IdentityFile)
+	if err != nil {
+		logging.Fatalf("Failed to load P2P identity: %v", err)
+	}
+	// Naming the peer ID to rotate away from makes the flag safe to leave
+	// set: once rotated, later starts find another ID and keep it
+	if previous := p2p.IdentityPeerID(identity); *rotateIdentity != "" && *rotateIdentity != previous {
+		logging.Infof("P2P identity is %s, not %s; --rotate-identity has nothing to do", previous, *rotateIdentity)
+	} else if *rotateIdentity != "" {
+		if identity, err = p2p.RotateIdentity(cfg.P2P.IdentityFile); err != nil {
+			logging.Fatalf("Failed to rotate P2P identity: %v", err)
+		}
+		logging.Infof("Rotated P2P identity from %s to %s; the previous key is kept in %s.old", previous, p2p.IdentityPeerID(identity), cfg.P2P.IdentityFile)
+	}
+	rotation, err := p2p.LoadRotation(cfg.P2P.IdentityFile, identity)
+	if err != nil {
+		logging.Fatalf("Failed to load P2P identity rotation: %v", err)
+	}
+	p2pNode.SetIdentity(identity)
+	chunkService.SetTransfer(p2pNode)
+	if cfg.Storage.DirectUploads {
+		// Nodes check store authorizations against the coordinator's peer ID
+		uploadService.SetDirectUploads(p2pNode, p2pNode, services.DefaultStoreAuthorizationTTL)
+	}
 
-	// Start P2P node
+	// Start P2P node. If it fails the API still serves accounts and listings,
+	// reporting itself degraded, while storage operations wait for a retry.
 	if err := p2pNode.Start(); err != nil {
-		log.Fatalf("Failed to start P2P node: %v", err)
+		logging.Errorf("P2P unavailable, storage operations disabled: %v", err)
+		if cfg.P2P.StartRetrySeconds > 0 {
+			go func() {
+				ticker := time.NewTicker(time.Duration(cfg.P2P.StartRetrySeconds) * time.Second)
+				defer ticker.Stop()
+				for range ticker.C {
+					if err := p2pNode.Start(); err != nil {
+						logging.Warnf("P2P start retry failed: %v", err)
+						continue
+					}
+					logging.Infof("P2P node started with ID: %s", p2pNode.PeerID())
+					return
+				}
+			}()
+		}
+	} else {
+		logging.Infof("P2P node started with ID: %s", p2pNode.PeerID())
+	}
+
+	// Initialize proof service (for background and on-demand proof challenges)
+	proofTimeout := services.ProofTimeout{BaseMs: cfg.Storage.ProofTimeoutBaseMs, MsPerRound: cfg.Storage.ProofTimeoutMsPerRound}
+	proofService := services.NewProofService(db, cfg.Storage.ProofDifficulty, proofTimeout, p2pNode,
+		time.Duration(cfg.Storage.VerifyCooldownSeconds)*time.Second)
+	proofService.SetMaxPendingPerNode(cfg.Storage.MaxPendingChallengesPerNode)
+	proofService.SetMissedProofGrace(cfg.Nodes.MissedProofGrace)
+	proofService.SetProofRetries(time.Duration(cfg.Storage.ProofRetryWindowHours)*time.Hour, cfg.Storage.MaxProofRetries)
+	// A chunk that has missed three rounds of proofs counts as degraded
+	proofService.SetHealthPolicy(cfg.Storage.DefaultReplicas, 3*time.Duration(cfg.Storage.ProofIntervalHours)*time.Hour)
+
+	// Read-only mode pauses every background job that writes, and is saved so
+	// a restart doesn't end it
+	readOnlyHandler := handlers.NewReadOnlyHandler(cfg.Server.ReadOnly)
+	if err := readOnlyHandler.Restore(context.Background(), store); err != nil {
+		logging.Fatalf("Failed to restore read-only mode: %v", err)
+	}
+
+	// Fail challenges nodes never answered so the backlog can't grow without
+	// bound. Nodes can't answer while P2P is down or the coordinator is
+	// read-only, so nothing expires until both have been over for a whole max age.
+	if cfg.Storage.PendingChallengeMaxAgeMinutes > 0 {
+		maxAge := time.Duration(cfg.Storage.PendingChallengeMaxAgeMinutes) * time.Minute
+		go func() {
+			ticker := time.NewTicker(time.Minute)
+			defer ticker.Stop()
+			var upSince time.Time
+			for now := range ticker.C {
+				if !p2pNode.Available() || readOnlyHandler.Enabled() {
+					upSince = time.Time{}
+					continue
+				}
+				if upSince.IsZero() {
+					upSince = now
+				}
+				if now.Sub(upSince) < maxAge {
+					continue
+				}
+				expired, err := proofService.ExpireStaleChallenges(context.Background(), maxAge)
+				if err != nil {
+					logging.Errorf("Stale challenge expiry: %v", err)
+				} else if expired > 0 {
+					logging.Infof("Expired %d stale proof challenges", expired)
+				}
+			}
+		}()
 	}
 
-	log.Printf("P2P node started with ID: %s", p2pNode.Host().ID().String())
+	// Send pending challenges to their nodes and verify the answers in batches
+	if cfg.Storage.ProofVerifySeconds > 0 {
+		go func() {
+			ticker := time.NewTicker(time.Duration(cfg.Storage.ProofVerifySeconds) * time.Second)
+			defer ticker.Stop()
+			for range ticker.C {
+				if !p2pNode.Available() || readOnlyHandler.Enabled() {
+					continue
+				}
+				result, err := proofService.VerifyPendingChallenges(context.Background(), cfg.Storage.ProofBatchSize)
+				if err != nil {
+					logging.Errorf("Proof verification: %v", err)
+				} else if result.Challenged > 0 {
+					logging.Infof("Verified a batch of %d proofs in %s: %d passed, %d failed, %d undelivered",
+						result.Challenged, result.Duration, result.Verified, result.Failed, result.Undelivered)
+				}
+			}
+		}()
+	}
+
+	// Snapshot node behavior into reputation history, which ranks nodes for placement
+	if cfg.Nodes.ReputationSnapshotMinutes > 0 {
+		interval := time.Duration(cfg.Nodes.ReputationSnapshotMinutes) * time.Minute
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for tick := range ticker.C {
+				if readOnlyHandler.Enabled() {
+					continue
+				}
+				recorded, err := nodeService.RecordReputationSnapshots(context.Background(), tick.Add(-interval))
+				if err != nil {
+					logging.Errorf("Reputation snapshot: %v", err)
+				}
+				logging.Debugf("Recorded reputation for %d nodes", recorded)
+			}
+		}()
+	}
+
+	// Credit nodes for each finished day of storage. Checking hourly catches
+	// the day soon after it ends, and days already credited are skipped.
+	if cfg.Nodes.EarningsCreditPerGBMonth > 0 {
+		go func() {
+			ticker := time.NewTicker(time.Hour)
+			defer ticker.Stop()
+			for tick := range ticker.C {
+				if readOnlyHandler.Enabled() {
+					continue
+				}
+				credited, err := nodeService.RecordDailyEarnings(context.Background(), tick.UTC().AddDate(0, 0, -1))
+				if err != nil {
+					logging.Errorf("Daily earnings: %v", err)
+				} else if credited > 0 {
+					logging.Infof("Credited %d nodes for a day of storage", credited)
+				}
+			}
+		}()
+	}
+
+	// Keep chunks of nodes going into maintenance available on other nodes,
+	// and retire those copies once the nodes are back
+	if cfg.Nodes.MaintenanceDrainSeconds > 0 {
+		go func() {
+			ticker := time.NewTicker(time.Duration(cfg.Nodes.MaintenanceDrainSeconds) * time.Second)
+			defer ticker.Stop()
+			for range ticker.C {
+				if !p2pNode.Available() || readOnlyHandler.Enabled() {
+					continue
+				}
+				report, err := chunkService.DrainMaintenanceNodes(context.Background(), p2pNode, cfg.Storage.DefaultReplicas, 100)
+				if err != nil {
+					logging.Errorf("Maintenance drain: %v", err)
+					continue
+				}
+				if report.Planned > 0 {
+					logging.Infof("Maintenance drain: copied %d of %d chunk replicas off %d nodes (%d failed)",
+						len(report.Copied), report.Planned, report.Draining, len(report.Failed))
+				}
+				if len(report.Retired) > 0 {
+					logging.Infof("Maintenance drain: retired %d chunk replicas copied for nodes back from maintenance", len(report.Retired))
+				}
+			}
+		}()
+	}
+
+	// Send rotated chunks to the nodes whose replicas missed them when the
+	// file's key was rotated
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for range ticker.C {
+			if !p2pNode.Available() || readOnlyHandler.Enabled() {
+				continue
+			}
+			refreshed, stale, err := chunkService.RefreshStaleReplicas(context.Background(), uuid.Nil)
+			if err != nil {
+				logging.Errorf("Stale replica refresh: %v", err)
+			} else if refreshed > 0 {
+				logging.Infof("Refreshed %d stale chunk replicas, %d still stale", refreshed, stale)
+			}
+		}
+	}()
+
+	// Purge files and upload sessions past their expiry, and what abandoned
+	// uploads left behind, in the background, except while read-only
+	if cfg.Storage.ExpirySweepSeconds > 0 {
+		go func() {
+			ticker := time.NewTicker(time.Duration(cfg.Storage.ExpirySweepSeconds) * time.Second)
+			defer ticker.Stop()
+			for range ticker.C {
+				if readOnlyHandler.Enabled() {
+					continue
+				}
+				purged, err := fileService.PurgeExpired(context.Background(), time.Now(), cfg.Storage.DefaultReplicas)
+				for _, file := range purged {
+					chunkService.InvalidateFile(file.ID)
+				}
+				if len(purged) > 0 {
+					logging.Infof("Purged %d expired files", len(purged))
+				}
+				if err != nil {
+					logging.Errorf("Expired file purge: %v", err)
+				}
+
+				// Abandoned uploads give back the credits held for them
+				expired, err := uploadService.ExpireSessions(context.Background(), time.Now())
+				if expired > 0 {
+					logging.Infof("Expired %d upload sessions", expired)
+				}
+				if err != nil {
+					logging.Errorf("Upload session expiry: %v", err)
+				}
+
+				// Canceled, expired and failed uploads leave no file or chunks behind
+				abandoned, err := fileService.PurgeAbandonedUploads(context.Background())
+				for _, file := range abandoned {
+					chunkService.InvalidateFile(file.ID)
+				}
+				if len(abandoned) > 0 {
+					logging.Infof("Purged %d abandoned uploads", len(abandoned))
+				}
+				if err != nil {
+					logging.Errorf("Abandoned upload purge: %v", err)
+				}
+			}
+		}()
+	}
+
+	// Send queued webhook deliveries, retrying failed ones with backoff, and
+	// prune settled ones past the retention every hour
+	if cfg.Webhooks.DeliverySeconds > 0 {
+		go func() {
+			ticker := time.NewTicker(time.Duration(cfg.Webhooks.DeliverySeconds) * time.Second)
+			defer ticker.Stop()
+			var lastPrune time.Time
+			for tick := range ticker.C {
+				if readOnlyHandler.Enabled() {
+					continue
+				}
+				report, err := webhookService.DeliverDue(context.Background(), time.Now(), 100)
+				if err != nil {
+					logging.Errorf("Webhook delivery: %v", err)
+				}
+				if report.Retrying > 0 || report.Failed > 0 {
+					logging.Warnf("Webhooks: %d delivered, %d to retry, %d given up", report.Delivered, report.Retrying, report.Failed)
+				}
+
+				if tick.Sub(lastPrune) < time.Hour {
+					continue
+				}
+				lastPrune = tick
+				pruned, err := webhookService.PruneDeliveries(context.Background(), tick)
+				if err != nil {
+					logging.Errorf("Webhook delivery pruning: %v", err)
+				}
+				if pruned > 0 {
+					logging.Infof("Pruned %d settled webhook deliveries", pruned)
+				}
+			}
+		}()
+	}
+
+	// Announce nodes whose heartbeats stopped. Each check covers the nodes
+	// that crossed the threshold since the previous one, so each is announced once.
+	if cfg.Nodes.OfflineAfterSeconds > 0 {
+		offlineAfter := time.Duration(cfg.Nodes.OfflineAfterSeconds) * time.Second
+		go func() {
+			ticker := time.NewTicker(time.Minute)
+			defer ticker.Stop()
+			last := time.Now()
+			for tick := range ticker.C {
+				// Nodes that go offline meanwhile are announced once it ends
+				if readOnlyHandler.Enabled() {
+					continue
+				}
+				nodes, err := nodeService.NodesGoneOffline(context.Background(), last.Add(-offlineAfter), tick.Add(-offlineAfter))
+				if err != nil {
+					logging.Errorf("Offline node check: %v", err)
+					continue
+				}
+				last = tick
+				for _, node := range nodes {
+					logging.Warnf("Node %s (%s) has sent no heartbeat since %s", node.Name, node.ID, node.LastHeartbeat.Format(time.RFC3339))
+					err := webhookService.Notify(context.Background(), services.EventNodeOffline, nil, services.NodeEvent{
+						NodeID:        node.ID,
+						PeerID:        node.PeerID,
+						Name:          node.Name,
+						LastHeartbeat: node.LastHeartbeat,
+					})
+					if err != nil {
+						logging.Errorf("Node offline webhook: %v", err)
+					}
+				}
+			}
+		}()
+	}
 
 	// Set up HTTP server
 	gin.SetMode(gin.ReleaseMode)
 	router := gin.New()
-	router.Use(gin.Recovery())
-	router.Use(gin.Logger())
+	if err := middleware.ConfigureTrustedProxies(router, cfg.Server.TrustedProxies); err != nil {
+		logging.Fatalf("Failed to configure trusted proxies: %v", err)
+	}
+	router.Use(gin.RecoveryWithWriter(logging.Writer(logging.LevelError)))
+	if cfg.Server.LogRequests {
+		router.Use(middleware.RequestLogger(logging.Writer(logging.LevelInfo), logging.NewRedactor(cfg.Server.RedactKeys)))
+	} else {
+		router.Use(gin.LoggerWithWriter(logging.Writer(logging.LevelInfo)))
+	}
+	router.Use(middleware.RequestTimeout(time.Duration(cfg.Server.RequestTimeoutSeconds)*time.Second, cfg.Server.RequestTimeoutExempt))
 
 	// CORS middleware
 	router.Use(func(c *gin.Context) {
@@ -98,10 +536,21 @@ func main() {
 		c.Next()
 	})
 
+	var idCodec *middleware.IDCodec
+	if cfg.Server.IDSecret != "" {
+		idSecret, err := hex.DecodeString(cfg.Server.IDSecret)
+		if err == nil {
+			idCodec, err = middleware.NewIDCodec(idSecret)
+		}
+		if err != nil {
+			logging.Fatalf("Invalid server.id_secret: %v", err)
+		}
+	}
+
 	// Health check
-	router.GET("/health", func(c *gin.Context) {
-		c.JSON(http.StatusOK, gin.H{"status": "healthy"})
-	})
+	healthHandler := handlers.NewHealthHandler(p2pNode)
+	router.GET("/health", healthHandler.Health)
+	requireP2P := healthHandler.RequireP2P
 
 	// Serve Web UI static files
 	router.Static("/web", "./web/static")
@@ -109,41 +558,135 @@ func main() {
 
 	// Initialize handlers
 	authHandler := handlers.NewAuthHandler(authService, os.Getenv("JWT_SECRET"))
-	nodeHandler := handlers.NewNodeHandler(nodeService)
-	fileHandler := handlers.NewFileHandler(fileService, chunkService)
+	nodeHandler := handlers.NewNodeHandler(nodeService, chunkService, p2pNode, cfg.Nodes.LeaderboardShowNames)
+	nodeHandler.SetIdentityRotation(rotation)
+	fileHandler := handlers.NewFileHandler(fileService, chunkService, proofService)
 	uploadHandler := handlers.NewUploadHandler(uploadService, fileService, chunkService, authService, cfg.Storage.DefaultReplicas)
+	proofHandler := handlers.NewProofHandler(proofService, nodeService)
+	adminHandler := handlers.NewAdminHandler(nodeService, chunkService, proofService, p2pNode, p2pNode)
+	capacityHandler := handlers.NewCapacityHandler(nodeService, p2pNode, int64(cfg.Nodes.CapacityProofMB)*1024*1024)
+	decommissionHandler := handlers.NewDecommissionHandler(nodeService, chunkService, p2pNode,
+		cfg.Storage.DefaultReplicas, cfg.Storage.MaxChunkSizeBytes)
+	inviteHandler := handlers.NewInviteHandler(services.NewInviteService(store), *cfg.Nodes.AllowOpenRegistration)
+	webhookHandler := handlers.NewWebhookHandler(webhookService, false)
+	operatorWebhookHandler := handlers.NewWebhookHandler(webhookService, true)
+	pricingHandler := handlers.NewPricingHandler(services.NewStorageRates(cfg.Storage.StorageCreditPerGBMonth,
+		cfg.Storage.DefaultReplicas, cfg.Storage.ChunkSizeBytes, cfg.Storage.MaxChunkSizeBytes, cfg.Storage.MaxChunksPerFile, pricing))
+	statsHandler := handlers.NewStatsHandler(nodeService)
 
 	// API routes
 	api := router.Group("/api/v1")
 	{
+		// Storage pricing (public)
+		api.GET("/pricing", pricingHandler.GetPricing)
+
+		// Network statistics (public)
+		api.GET("/stats", statsHandler.GetStats)
+
 		// Auth routes (public)
+		// Login stays open while read-only, lockout counting included, so
+		// users can still sign in to download
 		auth := api.Group("/auth")
+		auth.Use(readOnlyHandler.RejectWritesExcept("/api/v1/auth/login"))
 		{
 			auth.POST("/register", authHandler.Register)
 			auth.POST("/login", authHandler.Login)
 			auth.POST("/credits/purchase", middleware.JWTMiddleware(os.Getenv("JWT_SECRET")), authHandler.PurchaseCredits)
 			auth.GET("/profile", middleware.JWTMiddleware(os.Getenv("JWT_SECRET")), authHandler.Profile)
+			auth.DELETE("/account", middleware.JWTMiddleware(os.Getenv("JWT_SECRET")), authHandler.DeleteAccount)
 		}
 
-		// Node routes
+		// Node routes; those listed in nodes.signed_routes also require a request signature
+		signedRoutes := make(map[string]bool)
+		for _, route := range cfg.Nodes.SignedRoutes {
+			signedRoutes[route] = true
+		}
+		nodeAuth := func(route string) gin.HandlerFunc {
+			if signedRoutes[route] {
+				return middleware.SignedNodeAuthMiddleware(nodeService.GetAPIKeyHash,
+					time.Duration(cfg.Nodes.SignatureMaxSkewSeconds)*time.Second)
+			}
+			return middleware.NodeAuthMiddleware(nodeService.GetAPIKeyHash)
+		}
+		// Heartbeats keep being recorded while read-only, or every node would
+		// look offline once it ends; reconcile only compares chunk lists
 		nodes := api.Group("/nodes")
+		nodes.Use(readOnlyHandler.RejectWritesExcept("/api/v1/nodes/heartbeat", "/api/v1/nodes/reconcile"))
 		{
-			nodes.POST("/register", nodeHandler.Register)
+			nodes.POST("/register", requireP2P, inviteHandler.RequireInvite, nodeHandler.Register)
 			nodes.GET("", nodeHandler.ListNodes)
-			nodes.POST("/heartbeat", middleware.NodeAuthMiddleware(nodeService.GetAPIKeyHash), nodeHandler.Heartbeat)
-			nodes.GET("/balance", middleware.NodeAuthMiddleware(nodeService.GetAPIKeyHash), nodeHandler.GetBalance)
+			nodes.GET("/leaderboard", nodeHandler.Leaderboard)
+			nodes.POST("/heartbeat", nodeAuth("heartbeat"), nodeHandler.Heartbeat)
+			nodes.GET("/balance", nodeAuth("balance"), nodeHandler.GetBalance)
+			nodes.POST("/reconcile", nodeAuth("reconcile"), nodeHandler.Reconcile)
+			nodes.PUT("/capacity", nodeAuth("capacity"), nodeHandler.UpdateCapacity)
+			nodes.POST("/rotate-key", nodeAuth("rotate-key"), nodeHandler.RotateKey)
+			nodes.GET("/reputation", nodeAuth("reputation"), nodeHandler.GetReputation)
+			nodes.GET("/chunks", nodeAuth("chunks"), nodeHandler.ListChunks)
+			nodes.POST("/proofs/retry", nodeAuth("retry-proofs"), proofHandler.RetryProofs)
+			nodes.POST("/proofs/retry/:id", nodeAuth("retry-proofs"), proofHandler.AnswerRetry)
+			nodes.PUT("/maintenance", nodeAuth("maintenance"), nodeHandler.ScheduleMaintenance)
+			nodes.DELETE("/maintenance", nodeAuth("maintenance"), nodeHandler.CancelMaintenance)
+			nodes.POST("/decommission", nodeAuth("decommission"), decommissionHandler.Start)
+			nodes.POST("/decommission/chunks/:chunk_id", requireP2P, nodeAuth("decommission"), decommissionHandler.MigrateChunk)
+			nodes.DELETE("", nodeAuth("decommission"), decommissionHandler.Deregister)
+		}
+
+		// Operator routes; only the read-only toggle itself writes while read-only
+		admin := api.Group("/admin")
+		admin.Use(middleware.AdminAuthMiddleware(os.Getenv("ADMIN_API_KEY")), readOnlyHandler.RejectWritesExcept("/api/v1/admin/read-only"))
+		{
+			admin.GET("/read-only", readOnlyHandler.GetReadOnly)
+			admin.PUT("/read-only", readOnlyHandler.SetReadOnly)
+			admin.POST("/nodes/bulk", requireP2P, nodeHandler.BulkRegister)
+			admin.POST("/nodes/invites", inviteHandler.CreateInvite)
+			admin.POST("/rebalance", requireP2P, adminHandler.Rebalance)
+			admin.GET("/proofs/backlog", adminHandler.ProofBacklog)
+			admin.GET("/dedup-report", adminHandler.DedupReport)
+			admin.POST("/nodes/:id/capacity-proof", requireP2P, capacityHandler.ProveCapacity)
+			admin.POST("/nodes/:id/file-proof", requireP2P, adminHandler.ProveFile)
+			admin.POST("/nodes/:id/recompute", adminHandler.RecomputeNodeStats)
+			admin.GET("/nodes/exclusions", adminHandler.ListExcludedNodes)
+			admin.POST("/nodes/exclusions", adminHandler.ExcludeNode)
+			admin.DELETE("/nodes/exclusions/:peer_id", adminHandler.IncludeNode)
+			admin.POST("/nodes/recompute", adminHandler.RecomputeAllNodeStats)
+			admin.POST("/webhooks", operatorWebhookHandler.CreateWebhook)
+			admin.GET("/webhooks", operatorWebhookHandler.ListWebhooks)
+			admin.DELETE("/webhooks/:id", operatorWebhookHandler.DeleteWebhook)
+		}
+
+		// Webhook routes (protected)
+		webhooks := api.Group("/webhooks")
+		webhooks.Use(middleware.JWTMiddleware(os.Getenv("JWT_SECRET")), readOnlyHandler.RejectWrites)
+		{
+			webhooks.POST("", webhookHandler.CreateWebhook)
+			webhooks.GET("", webhookHandler.ListWebhooks)
+			webhooks.DELETE("/:id", webhookHandler.DeleteWebhook)
 		}
 
 		// File routes (protected)
 		files := api.Group("/files")
-		files.Use(middleware.JWTMiddleware(os.Getenv("JWT_SECRET")))
+		files.Use(middleware.JWTMiddleware(os.Getenv("JWT_SECRET")), readOnlyHandler.RejectWrites, middleware.ObfuscateIDs(idCodec))
 		{
 			files.GET("", fileHandler.ListFiles)
+			files.POST("", requireP2P, uploadHandler.UploadFile)
+			files.GET("/:id", fileHandler.GetFile)
 			files.GET("/:id/download", fileHandler.DownloadFile)
+			files.GET("/:id/chunks/:index", fileHandler.DownloadChunk)
+			files.GET("/:id/versions", fileHandler.ListVersions)
 			files.DELETE("/:id", fileHandler.DeleteFile)
-			files.POST("/upload/initiate", uploadHandler.InitiateUpload)
-			files.POST("/upload/:id/chunk", uploadHandler.UploadChunk)
-			files.POST("/upload/:id/complete", uploadHandler.CompleteUpload)
+			files.POST("/:id/verify", requireP2P, fileHandler.VerifyFile)
+			files.POST("/:id/repair", requireP2P, fileHandler.RepairFile)
+			files.GET("/:id/health", fileHandler.FileHealth)
+			files.GET("/:id/locations", fileHandler.FileLocations)
+			files.POST("/:id/rotate-key", requireP2P, fileHandler.RotateKey)
+			files.POST("/:id/tags", fileHandler.AddTags)
+			files.DELETE("/:id/tags/:tag", fileHandler.RemoveTag)
+			files.POST("/upload/initiate", requireP2P, uploadHandler.InitiateUpload)
+			files.POST("/upload/:id/chunk", requireP2P, uploadHandler.UploadChunk)
+			files.POST("/upload/:id/chunk/stored", uploadHandler.ChunkStored)
+			files.POST("/upload/:id/complete", requireP2P, uploadHandler.CompleteUpload)
+			files.DELETE("/upload/:id", uploadHandler.CancelUpload)
 		}
 	}
 
@@ -159,20 +702,57 @@ func main() {
 		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 		<-sigChan
 
-		log.Println("Shutting down server...")
+		logging.Infof("Shutting down server...")
 
 		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 		defer cancel()
 
 		if err := srv.Shutdown(ctx); err != nil {
-			log.Printf("Server forced to shutdown: %v", err)
+			logging.Errorf("Server forced to shutdown: %v", err)
 		}
 	}()
 
-	log.Printf("Coordinator HTTP server starting on %s:%d", cfg.Server.Host, cfg.Server.Port)
+	logging.Infof("Coordinator HTTP server starting on %s:%d", cfg.Server.Host, cfg.Server.Port)
 	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		log.Fatalf("Failed to start server: %v", err)
+		logging.Fatalf("Failed to start server: %v", err)
 	}
 
-	log.Println("Server exited")
+	logging.Infof("Server exited")
+}
+
+// printSelftestReport reports each selftest stage with its timing
+func printSelftestReport(w io.Writer, baseURL string, report *selftest.Report) {
+	fmt.Fprintf(w, "Selftest against %s\n", baseURL)
+	for _, stage := range report.Stages {
+		result := "PASS"
+		if stage.Error != "" {
+			result = "FAIL"
+		}
+		fmt.Fprintf(w, "  %s %-16s %8s", result, stage.Name, stage.Duration.Round(time.Millisecond))
+		if stage.Error != "" {
+			fmt.Fprintf(w, "  %s", stage.Error)
+		}
+		fmt.Fprintln(w)
+	}
+	if report.Passed {
+		fmt.Fprintln(w, "Selftest passed")
+	} else {
+		fmt.Fprintln(w, "Selftest failed")
+	}
+}
+
+// printMigrationStatus reports the schema version and pending migrations
+func printMigrationStatus(w io.Writer, status *storage.MigrationStatus) {
+	fmt.Fprintf(w, "Schema version: %d\n", status.Version)
+	if status.Dirty {
+		fmt.Fprintf(w, "Migration %d failed partway; repair the schema by hand before migrating\n", status.Version)
+	}
+	if len(status.Pending) == 0 {
+		fmt.Fprintln(w, "No pending migrations")
+		return
+	}
+	fmt.Fprintf(w, "Pending migrations (%d):\n", len(status.Pending))
+	for _, m := range status.Pending {
+		fmt.Fprintf(w, "  %d_%s\n", m.Version, m.Name)
+	}
 }
@@ -0,0 +1,73 @@
+// Package chunkformat describes the layout of stored chunk data. Chunks
+// written since the layout was versioned start with a header, Magic followed
+// by a version byte and a flags byte, and then hold the cipher's sealed
+// output (nonce, ciphertext and tag). Older chunks, and the ones direct
+// upload clients encrypt themselves, are the sealed output alone.
+package chunkformat
+
+import "bytes"
+
+// Magic opens every chunk that has a header
+var Magic = []byte("DSCK")
+
+// Format versions
+const (
+	// Legacy is the version of a chunk without a header
+	Legacy = 0
+	// V1 chunks carry a header whose flags describe the sealed plaintext
+	V1 = 1
+	// Current is the version new chunks are written with
+	Current = V1
+)
+
+// HeaderSize is the length of a header in bytes
+const HeaderSize = 6
+
+// Header flags
+const (
+	// FlagCompressed marks a chunk whose plaintext was DEFLATE-compressed
+	// before it was sealed
+	FlagCompressed byte = 1 << 0
+
+	// KnownFlags are the flags this version of the coordinator can decode
+	KnownFlags = FlagCompressed
+)
+
+// Header is the versioned prefix of a chunk
+type Header struct {
+	Version byte
+	Flags   byte
+}
+
+// Append appends the encoded header to dst
+func (h Header) Append(dst []byte) []byte {
+	dst = append(dst, Magic...)
+	return append(dst, h.Version, h.Flags)
+}
+
+// Parse splits data into its header and the sealed body that follows it;
+// ok is false for a chunk without a header
+func Parse(data []byte) (h Header, body []byte, ok bool) {
+	if len(data) < HeaderSize || !bytes.HasPrefix(data, Magic) {
+		return Header{}, data, false
+	}
+	return Header{Version: data[len(Magic)], Flags: data[len(Magic)+1]}, data[HeaderSize:], true
+}
+
+// Version returns the format version of a chunk's data, Legacy if it has no header
+func Version(data []byte) int {
+	h, _, ok := Parse(data)
+	if !ok {
+		return Legacy
+	}
+	return int(h.Version)
+}
+
+// Overhead returns how many bytes the header of a chunk of the given version
+// takes, 0 for Legacy
+func Overhead(version int) int {
+	if version == Legacy {
+		return 0
+	}
+	return HeaderSize
+}
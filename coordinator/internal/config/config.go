@@ -3,8 +3,6 @@ package config
 import (
 	"fmt"
 	"os"
-
-	"github.com/pelletier/go-toml/v2"
 )
 
 // Config holds all configuration for the coordinator
@@ -13,6 +11,10 @@ type Config struct {
 	Database DatabaseConfig `toml:"database"`
 	P2P      P2PConfig      `toml:"p2p"`
 	Storage  StorageConfig  `toml:"storage"`
+	Nodes    NodesConfig    `toml:"nodes"`
+	Pricing  PricingConfig  `toml:"pricing"`
+	Auth     AuthConfig     `toml:"auth"`
+	Webhooks WebhooksConfig `toml:"webhooks"`
 }
 
 // ServerConfig holds HTTP server configuration
@@ -21,6 +23,32 @@ type ServerConfig struct {
 	Port         int    `toml:"port"`
 	ReadTimeout  int    `toml:"read_timeout"`
 	WriteTimeout int    `toml:"write_timeout"`
+	LogLevel     string `toml:"log_level"`       // debug, info, warn or error
+	LogFile      string `toml:"log_file"`        // stdout, stderr or a file path
+	LogMaxSizeMB int    `toml:"log_max_size_mb"` // rotate log_file past this size
+	// TrustedProxies lists reverse proxy IPs/CIDRs whose X-Forwarded-For and
+	// X-Real-IP headers are believed; empty trusts none
+	TrustedProxies []string `toml:"trusted_proxies"`
+	// RequestTimeoutSeconds bounds how long a request may take before it is
+	// cancelled and answered with 503; negative disables
+	RequestTimeoutSeconds int `toml:"request_timeout_seconds"`
+	// RequestTimeoutExempt lists long-lived routes the timeout skips, as
+	// "/path" or "METHOD /path" in gin's syntax (e.g. "/api/v1/files/:id/download")
+	RequestTimeoutExempt []string `toml:"request_timeout_exempt"`
+	// IDSecret, hex-encoded and at least 32 bytes, makes the API expose file
+	// and upload session IDs only as opaque external IDs derived from it;
+	// empty exposes the UUIDs. Best set through COORD_SERVER_ID_SECRET.
+	IDSecret string `toml:"id_secret"`
+	// LogRequests logs each request's headers and JSON bodies, and the
+	// response's, in place of the access log line. Values of sensitive keys
+	// (logging.DefaultSensitiveKeys and RedactKeys) are masked.
+	LogRequests bool `toml:"log_requests"`
+	// RedactKeys adds JSON keys, header names and query parameters to mask in request logs
+	RedactKeys []string `toml:"redact_keys"`
+	// ReadOnly starts the coordinator in read-only mode: uploads, deletes and
+	// credit changes get 503 while reads keep working. Admins can toggle it
+	// at runtime; the mode they set is saved and outlasts a restart.
+	ReadOnly bool `toml:"read_only"`
 }
 
 // DatabaseConfig holds PostgreSQL configuration
@@ -39,15 +67,164 @@ type P2PConfig struct {
 	BootstrapPeers  []string `toml:"bootstrap_peers"`
 	EnableQUIC      bool     `toml:"enable_quic"`
 	EnableTCP       bool     `toml:"enable_tcp"`
+	// StartRetrySeconds is how often a failed P2P start is retried while the API runs degraded; negative disables
+	StartRetrySeconds int `toml:"start_retry_seconds"`
+	// IdentityFile holds the private key behind the coordinator's peer ID, created on first start
+	IdentityFile string `toml:"identity_file"`
 }
 
 // StorageConfig holds storage settings
 type StorageConfig struct {
-	ChunkSizeBytes          int64 `toml:"chunk_size_bytes"`
-	DefaultReplicas         int   `toml:"default_replicas"`
-	ProofDifficulty         int   `toml:"proof_difficulty"`
-	ProofIntervalHours      int   `toml:"proof_interval_hours"`
-	StorageCreditPerGBMonth int64 `toml:"storage_credit_per_gb_month"`
+	ChunkSizeBytes          int64   `toml:"chunk_size_bytes"`     // used by uploads that ask for no chunk size
+	MinChunkSizeBytes       int64   `toml:"min_chunk_size_bytes"` // smallest chunk size an upload may ask for
+	MaxChunkSizeBytes       int64   `toml:"max_chunk_size_bytes"` // largest chunk size an upload may ask for
+	DefaultReplicas         int     `toml:"default_replicas"`
+	ProofDifficulty         int     `toml:"proof_difficulty"`
+	ProofIntervalHours      int     `toml:"proof_interval_hours"`
+	ProofTimeoutBaseMs      int     `toml:"proof_timeout_base_ms"`
+	ProofTimeoutMsPerRound  float64 `toml:"proof_timeout_ms_per_round"`
+	StorageCreditPerGBMonth int64   `toml:"storage_credit_per_gb_month"`
+	VerifyCooldownSeconds   int     `toml:"verify_cooldown_seconds"`
+	MaxChunksPerFile        int     `toml:"max_chunks_per_file"`
+	ChunkCacheMB            int     `toml:"chunk_cache_mb"`       // in-memory download cache; negative disables
+	ExpirySweepSeconds      int     `toml:"expiry_sweep_seconds"` // expired file and upload session sweep interval; negative disables
+	// ChunkSizeTiers picks the chunk size of uploads that ask for none by
+	// file size; files below every tier use ChunkSizeBytes
+	ChunkSizeTiers []ChunkSizeTierConfig `toml:"chunk_size_tiers"`
+	// MinDistinctOperators is how many different operators each chunk's
+	// replicas must span; uploads fail rather than place them on fewer
+	MinDistinctOperators int `toml:"min_distinct_operators"`
+	// MinReplicas is the fewest replicas a chunk may be stored with when too
+	// few nodes are available for DefaultReplicas; uploads are charged for
+	// the replicas achieved. Defaults to DefaultReplicas.
+	MinReplicas int `toml:"min_replicas"`
+	// Placement picks the nodes for a chunk's replicas: "reputation" takes the
+	// most reputable nodes, "consistent-hash" maps each chunk to the same
+	// nodes whenever it is placed
+	Placement string `toml:"placement"`
+	// PlacementVirtualNodes is how many hash ring points each node gets under consistent-hash placement
+	PlacementVirtualNodes int `toml:"placement_virtual_nodes"`
+	// MaxActiveUploadsPerUser caps a user's concurrent upload sessions and streamed uploads; negative disables
+	MaxActiveUploadsPerUser int `toml:"max_active_uploads_per_user"`
+	// MaxPendingChallengesPerNode stops issuing challenges to a node with this many outstanding; negative disables
+	MaxPendingChallengesPerNode int `toml:"max_pending_challenges_per_node"`
+	// PendingChallengeMaxAgeMinutes fails challenges left pending this long; negative disables
+	PendingChallengeMaxAgeMinutes int `toml:"pending_challenge_max_age_minutes"`
+	// ProofVerifySeconds is how often pending challenges are sent to their
+	// nodes and the answers verified as a batch; negative disables
+	ProofVerifySeconds int `toml:"proof_verify_seconds"`
+	// ProofBatchSize caps the challenges one verification pass handles
+	ProofBatchSize int `toml:"proof_batch_size"`
+	// ProofRetryWindowHours is how far back a node may ask to retry failed proofs
+	ProofRetryWindowHours int `toml:"proof_retry_window_hours"`
+	// MaxProofRetries caps the failed proofs a node may retry per window; negative disables retries
+	MaxProofRetries int `toml:"max_proof_retries"`
+	// Cipher encrypts new uploads: aes-256-gcm, aes-128-gcm or chacha20-poly1305. Stored files keep theirs.
+	Cipher string `toml:"cipher"`
+	// KeyProvider keys new files: "random" generates a key and stores it with
+	// the file; "derived" derives it from MasterKey and the file ID, storing none
+	KeyProvider string `toml:"key_provider"`
+	// MasterKey is the hex-encoded secret of at least 32 bytes derived keys are
+	// made from; best set through COORD_STORAGE_MASTER_KEY. Keep it after
+	// switching back to "random": files keyed by derivation need it to be read.
+	MasterKey string `toml:"master_key"`
+	// DefaultMimeType is the Content-Type served for files uploaded without one
+	DefaultMimeType string `toml:"default_mime_type"`
+	// DirectUploads lets upload sessions send chunks straight to the storage
+	// nodes under an authorization signed with the coordinator's P2P key,
+	// so chunk data never passes through the coordinator
+	DirectUploads bool `toml:"direct_uploads"`
+}
+
+// NodesConfig holds storage node admission settings
+type NodesConfig struct {
+	MinNodeVersion string `toml:"min_node_version"`
+	// SignedRoutes lists node endpoints (e.g. "balance", "heartbeat") that
+	// require a request signature in addition to the API key
+	SignedRoutes            []string `toml:"signed_routes"`
+	SignatureMaxSkewSeconds int      `toml:"signature_max_skew_seconds"`
+	// ReputationSnapshotMinutes is how often node behavior is snapshotted into reputation history; negative disables
+	ReputationSnapshotMinutes int `toml:"reputation_snapshot_minutes"`
+	// AllowOpenRegistration lets any node register; when false, registration
+	// needs an admin-issued invite token. Unset means true.
+	AllowOpenRegistration *bool `toml:"allow_open_registration"`
+	// MaintenanceLeadMinutes is how long before a scheduled maintenance window
+	// a node stops receiving chunks and is drained; negative means at the start
+	MaintenanceLeadMinutes int `toml:"maintenance_lead_minutes"`
+	// MaintenanceDrainSeconds is how often chunks of draining nodes are re-replicated; negative disables
+	MaintenanceDrainSeconds int `toml:"maintenance_drain_seconds"`
+	// LeaderboardShowNames lists nodes by name and ID on the public
+	// leaderboard; otherwise they appear under a pseudonym
+	LeaderboardShowNames bool `toml:"leaderboard_show_names"`
+	// LeaderboardSecret, hex-encoded and at least 32 bytes, keys leaderboard
+	// pseudonyms; empty uses a random key, so pseudonyms change on every
+	// restart. Best set through COORD_NODES_LEADERBOARD_SECRET.
+	LeaderboardSecret string `toml:"leaderboard_secret"`
+	// UnverifiedCapacityGB caps how much of a node's claimed capacity is
+	// relied on until it passes a capacity proof; 0 trusts every claim
+	UnverifiedCapacityGB int `toml:"unverified_capacity_gb"`
+	// CapacityProofMB is how much data a capacity proof sends a node to store
+	// at random offsets across its claim
+	CapacityProofMB int `toml:"capacity_proof_mb"`
+	// OfflineAfterSeconds without a heartbeat make a node count as offline for
+	// node.offline webhooks, file locations and network stats; negative
+	// disables the check
+	OfflineAfterSeconds int `toml:"offline_after_seconds"`
+	// MissedProofGrace consecutive proofs a node misses (never answers, or
+	// answers too late) are forgiven as they are recorded rather than counted
+	// against its reputation, earnings and proof statistics; a verified
+	// proof starts the count over. Negative counts every miss.
+	MissedProofGrace int `toml:"missed_proof_grace"`
+	// EarningsCreditPerGBMonth is paid to a node for each GB it stores, per
+	// month, credited daily; 0 pays what users are charged per replica
+	// (storage.storage_credit_per_gb_month), negative credits nothing
+	EarningsCreditPerGBMonth int64 `toml:"earnings_credit_per_gb_month"`
+	// MissedProofPenaltyCredits are withheld from a node's daily earnings for
+	// each missed proof past MissedProofGrace; negative withholds none
+	MissedProofPenaltyCredits int64 `toml:"missed_proof_penalty_credits"`
+}
+
+// AuthConfig holds user login settings
+type AuthConfig struct {
+	// MaxFailedLogins consecutive failed logins lock an account for
+	// LockoutMinutes; negative disables lockout
+	MaxFailedLogins int `toml:"max_failed_logins"`
+	LockoutMinutes  int `toml:"lockout_minutes"`
+}
+
+// WebhooksConfig holds webhook delivery settings
+type WebhooksConfig struct {
+	// DeliverySeconds is how often queued deliveries are sent; negative disables delivery
+	DeliverySeconds int `toml:"delivery_seconds"`
+	// MaxAttempts is how often a delivery is tried before it is given up
+	MaxAttempts int `toml:"max_attempts"`
+	// BackoffSeconds is the wait after a first failed attempt; it doubles after each further one, up to an hour
+	BackoffSeconds int `toml:"backoff_seconds"`
+	// MaxPerUser is how many webhooks each user may register; negative removes the cap
+	MaxPerUser int `toml:"max_per_user"`
+	// RetentionDays is how long delivered and given-up deliveries are kept; negative keeps them
+	RetentionDays int `toml:"retention_days"`
+	// AllowPrivateTargets lets deliveries go to loopback, private and
+	// link-local addresses, which are otherwise refused
+	AllowPrivateTargets bool `toml:"allow_private_targets"`
+}
+
+// PricingConfig holds credit purchase pricing
+type PricingConfig struct {
+	DefaultCreditsPerUSD int64               `toml:"default_credits_per_usd"`
+	Tiers                []PricingTierConfig `toml:"tiers"`
+}
+
+// ChunkSizeTierConfig chunks files of at least MinFileBytes into ChunkSizeBytes chunks
+type ChunkSizeTierConfig struct {
+	MinFileBytes   int64 `toml:"min_file_bytes"`
+	ChunkSizeBytes int64 `toml:"chunk_size_bytes"`
+}
+
+// PricingTierConfig applies a bulk-discount rate to purchases of at least MinUSD
+type PricingTierConfig struct {
+	MinUSD        int   `toml:"min_usd"`
+	CreditsPerUSD int64 `toml:"credits_per_usd"`
 }
 
 // Load loads configuration from TOML file
@@ -58,16 +235,40 @@ func Load(path string) (*Config, error) {
 	}
 
 	var config Config
-	if err := toml.Unmarshal(data, &config); err != nil {
-		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	if err := decodeStrict(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	// Environment variables override the file, e.g. COORD_DATABASE_PASSWORD
+	if err := config.applyEnv(); err != nil {
+		return nil, fmt.Errorf("invalid environment override: %w", err)
 	}
 
 	// Set defaults
 	config.SetDefaults()
 
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+
 	return &config, nil
 }
 
+// DefaultRequestTimeoutExempt are the routes that stream chunks or move them
+// between nodes, and so may run past any request timeout
+var DefaultRequestTimeoutExempt = []string{
+	"POST /api/v1/files",
+	"GET /api/v1/files/:id/download",
+	"GET /api/v1/files/:id/chunks/:index",
+	"POST /api/v1/files/:id/verify",
+	"POST /api/v1/files/:id/repair",
+	"POST /api/v1/files/upload/:id/chunk",
+	"POST /api/v1/files/upload/:id/complete",
+	"POST /api/v1/admin/rebalance",
+	"POST /api/v1/admin/nodes/:id/capacity-proof",
+	"POST /api/v1/admin/nodes/:id/file-proof",
+}
+
 // DefaultConfig returns a default configuration
 func DefaultConfig() *Config {
 	cfg := &Config{}
@@ -95,6 +296,21 @@ func (c *Config) SetDefaults() {
 	if c.Server.WriteTimeout == 0 {
 		c.Server.WriteTimeout = 30
 	}
+	if c.Server.RequestTimeoutSeconds == 0 {
+		c.Server.RequestTimeoutSeconds = 30
+	}
+	if c.Server.RequestTimeoutExempt == nil {
+		c.Server.RequestTimeoutExempt = DefaultRequestTimeoutExempt
+	}
+	if c.Server.LogLevel == "" {
+		c.Server.LogLevel = "info"
+	}
+	if c.Server.LogFile == "" {
+		c.Server.LogFile = "stderr"
+	}
+	if c.Server.LogMaxSizeMB == 0 {
+		c.Server.LogMaxSizeMB = 100
+	}
 	if c.Database.Host == "" {
 		c.Database.Host = "localhost"
 	}
@@ -114,9 +330,21 @@ func (c *Config) SetDefaults() {
 		c.P2P.EnableTCP = true
 		c.P2P.EnableQUIC = true
 	}
+	if c.P2P.StartRetrySeconds == 0 {
+		c.P2P.StartRetrySeconds = 30
+	}
+	if c.P2P.IdentityFile == "" {
+		c.P2P.IdentityFile = "./data/p2p_identity.key"
+	}
 	if c.Storage.ChunkSizeBytes == 0 {
 		c.Storage.ChunkSizeBytes = 256 * 1024 // 256KB
 	}
+	if c.Storage.MinChunkSizeBytes == 0 {
+		c.Storage.MinChunkSizeBytes = min(64*1024, c.Storage.ChunkSizeBytes)
+	}
+	if c.Storage.MaxChunkSizeBytes == 0 {
+		c.Storage.MaxChunkSizeBytes = max(16*1024*1024, c.Storage.ChunkSizeBytes)
+	}
 	if c.Storage.DefaultReplicas == 0 {
 		c.Storage.DefaultReplicas = 3
 	}
@@ -126,7 +354,122 @@ func (c *Config) SetDefaults() {
 	if c.Storage.ProofIntervalHours == 0 {
 		c.Storage.ProofIntervalHours = 4
 	}
+	if c.Storage.ProofTimeoutBaseMs == 0 {
+		c.Storage.ProofTimeoutBaseMs = 1000 // network round-trip allowance
+	}
+	if c.Storage.ProofTimeoutMsPerRound == 0 {
+		c.Storage.ProofTimeoutMsPerRound = 1.0 // 2s total at the default difficulty
+	}
+	if c.Storage.ChunkCacheMB == 0 {
+		c.Storage.ChunkCacheMB = 64
+	}
+	if c.Storage.Cipher == "" {
+		c.Storage.Cipher = "aes-256-gcm"
+	}
+	if c.Storage.KeyProvider == "" {
+		c.Storage.KeyProvider = "random"
+	}
+	if c.Storage.DefaultMimeType == "" {
+		c.Storage.DefaultMimeType = "application/octet-stream"
+	}
+	if c.Storage.ExpirySweepSeconds == 0 {
+		c.Storage.ExpirySweepSeconds = 300
+	}
+	if c.Storage.MinDistinctOperators == 0 {
+		c.Storage.MinDistinctOperators = 1
+	}
+	if c.Storage.MinReplicas == 0 {
+		c.Storage.MinReplicas = c.Storage.DefaultReplicas
+	}
+	if c.Storage.Placement == "" {
+		c.Storage.Placement = "reputation"
+	}
+	if c.Storage.PlacementVirtualNodes == 0 {
+		c.Storage.PlacementVirtualNodes = 100
+	}
+	if c.Storage.MaxActiveUploadsPerUser == 0 {
+		c.Storage.MaxActiveUploadsPerUser = 10
+	}
+	if c.Storage.MaxPendingChallengesPerNode == 0 {
+		c.Storage.MaxPendingChallengesPerNode = 100
+	}
+	if c.Storage.PendingChallengeMaxAgeMinutes == 0 {
+		c.Storage.PendingChallengeMaxAgeMinutes = 60
+	}
+	if c.Storage.ProofVerifySeconds == 0 {
+		c.Storage.ProofVerifySeconds = 60
+	}
+	if c.Storage.ProofBatchSize == 0 {
+		c.Storage.ProofBatchSize = 500
+	}
+	if c.Storage.ProofRetryWindowHours == 0 {
+		c.Storage.ProofRetryWindowHours = 24
+	}
+	if c.Storage.MaxProofRetries == 0 {
+		c.Storage.MaxProofRetries = 50
+	}
 	if c.Storage.StorageCreditPerGBMonth == 0 {
 		c.Storage.StorageCreditPerGBMonth = 100 // 100 credits per GB per month
 	}
+	if c.Storage.VerifyCooldownSeconds == 0 {
+		c.Storage.VerifyCooldownSeconds = 300 // one on-demand verification per file every 5 minutes
+	}
+	if c.Storage.MaxChunksPerFile == 0 {
+		c.Storage.MaxChunksPerFile = 100000 // ~25GB at the default chunk size
+	}
+	if c.Nodes.SignatureMaxSkewSeconds == 0 {
+		c.Nodes.SignatureMaxSkewSeconds = 300
+	}
+	if c.Nodes.ReputationSnapshotMinutes == 0 {
+		c.Nodes.ReputationSnapshotMinutes = 60
+	}
+	if c.Nodes.MaintenanceLeadMinutes == 0 {
+		c.Nodes.MaintenanceLeadMinutes = 60
+	}
+	if c.Nodes.MaintenanceDrainSeconds == 0 {
+		c.Nodes.MaintenanceDrainSeconds = 60
+	}
+	if c.Nodes.CapacityProofMB == 0 {
+		c.Nodes.CapacityProofMB = 256
+	}
+	if c.Nodes.OfflineAfterSeconds == 0 {
+		c.Nodes.OfflineAfterSeconds = 300
+	}
+	if c.Nodes.MissedProofGrace == 0 {
+		c.Nodes.MissedProofGrace = 2
+	}
+	if c.Nodes.EarningsCreditPerGBMonth == 0 {
+		c.Nodes.EarningsCreditPerGBMonth = c.Storage.StorageCreditPerGBMonth
+	}
+	if c.Nodes.MissedProofPenaltyCredits == 0 {
+		c.Nodes.MissedProofPenaltyCredits = 1
+	}
+	if c.Webhooks.DeliverySeconds == 0 {
+		c.Webhooks.DeliverySeconds = 10
+	}
+	if c.Webhooks.MaxAttempts == 0 {
+		c.Webhooks.MaxAttempts = 8
+	}
+	if c.Webhooks.BackoffSeconds == 0 {
+		c.Webhooks.BackoffSeconds = 30
+	}
+	if c.Webhooks.MaxPerUser == 0 {
+		c.Webhooks.MaxPerUser = 10
+	}
+	if c.Webhooks.RetentionDays == 0 {
+		c.Webhooks.RetentionDays = 30
+	}
+	if c.Auth.MaxFailedLogins == 0 {
+		c.Auth.MaxFailedLogins = 5
+	}
+	if c.Auth.LockoutMinutes == 0 {
+		c.Auth.LockoutMinutes = 15
+	}
+	if c.Nodes.AllowOpenRegistration == nil {
+		open := true
+		c.Nodes.AllowOpenRegistration = &open
+	}
+	if c.Pricing.DefaultCreditsPerUSD == 0 {
+		c.Pricing.DefaultCreditsPerUSD = 1000 // $1 = 1000 credits
+	}
 }
@@ -0,0 +1,136 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.toml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestLoad_ExampleConfig(t *testing.T) {
+	for _, path := range []string{"../../config.example.toml", "../../config.toml"} {
+		_, err := Load(path)
+		assert.NoError(t, err, path)
+	}
+}
+
+func TestLoad_RejectsUnknownKey(t *testing.T) {
+	path := writeConfig(t, `
+[server]
+port = 8080
+
+[storage]
+chunk_size_byte = 1048576
+`)
+
+	_, err := Load(path)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unknown config key")
+	assert.Contains(t, err.Error(), "storage.chunk_size_byte (line 6)")
+}
+
+func TestLoad_EnvOverridesFile(t *testing.T) {
+	path := writeConfig(t, `
+[server]
+port = 8080
+trusted_proxies = ["10.0.0.1"]
+
+[database]
+password = "from-file"
+user = "file-user"
+`)
+	t.Setenv("COORD_DATABASE_PASSWORD", "from-env")
+	t.Setenv("COORD_SERVER_PORT", "9090")
+	t.Setenv("COORD_SERVER_TRUSTED_PROXIES", "10.0.0.2, 10.0.0.0/8")
+	t.Setenv("COORD_NODES_ALLOW_OPEN_REGISTRATION", "false")
+	t.Setenv("COORD_DATABASE_USER", "")
+
+	cfg, err := Load(path)
+	require.NoError(t, err)
+	assert.Equal(t, "from-env", cfg.Database.Password)
+	assert.Equal(t, 9090, cfg.Server.Port)
+	assert.Equal(t, []string{"10.0.0.2", "10.0.0.0/8"}, cfg.Server.TrustedProxies)
+	assert.False(t, *cfg.Nodes.AllowOpenRegistration)
+	assert.Equal(t, "file-user", cfg.Database.User, "An empty variable leaves the file value")
+	assert.Equal(t, "localhost", cfg.Database.Host, "Defaults still fill what neither sets")
+
+	// Overrides are validated like file values
+	t.Setenv("COORD_SERVER_PORT", "70000")
+	_, err = Load(path)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "server.port: must be between 1 and 65535, got 70000")
+
+	t.Setenv("COORD_SERVER_PORT", "eighty")
+	_, err = Load(path)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `COORD_SERVER_PORT: "eighty" is not an integer`)
+}
+
+func TestLoad_RejectsInvalidValues(t *testing.T) {
+	path := writeConfig(t, `
+[server]
+port = 70000
+log_level = "verbose"
+
+[storage]
+default_replicas = 2
+min_distinct_operators = 3
+min_replicas = 4
+cipher = "des"
+placement = "random"
+default_mime_type = "not a type"
+master_key = "abcd"
+
+[[storage.chunk_size_tiers]]
+min_file_bytes = 1048576
+chunk_size_bytes = 1024
+
+[auth]
+lockout_minutes = -1
+
+[webhooks]
+max_attempts = -1
+
+[[pricing.tiers]]
+min_usd = 100
+credits_per_usd = -5
+`)
+
+	_, err := Load(path)
+	require.Error(t, err)
+	for _, want := range []string{
+		"server.port: must be between 1 and 65535, got 70000",
+		"server.log_level",
+		"storage.min_distinct_operators: 3 exceeds storage.default_replicas (2)",
+		"storage.min_replicas: 4 exceeds storage.default_replicas (2)",
+		`storage.cipher: must be aes-256-gcm, aes-128-gcm or chacha20-poly1305, got "des"`,
+		`storage.placement: must be reputation or consistent-hash, got "random"`,
+		`storage.default_mime_type: must be a MIME type such as application/octet-stream, got "not a type"`,
+		"storage.master_key: must be at least 32 hex-encoded bytes if set",
+		"storage.chunk_size_tiers[0].chunk_size_bytes: must be between storage.min_chunk_size_bytes (65536) and storage.max_chunk_size_bytes (16777216), got 1024",
+		"pricing.tiers[0].credits_per_usd: must be positive, got -5",
+		"auth.lockout_minutes: must be positive, got -1",
+		"webhooks.max_attempts: must be positive, got -1",
+	} {
+		assert.Contains(t, err.Error(), want)
+	}
+}
+
+func TestValidate_Defaults(t *testing.T) {
+	assert.NoError(t, DefaultConfig().Validate())
+
+	cfg := DefaultConfig()
+	cfg.Server.TrustedProxies = []string{"10.0.0.0/8", "192.168.1.1", "proxy.local"}
+	err := cfg.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `server.trusted_proxies: "proxy.local" is not an IP or CIDR`)
+}
@@ -0,0 +1,129 @@
+package config
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"strings"
+
+	"github.com/federated-storage/coordinator/internal/logging"
+	"github.com/pelletier/go-toml/v2"
+)
+
+// decodeStrict parses data into v, rejecting keys v has no field for so that
+// typos are reported instead of silently ignored
+func decodeStrict(data []byte, v interface{}) error {
+	dec := toml.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+
+	var strict *toml.StrictMissingError
+	if errors.As(err, &strict) {
+		keys := make([]string, len(strict.Errors))
+		for i, e := range strict.Errors {
+			row, _ := e.Position()
+			keys[i] = fmt.Sprintf("%s (line %d)", strings.Join(e.Key(), "."), row)
+		}
+		return fmt.Errorf("unknown config key: %s", strings.Join(keys, ", "))
+	}
+	return err
+}
+
+// Validate checks values that parse but make no sense, alone or together.
+// Every problem is reported, each prefixed with its config key.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, key, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: %s", key, fmt.Sprintf(format, args...)))
+		}
+	}
+
+	check(c.Server.Port > 0 && c.Server.Port <= 65535, "server.port", "must be between 1 and 65535, got %d", c.Server.Port)
+	if _, err := logging.ParseLevel(c.Server.LogLevel); err != nil {
+		check(false, "server.log_level", "%v", err)
+	}
+	for _, proxy := range c.Server.TrustedProxies {
+		_, _, cidrErr := net.ParseCIDR(proxy)
+		check(cidrErr == nil || net.ParseIP(proxy) != nil, "server.trusted_proxies", "%q is not an IP or CIDR", proxy)
+	}
+	if c.Server.IDSecret != "" {
+		idSecret, err := hex.DecodeString(c.Server.IDSecret)
+		check(err == nil && len(idSecret) >= 32, "server.id_secret", "must be at least 32 hex-encoded bytes, or empty to expose UUIDs")
+	}
+	if c.Nodes.LeaderboardSecret != "" {
+		secret, err := hex.DecodeString(c.Nodes.LeaderboardSecret)
+		check(err == nil && len(secret) >= 32, "nodes.leaderboard_secret", "must be at least 32 hex-encoded bytes, or empty for a random key")
+	}
+	check(c.Database.Port > 0 && c.Database.Port <= 65535, "database.port", "must be between 1 and 65535, got %d", c.Database.Port)
+
+	check(c.Storage.ChunkSizeBytes > 0, "storage.chunk_size_bytes", "must be positive, got %d", c.Storage.ChunkSizeBytes)
+	check(c.Storage.MinChunkSizeBytes > 0 && c.Storage.MinChunkSizeBytes <= c.Storage.ChunkSizeBytes, "storage.min_chunk_size_bytes",
+		"must be between 1 and storage.chunk_size_bytes (%d), got %d", c.Storage.ChunkSizeBytes, c.Storage.MinChunkSizeBytes)
+	check(c.Storage.MaxChunkSizeBytes >= c.Storage.ChunkSizeBytes, "storage.max_chunk_size_bytes",
+		"must be at least storage.chunk_size_bytes (%d), got %d", c.Storage.ChunkSizeBytes, c.Storage.MaxChunkSizeBytes)
+	check(c.Storage.DefaultReplicas > 0, "storage.default_replicas", "must be positive, got %d", c.Storage.DefaultReplicas)
+	check(c.Storage.ProofDifficulty > 0, "storage.proof_difficulty", "must be positive, got %d", c.Storage.ProofDifficulty)
+	check(c.Auth.LockoutMinutes > 0, "auth.lockout_minutes", "must be positive, got %d", c.Auth.LockoutMinutes)
+	check(c.Storage.ProofRetryWindowHours > 0, "storage.proof_retry_window_hours", "must be positive, got %d", c.Storage.ProofRetryWindowHours)
+	check(c.Storage.ProofBatchSize > 0, "storage.proof_batch_size", "must be positive, got %d", c.Storage.ProofBatchSize)
+	check(c.Storage.MaxChunksPerFile > 0, "storage.max_chunks_per_file", "must be positive, got %d", c.Storage.MaxChunksPerFile)
+	switch c.Storage.Cipher {
+	case "aes-256-gcm", "aes-128-gcm", "chacha20-poly1305":
+	default:
+		check(false, "storage.cipher", "must be aes-256-gcm, aes-128-gcm or chacha20-poly1305, got %q", c.Storage.Cipher)
+	}
+	switch c.Storage.KeyProvider {
+	case "random":
+		// A master key kept after leaving derived keys reads the files keyed with it
+		if c.Storage.MasterKey != "" {
+			masterKey, err := hex.DecodeString(c.Storage.MasterKey)
+			check(err == nil && len(masterKey) >= 32, "storage.master_key",
+				"must be at least 32 hex-encoded bytes if set")
+		}
+	case "derived":
+		masterKey, err := hex.DecodeString(c.Storage.MasterKey)
+		check(err == nil && len(masterKey) >= 32, "storage.master_key",
+			"must be at least 32 hex-encoded bytes when storage.key_provider is derived")
+	default:
+		check(false, "storage.key_provider", "must be random or derived, got %q", c.Storage.KeyProvider)
+	}
+	switch c.Storage.Placement {
+	case "reputation", "consistent-hash":
+	default:
+		check(false, "storage.placement", "must be reputation or consistent-hash, got %q", c.Storage.Placement)
+	}
+	check(c.Storage.PlacementVirtualNodes > 0, "storage.placement_virtual_nodes", "must be positive, got %d", c.Storage.PlacementVirtualNodes)
+	_, _, mimeErr := mime.ParseMediaType(c.Storage.DefaultMimeType)
+	check(mimeErr == nil, "storage.default_mime_type", "must be a MIME type such as application/octet-stream, got %q", c.Storage.DefaultMimeType)
+	check(c.Storage.MinDistinctOperators <= c.Storage.DefaultReplicas, "storage.min_distinct_operators",
+		"%d exceeds storage.default_replicas (%d)", c.Storage.MinDistinctOperators, c.Storage.DefaultReplicas)
+	check(c.Storage.MinReplicas > 0, "storage.min_replicas", "must be positive, got %d", c.Storage.MinReplicas)
+	check(c.Storage.MinReplicas <= c.Storage.DefaultReplicas, "storage.min_replicas",
+		"%d exceeds storage.default_replicas (%d)", c.Storage.MinReplicas, c.Storage.DefaultReplicas)
+
+	check(c.Nodes.UnverifiedCapacityGB >= 0, "nodes.unverified_capacity_gb", "must not be negative, got %d", c.Nodes.UnverifiedCapacityGB)
+	check(c.Nodes.CapacityProofMB > 0, "nodes.capacity_proof_mb", "must be positive, got %d", c.Nodes.CapacityProofMB)
+
+	check(c.Webhooks.MaxAttempts > 0, "webhooks.max_attempts", "must be positive, got %d", c.Webhooks.MaxAttempts)
+	check(c.Webhooks.BackoffSeconds > 0, "webhooks.backoff_seconds", "must be positive, got %d", c.Webhooks.BackoffSeconds)
+
+	for i, tier := range c.Storage.ChunkSizeTiers {
+		key := fmt.Sprintf("storage.chunk_size_tiers[%d]", i)
+		check(tier.MinFileBytes >= 0, key+".min_file_bytes", "must not be negative, got %d", tier.MinFileBytes)
+		check(tier.ChunkSizeBytes >= c.Storage.MinChunkSizeBytes && tier.ChunkSizeBytes <= c.Storage.MaxChunkSizeBytes, key+".chunk_size_bytes",
+			"must be between storage.min_chunk_size_bytes (%d) and storage.max_chunk_size_bytes (%d), got %d",
+			c.Storage.MinChunkSizeBytes, c.Storage.MaxChunkSizeBytes, tier.ChunkSizeBytes)
+	}
+
+	for i, tier := range c.Pricing.Tiers {
+		key := fmt.Sprintf("pricing.tiers[%d]", i)
+		check(tier.MinUSD > 0, key+".min_usd", "must be positive, got %d", tier.MinUSD)
+		check(tier.CreditsPerUSD > 0, key+".credits_per_usd", "must be positive, got %d", tier.CreditsPerUSD)
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,241 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/federated-storage/coordinator/internal/models"
+	"github.com/federated-storage/coordinator/internal/services"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Rebalance defaults when the request leaves them unset
+const (
+	defaultRebalanceFraction = 0.1
+	defaultRebalanceMaxMoves = 100
+)
+
+// defaultFileProofChunks is how many chunks a file challenge samples when the request leaves it unset
+const defaultFileProofChunks = 16
+
+// AdminHandler handles operator maintenance requests
+type AdminHandler struct {
+	nodeService  *services.NodeService
+	chunkService *services.ChunkService
+	proofService *services.ProofService
+	transfer     services.ChunkTransfer
+	fileProver   services.FileProver
+}
+
+// NewAdminHandler creates a new admin handler
+func NewAdminHandler(nodeService *services.NodeService, chunkService *services.ChunkService, proofService *services.ProofService,
+	transfer services.ChunkTransfer, fileProver services.FileProver) *AdminHandler {
+	return &AdminHandler{nodeService: nodeService, chunkService: chunkService, proofService: proofService, transfer: transfer, fileProver: fileProver}
+}
+
+// FileProofRequest names the file a node is challenged on
+type FileProofRequest struct {
+	FileID string `json:"file_id" binding:"required"`
+	Chunks int    `json:"chunks" binding:"omitempty,min=1,max=1000"`
+}
+
+// ProveFile challenges a node to prove, with one aggregate proof, that it
+// holds a sample of the chunks of a file, and reports whether it passed. The
+// verdict counts towards the node's reputation.
+func (h *AdminHandler) ProveFile(c *gin.Context) {
+	nodeID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid node id"})
+		return
+	}
+	var req FileProofRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	fileID, err := uuid.Parse(req.FileID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid file id"})
+		return
+	}
+	if req.Chunks == 0 {
+		req.Chunks = defaultFileProofChunks
+	}
+
+	result, err := h.proofService.ProveFile(c.Request.Context(), h.fileProver, fileID, nodeID, req.Chunks)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrUnknownNode):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, services.ErrNoChallengeableChunks):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// RebalanceRequest bounds a rebalance pass
+type RebalanceRequest struct {
+	Fraction float64 `json:"fraction" binding:"omitempty,gt=0,lte=1"`
+	MaxMoves int     `json:"max_moves" binding:"omitempty,min=1,max=10000"`
+}
+
+// Rebalance moves chunks from over-full nodes to under-used ones. Each call
+// performs at most max_moves moves; aborting the request stops the pass.
+func (h *AdminHandler) Rebalance(c *gin.Context) {
+	var req RebalanceRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			respondBindError(c, err)
+			return
+		}
+	}
+	if req.Fraction == 0 {
+		req.Fraction = defaultRebalanceFraction
+	}
+	if req.MaxMoves == 0 {
+		req.MaxMoves = defaultRebalanceMaxMoves
+	}
+
+	report, err := h.chunkService.Rebalance(c.Request.Context(), h.transfer, req.Fraction, req.MaxMoves)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+// DedupReport reports how much space files with identical content take, to
+// judge whether content-addressed deduplication is worth enabling
+func (h *AdminHandler) DedupReport(c *gin.Context) {
+	report, err := h.chunkService.DedupReport(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to build dedup report"})
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+// ProofBacklog reports how many proof challenges are pending, in total and per node
+func (h *AdminHandler) ProofBacklog(c *gin.Context) {
+	counts, err := h.proofService.PendingChallengeCounts(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to count pending challenges"})
+		return
+	}
+
+	total := 0
+	byNode := make(map[string]int, len(counts))
+	for nodeID, n := range counts {
+		byNode[nodeID.String()] = n
+		total += n
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"pending_total":        total,
+		"pending_by_node":      byNode,
+		"max_pending_per_node": h.proofService.MaxPendingPerNode(),
+	})
+}
+
+// RecomputeNodeStats recalculates a node's earned credits, used storage and
+// uptime from the data behind them, fixing values that drifted, and returns
+// them before and after
+func (h *AdminHandler) RecomputeNodeStats(c *gin.Context) {
+	nodeID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid node id"})
+		return
+	}
+
+	result, err := h.nodeService.RecomputeNodeStats(c.Request.Context(), nodeID)
+	if err != nil {
+		if errors.Is(err, services.ErrUnknownNode) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// RecomputeAllNodeStats recomputes every node's derived statistics and
+// returns the before and after of those that were corrected
+func (h *AdminHandler) RecomputeAllNodeStats(c *gin.Context) {
+	checked, corrected, err := h.nodeService.RecomputeAllNodeStats(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":     err.Error(),
+			"checked":   checked,
+			"corrected": corrected,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"checked":   checked,
+		"corrected": corrected,
+	})
+}
+
+// ExcludeNodeRequest names a node to keep out of new placements
+type ExcludeNodeRequest struct {
+	PeerID string `json:"peer_id" binding:"required,max=255"`
+	Reason string `json:"reason" binding:"max=500"`
+}
+
+// ExcludeNode keeps a node out of new chunk placements without changing its
+// status; it keeps serving the chunks it already holds
+func (h *AdminHandler) ExcludeNode(c *gin.Context) {
+	var req ExcludeNodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	exclusion, err := h.chunkService.ExcludeNode(c.Request.Context(), req.PeerID, req.Reason)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, exclusion)
+}
+
+// ListExcludedNodes lists the nodes kept out of placement
+func (h *AdminHandler) ListExcludedNodes(c *gin.Context) {
+	exclusions, err := h.chunkService.ListExcludedNodes(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if exclusions == nil {
+		exclusions = []models.NodeExclusion{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"exclusions": exclusions})
+}
+
+// IncludeNode lets an excluded node receive new chunks again
+func (h *AdminHandler) IncludeNode(c *gin.Context) {
+	err := h.chunkService.IncludeNode(c.Request.Context(), c.Param("peer_id"))
+	if err != nil {
+		if errors.Is(err, services.ErrExclusionNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "included"})
+}
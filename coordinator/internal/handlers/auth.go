@@ -1,6 +1,9 @@
 package handlers
 
 import (
+	"errors"
+	"fmt"
+	"math"
 	"net/http"
 	"time"
 
@@ -31,7 +34,7 @@ func NewAuthHandler(authService *services.AuthService, jwtSecret string) *AuthHa
 func (h *AuthHandler) Register(c *gin.Context) {
 	var req services.RegisterRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondBindError(c, err)
 		return
 	}
 
@@ -59,11 +62,24 @@ func (h *AuthHandler) Register(c *gin.Context) {
 func (h *AuthHandler) Login(c *gin.Context) {
 	var req services.LoginRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondBindError(c, err)
 		return
 	}
 
 	user, err := h.authService.Login(c.Request.Context(), req)
+	var locked *services.AccountLockedError
+	if errors.As(err, &locked) {
+		retryAfter := int(math.Ceil(time.Until(locked.Until).Seconds()))
+		if retryAfter < 1 {
+			retryAfter = 1
+		}
+		c.Header("Retry-After", fmt.Sprintf("%d", retryAfter))
+		c.JSON(http.StatusLocked, gin.H{
+			"error":       err.Error(),
+			"retry_after": retryAfter,
+		})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
 		return
@@ -101,16 +117,40 @@ func (h *AuthHandler) Profile(c *gin.Context) {
 	c.JSON(http.StatusOK, user)
 }
 
+// DeleteAccount deletes the caller's account, which must own no files
+func (h *AuthHandler) DeleteAccount(c *gin.Context) {
+	userID, err := uuid.Parse(middleware.GetUserID(c))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+
+	err = h.authService.DeleteAccount(c.Request.Context(), userID)
+	switch {
+	case errors.Is(err, services.ErrAccountHasFiles):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, services.ErrUserNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+}
+
 // PurchaseCreditsRequest represents a credit purchase request
 type PurchaseCreditsRequest struct {
 	AmountUSD int `json:"amount_usd" binding:"required,min=1"`
 }
 
-// PurchaseCredits handles credit purchase (mock for MVP)
+// PurchaseCredits handles credit purchase (mock payment for MVP)
 func (h *AuthHandler) PurchaseCredits(c *gin.Context) {
 	var req PurchaseCreditsRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondBindError(c, err)
 		return
 	}
 
@@ -121,17 +161,15 @@ func (h *AuthHandler) PurchaseCredits(c *gin.Context) {
 		return
 	}
 
-	// Mock conversion: $1 = 1000 credits
-	credits := int64(req.AmountUSD * 1000)
-
-	err = h.authService.UpdateCredits(c.Request.Context(), userID, credits, "Credit purchase")
+	credits, rate, err := h.authService.PurchaseCredits(c.Request.Context(), userID, req.AmountUSD)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"amount_usd":    req.AmountUSD,
-		"credits_added": credits,
+		"amount_usd":      req.AmountUSD,
+		"credits_added":   credits,
+		"credits_per_usd": rate,
 	})
 }
@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/federated-storage/coordinator/internal/models"
+	"github.com/federated-storage/coordinator/internal/services"
+	"github.com/federated-storage/coordinator/internal/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogin_LockedAccountGets423(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	authService := services.NewAuthService(storage.NewMemoryStore(), services.NewPricing(1000, nil))
+	authService.SetLoginLockout(2, 10*time.Minute)
+	_, err := authService.Register(context.Background(), services.RegisterRequest{Email: "user@example.com", Password: "correct-horse"})
+	require.NoError(t, err)
+
+	router := gin.New()
+	router.POST("/login", NewAuthHandler(authService, "secret").Login)
+	login := func(password string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		body := `{"email": "user@example.com", "password": "` + password + `"}`
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(body)))
+		return w
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, login("wrong-password").Code)
+
+	w := login("wrong-password")
+	require.Equal(t, http.StatusLocked, w.Code)
+	assert.Contains(t, w.Body.String(), "account temporarily locked")
+	retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After"))
+	require.NoError(t, err)
+	assert.InDelta(t, 600, retryAfter, 5)
+
+	assert.Equal(t, http.StatusLocked, login("correct-horse").Code, "The right password does not bypass the lockout")
+}
+
+func TestDeleteAccount_RefusedWhileFilesRemain(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	store := storage.NewMemoryStore()
+	authService := services.NewAuthService(store, services.NewPricing(1000, nil))
+	user, err := authService.Register(context.Background(), services.RegisterRequest{Email: "user@example.com", Password: "correct-horse"})
+	require.NoError(t, err)
+	file := &models.File{ID: uuid.New(), UserID: user.ID, Filename: "a.txt", Status: "ready", Version: 1}
+	require.NoError(t, store.CreateFile(context.Background(), file))
+
+	router := gin.New()
+	router.DELETE("/account", func(c *gin.Context) {
+		c.Set("user_id", user.ID.String())
+	}, NewAuthHandler(authService, "secret").DeleteAccount)
+	deleteAccount := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/account", nil))
+		return w
+	}
+
+	w := deleteAccount()
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), "still owns files")
+
+	require.NoError(t, store.DeleteFile(context.Background(), file.ID))
+	assert.Equal(t, http.StatusOK, deleteAccount().Code)
+	assert.Equal(t, http.StatusNotFound, deleteAccount().Code)
+}
@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/federated-storage/coordinator/internal/services"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// CapacityHandler lets operators check that nodes can store what they claim
+type CapacityHandler struct {
+	nodeService *services.NodeService
+	prover      services.CapacityProver
+	regionBytes int64 // most data a capacity challenge sends
+}
+
+// NewCapacityHandler creates a new capacity handler
+func NewCapacityHandler(nodeService *services.NodeService, prover services.CapacityProver, regionBytes int64) *CapacityHandler {
+	return &CapacityHandler{nodeService: nodeService, prover: prover, regionBytes: regionBytes}
+}
+
+// ProveCapacity has a node store blocks at random offsets across its claimed
+// capacity and hash a sample of them, and reports whether it passed. Passing lifts the cap on
+// the capacity trusted for the node; failing reinstates it.
+func (h *CapacityHandler) ProveCapacity(c *gin.Context) {
+	nodeID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid node id"})
+		return
+	}
+
+	result, err := h.nodeService.ProveCapacity(c.Request.Context(), h.prover, nodeID, h.regionBytes)
+	if err != nil {
+		if errors.Is(err, services.ErrUnknownNode) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/federated-storage/coordinator/internal/services"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// migrateChunkSlack is allowed beyond the chunk size for encryption overhead
+const migrateChunkSlack = 64 << 10
+
+// DecommissionHandler handles a node permanently leaving the network: it
+// hands its chunks to the coordinator for re-replication, then deregisters
+type DecommissionHandler struct {
+	nodeService   *services.NodeService
+	chunkService  *services.ChunkService
+	transfer      services.ChunkTransfer
+	replicas      int   // replicas each migrated chunk needs on other nodes
+	maxChunkBytes int64 // upper bound on a migrated chunk's body
+}
+
+// NewDecommissionHandler creates a new decommission handler. Handed-off
+// chunks may be up to maxChunkSizeBytes, the largest chunk an upload can use.
+func NewDecommissionHandler(nodeService *services.NodeService, chunkService *services.ChunkService, transfer services.ChunkTransfer, replicas int, maxChunkSizeBytes int64) *DecommissionHandler {
+	return &DecommissionHandler{
+		nodeService:   nodeService,
+		chunkService:  chunkService,
+		transfer:      transfer,
+		replicas:      replicas,
+		maxChunkBytes: maxChunkSizeBytes + migrateChunkSlack,
+	}
+}
+
+// Start marks the calling node as decommissioning. It stops receiving new
+// chunks, challenges and reads at once; repeating the call is harmless.
+func (h *DecommissionHandler) Start(c *gin.Context) {
+	peerID := c.GetHeader("X-Peer-ID")
+	if peerID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing peer id"})
+		return
+	}
+
+	node, err := h.nodeService.GetNodeByPeerID(c.Request.Context(), peerID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "node not found"})
+		return
+	}
+
+	if err := h.nodeService.StartDecommission(c.Request.Context(), node.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	chunks, err := h.chunkService.ListNodeChunks(c.Request.Context(), node.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "decommissioning",
+		"chunks": len(chunks),
+	})
+}
+
+// MigrateChunk takes one chunk's data, sent as the raw request body, from a
+// decommissioning node. A 200 response confirms the chunk is re-replicated
+// elsewhere and the node's copy is no longer needed.
+func (h *DecommissionHandler) MigrateChunk(c *gin.Context) {
+	peerID := c.GetHeader("X-Peer-ID")
+	if peerID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing peer id"})
+		return
+	}
+	chunkID, err := uuid.Parse(c.Param("chunk_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid chunk id"})
+		return
+	}
+
+	node, err := h.nodeService.GetNodeByPeerID(c.Request.Context(), peerID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "node not found"})
+		return
+	}
+	if node.Status != "decommissioning" {
+		c.JSON(http.StatusConflict, gin.H{"error": services.ErrNotDecommissioning.Error()})
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, h.maxChunkBytes))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "chunk too large"})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "failed to read chunk data"})
+		return
+	}
+
+	result, err := h.chunkService.MigrateChunk(c.Request.Context(), h.transfer, node.ID, chunkID, data, h.replicas)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrUnknownChunk):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, services.ErrChunkDataMismatch):
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		case errors.Is(err, services.ErrReplicationIncomplete):
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// Deregister retires a decommissioning node once none of its chunks remain
+// assigned to it. Its API key stops working afterwards.
+func (h *DecommissionHandler) Deregister(c *gin.Context) {
+	peerID := c.GetHeader("X-Peer-ID")
+	if peerID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing peer id"})
+		return
+	}
+
+	node, err := h.nodeService.GetNodeByPeerID(c.Request.Context(), peerID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "node not found"})
+		return
+	}
+
+	chunks, err := h.chunkService.ListNodeChunks(c.Request.Context(), node.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if len(chunks) > 0 {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":            "node still holds chunks",
+			"remaining_chunks": len(chunks),
+		})
+		return
+	}
+
+	if err := h.nodeService.Deregister(c.Request.Context(), node.ID); err != nil {
+		if errors.Is(err, services.ErrNotDecommissioning) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "deregistered"})
+}
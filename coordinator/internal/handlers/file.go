@@ -1,24 +1,39 @@
 package handlers
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
+	"github.com/federated-storage/coordinator/internal/logging"
 	"github.com/federated-storage/coordinator/internal/middleware"
+	"github.com/federated-storage/coordinator/internal/models"
 	"github.com/federated-storage/coordinator/internal/services"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 )
 
+// chunkRetryAfterSeconds is how long a download waiting on offline nodes is told to wait
+const chunkRetryAfterSeconds = 60
+
 // FileHandler handles file-related requests
 type FileHandler struct {
 	fileService  *services.FileService
 	chunkService *services.ChunkService
+	proofService *services.ProofService
 }
 
 // NewFileHandler creates a new file handler
-func NewFileHandler(fileService *services.FileService, chunkService *services.ChunkService) *FileHandler {
-	return &FileHandler{fileService: fileService, chunkService: chunkService}
+func NewFileHandler(fileService *services.FileService, chunkService *services.ChunkService, proofService *services.ProofService) *FileHandler {
+	return &FileHandler{fileService: fileService, chunkService: chunkService, proofService: proofService}
 }
 
 // ListFiles handles listing user files
@@ -30,7 +45,13 @@ func (h *FileHandler) ListFiles(c *gin.Context) {
 		return
 	}
 
-	files, err := h.fileService.GetUserFiles(c.Request.Context(), userID)
+	// ?tags=a,b or ?tags=a&tags=b lists only files carrying every tag
+	var tags []string
+	for _, v := range c.QueryArray("tags") {
+		tags = append(tags, strings.Split(v, ",")...)
+	}
+
+	files, err := h.fileService.GetUserFiles(c.Request.Context(), userID, tags)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -39,8 +60,8 @@ func (h *FileHandler) ListFiles(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"files": files})
 }
 
-// DownloadFile handles file download
-func (h *FileHandler) DownloadFile(c *gin.Context) {
+// GetFile handles retrieving a file's details, including its tags
+func (h *FileHandler) GetFile(c *gin.Context) {
 	fileIDStr := c.Param("id")
 	fileID, err := uuid.Parse(fileIDStr)
 	if err != nil {
@@ -66,37 +87,406 @@ func (h *FileHandler) DownloadFile(c *gin.Context) {
 		return
 	}
 
-	if file.Status != "ready" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "file not ready"})
+	c.Header("ETag", services.FileETag(file))
+	c.JSON(http.StatusOK, file)
+}
+
+// DownloadFile handles file download
+func (h *FileHandler) DownloadFile(c *gin.Context) {
+	file, ok := h.downloadableFile(c)
+	if !ok {
 		return
 	}
 
-	chunks, err := h.chunkService.GetChunksByFileWithData(c.Request.Context(), fileID)
+	// ?from_chunk=N resumes an interrupted download at chunk N's first byte;
+	// 0 is the whole file, even one without chunks
+	fromChunk := 0
+	if v := c.Query("from_chunk"); v != "" {
+		var err error
+		fromChunk, err = strconv.Atoi(v)
+		if err != nil || fromChunk < 0 || (fromChunk > 0 && fromChunk >= file.ChunkCount) {
+			c.JSON(http.StatusRequestedRangeNotSatisfiable, gin.H{
+				"error":       "from_chunk must be between 0 and the last chunk index",
+				"chunk_count": file.ChunkCount,
+			})
+			return
+		}
+	}
+
+	chunks, err := h.chunkService.GetChunksByFile(c.Request.Context(), file.ID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to retrieve chunks"})
 		return
 	}
 
-	var decryptedData []byte
-	for i := 0; i < file.ChunkCount; i++ {
-		chunkData, ok := chunks[i]
-		if !ok {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("missing chunk %d", i)})
+	// A chunk that can't be read is either gone for good or waiting on its nodes
+	if err := h.chunkService.CheckChunksReadable(c.Request.Context(), chunks, file.ChunkCount); err != nil {
+		switch {
+		case errors.Is(err, services.ErrChunkUnavailable):
+			c.Header("Retry-After", strconv.Itoa(chunkRetryAfterSeconds))
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"error":       err.Error(),
+				"retry_after": chunkRetryAfterSeconds,
+			})
+		case errors.Is(err, services.ErrChunkLost):
+			c.JSON(http.StatusGone, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to retrieve chunks"})
+		}
+		return
+	}
+	chunks = chunks[:file.ChunkCount]
+
+	// The ETag names the content by its recorded hash. Files completed
+	// without one are named by their chunks' hashes instead, which needs no
+	// chunk data, so a resume only reads the chunks it sends. A full download
+	// of such a file still hashes it on the fly for X-Content-SHA256, which
+	// takes a pass over its chunks before any of them is sent.
+	cipher := services.Cipher(file.Cipher)
+	key, err := h.fileService.FileKey(file)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	contentHash := file.ContentSHA256
+	etag := `"` + contentHash + `"`
+	if contentHash == "" {
+		etag = chunksETag(chunks)
+	}
+	if contentHash == "" && fromChunk == 0 {
+		hash := sha256.New()
+		for _, chunk := range chunks {
+			data, err := h.readChunk(c, cipher, key, chunk)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			hash.Write(data)
+		}
+		contentHash = hex.EncodeToString(hash.Sum(nil))
+	}
+
+	// A resumed download must prove it continues the same content, or the
+	// client would splice two different files together
+	if fromChunk > 0 {
+		ifMatch := c.GetHeader("If-Match")
+		if ifMatch == "" {
+			c.JSON(http.StatusPreconditionRequired, gin.H{"error": "If-Match with the download's ETag is required to resume"})
+			return
+		}
+		if !etagMatches(ifMatch, etag) {
+			c.Header("ETag", etag)
+			c.JSON(http.StatusPreconditionFailed, gin.H{"error": "file has changed since the download started"})
 			return
 		}
+	}
+
+	// Chunks decrypt to their stored size less the cipher's and their
+	// header's overhead, which places every chunk in the file without
+	// reading any of them
+	offsets := make([]int64, len(chunks)+1)
+	for i, chunk := range chunks {
+		offsets[i+1] = offsets[i] + int64(services.PlaintextSize(cipher, chunk))
+	}
+	start, total := offsets[fromChunk], offsets[len(chunks)]
+	chunkSize := total
+	if len(chunks) > 1 {
+		chunkSize = offsets[1]
+	}
+
+	contentType := h.fileService.ContentType(file)
+	c.Header("Content-Disposition", contentDisposition(file.Filename))
+	c.Header("Content-Type", contentType)
+	// The MIME type is whatever the uploader claimed; browsers must not
+	// guess a more dangerous one from the content
+	c.Header("X-Content-Type-Options", "nosniff")
+	if contentHash != "" {
+		c.Header("X-Content-SHA256", contentHash)
+	}
+	c.Header("ETag", etag)
+	c.Header("X-Chunk-Count", strconv.Itoa(file.ChunkCount))
+	c.Header("X-Chunk-Size", strconv.FormatInt(chunkSize, 10))
+	c.Header("Content-Length", strconv.FormatInt(total-start, 10))
 
-		decrypted, err := services.DecryptChunk(chunkData, file.EncryptionKey)
+	status := http.StatusOK
+	if fromChunk > 0 {
+		status = http.StatusPartialContent
+		c.Header("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, total-1, total))
+	}
+	c.Status(status)
+
+	// Chunks are read, decrypted and sent one at a time. Once the client is
+	// gone there is no one to send the rest to, so stop reading.
+	for i := fromChunk; i < len(chunks); i++ {
+		if err := c.Request.Context().Err(); err != nil {
+			logging.Infof("Download of file %s stopped after %d of %d chunks: %v", file.ID, i-fromChunk, len(chunks)-fromChunk, err)
+			return
+		}
+		data, err := h.readChunk(c, cipher, key, chunks[i])
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to decrypt chunk %d", i)})
+			// The status is already sent; cutting the body short tells the client
+			logging.Errorf("Download of file %s failed at chunk %d: %v", file.ID, i, err)
 			return
 		}
-		decryptedData = append(decryptedData, decrypted...)
+		if _, err := c.Writer.Write(data); err != nil {
+			logging.Infof("Download of file %s stopped after %d of %d chunks: %v", file.ID, i-fromChunk, len(chunks)-fromChunk, err)
+			return
+		}
+		c.Writer.Flush()
+	}
+}
+
+// downloadableFile looks up the file a download names, in the version its
+// ?version=N or ?version=latest asks for, writing the error response and
+// returning false unless it belongs to the user and is ready and unexpired
+func (h *FileHandler) downloadableFile(c *gin.Context) (*models.File, bool) {
+	fileID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid file id"})
+		return nil, false
+	}
+
+	userIDStr := middleware.GetUserID(c)
+	userID, err := uuid.Parse(userIDStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return nil, false
+	}
+
+	file, err := h.fileService.GetFile(c.Request.Context(), fileID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+		return nil, false
+	}
+
+	if file.UserID != userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
+		return nil, false
+	}
+
+	file, err = h.fileService.ResolveVersion(c.Request.Context(), file, c.Query("version"))
+	if err != nil {
+		if errors.Is(err, services.ErrVersionNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "version not found"})
+			return nil, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to resolve version"})
+		return nil, false
+	}
+
+	// Expired files are refused even before the purge job has removed them
+	if services.FileExpired(file, time.Now()) {
+		c.JSON(http.StatusGone, gin.H{"error": "file has expired"})
+		return nil, false
+	}
+
+	if file.Status != "ready" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "file not ready"})
+		return nil, false
+	}
+	return file, true
+}
+
+// DownloadChunk handles fetching one decrypted chunk of a file by index, for
+// clients downloading chunks in parallel or checking part of a file.
+// X-Chunk-SHA256 carries the SHA-256 of the bytes sent.
+func (h *FileHandler) DownloadChunk(c *gin.Context) {
+	file, ok := h.downloadableFile(c)
+	if !ok {
+		return
+	}
+
+	index, err := strconv.Atoi(c.Param("index"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid chunk index"})
+		return
+	}
+	if index < 0 || index >= file.ChunkCount {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error":       "chunk not found",
+			"chunk_count": file.ChunkCount,
+		})
+		return
+	}
+
+	chunks, err := h.chunkService.GetChunksByFile(c.Request.Context(), file.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to retrieve chunks"})
+		return
+	}
+	var chunk *models.Chunk
+	for i := range chunks {
+		if chunks[i].ChunkIndex == index {
+			chunk = &chunks[i]
+			break
+		}
+	}
+	if err := h.chunkService.CheckChunkReadable(c.Request.Context(), chunk, index); err != nil {
+		switch {
+		case errors.Is(err, services.ErrChunkUnavailable):
+			c.Header("Retry-After", strconv.Itoa(chunkRetryAfterSeconds))
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"error":       err.Error(),
+				"retry_after": chunkRetryAfterSeconds,
+			})
+		case errors.Is(err, services.ErrChunkLost):
+			c.JSON(http.StatusGone, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to retrieve chunks"})
+		}
+		return
+	}
+
+	key, err := h.fileService.FileKey(file)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	data, err := h.readChunk(c, services.Cipher(file.Cipher), key, *chunk)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("X-Chunk-Index", strconv.Itoa(index))
+	c.Header("X-Chunk-Count", strconv.Itoa(file.ChunkCount))
+	c.Header("X-Chunk-SHA256", services.ContentSHA256(data))
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Data(http.StatusOK, "application/octet-stream", data)
+}
+
+// readChunk reads and decrypts one chunk of a download
+func (h *FileHandler) readChunk(c *gin.Context, cipher services.Cipher, key []byte, chunk models.Chunk) ([]byte, error) {
+	data, err := h.chunkService.ReadChunk(c.Request.Context(), chunk)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chunk %d: %w", chunk.ChunkIndex, err)
 	}
+	decrypted, err := services.OpenChunk(cipher, data, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt chunk %d", chunk.ChunkIndex)
+	}
+	return decrypted, nil
+}
 
-	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s", file.Filename))
-	c.Header("Content-Type", "application/octet-stream")
-	c.Header("Content-Length", fmt.Sprintf("%d", len(decryptedData)))
-	c.Data(http.StatusOK, "application/octet-stream", decryptedData)
+// chunksETag names a file's content by its chunks' hashes, for files without
+// a recorded content hash
+func chunksETag(chunks []models.Chunk) string {
+	hash := sha256.New()
+	for _, chunk := range chunks {
+		hash.Write([]byte(chunk.Hash + "\n"))
+	}
+	return `"chunks-` + hex.EncodeToString(hash.Sum(nil)) + `"`
+}
+
+// etagMatches reports whether an If-Match header accepts etag
+func etagMatches(ifMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkIfMatch enforces an If-Match header on a change to file, writing a
+// 412 and returning false when the file has changed since the client's ETag.
+// The revision is only claimed here, so handlers call it once the request
+// is known to be valid and right before making the change; a rejected
+// request leaves the ETag as it was. Without the header the change is
+// unconditional.
+func (h *FileHandler) checkIfMatch(c *gin.Context, file *models.File) bool {
+	ifMatch := c.GetHeader("If-Match")
+	if ifMatch == "" {
+		return true
+	}
+	if etagMatches(ifMatch, services.FileETag(file)) {
+		err := h.fileService.ClaimRevision(c.Request.Context(), file)
+		if err == nil {
+			return true
+		}
+		if !errors.Is(err, services.ErrFileModified) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return false
+		}
+	} else {
+		c.Header("ETag", services.FileETag(file))
+	}
+	c.JSON(http.StatusPreconditionFailed, gin.H{"error": "file has been modified; fetch it again and retry"})
+	return false
+}
+
+// contentDisposition builds an attachment header for filename per RFC 6266:
+// a quoted ASCII fallback for old clients plus the exact name, percent-encoded,
+// in filename*. Control characters are dropped from both, so a stored name can
+// never break out of the header.
+func contentDisposition(filename string) string {
+	var fallback, encoded strings.Builder
+	for _, r := range filename {
+		switch {
+		case unicode.IsControl(r):
+			continue
+		case r > unicode.MaxASCII || r == '"' || r == '\\':
+			fallback.WriteByte('_')
+		default:
+			fallback.WriteRune(r)
+		}
+
+		var buf [utf8.UTFMax]byte
+		for _, b := range buf[:utf8.EncodeRune(buf[:], r)] {
+			if isAttrChar(b) {
+				encoded.WriteByte(b)
+			} else {
+				fmt.Fprintf(&encoded, "%%%02X", b)
+			}
+		}
+	}
+	return fmt.Sprintf(`attachment; filename="%s"; filename*=UTF-8''%s`, fallback.String(), encoded.String())
+}
+
+// isAttrChar reports whether b may appear unencoded in an RFC 5987 ext-value
+func isAttrChar(b byte) bool {
+	switch {
+	case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", b) >= 0
+}
+
+// ListVersions returns the version history of a file, oldest first
+func (h *FileHandler) ListVersions(c *gin.Context) {
+	fileIDStr := c.Param("id")
+	fileID, err := uuid.Parse(fileIDStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid file id"})
+		return
+	}
+
+	userIDStr := middleware.GetUserID(c)
+	userID, err := uuid.Parse(userIDStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+
+	file, err := h.fileService.GetFile(c.Request.Context(), fileID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+		return
+	}
+
+	if file.UserID != userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
+		return
+	}
+
+	versions, err := h.fileService.ListVersions(c.Request.Context(), file)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list versions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"versions": versions})
 }
 
 // DeleteFile handles file deletion
@@ -126,11 +516,372 @@ func (h *FileHandler) DeleteFile(c *gin.Context) {
 		return
 	}
 
+	if !h.checkIfMatch(c, file) {
+		return
+	}
+
 	err = h.fileService.DeleteFile(c.Request.Context(), fileID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	h.chunkService.InvalidateFile(fileID)
 
 	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
 }
+
+// VerifyFile handles on-demand proof-of-storage verification of a file
+func (h *FileHandler) VerifyFile(c *gin.Context) {
+	fileIDStr := c.Param("id")
+	fileID, err := uuid.Parse(fileIDStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid file id"})
+		return
+	}
+
+	userIDStr := middleware.GetUserID(c)
+	userID, err := uuid.Parse(userIDStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+
+	file, err := h.fileService.GetFile(c.Request.Context(), fileID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+		return
+	}
+
+	if file.UserID != userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
+		return
+	}
+
+	if file.Status != "ready" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "file not ready"})
+		return
+	}
+
+	if ok, wait := h.proofService.AllowFileVerify(fileID); !ok {
+		retryAfter := int(math.Ceil(wait.Seconds()))
+		c.Header("Retry-After", fmt.Sprintf("%d", retryAfter))
+		c.JSON(http.StatusTooManyRequests, gin.H{
+			"error":       "file was verified recently",
+			"retry_after": retryAfter,
+		})
+		return
+	}
+
+	result, err := h.proofService.VerifyFile(c.Request.Context(), fileID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// RepairFile handles rewriting corrupt chunks of a file from healthy replicas
+func (h *FileHandler) RepairFile(c *gin.Context) {
+	fileIDStr := c.Param("id")
+	fileID, err := uuid.Parse(fileIDStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid file id"})
+		return
+	}
+
+	userIDStr := middleware.GetUserID(c)
+	userID, err := uuid.Parse(userIDStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+
+	file, err := h.fileService.GetFile(c.Request.Context(), fileID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+		return
+	}
+
+	if file.UserID != userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
+		return
+	}
+
+	if file.Status != "ready" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "file not ready"})
+		return
+	}
+
+	result, err := h.chunkService.RepairFile(c.Request.Context(), fileID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// FileHealth handles reporting how safely a file's chunks are stored
+func (h *FileHandler) FileHealth(c *gin.Context) {
+	fileIDStr := c.Param("id")
+	fileID, err := uuid.Parse(fileIDStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid file id"})
+		return
+	}
+
+	userIDStr := middleware.GetUserID(c)
+	userID, err := uuid.Parse(userIDStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+
+	file, err := h.fileService.GetFile(c.Request.Context(), fileID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+		return
+	}
+
+	if file.UserID != userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
+		return
+	}
+
+	if file.Status != "ready" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "file not ready"})
+		return
+	}
+
+	health, err := h.proofService.FileHealth(c.Request.Context(), file, time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, health)
+}
+
+// FileLocations lists the online nodes holding each chunk of a file, so its
+// owner can audit where the data lives
+func (h *FileHandler) FileLocations(c *gin.Context) {
+	fileIDStr := c.Param("id")
+	fileID, err := uuid.Parse(fileIDStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid file id"})
+		return
+	}
+
+	userIDStr := middleware.GetUserID(c)
+	userID, err := uuid.Parse(userIDStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+
+	file, err := h.fileService.GetFile(c.Request.Context(), fileID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+		return
+	}
+
+	if file.UserID != userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
+		return
+	}
+
+	chunks, err := h.chunkService.GetChunksByFile(c.Request.Context(), file.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to retrieve chunks"})
+		return
+	}
+	locations, err := h.chunkService.FileLocations(c.Request.Context(), file.ID, chunks, time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"file_id": file.ID,
+		"chunks":  locations,
+	})
+}
+
+// RotateKey handles re-encrypting a file's chunks under a new key and
+// sending the new ciphertext to the nodes holding replicas of them
+func (h *FileHandler) RotateKey(c *gin.Context) {
+	fileIDStr := c.Param("id")
+	fileID, err := uuid.Parse(fileIDStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid file id"})
+		return
+	}
+
+	userIDStr := middleware.GetUserID(c)
+	userID, err := uuid.Parse(userIDStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+
+	file, err := h.fileService.GetFile(c.Request.Context(), fileID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+		return
+	}
+
+	if file.UserID != userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
+		return
+	}
+
+	if file.Status != "ready" {
+		c.JSON(http.StatusConflict, gin.H{"error": "file is not ready or is already being rotated"})
+		return
+	}
+	if !h.checkIfMatch(c, file) {
+		return
+	}
+
+	if err := h.fileService.RotateKey(c.Request.Context(), fileID); err != nil {
+		if errors.Is(err, services.ErrFileBusy) {
+			c.JSON(http.StatusConflict, gin.H{"error": "file is not ready or is already being rotated"})
+			return
+		}
+		if errors.Is(err, services.ErrRotationUnsupported) {
+			c.JSON(http.StatusConflict, gin.H{"error": "files uploaded directly to nodes can't be rotated"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.chunkService.InvalidateFile(fileID)
+
+	refreshed, stale, err := h.chunkService.RefreshStaleReplicas(c.Request.Context(), fileID)
+	if err != nil {
+		logging.Errorf("Key of file %s rotated but its replicas were not refreshed: %v", fileID, err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":             "rotated",
+		"replicas_refreshed": refreshed,
+		"replicas_stale":     stale,
+	})
+}
+
+// AddTagsRequest represents a request to tag a file
+type AddTagsRequest struct {
+	Tags []string `json:"tags" binding:"required,min=1"`
+}
+
+// AddTags handles adding tags to a file
+func (h *FileHandler) AddTags(c *gin.Context) {
+	fileIDStr := c.Param("id")
+	fileID, err := uuid.Parse(fileIDStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid file id"})
+		return
+	}
+
+	var req AddTagsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	userIDStr := middleware.GetUserID(c)
+	userID, err := uuid.Parse(userIDStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+
+	file, err := h.fileService.GetFile(c.Request.Context(), fileID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+		return
+	}
+
+	if file.UserID != userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
+		return
+	}
+
+	tags, err := h.fileService.CheckTags(c.Request.Context(), fileID, req.Tags)
+	if err != nil {
+		if errors.Is(err, services.ErrInvalidTag) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !h.checkIfMatch(c, file) {
+		return
+	}
+
+	tags, err = h.fileService.AddTags(c.Request.Context(), fileID, tags)
+	if err != nil {
+		if errors.Is(err, services.ErrInvalidTag) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"file_id": fileID, "tags": tags})
+}
+
+// RemoveTag handles removing a tag from a file
+func (h *FileHandler) RemoveTag(c *gin.Context) {
+	fileIDStr := c.Param("id")
+	fileID, err := uuid.Parse(fileIDStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid file id"})
+		return
+	}
+
+	userIDStr := middleware.GetUserID(c)
+	userID, err := uuid.Parse(userIDStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+
+	file, err := h.fileService.GetFile(c.Request.Context(), fileID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+		return
+	}
+
+	if file.UserID != userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
+		return
+	}
+
+	tagged, err := h.fileService.HasTag(c.Request.Context(), fileID, c.Param("tag"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !tagged {
+		c.JSON(http.StatusNotFound, gin.H{"error": "tag not found"})
+		return
+	}
+	if !h.checkIfMatch(c, file) {
+		return
+	}
+
+	if err := h.fileService.RemoveTag(c.Request.Context(), fileID, c.Param("tag")); err != nil {
+		if errors.Is(err, services.ErrTagNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "tag not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "removed"})
+}
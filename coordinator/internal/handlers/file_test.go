@@ -0,0 +1,699 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/federated-storage/coordinator/internal/models"
+	"github.com/federated-storage/coordinator/internal/services"
+	"github.com/federated-storage/coordinator/internal/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownloadFile_ContentSHA256Header(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	fileService := services.NewFileService(store, 8, 100)
+	chunkService := services.NewChunkService(store, nil, nil)
+	handler := NewFileHandler(fileService, chunkService, nil)
+
+	userID := uuid.New()
+	key := make([]byte, 32)
+	parts := []string{"integrit", "y check!", "!"}
+	file, err := fileService.CreateFile(ctx, userID, "check.txt", 17, "", key, services.DefaultCipher, len(parts))
+	require.NoError(t, err)
+	for i, part := range parts {
+		encrypted, err := services.EncryptChunk([]byte(part), key)
+		require.NoError(t, err)
+		_, err = chunkService.StoreChunk(ctx, file.ID, i, encrypted, nil)
+		require.NoError(t, err)
+	}
+	require.NoError(t, fileService.MarkFileComplete(ctx, file.ID))
+
+	router := gin.New()
+	router.GET("/files/:id/download", func(c *gin.Context) {
+		c.Set("user_id", userID.String())
+		handler.DownloadFile(c)
+	})
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/files/"+file.ID.String()+"/download", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	sum := sha256.Sum256(w.Body.Bytes())
+	assert.Equal(t, "integrity check!!", w.Body.String())
+	assert.Equal(t, hex.EncodeToString(sum[:]), w.Header().Get("X-Content-SHA256"))
+
+	stored, err := fileService.GetFile(ctx, file.ID)
+	require.NoError(t, err)
+	assert.Equal(t, hex.EncodeToString(sum[:]), stored.ContentSHA256, "Hash should be recorded at completion")
+}
+
+func TestDownloadChunk_ByIndex(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	fileService := services.NewFileService(store, 8, 100)
+	chunkService := services.NewChunkService(store, nil, nil)
+	handler := NewFileHandler(fileService, chunkService, nil)
+
+	owner, stranger := uuid.New(), uuid.New()
+	key := make([]byte, 32)
+	parts := []string{"chunk ze", "ro, one", "!"}
+	file, err := fileService.CreateFile(ctx, owner, "parts.txt", 16, "", key, services.DefaultCipher, len(parts))
+	require.NoError(t, err)
+	for i, part := range parts {
+		encrypted, err := services.EncryptChunk([]byte(part), key)
+		require.NoError(t, err)
+		_, err = chunkService.StoreChunk(ctx, file.ID, i, encrypted, nil)
+		require.NoError(t, err)
+	}
+	require.NoError(t, fileService.MarkFileComplete(ctx, file.ID))
+
+	router := gin.New()
+	router.GET("/files/:id/chunks/:index", func(c *gin.Context) {
+		c.Set("user_id", c.GetHeader("X-Test-User"))
+		handler.DownloadChunk(c)
+	})
+	get := func(userID uuid.UUID, index string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/files/"+file.ID.String()+"/chunks/"+index, nil)
+		req.Header.Set("X-Test-User", userID.String())
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get(owner, "1")
+	require.Equal(t, http.StatusOK, w.Code)
+	sum := sha256.Sum256([]byte("ro, one"))
+	assert.Equal(t, "ro, one", w.Body.String(), "Only the requested chunk should be sent, decrypted")
+	assert.Equal(t, hex.EncodeToString(sum[:]), w.Header().Get("X-Chunk-SHA256"))
+	assert.Equal(t, "1", w.Header().Get("X-Chunk-Index"))
+	assert.Equal(t, "3", w.Header().Get("X-Chunk-Count"))
+	assert.Equal(t, "nosniff", w.Header().Get("X-Content-Type-Options"))
+
+	for _, index := range []string{"3", "-1"} {
+		w = get(owner, index)
+		assert.Equal(t, http.StatusNotFound, w.Code, "index %s", index)
+		assert.Contains(t, w.Body.String(), `"chunk_count":3`)
+	}
+	assert.Equal(t, http.StatusBadRequest, get(owner, "first").Code)
+
+	w = get(stranger, "1")
+	assert.Equal(t, http.StatusForbidden, w.Code, "Another user's chunks should not be served")
+	assert.NotContains(t, w.Body.String(), "ro, one")
+}
+
+func TestDownloadFile_MixesLegacyAndHeaderedChunks(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	fileService := services.NewFileService(store, 8, 100)
+	chunkService := services.NewChunkService(store, nil, nil)
+	handler := NewFileHandler(fileService, chunkService, nil)
+
+	userID := uuid.New()
+	key := make([]byte, 32)
+	parts := []string{"stored b", "efore an", "d after"}
+	file, err := fileService.CreateFile(ctx, userID, "mixed.txt", 23, "", key, services.DefaultCipher, len(parts))
+	require.NoError(t, err)
+	for i, part := range parts {
+		// The first chunk predates chunk headers
+		encrypted, err := services.EncryptChunk([]byte(part), key)
+		if i == 0 {
+			encrypted, err = services.DefaultCipher.Encrypt([]byte(part), key)
+		}
+		require.NoError(t, err)
+		_, err = chunkService.StoreChunk(ctx, file.ID, i, encrypted, nil)
+		require.NoError(t, err)
+	}
+	require.NoError(t, fileService.MarkFileComplete(ctx, file.ID))
+
+	router := gin.New()
+	router.GET("/files/:id/download", func(c *gin.Context) {
+		c.Set("user_id", userID.String())
+		handler.DownloadFile(c)
+	})
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/files/"+file.ID.String()+"/download", nil))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "stored before and after", w.Body.String())
+	assert.Equal(t, "23", w.Header().Get("Content-Length"))
+	assert.Equal(t, "8", w.Header().Get("X-Chunk-Size"))
+}
+
+func TestDownloadFile_ExpiredFileIsGone(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	fileService := services.NewFileService(store, 8, 100)
+	chunkService := services.NewChunkService(store, nil, nil)
+	handler := NewFileHandler(fileService, chunkService, nil)
+
+	userID := uuid.New()
+	key := make([]byte, 32)
+	file, err := fileService.CreateFile(ctx, userID, "temp.txt", 4, "", key, services.DefaultCipher, 1)
+	require.NoError(t, err)
+	encrypted, err := services.EncryptChunk([]byte("temp"), key)
+	require.NoError(t, err)
+	_, err = chunkService.StoreChunk(ctx, file.ID, 0, encrypted, nil)
+	require.NoError(t, err)
+	require.NoError(t, fileService.MarkFileComplete(ctx, file.ID))
+
+	router := gin.New()
+	router.GET("/files/:id/download", func(c *gin.Context) {
+		c.Set("user_id", userID.String())
+		handler.DownloadFile(c)
+	})
+	download := func() int {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/files/"+file.ID.String()+"/download", nil))
+		return w.Code
+	}
+
+	future := time.Now().Add(time.Hour)
+	require.NoError(t, fileService.SetExpiry(ctx, file.ID, &future))
+	assert.Equal(t, http.StatusOK, download())
+
+	// Not yet purged, but past its expiry
+	past := time.Now().Add(-time.Second)
+	require.NoError(t, fileService.SetExpiry(ctx, file.ID, &past))
+	assert.Equal(t, http.StatusGone, download())
+}
+
+func TestDownloadFile_UnreadableChunks(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	fileService := services.NewFileService(store, 8, 100)
+	chunkService := services.NewChunkService(store, nil, nil)
+	handler := NewFileHandler(fileService, chunkService, nil)
+
+	userID := uuid.New()
+	key := make([]byte, 32)
+	router := gin.New()
+	router.GET("/files/:id/download", func(c *gin.Context) {
+		c.Set("user_id", userID.String())
+		handler.DownloadFile(c)
+	})
+	download := func(fileID uuid.UUID) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/files/"+fileID.String()+"/download", nil))
+		return w
+	}
+
+	// Chunk 1's only copy is on a node that can't serve it right now
+	file, err := fileService.CreateFile(ctx, userID, "split.txt", 12, "", key, services.DefaultCipher, 2)
+	require.NoError(t, err)
+	encrypted, err := services.EncryptChunk([]byte("readable"), key)
+	require.NoError(t, err)
+	_, err = chunkService.StoreChunk(ctx, file.ID, 0, encrypted, nil)
+	require.NoError(t, err)
+	nodeID := uuid.New()
+	offline, err := chunkService.StoreChunk(ctx, file.ID, 1, nil, []uuid.UUID{nodeID})
+	require.NoError(t, err)
+	require.NoError(t, fileService.MarkFileComplete(ctx, file.ID))
+
+	w := download(file.ID)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "60", w.Header().Get("Retry-After"))
+	assert.Contains(t, w.Body.String(), "temporarily unavailable")
+
+	// With its last replica gone, the chunk can't come back
+	require.NoError(t, store.DeleteChunkAssignment(ctx, offline.ID, nodeID))
+	w = download(file.ID)
+	assert.Equal(t, http.StatusGone, w.Code)
+	assert.Contains(t, w.Body.String(), "permanently lost")
+	assert.Empty(t, w.Header().Get("Retry-After"))
+
+	// So is a chunk with no record at all
+	gone, err := fileService.CreateFile(ctx, userID, "gone.txt", 4, "", key, services.DefaultCipher, 1)
+	require.NoError(t, err)
+	require.NoError(t, fileService.MarkFileComplete(ctx, gone.ID))
+	assert.Equal(t, http.StatusGone, download(gone.ID).Code)
+}
+
+// countingStore counts chunk reads, calling onRead after each one
+type countingStore struct {
+	*storage.MemoryStore
+	reads  atomic.Int32
+	onRead func(reads int32)
+}
+
+func (s *countingStore) GetChunk(ctx context.Context, chunkID uuid.UUID) (*models.Chunk, []byte, error) {
+	s.onRead(s.reads.Add(1))
+	return s.MemoryStore.GetChunk(ctx, chunkID)
+}
+
+func TestDownloadFile_StopsReadingWhenClientGoes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// The client disconnects while the second chunk is being read
+	store := &countingStore{MemoryStore: storage.NewMemoryStore(), onRead: func(reads int32) {
+		if reads == 2 {
+			cancel()
+		}
+	}}
+	fileService := services.NewFileService(store, 8, 100)
+	chunkService := services.NewChunkService(store, nil, nil)
+	handler := NewFileHandler(fileService, chunkService, nil)
+
+	userID := uuid.New()
+	key := make([]byte, 32)
+	parts := []string{"streamed", " one chu", "nk at a ", "time"}
+	file, err := fileService.CreateFile(context.Background(), userID, "stream.txt", 28, "", key, services.DefaultCipher, len(parts))
+	require.NoError(t, err)
+	for i, part := range parts {
+		encrypted, err := services.EncryptChunk([]byte(part), key)
+		require.NoError(t, err)
+		_, err = chunkService.StoreChunk(context.Background(), file.ID, i, encrypted, nil)
+		require.NoError(t, err)
+	}
+	require.NoError(t, fileService.MarkFileComplete(context.Background(), file.ID))
+	store.reads.Store(0)
+
+	router := gin.New()
+	router.GET("/files/:id/download", func(c *gin.Context) {
+		c.Set("user_id", userID.String())
+		handler.DownloadFile(c)
+	})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/files/"+file.ID.String()+"/download", nil).WithContext(ctx))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "28", w.Header().Get("Content-Length"))
+	assert.Equal(t, int32(2), store.reads.Load(), "no chunk should be read after the client is gone")
+	assert.Equal(t, "streamed one chu", w.Body.String(), "the chunk read while the client left is still sent")
+}
+
+func TestDownloadFile_FetchesOlderVersion(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	fileService := services.NewFileService(store, 8, 100)
+	chunkService := services.NewChunkService(store, nil, nil)
+	handler := NewFileHandler(fileService, chunkService, nil)
+
+	userID := uuid.New()
+	key := make([]byte, 32)
+	upload := func(content string) uuid.UUID {
+		file, err := fileService.CreateVersionedFile(ctx, userID, "draft.txt", int64(len(content)), "", key, services.DefaultCipher, 1)
+		require.NoError(t, err)
+		encrypted, err := services.EncryptChunk([]byte(content), key)
+		require.NoError(t, err)
+		_, err = chunkService.StoreChunk(ctx, file.ID, 0, encrypted, nil)
+		require.NoError(t, err)
+		require.NoError(t, fileService.MarkFileComplete(ctx, file.ID))
+		return file.ID
+	}
+	firstID := upload("first")
+	secondID := upload("second")
+
+	router := gin.New()
+	router.Use(func(c *gin.Context) { c.Set("user_id", userID.String()) })
+	router.GET("/files/:id/download", handler.DownloadFile)
+	router.GET("/files/:id/versions", handler.ListVersions)
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	w := get("/files/" + secondID.String() + "/download?version=1")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "first", w.Body.String())
+
+	w = get("/files/" + firstID.String() + "/download?version=latest")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "second", w.Body.String())
+
+	w = get("/files/" + firstID.String() + "/download")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "first", w.Body.String(), "Without a version the requested file itself is served")
+
+	assert.Equal(t, http.StatusNotFound, get("/files/"+firstID.String()+"/download?version=3").Code)
+
+	w = get("/files/" + firstID.String() + "/versions")
+	require.Equal(t, http.StatusOK, w.Code)
+	var resp struct {
+		Versions []struct {
+			ID      uuid.UUID `json:"id"`
+			Version int       `json:"version"`
+		} `json:"versions"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Len(t, resp.Versions, 2)
+	assert.Equal(t, firstID, resp.Versions[0].ID)
+	assert.Equal(t, 1, resp.Versions[0].Version)
+	assert.Equal(t, secondID, resp.Versions[1].ID)
+	assert.Equal(t, 2, resp.Versions[1].Version)
+}
+
+func TestDownloadFile_ResumesFromChunk(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	fileService := services.NewFileService(store, 8, 100)
+	chunkService := services.NewChunkService(store, nil, nil)
+	handler := NewFileHandler(fileService, chunkService, nil)
+
+	userID := uuid.New()
+	key := make([]byte, 32)
+	parts := []string{"resumabl", "e downlo", "ad"}
+	file, err := fileService.CreateFile(ctx, userID, "resume.txt", 18, "", key, services.DefaultCipher, len(parts))
+	require.NoError(t, err)
+	var chunkIDs []uuid.UUID
+	for i, part := range parts {
+		encrypted, err := services.EncryptChunk([]byte(part), key)
+		require.NoError(t, err)
+		chunk, err := chunkService.StoreChunk(ctx, file.ID, i, encrypted, nil)
+		require.NoError(t, err)
+		chunkIDs = append(chunkIDs, chunk.ID)
+	}
+	require.NoError(t, fileService.MarkFileComplete(ctx, file.ID))
+
+	router := gin.New()
+	router.GET("/files/:id/download", func(c *gin.Context) {
+		c.Set("user_id", userID.String())
+		handler.DownloadFile(c)
+	})
+	download := func(query, ifMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/files/"+file.ID.String()+"/download"+query, nil)
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	full := download("", "")
+	require.Equal(t, http.StatusOK, full.Code)
+	etag := full.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+	assert.Equal(t, "3", full.Header().Get("X-Chunk-Count"))
+	assert.Equal(t, "8", full.Header().Get("X-Chunk-Size"))
+
+	// The client got 12 bytes before the connection dropped: one whole chunk.
+	// Resuming reads only the chunks it sends, so a first chunk that can no
+	// longer be decrypted doesn't stand in the way.
+	received := full.Body.Bytes()[:12]
+	require.NoError(t, store.SetChunkData(ctx, chunkIDs[0], []byte("unreadable")))
+	w := download("?from_chunk=1", etag)
+	require.Equal(t, http.StatusPartialContent, w.Code, w.Body.String())
+	assert.Equal(t, "bytes 8-17/18", w.Header().Get("Content-Range"))
+	assert.Equal(t, "e download", w.Body.String())
+	assert.Equal(t, "resumable download", string(received[:8])+w.Body.String())
+
+	// Resuming needs the ETag, and it must still match
+	assert.Equal(t, http.StatusPreconditionRequired, download("?from_chunk=1", "").Code)
+	assert.Equal(t, http.StatusPreconditionFailed, download("?from_chunk=1", `"stale"`).Code)
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, download("?from_chunk=3", etag).Code)
+
+	// from_chunk=0 is the whole file, even an empty one with no chunks
+	empty, err := fileService.CreateFile(ctx, userID, "empty.txt", 0, "", key, services.DefaultCipher, 0)
+	require.NoError(t, err)
+	require.NoError(t, fileService.MarkFileComplete(ctx, empty.ID))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/files/"+empty.ID.String()+"/download?from_chunk=0", nil))
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Empty(t, w.Body.String())
+}
+
+func TestContentDisposition(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		want     string
+	}{
+		{"plain", "report.pdf", `attachment; filename="report.pdf"; filename*=UTF-8''report.pdf`},
+		{"quotes", `say "hi".txt`, `attachment; filename="say _hi_.txt"; filename*=UTF-8''say%20%22hi%22.txt`},
+		{"non-ASCII", "résumé.pdf", `attachment; filename="r_sum_.pdf"; filename*=UTF-8''r%C3%A9sum%C3%A9.pdf`},
+		{"newline", "a.txt\r\nSet-Cookie: x=1", `attachment; filename="a.txtSet-Cookie: x=1"; filename*=UTF-8''a.txtSet-Cookie%3A%20x%3D1`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := contentDisposition(tt.filename)
+			assert.Equal(t, tt.want, got)
+			assert.NotContains(t, got, "\r")
+			assert.NotContains(t, got, "\n")
+		})
+	}
+}
+
+func TestDownloadFile_HeadersForUnsafeFilename(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	fileService := services.NewFileService(store, 8, 100)
+	fileService.SetDefaultMimeType("application/x-unknown")
+	chunkService := services.NewChunkService(store, nil, nil)
+	handler := NewFileHandler(fileService, chunkService, nil)
+
+	// Stored before filenames were validated at upload
+	userID := uuid.New()
+	key := make([]byte, 32)
+	file, err := fileService.CreateFile(ctx, userID, "évil\"\r\nX-Injected: 1", 2, "", key, services.DefaultCipher, 1)
+	require.NoError(t, err)
+	encrypted, err := services.EncryptChunk([]byte("hi"), key)
+	require.NoError(t, err)
+	_, err = chunkService.StoreChunk(ctx, file.ID, 0, encrypted, nil)
+	require.NoError(t, err)
+	require.NoError(t, fileService.MarkFileComplete(ctx, file.ID))
+
+	router := gin.New()
+	router.GET("/files/:id/download", func(c *gin.Context) {
+		c.Set("user_id", userID.String())
+		handler.DownloadFile(c)
+	})
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/files/"+file.ID.String()+"/download", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	assert.Empty(t, w.Header().Get("X-Injected"))
+	assert.Equal(t, `attachment; filename="_vil_X-Injected: 1"; filename*=UTF-8''%C3%A9vil%22X-Injected%3A%201`,
+		w.Header().Get("Content-Disposition"))
+	assert.Equal(t, "application/x-unknown", w.Header().Get("Content-Type"), "Files without a MIME type get the configured default")
+	assert.Equal(t, "nosniff", w.Header().Get("X-Content-Type-Options"), "Browsers must not sniff a type for user content")
+}
+
+func TestFileChanges_IfMatchPreconditions(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	fileService := services.NewFileService(store, 8, 100)
+	handler := NewFileHandler(fileService, services.NewChunkService(store, nil, nil), nil)
+
+	userID := uuid.New()
+	file, err := fileService.CreateFile(ctx, userID, "shared.txt", 4, "", make([]byte, 32), services.DefaultCipher, 1)
+	require.NoError(t, err)
+
+	router := gin.New()
+	router.Use(func(c *gin.Context) { c.Set("user_id", userID.String()) })
+	router.GET("/files/:id", handler.GetFile)
+	router.POST("/files/:id/tags", handler.AddTags)
+	router.DELETE("/files/:id/tags/:tag", handler.RemoveTag)
+	router.DELETE("/files/:id", handler.DeleteFile)
+	send := func(method, path, body, ifMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/files/"+file.ID.String()+path, strings.NewReader(body))
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send(http.MethodGet, "", "", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	etag := w.Header().Get("ETag")
+	require.NotEmpty(t, etag)
+
+	// Requests rejected for their content don't use up the ETag
+	w = send(http.MethodPost, "/tags", `{"tags": ["`+strings.Repeat("x", services.MaxTagLength+1)+`"]}`, etag)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = send(http.MethodDelete, "/tags/missing", "", etag)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = send(http.MethodGet, "", "", "")
+	assert.Equal(t, etag, w.Header().Get("ETag"), "A rejected change leaves the revision alone")
+
+	// Two clients hold the same ETag; the first change wins
+	w = send(http.MethodPost, "/tags", `{"tags": ["work"]}`, etag)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	w = send(http.MethodDelete, "", "", etag)
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+	current := w.Header().Get("ETag")
+	assert.NotEqual(t, etag, current, "The 412 carries the current ETag")
+	_, err = fileService.GetFile(ctx, file.ID)
+	assert.NoError(t, err, "A stale delete leaves the file in place")
+
+	// Refetching gives the ETag that now applies
+	w = send(http.MethodGet, "", "", "")
+	assert.Equal(t, current, w.Header().Get("ETag"))
+	w = send(http.MethodDelete, "", "", current)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	_, err = fileService.GetFile(ctx, file.ID)
+	assert.Error(t, err)
+}
+
+func TestFileChanges_ConcurrentSameETagOnlyOneWins(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	fileService := services.NewFileService(store, 8, 100)
+	created, err := fileService.CreateFile(ctx, uuid.New(), "race.txt", 4, "", make([]byte, 32), services.DefaultCipher, 1)
+	require.NoError(t, err)
+	file, err := fileService.GetFile(ctx, created.ID)
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	var won atomic.Int32
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if fileService.ClaimRevision(ctx, file) == nil {
+				won.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), won.Load())
+}
+
+func TestFileLocations_OwnerSeesOnlineNodes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	now := time.Now()
+	recent, stale := now.Add(-time.Minute), now.Add(-time.Hour)
+	online := models.StorageNode{ID: uuid.New(), PeerID: "peer-online", Name: "online", Region: "eu-west", LastHeartbeat: &recent}
+	quiet := models.StorageNode{ID: uuid.New(), PeerID: "peer-quiet", Name: "quiet", LastHeartbeat: &stale}
+	// Only active nodes are listed, so this one stands for a node gone inactive
+	inactiveID := uuid.New()
+
+	fileService := services.NewFileService(store, 8, 100)
+	chunkService := services.NewChunkService(store, staticNodes{online, quiet}, nil)
+	chunkService.SetOfflineAfter(5 * time.Minute)
+	handler := NewFileHandler(fileService, chunkService, nil)
+
+	ownerID := uuid.New()
+	file, err := fileService.CreateFile(ctx, ownerID, "where.txt", 16, "", make([]byte, 32), services.DefaultCipher, 2)
+	require.NoError(t, err)
+	_, err = chunkService.StoreChunk(ctx, file.ID, 0, []byte("chunk"), []uuid.UUID{online.ID, quiet.ID})
+	require.NoError(t, err)
+	_, err = chunkService.StoreChunk(ctx, file.ID, 1, []byte("chunk"), []uuid.UUID{inactiveID, online.ID})
+	require.NoError(t, err)
+
+	locations := func(userID uuid.UUID) *httptest.ResponseRecorder {
+		router := gin.New()
+		router.GET("/files/:id/locations", func(c *gin.Context) {
+			c.Set("user_id", userID.String())
+			handler.FileLocations(c)
+		})
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/files/"+file.ID.String()+"/locations", nil))
+		return w
+	}
+
+	w := locations(uuid.New())
+	assert.Equal(t, http.StatusForbidden, w.Code, "Only the owner may see where a file is held")
+	assert.NotContains(t, w.Body.String(), "peer-online")
+
+	w = locations(ownerID)
+	require.Equal(t, http.StatusOK, w.Code)
+	var resp struct {
+		Chunks []services.ChunkLocation `json:"chunks"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Len(t, resp.Chunks, 2)
+	want := []services.NodeLocation{{NodeID: online.ID, PeerID: "peer-online", Name: "online", Region: "eu-west"}}
+	for i, chunk := range resp.Chunks {
+		assert.Equal(t, i, chunk.ChunkIndex)
+		assert.Equal(t, want, chunk.Nodes, "Chunk %d lists only its online node", i)
+	}
+}
+
+func TestRepairFile_RewritesCorruptChunksFromReplicas(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	node := models.StorageNode{ID: uuid.New(), PeerID: "peer-replica"}
+	held := nodeChunks{}
+	fileService := services.NewFileService(store, 8, 100)
+	chunkService := services.NewChunkService(store, staticNodes{node}, nil)
+	chunkService.SetTransfer(held)
+	handler := NewFileHandler(fileService, chunkService, nil)
+
+	userID := uuid.New()
+	key := make([]byte, 32)
+	parts := []string{"repaired", "lost", "intact"}
+	file, err := fileService.CreateFile(ctx, userID, "repair.txt", 18, "", key, services.DefaultCipher, len(parts))
+	require.NoError(t, err)
+	var chunks []*models.Chunk
+	var originals [][]byte
+	for i, part := range parts {
+		encrypted, err := services.EncryptChunk([]byte(part), key)
+		require.NoError(t, err)
+		chunk, err := chunkService.StoreChunk(ctx, file.ID, i, encrypted, []uuid.UUID{node.ID})
+		require.NoError(t, err)
+		chunks, originals = append(chunks, chunk), append(originals, encrypted)
+	}
+	require.NoError(t, fileService.MarkFileComplete(ctx, file.ID))
+
+	// The node holds a healthy copy of the first chunk only; the coordinator's
+	// copies of the first two are corrupt
+	held.SendChunk(ctx, node.PeerID, chunks[0].ID.String(), originals[0])
+	for _, chunk := range chunks[:2] {
+		require.NoError(t, store.SetChunkData(ctx, chunk.ID, []byte("bit rot")))
+	}
+
+	router := gin.New()
+	router.Use(func(c *gin.Context) { c.Set("user_id", userID.String()) })
+	router.POST("/files/:id/repair", handler.RepairFile)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/files/"+file.ID.String()+"/repair", nil))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var result services.FileRepairResult
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	assert.Equal(t, 1, result.Repaired)
+	assert.Equal(t, 1, result.Lost)
+	require.Len(t, result.Chunks, 3)
+	assert.Equal(t, services.RepairRepaired, result.Chunks[0].Status)
+	assert.Equal(t, services.RepairLost, result.Chunks[1].Status)
+	assert.NotEmpty(t, result.Chunks[1].Error)
+	assert.Equal(t, services.RepairIntact, result.Chunks[2].Status)
+
+	_, data, err := store.GetChunk(ctx, chunks[0].ID)
+	require.NoError(t, err)
+	assert.Equal(t, originals[0], data, "The replica's copy replaces the corrupt one")
+	_, data, err = store.GetChunk(ctx, chunks[1].ID)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("bit rot"), data, "An unrepairable chunk is left as it was")
+
+	// Someone else's file can't be repaired
+	other := gin.New()
+	other.Use(func(c *gin.Context) { c.Set("user_id", uuid.NewString()) })
+	other.POST("/files/:id/repair", handler.RepairFile)
+	w = httptest.NewRecorder()
+	other.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/files/"+file.ID.String()+"/repair", nil))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// P2PStatus reports on the coordinator's P2P host, which may come up after
+// the HTTP API if it failed to start
+type P2PStatus interface {
+	Available() bool
+	PeerID() string // empty while unavailable
+	StartError() error
+}
+
+// HealthHandler reports service health and gates routes that need P2P
+type HealthHandler struct {
+	p2p P2PStatus
+}
+
+// NewHealthHandler creates a new health handler
+func NewHealthHandler(p2p P2PStatus) *HealthHandler {
+	return &HealthHandler{p2p: p2p}
+}
+
+// Health reports "healthy", or "degraded" while P2P is down: the API still
+// serves accounts and listings then, but not storage operations
+func (h *HealthHandler) Health(c *gin.Context) {
+	if h.p2p.Available() {
+		c.JSON(http.StatusOK, gin.H{"status": "healthy", "p2p": "available"})
+		return
+	}
+
+	resp := gin.H{"status": "degraded", "p2p": "unavailable"}
+	if err := h.p2p.StartError(); err != nil {
+		resp["p2p_error"] = err.Error()
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// RequireP2P refuses requests with 503 while P2P is down
+func (h *HealthHandler) RequireP2P(c *gin.Context) {
+	if !h.p2p.Available() {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "P2P unavailable; storage operations are disabled until it recovers"})
+		return
+	}
+	c.Next()
+}
@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeP2P struct {
+	available bool
+	err       error
+}
+
+func (f *fakeP2P) Available() bool { return f.available }
+
+func (f *fakeP2P) PeerID() string {
+	if !f.available {
+		return ""
+	}
+	return "12D3KooWCoordinator"
+}
+
+func (f *fakeP2P) StartError() error { return f.err }
+
+func TestHealth_DegradedWithoutP2P(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	p2p := &fakeP2P{err: errors.New("failed to create libp2p host: address in use")}
+	handler := NewHealthHandler(p2p)
+	router := gin.New()
+	router.GET("/health", handler.Health)
+	router.GET("/files", func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{}) })
+	router.POST("/files", handler.RequireP2P, func(c *gin.Context) { c.JSON(http.StatusCreated, gin.H{}) })
+
+	get := func(method, path string) (int, map[string]string) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		var body map[string]string
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		return w.Code, body
+	}
+
+	code, body := get(http.MethodGet, "/health")
+	assert.Equal(t, http.StatusOK, code, "A degraded coordinator still serves the API")
+	assert.Equal(t, "degraded", body["status"])
+	assert.Equal(t, "unavailable", body["p2p"])
+	assert.Contains(t, body["p2p_error"], "address in use")
+
+	code, _ = get(http.MethodGet, "/files")
+	assert.Equal(t, http.StatusOK, code, "Routes not needing P2P keep working")
+	code, body = get(http.MethodPost, "/files")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Contains(t, body["error"], "P2P unavailable")
+
+	// Once the retry brings P2P up, everything is back
+	p2p.available, p2p.err = true, nil
+	code, body = get(http.MethodGet, "/health")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "healthy", body["status"])
+	assert.Empty(t, body["p2p_error"])
+	code, _ = get(http.MethodPost, "/files")
+	assert.Equal(t, http.StatusCreated, code)
+}
@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/federated-storage/coordinator/internal/services"
+	"github.com/gin-gonic/gin"
+)
+
+// InviteTokenHeader carries a node's invite token on registration
+const InviteTokenHeader = "X-Invite-Token"
+
+// InviteHandler issues node invites and gates registration on them
+type InviteHandler struct {
+	invites          *services.InviteService
+	openRegistration bool
+}
+
+// NewInviteHandler creates a new invite handler. With openRegistration set,
+// nodes may register without an invite.
+func NewInviteHandler(invites *services.InviteService, openRegistration bool) *InviteHandler {
+	return &InviteHandler{invites: invites, openRegistration: openRegistration}
+}
+
+// CreateInviteRequest describes an invite to mint
+type CreateInviteRequest struct {
+	Note           string `json:"note" binding:"max=200"`
+	ExpiresInHours int    `json:"expires_in_hours" binding:"min=0"`
+}
+
+// CreateInvite mints a one-time node invite token. The token is only ever
+// shown in this response.
+func (h *InviteHandler) CreateInvite(c *gin.Context) {
+	var req CreateInviteRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			respondBindError(c, err)
+			return
+		}
+	}
+
+	token, invite, err := h.invites.CreateInvite(c.Request.Context(), req.Note, time.Duration(req.ExpiresInHours)*time.Hour)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"token":  token,
+		"invite": invite,
+	})
+}
+
+// RequireInvite admits a registration only with a valid invite token unless
+// registration is open. The invite is spent up front so concurrent attempts
+// can't share it, and given back if the registration does not succeed.
+func (h *InviteHandler) RequireInvite(c *gin.Context) {
+	if h.openRegistration {
+		c.Next()
+		return
+	}
+
+	invite, err := h.invites.Redeem(c.Request.Context(), c.GetHeader(InviteTokenHeader))
+	if err != nil {
+		if errors.Is(err, services.ErrInvalidInvite) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "registration requires a valid invite token"})
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Next()
+
+	if status := c.Writer.Status(); status < 200 || status > 299 {
+		h.invites.Restore(context.Background(), invite)
+	}
+}
@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/federated-storage/coordinator/internal/services"
+	"github.com/federated-storage/coordinator/internal/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequireInvite(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	// newRouter stands a stub in for registration, failing with registerStatus
+	newRouter := func(open bool, registerStatus *int) (*gin.Engine, *services.InviteService) {
+		invites := services.NewInviteService(storage.NewMemoryStore())
+		handler := NewInviteHandler(invites, open)
+		router := gin.New()
+		router.POST("/admin/nodes/invites", handler.CreateInvite)
+		router.POST("/nodes/register", handler.RequireInvite, func(c *gin.Context) {
+			c.JSON(*registerStatus, gin.H{})
+		})
+		return router, invites
+	}
+	register := func(router *gin.Engine, token string) int {
+		req := httptest.NewRequest(http.MethodPost, "/nodes/register", nil)
+		if token != "" {
+			req.Header.Set(InviteTokenHeader, token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	t.Run("open registration needs no invite", func(t *testing.T) {
+		status := http.StatusCreated
+		router, _ := newRouter(true, &status)
+		assert.Equal(t, http.StatusCreated, register(router, ""))
+	})
+
+	t.Run("closed registration admits a valid invite once", func(t *testing.T) {
+		status := http.StatusCreated
+		router, _ := newRouter(false, &status)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/admin/nodes/invites",
+			bytes.NewBufferString(`{"note": "rack 4", "expires_in_hours": 24}`)))
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		var resp struct {
+			Token  string `json:"token"`
+			Invite struct {
+				Note string `json:"note"`
+			} `json:"invite"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, "rack 4", resp.Invite.Note)
+
+		assert.Equal(t, http.StatusCreated, register(router, resp.Token))
+		assert.Equal(t, http.StatusForbidden, register(router, resp.Token), "Invites are single use")
+	})
+
+	t.Run("closed registration rejects missing and unknown invites", func(t *testing.T) {
+		status := http.StatusCreated
+		router, _ := newRouter(false, &status)
+		assert.Equal(t, http.StatusForbidden, register(router, ""))
+		assert.Equal(t, http.StatusForbidden, register(router, "fsi_not-a-real-token"))
+	})
+
+	t.Run("failed registration gives the invite back", func(t *testing.T) {
+		status := http.StatusConflict
+		router, invites := newRouter(false, &status)
+		token, _, err := invites.CreateInvite(context.Background(), "", 0)
+		require.NoError(t, err)
+
+		assert.Equal(t, http.StatusConflict, register(router, token))
+		status = http.StatusCreated
+		assert.Equal(t, http.StatusCreated, register(router, token))
+	})
+}
@@ -1,39 +1,100 @@
 package handlers
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 
+	"github.com/federated-storage/coordinator/internal/p2p"
 	"github.com/federated-storage/coordinator/internal/services"
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 )
 
 // NodeHandler handles storage node requests
 type NodeHandler struct {
-	nodeService *services.NodeService
+	nodeService      *services.NodeService
+	chunkService     *services.ChunkService
+	p2p              P2PStatus
+	leaderboardNames bool          // show node names and IDs on the public leaderboard
+	rotation         *p2p.Rotation // the signed move to the current peer ID, if the identity was rotated
 }
 
-// NewNodeHandler creates a new node handler
-func NewNodeHandler(nodeService *services.NodeService) *NodeHandler {
-	return &NodeHandler{nodeService: nodeService}
+// NewNodeHandler creates a new node handler. The coordinator's peer ID is
+// handed to nodes at registration so they only accept P2P streams from it.
+func NewNodeHandler(nodeService *services.NodeService, chunkService *services.ChunkService, p2p P2PStatus, leaderboardNames bool) *NodeHandler {
+	return &NodeHandler{nodeService: nodeService, chunkService: chunkService, p2p: p2p, leaderboardNames: leaderboardNames}
+}
+
+// SetIdentityRotation has heartbeat responses carry rotation, so nodes pinned
+// to the coordinator's previous peer ID can check the move to the current one
+func (h *NodeHandler) SetIdentityRotation(rotation *p2p.Rotation) {
+	h.rotation = rotation
 }
 
 // Register handles node registration
 func (h *NodeHandler) Register(c *gin.Context) {
 	var req services.RegisterNodeRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondBindError(c, err)
 		return
 	}
 
 	node, apiKey, err := h.nodeService.RegisterNode(c.Request.Context(), req)
 	if err != nil {
+		if errors.Is(err, services.ErrNodeVersionTooOld) {
+			c.JSON(http.StatusUpgradeRequired, gin.H{"error": err.Error()})
+			return
+		}
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
 	c.JSON(http.StatusCreated, services.RegisterNodeResponse{
-		NodeID: node.ID.String(),
-		APIKey: apiKey,
+		NodeID:            node.ID.String(),
+		APIKey:            apiKey,
+		CoordinatorPeerID: h.p2p.PeerID(),
+	})
+}
+
+// BulkRegisterRequest is an operator's batch of nodes to pre-register
+type BulkRegisterRequest struct {
+	Nodes []services.BulkNodeDescriptor `json:"nodes" binding:"required,min=1,max=500,dive"`
+}
+
+// BulkRegister handles registering many operator-provisioned nodes at once.
+// The batch is all-or-nothing: on any conflicting peer ID nothing is registered.
+func (h *NodeHandler) BulkRegister(c *gin.Context) {
+	var req BulkRegisterRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	reqs := make([]services.RegisterNodeRequest, len(req.Nodes))
+	for i, d := range req.Nodes {
+		reqs[i] = d.RegisterRequest()
+	}
+
+	results, err := h.nodeService.RegisterNodesBulk(c.Request.Context(), reqs)
+	if err != nil {
+		if errors.Is(err, services.ErrBulkRegisterRejected) {
+			c.JSON(http.StatusConflict, gin.H{
+				"error": "batch rejected, no nodes were registered",
+				"nodes": results,
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"registered":          len(results),
+		"coordinator_peer_id": h.p2p.PeerID(),
+		"nodes":               results,
 	})
 }
 
@@ -48,9 +109,42 @@ func (h *NodeHandler) ListNodes(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"nodes": nodes})
 }
 
+// maxLeaderboardEntries bounds how many nodes one leaderboard request returns
+const maxLeaderboardEntries = 500
+
+// Leaderboard handles the public ranking of nodes by credits earned, proof
+// success and uptime over ?period= (day, week, month or all; default month)
+func (h *NodeHandler) Leaderboard(c *gin.Context) {
+	period := c.DefaultQuery("period", "month")
+	since, err := services.LeaderboardSince(period, time.Now())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	limit := 50
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxLeaderboardEntries {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxLeaderboardEntries)})
+			return
+		}
+		limit = n
+	}
+
+	entries, err := h.nodeService.Leaderboard(c.Request.Context(), since, limit, h.leaderboardNames)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load leaderboard"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"period": period, "nodes": entries})
+}
+
 // HeartbeatRequest represents a heartbeat request
 type HeartbeatRequest struct {
-	UsedStorageBytes int64 `json:"used_storage_bytes"`
+	UsedStorageBytes int64  `json:"used_storage_bytes"`
+	Version          string `json:"version"`
 }
 
 // Heartbeat handles node heartbeat
@@ -63,7 +157,55 @@ func (h *NodeHandler) Heartbeat(c *gin.Context) {
 
 	var req HeartbeatRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondBindError(c, err)
+		return
+	}
+
+	node, err := h.nodeService.GetNodeByPeerID(c.Request.Context(), peerID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "node not found"})
+		return
+	}
+
+	err = h.nodeService.UpdateHeartbeat(c.Request.Context(), node.ID, req.UsedStorageBytes, req.Version)
+	if err != nil {
+		if errors.Is(err, services.ErrNodeVersionTooOld) {
+			c.JSON(http.StatusUpgradeRequired, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Nodes follow the coordinator's peer ID from here when it is rotated,
+	// once the rotation checks out against the peer ID they have pinned
+	resp := gin.H{
+		"status":              "ok",
+		"earned_credits":      node.EarnedCredits,
+		"coordinator_peer_id": h.p2p.PeerID(),
+	}
+	if h.rotation != nil {
+		resp["coordinator_rotation"] = h.rotation
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// UpdateCapacityRequest carries a node's new total capacity
+type UpdateCapacityRequest struct {
+	TotalStorageGB int `json:"total_storage_gb" binding:"required,min=1"`
+}
+
+// UpdateCapacity handles a node reporting a change in its total capacity
+func (h *NodeHandler) UpdateCapacity(c *gin.Context) {
+	peerID := c.GetHeader("X-Peer-ID")
+	if peerID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing peer id"})
+		return
+	}
+
+	var req UpdateCapacityRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
 		return
 	}
 
@@ -73,18 +215,195 @@ func (h *NodeHandler) Heartbeat(c *gin.Context) {
 		return
 	}
 
-	err = h.nodeService.UpdateHeartbeat(c.Request.Context(), node.ID, req.UsedStorageBytes)
+	totalBytes, err := h.nodeService.UpdateCapacity(c.Request.Context(), node.ID, req.TotalStorageGB)
+	if err != nil {
+		if errors.Is(err, services.ErrCapacityBelowUsage) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":              "ok",
+		"total_storage_bytes": totalBytes,
+	})
+}
+
+// MaintenanceRequest schedules a node's maintenance window (RFC 3339 times)
+type MaintenanceRequest struct {
+	Start time.Time `json:"start" binding:"required"`
+	End   time.Time `json:"end" binding:"required"`
+}
+
+// ScheduleMaintenance handles a node announcing when it will be offline. The
+// node is drained ahead of the window and gets no new chunks until it ends.
+func (h *NodeHandler) ScheduleMaintenance(c *gin.Context) {
+	peerID := c.GetHeader("X-Peer-ID")
+	if peerID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing peer id"})
+		return
+	}
+
+	var req MaintenanceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	node, err := h.nodeService.GetNodeByPeerID(c.Request.Context(), peerID)
 	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "node not found"})
+		return
+	}
+
+	if err := h.nodeService.SetMaintenanceWindow(c.Request.Context(), node.ID, req.Start, req.End); err != nil {
+		if errors.Is(err, services.ErrInvalidMaintenanceWindow) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"status":         "ok",
-		"earned_credits": node.EarnedCredits,
+		"status":            "scheduled",
+		"maintenance_start": req.Start,
+		"maintenance_end":   req.End,
 	})
 }
 
+// CancelMaintenance handles a node withdrawing its maintenance window
+func (h *NodeHandler) CancelMaintenance(c *gin.Context) {
+	peerID := c.GetHeader("X-Peer-ID")
+	if peerID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing peer id"})
+		return
+	}
+
+	node, err := h.nodeService.GetNodeByPeerID(c.Request.Context(), peerID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "node not found"})
+		return
+	}
+
+	if err := h.nodeService.ClearMaintenanceWindow(c.Request.Context(), node.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "canceled"})
+}
+
+// RotateKey handles a node replacing its API key. The new key is returned
+// only in this response; the old key is rejected from now on.
+func (h *NodeHandler) RotateKey(c *gin.Context) {
+	peerID := c.GetHeader("X-Peer-ID")
+	if peerID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing peer id"})
+		return
+	}
+
+	node, err := h.nodeService.GetNodeByPeerID(c.Request.Context(), peerID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "node not found"})
+		return
+	}
+
+	apiKey, err := h.nodeService.RotateAPIKey(c.Request.Context(), node.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"api_key": apiKey})
+}
+
+// ReconcileRequest carries a node's chunk inventory, either as a plain list or
+// packed (base64 of concatenated 16-byte chunk IDs) for large sets. A node
+// holding nothing sends an empty packed_chunk_ids, so it is the field being
+// present, not empty, that makes a request packed.
+type ReconcileRequest struct {
+	ChunkIDs       []string `json:"chunk_ids"`
+	PackedChunkIDs *string  `json:"packed_chunk_ids"`
+}
+
+// heldChunkIDs parses a chunk inventory sent plain, packed or both
+func heldChunkIDs(chunkIDs []string, packed *string) ([]uuid.UUID, error) {
+	var held []uuid.UUID
+	if packed != nil {
+		ids, err := services.UnpackChunkIDs(*packed)
+		if err != nil {
+			return nil, err
+		}
+		held = ids
+	}
+	for _, idStr := range chunkIDs {
+		id, err := uuid.Parse(idStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid chunk id %q", idStr)
+		}
+		held = append(held, id)
+	}
+	return held, nil
+}
+
+// Reconcile handles comparing a node's chunk inventory with what the coordinator expects it to hold
+func (h *NodeHandler) Reconcile(c *gin.Context) {
+	peerID := c.GetHeader("X-Peer-ID")
+	if peerID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing peer id"})
+		return
+	}
+
+	var req ReconcileRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	held, err := heldChunkIDs(req.ChunkIDs, req.PackedChunkIDs)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	node, err := h.nodeService.GetNodeByPeerID(c.Request.Context(), peerID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "node not found"})
+		return
+	}
+
+	diff, err := h.nodeService.Reconcile(c.Request.Context(), node.ID, held)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Answer in the same representation the node used
+	resp := gin.H{
+		"missing_count": len(diff.Missing),
+		"extra_count":   len(diff.Extra),
+	}
+	if req.PackedChunkIDs != nil {
+		resp["packed_missing"] = services.PackChunkIDs(diff.Missing)
+		resp["packed_extra"] = services.PackChunkIDs(diff.Extra)
+	} else {
+		resp["missing"] = chunkIDStrings(diff.Missing)
+		resp["extra"] = chunkIDStrings(diff.Extra)
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func chunkIDStrings(ids []uuid.UUID) []string {
+	out := make([]string, len(ids))
+	for i, id := range ids {
+		out[i] = id.String()
+	}
+	return out
+}
+
 // GetBalance handles getting node balance/earnings
 func (h *NodeHandler) GetBalance(c *gin.Context) {
 	peerID := c.GetHeader("X-Peer-ID")
@@ -106,3 +425,121 @@ func (h *NodeHandler) GetBalance(c *gin.Context) {
 		"uptime_percentage":  node.UptimePercentage,
 	})
 }
+
+// maxChunkPage bounds how many chunks one GET /nodes/chunks request returns
+const maxChunkPage = 1000
+
+// AssignedChunk is a chunk the coordinator expects a node to hold
+type AssignedChunk struct {
+	ChunkID   uuid.UUID `json:"chunk_id"`
+	Hash      string    `json:"hash"`
+	SizeBytes int       `json:"size_bytes"`
+}
+
+// ListChunks returns a page of the chunks assigned to the calling node, in
+// chunk ID order. ?after= takes the previous page's next_after; next_after is
+// omitted on the last page.
+func (h *NodeHandler) ListChunks(c *gin.Context) {
+	peerID := c.GetHeader("X-Peer-ID")
+	if peerID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing peer id"})
+		return
+	}
+	after, limit, ok := chunkPageParams(c)
+	if !ok {
+		return
+	}
+
+	node, err := h.nodeService.GetNodeByPeerID(c.Request.Context(), peerID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "node not found"})
+		return
+	}
+	h.writeChunkPage(c, node.ID, after, limit)
+}
+
+// chunkPageParams reads ?after= and ?limit=, answering 400 and returning
+// false if either is invalid
+func chunkPageParams(c *gin.Context) (uuid.UUID, int, bool) {
+	limit := 100
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxChunkPage {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxChunkPage)})
+			return uuid.Nil, 0, false
+		}
+		limit = n
+	}
+	after := uuid.Nil
+	if v := c.Query("after"); v != "" {
+		id, err := uuid.Parse(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "after must be a chunk id"})
+			return uuid.Nil, 0, false
+		}
+		after = id
+	}
+	return after, limit, true
+}
+
+// writeChunkPage answers with up to limit of nodeID's chunks following after
+func (h *NodeHandler) writeChunkPage(c *gin.Context, nodeID, after uuid.UUID, limit int) {
+	// One extra row tells whether another page follows
+	chunks, err := h.chunkService.ListNodeChunkPage(c.Request.Context(), nodeID, after, limit+1)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list chunks"})
+		return
+	}
+
+	resp := gin.H{}
+	if len(chunks) > limit {
+		chunks = chunks[:limit]
+		resp["next_after"] = chunks[limit-1].ID
+	}
+	page := make([]AssignedChunk, len(chunks))
+	for i, chunk := range chunks {
+		page[i] = AssignedChunk{ChunkID: chunk.ID, Hash: chunk.Hash, SizeBytes: chunk.SizeBytes}
+	}
+	resp["chunks"] = page
+	c.JSON(http.StatusOK, resp)
+}
+
+// maxReputationHistory bounds how many snapshots one reputation request returns
+const maxReputationHistory = 500
+
+// GetReputation returns the calling node's current reputation score and recent snapshots
+func (h *NodeHandler) GetReputation(c *gin.Context) {
+	peerID := c.GetHeader("X-Peer-ID")
+	if peerID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing peer id"})
+		return
+	}
+
+	limit := 30
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxReputationHistory {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxReputationHistory)})
+			return
+		}
+		limit = n
+	}
+
+	node, err := h.nodeService.GetNodeByPeerID(c.Request.Context(), peerID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "node not found"})
+		return
+	}
+
+	history, err := h.nodeService.GetReputationHistory(c.Request.Context(), node.ID, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load reputation history"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"node_id":          node.ID,
+		"reputation_score": node.ReputationScore,
+		"history":          history,
+	})
+}
@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/federated-storage/coordinator/internal/services"
+	"github.com/federated-storage/coordinator/internal/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReconcileRequest_PackedByPresence(t *testing.T) {
+	var empty ReconcileRequest
+	require.NoError(t, json.Unmarshal([]byte(`{"packed_chunk_ids": ""}`), &empty))
+	assert.NotNil(t, empty.PackedChunkIDs, "A node holding nothing still asked for a packed answer")
+	held, err := heldChunkIDs(empty.ChunkIDs, empty.PackedChunkIDs)
+	require.NoError(t, err)
+	assert.Empty(t, held)
+
+	var plain ReconcileRequest
+	require.NoError(t, json.Unmarshal([]byte(`{"chunk_ids": []}`), &plain))
+	assert.Nil(t, plain.PackedChunkIDs)
+
+	a, b := uuid.New(), uuid.New()
+	packed := services.PackChunkIDs([]uuid.UUID{a})
+	held, err = heldChunkIDs([]string{b.String()}, &packed)
+	require.NoError(t, err)
+	assert.Equal(t, []uuid.UUID{a, b}, held)
+
+	_, err = heldChunkIDs([]string{"not-a-uuid"}, nil)
+	assert.Error(t, err)
+	bad := "!!"
+	_, err = heldChunkIDs(nil, &bad)
+	assert.Error(t, err)
+}
+
+func TestListChunks_Pagination(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	chunkService := services.NewChunkService(store, nil, nil)
+	handler := &NodeHandler{chunkService: chunkService}
+
+	node, other := uuid.New(), uuid.New()
+	var want []uuid.UUID
+	for i := 0; i < 5; i++ {
+		chunk, err := chunkService.StoreChunk(ctx, uuid.New(), 0, []byte{byte(i)}, []uuid.UUID{node})
+		require.NoError(t, err)
+		want = append(want, chunk.ID)
+	}
+	_, err := chunkService.StoreChunk(ctx, uuid.New(), 0, []byte("elsewhere"), []uuid.UUID{other})
+	require.NoError(t, err)
+	slices.SortFunc(want, func(a, b uuid.UUID) int { return slices.Compare(a[:], b[:]) })
+
+	// The route stands in for ListChunks once the calling node is resolved
+	router := gin.New()
+	router.GET("/nodes/chunks", func(c *gin.Context) {
+		if after, limit, ok := chunkPageParams(c); ok {
+			handler.writeChunkPage(c, node, after, limit)
+		}
+	})
+	type page struct {
+		Chunks    []AssignedChunk `json:"chunks"`
+		NextAfter *uuid.UUID      `json:"next_after"`
+	}
+	get := func(query string) (int, page) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/nodes/chunks"+query, nil))
+		var p page
+		if w.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &p))
+		}
+		return w.Code, p
+	}
+
+	var got []uuid.UUID
+	var sizes []int
+	query := "?limit=2"
+	for pages := 0; ; pages++ {
+		require.Less(t, pages, 3, "Five chunks fit in three pages of two")
+		code, p := get(query)
+		require.Equal(t, http.StatusOK, code)
+		for _, chunk := range p.Chunks {
+			got = append(got, chunk.ChunkID)
+			sizes = append(sizes, len(p.Chunks))
+		}
+		if p.NextAfter == nil {
+			break
+		}
+		assert.Equal(t, p.Chunks[len(p.Chunks)-1].ChunkID, *p.NextAfter)
+		query = "?limit=2&after=" + p.NextAfter.String()
+	}
+	assert.Equal(t, want, got, "Every chunk of the node once, in ID order, and none of another node's")
+	assert.Equal(t, []int{2, 2, 2, 2, 1}, sizes)
+
+	code, p := get("")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Len(t, p.Chunks, 5)
+	assert.Nil(t, p.NextAfter, "A page holding everything is the last")
+
+	for _, query := range []string{"?limit=0", "?limit=1001", "?limit=x", "?after=not-a-chunk"} {
+		code, _ := get(query)
+		assert.Equal(t, http.StatusBadRequest, code, query)
+	}
+}
@@ -0,0 +1,24 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/federated-storage/coordinator/internal/services"
+	"github.com/gin-gonic/gin"
+)
+
+// PricingHandler publishes the server's storage pricing
+type PricingHandler struct {
+	rates services.StorageRates
+}
+
+// NewPricingHandler creates a new pricing handler
+func NewPricingHandler(rates services.StorageRates) *PricingHandler {
+	return &PricingHandler{rates: rates}
+}
+
+// GetPricing returns the storage rate, replica count, chunk size and file size
+// limit. It needs no authentication so UIs can show prices before sign-in.
+func (h *PricingHandler) GetPricing(c *gin.Context) {
+	c.JSON(http.StatusOK, h.rates)
+}
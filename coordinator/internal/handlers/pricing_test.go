@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/federated-storage/coordinator/internal/services"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetPricing_ReflectsConfig(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	pricing := services.NewPricing(1000, []services.PricingTier{{MinUSD: 100, CreditsPerUSD: 1100}})
+	handler := NewPricingHandler(services.NewStorageRates(250, 2, 64*1024, 1024*1024, 10, pricing))
+	router := gin.New()
+	router.GET("/pricing", handler.GetPricing)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/pricing", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var body struct {
+		CreditsPerGBMonth int64 `json:"storage_credits_per_gb_month"`
+		DefaultReplicas   int   `json:"default_replicas"`
+		ChunkSizeBytes    int64 `json:"chunk_size_bytes"`
+		MaxChunkSizeBytes int64 `json:"max_chunk_size_bytes"`
+		MaxFileSizeBytes  int64 `json:"max_file_size_bytes"`
+		CreditsPerUSD     int64 `json:"credits_per_usd"`
+		Tiers             []struct {
+			MinUSD        int   `json:"min_usd"`
+			CreditsPerUSD int64 `json:"credits_per_usd"`
+		} `json:"tiers"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, int64(250), body.CreditsPerGBMonth)
+	assert.Equal(t, 2, body.DefaultReplicas)
+	assert.Equal(t, int64(64*1024), body.ChunkSizeBytes)
+	assert.Equal(t, int64(1024*1024), body.MaxChunkSizeBytes)
+	assert.Equal(t, int64(10*1024*1024), body.MaxFileSizeBytes, "Sessions may ask for the largest chunk size")
+	assert.Equal(t, int64(1000), body.CreditsPerUSD)
+	require.Len(t, body.Tiers, 1)
+	assert.Equal(t, 100, body.Tiers[0].MinUSD)
+	assert.Equal(t, int64(1100), body.Tiers[0].CreditsPerUSD)
+}
@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/federated-storage/coordinator/internal/models"
+	"github.com/federated-storage/coordinator/internal/services"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// ProofHandler lets nodes retry proofs they failed while unreachable
+type ProofHandler struct {
+	proofService *services.ProofService
+	nodeService  *services.NodeService
+}
+
+// NewProofHandler creates a new proof handler
+func NewProofHandler(proofService *services.ProofService, nodeService *services.NodeService) *ProofHandler {
+	return &ProofHandler{proofService: proofService, nodeService: nodeService}
+}
+
+// RetryProofsRequest lists the chunks a node holds, plain or packed as in reconcile
+type RetryProofsRequest struct {
+	ChunkIDs       []string `json:"chunk_ids"`
+	PackedChunkIDs *string  `json:"packed_chunk_ids"`
+}
+
+// RetryAnswerRequest is a node's answer to a proof retry
+type RetryAnswerRequest struct {
+	ProofHash   string              `json:"proof_hash" binding:"required"`
+	DurationMs  int                 `json:"duration_ms"`
+	MerkleProof *models.MerkleProof `json:"merkle_proof"`
+}
+
+// RetryProofs re-issues the node's recently failed challenges for chunks it
+// says it holds, within its retry allowance
+func (h *ProofHandler) RetryProofs(c *gin.Context) {
+	peerID := c.GetHeader("X-Peer-ID")
+	if peerID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing peer id"})
+		return
+	}
+
+	var req RetryProofsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	held, err := heldChunkIDs(req.ChunkIDs, req.PackedChunkIDs)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	node, err := h.nodeService.GetNodeByPeerID(c.Request.Context(), peerID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "node not found"})
+		return
+	}
+
+	retries, err := h.proofService.ReissueFailedChallenges(c.Request.Context(), node.ID, held)
+	if err != nil {
+		if errors.Is(err, services.ErrProofRetryLimit) {
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if retries == nil {
+		retries = []services.ProofRetry{}
+	}
+	c.JSON(http.StatusOK, gin.H{"retries": retries})
+}
+
+// AnswerRetry verifies the node's answer to a proof retry. A pass excuses the
+// failure it retried; a wrong answer is 422.
+func (h *ProofHandler) AnswerRetry(c *gin.Context) {
+	peerID := c.GetHeader("X-Peer-ID")
+	if peerID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing peer id"})
+		return
+	}
+	challengeID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid challenge id"})
+		return
+	}
+
+	var req RetryAnswerRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	node, err := h.nodeService.GetNodeByPeerID(c.Request.Context(), peerID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "node not found"})
+		return
+	}
+
+	err = h.proofService.AnswerRetry(c.Request.Context(), node.ID, challengeID, req.ProofHash, req.DurationMs, req.MerkleProof)
+	switch {
+	case errors.Is(err, services.ErrUnknownRetry):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrProofRetryFailed):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusOK, gin.H{"challenge_id": challengeID, "status": "verified", "excused": true})
+	}
+}
@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/federated-storage/coordinator/internal/models"
+	"github.com/gin-gonic/gin"
+)
+
+// ReadOnlyStore saves read-only mode so it survives restarts
+type ReadOnlyStore interface {
+	GetReadOnlyMode(ctx context.Context) (*models.ReadOnlyMode, error)
+	SetReadOnlyMode(ctx context.Context, mode *models.ReadOnlyMode) error
+}
+
+// ReadOnlyHandler switches the coordinator in and out of read-only mode, for
+// migrations and incidents, and refuses writes while it is on
+type ReadOnlyHandler struct {
+	mu      sync.RWMutex
+	enabled bool
+	reason  string
+	since   time.Time
+	store   ReadOnlyStore // nil keeps the mode in memory only
+}
+
+// NewReadOnlyHandler creates a read-only switch, starting in read-only mode if enabled
+func NewReadOnlyHandler(enabled bool) *ReadOnlyHandler {
+	h := &ReadOnlyHandler{}
+	h.set(context.Background(), enabled, "")
+	return h
+}
+
+// Restore takes up the mode last saved in store, unless the switch already
+// started read-only, and saves every later change there
+func (h *ReadOnlyHandler) Restore(ctx context.Context, store ReadOnlyStore) error {
+	saved, err := store.GetReadOnlyMode(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load read-only mode: %w", err)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.store = store
+	if saved != nil && !h.enabled {
+		h.enabled, h.reason, h.since = saved.Enabled, saved.Reason, saved.Since
+	}
+	return nil
+}
+
+// set changes the mode once it is saved
+func (h *ReadOnlyHandler) set(ctx context.Context, enabled bool, reason string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	since := h.since
+	if enabled != h.enabled {
+		since = time.Now()
+	}
+	if h.store != nil {
+		if err := h.store.SetReadOnlyMode(ctx, &models.ReadOnlyMode{Enabled: enabled, Reason: reason, Since: since}); err != nil {
+			return fmt.Errorf("failed to save read-only mode: %w", err)
+		}
+	}
+	h.enabled, h.reason, h.since = enabled, reason, since
+	return nil
+}
+
+// Enabled reports whether the coordinator is read-only
+func (h *ReadOnlyHandler) Enabled() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.enabled
+}
+
+func (h *ReadOnlyHandler) status() gin.H {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	status := gin.H{"read_only": h.enabled}
+	if h.enabled {
+		status["since"] = h.since
+		if h.reason != "" {
+			status["reason"] = h.reason
+		}
+	}
+	return status
+}
+
+// RejectWrites refuses requests other than GET, HEAD and OPTIONS with 503
+// while the coordinator is read-only; reads pass through
+func (h *ReadOnlyHandler) RejectWrites(c *gin.Context) {
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		c.Next()
+		return
+	}
+	if !h.Enabled() {
+		c.Next()
+		return
+	}
+	resp := h.status()
+	resp["error"] = "coordinator is in read-only mode; uploads, deletes and credit changes are disabled until it ends"
+	c.AbortWithStatusJSON(http.StatusServiceUnavailable, resp)
+}
+
+// RejectWritesExcept is RejectWrites for a route group whose routes at the
+// given full paths keep taking writes while the coordinator is read-only
+func (h *ReadOnlyHandler) RejectWritesExcept(paths ...string) gin.HandlerFunc {
+	exempt := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		exempt[path] = true
+	}
+	return func(c *gin.Context) {
+		if exempt[c.FullPath()] {
+			c.Next()
+			return
+		}
+		h.RejectWrites(c)
+	}
+}
+
+// ReadOnlyRequest turns read-only mode on or off
+type ReadOnlyRequest struct {
+	Enabled *bool  `json:"enabled" binding:"required"`
+	Reason  string `json:"reason" binding:"max=500"` // shown to refused clients
+}
+
+// GetReadOnly reports whether the coordinator is read-only, since when and why
+func (h *ReadOnlyHandler) GetReadOnly(c *gin.Context) {
+	c.JSON(http.StatusOK, h.status())
+}
+
+// SetReadOnly turns read-only mode on or off
+func (h *ReadOnlyHandler) SetReadOnly(c *gin.Context) {
+	var req ReadOnlyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	if err := h.set(c.Request.Context(), *req.Enabled, req.Reason); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, h.status())
+}
@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/federated-storage/coordinator/internal/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadOnly_RejectsWritesButServesReads(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	handler := NewReadOnlyHandler(false)
+	router := gin.New()
+	router.GET("/admin/read-only", handler.GetReadOnly)
+	router.PUT("/admin/read-only", handler.SetReadOnly)
+	files := router.Group("/files", handler.RejectWrites)
+	files.GET("/:id", func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{"id": c.Param("id")}) })
+	files.POST("", func(c *gin.Context) { c.JSON(http.StatusCreated, gin.H{}) })
+	files.DELETE("/:id", func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{}) })
+
+	do := func(method, path, body string) (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+		var resp map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return w.Code, resp
+	}
+
+	code, _ := do(http.MethodPost, "/files", "")
+	assert.Equal(t, http.StatusCreated, code, "Writes pass while read-only mode is off")
+
+	code, resp := do(http.MethodPut, "/admin/read-only", `{"enabled": true, "reason": "database migration"}`)
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, true, resp["read_only"])
+	assert.True(t, handler.Enabled())
+
+	code, resp = do(http.MethodPost, "/files", "")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Contains(t, resp["error"], "read-only")
+	assert.Equal(t, "database migration", resp["reason"])
+	code, _ = do(http.MethodDelete, "/files/abc", "")
+	assert.Equal(t, http.StatusServiceUnavailable, code, "Deletes are writes too")
+
+	code, resp = do(http.MethodGet, "/files/abc", "")
+	assert.Equal(t, http.StatusOK, code, "Reads keep working in read-only mode")
+	assert.Equal(t, "abc", resp["id"])
+
+	code, _ = do(http.MethodPut, "/admin/read-only", `{"reason": "no flag"}`)
+	assert.Equal(t, http.StatusBadRequest, code, "The toggle needs an explicit enabled flag")
+
+	code, resp = do(http.MethodPut, "/admin/read-only", `{"enabled": false}`)
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, false, resp["read_only"])
+	code, _ = do(http.MethodPost, "/files", "")
+	assert.Equal(t, http.StatusCreated, code, "Writes resume once read-only mode ends")
+}
+
+func TestReadOnly_ExemptRoutesKeepTakingWrites(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	handler := NewReadOnlyHandler(true)
+	router := gin.New()
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	auth := router.Group("/auth", handler.RejectWritesExcept("/auth/login"))
+	auth.POST("/login", ok)
+	auth.POST("/register", ok)
+	nodes := router.Group("/nodes", handler.RejectWritesExcept("/nodes/heartbeat", "/nodes/reconcile"))
+	nodes.POST("/heartbeat", ok)
+	nodes.POST("/reconcile", ok)
+	nodes.POST("/register", ok)
+	nodes.POST("/proofs/retry/:id", ok)
+	nodes.GET("/chunks", ok)
+	admin := router.Group("/admin", handler.RejectWritesExcept("/admin/read-only"))
+	admin.PUT("/read-only", ok)
+	admin.POST("/rebalance", ok)
+	admin.POST("/nodes/bulk", ok)
+
+	tests := []struct {
+		method, path string
+		expectedCode int
+	}{
+		{http.MethodPost, "/auth/login", http.StatusOK},
+		{http.MethodPost, "/auth/register", http.StatusServiceUnavailable},
+		{http.MethodPost, "/nodes/heartbeat", http.StatusOK},
+		{http.MethodPost, "/nodes/reconcile", http.StatusOK},
+		{http.MethodPost, "/nodes/register", http.StatusServiceUnavailable},
+		{http.MethodPost, "/nodes/proofs/retry/abc", http.StatusServiceUnavailable},
+		{http.MethodGet, "/nodes/chunks", http.StatusOK},
+		{http.MethodPut, "/admin/read-only", http.StatusOK},
+		{http.MethodPost, "/admin/rebalance", http.StatusServiceUnavailable},
+		{http.MethodPost, "/admin/nodes/bulk", http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+		assert.Equal(t, tt.expectedCode, w.Code, "%s %s", tt.method, tt.path)
+	}
+}
+
+func TestReadOnly_SurvivesRestart(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+
+	handler := NewReadOnlyHandler(false)
+	require.NoError(t, handler.Restore(ctx, store))
+	assert.False(t, handler.Enabled(), "Nothing saved yet")
+	router := gin.New()
+	router.PUT("/admin/read-only", handler.SetReadOnly)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/admin/read-only", strings.NewReader(`{"enabled": true, "reason": "incident"}`)))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	restarted := NewReadOnlyHandler(false)
+	require.NoError(t, restarted.Restore(ctx, store))
+	assert.True(t, restarted.Enabled(), "A restart keeps the mode an operator set")
+	assert.Equal(t, "incident", restarted.status()["reason"])
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/admin/read-only", strings.NewReader(`{"enabled": false}`)))
+	require.Equal(t, http.StatusOK, w.Code)
+	restarted = NewReadOnlyHandler(false)
+	require.NoError(t, restarted.Restore(ctx, store))
+	assert.False(t, restarted.Enabled())
+
+	forced := NewReadOnlyHandler(true)
+	require.NoError(t, forced.Restore(ctx, store))
+	assert.True(t, forced.Enabled(), "Starting read-only from the config wins over a saved off")
+}
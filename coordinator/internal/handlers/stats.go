@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/federated-storage/coordinator/internal/services"
+	"github.com/gin-gonic/gin"
+)
+
+// statsCacheTTL is how long network statistics are served before they are
+// aggregated again. The endpoint is public and scans every node, file and
+// recent proof, so anyone polling it must not turn into as many scans.
+const statsCacheTTL = 30 * time.Second
+
+// NetworkStatsSource aggregates the network's statistics
+type NetworkStatsSource interface {
+	NetworkStats(ctx context.Context) (*services.NetworkStats, error)
+}
+
+// StatsHandler publishes aggregate network statistics
+type StatsHandler struct {
+	source NetworkStatsSource
+	now    func() time.Time
+
+	mu        sync.Mutex
+	cached    *services.NetworkStats
+	expiresAt time.Time
+}
+
+// NewStatsHandler creates a new stats handler
+func NewStatsHandler(source NetworkStatsSource) *StatsHandler {
+	return &StatsHandler{source: source, now: time.Now}
+}
+
+// GetStats returns active nodes, their capacity, stored files, chunks and
+// bytes, and the recent proof success rate. It needs no authentication so a
+// network dashboard can show it to anyone; answers are reused for
+// statsCacheTTL, and concurrent requests share one aggregation.
+func (h *StatsHandler) GetStats(c *gin.Context) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := h.now()
+	if h.cached == nil || !now.Before(h.expiresAt) {
+		stats, err := h.source.NetworkStats(c.Request.Context())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		h.cached, h.expiresAt = stats, now.Add(statsCacheTTL)
+	}
+
+	c.Header("Cache-Control", "public, max-age="+strconv.Itoa(int(h.expiresAt.Sub(now).Seconds())))
+	c.JSON(http.StatusOK, h.cached)
+}
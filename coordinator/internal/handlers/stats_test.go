@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/federated-storage/coordinator/internal/services"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingStats reports as many active nodes as it has been asked for stats
+type countingStats struct {
+	calls int
+}
+
+func (s *countingStats) NetworkStats(ctx context.Context) (*services.NetworkStats, error) {
+	s.calls++
+	return &services.NetworkStats{ActiveNodes: s.calls}, nil
+}
+
+func TestGetStats_ServedFromCacheUntilExpiry(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	source := &countingStats{}
+	handler := NewStatsHandler(source)
+	now := time.Now()
+	handler.now = func() time.Time { return now }
+	router := gin.New()
+	router.GET("/stats", handler.GetStats)
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/stats", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		return w
+	}
+
+	w := get()
+	assert.Contains(t, w.Body.String(), `"active_nodes":1`)
+	assert.Equal(t, "public, max-age=30", w.Header().Get("Cache-Control"))
+
+	now = now.Add(statsCacheTTL / 2)
+	w = get()
+	assert.Contains(t, w.Body.String(), `"active_nodes":1`, "Requests within the TTL reuse the last aggregation")
+	assert.Equal(t, "public, max-age=15", w.Header().Get("Cache-Control"))
+	assert.Equal(t, 1, source.calls)
+
+	now = now.Add(statsCacheTTL / 2)
+	assert.Contains(t, get().Body.String(), `"active_nodes":2`)
+	assert.Equal(t, 2, source.calls)
+}
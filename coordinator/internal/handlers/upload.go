@@ -1,11 +1,19 @@
 package handlers
 
 import (
+	"context"
 	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/federated-storage/coordinator/internal/middleware"
 	"github.com/federated-storage/coordinator/internal/services"
+	"github.com/federated-storage/coordinator/internal/storage"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 )
@@ -34,7 +42,7 @@ func NewUploadHandler(uploadService *services.UploadService, fileService *servic
 func (h *UploadHandler) InitiateUpload(c *gin.Context) {
 	var req services.InitiateUploadRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondBindError(c, err)
 		return
 	}
 
@@ -45,44 +53,76 @@ func (h *UploadHandler) InitiateUpload(c *gin.Context) {
 		return
 	}
 
-	// Check user credits
-	user, err := h.authService.GetUser(c.Request.Context(), userID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-
-	// Calculate required credits
+	// Hold the credits now so they can't be spent before the upload completes
 	requiredCredits := h.fileService.CalculateStorageCost(req.SizeBytes, h.replicas)
-	if user.Credits < requiredCredits {
-		c.JSON(http.StatusPaymentRequired, gin.H{
-			"error":             "insufficient credits",
-			"required_credits":  requiredCredits,
-			"available_credits": user.Credits,
-		})
+	if !h.holdCredits(c, userID, requiredCredits) {
 		return
 	}
 
-	session, err := h.uploadService.InitiateUpload(c.Request.Context(), userID, req)
+	session, err := h.uploadService.InitiateUpload(c.Request.Context(), userID, req, requiredCredits)
 	if err != nil {
+		h.authService.ReleaseCredits(context.Background(), userID, requiredCredits)
+		if errors.Is(err, services.ErrTooManyChunks) || errors.Is(err, services.ErrInvalidExpiry) ||
+			errors.Is(err, services.ErrInvalidFilename) || errors.Is(err, services.ErrDirectUploadsDisabled) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, services.ErrTooManyUploads) {
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, services.InitiateUploadResponse{
+	resp := services.InitiateUploadResponse{
 		SessionID:  session.ID.String(),
 		ChunkCount: session.ChunkCount,
-		ChunkSize:  256 * 1024, // 256KB
-	})
+		ChunkSize:  session.ChunkSize,
+	}
+	if session.Direct {
+		key, err := h.uploadService.SessionKey(session)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		resp.Cipher = session.Cipher
+		resp.EncryptionKey = base64.StdEncoding.EncodeToString(key)
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// holdCredits holds amount of the user's credits, writing the error response
+// and returning false if it can't
+func (h *UploadHandler) holdCredits(c *gin.Context, userID uuid.UUID, amount int64) bool {
+	err := h.authService.HoldCredits(c.Request.Context(), userID, amount)
+	if errors.Is(err, services.ErrInsufficientCredits) {
+		resp := gin.H{"error": "insufficient credits", "required_credits": amount}
+		if user, err := h.authService.GetUser(c.Request.Context(), userID); err == nil {
+			resp["available_credits"] = user.Credits
+		}
+		c.JSON(http.StatusPaymentRequired, resp)
+		return false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+	return true
 }
 
-// UploadChunkRequest represents a chunk upload request
+// UploadChunkRequest represents a chunk upload request. Direct sessions send
+// the encrypted chunk's hash and size instead of its data.
 type UploadChunkRequest struct {
 	ChunkIndex int    `json:"chunk_index" binding:"gte=0"`
 	Data       string `json:"data"`
+	Hash       string `json:"hash"`
+	SizeBytes  int64  `json:"size_bytes" binding:"gte=0"`
 }
 
-// UploadChunk handles chunk upload
+// UploadChunk handles chunk upload. For a direct session it stores nothing,
+// returning instead the nodes to send the chunk to and an authorization
+// they accept it under.
 func (h *UploadHandler) UploadChunk(c *gin.Context) {
 	sessionIDStr := c.Param("id")
 	sessionID, err := uuid.Parse(sessionIDStr)
@@ -93,7 +133,7 @@ func (h *UploadHandler) UploadChunk(c *gin.Context) {
 
 	var req UploadChunkRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondBindError(c, err)
 		return
 	}
 
@@ -116,9 +156,34 @@ func (h *UploadHandler) UploadChunk(c *gin.Context) {
 		c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
 		return
 	}
+	if session.Status != "active" {
+		c.JSON(http.StatusConflict, gin.H{"error": "upload session is not active"})
+		return
+	}
+
+	if session.Direct {
+		h.authorizeChunk(c, session, req)
+		return
+	}
+
+	// Decode base64 data from frontend; padding must be present and canonical
+	chunkData, err := base64.StdEncoding.Strict().DecodeString(req.Data)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid base64 data"})
+		return
+	}
+	if err := h.uploadService.CheckChunk(session, req.ChunkIndex, int64(len(chunkData))); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	fileID, ok := h.sessionFile(c, session)
+	if !ok {
+		return
+	}
 
 	// Select nodes for this chunk
-	nodes, err := h.chunkService.SelectNodesForChunks(c.Request.Context(), h.replicas)
+	nodes, err := h.chunkService.SelectNodesForChunks(c.Request.Context(), services.ChunkPlacementKey(fileID, req.ChunkIndex), h.replicas)
 	if err != nil {
 		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
 		return
@@ -130,48 +195,180 @@ func (h *UploadHandler) UploadChunk(c *gin.Context) {
 		nodeIDs[i] = node.ID
 	}
 
-	// Create file record if first chunk
-	var fileID uuid.UUID
-	if session.FileID == nil {
-		file, err := h.fileService.CreateFile(c.Request.Context(), userID, session.Filename, session.SizeBytes, "", session.EncryptionKey, session.ChunkCount)
-		if err != nil {
+	// Encrypt chunk
+	key, err := h.uploadService.SessionKey(session)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	encryptedData, err := services.SealChunk(services.Cipher(session.Cipher), chunkData, key, 0)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("encryption failed: %v", err)})
+		return
+	}
+
+	// Store chunk
+	_, err = h.chunkService.StoreChunk(c.Request.Context(), fileID, req.ChunkIndex, encryptedData, nodeIDs)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"chunk_index": req.ChunkIndex,
+		"status":      "stored",
+	})
+}
+
+// sessionFile returns the file a session's chunks belong to, creating its
+// record with the first chunk. On failure it writes the error response.
+func (h *UploadHandler) sessionFile(c *gin.Context, session *services.UploadSession) (uuid.UUID, bool) {
+	if session.FileID != nil {
+		return *session.FileID, true
+	}
+
+	file, err := h.fileService.CreateSessionFile(c.Request.Context(), session)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return uuid.Nil, false
+	}
+	if session.FileExpiresAt != nil {
+		if err := h.fileService.SetExpiry(c.Request.Context(), file.ID, session.FileExpiresAt); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
+			return uuid.Nil, false
 		}
-		fileID = file.ID
-		err = h.uploadService.UpdateSessionFileID(c.Request.Context(), sessionID, fileID)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+	if err := h.uploadService.UpdateSessionFileID(c.Request.Context(), session.ID, file.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return uuid.Nil, false
+	}
+	session.FileID = &file.ID
+	return file.ID, true
+}
+
+// StoreTarget is a node a direct upload sends a chunk to
+type StoreTarget struct {
+	NodeID  uuid.UUID `json:"node_id"`
+	PeerID  string    `json:"peer_id"`
+	Address string    `json:"address,omitempty"`
+}
+
+// authorizeChunk answers a direct session's chunk request with the nodes
+// chosen for the chunk and a signed authorization for them to store it
+func (h *UploadHandler) authorizeChunk(c *gin.Context, session *services.UploadSession, req UploadChunkRequest) {
+	if req.Data != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "direct uploads send the chunk to the nodes; give its hash and size_bytes instead of data"})
+		return
+	}
+	// Check the chunk before creating the file record for it
+	if err := h.uploadService.CheckDirectChunk(session, req.ChunkIndex, req.Hash, req.SizeBytes); err != nil {
+		if errors.Is(err, services.ErrDirectUploadsDisabled) {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
 			return
 		}
-	} else {
-		fileID = *session.FileID
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
-	// Decode base64 data from frontend
-	chunkData, err := base64.StdEncoding.DecodeString(req.Data)
+	fileID, ok := h.sessionFile(c, session)
+	if !ok {
+		return
+	}
+	nodes, err := h.chunkService.SelectNodesForChunks(c.Request.Context(), services.ChunkPlacementKey(fileID, req.ChunkIndex), h.replicas)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid base64 data"})
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Encrypt chunk
-	encryptedData, err := services.EncryptChunk(chunkData, session.EncryptionKey)
+	token, auth, err := h.uploadService.AuthorizeChunkStore(session, fileID, req.ChunkIndex, req.Hash, req.SizeBytes, nodes)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "encryption failed"})
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Store chunk
-	_, err = h.chunkService.StoreChunk(c.Request.Context(), fileID, req.ChunkIndex, encryptedData, nodeIDs)
+	targets := make([]StoreTarget, len(nodes))
+	for i, node := range nodes {
+		targets[i] = StoreTarget{NodeID: node.ID, PeerID: node.PeerID, Address: node.Address}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"chunk_index":   req.ChunkIndex,
+		"chunk_id":      auth.ChunkID,
+		"status":        "authorized",
+		"nodes":         targets,
+		"authorization": token,
+		"expires_at":    auth.ExpiresAt,
+	})
+}
+
+// ChunkStoredRequest reports a chunk a direct session's client stored on its
+// nodes, with the receipt each node answered the store with
+type ChunkStoredRequest struct {
+	Authorization string                  `json:"authorization" binding:"required"`
+	Receipts      []services.StoreReceipt `json:"receipts"`
+}
+
+// ChunkStored records a chunk a direct session's client stored on the nodes
+// its authorization named. Only nodes that signed a receipt for it are
+// recorded as holding it, and only the chunk's metadata and assignments are
+// kept.
+func (h *UploadHandler) ChunkStored(c *gin.Context) {
+	sessionID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid session id"})
+		return
+	}
+
+	var req ChunkStoredRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	userID, err := uuid.Parse(middleware.GetUserID(c))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+
+	session, err := h.uploadService.GetSession(c.Request.Context(), sessionID)
 	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+		return
+	}
+	if session.UserID != userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
+		return
+	}
+	if session.Status != "active" {
+		c.JSON(http.StatusConflict, gin.H{"error": "upload session is not active"})
+		return
+	}
+
+	_, chunk, nodeIDs, err := h.uploadService.VerifyChunkStored(session, req.Authorization, req.Receipts, time.Now())
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrInvalidStoreAuthorization), errors.Is(err, services.ErrInvalidStoreReceipt),
+			errors.Is(err, services.ErrDirectUploadsDisabled):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	if err := h.chunkService.RecordChunk(c.Request.Context(), chunk, nodeIDs); err != nil {
+		if errors.Is(err, storage.ErrConflict) {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("chunk %d is already stored", chunk.ChunkIndex)})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"chunk_index": req.ChunkIndex,
+		"chunk_index": chunk.ChunkIndex,
 		"status":      "stored",
+		"replicas":    len(nodeIDs),
 	})
 }
 
@@ -202,31 +399,351 @@ func (h *UploadHandler) CompleteUpload(c *gin.Context) {
 		return
 	}
 
-	// Deduct credits
-	requiredCredits := h.fileService.CalculateStorageCost(session.SizeBytes, h.replicas)
-	err = h.authService.UpdateCredits(c.Request.Context(), userID, -requiredCredits, "Storage payment for "+session.Filename)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	// Every chunk must be stored before the file can become ready
+	var missing []int
+	if session.FileID == nil {
+		for i := 0; i < session.ChunkCount; i++ {
+			missing = append(missing, i)
+		}
+	} else {
+		missing, err = h.fileService.MissingChunks(c.Request.Context(), *session.FileID, session.ChunkCount)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if len(missing) > 0 {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":          "upload is missing chunks",
+			"missing_chunks": missing,
+		})
 		return
 	}
 
-	// Update session status
-	err = h.uploadService.UpdateSessionStatus(c.Request.Context(), sessionID, "completed")
+	// The file is charged only for the replicas every chunk actually reached
+	charge, replicas := session.HeldCredits, h.replicas
+	if session.FileID != nil {
+		charge, replicas, err = h.replicaCharge(c.Request.Context(), *session.FileID, session.SizeBytes, session.HeldCredits)
+		if err != nil {
+			if errors.Is(err, services.ErrBelowReplicaFloor) {
+				c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	// Closing the session first means a repeated or concurrent completion
+	// can't capture the hold twice
+	closed, err := h.uploadService.CloseSession(c.Request.Context(), sessionID, "completed")
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	if !closed {
+		c.JSON(http.StatusConflict, gin.H{"error": "upload session is not active"})
+		return
+	}
 
+	// The file is marked ready before the hold is captured, so a user is
+	// never charged for a file that didn't become ready. Any failure reopens
+	// the session with its hold intact for the client to complete again.
+	reopen := func() {
+		h.uploadService.UpdateSessionStatus(context.Background(), sessionID, "active")
+	}
 	if session.FileID != nil {
-		err = h.fileService.MarkFileComplete(c.Request.Context(), *session.FileID)
-		if err != nil {
+		if err := h.fileService.SetReplicas(c.Request.Context(), *session.FileID, replicas); err != nil {
+			reopen()
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
+		if err := h.fileService.MarkFileComplete(c.Request.Context(), *session.FileID); err != nil {
+			reopen()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	err = h.authService.CaptureCredits(c.Request.Context(), userID, charge, "Storage payment for "+session.Filename)
+	if err != nil {
+		if session.FileID != nil {
+			h.fileService.ReopenFile(context.Background(), *session.FileID)
+		}
+		reopen()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
+	released := session.HeldCredits - charge
+	h.authService.ReleaseCredits(context.Background(), userID, released)
 
 	c.JSON(http.StatusOK, gin.H{
 		"status":           "completed",
-		"credits_deducted": requiredCredits,
+		"file_id":          session.FileID,
+		"credits_deducted": charge,
+		"credits_released": released,
+		"replicas":         replicas,
+		"target_replicas":  h.replicas,
+	})
+}
+
+// replicaCharge returns what storing a file costs for the fewest replicas any
+// of its chunks reached, never more than was held, along with that count
+func (h *UploadHandler) replicaCharge(ctx context.Context, fileID uuid.UUID, sizeBytes, held int64) (int64, int, error) {
+	replicas, err := h.chunkService.AchievedReplicas(ctx, fileID)
+	if err != nil {
+		return 0, 0, err
+	}
+	replicas = min(replicas, h.replicas)
+	return min(h.fileService.CalculateStorageCost(sizeBytes, replicas), held), replicas, nil
+}
+
+// CancelUpload abandons an active upload, deleting any chunks already stored
+// and returning the held credits
+func (h *UploadHandler) CancelUpload(c *gin.Context) {
+	sessionIDStr := c.Param("id")
+	sessionID, err := uuid.Parse(sessionIDStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid session id"})
+		return
+	}
+
+	userIDStr := middleware.GetUserID(c)
+	userID, err := uuid.Parse(userIDStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+
+	session, err := h.uploadService.GetSession(c.Request.Context(), sessionID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+		return
+	}
+
+	if session.UserID != userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
+		return
+	}
+
+	closed, err := h.uploadService.CloseSession(c.Request.Context(), sessionID, "canceled")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !closed {
+		c.JSON(http.StatusConflict, gin.H{"error": "upload session is not active"})
+		return
+	}
+
+	if err := h.authService.ReleaseCredits(c.Request.Context(), userID, session.HeldCredits); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Chunks already stored go with the unfinished file; a file a racing
+	// first chunk creates after this is left to the abandoned upload purge
+	fileID, err := h.fileService.DiscardSessionFile(c.Request.Context(), session)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if fileID != uuid.Nil {
+		h.chunkService.InvalidateFile(fileID)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":           "canceled",
+		"credits_released": session.HeldCredits,
+	})
+}
+
+// UploadFile handles a single-request upload: the body (or the first part of
+// a multipart form) is read chunk by chunk, encrypted and stored as it
+// arrives. The filename comes from the X-Filename header or the multipart
+// part; the size from Content-Length or, for multipart, X-File-Size.
+func (h *UploadHandler) UploadFile(c *gin.Context) {
+	userIDStr := middleware.GetUserID(c)
+	userID, err := uuid.Parse(userIDStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+
+	body, filename, mimeType, err := uploadBody(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := services.ValidateFilename(filename); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	sizeBytes := c.Request.ContentLength
+	if header := c.GetHeader("X-File-Size"); header != "" {
+		sizeBytes, err = strconv.ParseInt(header, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid X-File-Size header"})
+			return
+		}
+	}
+	if sizeBytes < 0 {
+		c.JSON(http.StatusLengthRequired, gin.H{"error": "file size is required (Content-Length or X-File-Size)"})
+		return
+	}
+
+	chunkCount, err := h.uploadService.ChunkCountFor(sizeBytes)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// The upload counts against the user's uploads in progress until it returns
+	done, err := h.uploadService.BeginStreamedUpload(c.Request.Context(), userID)
+	if err != nil {
+		if errors.Is(err, services.ErrTooManyUploads) {
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer done()
+
+	// Hold credits before reading any data; they are released unless the upload succeeds
+	requiredCredits := h.fileService.CalculateStorageCost(sizeBytes, h.replicas)
+	if !h.holdCredits(c, userID, requiredCredits) {
+		return
+	}
+	captured := false
+	defer func() {
+		if !captured {
+			h.authService.ReleaseCredits(context.Background(), userID, requiredCredits)
+		}
+	}()
+
+	cipher := h.uploadService.Cipher()
+	file, encryptionKey, err := h.fileService.CreateEncryptedFile(c.Request.Context(), userID, filename, sizeBytes, mimeType, cipher, chunkCount)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	status, err := h.storeStream(c, body, file.ID, sizeBytes, chunkCount, cipher, encryptionKey)
+	if err != nil {
+		h.fileService.DeleteFile(context.Background(), file.ID)
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	charge, replicas, err := h.replicaCharge(c.Request.Context(), file.ID, sizeBytes, requiredCredits)
+	if err != nil {
+		h.fileService.DeleteFile(context.Background(), file.ID)
+		if errors.Is(err, services.ErrBelowReplicaFloor) {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// As in CompleteUpload the file is ready before anything is captured;
+	// a failure on the way deletes it along with its chunks
+	if err := h.fileService.SetReplicas(c.Request.Context(), file.ID, replicas); err != nil {
+		h.fileService.DeleteFile(context.Background(), file.ID)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.fileService.MarkFileComplete(c.Request.Context(), file.ID); err != nil {
+		h.fileService.DeleteFile(context.Background(), file.ID)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = h.authService.CaptureCredits(c.Request.Context(), userID, charge, "Storage payment for "+filename)
+	if err != nil {
+		h.fileService.DeleteFile(context.Background(), file.ID)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	captured = true
+	h.authService.ReleaseCredits(context.Background(), userID, requiredCredits-charge)
+
+	file, err = h.fileService.GetFile(c.Request.Context(), file.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"file":             file,
+		"credits_deducted": charge,
+		"credits_released": requiredCredits - charge,
+		"replicas":         replicas,
+		"target_replicas":  h.replicas,
 	})
 }
+
+// uploadBody returns the reader holding the file's bytes along with its name and type
+func uploadBody(c *gin.Context) (io.Reader, string, string, error) {
+	if strings.HasPrefix(c.ContentType(), "multipart/form-data") {
+		reader, err := c.Request.MultipartReader()
+		if err != nil {
+			return nil, "", "", fmt.Errorf("invalid multipart body: %w", err)
+		}
+		part, err := reader.NextPart()
+		if err != nil {
+			return nil, "", "", fmt.Errorf("multipart body has no file part")
+		}
+		if part.FileName() == "" {
+			return nil, "", "", fmt.Errorf("first multipart part must be the file")
+		}
+		c.Request.ContentLength = -1 // the form's length includes boundaries
+		return part, part.FileName(), part.Header.Get("Content-Type"), nil
+	}
+
+	filename := c.GetHeader("X-Filename")
+	if filename == "" {
+		return nil, "", "", fmt.Errorf("X-Filename header is required")
+	}
+	return c.Request.Body, filename, c.ContentType(), nil
+}
+
+// storeStream reads exactly sizeBytes from body, storing each chunk as soon as it
+// is complete. It returns the HTTP status to report alongside any error.
+func (h *UploadHandler) storeStream(c *gin.Context, body io.Reader, fileID uuid.UUID, sizeBytes int64, chunkCount int, cipher services.Cipher, key []byte) (int, error) {
+	chunkSize := h.uploadService.ChunkSizeFor(sizeBytes)
+	buf := make([]byte, chunkSize)
+	for i := 0; i < chunkCount; i++ {
+		want := sizeBytes - int64(i)*chunkSize
+		if want > chunkSize {
+			want = chunkSize
+		}
+		if _, err := io.ReadFull(body, buf[:want]); err != nil {
+			return http.StatusBadRequest, fmt.Errorf("body ended before the declared %d bytes", sizeBytes)
+		}
+
+		nodes, err := h.chunkService.SelectNodesForChunks(c.Request.Context(), services.ChunkPlacementKey(fileID, i), h.replicas)
+		if err != nil {
+			return http.StatusServiceUnavailable, err
+		}
+		nodeIDs := make([]uuid.UUID, len(nodes))
+		for j, node := range nodes {
+			nodeIDs[j] = node.ID
+		}
+
+		encryptedData, err := services.SealChunk(cipher, buf[:want], key, 0)
+		if err != nil {
+			return http.StatusInternalServerError, fmt.Errorf("encryption failed: %w", err)
+		}
+		if _, err := h.chunkService.StoreChunk(c.Request.Context(), fileID, i, encryptedData, nodeIDs); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+
+	if n, _ := body.Read(make([]byte, 1)); n > 0 {
+		return http.StatusBadRequest, fmt.Errorf("body is longer than the declared %d bytes", sizeBytes)
+	}
+	return http.StatusOK, nil
+}
@@ -0,0 +1,913 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/federated-storage/coordinator/internal/merkle"
+	"github.com/federated-storage/coordinator/internal/models"
+	"github.com/federated-storage/coordinator/internal/services"
+	"github.com/federated-storage/coordinator/internal/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompleteUpload_RejectsMissingChunks(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name         string
+		stored       []int
+		expectedCode int
+		expectedGaps []int
+		fileStatus   string
+	}{
+		{name: "complete set", stored: []int{0, 1, 2}, expectedCode: http.StatusOK, fileStatus: "ready"},
+		{name: "gapped set", stored: []int{0, 2}, expectedCode: http.StatusConflict, expectedGaps: []int{1}, fileStatus: "uploading"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := storage.NewMemoryStore()
+			authService := services.NewAuthService(store, services.NewPricing(1000, nil))
+			fileService := services.NewFileService(store, 8, 100)
+			chunkService := services.NewChunkService(store, nil, nil)
+			uploadService := services.NewUploadService(store, 8, 1, 100)
+			handler := NewUploadHandler(uploadService, fileService, chunkService, authService, 1)
+
+			user := &models.User{ID: uuid.New(), Email: uuid.NewString() + "@example.com", Credits: 1000}
+			require.NoError(t, store.CreateUser(ctx, user))
+
+			key := make([]byte, 32)
+			file, err := fileService.CreateFile(ctx, user.ID, "gaps.txt", 24, "", key, services.DefaultCipher, 3)
+			require.NoError(t, err)
+			for _, i := range tt.stored {
+				encrypted, err := services.EncryptChunk([]byte("chunk"), key)
+				require.NoError(t, err)
+				_, err = chunkService.StoreChunk(ctx, file.ID, i, encrypted, nil)
+				require.NoError(t, err)
+			}
+
+			session := &models.UploadSession{
+				ID: uuid.New(), UserID: user.ID, FileID: &file.ID, Filename: "gaps.txt",
+				SizeBytes: 24, EncryptionKey: key, ChunkCount: 3, Status: "active",
+			}
+			require.NoError(t, store.CreateUploadSession(ctx, session))
+
+			router := gin.New()
+			router.POST("/files/upload/:id/complete", func(c *gin.Context) {
+				c.Set("user_id", user.ID.String())
+				handler.CompleteUpload(c)
+			})
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/files/upload/"+session.ID.String()+"/complete", nil))
+			assert.Equal(t, tt.expectedCode, w.Code)
+
+			if tt.expectedGaps != nil {
+				var body struct {
+					MissingChunks []int `json:"missing_chunks"`
+				}
+				require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+				assert.Equal(t, tt.expectedGaps, body.MissingChunks)
+			}
+
+			stored, err := fileService.GetFile(ctx, file.ID)
+			require.NoError(t, err)
+			assert.Equal(t, tt.fileStatus, stored.Status)
+		})
+	}
+}
+
+// failingStore fails setting a file to failStatus, and setting replicas if failReplicas
+type failingStore struct {
+	*storage.MemoryStore
+	failStatus   string
+	failReplicas bool
+}
+
+func (s *failingStore) SetFileStatus(ctx context.Context, fileID uuid.UUID, status string) error {
+	if status == s.failStatus {
+		return errors.New("database unavailable")
+	}
+	return s.MemoryStore.SetFileStatus(ctx, fileID, status)
+}
+
+func (s *failingStore) SetFileReplicas(ctx context.Context, fileID uuid.UUID, replicas int) error {
+	if s.failReplicas {
+		return errors.New("database unavailable")
+	}
+	return s.MemoryStore.SetFileReplicas(ctx, fileID, replicas)
+}
+
+func TestCompleteUpload_ChargesOnlyOnceTheFileIsReady(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	store := &failingStore{MemoryStore: storage.NewMemoryStore(), failStatus: "ready"}
+	authService := services.NewAuthService(store, services.NewPricing(1000, nil))
+	// 8 bytes at 2^30 credits per GB costs 8 credits per replica
+	fileService := services.NewFileService(store, 8, 1<<30)
+	node := models.StorageNode{ID: uuid.New()}
+	chunkService := services.NewChunkService(store, staticNodes{node}, nil)
+	uploadService := services.NewUploadService(store, 8, 1, 100)
+	handler := NewUploadHandler(uploadService, fileService, chunkService, authService, 1)
+
+	user := &models.User{ID: uuid.New(), Email: "unlucky@example.com", Credits: 20}
+	require.NoError(t, store.CreateUser(ctx, user))
+	require.NoError(t, authService.HoldCredits(ctx, user.ID, 10))
+	key := make([]byte, 32)
+	file, err := fileService.CreateFile(ctx, user.ID, "unlucky.txt", 8, "", key, services.DefaultCipher, 1)
+	require.NoError(t, err)
+	encrypted, err := services.EncryptChunk([]byte("12345678"), key)
+	require.NoError(t, err)
+	_, err = chunkService.StoreChunk(ctx, file.ID, 0, encrypted, []uuid.UUID{node.ID})
+	require.NoError(t, err)
+	session := &models.UploadSession{
+		ID: uuid.New(), UserID: user.ID, FileID: &file.ID, Filename: "unlucky.txt",
+		SizeBytes: 8, EncryptionKey: key, ChunkCount: 1, Status: "active", HeldCredits: 10,
+	}
+	require.NoError(t, store.CreateUploadSession(ctx, session))
+
+	router := gin.New()
+	router.POST("/files/upload/:id/complete", func(c *gin.Context) {
+		c.Set("user_id", user.ID.String())
+		handler.CompleteUpload(c)
+	})
+	complete := func() int {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/files/upload/"+session.ID.String()+"/complete", nil))
+		return w.Code
+	}
+
+	for _, failReplicas := range []bool{true, false} {
+		store.failReplicas = failReplicas
+		assert.Equal(t, http.StatusInternalServerError, complete())
+		charged, err := store.GetUserByID(ctx, user.ID)
+		require.NoError(t, err)
+		assert.Equal(t, int64(10), charged.Credits)
+		assert.Equal(t, int64(10), charged.HeldCredits, "Nothing is captured for a file that isn't ready")
+		reopened, err := uploadService.GetSession(ctx, session.ID)
+		require.NoError(t, err)
+		assert.Equal(t, "active", reopened.Status, "The session reopens for another try")
+	}
+
+	store.failStatus = ""
+	assert.Equal(t, http.StatusOK, complete())
+	charged, err := store.GetUserByID(ctx, user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, int64(12), charged.Credits, "8 of the 10 held are captured")
+	assert.Zero(t, charged.HeldCredits)
+	ready, err := fileService.GetFile(ctx, file.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "ready", ready.Status)
+}
+
+// staticNodes always offers the same storage nodes
+type staticNodes []models.StorageNode
+
+func (n staticNodes) GetAllNodes(ctx context.Context) ([]models.StorageNode, error) {
+	return n, nil
+}
+
+func TestUploadFile_StreamedMultiChunkRoundTrip(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	authService := services.NewAuthService(store, services.NewPricing(1000, nil))
+	fileService := services.NewFileService(store, 8, 100)
+	chunkService := services.NewChunkService(store, staticNodes{{ID: uuid.New()}}, nil)
+	uploadService := services.NewUploadService(store, 8, 1, 100)
+	uploadHandler := NewUploadHandler(uploadService, fileService, chunkService, authService, 1)
+	fileHandler := NewFileHandler(fileService, chunkService, nil)
+
+	user := &models.User{ID: uuid.New(), Email: "stream@example.com", Credits: 1000}
+	require.NoError(t, store.CreateUser(ctx, user))
+
+	router := gin.New()
+	router.Use(func(c *gin.Context) { c.Set("user_id", user.ID.String()) })
+	router.POST("/files", uploadHandler.UploadFile)
+	router.GET("/files/:id/download", fileHandler.DownloadFile)
+
+	content := []byte("one request, several chunks, encrypted on the fly")
+	req := httptest.NewRequest(http.MethodPost, "/files", bytes.NewReader(content))
+	req.Header.Set("X-Filename", "stream.txt")
+	req.Header.Set("Content-Type", "text/plain")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	var resp struct {
+		File     models.File `json:"file"`
+		Replicas int         `json:"replicas"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, 1, resp.Replicas, "The achieved replicas are reported as on completion")
+	assert.Equal(t, 1, resp.File.Replicas)
+	assert.Equal(t, "stream.txt", resp.File.Filename)
+	assert.Equal(t, "ready", resp.File.Status)
+	assert.Equal(t, 7, resp.File.ChunkCount, "49 bytes in 8-byte chunks")
+	assert.Equal(t, "text/plain", resp.File.MimeType)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/files/"+resp.File.ID.String()+"/download", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, content, w.Body.Bytes())
+
+	// A body shorter than declared is rejected and leaves no file behind
+	req = httptest.NewRequest(http.MethodPost, "/files", bytes.NewReader(content[:10]))
+	req.Header.Set("X-Filename", "short.txt")
+	req.Header.Set("X-File-Size", "20")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	files, err := fileService.GetUserFiles(ctx, user.ID, nil)
+	require.NoError(t, err)
+	assert.Len(t, files, 1)
+}
+
+func TestUploadFile_FailedCompletionLeavesNoFile(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name         string
+		failStatus   string
+		failReplicas bool
+	}{
+		{name: "marking the file ready fails", failStatus: "ready"},
+		{name: "recording replicas fails", failReplicas: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := &failingStore{MemoryStore: storage.NewMemoryStore(), failStatus: tt.failStatus, failReplicas: tt.failReplicas}
+			authService := services.NewAuthService(store, services.NewPricing(1000, nil))
+			fileService := services.NewFileService(store, 8, 1<<30)
+			chunkService := services.NewChunkService(store, staticNodes{{ID: uuid.New()}}, nil)
+			uploadService := services.NewUploadService(store, 8, 1, 100)
+			handler := NewUploadHandler(uploadService, fileService, chunkService, authService, 1)
+
+			user := &models.User{ID: uuid.New(), Email: uuid.NewString() + "@example.com", Credits: 100}
+			require.NoError(t, store.CreateUser(ctx, user))
+
+			router := gin.New()
+			router.Use(func(c *gin.Context) { c.Set("user_id", user.ID.String()) })
+			router.POST("/files", handler.UploadFile)
+			req := httptest.NewRequest(http.MethodPost, "/files", bytes.NewReader([]byte("sixteen bytes!!!")))
+			req.Header.Set("X-Filename", "orphan.txt")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+			files, err := fileService.GetUserFiles(ctx, user.ID, nil)
+			require.NoError(t, err)
+			assert.Empty(t, files, "The file and its chunks are deleted")
+			u, err := store.GetUserByID(ctx, user.ID)
+			require.NoError(t, err)
+			assert.Equal(t, int64(100), u.Credits, "Nothing is charged")
+			assert.Zero(t, u.HeldCredits)
+		})
+	}
+}
+
+func TestUploadChunk_ValidatesData(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	// The session is 20 bytes in 8-byte chunks: 8, 8 and a final 4
+	tests := []struct {
+		name         string
+		index        int
+		data         string
+		expectedCode int
+	}{
+		{name: "full chunk", data: base64.StdEncoding.EncodeToString([]byte("12345678")), expectedCode: http.StatusOK},
+		{name: "short final chunk", index: 2, data: base64.StdEncoding.EncodeToString([]byte("1234")), expectedCode: http.StatusOK},
+		{name: "short non-final chunk", data: base64.StdEncoding.EncodeToString([]byte("1234")), expectedCode: http.StatusBadRequest},
+		{name: "full-size final chunk", index: 2, data: base64.StdEncoding.EncodeToString([]byte("12345678")), expectedCode: http.StatusBadRequest},
+		{name: "index past the end", index: 3, data: base64.StdEncoding.EncodeToString([]byte("1234")), expectedCode: http.StatusBadRequest},
+		{name: "oversized chunk", data: base64.StdEncoding.EncodeToString(bytes.Repeat([]byte("x"), 1024)), expectedCode: http.StatusBadRequest},
+		{name: "missing padding", data: "MTIzNA", expectedCode: http.StatusBadRequest},
+		{name: "non-canonical padding", data: "MTIzNB==", expectedCode: http.StatusBadRequest},
+		{name: "not base64", data: "!!!!", expectedCode: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := storage.NewMemoryStore()
+			authService := services.NewAuthService(store, services.NewPricing(1000, nil))
+			fileService := services.NewFileService(store, 8, 100)
+			chunkService := services.NewChunkService(store, staticNodes{{ID: uuid.New()}}, nil)
+			uploadService := services.NewUploadService(store, 8, 1, 100)
+			handler := NewUploadHandler(uploadService, fileService, chunkService, authService, 1)
+
+			userID := uuid.New()
+			session, err := uploadService.InitiateUpload(ctx, userID, services.InitiateUploadRequest{Filename: "a.bin", SizeBytes: 20}, 0)
+			require.NoError(t, err)
+
+			router := gin.New()
+			router.POST("/files/upload/:id/chunk", func(c *gin.Context) {
+				c.Set("user_id", userID.String())
+				handler.UploadChunk(c)
+			})
+
+			body, _ := json.Marshal(UploadChunkRequest{ChunkIndex: tt.index, Data: tt.data})
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/files/upload/"+session.ID.String()+"/chunk", bytes.NewReader(body)))
+			assert.Equal(t, tt.expectedCode, w.Code, w.Body.String())
+
+			// Rejected data is caught before a file record is created
+			stored, err := uploadService.GetSession(ctx, session.ID)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedCode == http.StatusOK, stored.FileID != nil)
+		})
+	}
+}
+
+func TestInitiateUpload_CapsActiveSessionsPerUser(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	authService := services.NewAuthService(store, services.NewPricing(1000, nil))
+	fileService := services.NewFileService(store, 8, 100)
+	chunkService := services.NewChunkService(store, nil, nil)
+	uploadService := services.NewUploadService(store, 8, 1, 100)
+	uploadService.SetMaxActiveSessions(2)
+	handler := NewUploadHandler(uploadService, fileService, chunkService, authService, 1)
+
+	user := &models.User{ID: uuid.New(), Email: "busy@example.com", Credits: 1000}
+	require.NoError(t, store.CreateUser(ctx, user))
+
+	// Abandoned sessions past their expiry don't count
+	require.NoError(t, store.CreateUploadSession(ctx, &models.UploadSession{
+		ID: uuid.New(), UserID: user.ID, Filename: "stale.txt", SizeBytes: 8, ChunkCount: 1,
+		Status: "active", ExpiresAt: time.Now().Add(-time.Minute),
+	}))
+
+	router := gin.New()
+	router.Use(func(c *gin.Context) { c.Set("user_id", user.ID.String()) })
+	router.POST("/files/upload/initiate", handler.InitiateUpload)
+	initiate := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		body := `{"filename": "a.txt", "size_bytes": 8}`
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/files/upload/initiate", bytes.NewBufferString(body)))
+		return w
+	}
+
+	var sessions []string
+	for i := 0; i < 2; i++ {
+		w := initiate()
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var resp services.InitiateUploadResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		sessions = append(sessions, resp.SessionID)
+	}
+
+	w := initiate()
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Contains(t, w.Body.String(), "too many uploads in progress")
+
+	// Other users are unaffected
+	other := &models.User{ID: uuid.New(), Email: "idle@example.com", Credits: 1000}
+	require.NoError(t, store.CreateUser(ctx, other))
+	_, err := uploadService.InitiateUpload(ctx, other.ID, services.InitiateUploadRequest{Filename: "b.txt", SizeBytes: 8}, 0)
+	assert.NoError(t, err)
+
+	// Finishing one upload frees a slot
+	require.NoError(t, uploadService.UpdateSessionStatus(ctx, uuid.MustParse(sessions[0]), "completed"))
+	assert.Equal(t, http.StatusOK, initiate().Code)
+	assert.Equal(t, http.StatusTooManyRequests, initiate().Code)
+}
+
+func TestUploadFile_CountsAgainstActiveUploads(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	authService := services.NewAuthService(store, services.NewPricing(1000, nil))
+	fileService := services.NewFileService(store, 8, 100)
+	chunkService := services.NewChunkService(store, staticNodes{{ID: uuid.New()}}, nil)
+	uploadService := services.NewUploadService(store, 8, 1, 100)
+	uploadService.SetMaxActiveSessions(1)
+	handler := NewUploadHandler(uploadService, fileService, chunkService, authService, 1)
+
+	user := &models.User{ID: uuid.New(), Email: "oneshot@example.com", Credits: 1000}
+	require.NoError(t, store.CreateUser(ctx, user))
+
+	router := gin.New()
+	router.Use(func(c *gin.Context) { c.Set("user_id", user.ID.String()) })
+	router.POST("/files", handler.UploadFile)
+	router.POST("/files/upload/initiate", handler.InitiateUpload)
+	upload := func(body io.Reader) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/files", body)
+		req.Header.Set("X-Filename", "oneshot.txt")
+		req.Header.Set("X-File-Size", "16")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	initiate := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		body := `{"filename": "a.txt", "size_bytes": 8}`
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/files/upload/initiate", bytes.NewBufferString(body)))
+		return w
+	}
+
+	// An open session leaves no room for a single-request upload
+	w := initiate()
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp services.InitiateUploadResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	before, err := store.GetUserByID(ctx, user.ID)
+	require.NoError(t, err)
+	w = upload(bytes.NewReader(make([]byte, 16)))
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Contains(t, w.Body.String(), "too many uploads in progress")
+	after, err := store.GetUserByID(ctx, user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, before.HeldCredits, after.HeldCredits, "A refused upload holds no credits")
+	require.NoError(t, uploadService.UpdateSessionStatus(ctx, uuid.MustParse(resp.SessionID), "completed"))
+
+	// A single-request upload still streaming takes the slot a session would
+	pr, pw := io.Pipe()
+	streamed := make(chan *httptest.ResponseRecorder)
+	go func() { streamed <- upload(pr) }()
+	_, err = pw.Write(make([]byte, 8)) // returns once the handler is reading the body
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, initiate().Code)
+	_, err = pw.Write(make([]byte, 8))
+	require.NoError(t, err)
+	require.NoError(t, pw.Close())
+	w = <-streamed
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	// Once it finishes the slot is free again
+	assert.Equal(t, http.StatusOK, initiate().Code)
+}
+
+func TestUploadLifecycle_HoldsCreditsUntilSettled(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	authService := services.NewAuthService(store, services.NewPricing(1000, nil))
+	// 8 bytes at 2^30 credits per GB costs 8 credits
+	fileService := services.NewFileService(store, 8, 1<<30)
+	chunkService := services.NewChunkService(store, staticNodes{{ID: uuid.New()}}, nil)
+	uploadService := services.NewUploadService(store, 8, 1, 100)
+	handler := NewUploadHandler(uploadService, fileService, chunkService, authService, 1)
+
+	user := &models.User{ID: uuid.New(), Email: "hold@example.com", Credits: 20}
+	require.NoError(t, store.CreateUser(ctx, user))
+
+	router := gin.New()
+	router.Use(func(c *gin.Context) { c.Set("user_id", user.ID.String()) })
+	router.POST("/files/upload/initiate", handler.InitiateUpload)
+	router.POST("/files/upload/:id/chunk", handler.UploadChunk)
+	router.POST("/files/upload/:id/complete", handler.CompleteUpload)
+	router.DELETE("/files/upload/:id", handler.CancelUpload)
+	send := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, bytes.NewBufferString(body)))
+		return w
+	}
+	initiate := func() string {
+		w := send(http.MethodPost, "/files/upload/initiate", `{"filename": "a.txt", "size_bytes": 8}`)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var resp services.InitiateUploadResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return resp.SessionID
+	}
+	balance := func() (int64, int64) {
+		u, err := store.GetUserByID(ctx, user.ID)
+		require.NoError(t, err)
+		return u.Credits, u.HeldCredits
+	}
+
+	// Two uploads hold 16 of 20 credits, so a third can't start
+	completed, canceled := initiate(), initiate()
+	credits, held := balance()
+	assert.Equal(t, int64(4), credits)
+	assert.Equal(t, int64(16), held)
+	w := send(http.MethodPost, "/files/upload/initiate", `{"filename": "c.txt", "size_bytes": 8}`)
+	assert.Equal(t, http.StatusPaymentRequired, w.Code)
+	assert.Contains(t, w.Body.String(), `"available_credits":4`)
+
+	// Completing captures the hold exactly once
+	chunk, _ := json.Marshal(UploadChunkRequest{ChunkIndex: 0, Data: base64.StdEncoding.EncodeToString([]byte("12345678"))})
+	require.Equal(t, http.StatusOK, send(http.MethodPost, "/files/upload/"+completed+"/chunk", string(chunk)).Code)
+	w = send(http.MethodPost, "/files/upload/"+completed+"/complete", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), `"credits_deducted":8`)
+	assert.Equal(t, http.StatusConflict, send(http.MethodPost, "/files/upload/"+completed+"/complete", "").Code)
+	credits, held = balance()
+	assert.Equal(t, int64(4), credits)
+	assert.Equal(t, int64(8), held)
+
+	// Canceling returns the other hold
+	w = send(http.MethodDelete, "/files/upload/"+canceled, "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, http.StatusConflict, send(http.MethodDelete, "/files/upload/"+canceled, "").Code)
+	credits, held = balance()
+	assert.Equal(t, int64(12), credits)
+	assert.Equal(t, int64(0), held)
+
+	transactions := store.Transactions(user.ID)
+	require.Len(t, transactions, 1)
+	assert.Equal(t, int64(-8), transactions[0].Amount)
+}
+
+func TestCancelUpload_LeavesNoFileOrChunks(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	authService := services.NewAuthService(store, services.NewPricing(1000, nil))
+	fileService := services.NewFileService(store, 8, 1<<30)
+	chunkService := services.NewChunkService(store, staticNodes{{ID: uuid.New()}}, nil)
+	uploadService := services.NewUploadService(store, 8, 1, 100)
+	handler := NewUploadHandler(uploadService, fileService, chunkService, authService, 1)
+
+	user := &models.User{ID: uuid.New(), Email: "cancel@example.com", Credits: 100}
+	require.NoError(t, store.CreateUser(ctx, user))
+
+	router := gin.New()
+	router.Use(func(c *gin.Context) { c.Set("user_id", user.ID.String()) })
+	router.POST("/files/upload/initiate", handler.InitiateUpload)
+	router.POST("/files/upload/:id/chunk", handler.UploadChunk)
+	router.POST("/files/upload/:id/complete", handler.CompleteUpload)
+	router.DELETE("/files/upload/:id", handler.CancelUpload)
+	send := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, bytes.NewBufferString(body)))
+		return w
+	}
+	initiate := func(sizeBytes int) string {
+		w := send(http.MethodPost, "/files/upload/initiate", fmt.Sprintf(`{"filename": "a.txt", "size_bytes": %d}`, sizeBytes))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var resp services.InitiateUploadResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return resp.SessionID
+	}
+	sendChunk := func(sessionID string, index int) *httptest.ResponseRecorder {
+		chunk, _ := json.Marshal(UploadChunkRequest{ChunkIndex: index, Data: base64.StdEncoding.EncodeToString([]byte("12345678"))})
+		return send(http.MethodPost, "/files/upload/"+sessionID+"/chunk", string(chunk))
+	}
+	leftovers := func(fileID uuid.UUID) (bool, int) {
+		_, err := store.GetFile(ctx, fileID)
+		chunks, listErr := store.ListChunkData(ctx, fileID)
+		require.NoError(t, listErr)
+		return err == nil, len(chunks)
+	}
+
+	// A finished upload of the same name must survive everything below
+	completed := initiate(8)
+	require.Equal(t, http.StatusOK, sendChunk(completed, 0).Code)
+	require.Equal(t, http.StatusOK, send(http.MethodPost, "/files/upload/"+completed+"/complete", "").Code)
+
+	canceled := initiate(16)
+	for i := 0; i < 2; i++ {
+		require.Equal(t, http.StatusOK, sendChunk(canceled, i).Code)
+	}
+	fileID := uuid.MustParse(canceled)
+	exists, chunks := leftovers(fileID)
+	require.True(t, exists)
+	require.Equal(t, 2, chunks)
+
+	w := send(http.MethodDelete, "/files/upload/"+canceled, "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	exists, chunks = leftovers(fileID)
+	assert.False(t, exists, "Canceling should delete the unfinished file")
+	assert.Zero(t, chunks, "Canceling should delete the chunks stored so far")
+
+	assert.Equal(t, http.StatusConflict, sendChunk(canceled, 0).Code, "Chunks are refused once the session ends")
+
+	// A first chunk racing the cancel can still create the file after it;
+	// the purge removes that too
+	raced := initiate(16)
+	session, err := uploadService.GetSession(ctx, uuid.MustParse(raced))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, send(http.MethodDelete, "/files/upload/"+raced, "").Code)
+	file, err := fileService.CreateSessionFile(ctx, session)
+	require.NoError(t, err)
+	_, err = chunkService.StoreChunk(ctx, file.ID, 0, []byte("sealed"), nil)
+	require.NoError(t, err)
+
+	purged, err := fileService.PurgeAbandonedUploads(ctx)
+	require.NoError(t, err)
+	require.Len(t, purged, 1)
+	assert.Equal(t, file.ID, purged[0].ID)
+	exists, chunks = leftovers(file.ID)
+	assert.False(t, exists)
+	assert.Zero(t, chunks)
+
+	file, err = store.GetFile(ctx, uuid.MustParse(completed))
+	require.NoError(t, err, "Completed files are never purged")
+	assert.Equal(t, "ready", file.Status)
+	_, chunks = leftovers(file.ID)
+	assert.Equal(t, 1, chunks)
+	u, err := store.GetUserByID(ctx, user.ID)
+	require.NoError(t, err)
+	assert.Zero(t, u.HeldCredits, "The canceled upload's hold should be released")
+}
+
+func TestCompleteUpload_ChargesForReplicasAchieved(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	authService := services.NewAuthService(store, services.NewPricing(1000, nil))
+	// 8 bytes at 2^30 credits per GB costs 8 credits per replica
+	fileService := services.NewFileService(store, 8, 1<<30)
+	// Only two nodes for a target of three replicas
+	chunkService := services.NewChunkService(store, staticNodes{{ID: uuid.New()}, {ID: uuid.New()}}, nil)
+	chunkService.SetMinReplicas(1)
+	uploadService := services.NewUploadService(store, 8, 3, 100)
+	handler := NewUploadHandler(uploadService, fileService, chunkService, authService, 3)
+
+	user := &models.User{ID: uuid.New(), Email: "replicas@example.com", Credits: 30}
+	require.NoError(t, store.CreateUser(ctx, user))
+
+	router := gin.New()
+	router.Use(func(c *gin.Context) { c.Set("user_id", user.ID.String()) })
+	router.POST("/files/upload/initiate", handler.InitiateUpload)
+	router.POST("/files/upload/:id/chunk", handler.UploadChunk)
+	router.POST("/files/upload/:id/complete", handler.CompleteUpload)
+	send := func(path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, bytes.NewBufferString(body)))
+		return w
+	}
+
+	w := send("/files/upload/initiate", `{"filename": "a.txt", "size_bytes": 8}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var initiated services.InitiateUploadResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &initiated))
+	chunk, _ := json.Marshal(UploadChunkRequest{ChunkIndex: 0, Data: base64.StdEncoding.EncodeToString([]byte("12345678"))})
+	require.Equal(t, http.StatusOK, send("/files/upload/"+initiated.SessionID+"/chunk", string(chunk)).Code)
+
+	// Below the floor the upload stays open and nothing is charged
+	chunkService.SetMinReplicas(3)
+	w = send("/files/upload/"+initiated.SessionID+"/complete", "")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	u, err := store.GetUserByID(ctx, user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, int64(24), u.HeldCredits)
+
+	chunkService.SetMinReplicas(1)
+	w = send("/files/upload/"+initiated.SessionID+"/complete", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp struct {
+		CreditsDeducted int64 `json:"credits_deducted"`
+		CreditsReleased int64 `json:"credits_released"`
+		Replicas        int   `json:"replicas"`
+		TargetReplicas  int   `json:"target_replicas"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, int64(16), resp.CreditsDeducted, "charged for two replicas, not three")
+	assert.Equal(t, int64(8), resp.CreditsReleased)
+	assert.Equal(t, 2, resp.Replicas)
+	assert.Equal(t, 3, resp.TargetReplicas)
+
+	u, err = store.GetUserByID(ctx, user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, int64(14), u.Credits)
+	assert.Equal(t, int64(0), u.HeldCredits)
+
+	session, err := uploadService.GetSession(ctx, uuid.MustParse(initiated.SessionID))
+	require.NoError(t, err)
+	file, err := fileService.GetFile(ctx, *session.FileID)
+	require.NoError(t, err)
+	assert.Equal(t, 2, file.Replicas)
+}
+
+func TestUpload_SessionChunkSizeRoundTrip(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	authService := services.NewAuthService(store, services.NewPricing(1000, nil))
+	fileService := services.NewFileService(store, 8, 100)
+	chunkService := services.NewChunkService(store, staticNodes{{ID: uuid.New()}}, nil)
+	uploadService := services.NewUploadService(store, 8, 1, 100)
+	uploadService.SetChunkSizeRange(4, 16)
+	uploads := NewUploadHandler(uploadService, fileService, chunkService, authService, 1)
+	files := NewFileHandler(fileService, chunkService, nil)
+
+	user := &models.User{ID: uuid.New(), Email: "chunks@example.com", Credits: 1000}
+	require.NoError(t, store.CreateUser(ctx, user))
+
+	router := gin.New()
+	router.Use(func(c *gin.Context) { c.Set("user_id", user.ID.String()) })
+	router.POST("/files/upload/initiate", uploads.InitiateUpload)
+	router.POST("/files/upload/:id/chunk", uploads.UploadChunk)
+	router.POST("/files/upload/:id/complete", uploads.CompleteUpload)
+	router.GET("/files/:id/download", files.DownloadFile)
+	send := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, bytes.NewBufferString(body)))
+		return w
+	}
+	upload := func(sessionID string, index int, data string) int {
+		chunk, _ := json.Marshal(UploadChunkRequest{ChunkIndex: index, Data: base64.StdEncoding.EncodeToString([]byte(data))})
+		return send(http.MethodPost, "/files/upload/"+sessionID+"/chunk", string(chunk)).Code
+	}
+
+	// Asking for 2-byte chunks gets the configured minimum
+	w := send(http.MethodPost, "/files/upload/initiate", `{"filename": "tiny.txt", "size_bytes": 8, "chunk_size": 2}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp services.InitiateUploadResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, int64(4), resp.ChunkSize)
+	assert.Equal(t, 2, resp.ChunkCount)
+
+	// 13 bytes in 5-byte chunks, which the server's 8-byte size would split differently
+	w = send(http.MethodPost, "/files/upload/initiate", `{"filename": "odd.txt", "size_bytes": 13, "chunk_size": 5}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, int64(5), resp.ChunkSize)
+	require.Equal(t, 3, resp.ChunkCount)
+
+	content := "hello, chunks"
+	assert.Equal(t, http.StatusBadRequest, upload(resp.SessionID, 0, content[:8]), "chunks must match the session's size")
+	for i := 0; i < resp.ChunkCount; i++ {
+		end := min((i+1)*5, len(content))
+		require.Equal(t, http.StatusOK, upload(resp.SessionID, i, content[i*5:end]))
+	}
+	w = send(http.MethodPost, "/files/upload/"+resp.SessionID+"/complete", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	session, err := uploadService.GetSession(ctx, uuid.MustParse(resp.SessionID))
+	require.NoError(t, err)
+	require.NotNil(t, session.FileID)
+
+	w = send(http.MethodGet, "/files/"+session.FileID.String()+"/download", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, content, w.Body.String())
+}
+
+// ed25519Signer stands in for the coordinator's P2P identity
+type ed25519Signer ed25519.PrivateKey
+
+func (s ed25519Signer) Sign(data []byte) ([]byte, error) {
+	return ed25519.Sign(ed25519.PrivateKey(s), data), nil
+}
+
+func (s ed25519Signer) Verify(data, signature []byte) (bool, error) {
+	return ed25519.Verify(ed25519.PrivateKey(s).Public().(ed25519.PublicKey), data, signature), nil
+}
+
+// nodeKey stands in for a storage node's peer key
+type nodeKey struct {
+	peerID string
+	key    ed25519.PrivateKey
+}
+
+func (k nodeKey) VerifyPeer(peerID string, data, signature []byte) (bool, error) {
+	if peerID != k.peerID {
+		return false, fmt.Errorf("unknown peer %s", peerID)
+	}
+	return ed25519.Verify(k.key.Public().(ed25519.PublicKey), data, signature), nil
+}
+
+// receipt is what the node answers storing data as chunkID with
+func (k nodeKey) receipt(chunkID uuid.UUID, data []byte) services.StoreReceipt {
+	sum := sha256.Sum256(data)
+	receipt := services.StoreReceipt{
+		PeerID: k.peerID, ChunkID: chunkID, Hash: hex.EncodeToString(sum[:]),
+		SizeBytes: int64(len(data)), MerkleRoot: hex.EncodeToString(merkle.Root(data)),
+	}
+	receipt.Signature = ed25519.Sign(k.key, services.StoreReceiptPayload(receipt.ChunkID, receipt.Hash, receipt.SizeBytes, receipt.MerkleRoot))
+	return receipt
+}
+
+// nodeChunks is the chunks a client stored directly on nodes, by peer and chunk ID
+type nodeChunks map[string][]byte
+
+func (n nodeChunks) SendChunk(ctx context.Context, peerID, chunkID string, data []byte) error {
+	n[peerID+"/"+chunkID] = data
+	return nil
+}
+
+func (n nodeChunks) RetrieveChunk(ctx context.Context, peerID, chunkID string) ([]byte, error) {
+	data, ok := n[peerID+"/"+chunkID]
+	if !ok {
+		return nil, fmt.Errorf("chunk not held")
+	}
+	return data, nil
+}
+
+func TestUpload_DirectToNodesRoundTrip(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	node := models.StorageNode{ID: uuid.New(), PeerID: "peer-direct", Address: "/ip4/10.0.0.7/tcp/4001"}
+	held := nodeChunks{}
+	authService := services.NewAuthService(store, services.NewPricing(1000, nil))
+	fileService := services.NewFileService(store, 8, 100)
+	chunkService := services.NewChunkService(store, staticNodes{node}, nil)
+	chunkService.SetTransfer(held)
+	uploadService := services.NewUploadService(store, 8, 1, 100)
+	uploads := NewUploadHandler(uploadService, fileService, chunkService, authService, 1)
+	files := NewFileHandler(fileService, chunkService, nil)
+
+	user := &models.User{ID: uuid.New(), Email: "direct@example.com", Credits: 1000}
+	require.NoError(t, store.CreateUser(ctx, user))
+
+	router := gin.New()
+	router.Use(func(c *gin.Context) { c.Set("user_id", user.ID.String()) })
+	router.POST("/files/upload/initiate", uploads.InitiateUpload)
+	router.POST("/files/upload/:id/chunk", uploads.UploadChunk)
+	router.POST("/files/upload/:id/chunk/stored", uploads.ChunkStored)
+	router.POST("/files/upload/:id/complete", uploads.CompleteUpload)
+	router.GET("/files/:id/download", files.DownloadFile)
+	send := func(path string, body interface{}) *httptest.ResponseRecorder {
+		encoded, _ := json.Marshal(body)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, bytes.NewReader(encoded)))
+		return w
+	}
+
+	initiate := map[string]interface{}{"filename": "direct.txt", "size_bytes": 13, "direct": true}
+	w := send("/files/upload/initiate", initiate)
+	assert.Equal(t, http.StatusBadRequest, w.Code, "Direct uploads must be enabled")
+
+	_, key, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	peer := nodeKey{peerID: node.PeerID}
+	_, peer.key, err = ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	uploadService.SetDirectUploads(ed25519Signer(key), peer, time.Minute)
+	w = send("/files/upload/initiate", initiate)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var session services.InitiateUploadResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &session))
+	encryptionKey, err := base64.StdEncoding.DecodeString(session.EncryptionKey)
+	require.NoError(t, err)
+	cipher := services.Cipher(session.Cipher)
+	chunkPath := "/files/upload/" + session.SessionID + "/chunk"
+
+	// A direct session's chunk data is for the nodes, not the coordinator
+	w = send(chunkPath, UploadChunkRequest{ChunkIndex: 0, Data: base64.StdEncoding.EncodeToString([]byte("12345678"))})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	content := "direct upload"
+	for i := 0; i < session.ChunkCount; i++ {
+		encrypted, err := cipher.Encrypt([]byte(content[i*8:min((i+1)*8, len(content))]), encryptionKey)
+		require.NoError(t, err)
+		sum := sha256.Sum256(encrypted)
+		hash := hex.EncodeToString(sum[:])
+
+		w = send(chunkPath, UploadChunkRequest{ChunkIndex: i, Hash: hash, SizeBytes: int64(len(encrypted))})
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var grant struct {
+			ChunkID       uuid.UUID     `json:"chunk_id"`
+			Nodes         []StoreTarget `json:"nodes"`
+			Authorization string        `json:"authorization"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &grant))
+		assert.Equal(t, []StoreTarget{{NodeID: node.ID, PeerID: node.PeerID, Address: node.Address}}, grant.Nodes)
+
+		// The client stores the chunk on the node, then reports it with the node's receipt
+		require.NoError(t, held.SendChunk(ctx, grant.Nodes[0].PeerID, grant.ChunkID.String(), encrypted))
+		receipt := peer.receipt(grant.ChunkID, encrypted)
+		w = send(chunkPath+"/stored", ChunkStoredRequest{Authorization: grant.Authorization})
+		assert.Equal(t, http.StatusBadRequest, w.Code, "A chunk no node acknowledged isn't recorded")
+		w = send(chunkPath+"/stored", ChunkStoredRequest{Authorization: grant.Authorization, Receipts: []services.StoreReceipt{peer.receipt(grant.ChunkID, []byte("other"))}})
+		assert.Equal(t, http.StatusBadRequest, w.Code, "The stored content must match the authorized hash")
+		w = send(chunkPath+"/stored", ChunkStoredRequest{Authorization: grant.Authorization, Receipts: []services.StoreReceipt{receipt}})
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		w = send(chunkPath+"/stored", ChunkStoredRequest{Authorization: grant.Authorization, Receipts: []services.StoreReceipt{receipt}})
+		assert.Equal(t, http.StatusConflict, w.Code)
+	}
+
+	w = send("/files/upload/"+session.SessionID+"/complete", nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	stored, err := uploadService.GetSession(ctx, uuid.MustParse(session.SessionID))
+	require.NoError(t, err)
+	require.NotNil(t, stored.FileID)
+
+	// The coordinator kept only metadata; downloads fetch the chunks from the node
+	chunks, err := chunkService.GetChunksByFile(ctx, *stored.FileID)
+	require.NoError(t, err)
+	require.Len(t, chunks, 2)
+	for _, chunk := range chunks {
+		_, data, err := store.GetChunk(ctx, chunk.ID)
+		require.NoError(t, err)
+		assert.Empty(t, data)
+	}
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/files/"+stored.FileID.String()+"/download", nil))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, content, w.Body.String())
+}
@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+func init() {
+	// Report validation failures using JSON field names rather than Go struct names
+	if v, ok := binding.Validator.Engine().(*validator.Validate); ok {
+		v.RegisterTagNameFunc(func(field reflect.StructField) string {
+			name := strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+			if name == "-" {
+				return ""
+			}
+			return name
+		})
+	}
+}
+
+// FieldError describes a single invalid request field
+type FieldError struct {
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+// respondBindError writes a 400 response describing why a request body failed to bind
+func respondBindError(c *gin.Context, err error) {
+	c.JSON(http.StatusBadRequest, bindErrorResponse(err))
+}
+
+// bindErrorResponse translates a binding error into {error, errors: [...]}.
+// "error" joins the messages so existing clients reading a single string keep working.
+func bindErrorResponse(err error) gin.H {
+	fieldErrors := translateBindError(err)
+
+	messages := make([]string, len(fieldErrors))
+	for i, fe := range fieldErrors {
+		messages[i] = fe.Message
+	}
+
+	return gin.H{
+		"error":  strings.Join(messages, "; "),
+		"errors": fieldErrors,
+	}
+}
+
+func translateBindError(err error) []FieldError {
+	var validationErrors validator.ValidationErrors
+	if errors.As(err, &validationErrors) {
+		result := make([]FieldError, 0, len(validationErrors))
+		for _, fe := range validationErrors {
+			result = append(result, FieldError{Field: fieldPath(fe), Message: validationMessage(fe)})
+		}
+		return result
+	}
+
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.Is(err, io.EOF):
+		return []FieldError{{Message: "request body is empty"}}
+	case errors.As(err, &syntaxErr), errors.Is(err, io.ErrUnexpectedEOF):
+		return []FieldError{{Message: "request body must be valid JSON"}}
+	case errors.As(err, &typeErr):
+		return []FieldError{{Field: typeErr.Field, Message: fmt.Sprintf("%s must be of type %s", typeErr.Field, typeErr.Type)}}
+	}
+
+	return []FieldError{{Message: err.Error()}}
+}
+
+// fieldPath returns the JSON path of an invalid field, e.g. "nodes[2].peer_id"
+// for nested entries, dropping the Go name of the request struct
+func fieldPath(fe validator.FieldError) string {
+	ns := fe.Namespace()
+	if i := strings.Index(ns, "."); i >= 0 {
+		return ns[i+1:]
+	}
+	return fe.Field()
+}
+
+func validationMessage(fe validator.FieldError) string {
+	field := fieldPath(fe)
+	switch fe.Tag() {
+	case "required":
+		return fmt.Sprintf("%s is required", field)
+	case "email":
+		return fmt.Sprintf("%s must be a valid email address", field)
+	case "min", "gte":
+		if unit := lengthUnit(fe.Kind()); unit != "" {
+			return fmt.Sprintf("%s must be at least %s %s", field, fe.Param(), unit)
+		}
+		return fmt.Sprintf("%s must be at least %s", field, fe.Param())
+	case "max", "lte":
+		if unit := lengthUnit(fe.Kind()); unit != "" {
+			return fmt.Sprintf("%s must be at most %s %s", field, fe.Param(), unit)
+		}
+		return fmt.Sprintf("%s must be at most %s", field, fe.Param())
+	case "oneof":
+		return fmt.Sprintf("%s must be one of: %s", field, strings.ReplaceAll(fe.Param(), " ", ", "))
+	}
+	return fmt.Sprintf("%s is invalid", field)
+}
+
+func lengthUnit(kind reflect.Kind) string {
+	switch kind {
+	case reflect.String:
+		return "characters"
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return "items"
+	}
+	return ""
+}
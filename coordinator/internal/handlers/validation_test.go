@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/federated-storage/coordinator/internal/services"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+type bindErrorBody struct {
+	Error  string       `json:"error"`
+	Errors []FieldError `json:"errors"`
+}
+
+func bindAndRespond(t *testing.T, body string, req interface{}) (int, bindErrorBody) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(body))
+	c.Request.Header.Set("Content-Type", "application/json")
+
+	if err := c.ShouldBindJSON(req); err != nil {
+		respondBindError(c, err)
+	}
+
+	var result bindErrorBody
+	json.Unmarshal(w.Body.Bytes(), &result)
+	return w.Code, result
+}
+
+func TestBindError_FriendlyValidationMessages(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		req      interface{}
+		wantMsgs []FieldError
+	}{
+		{
+			name: "invalid email and short password",
+			body: `{"email": "not-an-email", "password": "123"}`,
+			req:  &services.RegisterRequest{},
+			wantMsgs: []FieldError{
+				{Field: "email", Message: "email must be a valid email address"},
+				{Field: "password", Message: "password must be at least 8 characters"},
+			},
+		},
+		{
+			name: "missing required fields",
+			body: `{}`,
+			req:  &services.LoginRequest{},
+			wantMsgs: []FieldError{
+				{Field: "email", Message: "email is required"},
+				{Field: "password", Message: "password is required"},
+			},
+		},
+		{
+			name: "numeric minimum",
+			body: `{"amount_usd": -5}`,
+			req:  &PurchaseCreditsRequest{},
+			wantMsgs: []FieldError{
+				{Field: "amount_usd", Message: "amount_usd must be at least 1"},
+			},
+		},
+		{
+			name: "nested bulk entries",
+			body: `{"nodes": [{"name": "a", "peer_id": "p1", "public_key": "AQID", "total_storage_gb": 10}, {"name": "b", "public_key": "AQID", "total_storage_gb": 0}]}`,
+			req:  &BulkRegisterRequest{},
+			wantMsgs: []FieldError{
+				{Field: "nodes[1].peer_id", Message: "nodes[1].peer_id is required"},
+				{Field: "nodes[1].total_storage_gb", Message: "nodes[1].total_storage_gb is required"},
+			},
+		},
+		{
+			name: "malformed json",
+			body: `{"email": `,
+			req:  &services.LoginRequest{},
+			wantMsgs: []FieldError{
+				{Message: "request body must be valid JSON"},
+			},
+		},
+		{
+			name: "wrong type",
+			body: `{"filename": "a.txt", "size_bytes": "big"}`,
+			req:  &services.InitiateUploadRequest{},
+			wantMsgs: []FieldError{
+				{Field: "size_bytes", Message: "size_bytes must be of type int64"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, body := bindAndRespond(t, tt.body, tt.req)
+
+			assert.Equal(t, http.StatusBadRequest, code)
+			assert.Equal(t, tt.wantMsgs, body.Errors)
+			assert.NotContains(t, body.Error, "Key: ", "Raw validator output should not leak")
+			assert.Contains(t, body.Error, tt.wantMsgs[0].Message)
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/federated-storage/coordinator/internal/middleware"
+	"github.com/federated-storage/coordinator/internal/models"
+	"github.com/federated-storage/coordinator/internal/services"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// WebhookHandler manages webhooks, either a user's own or, on the admin
+// API, the operator's
+type WebhookHandler struct {
+	webhooks *services.WebhookService
+	operator bool
+}
+
+// NewWebhookHandler creates a new webhook handler. With operator set it
+// manages operator webhooks, which see every event, instead of the
+// authenticated user's.
+func NewWebhookHandler(webhooks *services.WebhookService, operator bool) *WebhookHandler {
+	return &WebhookHandler{webhooks: webhooks, operator: operator}
+}
+
+// CreateWebhookRequest describes a webhook to register
+type CreateWebhookRequest struct {
+	URL    string   `json:"url" binding:"required"`
+	Events []string `json:"events" binding:"required,min=1"`
+}
+
+// owner returns whose webhooks this request manages: nil for the operator
+func (h *WebhookHandler) owner(c *gin.Context) (*uuid.UUID, bool) {
+	if h.operator {
+		return nil, true
+	}
+	userID, err := uuid.Parse(middleware.GetUserID(c))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return nil, false
+	}
+	return &userID, true
+}
+
+// CreateWebhook registers a webhook. The secret its deliveries are signed
+// with is only ever shown in this response.
+func (h *WebhookHandler) CreateWebhook(c *gin.Context) {
+	owner, ok := h.owner(c)
+	if !ok {
+		return
+	}
+
+	var req CreateWebhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	hook, secret, err := h.webhooks.Register(c.Request.Context(), owner, req.URL, req.Events)
+	if err != nil {
+		if errors.Is(err, services.ErrInvalidWebhook) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, services.ErrWebhookLimit) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"webhook": hook,
+		"secret":  secret,
+	})
+}
+
+// ListWebhooks lists the user's webhooks, or every webhook for the operator
+func (h *WebhookHandler) ListWebhooks(c *gin.Context) {
+	owner, ok := h.owner(c)
+	if !ok {
+		return
+	}
+
+	hooks, err := h.webhooks.List(c.Request.Context(), owner)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if hooks == nil {
+		hooks = []models.Webhook{}
+	}
+	c.JSON(http.StatusOK, gin.H{"webhooks": hooks})
+}
+
+// DeleteWebhook removes a webhook, dropping deliveries still queued for it
+func (h *WebhookHandler) DeleteWebhook(c *gin.Context) {
+	owner, ok := h.owner(c)
+	if !ok {
+		return
+	}
+	webhookID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid webhook id"})
+		return
+	}
+
+	err = h.webhooks.Delete(c.Request.Context(), webhookID, owner)
+	if err != nil {
+		if errors.Is(err, services.ErrWebhookNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+}
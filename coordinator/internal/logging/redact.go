@@ -0,0 +1,111 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Redacted replaces the values of sensitive fields in logged output
+const Redacted = "[REDACTED]"
+
+// DefaultSensitiveKeys are the JSON keys, header names and query parameters
+// whose values are never logged
+var DefaultSensitiveKeys = []string{
+	"password", "current_password", "new_password",
+	"token", "access_token", "refresh_token", "jwt",
+	"api_key", "x-api-key", "x-admin-key",
+	"authorization", "proxy-authorization", "cookie", "set-cookie",
+	"signature", "x-signature",
+	"secret", "encryption_key", "master_key", "private_key", "id_secret",
+}
+
+// Redactor masks the values of sensitive keys. Keys match case-insensitively
+// with "-" and "_" treated alike, so "api_key" also covers an "Api-Key" header.
+type Redactor struct {
+	keys map[string]bool
+}
+
+// NewRedactor masks DefaultSensitiveKeys and extra
+func NewRedactor(extra []string) *Redactor {
+	r := &Redactor{keys: make(map[string]bool)}
+	for _, key := range append(append([]string(nil), DefaultSensitiveKeys...), extra...) {
+		r.keys[normalizeKey(key)] = true
+	}
+	return r
+}
+
+func normalizeKey(key string) string {
+	return strings.ReplaceAll(strings.ToLower(strings.TrimSpace(key)), "-", "_")
+}
+
+// Sensitive reports whether key's value must not be logged
+func (r *Redactor) Sensitive(key string) bool {
+	return r.keys[normalizeKey(key)]
+}
+
+// Header returns a copy of h with the values of sensitive headers masked
+func (r *Redactor) Header(h http.Header) http.Header {
+	masked := make(http.Header, len(h))
+	for name, values := range h {
+		if r.Sensitive(name) {
+			values = []string{Redacted}
+		}
+		masked[name] = values
+	}
+	return masked
+}
+
+// Query returns rawQuery with the values of sensitive parameters masked
+func (r *Redactor) Query(rawQuery string) string {
+	if rawQuery == "" {
+		return ""
+	}
+	values, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return Redacted
+	}
+	for name := range values {
+		if r.Sensitive(name) {
+			values[name] = []string{Redacted}
+		}
+	}
+	return values.Encode()
+}
+
+// JSON returns body with the value of every sensitive key masked, at any
+// depth. A body that is not valid JSON can't be checked and is refused, so
+// nothing unmasked is ever returned.
+func (r *Redactor) JSON(body []byte) ([]byte, bool) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil || dec.More() {
+		return nil, false
+	}
+	masked, err := json.Marshal(r.value(v))
+	if err != nil {
+		return nil, false
+	}
+	return masked, true
+}
+
+func (r *Redactor) value(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if r.Sensitive(key) {
+				v[key] = Redacted
+			} else {
+				v[key] = r.value(value)
+			}
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = r.value(v[i])
+		}
+	}
+	return v
+}
@@ -0,0 +1,149 @@
+// Package merkle builds Merkle trees over a chunk's fixed-size sub-blocks so
+// a storage node can prove it holds a specific part of a chunk without
+// sending the whole chunk.
+//
+// The storage node has an identical package; the two must agree on
+// BlockSize and the hashing scheme.
+package merkle
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+// BlockSize is the size of a leaf sub-block; a chunk's last block may be shorter
+const BlockSize = 1024
+
+// Domain prefixes keep a leaf hash from ever equalling an interior node hash
+const (
+	leafPrefix = 0x00
+	nodePrefix = 0x01
+)
+
+// LeafCount returns the number of sub-blocks in a chunk of size bytes. An
+// empty chunk has a single empty block.
+func LeafCount(size int) int {
+	if size <= 0 {
+		return 1
+	}
+	return (size + BlockSize - 1) / BlockSize
+}
+
+// LeafIndex derives the sub-block a challenge asks for from its seed, so the
+// node cannot know in advance which block will be requested
+func LeafIndex(seed []byte, leafCount int) int {
+	if leafCount <= 1 {
+		return 0
+	}
+	sum := sha256.Sum256(seed)
+	return int(binary.BigEndian.Uint64(sum[:8]) % uint64(leafCount))
+}
+
+// Root returns the Merkle root of data split into BlockSize sub-blocks
+func Root(data []byte) []byte {
+	level := leaves(data)
+	for len(level) > 1 {
+		level = parents(level)
+	}
+	return level[0]
+}
+
+// Prove returns the sub-block at index and the sibling hashes linking it to
+// the root, from the leaf level up
+func Prove(data []byte, index int) ([]byte, [][]byte, error) {
+	count := LeafCount(len(data))
+	if index < 0 || index >= count {
+		return nil, nil, fmt.Errorf("sub-block %d out of range (chunk has %d)", index, count)
+	}
+
+	var path [][]byte
+	level := leaves(data)
+	for i := index; len(level) > 1; i /= 2 {
+		path = append(path, level[sibling(len(level), i)])
+		level = parents(level)
+	}
+	return block(data, index), path, nil
+}
+
+// Verify reports whether block is the sub-block at index of a chunk with
+// leafCount sub-blocks and the given root
+func Verify(root []byte, leafCount, index int, blk []byte, path [][]byte) bool {
+	if index < 0 || index >= leafCount || len(blk) > BlockSize || len(path) != depth(leafCount) {
+		return false
+	}
+
+	hash := hashLeaf(blk)
+	for _, sib := range path {
+		if index%2 == 0 {
+			hash = hashNode(hash, sib)
+		} else {
+			hash = hashNode(sib, hash)
+		}
+		index /= 2
+	}
+	return bytes.Equal(hash, root)
+}
+
+// depth is the number of levels above the leaves, which is the path length
+func depth(leafCount int) int {
+	d := 0
+	for n := leafCount; n > 1; n = (n + 1) / 2 {
+		d++
+	}
+	return d
+}
+
+// sibling returns the index paired with i on a level of n nodes. A trailing
+// node without a partner is paired with itself.
+func sibling(n, i int) int {
+	if i%2 == 1 {
+		return i - 1
+	}
+	if i+1 < n {
+		return i + 1
+	}
+	return i
+}
+
+func block(data []byte, index int) []byte {
+	start := index * BlockSize
+	end := start + BlockSize
+	if end > len(data) {
+		end = len(data)
+	}
+	return data[start:end]
+}
+
+func leaves(data []byte) [][]byte {
+	count := LeafCount(len(data))
+	level := make([][]byte, count)
+	for i := range level {
+		level[i] = hashLeaf(block(data, i))
+	}
+	return level
+}
+
+func parents(level [][]byte) [][]byte {
+	next := make([][]byte, 0, (len(level)+1)/2)
+	for i := 0; i < len(level); i += 2 {
+		next = append(next, hashNode(level[i], level[sibling(len(level), i)]))
+	}
+	return next
+}
+
+func hashLeaf(blk []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{leafPrefix})
+	h.Write(blk)
+	return h.Sum(nil)
+}
+
+func hashNode(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{nodePrefix})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
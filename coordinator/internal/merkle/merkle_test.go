@@ -0,0 +1,78 @@
+package merkle
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testData returns size pseudo-random bytes, so no two sub-blocks are alike
+func testData(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(data)
+	return data
+}
+
+func TestVerify_AcceptsValidPaths(t *testing.T) {
+	sizes := []int{0, 10, BlockSize, BlockSize + 1, 5*BlockSize + 300, 8 * BlockSize}
+
+	for _, size := range sizes {
+		data := testData(size)
+		root := Root(data)
+		count := LeafCount(size)
+
+		for i := 0; i < count; i++ {
+			blk, path, err := Prove(data, i)
+			require.NoError(t, err)
+			assert.True(t, Verify(root, count, i, blk, path), "size %d, block %d", size, i)
+		}
+	}
+}
+
+func TestVerify_RejectsTamperedProofs(t *testing.T) {
+	data := testData(5*BlockSize + 300)
+	root := Root(data)
+	count := LeafCount(len(data))
+
+	blk, path, err := Prove(data, 3)
+	require.NoError(t, err)
+	require.True(t, Verify(root, count, 3, blk, path))
+
+	tampered := bytes.Clone(blk)
+	tampered[0] ^= 0xff
+	assert.False(t, Verify(root, count, 3, tampered, path), "tampered sub-block")
+
+	assert.False(t, Verify(root, count, 2, blk, path), "block presented at the wrong index")
+
+	badPath := append([][]byte(nil), path...)
+	badPath[1] = bytes.Repeat([]byte{0xaa}, 32)
+	assert.False(t, Verify(root, count, 3, blk, badPath), "tampered sibling hash")
+
+	assert.False(t, Verify(root, count, 3, blk, path[:len(path)-1]), "truncated path")
+
+	other := testData(len(data))
+	other[3*BlockSize+5] ^= 0x01
+	assert.False(t, Verify(Root(other), count, 3, blk, path), "root of different data")
+}
+
+func TestLeafIndex_DependsOnSeed(t *testing.T) {
+	assert.Equal(t, 0, LeafIndex([]byte("seed"), 1))
+
+	seen := make(map[int]bool)
+	for i := 0; i < 64; i++ {
+		index := LeafIndex([]byte{byte(i)}, 16)
+		assert.GreaterOrEqual(t, index, 0)
+		assert.Less(t, index, 16)
+		seen[index] = true
+	}
+	assert.Greater(t, len(seen), 1, "different seeds should pick different blocks")
+	assert.Equal(t, LeafIndex([]byte("seed"), 16), LeafIndex([]byte("seed"), 16))
+}
+
+func TestProve_OutOfRange(t *testing.T) {
+	_, _, err := Prove(testData(BlockSize), 1)
+	assert.Error(t, err)
+}
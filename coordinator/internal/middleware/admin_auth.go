@@ -0,0 +1,29 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AdminAuthMiddleware creates middleware for operator endpoints, authenticated by a
+// shared key in the X-Admin-Key header. An empty key disables the admin API.
+func AdminAuthMiddleware(adminKey string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if adminKey == "" {
+			c.JSON(http.StatusForbidden, gin.H{"error": "admin api is disabled"})
+			c.Abort()
+			return
+		}
+
+		key := c.GetHeader("X-Admin-Key")
+		if subtle.ConstantTimeCompare([]byte(key), []byte(adminKey)) != 1 {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
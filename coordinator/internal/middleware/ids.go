@@ -0,0 +1,191 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/hkdf"
+)
+
+// MinIDSecretSize is the shortest secret external IDs are derived from, in bytes
+const MinIDSecretSize = 32
+
+// idTagSize is how many bytes of HMAC authenticate an external ID
+const idTagSize = 8
+
+// ErrInvalidID is returned for an external ID that was not issued by the
+// codec decoding it, including one that was altered
+var ErrInvalidID = errors.New("invalid id")
+
+// IDCodec turns UUIDs into opaque external IDs and back. The UUID is
+// encrypted as a single AES block, hiding its structure, and followed by a
+// truncated HMAC of the ciphertext, so altered or made-up IDs are rejected
+// before any lookup rather than probed against the database.
+type IDCodec struct {
+	block  cipher.Block
+	macKey []byte
+}
+
+// NewIDCodec creates a codec keyed by secret, which must be at least
+// MinIDSecretSize bytes. The same secret always gives the same external IDs.
+func NewIDCodec(secret []byte) (*IDCodec, error) {
+	if len(secret) < MinIDSecretSize {
+		return nil, fmt.Errorf("id secret must be at least %d bytes, got %d", MinIDSecretSize, len(secret))
+	}
+	keys := make([]byte, 64)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, []byte("de-store external ids")), keys); err != nil {
+		return nil, fmt.Errorf("failed to derive id keys: %w", err)
+	}
+	block, err := aes.NewCipher(keys[:32])
+	if err != nil {
+		return nil, err
+	}
+	return &IDCodec{block: block, macKey: keys[32:]}, nil
+}
+
+func (c *IDCodec) tag(sealed []byte) []byte {
+	mac := hmac.New(sha256.New, c.macKey)
+	mac.Write(sealed)
+	return mac.Sum(nil)[:idTagSize]
+}
+
+// Encode returns the external ID of id
+func (c *IDCodec) Encode(id uuid.UUID) string {
+	out := make([]byte, aes.BlockSize, aes.BlockSize+idTagSize)
+	c.block.Encrypt(out, id[:])
+	return base64.RawURLEncoding.EncodeToString(append(out, c.tag(out)...))
+}
+
+// Decode returns the UUID behind an external ID, or ErrInvalidID
+func (c *IDCodec) Decode(external string) (uuid.UUID, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(external)
+	if err != nil || len(raw) != aes.BlockSize+idTagSize {
+		return uuid.Nil, ErrInvalidID
+	}
+	sealed := raw[:aes.BlockSize]
+	if !hmac.Equal(raw[aes.BlockSize:], c.tag(sealed)) {
+		return uuid.Nil, ErrInvalidID
+	}
+	var id uuid.UUID
+	c.block.Decrypt(id[:], sealed)
+	return id, nil
+}
+
+// obfuscatedKeys are the JSON keys whose UUID values are file or upload
+// session IDs in the responses of the routes ObfuscateIDs wraps
+var obfuscatedKeys = map[string]bool{
+	"id":             true,
+	"file_id":        true,
+	"parent_file_id": true,
+	"session_id":     true,
+}
+
+// idWriter holds back JSON responses so their IDs can be encoded; anything
+// else, such as a download, is written through as it comes
+type idWriter struct {
+	gin.ResponseWriter
+	body     bytes.Buffer
+	buffered bool
+}
+
+func (w *idWriter) holdsBack() bool {
+	if !w.buffered && !w.ResponseWriter.Written() &&
+		strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+		w.buffered = true
+	}
+	return w.buffered
+}
+
+func (w *idWriter) Write(data []byte) (int, error) {
+	if w.holdsBack() {
+		return w.body.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *idWriter) WriteString(s string) (int, error) {
+	if w.holdsBack() {
+		return w.body.WriteString(s)
+	}
+	return w.ResponseWriter.WriteString(s)
+}
+
+// encodeIDs replaces the UUID strings under obfuscatedKeys, at any depth, with
+// their external IDs
+func encodeIDs(codec *IDCodec, v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if s, ok := value.(string); ok && obfuscatedKeys[key] {
+				if id, err := uuid.Parse(s); err == nil {
+					v[key] = codec.Encode(id)
+				}
+				continue
+			}
+			v[key] = encodeIDs(codec, value)
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = encodeIDs(codec, v[i])
+		}
+	}
+	return v
+}
+
+// ObfuscateIDs exposes file and upload session IDs only in their codec form:
+// the :id path parameter is decoded back to its UUID before the handler runs,
+// and UUIDs under the id, file_id, parent_file_id and session_id keys of JSON
+// responses are encoded. A path ID the codec did not issue, a raw UUID
+// included, gets 404 without reaching the handler. A nil codec disables the
+// middleware.
+func ObfuscateIDs(codec *IDCodec) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if codec == nil {
+			c.Next()
+			return
+		}
+
+		for i, param := range c.Params {
+			if param.Key != "id" {
+				continue
+			}
+			id, err := codec.Decode(param.Value)
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "not found"})
+				return
+			}
+			c.Params[i].Value = id.String()
+		}
+
+		writer := &idWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+		c.Next()
+		c.Writer = writer.ResponseWriter
+
+		if !writer.buffered {
+			return
+		}
+		body := writer.body.Bytes()
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		var v interface{}
+		if dec.Decode(&v) == nil {
+			if encoded, err := json.Marshal(encodeIDs(codec, v)); err == nil {
+				body = encoded
+			}
+		}
+		c.Writer.Write(body)
+	}
+}
@@ -0,0 +1,107 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIDCodec_RoundTripAndTampering(t *testing.T) {
+	_, err := NewIDCodec(make([]byte, 16))
+	assert.Error(t, err, "Short secrets are refused")
+
+	codec, err := NewIDCodec(bytes.Repeat([]byte("k"), 32))
+	require.NoError(t, err)
+
+	id := uuid.New()
+	external := codec.Encode(id)
+	assert.Len(t, external, 32)
+	assert.NotContains(t, external, id.String())
+	assert.Equal(t, external, codec.Encode(id), "Encoding is deterministic")
+	decoded, err := codec.Decode(external)
+	require.NoError(t, err)
+	assert.Equal(t, id, decoded)
+
+	// Flipping any character is caught
+	for i := range external {
+		tampered := []byte(external)
+		if tampered[i] == 'A' {
+			tampered[i] = 'B'
+		} else {
+			tampered[i] = 'A'
+		}
+		_, err := codec.Decode(string(tampered))
+		assert.ErrorIs(t, err, ErrInvalidID, "position %d", i)
+	}
+	for _, bad := range []string{"", id.String(), external[:31], external + "A", "!!" + external[2:]} {
+		_, err := codec.Decode(bad)
+		assert.ErrorIs(t, err, ErrInvalidID, bad)
+	}
+
+	// Another secret's IDs are not accepted
+	other, err := NewIDCodec(bytes.Repeat([]byte("o"), 32))
+	require.NoError(t, err)
+	_, err = other.Decode(external)
+	assert.ErrorIs(t, err, ErrInvalidID)
+}
+
+func TestObfuscateIDs(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	codec, err := NewIDCodec(bytes.Repeat([]byte("k"), 32))
+	require.NoError(t, err)
+
+	fileID, nodeID := uuid.New(), uuid.New()
+	router := gin.New()
+	router.Use(ObfuscateIDs(codec))
+	var seen string
+	router.GET("/files/:id", func(c *gin.Context) {
+		seen = c.Param("id")
+		c.JSON(http.StatusCreated, gin.H{
+			"id":    fileID,
+			"size":  12345678901234,
+			"nodes": []gin.H{{"node_id": nodeID, "file_id": fileID}},
+		})
+	})
+	router.GET("/files/:id/download", func(c *gin.Context) {
+		c.Data(http.StatusOK, "application/octet-stream", []byte(`{"id":"`+fileID.String()+`"}`))
+	})
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/files/"+codec.Encode(fileID), nil))
+	require.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, fileID.String(), seen, "The handler sees the UUID")
+	var body struct {
+		ID    string            `json:"id"`
+		Size  int64             `json:"size"`
+		Nodes []json.RawMessage `json:"nodes"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, codec.Encode(fileID), body.ID)
+	assert.Equal(t, int64(12345678901234), body.Size)
+	require.Len(t, body.Nodes, 1)
+	assert.JSONEq(t, `{"node_id": "`+nodeID.String()+`", "file_id": "`+codec.Encode(fileID)+`"}`, string(body.Nodes[0]),
+		"Only file and session IDs are encoded")
+
+	// Non-JSON responses pass through untouched
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/files/"+codec.Encode(fileID)+"/download", nil))
+	assert.Equal(t, `{"id":"`+fileID.String()+`"}`, w.Body.String())
+
+	// Raw UUIDs and altered IDs never reach the handler
+	seen = ""
+	tampered := []byte(codec.Encode(fileID))
+	tampered[0] ^= 1
+	for _, id := range []string{fileID.String(), string(tampered)} {
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/files/"+id, nil))
+		assert.Equal(t, http.StatusNotFound, w.Code, id)
+	}
+	assert.Empty(t, seen)
+}
@@ -1,14 +1,46 @@
 package middleware
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
 	"crypto/subtle"
+	"encoding/hex"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
+// DefaultSignatureMaxSkew bounds how far a signed request's timestamp may be
+// from the coordinator's clock
+const DefaultSignatureMaxSkew = 5 * time.Minute
+
 // NodeAuthMiddleware creates middleware for node API key authentication
 func NodeAuthMiddleware(getAPIKeyHash func(peerID string) (string, error)) gin.HandlerFunc {
+	return nodeAuth(getAPIKeyHash, false, 0)
+}
+
+// SignedNodeAuthMiddleware authenticates like NodeAuthMiddleware and also
+// requires X-Timestamp (unix seconds) and X-Signature headers, where the
+// signature is SignNodeRequest over the method, path and timestamp. Requests
+// that are unsigned, wrongly signed or older than maxSkew are rejected.
+func SignedNodeAuthMiddleware(getAPIKeyHash func(peerID string) (string, error), maxSkew time.Duration) gin.HandlerFunc {
+	if maxSkew <= 0 {
+		maxSkew = DefaultSignatureMaxSkew
+	}
+	return nodeAuth(getAPIKeyHash, true, maxSkew)
+}
+
+// SignNodeRequest returns the hex HMAC-SHA256, keyed with the node's API key,
+// of the request method, path (with query) and timestamp
+func SignNodeRequest(apiKey, method, path, timestamp string) string {
+	mac := hmac.New(sha256.New, []byte(apiKey))
+	mac.Write([]byte(method + "\n" + path + "\n" + timestamp))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func nodeAuth(getAPIKeyHash func(peerID string) (string, error), requireSignature bool, maxSkew time.Duration) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		peerID := c.GetHeader("X-Peer-ID")
 		apiKey := c.GetHeader("X-API-Key")
@@ -32,7 +64,40 @@ func NodeAuthMiddleware(getAPIKeyHash func(peerID string) (string, error)) gin.H
 			return
 		}
 
+		if requireSignature {
+			if msg := checkSignature(c, apiKey, maxSkew); msg != "" {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": msg})
+				c.Abort()
+				return
+			}
+		}
+
 		c.Set("peer_id", peerID)
 		c.Next()
 	}
 }
+
+// checkSignature validates the request's timestamp and signature, returning
+// the reason for rejection or "" if the request is properly signed
+func checkSignature(c *gin.Context, apiKey string, maxSkew time.Duration) string {
+	timestamp := c.GetHeader("X-Timestamp")
+	signature := c.GetHeader("X-Signature")
+	if timestamp == "" || signature == "" {
+		return "request signature required"
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "invalid request timestamp"
+	}
+	skew := time.Since(time.Unix(seconds, 0))
+	if skew > maxSkew || skew < -maxSkew {
+		return "stale request timestamp"
+	}
+
+	expected := SignNodeRequest(apiKey, c.Request.Method, c.Request.URL.RequestURI(), timestamp)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return "invalid request signature"
+	}
+	return ""
+}
@@ -0,0 +1,23 @@
+package middleware
+
+import (
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ConfigureTrustedProxies makes c.ClientIP() report the original client when
+// requests arrive through one of the given proxies (IPs or CIDRs), taking it
+// from X-Forwarded-For or X-Real-IP. Forwarding headers from any other peer
+// are ignored, so with no proxies configured the connection's address is used.
+func ConfigureTrustedProxies(router *gin.Engine, proxies []string) error {
+	router.ForwardedByClientIP = true
+	router.RemoteIPHeaders = []string{"X-Forwarded-For", "X-Real-IP"}
+	if len(proxies) == 0 {
+		proxies = nil
+	}
+	if err := router.SetTrustedProxies(proxies); err != nil {
+		return fmt.Errorf("invalid trusted proxy: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigureTrustedProxies(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name       string
+		proxies    []string
+		remoteAddr string
+		headers    map[string]string
+		expectedIP string
+	}{
+		{
+			name: "forwarded through trusted proxy", proxies: []string{"10.0.0.0/8"}, remoteAddr: "10.0.0.5:4321",
+			headers: map[string]string{"X-Forwarded-For": "203.0.113.7"}, expectedIP: "203.0.113.7",
+		},
+		{
+			name: "chain of trusted proxies", proxies: []string{"10.0.0.0/8"}, remoteAddr: "10.0.0.5:4321",
+			headers: map[string]string{"X-Forwarded-For": "203.0.113.7, 10.1.2.3"}, expectedIP: "203.0.113.7",
+		},
+		{
+			name: "real ip header from trusted proxy", proxies: []string{"10.0.0.5"}, remoteAddr: "10.0.0.5:4321",
+			headers: map[string]string{"X-Real-IP": "198.51.100.9"}, expectedIP: "198.51.100.9",
+		},
+		{
+			name: "spoofed header from untrusted peer", proxies: []string{"10.0.0.0/8"}, remoteAddr: "192.0.2.44:4321",
+			headers: map[string]string{"X-Forwarded-For": "203.0.113.7"}, expectedIP: "192.0.2.44",
+		},
+		{
+			name: "no proxies configured", proxies: nil, remoteAddr: "10.0.0.5:4321",
+			headers: map[string]string{"X-Forwarded-For": "203.0.113.7"}, expectedIP: "10.0.0.5",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := gin.New()
+			require.NoError(t, ConfigureTrustedProxies(router, tt.proxies))
+			router.GET("/ip", func(c *gin.Context) { c.String(http.StatusOK, c.ClientIP()) })
+
+			req := httptest.NewRequest(http.MethodGet, "/ip", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tt.expectedIP, w.Body.String())
+		})
+	}
+
+	assert.Error(t, ConfigureTrustedProxies(gin.New(), []string{"not-an-ip"}))
+}
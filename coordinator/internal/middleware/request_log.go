@@ -0,0 +1,104 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/federated-storage/coordinator/internal/logging"
+	"github.com/gin-gonic/gin"
+)
+
+// maxLoggedBodyBytes bounds the request and response bodies RequestLogger
+// keeps; longer ones are left out of the log
+const maxLoggedBodyBytes = 64 * 1024
+
+func isJSON(contentType string) bool {
+	return strings.HasPrefix(contentType, "application/json")
+}
+
+// bodyLogWriter keeps the start of a JSON response for the log while writing it through
+type bodyLogWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+	size int
+}
+
+func (w *bodyLogWriter) keep(data []byte) {
+	w.size += len(data)
+	if isJSON(w.Header().Get("Content-Type")) && w.body.Len() < maxLoggedBodyBytes {
+		w.body.Write(data[:min(len(data), maxLoggedBodyBytes-w.body.Len())])
+	}
+}
+
+func (w *bodyLogWriter) Write(data []byte) (int, error) {
+	w.keep(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *bodyLogWriter) WriteString(s string) (int, error) {
+	w.keep([]byte(s))
+	return w.ResponseWriter.WriteString(s)
+}
+
+// loggedBody describes a body for the log: its JSON with sensitive keys
+// masked, or just its size when it isn't JSON, is too long to keep whole, or
+// can't be parsed to be masked
+func loggedBody(redactor *logging.Redactor, contentType string, kept []byte, size int) string {
+	if size == 0 {
+		return "-"
+	}
+	if isJSON(contentType) && len(kept) == size {
+		if masked, ok := redactor.JSON(kept); ok {
+			return string(masked)
+		}
+	}
+	return fmt.Sprintf("<%d bytes>", size)
+}
+
+// RequestLogger writes a line per request to out with its method, path,
+// status, latency and client IP, followed by its headers, the response's
+// headers and both JSON bodies. Everything passes through redactor first:
+// sensitive headers, query parameters and JSON keys are masked, and bodies it
+// can't check are logged only by size. Request bodies that aren't JSON, such
+// as uploads, are not read.
+func RequestLogger(out io.Writer, redactor *logging.Redactor) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		var requestBody []byte
+		requestSize := 0
+		if c.Request.Body != nil && isJSON(c.ContentType()) {
+			kept, _ := io.ReadAll(io.LimitReader(c.Request.Body, maxLoggedBodyBytes+1))
+			c.Request.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(kept), c.Request.Body), c.Request.Body}
+			requestBody, requestSize = kept, max(len(kept), int(c.Request.ContentLength))
+			if len(kept) > maxLoggedBodyBytes {
+				requestBody = nil
+			}
+		} else if c.Request.ContentLength > 0 {
+			requestSize = int(c.Request.ContentLength)
+		}
+
+		writer := &bodyLogWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+		c.Next()
+		c.Writer = writer.ResponseWriter
+
+		path := c.Request.URL.Path
+		if query := redactor.Query(c.Request.URL.RawQuery); query != "" {
+			path += "?" + query
+		}
+		requestHeaders, _ := json.Marshal(redactor.Header(c.Request.Header))
+		responseHeaders, _ := json.Marshal(redactor.Header(writer.Header()))
+		fmt.Fprintf(out, "[REQUEST] %s | %3d | %13v | %15s | %s %s | headers=%s | body=%s | response_headers=%s | response=%s\n",
+			start.Format("2006/01/02 - 15:04:05"), writer.Status(), time.Since(start), c.ClientIP(), c.Request.Method, path,
+			requestHeaders, loggedBody(redactor, c.ContentType(), requestBody, requestSize),
+			responseHeaders, loggedBody(redactor, writer.Header().Get("Content-Type"), writer.body.Bytes(), writer.size))
+	}
+}
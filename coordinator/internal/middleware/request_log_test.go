@@ -0,0 +1,57 @@
+package middleware
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/federated-storage/coordinator/internal/logging"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestLogger_MasksSensitiveFields(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var out bytes.Buffer
+	router := gin.New()
+	router.Use(RequestLogger(&out, logging.NewRedactor(nil)))
+	var received struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+	router.POST("/api/v1/auth/register", func(c *gin.Context) {
+		require.NoError(t, c.ShouldBindJSON(&received))
+		c.JSON(http.StatusCreated, gin.H{"token": "eyJhbGciOiJIUzI1NiJ9.payload.sig", "user": gin.H{"email": received.Email}})
+	})
+	router.POST("/upload", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/auth/register?api_key=query-secret",
+		strings.NewReader(`{"email":"user@example.com","password":"correct horse battery staple"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-Key", "node-api-key-123")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "correct horse battery staple", received.Password, "The handler still gets the whole body")
+
+	logged := out.String()
+	for _, secret := range []string{"correct horse battery staple", "node-api-key-123", "query-secret", "eyJhbGciOiJIUzI1NiJ9"} {
+		assert.NotContains(t, logged, secret)
+	}
+	assert.Contains(t, logged, `"password":"[REDACTED]"`)
+	assert.Contains(t, logged, `"X-Api-Key":["[REDACTED]"]`)
+	assert.Contains(t, logged, `"token":"[REDACTED]"`)
+	assert.Contains(t, logged, "user@example.com", "Other fields are logged")
+	assert.Contains(t, logged, "POST /api/v1/auth/register?api_key=%5BREDACTED%5D")
+
+	// Bodies that aren't JSON are logged only by size
+	out.Reset()
+	req = httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("password=hunter2"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	assert.NotContains(t, out.String(), "hunter2")
+	assert.Contains(t, out.String(), "body=<16 bytes>")
+}
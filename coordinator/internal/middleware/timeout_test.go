@@ -0,0 +1,92 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestTimeout(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	// slow stands in for a handler stuck on a query: it gives up when its
+	// context is cancelled, reporting the error as handlers do
+	slow := func(c *gin.Context) {
+		select {
+		case <-c.Request.Context().Done():
+			c.JSON(http.StatusInternalServerError, gin.H{"error": c.Request.Context().Err().Error()})
+		case <-time.After(5 * time.Second):
+			c.JSON(http.StatusOK, gin.H{"status": "done"})
+		}
+	}
+	// stubborn ignores its context and answers late
+	stubborn := func(c *gin.Context) {
+		time.Sleep(100 * time.Millisecond)
+		c.JSON(http.StatusOK, gin.H{"status": "done"})
+	}
+
+	// download starts describing an attachment before it stalls
+	download := func(c *gin.Context) {
+		c.Header("Content-Disposition", `attachment; filename="report.pdf"`)
+		c.Header("Content-Length", "1048576")
+		stubborn(c)
+	}
+
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Header("X-Request-ID", "req-1")
+		c.Next()
+	})
+	router.Use(RequestTimeout(50*time.Millisecond, []string{"/files/:id/download", "POST /upload"}))
+	router.GET("/slow", slow)
+	router.GET("/stubborn", stubborn)
+	router.GET("/report", download)
+	router.GET("/fast", func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{"status": "done"}) })
+	router.GET("/files/:id/download", stubborn)
+	router.POST("/upload", stubborn)
+	router.GET("/upload", stubborn)
+
+	serve := func(method, path string) (*httptest.ResponseRecorder, time.Duration) {
+		start := time.Now()
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w, time.Since(start)
+	}
+
+	w, took := serve(http.MethodGet, "/slow")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), "request timed out")
+	assert.NotContains(t, w.Body.String(), "deadline exceeded", "The handler's own error should be discarded")
+	assert.Less(t, took, time.Second, "The slow handler should be cut off at the timeout")
+
+	w, _ = serve(http.MethodGet, "/stubborn")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code, "A late answer is replaced")
+	assert.NotContains(t, w.Body.String(), "done")
+
+	w, _ = serve(http.MethodGet, "/report")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Empty(t, w.Header().Get("Content-Disposition"), "Headers of the abandoned answer must not reach the 503")
+	assert.NotEqual(t, "1048576", w.Header().Get("Content-Length"))
+	assert.Equal(t, "application/json; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, "req-1", w.Header().Get("X-Request-ID"), "Headers set before the handler ran are kept")
+
+	w, _ = serve(http.MethodGet, "/fast")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w, _ = serve(http.MethodGet, "/files/abc/download")
+	assert.Equal(t, http.StatusOK, w.Code, "Exempt routes run unbounded")
+	w, _ = serve(http.MethodPost, "/upload")
+	assert.Equal(t, http.StatusOK, w.Code, "A route can be exempt for one method")
+	w, _ = serve(http.MethodGet, "/upload")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	router = gin.New()
+	router.Use(RequestTimeout(0, nil))
+	router.GET("/stubborn", stubborn)
+	w, _ = serve(http.MethodGet, "/stubborn")
+	assert.Equal(t, http.StatusOK, w.Code, "A zero timeout disables the middleware")
+}
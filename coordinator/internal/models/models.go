@@ -8,12 +8,18 @@ import (
 
 // User represents a user in the system
 type User struct {
-	ID           uuid.UUID `db:"id" json:"id"`
-	Email        string    `db:"email" json:"email"`
-	PasswordHash string    `db:"password_hash" json:"-"`
-	Credits      int64     `db:"credits" json:"credits"`
-	CreatedAt    time.Time `db:"created_at" json:"created_at"`
-	UpdatedAt    time.Time `db:"updated_at" json:"updated_at"`
+	ID            uuid.UUID `db:"id" json:"id"`
+	Email         string    `db:"email" json:"email"`
+	PasswordHash  string    `db:"password_hash" json:"-"`
+	Credits       int64     `db:"credits" json:"credits"`
+	HeldCredits   int64     `db:"held_credits" json:"held_credits"` // reserved for uploads in progress
+	CreditsPerUSD *int64    `db:"credits_per_usd" json:"credits_per_usd,omitempty"`
+	CreatedAt     time.Time `db:"created_at" json:"created_at"`
+	UpdatedAt     time.Time `db:"updated_at" json:"updated_at"`
+	// FailedLoginAttempts counts consecutive failed logins; LockedUntil is set
+	// while too many of them keep the account locked
+	FailedLoginAttempts int        `db:"failed_login_attempts" json:"-"`
+	LockedUntil         *time.Time `db:"locked_until" json:"-"`
 }
 
 // StorageNode represents a storage node in the network
@@ -25,27 +31,109 @@ type StorageNode struct {
 	Address           string     `db:"address" json:"address"`
 	APIKeyHash        string     `db:"api_key_hash" json:"-"`
 	Status            string     `db:"status" json:"status"`
+	Version           string     `db:"version" json:"version"`
+	OperatorID        string     `db:"operator_id" json:"operator_id,omitempty"`
+	Region            string     `db:"region" json:"region,omitempty"`
 	TotalStorageBytes int64      `db:"total_storage_bytes" json:"total_storage_bytes"`
 	UsedStorageBytes  int64      `db:"used_storage_bytes" json:"used_storage_bytes"`
 	EarnedCredits     int64      `db:"earned_credits" json:"earned_credits"`
 	UptimePercentage  float64    `db:"uptime_percentage" json:"uptime_percentage"`
+	ReputationScore   float64    `db:"reputation_score" json:"reputation_score"`
 	LastHeartbeat     *time.Time `db:"last_heartbeat" json:"last_heartbeat"`
-	CreatedAt         time.Time  `db:"created_at" json:"created_at"`
-	UpdatedAt         time.Time  `db:"updated_at" json:"updated_at"`
+	// MaintenanceStart and MaintenanceEnd bound a window the node scheduled
+	// to be offline; both are nil when none is scheduled
+	MaintenanceStart *time.Time `db:"maintenance_start" json:"maintenance_start,omitempty"`
+	MaintenanceEnd   *time.Time `db:"maintenance_end" json:"maintenance_end,omitempty"`
+	// CapacityVerifiedAt is when the node last passed a capacity proof
+	CapacityVerifiedAt *time.Time `db:"capacity_verified_at" json:"capacity_verified_at,omitempty"`
+	// ClaimedStorageBytes is set when TotalStorageBytes was capped because
+	// the claim is not yet backed by a capacity proof
+	ClaimedStorageBytes int64     `db:"-" json:"claimed_storage_bytes,omitempty"`
+	CreatedAt           time.Time `db:"created_at" json:"created_at"`
+	UpdatedAt           time.Time `db:"updated_at" json:"updated_at"`
 }
 
-// File represents a stored file
-type File struct {
+// NodeReputation is a point-in-time snapshot of a node's behavior
+type NodeReputation struct {
+	ID               uuid.UUID `db:"id" json:"id"`
+	NodeID           uuid.UUID `db:"node_id" json:"node_id"`
+	UptimePercentage float64   `db:"uptime_percentage" json:"uptime_percentage"`
+	ProofsVerified   int       `db:"proofs_verified" json:"proofs_verified"`
+	ProofsFailed     int       `db:"proofs_failed" json:"proofs_failed"`
+	ProofPassRate    float64   `db:"proof_pass_rate" json:"proof_pass_rate"`
+	Availability     float64   `db:"availability" json:"availability"`
+	Score            float64   `db:"score" json:"score"`
+	RecordedAt       time.Time `db:"recorded_at" json:"recorded_at"`
+}
+
+// NodeInvite is an admin-issued, one-time token admitting a storage node
+type NodeInvite struct {
+	ID        uuid.UUID  `db:"id" json:"id"`
+	TokenHash string     `db:"token_hash" json:"-"`
+	Note      string     `db:"note" json:"note"`
+	ExpiresAt *time.Time `db:"expires_at" json:"expires_at,omitempty"`
+	UsedAt    *time.Time `db:"used_at" json:"used_at,omitempty"`
+	CreatedAt time.Time  `db:"created_at" json:"created_at"`
+}
+
+// NodeExclusion keeps the node with PeerID out of new chunk placements
+type NodeExclusion struct {
+	PeerID    string    `db:"peer_id" json:"peer_id"`
+	Reason    string    `db:"reason" json:"reason"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// ReadOnlyMode is whether the coordinator refuses writes, since when and why
+type ReadOnlyMode struct {
+	Enabled bool      `db:"enabled" json:"read_only"`
+	Reason  string    `db:"reason" json:"reason,omitempty"`
+	Since   time.Time `db:"since" json:"since"`
+}
+
+// Webhook receives signed event notifications at URL. UserID is nil for
+// operator webhooks, which see every event rather than one user's.
+type Webhook struct {
+	ID        uuid.UUID  `db:"id" json:"id"`
+	UserID    *uuid.UUID `db:"user_id" json:"user_id,omitempty"`
+	URL       string     `db:"url" json:"url"`
+	Secret    string     `db:"secret" json:"-"`
+	Events    []string   `db:"events" json:"events"`
+	CreatedAt time.Time  `db:"created_at" json:"created_at"`
+}
+
+// WebhookDelivery is one event queued for one webhook
+type WebhookDelivery struct {
 	ID            uuid.UUID `db:"id" json:"id"`
-	UserID        uuid.UUID `db:"user_id" json:"user_id"`
-	Filename      string    `db:"filename" json:"filename"`
-	SizeBytes     int64     `db:"size_bytes" json:"size_bytes"`
-	MimeType      string    `db:"mime_type" json:"mime_type"`
-	EncryptionKey []byte    `db:"encryption_key" json:"-"`
-	Status        string    `db:"status" json:"status"`
-	ChunkCount    int       `db:"chunk_count" json:"chunk_count"`
+	WebhookID     uuid.UUID `db:"webhook_id" json:"webhook_id"`
+	Event         string    `db:"event" json:"event"`
+	Payload       []byte    `db:"payload" json:"-"`
+	Status        string    `db:"status" json:"status"` // pending, delivered or failed
+	Attempts      int       `db:"attempts" json:"attempts"`
+	NextAttemptAt time.Time `db:"next_attempt_at" json:"next_attempt_at"`
+	LastError     string    `db:"last_error" json:"last_error,omitempty"`
 	CreatedAt     time.Time `db:"created_at" json:"created_at"`
-	UpdatedAt     time.Time `db:"updated_at" json:"updated_at"`
+}
+
+// File represents a stored file
+type File struct {
+	ID            uuid.UUID  `db:"id" json:"id"`
+	UserID        uuid.UUID  `db:"user_id" json:"user_id"`
+	Filename      string     `db:"filename" json:"filename"`
+	SizeBytes     int64      `db:"size_bytes" json:"size_bytes"`
+	MimeType      string     `db:"mime_type" json:"mime_type"`
+	EncryptionKey []byte     `db:"encryption_key" json:"-"`
+	Cipher        string     `db:"cipher" json:"cipher"`
+	Status        string     `db:"status" json:"status"`
+	ChunkCount    int        `db:"chunk_count" json:"chunk_count"`
+	ContentSHA256 string     `db:"content_sha256" json:"content_sha256,omitempty"`
+	ExpiresAt     *time.Time `db:"expires_at" json:"expires_at,omitempty"`
+	Version       int        `db:"version" json:"version"`
+	ParentFileID  *uuid.UUID `db:"parent_file_id" json:"parent_file_id,omitempty"` // first version, for later versions
+	Revision      int        `db:"revision" json:"revision"`                       // incremented on every change, for If-Match
+	Replicas      int        `db:"replicas" json:"replicas,omitempty"`             // replicas charged for at completion; 0 if not recorded
+	Tags          []string   `db:"-" json:"tags"`
+	CreatedAt     time.Time  `db:"created_at" json:"created_at"`
+	UpdatedAt     time.Time  `db:"updated_at" json:"updated_at"`
 }
 
 // Chunk represents a file chunk
@@ -55,6 +143,22 @@ type Chunk struct {
 	ChunkIndex int       `db:"chunk_index" json:"chunk_index"`
 	Hash       string    `db:"hash" json:"hash"`
 	SizeBytes  int       `db:"size_bytes" json:"size_bytes"`
+	MerkleRoot string    `db:"merkle_root" json:"merkle_root,omitempty"` // empty for chunks stored before roots were recorded
+	// Format is the chunkformat version of the stored data; chunks stored
+	// before headers were written, and direct uploads, are chunkformat.Legacy
+	Format int `db:"format" json:"-"`
+	// NodeOnly is set by Store.ListChunks for chunks the coordinator holds no
+	// copy of, which are read from their nodes
+	NodeOnly bool `db:"-" json:"-"`
+}
+
+// ContentHashGroup counts the ready files whose plaintext hashes to Hash.
+// Chunks are encrypted under per-file keys, so only the plaintext hash shows
+// files with the same content.
+type ContentHashGroup struct {
+	Hash      string `json:"hash"`
+	Files     int    `json:"files"`
+	SizeBytes int64  `json:"size_bytes"` // size of one copy
 }
 
 // ChunkAssignment represents a chunk stored on a node
@@ -66,6 +170,15 @@ type ChunkAssignment struct {
 	CreatedAt time.Time `db:"created_at" json:"created_at"`
 }
 
+// DrainCopy records a replica copied to NodeID while SourceNodeID drained
+// for maintenance, to be retired once the source is back
+type DrainCopy struct {
+	ChunkID      uuid.UUID `db:"chunk_id" json:"chunk_id"`
+	NodeID       uuid.UUID `db:"node_id" json:"node_id"`
+	SourceNodeID uuid.UUID `db:"source_node_id" json:"source_node_id"`
+	CreatedAt    time.Time `db:"created_at" json:"created_at"`
+}
+
 // UploadSession represents an active upload
 type UploadSession struct {
 	ID             uuid.UUID  `db:"id" json:"id"`
@@ -74,10 +187,17 @@ type UploadSession struct {
 	Filename       string     `db:"filename" json:"filename"`
 	SizeBytes      int64      `db:"size_bytes" json:"size_bytes"`
 	EncryptionKey  []byte     `db:"encryption_key" json:"-"`
+	Cipher         string     `db:"cipher" json:"cipher"`
 	ChunkCount     int        `db:"chunk_count" json:"chunk_count"`
+	ChunkSize      int64      `db:"chunk_size" json:"chunk_size"`           // 0 for sessions from before it was recorded
+	LastChunkSize  int64      `db:"last_chunk_size" json:"last_chunk_size"` // every other chunk is full-size
 	ReceivedChunks int        `db:"received_chunks" json:"received_chunks"`
 	Status         string     `db:"status" json:"status"`
 	ExpiresAt      time.Time  `db:"expires_at" json:"expires_at"`
+	FileExpiresAt  *time.Time `db:"file_expires_at" json:"file_expires_at,omitempty"`
+	Versioned      bool       `db:"versioned" json:"versioned"`
+	Direct         bool       `db:"direct" json:"direct"` // chunks are sent straight to the nodes
+	HeldCredits    int64      `db:"held_credits" json:"held_credits"`
 	CreatedAt      time.Time  `db:"created_at" json:"created_at"`
 }
 
@@ -88,6 +208,7 @@ type ProofChallenge struct {
 	NodeID     uuid.UUID  `db:"node_id" json:"node_id"`
 	Seed       []byte     `db:"seed" json:"-"`
 	Difficulty int        `db:"difficulty" json:"difficulty"`
+	TimeoutMs  int        `db:"timeout_ms" json:"timeout_ms"`
 	Status     string     `db:"status" json:"status"`
 	ProofHash  *string    `db:"proof_hash" json:"proof_hash,omitempty"`
 	DurationMs *int       `db:"duration_ms" json:"duration_ms,omitempty"`
@@ -95,6 +216,50 @@ type ProofChallenge struct {
 	CreatedAt  time.Time  `db:"created_at" json:"created_at"`
 }
 
+// FileChallenge asks a node for one proof covering several chunks of a file,
+// sampled from the seed among those it holds
+type FileChallenge struct {
+	ID         uuid.UUID   `db:"id" json:"id"`
+	FileID     uuid.UUID   `db:"file_id" json:"file_id"`
+	NodeID     uuid.UUID   `db:"node_id" json:"node_id"`
+	Seed       []byte      `db:"seed" json:"-"`
+	ChunkIDs   []uuid.UUID `db:"chunk_ids" json:"chunk_ids"` // in chunk index order, which the proof follows
+	TimeoutMs  int         `db:"timeout_ms" json:"timeout_ms"`
+	Status     string      `db:"status" json:"status"`
+	ProofHash  *string     `db:"proof_hash" json:"proof_hash,omitempty"`
+	DurationMs *int        `db:"duration_ms" json:"duration_ms,omitempty"`
+	VerifiedAt *time.Time  `db:"verified_at" json:"verified_at,omitempty"`
+	CreatedAt  time.Time   `db:"created_at" json:"created_at"`
+}
+
+// MerkleProof is a chunk sub-block and the sibling hashes linking it to the chunk's Merkle root
+type MerkleProof struct {
+	LeafIndex int      `json:"leaf_index"`
+	Block     []byte   `json:"block"`
+	Path      [][]byte `json:"path"`
+}
+
+// CapacityChallenge asks a node to store the blocks of BlockSize bytes sent
+// after it, each at its block offset into the node's claimed capacity
+type CapacityChallenge struct {
+	BlockSize int     `json:"block_size"`
+	Offsets   []int64 `json:"offsets"`
+}
+
+// CapacitySample asks a node holding a capacity challenge's blocks to hash
+// some of them as read back from its disk, each prefixed with Nonce
+type CapacitySample struct {
+	Nonce  []byte `json:"nonce"`
+	Blocks []int  `json:"blocks"` // positions in the challenge's Offsets
+}
+
+// CapacityProof is a node's answer to a capacity sample, one hex SHA-256 per
+// sampled block, or why it could not take the challenge
+type CapacityProof struct {
+	Digests []string `json:"digests,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
 // CreditTransaction represents a credit transaction
 type CreditTransaction struct {
 	ID              uuid.UUID  `db:"id" json:"id"`
@@ -104,6 +269,11 @@ type CreditTransaction struct {
 	Amount          int64      `db:"amount" json:"amount"`
 	Description     string     `db:"description" json:"description"`
 	CreatedAt       time.Time  `db:"created_at" json:"created_at"`
+	// PrevHash is the RowHash of the user's previous transaction, empty for the first
+	PrevHash string `db:"prev_hash" json:"prev_hash,omitempty"`
+	// RowHash chains this transaction to PrevHash; empty for transactions
+	// recorded before the chain existed
+	RowHash string `db:"row_hash" json:"row_hash,omitempty"`
 }
 
 // NodeEarnings represents daily earnings for a node
@@ -0,0 +1,131 @@
+package p2p
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// rotationContext prefixes what a rotation's signature covers, so it can't be
+// passed off as any other signature made with the previous key. Storage
+// nodes use the same value.
+const rotationContext = "federated-storage coordinator rotation\n"
+
+// ErrRotationPending is returned by RotateIdentity while the key of the
+// previous rotation is still kept, since nodes that haven't followed that
+// rotation yet can only do so while it exists
+var ErrRotationPending = errors.New("previous p2p identity still kept")
+
+// Rotation is the previous identity's signed statement that the coordinator
+// now runs under PeerID. Nodes pinned to PreviousPeerID only follow the
+// coordinator to PeerID if the signature checks out against it.
+type Rotation struct {
+	PreviousPeerID string `json:"previous_peer_id"`
+	PeerID         string `json:"peer_id"`
+	Signature      []byte `json:"signature"`
+}
+
+// RotationPayload is what a rotation's signature covers
+func RotationPayload(previousPeerID, peerID string) []byte {
+	return []byte(rotationContext + previousPeerID + "\n" + peerID)
+}
+
+// LoadIdentity reads the private key the coordinator's peer ID derives from,
+// generating and saving one at path on first start so the ID survives
+// restarts. Storage nodes only accept chunk and proof streams from that ID.
+func LoadIdentity(path string) (crypto.PrivKey, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return newIdentity(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read p2p identity: %w", err)
+	}
+	key, err := crypto.UnmarshalPrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid p2p identity in %s: %w", path, err)
+	}
+	return key, nil
+}
+
+// RotateIdentity replaces the key at path with a new one, changing the
+// coordinator's peer ID. The previous key is kept as path + ".old", both to
+// sign the rotation for nodes and so a mistaken rotation can be undone by
+// moving it back. It fails with ErrRotationPending while an earlier
+// rotation's key is still there.
+func RotateIdentity(path string) (crypto.PrivKey, error) {
+	if _, err := os.Stat(path + ".old"); err == nil {
+		return nil, fmt.Errorf("%w in %s.old; remove it once every node follows the current peer ID", ErrRotationPending, path)
+	}
+	if err := os.Rename(path, path+".old"); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to keep previous p2p identity: %w", err)
+	}
+	return newIdentity(path)
+}
+
+// LoadRotation returns the rotation to current, the key at path, signed with
+// the previous key kept beside it, or nil if no previous key is kept
+func LoadRotation(path string, current crypto.PrivKey) (*Rotation, error) {
+	data, err := os.ReadFile(path + ".old")
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read previous p2p identity: %w", err)
+	}
+	previous, err := crypto.UnmarshalPrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid previous p2p identity in %s.old: %w", path, err)
+	}
+
+	rotation := &Rotation{PreviousPeerID: IdentityPeerID(previous), PeerID: IdentityPeerID(current)}
+	if rotation.PreviousPeerID == rotation.PeerID {
+		return nil, nil
+	}
+	if rotation.Signature, err = previous.Sign(RotationPayload(rotation.PreviousPeerID, rotation.PeerID)); err != nil {
+		return nil, fmt.Errorf("failed to sign p2p identity rotation: %w", err)
+	}
+	return rotation, nil
+}
+
+// IdentityPeerID returns the peer ID of a node running under key
+func IdentityPeerID(key crypto.PrivKey) string {
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		return ""
+	}
+	return id.String()
+}
+
+// newIdentity generates an Ed25519 key and writes it to path, readable only
+// by its owner. It goes through a temporary file so a crash never leaves a
+// truncated key behind.
+func newIdentity(path string) (crypto.PrivKey, error) {
+	key, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate p2p identity: %w", err)
+	}
+	data, err := crypto.MarshalPrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode p2p identity: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create p2p identity directory: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return nil, fmt.Errorf("failed to save p2p identity: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return nil, fmt.Errorf("failed to save p2p identity: %w", err)
+	}
+	return key, nil
+}
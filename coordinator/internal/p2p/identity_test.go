@@ -0,0 +1,85 @@
+package p2p
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startedPeerID starts a node under the identity at path and returns its peer ID
+func startedPeerID(t *testing.T, path string) string {
+	t.Helper()
+	key, err := LoadIdentity(path)
+	require.NoError(t, err)
+	n, err := NewNode([]string{"/ip4/127.0.0.1/tcp/0"}, true, false)
+	require.NoError(t, err)
+	n.SetIdentity(key)
+	require.NoError(t, n.Start())
+	defer n.Close()
+	require.Equal(t, IdentityPeerID(key), n.PeerID())
+	return n.PeerID()
+}
+
+func TestIdentity_RestartKeepsPeerID(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "p2p", "identity.key")
+
+	first := startedPeerID(t, path)
+	info, err := os.Stat(path)
+	require.NoError(t, err, "First start should save the key")
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	assert.Equal(t, first, startedPeerID(t, path), "A restart should come back under the same peer ID")
+}
+
+func TestIdentity_RotationChangesPeerID(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "identity.key")
+	before := startedPeerID(t, path)
+
+	_, err := RotateIdentity(path)
+	require.NoError(t, err)
+	after := startedPeerID(t, path)
+	assert.NotEqual(t, before, after, "Rotation should change the peer ID")
+	assert.Equal(t, after, startedPeerID(t, path), "The rotated key should be kept for later starts")
+	_, err = RotateIdentity(path)
+	assert.ErrorIs(t, err, ErrRotationPending, "A second rotation must not overwrite the key nodes still need")
+	assert.Equal(t, after, startedPeerID(t, path))
+
+	require.NoError(t, os.Rename(path+".old", path))
+	assert.Equal(t, before, startedPeerID(t, path), "The previous key should be kept to undo a rotation")
+}
+
+func TestIdentity_RotationIsSignedByPreviousKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "identity.key")
+	previous, err := LoadIdentity(path)
+	require.NoError(t, err)
+	rotation, err := LoadRotation(path, previous)
+	require.NoError(t, err)
+	assert.Nil(t, rotation, "Nothing to sign before a rotation")
+
+	current, err := RotateIdentity(path)
+	require.NoError(t, err)
+	rotation, err = LoadRotation(path, current)
+	require.NoError(t, err)
+	require.NotNil(t, rotation)
+	assert.Equal(t, IdentityPeerID(previous), rotation.PreviousPeerID)
+	assert.Equal(t, IdentityPeerID(current), rotation.PeerID)
+
+	n := &Node{}
+	valid, err := n.VerifyPeer(rotation.PreviousPeerID, RotationPayload(rotation.PreviousPeerID, rotation.PeerID), rotation.Signature)
+	require.NoError(t, err)
+	assert.True(t, valid, "Nodes pinned to the previous peer ID can check the rotation")
+	valid, err = n.VerifyPeer(rotation.PeerID, RotationPayload(rotation.PreviousPeerID, rotation.PeerID), rotation.Signature)
+	require.NoError(t, err)
+	assert.False(t, valid, "The new key can't vouch for itself")
+}
+
+func TestIdentity_RejectsCorruptKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "identity.key")
+	require.NoError(t, os.WriteFile(path, []byte("not a key"), 0600))
+
+	_, err := LoadIdentity(path)
+	assert.Error(t, err, "A corrupt key must not be silently replaced with a new peer ID")
+}
@@ -2,21 +2,73 @@ package p2p
 
 import (
 	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"sync"
+	"time"
 
+	"github.com/federated-storage/coordinator/internal/models"
 	"github.com/libp2p/go-libp2p"
 	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/protocol"
 )
 
+// ErrUnavailable is returned by operations that need the P2P host while it is not running
+var ErrUnavailable = errors.New("p2p unavailable")
+
+// ErrNodeBusy is returned by SendChunk when the storage node turned the chunk
+// away for being over its store rate; the chunk should be retried later. The
+// error also has a RetryAfter method giving the delay the node asked for.
+var ErrNodeBusy = errors.New("storage node busy")
+
+// busyError is ErrNodeBusy with the delay the node asked for
+type busyError struct {
+	retryAfter time.Duration
+}
+
+func (e *busyError) Error() string {
+	return fmt.Sprintf("%v: retry after %dms", ErrNodeBusy, e.retryAfter.Milliseconds())
+}
+
+func (e *busyError) Is(target error) bool { return target == ErrNodeBusy }
+
+// RetryAfter is how long the node asked to wait before the next store
+func (e *busyError) RetryAfter() time.Duration { return e.retryAfter }
+
+// storeRequestMessage is the first frame of a store stream; the chunk follows
+// in a second. Stores from the coordinator need no authorization.
+type storeRequestMessage struct {
+	ChunkID string `json:"chunk_id"`
+}
+
+// storeResponseMessage is what a storage node answers a store with: its
+// receipt once the chunk is stored, otherwise why not
+type storeResponseMessage struct {
+	Error        string          `json:"error,omitempty"`
+	Busy         bool            `json:"busy,omitempty"`
+	RetryAfterMs int64           `json:"retry_after_ms,omitempty"`
+	Receipt      json.RawMessage `json:"receipt,omitempty"`
+}
+
 // Node represents a libp2p node
 type Node struct {
-	host   host.Host
-	dht    *dht.IpfsDHT
-	config NodeConfig
+	hostMu   sync.RWMutex // guards host, dht and startErr, which Start sets after launch
+	host     host.Host
+	dht      *dht.IpfsDHT
+	startErr error
+	config   NodeConfig
+
+	// supportedVersions overrides SupportedVersions when set
+	supportedVersions []string
+	versionMu         sync.Mutex
+	negotiated        map[peer.ID]string
 }
 
 // NodeConfig holds P2P node configuration
@@ -25,15 +77,16 @@ type NodeConfig struct {
 	EnableTCP       bool
 	EnableQUIC      bool
 	BootstrapPeers  []string
+	Identity        crypto.PrivKey // nil for a new peer ID each start
 }
 
-// NewNode creates a new libp2p node
+// NewNode creates a new libp2p node listening over the enabled transports.
+// Listen addresses using a disabled transport are dropped; with none given,
+// the node listens on all interfaces for each enabled transport.
 func NewNode(listenAddresses []string, enableTCP, enableQUIC bool) (*Node, error) {
-	if len(listenAddresses) == 0 {
-		listenAddresses = []string{
-			"/ip4/0.0.0.0/tcp/0",
-			"/ip4/0.0.0.0/udp/0/quic-v1",
-		}
+	listenAddresses, err := listenAddrs(listenAddresses, enableTCP, enableQUIC)
+	if err != nil {
+		return nil, err
 	}
 
 	config := NodeConfig{
@@ -47,38 +100,78 @@ func NewNode(listenAddresses []string, enableTCP, enableQUIC bool) (*Node, error
 	}, nil
 }
 
-// Start starts the P2P node
+// SetIdentity makes the node run under key's peer ID instead of a new one
+// each start. Must be called before Start.
+func (n *Node) SetIdentity(key crypto.PrivKey) {
+	n.config.Identity = key
+}
+
+// Start starts the P2P node. A failed start leaves nothing running and may be
+// retried; starting a running node does nothing.
 func (n *Node) Start() error {
+	if n.Available() {
+		return nil
+	}
+
 	// Build libp2p options
 	opts := []libp2p.Option{
 		libp2p.ListenAddrStrings(n.config.ListenAddresses...),
 	}
+	opts = append(opts, transportOptions(n.config.EnableTCP, n.config.EnableQUIC)...)
+	if n.config.Identity != nil {
+		opts = append(opts, libp2p.Identity(n.config.Identity))
+	}
 
 	// Create host
 	h, err := libp2p.New(opts...)
 	if err != nil {
-		return fmt.Errorf("failed to create libp2p host: %w", err)
+		return n.setStartError(fmt.Errorf("failed to create libp2p host: %w", err))
 	}
-	n.host = h
 
 	// Create DHT for peer discovery
 	ctx := context.Background()
 	kadDHT, err := dht.New(ctx, h)
 	if err != nil {
-		return fmt.Errorf("failed to create DHT: %w", err)
+		h.Close()
+		return n.setStartError(fmt.Errorf("failed to create DHT: %w", err))
 	}
-	n.dht = kadDHT
 
 	// Bootstrap DHT
 	if err := kadDHT.Bootstrap(ctx); err != nil {
-		return fmt.Errorf("failed to bootstrap DHT: %w", err)
+		kadDHT.Close()
+		h.Close()
+		return n.setStartError(fmt.Errorf("failed to bootstrap DHT: %w", err))
 	}
 
+	n.hostMu.Lock()
+	n.host, n.dht, n.startErr = h, kadDHT, nil
+	n.hostMu.Unlock()
 	return nil
 }
 
+func (n *Node) setStartError(err error) error {
+	n.hostMu.Lock()
+	n.startErr = err
+	n.hostMu.Unlock()
+	return err
+}
+
+// Available reports whether the P2P host is running
+func (n *Node) Available() bool {
+	return n.Host() != nil
+}
+
+// StartError returns why the last start attempt failed, or nil once the node is running
+func (n *Node) StartError() error {
+	n.hostMu.RLock()
+	defer n.hostMu.RUnlock()
+	return n.startErr
+}
+
 // Stop stops the P2P node
 func (n *Node) Stop() error {
+	n.hostMu.RLock()
+	defer n.hostMu.RUnlock()
 	if n.dht != nil {
 		if err := n.dht.Close(); err != nil {
 			return err
@@ -95,27 +188,39 @@ func (n *Node) Close() error {
 	return n.Stop()
 }
 
-// Host returns the libp2p host
+// Host returns the libp2p host, or nil while the node is not running
 func (n *Node) Host() host.Host {
+	n.hostMu.RLock()
+	defer n.hostMu.RUnlock()
 	return n.host
 }
 
 // ID returns the peer ID
 func (n *Node) ID() peer.ID {
-	if n.host == nil {
+	h := n.Host()
+	if h == nil {
 		return ""
 	}
-	return n.host.ID()
+	return h.ID()
+}
+
+// PeerID returns the peer ID as a string, empty while the node is not running
+func (n *Node) PeerID() string {
+	if id := n.ID(); id != "" {
+		return id.String()
+	}
+	return ""
 }
 
 // Addrs returns the multiaddrs the node is listening on
 func (n *Node) Addrs() []string {
-	if n.host == nil {
+	h := n.Host()
+	if h == nil {
 		return nil
 	}
 
 	var addrs []string
-	for _, addr := range n.host.Addrs() {
+	for _, addr := range h.Addrs() {
 		addrs = append(addrs, addr.String())
 	}
 	return addrs
@@ -128,48 +233,156 @@ func (n *Node) Connect(ctx context.Context, peerAddr string) error {
 		return fmt.Errorf("failed to parse peer address: %w", err)
 	}
 
-	if err := n.host.Connect(ctx, *addrInfo); err != nil {
+	h := n.Host()
+	if h == nil {
+		return ErrUnavailable
+	}
+	if err := h.Connect(ctx, *addrInfo); err != nil {
 		return fmt.Errorf("failed to connect to peer: %w", err)
 	}
 
 	return nil
 }
 
-// SetStreamHandler sets a handler for a protocol
+// Sign signs data with the node's private key, so a peer that knows its peer
+// ID can check the signature
+func (n *Node) Sign(data []byte) ([]byte, error) {
+	h := n.Host()
+	if h == nil {
+		return nil, ErrUnavailable
+	}
+	key := h.Peerstore().PrivKey(h.ID())
+	if key == nil {
+		return nil, fmt.Errorf("no private key for %s", h.ID())
+	}
+	return key.Sign(data)
+}
+
+// Verify reports whether signature is the node's signature of data
+func (n *Node) Verify(data, signature []byte) (bool, error) {
+	h := n.Host()
+	if h == nil {
+		return false, ErrUnavailable
+	}
+	key := h.Peerstore().PubKey(h.ID())
+	if key == nil {
+		return false, fmt.Errorf("no public key for %s", h.ID())
+	}
+	return key.Verify(data, signature)
+}
+
+// VerifyPeer reports whether signature is peerID's signature of data, using
+// the public key embedded in the peer ID. It needs no running host.
+func (n *Node) VerifyPeer(peerID string, data, signature []byte) (bool, error) {
+	id, err := peer.Decode(peerID)
+	if err != nil {
+		return false, fmt.Errorf("invalid peer ID: %w", err)
+	}
+	key, err := id.ExtractPublicKey()
+	if err != nil {
+		return false, fmt.Errorf("no public key in peer ID %s: %w", peerID, err)
+	}
+	return key.Verify(data, signature)
+}
+
+// SetStreamHandler sets a handler for a protocol; it does nothing while the node is not running
 func (n *Node) SetStreamHandler(protocolID string, handler network.StreamHandler) {
-	n.host.SetStreamHandler(protocol.ID(protocolID), handler)
+	if h := n.Host(); h != nil {
+		h.SetStreamHandler(protocol.ID(protocolID), handler)
+	}
 }
 
-// SendChunk sends a chunk to a storage node (placeholder for full implementation)
+// SendChunk stores a chunk on a storage node and waits for the node to
+// acknowledge it
 func (n *Node) SendChunk(ctx context.Context, peerID string, chunkID string, data []byte) error {
-	// This is a simplified version - full implementation would:
-	// 1. Open a stream to the peer
-	// 2. Send the chunk using protobuf
-	// 3. Wait for acknowledgment
-
 	pid, err := peer.Decode(peerID)
 	if err != nil {
 		return fmt.Errorf("invalid peer ID: %w", err)
 	}
 
 	// Open stream
-	stream, err := n.host.NewStream(ctx, pid, "/federated-storage/1.0.0/store-chunk")
+	stream, err := n.openStream(ctx, pid, "store-chunk")
 	if err != nil {
-		return fmt.Errorf("failed to open stream: %w", err)
+		return err
 	}
 	defer stream.Close()
 
-	// For MVP, just write the data directly
-	// In production, use protobuf for structured messages
-	_, err = stream.Write(data)
+	header, err := json.Marshal(storeRequestMessage{ChunkID: chunkID})
 	if err != nil {
-		return fmt.Errorf("failed to write chunk: %w", err)
+		return err
+	}
+	writeErr := writeFrame(stream, header)
+	if writeErr == nil {
+		writeErr = writeFrame(stream, data)
 	}
+	stream.CloseWrite()
 
+	// A node over its store rate answers before reading the data, which can
+	// also cut the write short
+	var resp storeResponseMessage
+	if err := json.NewDecoder(stream).Decode(&resp); err != nil {
+		if writeErr != nil {
+			return fmt.Errorf("failed to write chunk: %w", writeErr)
+		}
+		return fmt.Errorf("failed to read store response: %w", err)
+	}
+	switch {
+	case resp.Busy:
+		return &busyError{retryAfter: time.Duration(resp.RetryAfterMs) * time.Millisecond}
+	case resp.Error != "":
+		return fmt.Errorf("failed to store chunk: %s", resp.Error)
+	case resp.Receipt == nil:
+		return fmt.Errorf("failed to store chunk: node sent no receipt")
+	}
 	return nil
 }
 
-// RetrieveChunk retrieves a chunk from a storage node (placeholder for full implementation)
+// writeFrame writes payload to w length-prefixed, as storage nodes read
+// chunk stream frames: a 4-byte big-endian length, then the payload
+func writeFrame(w io.Writer, payload []byte) error {
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(payload)))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// maxFrameSize bounds a frame read from a storage node, as nodes bound theirs
+const maxFrameSize = 16 << 20
+
+// readFrame reads one length-prefixed frame, as writeFrame writes them
+func readFrame(r io.Reader) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size > maxFrameSize {
+		return nil, fmt.Errorf("frame of %d bytes exceeds the limit of %d", size, maxFrameSize)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// retrieveRequestMessage is the only frame the coordinator writes on a
+// retrieve stream. The node answers with a retrieveResponseMessage frame
+// and, unless it carries an error, a frame holding the chunk.
+type retrieveRequestMessage struct {
+	ChunkID string `json:"chunk_id"`
+}
+
+// retrieveResponseMessage is the first frame a storage node answers a retrieve with
+type retrieveResponseMessage struct {
+	Error string `json:"error,omitempty"`
+}
+
+// RetrieveChunk reads a chunk back from a storage node. The data is returned
+// as the node sent it; callers check it against the chunk's hash.
 func (n *Node) RetrieveChunk(ctx context.Context, peerID string, chunkID string) ([]byte, error) {
 	pid, err := peer.Decode(peerID)
 	if err != nil {
@@ -177,13 +390,201 @@ func (n *Node) RetrieveChunk(ctx context.Context, peerID string, chunkID string)
 	}
 
 	// Open stream
-	stream, err := n.host.NewStream(ctx, pid, "/federated-storage/1.0.0/retrieve-chunk")
+	stream, err := n.openStream(ctx, pid, "retrieve-chunk")
 	if err != nil {
-		return nil, fmt.Errorf("failed to open stream: %w", err)
+		return nil, err
 	}
 	defer stream.Close()
 
-	// For MVP, return empty data
-	// In production, read from stream using protobuf
-	return []byte{}, nil
+	header, err := json.Marshal(retrieveRequestMessage{ChunkID: chunkID})
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFrame(stream, header); err != nil {
+		return nil, fmt.Errorf("failed to send retrieve request: %w", err)
+	}
+	stream.CloseWrite()
+
+	frame, err := readFrame(stream)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read retrieve response: %w", err)
+	}
+	var resp retrieveResponseMessage
+	if err := json.Unmarshal(frame, &resp); err != nil {
+		return nil, fmt.Errorf("malformed retrieve response: %w", err)
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("failed to retrieve chunk: %s", resp.Error)
+	}
+	data, err := readFrame(stream)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chunk: %w", err)
+	}
+	return data, nil
+}
+
+// proofChallengeMessage is the request sent on the proof-challenge protocol
+type proofChallengeMessage struct {
+	ChunkID    string `json:"chunk_id"`
+	Seed       []byte `json:"seed"`
+	Difficulty int    `json:"difficulty"`
+	LeafIndex  *int   `json:"leaf_index,omitempty"` // Merkle sub-block to return, if any
+}
+
+// proofResponseMessage is the response read from the proof-challenge protocol
+type proofResponseMessage struct {
+	ProofHash  string              `json:"proof_hash"`
+	DurationMs int                 `json:"duration_ms"`
+	Merkle     *models.MerkleProof `json:"merkle,omitempty"`
+	Error      string              `json:"error,omitempty"`
+}
+
+// SendProofChallenge sends a proof challenge to a storage node and waits for
+// its response. A leafIndex of 0 or more also requests that Merkle sub-block.
+func (n *Node) SendProofChallenge(ctx context.Context, peerID, chunkID string, seed []byte, difficulty, leafIndex int) (string, int, *models.MerkleProof, error) {
+	if !n.Available() {
+		return "", 0, nil, ErrUnavailable
+	}
+
+	pid, err := peer.Decode(peerID)
+	if err != nil {
+		return "", 0, nil, fmt.Errorf("invalid peer ID: %w", err)
+	}
+
+	stream, err := n.openStream(ctx, pid, "proof-challenge")
+	if err != nil {
+		return "", 0, nil, err
+	}
+	defer stream.Close()
+
+	req := proofChallengeMessage{ChunkID: chunkID, Seed: seed, Difficulty: difficulty}
+	if leafIndex >= 0 {
+		req.LeafIndex = &leafIndex
+	}
+	if err := json.NewEncoder(stream).Encode(req); err != nil {
+		return "", 0, nil, fmt.Errorf("failed to send challenge: %w", err)
+	}
+	if err := stream.CloseWrite(); err != nil {
+		return "", 0, nil, fmt.Errorf("failed to close write side: %w", err)
+	}
+
+	var resp proofResponseMessage
+	if err := json.NewDecoder(stream).Decode(&resp); err != nil {
+		return "", 0, nil, fmt.Errorf("failed to read proof response: %w", err)
+	}
+	if resp.Error != "" {
+		return "", 0, nil, fmt.Errorf("node returned error: %s", resp.Error)
+	}
+
+	return resp.ProofHash, resp.DurationMs, resp.Merkle, nil
+}
+
+// fileChallengeMessage is the request sent on the file-proof protocol
+type fileChallengeMessage struct {
+	Seed     []byte   `json:"seed"`
+	ChunkIDs []string `json:"chunk_ids"`
+}
+
+// fileProofMessage is the response read from the file-proof protocol
+type fileProofMessage struct {
+	ProofHash string `json:"proof_hash"`
+	Error     string `json:"error,omitempty"`
+}
+
+// SendFileChallenge asks a storage node for the aggregate proof of chunkIDs
+// under seed. The returned duration runs from sending the challenge to
+// reading the answer, so it doesn't depend on what the node reports. A node
+// that can't produce the proof answers with nodeError set.
+func (n *Node) SendFileChallenge(ctx context.Context, peerID string, seed []byte, chunkIDs []string) (string, string, time.Duration, error) {
+	if !n.Available() {
+		return "", "", 0, ErrUnavailable
+	}
+
+	pid, err := peer.Decode(peerID)
+	if err != nil {
+		return "", "", 0, fmt.Errorf("invalid peer ID: %w", err)
+	}
+
+	stream, err := n.openStream(ctx, pid, "file-proof")
+	if err != nil {
+		return "", "", 0, err
+	}
+	defer stream.Close()
+
+	start := time.Now()
+	if err := json.NewEncoder(stream).Encode(fileChallengeMessage{Seed: seed, ChunkIDs: chunkIDs}); err != nil {
+		return "", "", 0, fmt.Errorf("failed to send challenge: %w", err)
+	}
+	if err := stream.CloseWrite(); err != nil {
+		return "", "", 0, fmt.Errorf("failed to close write side: %w", err)
+	}
+
+	var resp fileProofMessage
+	if err := json.NewDecoder(stream).Decode(&resp); err != nil {
+		return "", "", 0, fmt.Errorf("failed to read proof response: %w", err)
+	}
+	return resp.ProofHash, resp.Error, time.Since(start), nil
+}
+
+// SendCapacityChallenge has a storage node store a capacity challenge's
+// blocks, filled in by fill and sent one frame each after the challenge, and
+// once the node acknowledges holding them all, answer sample. The returned
+// duration runs from sending the sample to reading the answer. A node that
+// declines answers with Error set in the proof.
+func (n *Node) SendCapacityChallenge(ctx context.Context, peerID string, challenge *models.CapacityChallenge, fill func(i int, buf []byte), sample *models.CapacitySample) (*models.CapacityProof, time.Duration, error) {
+	if !n.Available() {
+		return nil, 0, ErrUnavailable
+	}
+
+	pid, err := peer.Decode(peerID)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid peer ID: %w", err)
+	}
+
+	stream, err := n.openStream(ctx, pid, "capacity-proof")
+	if err != nil {
+		return nil, 0, err
+	}
+	defer stream.Close()
+
+	header, err := json.Marshal(challenge)
+	if err != nil {
+		return nil, 0, err
+	}
+	writeErr := writeFrame(stream, header)
+	buf := make([]byte, challenge.BlockSize)
+	for i := 0; writeErr == nil && i < len(challenge.Offsets); i++ {
+		fill(i, buf)
+		writeErr = writeFrame(stream, buf)
+	}
+
+	// A node that declines answers before reading the blocks, which can
+	// also cut the write short
+	responses := json.NewDecoder(stream)
+	var stored models.CapacityProof
+	if err := responses.Decode(&stored); err != nil {
+		if writeErr != nil {
+			return nil, 0, fmt.Errorf("failed to send blocks: %w", writeErr)
+		}
+		return nil, 0, fmt.Errorf("failed to read capacity acknowledgement: %w", err)
+	}
+	if stored.Error != "" {
+		return &stored, 0, nil
+	}
+	if writeErr != nil {
+		return nil, 0, fmt.Errorf("failed to send blocks: %w", writeErr)
+	}
+
+	start := time.Now()
+	if err := json.NewEncoder(stream).Encode(sample); err != nil {
+		return nil, 0, fmt.Errorf("failed to send sample: %w", err)
+	}
+	if err := stream.CloseWrite(); err != nil {
+		return nil, 0, fmt.Errorf("failed to close write side: %w", err)
+	}
+	var proof models.CapacityProof
+	if err := responses.Decode(&proof); err != nil {
+		return nil, 0, fmt.Errorf("failed to read capacity proof: %w", err)
+	}
+	return &proof, time.Since(start), nil
 }
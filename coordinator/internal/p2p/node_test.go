@@ -0,0 +1,321 @@
+package p2p
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/federated-storage/coordinator/internal/models"
+	"github.com/federated-storage/coordinator/internal/services"
+	"github.com/federated-storage/coordinator/internal/storage"
+	"github.com/google/uuid"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serveLegacyProofs makes h answer proof challenges the way a storage node
+// speaking only version 1.0.0 does, optionally with the handshake protocol
+func serveLegacyProofs(h host.Host, withHandshake bool) {
+	if withHandshake {
+		h.SetStreamHandler(handshakeProtocol, func(s network.Stream) {
+			defer s.Close()
+			var req handshakeMessage
+			if err := json.NewDecoder(s).Decode(&req); err != nil {
+				return
+			}
+			var resp handshakeMessage
+			if version, err := SelectVersion([]string{"1.0.0"}, req.Versions); err != nil {
+				resp.Error = err.Error()
+			} else {
+				resp.Version = version
+			}
+			json.NewEncoder(s).Encode(resp)
+		})
+	}
+	h.SetStreamHandler(protocolID("1.0.0", "proof-challenge"), func(s network.Stream) {
+		defer s.Close()
+		var req proofChallengeMessage
+		if err := json.NewDecoder(s).Decode(&req); err != nil {
+			return
+		}
+		json.NewEncoder(s).Encode(proofResponseMessage{ProofHash: "proof-" + req.ChunkID, DurationMs: 1})
+	})
+}
+
+func TestNode_NegotiatesWithOlderStorageNode(t *testing.T) {
+	tests := []struct {
+		name          string
+		withHandshake bool
+	}{
+		{name: "1.0-only node with handshake", withHandshake: true},
+		{name: "node predating the handshake", withHandshake: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mn := mocknet.New()
+			defer mn.Close()
+
+			coordinatorHost, err := mn.GenPeer()
+			require.NoError(t, err)
+			storageHost, err := mn.GenPeer()
+			require.NoError(t, err)
+			require.NoError(t, mn.LinkAll())
+			require.NoError(t, mn.ConnectAllButSelf())
+			serveLegacyProofs(storageHost, tt.withHandshake)
+
+			n := &Node{host: coordinatorHost, supportedVersions: []string{"1.0.0", "1.1.0"}}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			version, err := n.ProtocolVersion(ctx, storageHost.ID())
+			require.NoError(t, err)
+			assert.Equal(t, "1.0.0", version)
+
+			proof, _, _, err := n.SendProofChallenge(ctx, storageHost.ID().String(), "chunk-1", []byte("seed"), 1, -1)
+			require.NoError(t, err)
+			assert.Equal(t, "proof-chunk-1", proof)
+		})
+	}
+}
+
+func TestSelectVersion_PicksHighestCommon(t *testing.T) {
+	version, err := SelectVersion([]string{"1.0.0", "1.1.0"}, []string{"1.0.0"})
+	require.NoError(t, err)
+	assert.Equal(t, "1.0.0", version)
+
+	version, err = SelectVersion([]string{"1.0.0", "1.1.0"}, []string{"1.1.0", "1.0.0"})
+	require.NoError(t, err)
+	assert.Equal(t, "1.1.0", version)
+
+	_, err = SelectVersion([]string{"1.1.0"}, []string{"1.0.0"})
+	assert.ErrorIs(t, err, ErrNoCommonVersion)
+}
+
+func TestBusyError_CarriesRetryAfter(t *testing.T) {
+	var err error = &busyError{retryAfter: 250 * time.Millisecond}
+	assert.ErrorIs(t, err, ErrNodeBusy)
+	assert.Contains(t, err.Error(), "retry after 250ms")
+	var busy interface{ RetryAfter() time.Duration }
+	require.ErrorAs(t, err, &busy, "Callers outside the package back off by RetryAfter")
+	assert.Equal(t, 250*time.Millisecond, busy.RetryAfter())
+}
+
+// serveChunks makes h store and return chunks over the store-chunk and
+// retrieve-chunk protocols as a storage node does, keeping them in memory
+func serveChunks(h host.Host) {
+	var mu sync.Mutex
+	chunks := make(map[string][]byte)
+	h.SetStreamHandler(protocolID("1.0.0", "store-chunk"), func(s network.Stream) {
+		defer s.Close()
+		header, err := readFrame(s)
+		if err != nil {
+			return
+		}
+		var req storeRequestMessage
+		json.Unmarshal(header, &req)
+		data, err := readFrame(s)
+		if err != nil {
+			return
+		}
+		mu.Lock()
+		chunks[req.ChunkID] = data
+		mu.Unlock()
+		json.NewEncoder(s).Encode(storeResponseMessage{Receipt: json.RawMessage(`{}`)})
+	})
+	h.SetStreamHandler(protocolID("1.0.0", "retrieve-chunk"), func(s network.Stream) {
+		defer s.Close()
+		header, err := readFrame(s)
+		if err != nil {
+			return
+		}
+		var req retrieveRequestMessage
+		json.Unmarshal(header, &req)
+		mu.Lock()
+		data, ok := chunks[req.ChunkID]
+		mu.Unlock()
+		if !ok {
+			resp, _ := json.Marshal(retrieveResponseMessage{Error: "chunk not found"})
+			writeFrame(s, resp)
+			return
+		}
+		resp, _ := json.Marshal(retrieveResponseMessage{})
+		writeFrame(s, resp)
+		writeFrame(s, data)
+	})
+}
+
+func TestNode_RetrieveChunkReturnsStoredData(t *testing.T) {
+	mn := mocknet.New()
+	defer mn.Close()
+	coordinatorHost, err := mn.GenPeer()
+	require.NoError(t, err)
+	storageHost, err := mn.GenPeer()
+	require.NoError(t, err)
+	require.NoError(t, mn.LinkAll())
+	require.NoError(t, mn.ConnectAllButSelf())
+	serveChunks(storageHost)
+
+	n := &Node{host: coordinatorHost, supportedVersions: []string{"1.0.0"}}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	peerID := storageHost.ID().String()
+
+	chunkID := uuid.NewString()
+	data := []byte("ciphertext held by the node")
+	require.NoError(t, n.SendChunk(ctx, peerID, chunkID, data))
+	got, err := n.RetrieveChunk(ctx, peerID, chunkID)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+
+	_, err = n.RetrieveChunk(ctx, peerID, uuid.NewString())
+	assert.ErrorContains(t, err, "chunk not found", "A chunk the node lacks is an error, not empty data")
+
+	// A copy between nodes reads the chunk back over the same streams to verify it
+	store := storage.NewMemoryStore()
+	chunks := services.NewChunkService(store, nil, nil)
+	chunk, err := chunks.StoreChunk(ctx, uuid.New(), 0, data, nil)
+	require.NoError(t, err)
+	target := uuid.New()
+	require.NoError(t, chunks.CopyChunk(ctx, n, services.ChunkMove{ChunkID: chunk.ID, ToNodeID: target, ToPeerID: peerID}))
+	assignments, err := store.ListChunkAssignments(ctx, chunk.ID)
+	require.NoError(t, err)
+	require.Len(t, assignments, 1)
+	assert.Equal(t, target, assignments[0].NodeID)
+}
+
+// staticNodes is a services.NodeLister over a fixed set of nodes
+type staticNodes []models.StorageNode
+
+func (n staticNodes) GetAllNodes(ctx context.Context) ([]models.StorageNode, error) {
+	return n, nil
+}
+
+func TestNode_ReadsDirectUploadsFromNodes(t *testing.T) {
+	mn := mocknet.New()
+	defer mn.Close()
+	coordinatorHost, err := mn.GenPeer()
+	require.NoError(t, err)
+	storageHost, err := mn.GenPeer()
+	require.NoError(t, err)
+	require.NoError(t, mn.LinkAll())
+	require.NoError(t, mn.ConnectAllButSelf())
+	serveChunks(storageHost)
+
+	n := &Node{host: coordinatorHost, supportedVersions: []string{"1.0.0"}}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	node := models.StorageNode{ID: uuid.New(), PeerID: storageHost.ID().String()}
+
+	// A direct upload puts the chunk on the node and only its metadata here
+	data := []byte("ciphertext uploaded straight to the node")
+	sum := sha256.Sum256(data)
+	chunk := &models.Chunk{ID: uuid.New(), FileID: uuid.New(), Hash: hex.EncodeToString(sum[:]), SizeBytes: len(data)}
+	require.NoError(t, n.SendChunk(ctx, node.PeerID, chunk.ID.String(), data))
+	store := storage.NewMemoryStore()
+	chunks := services.NewChunkService(store, staticNodes{node}, nil)
+	chunks.SetTransfer(n)
+	require.NoError(t, chunks.RecordChunk(ctx, chunk, []uuid.UUID{node.ID}))
+
+	listed, err := chunks.GetChunksByFile(ctx, chunk.FileID)
+	require.NoError(t, err)
+	require.NoError(t, chunks.CheckChunksReadable(ctx, listed, 1))
+	got, err := chunks.ReadChunk(ctx, listed[0])
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+}
+
+func TestNode_RepairsCorruptChunksFromNodes(t *testing.T) {
+	mn := mocknet.New()
+	defer mn.Close()
+	coordinatorHost, err := mn.GenPeer()
+	require.NoError(t, err)
+	emptyHost, err := mn.GenPeer()
+	require.NoError(t, err)
+	holderHost, err := mn.GenPeer()
+	require.NoError(t, err)
+	require.NoError(t, mn.LinkAll())
+	require.NoError(t, mn.ConnectAllButSelf())
+	serveChunks(emptyHost)
+	serveChunks(holderHost)
+
+	n := &Node{host: coordinatorHost, supportedVersions: []string{"1.0.0"}}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	empty := models.StorageNode{ID: uuid.New(), PeerID: emptyHost.ID().String()}
+	holder := models.StorageNode{ID: uuid.New(), PeerID: holderHost.ID().String()}
+
+	store := storage.NewMemoryStore()
+	chunks := services.NewChunkService(store, staticNodes{empty, holder}, nil)
+	chunks.SetTransfer(n)
+	fileID := uuid.New()
+	good, err := chunks.StoreChunk(ctx, fileID, 0, []byte("replicated chunk"), []uuid.UUID{empty.ID, holder.ID})
+	require.NoError(t, err)
+	require.NoError(t, n.SendChunk(ctx, holder.PeerID, good.ID.String(), []byte("replicated chunk")))
+	gone, err := chunks.StoreChunk(ctx, fileID, 1, []byte("unreplicated"), []uuid.UUID{empty.ID})
+	require.NoError(t, err)
+	require.NoError(t, store.SetChunkData(ctx, good.ID, []byte("bit rot")))
+	require.NoError(t, store.SetChunkData(ctx, gone.ID, []byte("bit rot")))
+
+	// The node lacking a chunk answers with an error and the next is asked
+	result, err := chunks.RepairFile(ctx, fileID)
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Repaired)
+	assert.Equal(t, 1, result.Lost)
+	require.Len(t, result.Chunks, 2)
+	assert.Equal(t, services.RepairRepaired, result.Chunks[0].Status)
+	assert.Equal(t, services.RepairLost, result.Chunks[1].Status)
+	assert.Contains(t, result.Chunks[1].Error, "chunk not found")
+	_, data, err := store.GetChunk(ctx, good.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("replicated chunk"), data)
+}
+
+func TestNode_DrainsMaintenanceNodesOverStreams(t *testing.T) {
+	mn := mocknet.New()
+	defer mn.Close()
+	coordinatorHost, err := mn.GenPeer()
+	require.NoError(t, err)
+	drainingHost, err := mn.GenPeer()
+	require.NoError(t, err)
+	targetHost, err := mn.GenPeer()
+	require.NoError(t, err)
+	require.NoError(t, mn.LinkAll())
+	require.NoError(t, mn.ConnectAllButSelf())
+	serveChunks(drainingHost)
+	serveChunks(targetHost)
+
+	n := &Node{host: coordinatorHost, supportedVersions: []string{"1.0.0"}}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start, end := time.Now().Add(-time.Minute), time.Now().Add(time.Hour)
+	draining := models.StorageNode{ID: uuid.New(), PeerID: drainingHost.ID().String(), TotalStorageBytes: 1000,
+		MaintenanceStart: &start, MaintenanceEnd: &end}
+	target := models.StorageNode{ID: uuid.New(), PeerID: targetHost.ID().String(), TotalStorageBytes: 1000}
+
+	// A direct upload held only by the draining node is read from it and copied
+	data := []byte("held only by the draining node")
+	sum := sha256.Sum256(data)
+	chunk := &models.Chunk{ID: uuid.New(), FileID: uuid.New(), Hash: hex.EncodeToString(sum[:]), SizeBytes: len(data)}
+	require.NoError(t, n.SendChunk(ctx, draining.PeerID, chunk.ID.String(), data))
+	store := storage.NewMemoryStore()
+	chunks := services.NewChunkService(store, staticNodes{draining, target}, nil)
+	chunks.SetTransfer(n)
+	require.NoError(t, chunks.RecordChunk(ctx, chunk, []uuid.UUID{draining.ID}))
+
+	report, err := chunks.DrainMaintenanceNodes(ctx, n, 1, 10)
+	require.NoError(t, err)
+	assert.Empty(t, report.Failed)
+	require.Len(t, report.Copied, 1)
+	assert.Equal(t, target.ID, report.Copied[0].ToNodeID)
+	got, err := n.RetrieveChunk(ctx, target.PeerID, chunk.ID.String())
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+}
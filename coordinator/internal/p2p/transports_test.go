@@ -0,0 +1,59 @@
+package p2p
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenAddrs_FollowsEnabledTransports(t *testing.T) {
+	configured := []string{"/ip4/127.0.0.1/tcp/4001", "/ip4/127.0.0.1/udp/4001/quic-v1", "/ip4/127.0.0.1/tcp/4002/ws"}
+
+	addrs, err := listenAddrs(configured, true, true)
+	require.NoError(t, err)
+	assert.Equal(t, configured[:2], addrs, "Addresses for transports the node doesn't run are dropped")
+
+	addrs, err = listenAddrs(configured, true, false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/ip4/127.0.0.1/tcp/4001"}, addrs)
+
+	addrs, err = listenAddrs(nil, false, true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{defaultQUICAddr}, addrs)
+
+	_, err = listenAddrs([]string{"/ip4/127.0.0.1/udp/4001/quic-v1"}, true, false)
+	assert.ErrorIs(t, err, ErrNoTransports)
+	_, err = listenAddrs(nil, false, false)
+	assert.ErrorIs(t, err, ErrNoTransports)
+}
+
+func TestNode_DisabledTransportIsNotBound(t *testing.T) {
+	configured := []string{"/ip4/127.0.0.1/tcp/0", "/ip4/127.0.0.1/udp/0/quic-v1"}
+	for _, tt := range []struct {
+		name              string
+		enableTCP         bool
+		enableQUIC        bool
+		wantTCP, wantQUIC bool
+	}{
+		{name: "both", enableTCP: true, enableQUIC: true, wantTCP: true, wantQUIC: true},
+		{name: "tcp only", enableTCP: true, wantTCP: true},
+		{name: "quic only", enableQUIC: true, wantQUIC: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			n, err := NewNode(configured, tt.enableTCP, tt.enableQUIC)
+			require.NoError(t, err)
+			require.NoError(t, n.Start())
+			defer n.Close()
+
+			var tcp, quic bool
+			for _, addr := range n.Addrs() {
+				tcp = tcp || addrTransport(addr) == "tcp"
+				quic = quic || strings.Contains(addr, "/quic")
+			}
+			assert.Equal(t, tt.wantTCP, tcp, "tcp bound")
+			assert.Equal(t, tt.wantQUIC, quic, "quic bound")
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package p2p
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// handshakeProtocol is unversioned in spirit: its message format must never change,
+// since it is how peers find out which versioned protocols they share
+const handshakeProtocol = "/federated-storage/handshake/1.0.0"
+
+// SupportedVersions lists the wire-protocol versions this build speaks
+var SupportedVersions = []string{"1.0.0"}
+
+// legacyVersion is assumed for peers that predate the handshake protocol
+const legacyVersion = "1.0.0"
+
+// ErrNoCommonVersion is returned when two peers share no protocol version
+var ErrNoCommonVersion = errors.New("no common protocol version")
+
+// handshakeMessage carries a peer's supported versions in a request, or the
+// selected version in a response
+type handshakeMessage struct {
+	Versions []string `json:"versions,omitempty"`
+	Version  string   `json:"version,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// protocolID builds the stream protocol ID for a named protocol at a version
+func protocolID(version, name string) protocol.ID {
+	return protocol.ID(fmt.Sprintf("/federated-storage/%s/%s", version, name))
+}
+
+// parseVersion splits "major.minor.patch" into numbers for ordering
+func parseVersion(v string) ([3]int, bool) {
+	var out [3]int
+	parts := strings.Split(v, ".")
+	if len(parts) != 3 {
+		return out, false
+	}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return out, false
+		}
+		out[i] = n
+	}
+	return out, true
+}
+
+// versionLess reports whether a orders before b
+func versionLess(a, b [3]int) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
+
+// SelectVersion returns the highest version present in both lists.
+// Malformed entries are ignored.
+func SelectVersion(local, remote []string) (string, error) {
+	offered := make(map[string]bool, len(remote))
+	for _, v := range remote {
+		offered[v] = true
+	}
+
+	var best string
+	var bestParsed [3]int
+	for _, v := range local {
+		parsed, ok := parseVersion(v)
+		if !ok || !offered[v] {
+			continue
+		}
+		if best == "" || versionLess(bestParsed, parsed) {
+			best, bestParsed = v, parsed
+		}
+	}
+	if best == "" {
+		return "", fmt.Errorf("%w: local %v, remote %v", ErrNoCommonVersion, local, remote)
+	}
+	return best, nil
+}
+
+// versions returns the protocol versions this node speaks
+func (n *Node) versions() []string {
+	if len(n.supportedVersions) > 0 {
+		return n.supportedVersions
+	}
+	return SupportedVersions
+}
+
+// ProtocolVersion returns the protocol version to use with a peer, running the
+// handshake on first contact and caching the result for later streams
+func (n *Node) ProtocolVersion(ctx context.Context, pid peer.ID) (string, error) {
+	n.versionMu.Lock()
+	version, ok := n.negotiated[pid]
+	n.versionMu.Unlock()
+	if ok {
+		return version, nil
+	}
+
+	version, err := n.handshake(ctx, pid)
+	if err != nil {
+		return "", err
+	}
+
+	n.versionMu.Lock()
+	if n.negotiated == nil {
+		n.negotiated = make(map[peer.ID]string)
+	}
+	n.negotiated[pid] = version
+	n.versionMu.Unlock()
+	return version, nil
+}
+
+// handshake sends our supported versions to the peer and returns its choice
+func (n *Node) handshake(ctx context.Context, pid peer.ID) (string, error) {
+	h := n.Host()
+	if h == nil {
+		return "", ErrUnavailable
+	}
+	stream, err := h.NewStream(ctx, pid, handshakeProtocol)
+	if err != nil {
+		// Nodes that predate negotiation only speak the legacy protocol. The
+		// result isn't cached, so a transient failure here is retried next time.
+		for _, v := range n.versions() {
+			if v == legacyVersion {
+				return legacyVersion, nil
+			}
+		}
+		return "", fmt.Errorf("failed to open handshake stream: %w", err)
+	}
+	defer stream.Close()
+
+	if err := json.NewEncoder(stream).Encode(handshakeMessage{Versions: n.versions()}); err != nil {
+		return "", fmt.Errorf("failed to send handshake: %w", err)
+	}
+	if err := stream.CloseWrite(); err != nil {
+		return "", fmt.Errorf("failed to close write side: %w", err)
+	}
+
+	var resp handshakeMessage
+	if err := json.NewDecoder(stream).Decode(&resp); err != nil {
+		return "", fmt.Errorf("failed to read handshake response: %w", err)
+	}
+	if resp.Error != "" {
+		return "", fmt.Errorf("%w: %s", ErrNoCommonVersion, resp.Error)
+	}
+
+	// Guard against a peer picking a version we never offered
+	version, err := SelectVersion(n.versions(), []string{resp.Version})
+	if err != nil {
+		return "", err
+	}
+	return version, nil
+}
+
+// openStream negotiates a version with the peer and opens the named protocol at it
+func (n *Node) openStream(ctx context.Context, pid peer.ID, name string) (network.Stream, error) {
+	h := n.Host()
+	if h == nil {
+		return nil, ErrUnavailable
+	}
+	version, err := n.ProtocolVersion(ctx, pid)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := h.NewStream(ctx, pid, protocolID(version, name))
+	if err != nil {
+		// The peer may have been downgraded since the handshake; renegotiate next time
+		n.versionMu.Lock()
+		delete(n.negotiated, pid)
+		n.versionMu.Unlock()
+		return nil, fmt.Errorf("failed to open stream: %w", err)
+	}
+	// Reads and writes on the stream give up when the caller's deadline passes
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(deadline)
+	}
+	return stream, nil
+}
@@ -0,0 +1,224 @@
+// Package selftest checks a running coordinator end to end: it uploads a
+// generated file through the public API, downloads it and compares the bytes.
+package selftest
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultSizeBytes is the size of the file a selftest uploads by default
+const DefaultSizeBytes = 1024*1024 + 123
+
+// Stage is the outcome of one step of a selftest
+type Stage struct {
+	Name     string        `json:"name"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// Report is the outcome of a selftest, which passed if every stage did
+type Report struct {
+	Stages []Stage `json:"stages"`
+	Passed bool    `json:"passed"`
+}
+
+// run times fn as the named stage, reporting whether it succeeded
+func (r *Report) run(name string, fn func() error) bool {
+	start := time.Now()
+	err := fn()
+	stage := Stage{Name: name, Duration: time.Since(start)}
+	if err != nil {
+		stage.Error = err.Error()
+	}
+	r.Stages = append(r.Stages, stage)
+	return err == nil
+}
+
+// client calls the coordinator's API as one user
+type client struct {
+	http    *http.Client
+	baseURL string
+	token   string
+}
+
+// call sends body as JSON to path and decodes a successful response into
+// out; any other status is an error carrying the response's message
+func (c *client) call(ctx context.Context, method, path string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("%s %s: failed to read response: %w", method, path, err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var failure struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(data, &failure) == nil && failure.Error != "" {
+			return fmt.Errorf("%s %s: %d: %s", method, path, resp.StatusCode, failure.Error)
+		}
+		return fmt.Errorf("%s %s: %d", method, path, resp.StatusCode)
+	}
+
+	switch out := out.(type) {
+	case nil:
+		return nil
+	case *[]byte:
+		*out = data
+		return nil
+	default:
+		if err := json.Unmarshal(data, out); err != nil {
+			return fmt.Errorf("%s %s: malformed response: %w", method, path, err)
+		}
+		return nil
+	}
+}
+
+// Run registers a throwaway user at the coordinator at baseURL, buys it
+// credits, uploads sizeBytes of random data through the initiate, chunk and
+// complete flow, downloads the file and checks it is byte-for-byte what was
+// sent. It then deletes the file, or cancels the upload if it never
+// completed, and deletes the throwaway user with the credits it bought.
+// Stages stop at the first failure, except the cleanup.
+func Run(ctx context.Context, httpClient *http.Client, baseURL string, sizeBytes int) *Report {
+	report := &Report{}
+	c := &client{http: httpClient, baseURL: strings.TrimRight(baseURL, "/")}
+	content := make([]byte, sizeBytes)
+	var sessionID, fileID string
+
+	ok := report.run("register", func() error {
+		suffix := make([]byte, 8)
+		if _, err := rand.Read(suffix); err != nil {
+			return err
+		}
+		var auth struct {
+			Token string `json:"token"`
+		}
+		err := c.call(ctx, http.MethodPost, "/api/v1/auth/register", map[string]string{
+			"email":    "selftest-" + hex.EncodeToString(suffix) + "@example.com",
+			"password": hex.EncodeToString(suffix) + "-selftest",
+		}, &auth)
+		c.token = auth.Token
+		return err
+	}) && report.run("purchase-credits", func() error {
+		return c.call(ctx, http.MethodPost, "/api/v1/auth/credits/purchase", map[string]int{"amount_usd": 1}, nil)
+	})
+
+	var chunkSize int64
+	var chunkCount int
+	ok = ok && report.run("initiate", func() error {
+		if _, err := rand.Read(content); err != nil {
+			return err
+		}
+		var session struct {
+			SessionID  string `json:"session_id"`
+			ChunkCount int    `json:"chunk_count"`
+			ChunkSize  int64  `json:"chunk_size"`
+		}
+		// Ask for small chunks so the file spans several; the server may clamp them
+		err := c.call(ctx, http.MethodPost, "/api/v1/files/upload/initiate", map[string]interface{}{
+			"filename":   "selftest.bin",
+			"size_bytes": sizeBytes,
+			"chunk_size": (sizeBytes + 2) / 3,
+		}, &session)
+		if err != nil {
+			return err
+		}
+		if session.ChunkSize <= 0 {
+			return fmt.Errorf("initiate returned chunk size %d", session.ChunkSize)
+		}
+		sessionID, chunkSize, chunkCount = session.SessionID, session.ChunkSize, session.ChunkCount
+		return nil
+	})
+
+	ok = ok && report.run("upload-chunks", func() error {
+		for i := 0; i < chunkCount; i++ {
+			start := int64(i) * chunkSize
+			end := min(start+chunkSize, int64(len(content)))
+			err := c.call(ctx, http.MethodPost, "/api/v1/files/upload/"+sessionID+"/chunk", map[string]interface{}{
+				"chunk_index": i,
+				"data":        base64.StdEncoding.EncodeToString(content[start:end]),
+			}, nil)
+			if err != nil {
+				return fmt.Errorf("chunk %d: %w", i, err)
+			}
+		}
+		return nil
+	}) && report.run("complete", func() error {
+		var completed struct {
+			FileID string `json:"file_id"`
+		}
+		if err := c.call(ctx, http.MethodPost, "/api/v1/files/upload/"+sessionID+"/complete", nil, &completed); err != nil {
+			return err
+		}
+		if completed.FileID == "" {
+			return fmt.Errorf("complete returned no file_id")
+		}
+		fileID = completed.FileID
+		return nil
+	})
+
+	var downloaded []byte
+	ok = ok && report.run("download", func() error {
+		return c.call(ctx, http.MethodGet, "/api/v1/files/"+fileID+"/download", nil, &downloaded)
+	}) && report.run("verify", func() error {
+		if !bytes.Equal(downloaded, content) {
+			return fmt.Errorf("downloaded %d bytes that differ from the %d uploaded", len(downloaded), len(content))
+		}
+		return nil
+	})
+
+	cleaned := true
+	switch {
+	case fileID != "":
+		cleaned = report.run("cleanup", func() error {
+			return c.call(ctx, http.MethodDelete, "/api/v1/files/"+fileID, nil, nil)
+		})
+	case sessionID != "":
+		cleaned = report.run("cleanup", func() error {
+			return c.call(ctx, http.MethodDelete, "/api/v1/files/upload/"+sessionID, nil, nil)
+		})
+	}
+
+	// The account can only go once it owns nothing
+	if c.token != "" && cleaned {
+		cleaned = report.run("delete-account", func() error {
+			return c.call(ctx, http.MethodDelete, "/api/v1/auth/account", nil, nil)
+		})
+	}
+
+	report.Passed = ok && cleaned
+	return report
+}
@@ -0,0 +1,115 @@
+package selftest
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/federated-storage/coordinator/internal/handlers"
+	"github.com/federated-storage/coordinator/internal/middleware"
+	"github.com/federated-storage/coordinator/internal/models"
+	"github.com/federated-storage/coordinator/internal/services"
+	"github.com/federated-storage/coordinator/internal/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type staticNodes []models.StorageNode
+
+func (n staticNodes) GetAllNodes(ctx context.Context) ([]models.StorageNode, error) {
+	return n, nil
+}
+
+// newServer serves the routes a selftest uses from an in-memory store,
+// recording the users that call the file routes
+func newServer(t *testing.T, breakDownload bool) (*httptest.Server, *storage.MemoryStore, *[]string) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	const secret = "selftest-secret"
+	store := storage.NewMemoryStore()
+	authService := services.NewAuthService(store, services.NewPricing(1000, nil))
+	fileService := services.NewFileService(store, 64*1024, 100)
+	chunkService := services.NewChunkService(store, staticNodes{{ID: uuid.New()}}, nil)
+	uploadService := services.NewUploadService(store, 64*1024, 1, 100)
+	uploadService.SetChunkSizeRange(1024, 1024*1024)
+	authHandler := handlers.NewAuthHandler(authService, secret)
+	uploadHandler := handlers.NewUploadHandler(uploadService, fileService, chunkService, authService, 1)
+	fileHandler := handlers.NewFileHandler(fileService, chunkService, nil)
+
+	router := gin.New()
+	api := router.Group("/api/v1")
+	api.POST("/auth/register", authHandler.Register)
+	api.POST("/auth/credits/purchase", middleware.JWTMiddleware(secret), authHandler.PurchaseCredits)
+	api.DELETE("/auth/account", middleware.JWTMiddleware(secret), authHandler.DeleteAccount)
+	var users []string
+	files := api.Group("/files", middleware.JWTMiddleware(secret), func(c *gin.Context) {
+		users = append(users, middleware.GetUserID(c))
+	})
+	files.POST("/upload/initiate", uploadHandler.InitiateUpload)
+	files.POST("/upload/:id/chunk", uploadHandler.UploadChunk)
+	files.POST("/upload/:id/complete", uploadHandler.CompleteUpload)
+	files.DELETE("/upload/:id", uploadHandler.CancelUpload)
+	files.DELETE("/:id", fileHandler.DeleteFile)
+	if breakDownload {
+		files.GET("/:id/download", func(c *gin.Context) { c.Data(http.StatusOK, "application/octet-stream", []byte("wrong")) })
+	} else {
+		files.GET("/:id/download", fileHandler.DownloadFile)
+	}
+
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return server, store, &users
+}
+
+func stageNames(report *Report) []string {
+	var names []string
+	for _, stage := range report.Stages {
+		names = append(names, stage.Name)
+	}
+	return names
+}
+
+func TestRun_PassesAgainstWorkingServer(t *testing.T) {
+	server, store, users := newServer(t, false)
+
+	report := Run(context.Background(), server.Client(), server.URL+"/", 10_000)
+	for _, stage := range report.Stages {
+		assert.Empty(t, stage.Error, stage.Name)
+		assert.Positive(t, stage.Duration, stage.Name)
+	}
+	assert.True(t, report.Passed)
+	assert.Equal(t, []string{"register", "purchase-credits", "initiate", "upload-chunks", "complete", "download", "verify", "cleanup",
+		"delete-account"}, stageNames(report))
+
+	// The file and the throwaway user are deleted afterwards
+	require.NotEmpty(t, *users)
+	userID := uuid.MustParse((*users)[0])
+	files, err := store.ListFilesByUser(context.Background(), userID, nil)
+	require.NoError(t, err)
+	assert.Empty(t, files)
+	_, err = store.GetUserByID(context.Background(), userID)
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+}
+
+func TestRun_FailsOnCorruptDownload(t *testing.T) {
+	server, _, _ := newServer(t, true)
+
+	report := Run(context.Background(), server.Client(), server.URL, 10_000)
+	assert.False(t, report.Passed)
+	names := stageNames(report)
+	assert.Equal(t, []string{"cleanup", "delete-account"}, names[len(names)-2:], "The file and user are cleaned up even when the check fails")
+	verify := report.Stages[len(report.Stages)-3]
+	assert.Equal(t, "verify", verify.Name)
+	assert.Contains(t, verify.Error, "differ")
+}
+
+func TestRun_StopsAtFirstFailure(t *testing.T) {
+	report := Run(context.Background(), http.DefaultClient, "http://127.0.0.1:1", 10)
+	assert.False(t, report.Passed)
+	require.Len(t, report.Stages, 1)
+	assert.Equal(t, "register", report.Stages[0].Name)
+	assert.NotEmpty(t, report.Stages[0].Error)
+}
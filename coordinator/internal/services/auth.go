@@ -2,9 +2,11 @@ package services
 
 import (
 	"context"
-	"crypto/rand"
+	"errors"
 	"fmt"
 	"math"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/federated-storage/coordinator/internal/models"
@@ -15,14 +17,41 @@ import (
 
 // AuthService handles authentication operations
 type AuthService struct {
-	db *storage.DB
+	store   storage.Store
+	pricing Pricing
+	// maxFailedLogins consecutive failures lock an account for lockout; 0 disables
+	maxFailedLogins int
+	lockout         time.Duration
+	now             func() time.Time
 }
 
 // NewAuthService creates a new auth service
-func NewAuthService(db *storage.DB) *AuthService {
-	return &AuthService{db: db}
+func NewAuthService(store storage.Store, pricing Pricing) *AuthService {
+	return &AuthService{store: store, pricing: pricing, now: time.Now}
 }
 
+// SetLoginLockout locks an account for cooldown after maxAttempts consecutive
+// failed logins; maxAttempts <= 0 disables lockout
+func (s *AuthService) SetLoginLockout(maxAttempts int, cooldown time.Duration) {
+	if maxAttempts < 0 {
+		maxAttempts = 0
+	}
+	s.maxFailedLogins = maxAttempts
+	s.lockout = cooldown
+}
+
+// ErrAccountLocked is returned by Login while an account is locked out
+var ErrAccountLocked = errors.New("account temporarily locked")
+
+// AccountLockedError is an ErrAccountLocked that says when the lockout ends
+type AccountLockedError struct {
+	Until time.Time
+}
+
+func (e *AccountLockedError) Error() string { return ErrAccountLocked.Error() }
+
+func (e *AccountLockedError) Unwrap() error { return ErrAccountLocked }
+
 // RegisterRequest represents a registration request
 type RegisterRequest struct {
 	Email    string `json:"email" binding:"required,email"`
@@ -44,18 +73,6 @@ type AuthResponse struct {
 
 // Register creates a new user
 func (s *AuthService) Register(ctx context.Context, req RegisterRequest) (*models.User, error) {
-	// Check if user exists
-	var exists bool
-	err := s.db.Pool.QueryRow(ctx,
-		"SELECT EXISTS(SELECT 1 FROM users WHERE email = $1)",
-		req.Email).Scan(&exists)
-	if err != nil {
-		return nil, fmt.Errorf("failed to check user existence: %w", err)
-	}
-	if exists {
-		return nil, fmt.Errorf("user already exists")
-	}
-
 	// Hash password
 	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
 	if err != nil {
@@ -70,63 +87,87 @@ func (s *AuthService) Register(ctx context.Context, req RegisterRequest) (*model
 		Credits:      0,
 	}
 
-	_, err = s.db.Pool.Exec(ctx,
-		`INSERT INTO users (id, email, password_hash, credits) 
-		 VALUES ($1, $2, $3, $4)`,
-		user.ID, user.Email, user.PasswordHash, user.Credits)
-	if err != nil {
+	if err := s.store.CreateUser(ctx, user); err != nil {
+		if errors.Is(err, storage.ErrConflict) {
+			return nil, fmt.Errorf("user already exists")
+		}
 		return nil, fmt.Errorf("failed to create user: %w", err)
 	}
 
 	return user, nil
 }
 
-// Login authenticates a user
+// Login authenticates a user. While an account is locked out every attempt
+// fails with an *AccountLockedError, before the password is checked.
 func (s *AuthService) Login(ctx context.Context, req LoginRequest) (*models.User, error) {
-	var user models.User
-	err := s.db.Pool.QueryRow(ctx,
-		"SELECT id, email, password_hash, credits FROM users WHERE email = $1",
-		req.Email).Scan(&user.ID, &user.Email, &user.PasswordHash, &user.Credits)
+	user, err := s.store.GetUserByEmail(ctx, req.Email)
 	if err != nil {
 		return nil, fmt.Errorf("invalid credentials")
 	}
 
+	now := s.now()
+	if user.LockedUntil != nil && now.Before(*user.LockedUntil) {
+		return nil, &AccountLockedError{Until: *user.LockedUntil}
+	}
+
 	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)); err != nil {
+		if s.maxFailedLogins == 0 {
+			return nil, fmt.Errorf("invalid credentials")
+		}
+		until := now.Add(s.lockout)
+		locked, err := s.store.RecordLoginFailure(ctx, user.ID, s.maxFailedLogins, until)
+		if err != nil {
+			return nil, fmt.Errorf("failed to record login attempt: %w", err)
+		}
+		if locked {
+			return nil, &AccountLockedError{Until: until}
+		}
 		return nil, fmt.Errorf("invalid credentials")
 	}
 
-	return &user, nil
+	if user.FailedLoginAttempts > 0 || user.LockedUntil != nil {
+		if err := s.store.ResetLoginFailures(ctx, user.ID); err != nil {
+			return nil, fmt.Errorf("failed to reset login attempts: %w", err)
+		}
+	}
+
+	return user, nil
 }
 
 // GetUser retrieves a user by ID
 func (s *AuthService) GetUser(ctx context.Context, userID uuid.UUID) (*models.User, error) {
-	var user models.User
-	err := s.db.Pool.QueryRow(ctx,
-		"SELECT id, email, credits, created_at, updated_at FROM users WHERE id = $1",
-		userID).Scan(&user.ID, &user.Email, &user.Credits, &user.CreatedAt, &user.UpdatedAt)
+	user, err := s.store.GetUserByID(ctx, userID)
 	if err != nil {
 		return nil, fmt.Errorf("user not found")
 	}
-	return &user, nil
+	return user, nil
 }
 
-// UpdateCredits updates user credits
-func (s *AuthService) UpdateCredits(ctx context.Context, userID uuid.UUID, amount int64, description string) error {
-	tx, err := s.db.Pool.Begin(ctx)
-	if err != nil {
-		return fmt.Errorf("failed to begin transaction: %w", err)
-	}
-	defer tx.Rollback(ctx)
-
-	// Update user credits
-	_, err = tx.Exec(ctx,
-		"UPDATE users SET credits = credits + $1, updated_at = $2 WHERE id = $3",
-		amount, time.Now(), userID)
-	if err != nil {
-		return fmt.Errorf("failed to update credits: %w", err)
+// ErrAccountHasFiles is returned by DeleteAccount while the user still owns files
+var ErrAccountHasFiles = errors.New("account still owns files; delete them first")
+
+// ErrUserNotFound is returned by DeleteAccount for an unknown user
+var ErrUserNotFound = errors.New("user not found")
+
+// DeleteAccount removes a user once they own no files, along with their
+// upload sessions, webhooks and remaining credits. Their credit
+// transactions are kept, no longer tied to the user.
+func (s *AuthService) DeleteAccount(ctx context.Context, userID uuid.UUID) error {
+	err := s.store.DeleteUser(ctx, userID)
+	switch {
+	case errors.Is(err, storage.ErrConflict):
+		return ErrAccountHasFiles
+	case errors.Is(err, storage.ErrNotFound):
+		return ErrUserNotFound
+	case err != nil:
+		return fmt.Errorf("failed to delete account: %w", err)
 	}
+	return nil
+}
 
-	// Record transaction
+// UpdateCredits updates user credits
+func (s *AuthService) UpdateCredits(ctx context.Context, userID uuid.UUID, amount int64, description string) error {
+	// Classify the transaction
 	var transactionType string
 	if amount >= 0 {
 		transactionType = "credit"
@@ -134,15 +175,68 @@ func (s *AuthService) UpdateCredits(ctx context.Context, userID uuid.UUID, amoun
 		transactionType = "debit"
 	}
 
-	_, err = tx.Exec(ctx,
-		`INSERT INTO credit_transactions (user_id, transaction_type, amount, description) 
-		 VALUES ($1, $2, $3, $4)`,
-		userID, transactionType, amount, description)
+	return s.store.AddCredits(ctx, userID, amount, transactionType, description)
+}
+
+// VerifyCreditChain checks that the user's credit transactions still hash
+// into an unbroken chain, returning an error wrapping
+// storage.ErrCreditChainBroken if any was altered or removed
+func (s *AuthService) VerifyCreditChain(ctx context.Context, userID uuid.UUID) error {
+	transactions, err := s.store.ListCreditTransactions(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("failed to list credit transactions: %w", err)
+	}
+	return storage.VerifyCreditChain(transactions)
+}
+
+// ErrInsufficientCredits is returned when a user's balance cannot cover a hold
+var ErrInsufficientCredits = errors.New("insufficient credits")
+
+// HoldCredits moves amount out of the user's spendable balance into a held
+// balance, so credits promised to an upload in progress can't be spent
+// elsewhere. The hold ends with CaptureCredits or ReleaseCredits.
+func (s *AuthService) HoldCredits(ctx context.Context, userID uuid.UUID, amount int64) error {
+	if amount <= 0 {
+		return nil
+	}
+	err := s.store.HoldCredits(ctx, userID, amount)
+	if errors.Is(err, storage.ErrInsufficientCredits) {
+		return fmt.Errorf("%w: %d required", ErrInsufficientCredits, amount)
+	}
+	return err
+}
+
+// ReleaseCredits returns held credits to the user's spendable balance
+func (s *AuthService) ReleaseCredits(ctx context.Context, userID uuid.UUID, amount int64) error {
+	if amount <= 0 {
+		return nil
+	}
+	return s.store.ReleaseCredits(ctx, userID, amount)
+}
+
+// CaptureCredits spends held credits, recording them as a debit
+func (s *AuthService) CaptureCredits(ctx context.Context, userID uuid.UUID, amount int64, description string) error {
+	if amount <= 0 {
+		return nil
+	}
+	return s.store.CaptureCredits(ctx, userID, amount, description)
+}
+
+// PurchaseCredits converts a USD amount into credits using the pricing tiers
+// (or the user's override) and adds them to the user's balance
+func (s *AuthService) PurchaseCredits(ctx context.Context, userID uuid.UUID, amountUSD int) (int64, int64, error) {
+	user, err := s.GetUser(ctx, userID)
 	if err != nil {
-		return fmt.Errorf("failed to record transaction: %w", err)
+		return 0, 0, err
 	}
 
-	return tx.Commit(ctx)
+	credits, rate := s.pricing.Credits(amountUSD, user.CreditsPerUSD)
+	description := fmt.Sprintf("Credit purchase ($%d at %d credits/USD)", amountUSD, rate)
+	if err := s.UpdateCredits(ctx, userID, credits, description); err != nil {
+		return 0, 0, err
+	}
+
+	return credits, rate, nil
 }
 
 // InitiateUploadRequest represents an upload initiation request
@@ -150,6 +244,17 @@ type InitiateUploadRequest struct {
 	Filename  string `json:"filename" binding:"required"`
 	SizeBytes int64  `json:"size_bytes" binding:"required,min=1"`
 	MimeType  string `json:"mime_type"`
+	// ExpiresAt optionally schedules the file for deletion
+	ExpiresAt *time.Time `json:"expires_at"`
+	// Versioned makes the upload a new version of the user's latest file with the same name
+	Versioned bool `json:"versioned"`
+	// ChunkSize optionally asks for a chunk size other than the one scheduled
+	// for the file's size; it is clamped to the server's bounds and returned
+	// in the response
+	ChunkSize int64 `json:"chunk_size" binding:"min=0"`
+	// Direct sends the chunks straight to the storage nodes; the client
+	// encrypts them with the key returned in the response
+	Direct bool `json:"direct"`
 }
 
 // InitiateUploadResponse represents an upload initiation response
@@ -157,68 +262,316 @@ type InitiateUploadResponse struct {
 	SessionID  string `json:"session_id"`
 	ChunkCount int    `json:"chunk_count"`
 	ChunkSize  int64  `json:"chunk_size"`
+	// For direct uploads, the cipher and base64 key to encrypt chunks with
+	Cipher        string `json:"cipher,omitempty"`
+	EncryptionKey string `json:"encryption_key,omitempty"`
 }
 
 // UploadSession represents an active upload session
-type UploadSession struct {
-	ID             uuid.UUID
-	UserID         uuid.UUID
-	FileID         *uuid.UUID
-	Filename       string
-	SizeBytes      int64
-	EncryptionKey  []byte
-	ChunkCount     int
-	ReceivedChunks int
-	Status         string
-	ExpiresAt      time.Time
-}
+type UploadSession = models.UploadSession
+
+// ErrTooManyChunks is returned when a file would be split into more chunks than allowed
+var ErrTooManyChunks = errors.New("file exceeds maximum chunk count")
+
+// ErrInvalidExpiry is returned when a requested file expiry is not in the future
+var ErrInvalidExpiry = errors.New("expires_at must be in the future")
+
+// ErrTooManyUploads is returned when a user already has the maximum number of uploads in progress
+var ErrTooManyUploads = errors.New("too many uploads in progress")
+
+// ErrChunkTooLarge is returned when an uploaded chunk exceeds the size expected at its index
+var ErrChunkTooLarge = errors.New("chunk exceeds chunk size")
+
+// ErrChunkTooSmall is returned when an uploaded chunk is shorter than expected at its index
+var ErrChunkTooSmall = errors.New("chunk is smaller than chunk size")
+
+// ErrChunkIndexOutOfRange is returned for a chunk index beyond the session's chunk count
+var ErrChunkIndexOutOfRange = errors.New("chunk index out of range")
 
 // UploadService handles file upload operations
 type UploadService struct {
-	db        *storage.DB
-	chunkSize int64
-	replicas  int
+	store             storage.Store
+	chunkSize         int64
+	minChunkSize      int64 // bounds on the chunk size a session may ask for
+	maxChunkSize      int64
+	chunkSizeTiers    []ChunkSizeTier // sorted by MinFileBytes; empty uses chunkSize for every file
+	replicas          int
+	maxChunks         int
+	maxActiveSessions int // per user, counting streamed uploads; 0 or less means unlimited
+	streamMu          sync.Mutex
+	streaming         map[uuid.UUID]int // single-request uploads in progress, by user
+	cipher            Cipher
+	keys              KeyProvider
+	// signer signs store authorizations for direct uploads; nil disables them
+	signer                Signer
+	peers                 PeerVerifier // checks the nodes' store receipts
+	storeAuthorizationTTL time.Duration
 }
 
 // NewUploadService creates a new upload service
-func NewUploadService(db *storage.DB, chunkSize int64, replicas int) *UploadService {
+func NewUploadService(store storage.Store, chunkSize int64, replicas int, maxChunks int) *UploadService {
 	return &UploadService{
-		db:        db,
-		chunkSize: chunkSize,
-		replicas:  replicas,
+		store:        store,
+		chunkSize:    chunkSize,
+		minChunkSize: chunkSize,
+		maxChunkSize: chunkSize,
+		replicas:     replicas,
+		maxChunks:    maxChunks,
+		streaming:    make(map[uuid.UUID]int),
+		cipher:       DefaultCipher,
+		keys:         RandomKeys{},
+
+		storeAuthorizationTTL: DefaultStoreAuthorizationTTL,
 	}
 }
 
-// InitiateUpload creates a new upload session
-func (s *UploadService) InitiateUpload(ctx context.Context, userID uuid.UUID, req InitiateUploadRequest) (*UploadSession, error) {
-	// Generate encryption key (256-bit)
-	encryptionKey := make([]byte, 32)
-	if _, err := rand.Read(encryptionKey); err != nil {
-		return nil, fmt.Errorf("failed to generate encryption key: %w", err)
+// SetChunkSizeRange lets upload sessions ask for a chunk size between min
+// and max bytes; by default every session uses the server's chunk size
+func (s *UploadService) SetChunkSizeRange(min, max int64) {
+	s.minChunkSize = min
+	s.maxChunkSize = max
+}
+
+// ClampChunkSize returns the chunk size a session asking for requested gets:
+// the server's chunk size if requested is 0, otherwise requested clamped to
+// the configured range
+func (s *UploadService) ClampChunkSize(requested int64) int64 {
+	if requested <= 0 {
+		return s.chunkSize
 	}
+	return min(max(requested, s.minChunkSize), s.maxChunkSize)
+}
 
-	// Calculate chunk count
-	chunkCount := int(math.Ceil(float64(req.SizeBytes) / float64(s.chunkSize)))
+// ChunkSizeTier chunks files of at least MinFileBytes into ChunkSizeBytes chunks
+type ChunkSizeTier struct {
+	MinFileBytes   int64
+	ChunkSizeBytes int64
+}
+
+// SetChunkSizeSchedule picks the chunk size of sessions that ask for none
+// by file size: the tier with the highest threshold the file reaches wins,
+// and files below every tier use the server's chunk size
+func (s *UploadService) SetChunkSizeSchedule(tiers []ChunkSizeTier) {
+	sorted := make([]ChunkSizeTier, len(tiers))
+	copy(sorted, tiers)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].MinFileBytes < sorted[j].MinFileBytes })
+	s.chunkSizeTiers = sorted
+}
+
+// ChunkSizeFor returns the chunk size the schedule picks for a sizeBytes file
+func (s *UploadService) ChunkSizeFor(sizeBytes int64) int64 {
+	chunkSize := s.chunkSize
+	for _, tier := range s.chunkSizeTiers {
+		if sizeBytes >= tier.MinFileBytes {
+			chunkSize = tier.ChunkSizeBytes
+		}
+	}
+	return chunkSize
+}
+
+// sessionChunkSize is the size every chunk of a session but the last must
+// have: the one recorded with it, or for sessions from before it was
+// recorded, the one the schedule picks for the session's file
+func (s *UploadService) sessionChunkSize(session *UploadSession) int64 {
+	if session.ChunkSize > 0 {
+		return session.ChunkSize
+	}
+	return s.ChunkSizeFor(session.SizeBytes)
+}
+
+// SetCipher chooses the cipher new uploads are encrypted with
+func (s *UploadService) SetCipher(c Cipher) {
+	s.cipher = c
+}
+
+// Cipher returns the cipher new uploads are encrypted with
+func (s *UploadService) Cipher() Cipher {
+	return s.cipher
+}
+
+// SetKeyProvider chooses how new uploads are keyed
+func (s *UploadService) SetKeyProvider(keys KeyProvider) {
+	s.keys = keys
+}
+
+// SessionKey returns the key a session's chunks are encrypted with, which
+// becomes the key of the file it creates
+func (s *UploadService) SessionKey(session *UploadSession) ([]byte, error) {
+	return s.keys.FileKey(Cipher(session.Cipher), session.ID, session.EncryptionKey)
+}
+
+// SetMaxActiveSessions caps how many unexpired active upload sessions and
+// single-request uploads one user may have in progress; n <= 0 removes the cap
+func (s *UploadService) SetMaxActiveSessions(n int) {
+	s.maxActiveSessions = n
+}
+
+// checkActiveUploads fails with ErrTooManyUploads if userID already has the
+// maximum number of uploads in progress. The caller holds streamMu.
+func (s *UploadService) checkActiveUploads(ctx context.Context, userID uuid.UUID) error {
+	if s.maxActiveSessions <= 0 {
+		return nil
+	}
+	active, err := s.store.CountActiveUploadSessions(ctx, userID, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to count upload sessions: %w", err)
+	}
+	active += s.streaming[userID]
+	if active >= s.maxActiveSessions {
+		return fmt.Errorf("%w: %d of %d in progress", ErrTooManyUploads, active, s.maxActiveSessions)
+	}
+	return nil
+}
+
+// BeginStreamedUpload counts a single-request upload against userID's
+// uploads in progress, failing with ErrTooManyUploads if none are left.
+// Those uploads have no session, so they are counted by this coordinator
+// only; the returned function ends the count once the upload finishes.
+func (s *UploadService) BeginStreamedUpload(ctx context.Context, userID uuid.UUID) (func(), error) {
+	s.streamMu.Lock()
+	defer s.streamMu.Unlock()
+	if err := s.checkActiveUploads(ctx, userID); err != nil {
+		return nil, err
+	}
+	s.streaming[userID]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.streamMu.Lock()
+			defer s.streamMu.Unlock()
+			if s.streaming[userID]--; s.streaming[userID] <= 0 {
+				delete(s.streaming, userID)
+			}
+		})
+	}, nil
+}
+
+// ChunkSize returns the server's chunk size, used for uploads that don't ask for another
+func (s *UploadService) ChunkSize() int64 {
+	return s.chunkSize
+}
+
+// LastChunkSize returns the size of the final chunk of a sizeBytes file split
+// into chunkSize chunks: the remainder, or a full chunk for an exact multiple
+func LastChunkSize(sizeBytes, chunkSize int64) int64 {
+	if sizeBytes <= 0 {
+		return 0
+	}
+	if rem := sizeBytes % chunkSize; rem != 0 {
+		return rem
+	}
+	return chunkSize
+}
+
+// CheckChunk validates the size of chunk index of a session. Every chunk but
+// the last must be exactly the chunk size and the last exactly the
+// remainder, so the stored chunks always add up to the declared file size.
+func (s *UploadService) CheckChunk(session *UploadSession, index int, sizeBytes int64) error {
+	if index < 0 || index >= session.ChunkCount {
+		return fmt.Errorf("%w: chunk %d of a %d-chunk upload", ErrChunkIndexOutOfRange, index, session.ChunkCount)
+	}
+
+	chunkSize := s.sessionChunkSize(session)
+	expected := chunkSize
+	if index == session.ChunkCount-1 {
+		expected = session.LastChunkSize
+		if expected == 0 {
+			// Sessions from before the final size was recorded
+			expected = LastChunkSize(session.SizeBytes, chunkSize)
+		}
+	}
+
+	switch {
+	case sizeBytes > expected:
+		return fmt.Errorf("%w: chunk %d is %d bytes, expected %d", ErrChunkTooLarge, index, sizeBytes, expected)
+	case sizeBytes < expected:
+		return fmt.Errorf("%w: chunk %d is %d bytes, expected %d", ErrChunkTooSmall, index, sizeBytes, expected)
+	}
+	return nil
+}
+
+// ChunkCountFor calculates the number of chunks for a file split at the
+// chunk size scheduled for it, enforcing the per-file cap
+func (s *UploadService) ChunkCountFor(sizeBytes int64) (int, error) {
+	return s.chunkCountFor(sizeBytes, s.ChunkSizeFor(sizeBytes))
+}
+
+func (s *UploadService) chunkCountFor(sizeBytes, chunkSize int64) (int, error) {
+	chunkCount := int(math.Ceil(float64(sizeBytes) / float64(chunkSize)))
+	if s.maxChunks > 0 && chunkCount > s.maxChunks {
+		return 0, fmt.Errorf("%w: %d chunks exceeds the limit of %d (chunk size of %d bytes is too small for this file)",
+			ErrTooManyChunks, chunkCount, s.maxChunks, chunkSize)
+	}
+	return chunkCount, nil
+}
+
+// InitiateUpload creates a new upload session. heldCredits records the credits
+// already held for it, which are captured or released when the session ends.
+func (s *UploadService) InitiateUpload(ctx context.Context, userID uuid.UUID, req InitiateUploadRequest, heldCredits int64) (*UploadSession, error) {
+	if err := ValidateFilename(req.Filename); err != nil {
+		return nil, err
+	}
+
+	// A session that asks for no chunk size gets the one scheduled for its file
+	chunkSize := s.ClampChunkSize(req.ChunkSize)
+	if req.ChunkSize <= 0 {
+		chunkSize = s.ChunkSizeFor(req.SizeBytes)
+	}
+	chunkCount, err := s.chunkCountFor(req.SizeBytes, chunkSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		return nil, ErrInvalidExpiry
+	}
+	if req.Direct && s.signer == nil {
+		return nil, ErrDirectUploadsDisabled
+	}
+
+	// The session's file will take its ID, so the key is made for that
+	sessionID := uuid.New()
+	encryptionKey, store, err := s.keys.NewKey(s.cipher, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	// Every chunk of the session is sealed with this key, so a provider
+	// handing out the wrong size fails the upload here, not chunk by chunk
+	if err := s.cipher.CheckKey(encryptionKey); err != nil {
+		return nil, fmt.Errorf("key provider returned an unusable key: %w", err)
+	}
+	if !store {
+		encryptionKey = nil
+	}
 
 	session := &UploadSession{
-		ID:             uuid.New(),
+		ID:             sessionID,
 		UserID:         userID,
 		Filename:       req.Filename,
 		SizeBytes:      req.SizeBytes,
 		EncryptionKey:  encryptionKey,
+		Cipher:         string(s.cipher),
 		ChunkCount:     chunkCount,
+		ChunkSize:      chunkSize,
+		LastChunkSize:  LastChunkSize(req.SizeBytes, chunkSize),
 		ReceivedChunks: 0,
 		Status:         "active",
 		ExpiresAt:      time.Now().Add(24 * time.Hour),
+		FileExpiresAt:  req.ExpiresAt,
+		Versioned:      req.Versioned,
+		Direct:         req.Direct,
+		HeldCredits:    heldCredits,
 	}
 
-	_, err := s.db.Pool.Exec(ctx,
-		`INSERT INTO upload_sessions (id, user_id, filename, size_bytes, encryption_key, chunk_count, received_chunks, status, expires_at) 
-		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
-		session.ID, session.UserID, session.Filename, session.SizeBytes,
-		session.EncryptionKey, session.ChunkCount, session.ReceivedChunks,
-		session.Status, session.ExpiresAt)
-	if err != nil {
+	// Counting and creating under one lock keeps concurrent initiations
+	// from all passing the check before any of their sessions exists
+	s.streamMu.Lock()
+	defer s.streamMu.Unlock()
+	if err := s.checkActiveUploads(ctx, userID); err != nil {
+		return nil, err
+	}
+	if err := s.store.CreateUploadSession(ctx, session); err != nil {
 		return nil, fmt.Errorf("failed to create upload session: %w", err)
 	}
 
@@ -227,34 +580,57 @@ func (s *UploadService) InitiateUpload(ctx context.Context, userID uuid.UUID, re
 
 // GetSession retrieves an upload session
 func (s *UploadService) GetSession(ctx context.Context, sessionID uuid.UUID) (*UploadSession, error) {
-	var session UploadSession
-	var fileID *uuid.UUID
-	err := s.db.Pool.QueryRow(ctx,
-		`SELECT id, user_id, file_id, filename, size_bytes, encryption_key, chunk_count, received_chunks, status, expires_at 
-		 FROM upload_sessions WHERE id = $1`,
-		sessionID).Scan(
-		&session.ID, &session.UserID, &fileID, &session.Filename,
-		&session.SizeBytes, &session.EncryptionKey, &session.ChunkCount,
-		&session.ReceivedChunks, &session.Status, &session.ExpiresAt)
+	session, err := s.store.GetUploadSession(ctx, sessionID)
 	if err != nil {
 		return nil, fmt.Errorf("session not found")
 	}
-	session.FileID = fileID
-	return &session, nil
+	return session, nil
 }
 
 // UpdateSessionStatus updates upload session status
 func (s *UploadService) UpdateSessionStatus(ctx context.Context, sessionID uuid.UUID, status string) error {
-	_, err := s.db.Pool.Exec(ctx,
-		"UPDATE upload_sessions SET status = $1 WHERE id = $2",
-		status, sessionID)
-	return err
+	return s.store.SetUploadSessionStatus(ctx, sessionID, status)
+}
+
+// CloseSession moves an active session to status, reporting false if the
+// session was no longer active. Only one caller can close a session, so only
+// one settles its credit hold.
+func (s *UploadService) CloseSession(ctx context.Context, sessionID uuid.UUID, status string) (bool, error) {
+	return s.store.SwapUploadSessionStatus(ctx, sessionID, "active", status)
+}
+
+// ExpireSessions closes every active session whose expiry is at or before now
+// and releases its credit hold. It returns how many sessions it expired;
+// failures on individual sessions are joined into the error without stopping
+// the sweep.
+func (s *UploadService) ExpireSessions(ctx context.Context, now time.Time) (int, error) {
+	sessions, err := s.store.ListExpiredUploadSessions(ctx, now)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list expired upload sessions: %w", err)
+	}
+
+	expired := 0
+	var errs []error
+	for _, session := range sessions {
+		closed, err := s.CloseSession(ctx, session.ID, "expired")
+		if err != nil {
+			errs = append(errs, fmt.Errorf("session %s: %w", session.ID, err))
+			continue
+		}
+		if !closed {
+			continue
+		}
+		expired++
+		if session.HeldCredits > 0 {
+			if err := s.store.ReleaseCredits(ctx, session.UserID, session.HeldCredits); err != nil {
+				errs = append(errs, fmt.Errorf("session %s: failed to release credits: %w", session.ID, err))
+			}
+		}
+	}
+	return expired, errors.Join(errs...)
 }
 
 // UpdateSessionFileID updates the file ID for an upload session
 func (s *UploadService) UpdateSessionFileID(ctx context.Context, sessionID uuid.UUID, fileID uuid.UUID) error {
-	_, err := s.db.Pool.Exec(ctx,
-		"UPDATE upload_sessions SET file_id = $1 WHERE id = $2",
-		fileID, sessionID)
-	return err
+	return s.store.SetUploadSessionFile(ctx, sessionID, fileID)
 }
@@ -0,0 +1,251 @@
+package services
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"slices"
+	"time"
+
+	"github.com/federated-storage/coordinator/internal/models"
+	"github.com/google/uuid"
+)
+
+// CapacityBlockSize is the unit capacity challenges address a node's storage in
+const CapacityBlockSize = 1 << 20
+
+// capacitySampleBlocks is how many of a challenge's blocks the node is asked
+// to hash once it holds them all
+const capacitySampleBlocks = 16
+
+// Answering a sample may take a fixed allowance plus this long per MB
+// sampled, which covers reading the blocks back from a slow disk and hashing
+// them. It is timed on the coordinator, from sending the sample to reading
+// the answer.
+const (
+	capacityProofBaseMs  = 2000
+	capacityProofMsPerMB = 50
+)
+
+// ErrCapacityProofFailed is returned when a node's capacity proof is wrong or too slow
+var ErrCapacityProofFailed = errors.New("capacity proof failed")
+
+// ErrUnknownNode is returned when an admin operation targets a node that does
+// not exist or, for capacity proofs, is not active
+var ErrUnknownNode = errors.New("unknown node")
+
+// CapacityProver sends capacity challenges to storage nodes: it sends the
+// challenge and its blocks, filled in by fill, and once the node holds them
+// the sample. It returns the node's answer and how long the node took to
+// answer the sample, as measured by the coordinator.
+type CapacityProver interface {
+	SendCapacityChallenge(ctx context.Context, peerID string, challenge *models.CapacityChallenge, fill func(i int, buf []byte), sample *models.CapacitySample) (*models.CapacityProof, time.Duration, error)
+}
+
+// CapacityRegion is a capacity challenge and the secret its blocks' data is
+// derived from. The secret never leaves the coordinator, so the node can
+// only answer a sample by storing the blocks it was sent, not by
+// regenerating them.
+type CapacityRegion struct {
+	Challenge models.CapacityChallenge
+	key       []byte
+}
+
+// NewCapacityChallenge picks up to regionBytes worth of blocks at distinct
+// random block offsets across a node's claimed capacity. Because the node
+// can't know in advance where they will land or which will be sampled,
+// passing shows it can hold data anywhere up to its claim, not just that it
+// has regionBytes free.
+func NewCapacityChallenge(claimedBytes, regionBytes int64) (*CapacityRegion, error) {
+	claimedBlocks := claimedBytes / CapacityBlockSize
+	if claimedBlocks < 1 {
+		return nil, fmt.Errorf("claimed capacity of %d bytes is less than one %d byte block", claimedBytes, CapacityBlockSize)
+	}
+	blocks := min(max(regionBytes/CapacityBlockSize, 1), claimedBlocks)
+
+	key := make([]byte, 32)
+	if _, err := crand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	picked := make(map[int64]bool, blocks)
+	offsets := make([]int64, 0, blocks)
+	for int64(len(offsets)) < blocks {
+		offset := rand.Int63n(claimedBlocks)
+		if !picked[offset] {
+			picked[offset] = true
+			offsets = append(offsets, offset)
+		}
+	}
+	slices.Sort(offsets)
+	return &CapacityRegion{
+		Challenge: models.CapacityChallenge{BlockSize: CapacityBlockSize, Offsets: offsets},
+		key:       key,
+	}, nil
+}
+
+// Bytes is the size of the region's blocks together
+func (r *CapacityRegion) Bytes() int64 {
+	return int64(len(r.Challenge.Offsets)) * int64(r.Challenge.BlockSize)
+}
+
+// Block fills buf with the data of the region's block i: an AES-CTR
+// keystream keyed by the region's secret and the block's offset
+func (r *CapacityRegion) Block(i int, buf []byte) {
+	var offset [8]byte
+	binary.BigEndian.PutUint64(offset[:], uint64(r.Challenge.Offsets[i]))
+	key := sha256.Sum256(append(append([]byte{}, r.key...), offset[:]...))
+	block, _ := aes.NewCipher(key[:]) // a 32-byte key can't fail
+	clear(buf)
+	cipher.NewCTR(block, make([]byte, aes.BlockSize)).XORKeyStream(buf, buf)
+}
+
+// NewSample picks the blocks a node holding the region must hash, under a
+// fresh nonce so no hash can be prepared while the blocks arrive
+func (r *CapacityRegion) NewSample() (*models.CapacitySample, error) {
+	nonce := make([]byte, 32)
+	if _, err := crand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	blocks := rand.Perm(len(r.Challenge.Offsets))
+	return &models.CapacitySample{Nonce: nonce, Blocks: blocks[:min(len(blocks), capacitySampleBlocks)]}, nil
+}
+
+// SampleDigests returns the digests a node holding the region answers sample with
+func (r *CapacityRegion) SampleDigests(sample *models.CapacitySample) []string {
+	buf := make([]byte, r.Challenge.BlockSize)
+	digests := make([]string, len(sample.Blocks))
+	for i, block := range sample.Blocks {
+		r.Block(block, buf)
+		h := sha256.New()
+		h.Write(sample.Nonce)
+		h.Write(buf)
+		digests[i] = hex.EncodeToString(h.Sum(nil))
+	}
+	return digests
+}
+
+// CapacityTimeoutMs is how long a node may take to answer a sample
+func CapacityTimeoutMs(sample *models.CapacitySample, blockSize int) int {
+	mb := int64(len(sample.Blocks)) * int64(blockSize) / (1 << 20)
+	return capacityProofBaseMs + int(mb)*capacityProofMsPerMB
+}
+
+// VerifyCapacityProof checks a node's answer to sample against the region's
+// data, and the time it took, as measured by the coordinator, against the
+// sample's limit
+func VerifyCapacityProof(region *CapacityRegion, sample *models.CapacitySample, proof *models.CapacityProof, took time.Duration) error {
+	if proof.Error != "" {
+		return fmt.Errorf("%w: node could not take the challenge: %s", ErrCapacityProofFailed, proof.Error)
+	}
+	if timeout := CapacityTimeoutMs(sample, region.Challenge.BlockSize); took.Milliseconds() > int64(timeout) {
+		return fmt.Errorf("%w: took %d ms, limit %d ms", ErrCapacityProofFailed, took.Milliseconds(), timeout)
+	}
+	if !slices.Equal(proof.Digests, region.SampleDigests(sample)) {
+		return fmt.Errorf("%w: digests do not match the blocks sent", ErrCapacityProofFailed)
+	}
+	return nil
+}
+
+// TrustedCapacity is how much of a node's claimed capacity placement may
+// rely on: all of it once a capacity proof has passed, otherwise no more than
+// unverifiedBytes. An unverifiedBytes of 0 trusts every claim.
+func TrustedCapacity(node *models.StorageNode, unverifiedBytes int64) int64 {
+	if unverifiedBytes <= 0 || node.CapacityVerifiedAt != nil {
+		return node.TotalStorageBytes
+	}
+	return min(node.TotalStorageBytes, unverifiedBytes)
+}
+
+// ExcludeFull returns the nodes with room left under their (trusted)
+// capacity; nodes reporting no capacity are kept
+func ExcludeFull(nodes []models.StorageNode) []models.StorageNode {
+	eligible := make([]models.StorageNode, 0, len(nodes))
+	for _, n := range nodes {
+		if n.TotalStorageBytes <= 0 || n.UsedStorageBytes < n.TotalStorageBytes {
+			eligible = append(eligible, n)
+		}
+	}
+	return eligible
+}
+
+// CapacityProofResult reports a capacity challenge sent to a node
+type CapacityProofResult struct {
+	NodeID       uuid.UUID `json:"node_id"`
+	Verified     bool      `json:"verified"`
+	ClaimedBytes int64     `json:"claimed_bytes"`
+	RegionBytes  int64     `json:"region_bytes"`
+	Blocks       int       `json:"blocks"`         // written at random offsets across the claim
+	Sampled      int       `json:"sampled_blocks"` // of those, hashed by the node afterwards
+	DurationMs   int       `json:"duration_ms"`    // to answer the sample, measured by the coordinator
+	TimeoutMs    int       `json:"timeout_ms"`
+	Error        string    `json:"error,omitempty"`
+}
+
+// SetUnverifiedCapacity caps the capacity trusted for nodes that have not
+// passed a capacity proof; 0 trusts every claim
+func (s *NodeService) SetUnverifiedCapacity(bytes int64) {
+	s.unverifiedCapacity = bytes
+}
+
+// ProveCapacity has a node store up to regionBytes of blocks at random
+// offsets across its claimed capacity, then hash a random sample of them. Passing trusts the node's full
+// claim; a wrong or late answer withdraws any earlier verification. An error
+// means the node could not be challenged, which leaves its status alone.
+func (s *NodeService) ProveCapacity(ctx context.Context, prover CapacityProver, nodeID uuid.UUID, regionBytes int64) (*CapacityProofResult, error) {
+	var peerID string
+	var claimed int64
+	err := s.db.Pool.QueryRow(ctx,
+		"SELECT peer_id, total_storage_bytes FROM storage_nodes WHERE id = $1 AND status = 'active'",
+		nodeID).Scan(&peerID, &claimed)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownNode, nodeID)
+	}
+
+	region, err := NewCapacityChallenge(claimed, regionBytes)
+	if err != nil {
+		return nil, err
+	}
+	sample, err := region.NewSample()
+	if err != nil {
+		return nil, err
+	}
+	result := &CapacityProofResult{
+		NodeID:       nodeID,
+		ClaimedBytes: claimed,
+		RegionBytes:  region.Bytes(),
+		Blocks:       len(region.Challenge.Offsets),
+		Sampled:      len(sample.Blocks),
+		TimeoutMs:    CapacityTimeoutMs(sample, region.Challenge.BlockSize),
+	}
+
+	proof, took, err := prover.SendCapacityChallenge(ctx, peerID, &region.Challenge, region.Block, sample)
+	if err != nil {
+		return nil, fmt.Errorf("failed to challenge node: %w", err)
+	}
+	result.DurationMs = int(took.Milliseconds())
+
+	var verifiedAt *time.Time
+	if err := VerifyCapacityProof(region, sample, proof, took); err != nil {
+		result.Error = err.Error()
+	} else {
+		now := time.Now()
+		verifiedAt = &now
+		result.Verified = true
+	}
+
+	// A claim changed while the challenge ran is left for the next one
+	_, err = s.db.Pool.Exec(ctx,
+		"UPDATE storage_nodes SET capacity_verified_at = $1 WHERE id = $2 AND total_storage_bytes = $3",
+		verifiedAt, nodeID, claimed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record capacity proof: %w", err)
+	}
+	return result, nil
+}
@@ -2,28 +2,78 @@ package services
 
 import (
 	"context"
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"io"
+	"time"
 
+	"github.com/federated-storage/coordinator/internal/chunkformat"
+	"github.com/federated-storage/coordinator/internal/merkle"
 	"github.com/federated-storage/coordinator/internal/models"
 	"github.com/federated-storage/coordinator/internal/storage"
 	"github.com/google/uuid"
 )
 
+// NodeLister lists the active storage nodes chunks can be placed on
+type NodeLister interface {
+	GetAllNodes(ctx context.Context) ([]models.StorageNode, error)
+}
+
 // ChunkService handles chunk operations
 type ChunkService struct {
-	db          *storage.DB
-	nodeService *NodeService
+	store        storage.Store
+	nodeService  NodeLister
+	cache        *ChunkCache // nil disables caching
+	minOperators int         // distinct operators each chunk's replicas must span
+	minReplicas  int         // fewest replicas a chunk may be stored with; 0 requires the full count
+	placement    Placement   // how candidate nodes are ordered; empty ranks by reputation
+	virtualNodes int         // points per node on the hash ring
+	// maintenanceLead is how long before its maintenance window a node stops
+	// receiving chunks and starts being drained
+	maintenanceLead time.Duration
+	// transfer fetches chunks the coordinator holds no copy of from their
+	// nodes; nil leaves them unreadable
+	transfer ChunkTransfer
+	// offlineAfter without a heartbeat leaves a node out of file locations; 0 never does
+	offlineAfter time.Duration
+}
+
+// NewChunkService creates a new chunk service; cache may be nil
+func NewChunkService(store storage.Store, nodeService NodeLister, cache *ChunkCache) *ChunkService {
+	return &ChunkService{store: store, nodeService: nodeService, cache: cache}
+}
+
+// SetMinOperators makes node selection fail unless a chunk's replicas can be
+// placed on at least n distinct operators (capped at the replica count).
+// Replicas are spread across operators whenever possible regardless.
+func (s *ChunkService) SetMinOperators(n int) {
+	s.minOperators = n
+}
+
+// SetMinReplicas lets node selection place fewer replicas than requested,
+// down to n, when not enough nodes are available. Uploads below the floor fail.
+func (s *ChunkService) SetMinReplicas(n int) {
+	s.minReplicas = n
+}
+
+// SetPlacement chooses how chunks' replicas are placed. With
+// PlacementConsistentHash each node gets virtualNodes points on the ring.
+func (s *ChunkService) SetPlacement(placement Placement, virtualNodes int) {
+	s.placement = placement
+	s.virtualNodes = virtualNodes
 }
 
-// NewChunkService creates a new chunk service
-func NewChunkService(db *storage.DB, nodeService *NodeService) *ChunkService {
-	return &ChunkService{db: db, nodeService: nodeService}
+// SetMaintenanceLead sets how far ahead of a node's maintenance window it is
+// drained and left out of placement
+func (s *ChunkService) SetMaintenanceLead(d time.Duration) {
+	s.maintenanceLead = d
+}
+
+// SetTransfer fetches chunks stored only on nodes, as direct uploads leave
+// them, from those nodes when they are read
+func (s *ChunkService) SetTransfer(transfer ChunkTransfer) {
+	s.transfer = transfer
 }
 
 // StoreChunk stores a chunk and its assignments
@@ -38,154 +88,316 @@ func (s *ChunkService) StoreChunk(ctx context.Context, fileID uuid.UUID, chunkIn
 		ChunkIndex: chunkIndex,
 		Hash:       hashStr,
 		SizeBytes:  len(data),
+		MerkleRoot: hex.EncodeToString(merkle.Root(data)),
+		Format:     chunkformat.Version(data),
 	}
 
-	// Insert chunk with data
-	_, err := s.db.Pool.Exec(ctx,
-		"INSERT INTO chunks (id, file_id, chunk_index, hash, size_bytes, data) VALUES ($1, $2, $3, $4, $5, $6)",
-		chunk.ID, chunk.FileID, chunk.ChunkIndex, chunk.Hash, chunk.SizeBytes, data)
-	if err != nil {
-		return nil, fmt.Errorf("failed to insert chunk: %w", err)
-	}
-
-	// Create assignments
-	for _, nodeID := range nodeIDs {
-		_, err := s.db.Pool.Exec(ctx,
-			"INSERT INTO chunk_assignments (id, chunk_id, node_id) VALUES ($1, $2, $3)",
-			uuid.New(), chunk.ID, nodeID)
-		if err != nil {
-			return nil, fmt.Errorf("failed to create chunk assignment: %w", err)
-		}
+	if err := s.store.CreateChunk(ctx, chunk, data, nodeIDs); err != nil {
+		return nil, err
 	}
 
 	return chunk, nil
 }
 
+// RecordChunk records a chunk a client stored directly on nodeIDs: its
+// metadata and assignments, but no data. It fails with storage.ErrConflict if
+// the file already has a chunk at that index.
+func (s *ChunkService) RecordChunk(ctx context.Context, chunk *models.Chunk, nodeIDs []uuid.UUID) error {
+	return s.store.CreateChunk(ctx, chunk, nil, nodeIDs)
+}
+
 // GetChunksByFile retrieves all chunks for a file
 func (s *ChunkService) GetChunksByFile(ctx context.Context, fileID uuid.UUID) ([]models.Chunk, error) {
-	rows, err := s.db.Pool.Query(ctx,
-		"SELECT id, file_id, chunk_index, hash, size_bytes FROM chunks WHERE file_id = $1 ORDER BY chunk_index",
-		fileID)
+	return s.store.ListChunks(ctx, fileID)
+}
+
+// GetChunksByFileWithData retrieves all chunks with data for a file, serving
+// them from the cache when every chunk is present there
+func (s *ChunkService) GetChunksByFileWithData(ctx context.Context, fileID uuid.UUID) (map[int][]byte, error) {
+	if s.cache == nil {
+		return s.store.ListChunkData(ctx, fileID)
+	}
+
+	chunks, err := s.store.ListChunks(ctx, fileID)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
+	data := make(map[int][]byte, len(chunks))
+	for _, chunk := range chunks {
+		cached, ok := s.cache.Get(chunk.ID, chunk.Hash)
+		if !ok {
+			break
+		}
+		data[chunk.ChunkIndex] = cached
+	}
+	if len(data) == len(chunks) {
+		return data, nil
+	}
 
-	var chunks []models.Chunk
-	for rows.Next() {
-		var chunk models.Chunk
-		err := rows.Scan(&chunk.ID, &chunk.FileID, &chunk.ChunkIndex, &chunk.Hash, &chunk.SizeBytes)
-		if err != nil {
-			return nil, err
+	data, err = s.store.ListChunkData(ctx, fileID)
+	if err != nil {
+		return nil, err
+	}
+	for _, chunk := range chunks {
+		if d, ok := data[chunk.ChunkIndex]; ok {
+			s.cache.Put(fileID, chunk.ID, chunk.Hash, d)
 		}
-		chunks = append(chunks, chunk)
 	}
-	return chunks, nil
+	return data, nil
 }
 
-// GetChunksByFileWithData retrieves all chunks with data for a file
-func (s *ChunkService) GetChunksByFileWithData(ctx context.Context, fileID uuid.UUID) (map[int][]byte, error) {
-	rows, err := s.db.Pool.Query(ctx,
-		"SELECT chunk_index, data FROM chunks WHERE file_id = $1 ORDER BY chunk_index",
-		fileID)
+// InvalidateFile drops a file's chunks from the cache after they are deleted or rewritten
+func (s *ChunkService) InvalidateFile(fileID uuid.UUID) {
+	if s.cache != nil {
+		s.cache.RemoveFile(fileID)
+	}
+}
+
+// ErrChunkLost is returned when a chunk can't be read and no active replica
+// of it is left anywhere, so retrying won't help
+var ErrChunkLost = errors.New("chunk permanently lost")
+
+// ErrChunkUnavailable is returned when a chunk can't be read now but has
+// active replicas, whose nodes may come back
+var ErrChunkUnavailable = errors.New("chunk temporarily unavailable")
+
+// CheckChunksReadable reports why a file can't be streamed from chunks, its
+// chunk metadata as returned by GetChunksByFile: the first chunk that is
+// missing or has no stored data is ErrChunkLost if no active assignment of it
+// remains, and ErrChunkUnavailable otherwise. A chunk held only by nodes is
+// readable while it has active assignments and the coordinator can reach nodes.
+func (s *ChunkService) CheckChunksReadable(ctx context.Context, chunks []models.Chunk, chunkCount int) error {
+	byIndex := make(map[int]*models.Chunk, len(chunks))
+	for i := range chunks {
+		byIndex[chunks[i].ChunkIndex] = &chunks[i]
+	}
+	for i := 0; i < chunkCount; i++ {
+		if err := s.CheckChunkReadable(ctx, byIndex[i], i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckChunkReadable is CheckChunksReadable for the chunk at index alone,
+// with chunk nil if it has no metadata
+func (s *ChunkService) CheckChunkReadable(ctx context.Context, chunk *models.Chunk, index int) error {
+	if chunk == nil {
+		return fmt.Errorf("%w: chunk %d", ErrChunkLost, index)
+	}
+	if chunk.SizeBytes > 0 && !chunk.NodeOnly {
+		return nil
+	}
+	assignments, err := s.store.ListChunkAssignments(ctx, chunk.ID)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if len(assignments) == 0 {
+		return fmt.Errorf("%w: chunk %d has no replicas left", ErrChunkLost, index)
+	}
+	if chunk.NodeOnly && s.transfer != nil && s.nodeService != nil {
+		return nil
 	}
-	defer rows.Close()
+	return fmt.Errorf("%w: none of the %d nodes holding chunk %d can serve it", ErrChunkUnavailable, len(assignments), index)
+}
 
-	chunks := make(map[int][]byte)
-	for rows.Next() {
-		var chunkIndex int
-		var data []byte
-		err := rows.Scan(&chunkIndex, &data)
-		if err != nil {
+// ReadChunk returns one chunk's data, from the cache if it holds the chunk.
+// A chunk the coordinator holds no copy of is fetched from its nodes.
+func (s *ChunkService) ReadChunk(ctx context.Context, chunk models.Chunk) ([]byte, error) {
+	if s.cache != nil {
+		if cached, ok := s.cache.Get(chunk.ID, chunk.Hash); ok {
+			return cached, nil
+		}
+	}
+	_, data, err := s.store.GetChunk(ctx, chunk.ID)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 && chunk.SizeBytes > 0 {
+		if data, err = s.fetchFromNodes(ctx, chunk); err != nil {
 			return nil, err
 		}
-		chunks[chunkIndex] = data
 	}
-	return chunks, nil
+	if s.cache != nil {
+		s.cache.Put(chunk.FileID, chunk.ID, chunk.Hash, data)
+	}
+	return data, nil
 }
 
-// GetChunkAssignments retrieves nodes storing a specific chunk
-func (s *ChunkService) GetChunkAssignments(ctx context.Context, chunkID uuid.UUID) ([]models.ChunkAssignment, error) {
-	rows, err := s.db.Pool.Query(ctx,
-		`SELECT ca.id, ca.chunk_id, ca.node_id, ca.status, ca.created_at, sn.peer_id, sn.address
-		 FROM chunk_assignments ca
-		 JOIN storage_nodes sn ON ca.node_id = sn.id
-		 WHERE ca.chunk_id = $1 AND ca.status = 'active' AND sn.status = 'active'`,
-		chunkID)
+// fetchFromNodes retrieves a chunk from the first of its active nodes that
+// returns content matching its hash
+func (s *ChunkService) fetchFromNodes(ctx context.Context, chunk models.Chunk) ([]byte, error) {
+	if s.transfer == nil || s.nodeService == nil {
+		return nil, fmt.Errorf("%w: chunk %d is only stored on nodes", ErrChunkUnavailable, chunk.ChunkIndex)
+	}
+	assignments, err := s.store.ListChunkAssignments(ctx, chunk.ID)
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := s.nodeService.GetAllNodes(ctx)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
+	peerIDs := make(map[uuid.UUID]string, len(nodes))
+	for _, node := range nodes {
+		peerIDs[node.ID] = node.PeerID
+	}
 
-	var assignments []models.ChunkAssignment
-	for rows.Next() {
-		var ca models.ChunkAssignment
-		var peerID, address string
-		err := rows.Scan(&ca.ID, &ca.ChunkID, &ca.NodeID, &ca.Status, &ca.CreatedAt, &peerID, &address)
+	var errs []error
+	for _, assignment := range assignments {
+		peerID, ok := peerIDs[assignment.NodeID]
+		if !ok {
+			continue
+		}
+		data, err := s.transfer.RetrieveChunk(ctx, peerID, chunk.ID.String())
 		if err != nil {
-			return nil, err
+			errs = append(errs, fmt.Errorf("node %s: %w", assignment.NodeID, err))
+			continue
+		}
+		if hash := sha256.Sum256(data); hex.EncodeToString(hash[:]) != chunk.Hash {
+			errs = append(errs, fmt.Errorf("node %s: %w", assignment.NodeID, ErrChunkVerifyFailed))
+			continue
 		}
-		assignments = append(assignments, ca)
+		return data, nil
 	}
-	return assignments, nil
+	return nil, fmt.Errorf("%w: no node returned chunk %d: %w", ErrChunkUnavailable, chunk.ChunkIndex, errors.Join(errs...))
+}
+
+// GetChunkAssignments retrieves nodes storing a specific chunk
+func (s *ChunkService) GetChunkAssignments(ctx context.Context, chunkID uuid.UUID) ([]models.ChunkAssignment, error) {
+	return s.store.ListChunkAssignments(ctx, chunkID)
 }
 
-// SelectNodesForChunks selects nodes for storing chunks (round-robin for MVP)
-func (s *ChunkService) SelectNodesForChunks(ctx context.Context, replicaCount int) ([]models.StorageNode, error) {
+// ListNodeChunkPage returns up to limit chunks assigned to a node with IDs after after, in ID order
+func (s *ChunkService) ListNodeChunkPage(ctx context.Context, nodeID, after uuid.UUID, limit int) ([]models.Chunk, error) {
+	return s.store.ListNodeChunkPage(ctx, nodeID, after, limit)
+}
+
+// SelectNodesForChunks selects nodes for storing the chunk with the given
+// ChunkPlacementKey, one replica per operator where possible. Nodes are taken
+// most reputable first or, with PlacementConsistentHash, in hash ring order
+// from the key. Nodes draining for maintenance or excluded by an operator
+// are skipped.
+func (s *ChunkService) SelectNodesForChunks(ctx context.Context, key string, replicaCount int) ([]models.StorageNode, error) {
 	nodes, err := s.nodeService.GetAllNodes(ctx)
 	if err != nil {
 		return nil, err
 	}
+	if nodes, err = s.excludeListed(ctx, nodes); err != nil {
+		return nil, err
+	}
+	nodes = ExcludeDraining(nodes, time.Now(), s.maintenanceLead)
+	nodes = ExcludeFull(nodes)
 
-	if len(nodes) < replicaCount {
-		return nil, fmt.Errorf("not enough active nodes (%d available, %d required)", len(nodes), replicaCount)
+	// With too few nodes for every replica, store as many as the floor allows
+	if s.minReplicas > 0 && len(nodes) < replicaCount {
+		replicaCount = max(len(nodes), s.minReplicas)
 	}
 
-	// Simple round-robin: return first N nodes
-	// In production, implement smarter selection based on capacity, latency, etc.
-	return nodes[:replicaCount], nil
+	if s.placement == PlacementConsistentHash {
+		nodes = NewHashRing(nodes, s.virtualNodes).Candidates(key)
+	} else {
+		RankByReputation(nodes)
+	}
+	return PlaceReplicas(nodes, replicaCount, s.minOperators)
 }
 
-// EncryptChunk encrypts chunk data using AES-256-GCM
-func EncryptChunk(data []byte, key []byte) ([]byte, error) {
-	block, err := aes.NewCipher(key)
+// ErrBelowReplicaFloor is returned when a file's chunks were stored with fewer replicas than the floor
+var ErrBelowReplicaFloor = errors.New("fewer replicas than the replication floor")
+
+// AchievedReplicas returns the fewest active replicas any chunk of a file has,
+// which is what the file's storage is charged for. It fails with
+// ErrBelowReplicaFloor if that is under the floor set by SetMinReplicas.
+func (s *ChunkService) AchievedReplicas(ctx context.Context, fileID uuid.UUID) (int, error) {
+	chunks, err := s.store.ListChunks(ctx, fileID)
 	if err != nil {
-		return nil, err
+		return 0, fmt.Errorf("failed to list chunks: %w", err)
 	}
-
-	gcm, err := cipher.NewGCM(block)
+	assignments, err := s.store.ListFileAssignments(ctx, fileID)
 	if err != nil {
-		return nil, err
+		return 0, fmt.Errorf("failed to list assignments: %w", err)
+	}
+	replicas := make(map[uuid.UUID]int, len(chunks))
+	for _, a := range assignments {
+		replicas[a.ChunkID]++
 	}
 
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-		return nil, err
+	achieved := -1
+	for _, chunk := range chunks {
+		if achieved < 0 || replicas[chunk.ID] < achieved {
+			achieved = replicas[chunk.ID]
+		}
 	}
+	achieved = max(achieved, 0)
 
-	ciphertext := gcm.Seal(nonce, nonce, data, nil)
-	return ciphertext, nil
+	if achieved < s.minReplicas {
+		return achieved, fmt.Errorf("%w: %d of %d", ErrBelowReplicaFloor, achieved, s.minReplicas)
+	}
+	return achieved, nil
 }
 
-// DecryptChunk decrypts chunk data using AES-256-GCM
-func DecryptChunk(data []byte, key []byte) ([]byte, error) {
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, err
+// ErrInsufficientOperators is returned when replicas cannot be spread across
+// the required number of distinct operators
+var ErrInsufficientOperators = errors.New("not enough distinct operators")
+
+// operatorKey groups nodes by operator; nodes that did not report one are
+// treated as independently operated
+func operatorKey(node models.StorageNode) string {
+	if node.OperatorID == "" {
+		return "node:" + node.ID.String()
 	}
+	return "operator:" + node.OperatorID
+}
 
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return nil, err
+// PlaceReplicas picks replicaCount nodes, taking at most one node per operator
+// before doubling up on any operator. Nodes are otherwise taken in order.
+// It fails if the picked nodes span fewer than minOperators operators.
+func PlaceReplicas(nodes []models.StorageNode, replicaCount, minOperators int) ([]models.StorageNode, error) {
+	if len(nodes) < replicaCount {
+		return nil, fmt.Errorf("not enough active nodes (%d available, %d required)", len(nodes), replicaCount)
 	}
 
-	nonceSize := gcm.NonceSize()
-	if len(data) < nonceSize {
-		return nil, fmt.Errorf("ciphertext too short")
+	selected := make([]models.StorageNode, 0, replicaCount)
+	picked := make([]bool, len(nodes))
+	operators := make(map[string]bool)
+	for i, node := range nodes {
+		if len(selected) == replicaCount {
+			break
+		}
+		if key := operatorKey(node); !operators[key] {
+			operators[key] = true
+			picked[i] = true
+			selected = append(selected, node)
+		}
 	}
+	distinct := len(selected)
 
-	nonce, ciphertext := data[:nonceSize], data[nonceSize:]
-	return gcm.Open(nil, nonce, ciphertext, nil)
+	// Not enough operators to go around: fill up from those already used
+	for i, node := range nodes {
+		if len(selected) == replicaCount {
+			break
+		}
+		if !picked[i] {
+			selected = append(selected, node)
+		}
+	}
+
+	required := min(minOperators, replicaCount)
+	if distinct < required {
+		return nil, fmt.Errorf("%w (%d available, %d required)", ErrInsufficientOperators, distinct, required)
+	}
+	return selected, nil
+}
+
+// EncryptChunk encrypts chunk data with DefaultCipher into a chunk with a
+// current header and no flags. A key that is not 32 bytes is refused with
+// ErrInvalidKeySize.
+func EncryptChunk(data []byte, key []byte) ([]byte, error) {
+	return SealChunk(DefaultCipher, data, key, 0)
+}
+
+// DecryptChunk decrypts chunk data with DefaultCipher, with or without a
+// header. A key that is not 32 bytes is refused with ErrInvalidKeySize.
+func DecryptChunk(data []byte, key []byte) ([]byte, error) {
+	return OpenChunk(DefaultCipher, data, key)
 }
@@ -0,0 +1,101 @@
+package services
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// ChunkCache is a thread-safe LRU of encrypted chunk data keyed by chunk ID,
+// bounded by the total bytes it holds. Entries remember the chunk hash they
+// were cached under, so data rewritten in place (e.g. by key rotation) is
+// never served stale.
+type ChunkCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	size     int64
+	order    *list.List // front is most recently used
+	entries  map[uuid.UUID]*list.Element
+}
+
+type chunkCacheEntry struct {
+	chunkID uuid.UUID
+	fileID  uuid.UUID
+	hash    string
+	data    []byte
+}
+
+// NewChunkCache creates a cache holding at most maxBytes of chunk data
+func NewChunkCache(maxBytes int64) *ChunkCache {
+	return &ChunkCache{
+		maxBytes: maxBytes,
+		order:    list.New(),
+		entries:  make(map[uuid.UUID]*list.Element),
+	}
+}
+
+// Get returns a chunk's data if it is cached under the given hash
+func (c *ChunkCache) Get(chunkID uuid.UUID, hash string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[chunkID]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*chunkCacheEntry)
+	if entry.hash != hash {
+		c.removeElement(el)
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return entry.data, true
+}
+
+// Put caches a chunk's data, evicting the least recently used chunks to stay under the size cap
+func (c *ChunkCache) Put(fileID, chunkID uuid.UUID, hash string, data []byte) {
+	size := int64(len(data))
+	if size > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[chunkID]; ok {
+		c.removeElement(el)
+	}
+	for c.size+size > c.maxBytes {
+		c.removeElement(c.order.Back())
+	}
+	c.entries[chunkID] = c.order.PushFront(&chunkCacheEntry{chunkID: chunkID, fileID: fileID, hash: hash, data: data})
+	c.size += size
+}
+
+// RemoveFile drops every cached chunk of a file
+func (c *ChunkCache) RemoveFile(fileID uuid.UUID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for el := c.order.Front(); el != nil; {
+		next := el.Next()
+		if el.Value.(*chunkCacheEntry).fileID == fileID {
+			c.removeElement(el)
+		}
+		el = next
+	}
+}
+
+// Size returns the number of bytes currently cached
+func (c *ChunkCache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+func (c *ChunkCache) removeElement(el *list.Element) {
+	entry := c.order.Remove(el).(*chunkCacheEntry)
+	delete(c.entries, entry.chunkID)
+	c.size -= int64(len(entry.data))
+}
@@ -0,0 +1,95 @@
+package services
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/federated-storage/coordinator/internal/chunkformat"
+	"github.com/federated-storage/coordinator/internal/models"
+)
+
+// ErrUnsupportedChunk is returned for a chunk whose header has a version or
+// flags this coordinator does not know
+var ErrUnsupportedChunk = errors.New("unsupported chunk format")
+
+// SealChunk encrypts plaintext with c under key into a chunk with a current
+// header carrying flags, compressing the plaintext first if flags include
+// chunkformat.FlagCompressed. The header is authenticated along with the
+// data, so its flags can't be changed without the chunk failing to open.
+func SealChunk(c Cipher, plaintext, key []byte, flags byte) ([]byte, error) {
+	if err := c.CheckKey(key); err != nil {
+		return nil, err
+	}
+	if flags&^chunkformat.KnownFlags != 0 {
+		return nil, fmt.Errorf("%w: flags %#x", ErrUnsupportedChunk, flags)
+	}
+	if flags&chunkformat.FlagCompressed != 0 {
+		var buf bytes.Buffer
+		w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(plaintext); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		plaintext = buf.Bytes()
+	}
+
+	header := chunkformat.Header{Version: chunkformat.Current, Flags: flags}.Append(nil)
+	return c.seal(header, plaintext, key, header)
+}
+
+// OpenChunk decrypts a stored chunk of any format. A chunk without a header
+// is the cipher's sealed output alone, as every chunk was before headers
+// were written, and is opened as such.
+func OpenChunk(c Cipher, data, key []byte) ([]byte, error) {
+	if err := c.CheckKey(key); err != nil {
+		return nil, err
+	}
+	header, body, ok := chunkformat.Parse(data)
+	if !ok {
+		return c.Decrypt(data, key)
+	}
+	plaintext, err := openHeadered(c, header, data[:chunkformat.HeaderSize], body, key)
+	if err != nil {
+		// A legacy chunk whose random nonce happens to start like a header
+		if legacy, legacyErr := c.Decrypt(data, key); legacyErr == nil {
+			return legacy, nil
+		}
+		return nil, err
+	}
+	return plaintext, nil
+}
+
+func openHeadered(c Cipher, header chunkformat.Header, rawHeader, body, key []byte) ([]byte, error) {
+	if header.Version != chunkformat.V1 {
+		return nil, fmt.Errorf("%w: version %d", ErrUnsupportedChunk, header.Version)
+	}
+	if header.Flags&^chunkformat.KnownFlags != 0 {
+		return nil, fmt.Errorf("%w: flags %#x", ErrUnsupportedChunk, header.Flags)
+	}
+	plaintext, err := c.open(body, key, rawHeader)
+	if err != nil {
+		return nil, err
+	}
+	if header.Flags&chunkformat.FlagCompressed != 0 {
+		plaintext, err = io.ReadAll(flate.NewReader(bytes.NewReader(plaintext)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress chunk: %w", err)
+		}
+	}
+	return plaintext, nil
+}
+
+// PlaintextSize returns the size a chunk decrypts to, from its stored size
+// less the cipher's and the header's overhead. This does not hold for
+// compressed chunks, which is why nothing writes them yet.
+func PlaintextSize(c Cipher, chunk models.Chunk) int {
+	return chunk.SizeBytes - c.Overhead() - chunkformat.Overhead(chunk.Format)
+}
@@ -0,0 +1,164 @@
+package services
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Cipher names the AEAD a file's chunks are encrypted with. It is chosen when
+// an upload starts and stored with the file, so changing the configured cipher
+// never affects files already stored.
+type Cipher string
+
+// Supported ciphers
+const (
+	CipherAES256GCM        Cipher = "aes-256-gcm"
+	CipherAES128GCM        Cipher = "aes-128-gcm"
+	CipherChaCha20Poly1305 Cipher = "chacha20-poly1305" // faster than AES on CPUs without AES instructions
+)
+
+// DefaultCipher is used when none is configured, and for files stored before
+// the cipher was recorded
+const DefaultCipher = CipherAES256GCM
+
+// ErrUnknownCipher is returned for a cipher name that is not supported
+var ErrUnknownCipher = errors.New("unknown cipher")
+
+// ErrInvalidKeySize is returned when a key does not match its cipher's key size
+var ErrInvalidKeySize = errors.New("invalid encryption key size")
+
+// ParseCipher validates a cipher name; an empty name is DefaultCipher
+func ParseCipher(name string) (Cipher, error) {
+	c := Cipher(name)
+	if c == "" {
+		return DefaultCipher, nil
+	}
+	if c.KeySize() == 0 {
+		return "", fmt.Errorf("%w %q (supported: %s, %s, %s)", ErrUnknownCipher, name,
+			CipherAES256GCM, CipherAES128GCM, CipherChaCha20Poly1305)
+	}
+	return c, nil
+}
+
+// KeySize returns the key length the cipher needs in bytes, or 0 if it is unknown
+func (c Cipher) KeySize() int {
+	switch c.orDefault() {
+	case CipherAES256GCM:
+		return 32
+	case CipherAES128GCM:
+		return 16
+	case CipherChaCha20Poly1305:
+		return chacha20poly1305.KeySize
+	default:
+		return 0
+	}
+}
+
+// NewKey generates a random key of the cipher's size
+func (c Cipher) NewKey() ([]byte, error) {
+	size := c.KeySize()
+	if size == 0 {
+		return nil, fmt.Errorf("%w %q", ErrUnknownCipher, string(c))
+	}
+	key := make([]byte, size)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate encryption key: %w", err)
+	}
+	return key, nil
+}
+
+// Encrypt seals data under key, prefixing the random nonce
+func (c Cipher) Encrypt(data, key []byte) ([]byte, error) {
+	return c.seal(nil, data, key, nil)
+}
+
+// Decrypt opens data produced by Encrypt with the same cipher and key
+func (c Cipher) Decrypt(data, key []byte) ([]byte, error) {
+	return c.open(data, key, nil)
+}
+
+// seal appends the random nonce and the sealed data to dst, authenticating
+// additionalData along with it
+func (c Cipher) seal(dst, data, key, additionalData []byte) ([]byte, error) {
+	aead, err := c.aead(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(append(dst, nonce...), nonce, data, additionalData), nil
+}
+
+// open opens the nonce-prefixed output of seal given the same additionalData
+func (c Cipher) open(data, key, additionalData []byte) ([]byte, error) {
+	aead, err := c.aead(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonceSize := aead.NonceSize()
+	if len(data) < nonceSize {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+
+	nonce, ciphertext := data[:nonceSize], data[nonceSize:]
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
+
+// Overhead returns how many bytes Encrypt adds to its input: the nonce and
+// the authentication tag. It is 0 for an unknown cipher.
+func (c Cipher) Overhead() int {
+	aead, err := c.aead(make([]byte, c.KeySize()))
+	if err != nil {
+		return 0
+	}
+	return aead.NonceSize() + aead.Overhead()
+}
+
+func (c Cipher) orDefault() Cipher {
+	if c == "" {
+		return DefaultCipher
+	}
+	return c
+}
+
+// CheckKey returns ErrInvalidKeySize, naming the size needed, unless key is
+// exactly the cipher's key size. AES would accept a 16- or 24-byte key for
+// aes-256-gcm and quietly encrypt with a weaker variant.
+func (c Cipher) CheckKey(key []byte) error {
+	size := c.KeySize()
+	if size == 0 {
+		return fmt.Errorf("%w %q", ErrUnknownCipher, string(c))
+	}
+	if len(key) != size {
+		return fmt.Errorf("%w: %s needs a %d-byte key, got %d bytes", ErrInvalidKeySize, c.orDefault(), size, len(key))
+	}
+	return nil
+}
+
+// aead builds the cipher for key, rejecting a key of the wrong size up front
+// rather than leaving it to the underlying library's less helpful error
+func (c Cipher) aead(key []byte) (cipher.AEAD, error) {
+	if err := c.CheckKey(key); err != nil {
+		return nil, err
+	}
+
+	if c.orDefault() == CipherChaCha20Poly1305 {
+		return chacha20poly1305.New(key)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,146 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/federated-storage/coordinator/internal/models"
+	"github.com/federated-storage/coordinator/internal/storage"
+	"github.com/google/uuid"
+)
+
+// ErrNotDecommissioning is returned for decommission steps by a node that has not started decommissioning
+var ErrNotDecommissioning = errors.New("node is not decommissioning")
+
+// ErrUnknownChunk is returned when a node migrates a chunk the coordinator has no record of
+var ErrUnknownChunk = errors.New("unknown chunk")
+
+// ErrChunkDataMismatch is returned when data sent for a chunk does not match its recorded hash
+var ErrChunkDataMismatch = errors.New("chunk data does not match its hash")
+
+// ErrReplicationIncomplete is returned when a chunk could not be given enough replicas elsewhere
+var ErrReplicationIncomplete = errors.New("chunk could not be fully re-replicated")
+
+// StartDecommission takes a node out of placement, proof challenges and
+// reads for good, while still letting it authenticate to migrate its chunks
+func (s *NodeService) StartDecommission(ctx context.Context, nodeID uuid.UUID) error {
+	tag, err := s.db.Pool.Exec(ctx,
+		"UPDATE storage_nodes SET status = 'decommissioning', updated_at = $1 WHERE id = $2 AND status IN ('active', 'decommissioning')",
+		time.Now(), nodeID)
+	if err != nil {
+		return fmt.Errorf("failed to start decommission: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("node not found")
+	}
+	return nil
+}
+
+// Deregister retires a decommissioning node; its API key stops working
+func (s *NodeService) Deregister(ctx context.Context, nodeID uuid.UUID) error {
+	tag, err := s.db.Pool.Exec(ctx,
+		"UPDATE storage_nodes SET status = 'deregistered', updated_at = $1 WHERE id = $2 AND status = 'decommissioning'",
+		time.Now(), nodeID)
+	if err != nil {
+		return fmt.Errorf("failed to deregister node: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotDecommissioning
+	}
+	return nil
+}
+
+// ListNodeChunks returns the chunks actively assigned to a node
+func (s *ChunkService) ListNodeChunks(ctx context.Context, nodeID uuid.UUID) ([]models.Chunk, error) {
+	return s.store.ListNodeChunks(ctx, nodeID)
+}
+
+// MigrateResult reports a chunk handed off by a decommissioning node
+type MigrateResult struct {
+	ChunkID  uuid.UUID `json:"chunk_id"`
+	Replicas int       `json:"replicas"` // verified replicas now held by other nodes
+	Copied   int       `json:"copied"`   // of which were created for this migration
+}
+
+// replicaTargets returns the nodes that do not already hold a chunk and have
+// room for size more bytes, least utilized first
+func replicaTargets(nodes []models.StorageNode, holders map[uuid.UUID]bool, size int64) []models.StorageNode {
+	var targets []models.StorageNode
+	for _, n := range nodes {
+		if !holders[n.ID] && n.TotalStorageBytes > 0 && n.UsedStorageBytes+size <= n.TotalStorageBytes {
+			targets = append(targets, n)
+		}
+	}
+	util := func(n models.StorageNode) float64 {
+		return float64(n.UsedStorageBytes) / float64(n.TotalStorageBytes)
+	}
+	sort.SliceStable(targets, func(i, j int) bool { return util(targets[i]) < util(targets[j]) })
+	return targets
+}
+
+// MigrateChunk takes over one chunk from a decommissioning node. The data the
+// node sent must match the chunk's hash; it is copied to other nodes until
+// replicas of them hold verified copies, and only then is the node's replica
+// retired, so the node may delete its copy once this returns without error.
+func (s *ChunkService) MigrateChunk(ctx context.Context, transfer ChunkTransfer, nodeID, chunkID uuid.UUID, data []byte, replicas int) (*MigrateResult, error) {
+	chunk, _, err := s.store.GetChunk(ctx, chunkID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownChunk, chunkID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load chunk: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != chunk.Hash {
+		return nil, fmt.Errorf("%w: chunk %s", ErrChunkDataMismatch, chunkID)
+	}
+
+	assignments, err := s.store.ListChunkAssignments(ctx, chunkID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list assignments: %w", err)
+	}
+	holders := map[uuid.UUID]bool{nodeID: true}
+	result := &MigrateResult{ChunkID: chunkID}
+	for _, a := range assignments {
+		if a.NodeID != nodeID {
+			holders[a.NodeID] = true
+			result.Replicas++
+		}
+	}
+
+	if result.Replicas < replicas {
+		nodes, err := s.nodeService.GetAllNodes(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list nodes: %w", err)
+		}
+		if nodes, err = s.excludeListed(ctx, nodes); err != nil {
+			return nil, err
+		}
+		nodes = ExcludeDraining(nodes, time.Now(), s.maintenanceLead)
+		// Later targets stand in for any whose copy fails verification
+		for _, target := range replicaTargets(nodes, holders, int64(chunk.SizeBytes)) {
+			if result.Replicas >= replicas {
+				break
+			}
+			move := ChunkMove{ChunkID: chunkID, SizeBytes: chunk.SizeBytes, FromNodeID: nodeID, ToNodeID: target.ID, ToPeerID: target.PeerID}
+			if err := s.copyChunkData(ctx, transfer, move, chunk.Hash, data); err != nil {
+				continue
+			}
+			result.Replicas++
+			result.Copied++
+		}
+	}
+	if result.Replicas < replicas {
+		return nil, fmt.Errorf("%w: %d of %d replicas placed", ErrReplicationIncomplete, result.Replicas, replicas)
+	}
+
+	if err := s.store.SetChunkAssignment(ctx, chunkID, nodeID, "retired"); err != nil {
+		return nil, fmt.Errorf("failed to retire assignment: %w", err)
+	}
+	return result, nil
+}
@@ -0,0 +1,75 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/federated-storage/coordinator/internal/models"
+)
+
+// dedupReportGroups is how many of the most wasteful duplicate groups a report lists
+const dedupReportGroups = 10
+
+// DedupReport estimates what deduplicating files with identical plaintext
+// would reclaim. Sizes count one copy of each file, before replication.
+// Files completed without a recorded plaintext hash can't be compared and
+// are only counted in UnhashedFiles.
+type DedupReport struct {
+	TotalFiles      int                       `json:"total_files"`
+	UniqueFiles     int                       `json:"unique_files"`
+	UnhashedFiles   int                       `json:"unhashed_files"`
+	DuplicateGroups int                       `json:"duplicate_groups"` // hashes held by more than one file
+	TotalBytes      int64                     `json:"total_bytes"`
+	UniqueBytes     int64                     `json:"unique_bytes"`
+	SavingsBytes    int64                     `json:"savings_bytes"`
+	SavingsPercent  float64                   `json:"savings_percent"`
+	TopGroups       []models.ContentHashGroup `json:"top_groups"` // largest savings first
+}
+
+// BuildDedupReport summarizes files grouped by plaintext hash
+func BuildDedupReport(groups []models.ContentHashGroup) *DedupReport {
+	report := &DedupReport{TopGroups: []models.ContentHashGroup{}}
+	var duplicates []models.ContentHashGroup
+	for _, g := range groups {
+		if g.Hash == "" {
+			report.UnhashedFiles += g.Files
+			continue
+		}
+		report.TotalFiles += g.Files
+		report.UniqueFiles++
+		report.TotalBytes += int64(g.Files) * g.SizeBytes
+		report.UniqueBytes += g.SizeBytes
+		if g.Files > 1 {
+			duplicates = append(duplicates, g)
+		}
+	}
+	report.DuplicateGroups = len(duplicates)
+	report.SavingsBytes = report.TotalBytes - report.UniqueBytes
+	if report.TotalBytes > 0 {
+		report.SavingsPercent = float64(report.SavingsBytes) / float64(report.TotalBytes) * 100
+	}
+
+	savings := func(g models.ContentHashGroup) int64 { return int64(g.Files-1) * g.SizeBytes }
+	sort.Slice(duplicates, func(i, j int) bool {
+		if savings(duplicates[i]) != savings(duplicates[j]) {
+			return savings(duplicates[i]) > savings(duplicates[j])
+		}
+		return duplicates[i].Hash < duplicates[j].Hash
+	})
+	if len(duplicates) > dedupReportGroups {
+		duplicates = duplicates[:dedupReportGroups]
+	}
+	report.TopGroups = append(report.TopGroups, duplicates...)
+	return report
+}
+
+// DedupReport groups ready files by plaintext hash and reports how much space
+// duplicates take
+func (s *ChunkService) DedupReport(ctx context.Context) (*DedupReport, error) {
+	groups, err := s.store.ListContentHashGroups(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to group files by content hash: %w", err)
+	}
+	return BuildDedupReport(groups), nil
+}
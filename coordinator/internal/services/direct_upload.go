@@ -0,0 +1,279 @@
+package services
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/federated-storage/coordinator/internal/models"
+	"github.com/google/uuid"
+)
+
+// DefaultStoreAuthorizationTTL is how long a client has to store a chunk on
+// its nodes and report it stored
+const DefaultStoreAuthorizationTTL = 15 * time.Minute
+
+// storeAuthorizationContext prefixes what is signed, so a store
+// authorization's signature can't be passed off as any other signature made
+// with the coordinator's key
+const storeAuthorizationContext = "federated-storage store authorization\n"
+
+// storeReceiptContext prefixes what a node signs in a store receipt; storage
+// nodes use the same value
+const storeReceiptContext = "federated-storage store receipt\n"
+
+// ErrDirectUploadsDisabled is returned when a direct upload is requested but not enabled
+var ErrDirectUploadsDisabled = errors.New("direct uploads are not enabled")
+
+// ErrInvalidStoreAuthorization is returned for a store authorization that is
+// malformed, forged, expired or for another session, chunk or content
+var ErrInvalidStoreAuthorization = errors.New("invalid store authorization")
+
+// ErrInvalidChunkHash is returned when a chunk hash is not a hex SHA-256 digest
+var ErrInvalidChunkHash = errors.New("chunk hash must be a hex SHA-256 digest")
+
+// ErrInvalidStoreReceipt is returned for a store receipt that is missing,
+// forged, from a node the authorization didn't name, or for other content
+var ErrInvalidStoreReceipt = errors.New("invalid store receipt")
+
+// Signer signs with the coordinator's P2P identity, so nodes can check a
+// signature against the coordinator peer ID they already trust
+type Signer interface {
+	Sign(data []byte) ([]byte, error)
+	Verify(data, signature []byte) (bool, error)
+}
+
+// PeerVerifier checks signatures made by other peers against the public key
+// their peer ID embeds
+type PeerVerifier interface {
+	VerifyPeer(peerID string, data, signature []byte) (bool, error)
+}
+
+// StoreReceipt is a node's signed statement that it stored a chunk, as the
+// node returns it to the client. The Merkle root is the node's own, computed
+// over what it stored.
+type StoreReceipt struct {
+	PeerID     string    `json:"peer_id"`
+	ChunkID    uuid.UUID `json:"chunk_id"`
+	Hash       string    `json:"hash"`
+	SizeBytes  int64     `json:"size_bytes"`
+	MerkleRoot string    `json:"merkle_root"`
+	Signature  []byte    `json:"signature"`
+}
+
+// StoreReceiptPayload is what a store receipt's signature covers
+func StoreReceiptPayload(chunkID uuid.UUID, hash string, sizeBytes int64, merkleRoot string) []byte {
+	return []byte(fmt.Sprintf("%s%s\n%s\n%d\n%s", storeReceiptContext, chunkID, hash, sizeBytes, merkleRoot))
+}
+
+// StoreAuthorization lets a client store one encrypted chunk directly on the
+// nodes chosen for it. It names the chunk and the exact content allowed, so a
+// node can refuse anything else.
+type StoreAuthorization struct {
+	SessionID  uuid.UUID   `json:"session_id"`
+	FileID     uuid.UUID   `json:"file_id"`
+	ChunkID    uuid.UUID   `json:"chunk_id"`
+	ChunkIndex int         `json:"chunk_index"`
+	Hash       string      `json:"hash"`       // hex SHA-256 of the encrypted chunk
+	SizeBytes  int64       `json:"size_bytes"` // of the encrypted chunk
+	NodeIDs    []uuid.UUID `json:"node_ids"`
+	PeerIDs    []string    `json:"peer_ids"` // the nodes that may accept the chunk, in NodeIDs order
+	ExpiresAt  time.Time   `json:"expires_at"`
+}
+
+// validChunkHash reports whether hash is a lowercase hex SHA-256 digest, the
+// form chunk hashes are recorded in
+func validChunkHash(hash string) bool {
+	if len(hash) != 64 || strings.ToLower(hash) != hash {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
+// SignStoreAuthorization encodes auth as a token: its JSON and the
+// signature over it, each base64url-encoded, joined by a dot
+func SignStoreAuthorization(signer Signer, auth *StoreAuthorization) (string, error) {
+	payload, err := json.Marshal(auth)
+	if err != nil {
+		return "", err
+	}
+	signature, err := signer.Sign(append([]byte(storeAuthorizationContext), payload...))
+	if err != nil {
+		return "", fmt.Errorf("failed to sign store authorization: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// ParseStoreAuthorization checks a token's signature and expiry and returns
+// the authorization it carries
+func ParseStoreAuthorization(signer Signer, token string, now time.Time) (*StoreAuthorization, error) {
+	encodedPayload, encodedSignature, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, fmt.Errorf("%w: malformed token", ErrInvalidStoreAuthorization)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed token", ErrInvalidStoreAuthorization)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(encodedSignature)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed token", ErrInvalidStoreAuthorization)
+	}
+
+	valid, err := signer.Verify(append([]byte(storeAuthorizationContext), payload...), signature)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify store authorization: %w", err)
+	}
+	if !valid {
+		return nil, fmt.Errorf("%w: bad signature", ErrInvalidStoreAuthorization)
+	}
+
+	var auth StoreAuthorization
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&auth); err != nil {
+		return nil, fmt.Errorf("%w: malformed payload", ErrInvalidStoreAuthorization)
+	}
+	if !now.Before(auth.ExpiresAt) {
+		return nil, fmt.Errorf("%w: expired at %s", ErrInvalidStoreAuthorization, auth.ExpiresAt.Format(time.RFC3339))
+	}
+	return &auth, nil
+}
+
+// SetDirectUploads lets sessions send their chunks straight to the storage
+// nodes, under store authorizations signed by signer and valid for ttl, and
+// have peers check the receipts nodes sign for them. A nil signer disables
+// direct uploads.
+func (s *UploadService) SetDirectUploads(signer Signer, peers PeerVerifier, ttl time.Duration) {
+	s.signer = signer
+	s.peers = peers
+	s.storeAuthorizationTTL = ttl
+}
+
+// DirectUploads reports whether sessions may send chunks straight to the nodes
+func (s *UploadService) DirectUploads() bool {
+	return s.signer != nil
+}
+
+// CheckDirectChunk validates the encrypted chunk a direct session is about
+// to store at index, given its hash and size
+func (s *UploadService) CheckDirectChunk(session *UploadSession, index int, hash string, sizeBytes int64) error {
+	if !session.Direct || s.signer == nil {
+		return ErrDirectUploadsDisabled
+	}
+	if !validChunkHash(hash) {
+		return ErrInvalidChunkHash
+	}
+	// The session's chunk sizes are of the plaintext
+	return s.CheckChunk(session, index, sizeBytes-int64(Cipher(session.Cipher).Overhead()))
+}
+
+// AuthorizeChunkStore checks the encrypted chunk a direct session is about to
+// store at index, hash and sizeBytes, and returns a token authorizing nodes to
+// accept exactly that chunk along with the authorization it carries
+func (s *UploadService) AuthorizeChunkStore(session *UploadSession, fileID uuid.UUID, index int, hash string, sizeBytes int64, nodes []models.StorageNode) (string, *StoreAuthorization, error) {
+	if err := s.CheckDirectChunk(session, index, hash, sizeBytes); err != nil {
+		return "", nil, err
+	}
+
+	auth := &StoreAuthorization{
+		SessionID:  session.ID,
+		FileID:     fileID,
+		ChunkID:    uuid.New(),
+		ChunkIndex: index,
+		Hash:       hash,
+		SizeBytes:  sizeBytes,
+		NodeIDs:    make([]uuid.UUID, len(nodes)),
+		PeerIDs:    make([]string, len(nodes)),
+		ExpiresAt:  time.Now().Add(s.storeAuthorizationTTL).UTC(),
+	}
+	for i, node := range nodes {
+		auth.NodeIDs[i] = node.ID
+		auth.PeerIDs[i] = node.PeerID
+	}
+
+	token, err := SignStoreAuthorization(s.signer, auth)
+	if err != nil {
+		return "", nil, err
+	}
+	return token, auth, nil
+}
+
+// VerifyChunkStored checks the token a direct session's client presents once
+// it has stored a chunk, which must be unexpired and issued for this session
+// and its file, and the receipts the nodes signed for it. Each receipt must
+// come from a node the token named, for the chunk and content it named, and
+// all must agree on the Merkle root. It returns the chunk to record, without
+// data, and the nodes whose receipts were presented; nodes without one are
+// not recorded as holding the chunk.
+func (s *UploadService) VerifyChunkStored(session *UploadSession, token string, receipts []StoreReceipt, now time.Time) (*StoreAuthorization, *models.Chunk, []uuid.UUID, error) {
+	if !session.Direct || s.signer == nil {
+		return nil, nil, nil, ErrDirectUploadsDisabled
+	}
+	auth, err := ParseStoreAuthorization(s.signer, token, now)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if auth.SessionID != session.ID || session.FileID == nil || auth.FileID != *session.FileID {
+		return nil, nil, nil, fmt.Errorf("%w: issued for another upload", ErrInvalidStoreAuthorization)
+	}
+	if len(receipts) == 0 {
+		return nil, nil, nil, fmt.Errorf("%w: no node has acknowledged the chunk", ErrInvalidStoreReceipt)
+	}
+
+	nodeIDs := make([]uuid.UUID, 0, len(receipts))
+	merkleRoot := receipts[0].MerkleRoot
+	for _, receipt := range receipts {
+		nodeID, err := s.verifyStoreReceipt(auth, receipt)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if slices.Contains(nodeIDs, nodeID) {
+			return nil, nil, nil, fmt.Errorf("%w: two receipts from %s", ErrInvalidStoreReceipt, receipt.PeerID)
+		}
+		if receipt.MerkleRoot != merkleRoot {
+			return nil, nil, nil, fmt.Errorf("%w: nodes disagree on the chunk's Merkle root", ErrInvalidStoreReceipt)
+		}
+		nodeIDs = append(nodeIDs, nodeID)
+	}
+
+	chunk := &models.Chunk{
+		ID:         auth.ChunkID,
+		FileID:     auth.FileID,
+		ChunkIndex: auth.ChunkIndex,
+		Hash:       auth.Hash,
+		SizeBytes:  int(auth.SizeBytes),
+		MerkleRoot: merkleRoot,
+	}
+	return auth, chunk, nodeIDs, nil
+}
+
+// verifyStoreReceipt checks a receipt against the authorization it answers
+// and returns the ID of the node that signed it
+func (s *UploadService) verifyStoreReceipt(auth *StoreAuthorization, receipt StoreReceipt) (uuid.UUID, error) {
+	i := slices.Index(auth.PeerIDs, receipt.PeerID)
+	if i < 0 {
+		return uuid.Nil, fmt.Errorf("%w: %s was not authorized to store chunk %d", ErrInvalidStoreReceipt, receipt.PeerID, auth.ChunkIndex)
+	}
+	if receipt.ChunkID != auth.ChunkID || receipt.Hash != auth.Hash || receipt.SizeBytes != auth.SizeBytes {
+		return uuid.Nil, fmt.Errorf("%w: %s stored other content than chunk %d was authorized for", ErrInvalidStoreReceipt, receipt.PeerID, auth.ChunkIndex)
+	}
+	if !validChunkHash(receipt.MerkleRoot) {
+		return uuid.Nil, fmt.Errorf("%w: merkle_root must be a hex SHA-256 digest", ErrInvalidStoreReceipt)
+	}
+	if s.peers == nil {
+		return uuid.Nil, fmt.Errorf("%w: receipts can't be checked", ErrInvalidStoreReceipt)
+	}
+	valid, err := s.peers.VerifyPeer(receipt.PeerID, StoreReceiptPayload(receipt.ChunkID, receipt.Hash, receipt.SizeBytes, receipt.MerkleRoot), receipt.Signature)
+	if err != nil || !valid {
+		return uuid.Nil, fmt.Errorf("%w: bad signature from %s", ErrInvalidStoreReceipt, receipt.PeerID)
+	}
+	return auth.NodeIDs[i], nil
+}
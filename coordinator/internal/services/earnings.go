@@ -0,0 +1,100 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/federated-storage/coordinator/internal/models"
+	"github.com/google/uuid"
+)
+
+// EarningsRates price a node's day of storage
+type EarningsRates struct {
+	// CreditsPerGBMonth is paid for each GB a node stores, per month
+	CreditsPerGBMonth int64
+	// MissedProofPenalty is withheld for each missed proof that counts,
+	// those past the node's missed-proof grace
+	MissedProofPenalty int64
+}
+
+// SetEarningsRates sets what nodes earn for storage and lose for missed proofs
+func (s *NodeService) SetEarningsRates(rates EarningsRates) {
+	s.earningsRates = rates
+}
+
+// dailyEarnings prices one day of storing storageBytes, less the penalty
+// for missed proofs. A day never earns less than nothing.
+func dailyEarnings(storageBytes int64, missed int, rates EarningsRates) (storage, penalty, total int64) {
+	storage = storageBytes * rates.CreditsPerGBMonth / (30 * 1024 * 1024 * 1024)
+	penalty = int64(missed) * max(rates.MissedProofPenalty, 0)
+	return storage, penalty, max(storage-penalty, 0)
+}
+
+// RecordDailyEarnings credits every active node for the UTC day containing
+// day: storage at its current usage, less the penalty for proofs it missed
+// that day. Misses forgiven under the grace cost nothing. A node already
+// credited for the day is skipped, so a missed or repeated run is harmless.
+// It returns how many nodes were credited.
+func (s *NodeService) RecordDailyEarnings(ctx context.Context, day time.Time) (int, error) {
+	nodes, err := s.GetAllNodes(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list nodes: %w", err)
+	}
+
+	date := day.UTC().Truncate(24 * time.Hour)
+	credited := 0
+	var errs []error
+	for _, node := range nodes {
+		if node.Status != "active" {
+			continue
+		}
+		ok, err := s.recordEarnings(ctx, node, date)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("node %s: %w", node.ID, err))
+			continue
+		}
+		if ok {
+			credited++
+		}
+	}
+	return credited, errors.Join(errs...)
+}
+
+// recordEarnings credits node for date, reporting false if it already was
+func (s *NodeService) recordEarnings(ctx context.Context, node models.StorageNode, date time.Time) (bool, error) {
+	tx, err := s.db.Pool.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	var missed int
+	err = tx.QueryRow(ctx,
+		`SELECT COUNT(*) FROM proof_challenges
+		 WHERE node_id = $1 AND status = 'failed' AND proof_hash IS NULL AND verified_at >= $2 AND verified_at < $3`,
+		node.ID, date, date.Add(24*time.Hour)).Scan(&missed)
+	if err != nil {
+		return false, fmt.Errorf("failed to count missed proofs: %w", err)
+	}
+
+	storage, penalty, total := dailyEarnings(node.UsedStorageBytes, missed, s.earningsRates)
+	tag, err := tx.Exec(ctx,
+		`INSERT INTO node_earnings (id, node_id, date, storage_bytes, storage_credits, missed_proof_penalty, total_earnings)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7)
+		 ON CONFLICT (node_id, date) DO NOTHING`,
+		uuid.New(), node.ID, date, node.UsedStorageBytes, storage, penalty, total)
+	if err != nil {
+		return false, fmt.Errorf("failed to record earnings: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return false, nil
+	}
+	if _, err := tx.Exec(ctx,
+		"UPDATE storage_nodes SET earned_credits = earned_credits + $1 WHERE id = $2",
+		total, node.ID); err != nil {
+		return false, fmt.Errorf("failed to credit earnings: %w", err)
+	}
+	return true, tx.Commit(ctx)
+}
@@ -0,0 +1,61 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/federated-storage/coordinator/internal/models"
+	"github.com/federated-storage/coordinator/internal/storage"
+)
+
+// ErrExclusionNotFound is returned when lifting an exclusion that does not exist
+var ErrExclusionNotFound = errors.New("node is not excluded")
+
+// ExcludeNode keeps the node with peerID out of new chunk placements until
+// IncludeNode lifts it. Its status is untouched: it keeps heartbeating,
+// serving the chunks it holds and answering proofs. Excluding a peer again
+// replaces the reason.
+func (s *ChunkService) ExcludeNode(ctx context.Context, peerID, reason string) (*models.NodeExclusion, error) {
+	exclusion := &models.NodeExclusion{PeerID: peerID, Reason: reason}
+	if err := s.store.AddNodeExclusion(ctx, exclusion); err != nil {
+		return nil, fmt.Errorf("failed to exclude node: %w", err)
+	}
+	return exclusion, nil
+}
+
+// IncludeNode lifts a node's exclusion
+func (s *ChunkService) IncludeNode(ctx context.Context, peerID string) error {
+	err := s.store.RemoveNodeExclusion(ctx, peerID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return ErrExclusionNotFound
+	}
+	return err
+}
+
+// ListExcludedNodes returns the nodes kept out of placement, oldest exclusion first
+func (s *ChunkService) ListExcludedNodes(ctx context.Context) ([]models.NodeExclusion, error) {
+	return s.store.ListNodeExclusions(ctx)
+}
+
+// excludeListed drops the nodes operators have excluded from placement
+func (s *ChunkService) excludeListed(ctx context.Context, nodes []models.StorageNode) ([]models.StorageNode, error) {
+	exclusions, err := s.store.ListNodeExclusions(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list node exclusions: %w", err)
+	}
+	if len(exclusions) == 0 {
+		return nodes, nil
+	}
+	excluded := make(map[string]bool, len(exclusions))
+	for _, e := range exclusions {
+		excluded[e.PeerID] = true
+	}
+	eligible := make([]models.StorageNode, 0, len(nodes))
+	for _, n := range nodes {
+		if !excluded[n.PeerID] {
+			eligible = append(eligible, n)
+		}
+	}
+	return eligible, nil
+}
@@ -2,107 +2,695 @@ package services
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"mime"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/federated-storage/coordinator/internal/models"
 	"github.com/federated-storage/coordinator/internal/storage"
 	"github.com/google/uuid"
 )
 
+// Tag limits per file
+const (
+	MaxTagsPerFile = 20
+	MaxTagLength   = 32
+)
+
+// ErrInvalidTag is returned when a tag is empty, too long or would exceed the per-file limit
+var ErrInvalidTag = errors.New("invalid tag")
+
+// ErrTagNotFound is returned when removing a tag the file does not have
+var ErrTagNotFound = errors.New("tag not found")
+
+// MaxFilenameLength is the longest filename accepted, in bytes
+const MaxFilenameLength = 255
+
+// ErrInvalidFilename is returned for a filename that is empty, too long, not
+// UTF-8 or contains control characters
+var ErrInvalidFilename = errors.New("invalid filename")
+
+// ValidateFilename rejects filenames that could not be safely echoed back in
+// a Content-Disposition header
+func ValidateFilename(name string) error {
+	switch {
+	case strings.TrimSpace(name) == "":
+		return fmt.Errorf("%w: filename is empty", ErrInvalidFilename)
+	case len(name) > MaxFilenameLength:
+		return fmt.Errorf("%w: filename is longer than %d bytes", ErrInvalidFilename, MaxFilenameLength)
+	case !utf8.ValidString(name):
+		return fmt.Errorf("%w: filename is not valid UTF-8", ErrInvalidFilename)
+	case strings.IndexFunc(name, unicode.IsControl) >= 0:
+		return fmt.Errorf("%w: filename contains control characters", ErrInvalidFilename)
+	}
+	return nil
+}
+
+// DefaultMimeType is served for files stored without a usable MIME type
+const DefaultMimeType = "application/octet-stream"
+
+// ErrFileBusy is returned when a file is locked by another operation (e.g. key rotation)
+var ErrFileBusy = errors.New("file is busy")
+
+// ErrRotationUnsupported is returned when rotating the key of a file whose
+// chunks only its nodes hold, as direct uploads leave them: the coordinator
+// has no ciphertext of its own to re-encrypt
+var ErrRotationUnsupported = errors.New("key rotation unsupported for files stored only on nodes")
+
+// StoragePeriod is the span of storage one upload payment covers
+const StoragePeriod = 30 * 24 * time.Hour
+
 // FileService handles file operations
 type FileService struct {
-	db            *storage.DB
-	chunkSize     int64
-	storageCredit int64 // credits per GB per month
+	store           storage.Store
+	chunkSize       int64
+	storageCredit   int64  // credits per GB per month
+	defaultMimeType string // served for files stored without a MIME type
+	webhooks        *WebhookService
+	keys            KeyProvider
 }
 
 // NewFileService creates a new file service
-func NewFileService(db *storage.DB, chunkSize int64, storageCredit int64) *FileService {
+func NewFileService(store storage.Store, chunkSize int64, storageCredit int64) *FileService {
 	return &FileService{
-		db:            db,
-		chunkSize:     chunkSize,
-		storageCredit: storageCredit,
+		store:           store,
+		chunkSize:       chunkSize,
+		storageCredit:   storageCredit,
+		defaultMimeType: DefaultMimeType,
+		keys:            RandomKeys{},
+	}
+}
+
+// SetKeyProvider chooses how new files are keyed and stored keys are found
+func (s *FileService) SetKeyProvider(keys KeyProvider) {
+	s.keys = keys
+}
+
+// FileKey returns the key a file's chunks are encrypted with
+func (s *FileService) FileKey(file *models.File) ([]byte, error) {
+	return s.keys.FileKey(Cipher(file.Cipher), file.ID, file.EncryptionKey)
+}
+
+// SetDefaultMimeType sets the Content-Type served for files stored without one
+func (s *FileService) SetDefaultMimeType(mimeType string) {
+	s.defaultMimeType = mimeType
+}
+
+// SetWebhooks notifies webhooks when uploads complete and files are deleted
+func (s *FileService) SetWebhooks(webhooks *WebhookService) {
+	s.webhooks = webhooks
+}
+
+// notify queues a file event for webhooks, if any are set. Webhooks are best
+// effort: one that can't be queued never fails the change it reports.
+func (s *FileService) notify(ctx context.Context, event string, file *models.File, reason string) {
+	if s.webhooks == nil {
+		return
+	}
+	_ = s.webhooks.Notify(ctx, event, &file.UserID, FileEvent{
+		FileID:    file.ID,
+		UserID:    file.UserID,
+		Filename:  file.Filename,
+		SizeBytes: file.SizeBytes,
+		Reason:    reason,
+	})
+}
+
+// ContentType returns the MIME type to serve a file with: the one recorded
+// at upload if it parses, otherwise the default
+func (s *FileService) ContentType(file *models.File) string {
+	if file.MimeType != "" {
+		if _, _, err := mime.ParseMediaType(file.MimeType); err == nil {
+			return file.MimeType
+		}
 	}
+	return s.defaultMimeType
 }
 
 // CreateFile creates a new file record
-func (s *FileService) CreateFile(ctx context.Context, userID uuid.UUID, filename string, sizeBytes int64, mimeType string, encryptionKey []byte, chunkCount int) (*models.File, error) {
+func (s *FileService) CreateFile(ctx context.Context, userID uuid.UUID, filename string, sizeBytes int64, mimeType string, encryptionKey []byte, cipher Cipher, chunkCount int) (*models.File, error) {
+	return s.createFile(ctx, uuid.New(), userID, filename, sizeBytes, mimeType, encryptionKey, cipher, chunkCount)
+}
+
+// CreateEncryptedFile creates a new file record keyed by the key provider,
+// returning the key to encrypt its chunks with
+func (s *FileService) CreateEncryptedFile(ctx context.Context, userID uuid.UUID, filename string, sizeBytes int64, mimeType string, cipher Cipher, chunkCount int) (*models.File, []byte, error) {
+	fileID := uuid.New()
+	key, store, err := s.keys.NewKey(cipher, fileID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := cipher.CheckKey(key); err != nil {
+		return nil, nil, fmt.Errorf("key provider returned an unusable key: %w", err)
+	}
+	stored := key
+	if !store {
+		stored = nil
+	}
+	file, err := s.createFile(ctx, fileID, userID, filename, sizeBytes, mimeType, stored, cipher, chunkCount)
+	if err != nil {
+		return nil, nil, err
+	}
+	return file, key, nil
+}
+
+// CreateSessionFile creates the record of the file an upload session's
+// chunks belong to. The file takes the session's ID, which the session's key
+// was made for, and the key the session stored, if any.
+func (s *FileService) CreateSessionFile(ctx context.Context, session *UploadSession) (*models.File, error) {
+	cipher := Cipher(session.Cipher)
+	if session.Versioned {
+		return s.createVersionedFile(ctx, session.ID, session.UserID, session.Filename, session.SizeBytes, "", session.EncryptionKey, cipher, session.ChunkCount)
+	}
+	return s.createFile(ctx, session.ID, session.UserID, session.Filename, session.SizeBytes, "", session.EncryptionKey, cipher, session.ChunkCount)
+}
+
+func (s *FileService) createFile(ctx context.Context, fileID, userID uuid.UUID, filename string, sizeBytes int64, mimeType string, encryptionKey []byte, cipher Cipher, chunkCount int) (*models.File, error) {
 	file := &models.File{
-		ID:            uuid.New(),
+		ID:            fileID,
 		UserID:        userID,
 		Filename:      filename,
 		SizeBytes:     sizeBytes,
 		MimeType:      mimeType,
 		EncryptionKey: encryptionKey,
+		Cipher:        string(cipher.orDefault()),
 		Status:        "uploading",
 		ChunkCount:    chunkCount,
+		Version:       1,
 	}
 
-	_, err := s.db.Pool.Exec(ctx,
-		`INSERT INTO files (id, user_id, filename, size_bytes, mime_type, encryption_key, status, chunk_count) 
-		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
-		file.ID, file.UserID, file.Filename, file.SizeBytes, file.MimeType,
-		file.EncryptionKey, file.Status, file.ChunkCount)
-	if err != nil {
+	if err := s.store.CreateFile(ctx, file); err != nil {
 		return nil, fmt.Errorf("failed to create file: %w", err)
 	}
 
 	return file, nil
 }
 
+// CreateVersionedFile creates a file record as the next version of the user's
+// latest file with the same name, or as version 1 if there is none
+func (s *FileService) CreateVersionedFile(ctx context.Context, userID uuid.UUID, filename string, sizeBytes int64, mimeType string, encryptionKey []byte, cipher Cipher, chunkCount int) (*models.File, error) {
+	return s.createVersionedFile(ctx, uuid.New(), userID, filename, sizeBytes, mimeType, encryptionKey, cipher, chunkCount)
+}
+
+func (s *FileService) createVersionedFile(ctx context.Context, fileID, userID uuid.UUID, filename string, sizeBytes int64, mimeType string, encryptionKey []byte, cipher Cipher, chunkCount int) (*models.File, error) {
+	latest, err := s.store.LatestFileByName(ctx, userID, filename)
+	if errors.Is(err, storage.ErrNotFound) {
+		return s.createFile(ctx, fileID, userID, filename, sizeBytes, mimeType, encryptionKey, cipher, chunkCount)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up previous version: %w", err)
+	}
+
+	rootID := latest.ID
+	if latest.ParentFileID != nil {
+		rootID = *latest.ParentFileID
+	}
+	file := &models.File{
+		ID:            fileID,
+		UserID:        userID,
+		Filename:      filename,
+		SizeBytes:     sizeBytes,
+		MimeType:      mimeType,
+		EncryptionKey: encryptionKey,
+		Cipher:        string(cipher.orDefault()),
+		Status:        "uploading",
+		ChunkCount:    chunkCount,
+		Version:       latest.Version + 1,
+		ParentFileID:  &rootID,
+	}
+
+	if err := s.store.CreateFile(ctx, file); err != nil {
+		return nil, fmt.Errorf("failed to create file version: %w", err)
+	}
+
+	return file, nil
+}
+
+// ListVersions returns every version in file's history, oldest first
+func (s *FileService) ListVersions(ctx context.Context, file *models.File) ([]models.File, error) {
+	rootID := file.ID
+	if file.ParentFileID != nil {
+		rootID = *file.ParentFileID
+	}
+	versions, err := s.store.ListFileVersions(ctx, rootID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list versions: %w", err)
+	}
+	return versions, nil
+}
+
+// ErrVersionNotFound is returned when a requested file version does not exist
+var ErrVersionNotFound = errors.New("version not found")
+
+// ResolveVersion returns the requested version of file's history: "" selects
+// file itself, "latest" the newest ready version, and a number that version
+func (s *FileService) ResolveVersion(ctx context.Context, file *models.File, version string) (*models.File, error) {
+	if version == "" {
+		return file, nil
+	}
+
+	versions, err := s.ListVersions(ctx, file)
+	if err != nil {
+		return nil, err
+	}
+
+	if version == "latest" {
+		for i := len(versions) - 1; i >= 0; i-- {
+			if versions[i].Status == "ready" {
+				return s.GetFile(ctx, versions[i].ID)
+			}
+		}
+		return nil, ErrVersionNotFound
+	}
+
+	n, err := strconv.Atoi(version)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %q", ErrVersionNotFound, version)
+	}
+	for _, v := range versions {
+		if v.Version == n {
+			return s.GetFile(ctx, v.ID)
+		}
+	}
+	return nil, ErrVersionNotFound
+}
+
 // GetFile retrieves a file by ID
 func (s *FileService) GetFile(ctx context.Context, fileID uuid.UUID) (*models.File, error) {
-	var file models.File
-	err := s.db.Pool.QueryRow(ctx,
-		`SELECT id, user_id, filename, size_bytes, mime_type, encryption_key, status, chunk_count, created_at, updated_at 
-		 FROM files WHERE id = $1`,
-		fileID).Scan(
-		&file.ID, &file.UserID, &file.Filename, &file.SizeBytes, &file.MimeType,
-		&file.EncryptionKey, &file.Status, &file.ChunkCount, &file.CreatedAt, &file.UpdatedAt)
+	file, err := s.store.GetFile(ctx, fileID)
 	if err != nil {
 		return nil, fmt.Errorf("file not found")
 	}
-	return &file, nil
+	return file, nil
 }
 
-// GetUserFiles retrieves all files for a user
-func (s *FileService) GetUserFiles(ctx context.Context, userID uuid.UUID) ([]models.File, error) {
-	rows, err := s.db.Pool.Query(ctx,
-		`SELECT id, user_id, filename, size_bytes, mime_type, status, chunk_count, created_at, updated_at 
-		 FROM files WHERE user_id = $1 ORDER BY created_at DESC`,
-		userID)
+// ErrFileModified is returned when a conditional change names a file revision that is no longer current
+var ErrFileModified = errors.New("file has been modified")
+
+// FileETag identifies a file's current revision; it changes whenever the file does
+func FileETag(file *models.File) string {
+	return `"r` + strconv.Itoa(file.Revision) + `"`
+}
+
+// ClaimRevision takes the file's revision as loaded for a conditional change.
+// Of several changes made against the same revision only the first succeeds;
+// the rest, and any made after another change, get ErrFileModified.
+func (s *FileService) ClaimRevision(ctx context.Context, file *models.File) error {
+	claimed, err := s.store.ClaimFileRevision(ctx, file.ID, file.Revision)
+	if err != nil {
+		return fmt.Errorf("failed to check file revision: %w", err)
+	}
+	if !claimed {
+		return ErrFileModified
+	}
+	return nil
+}
+
+// GetUserFiles retrieves all files for a user, optionally only those carrying every given tag
+func (s *FileService) GetUserFiles(ctx context.Context, userID uuid.UUID, tags []string) ([]models.File, error) {
+	return s.store.ListFilesByUser(ctx, userID, NormalizeTags(tags))
+}
+
+// NormalizeTags lowercases and trims tags, dropping empties and duplicates
+func NormalizeTags(tags []string) []string {
+	seen := make(map[string]bool, len(tags))
+	var out []string
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		out = append(out, tag)
+	}
+	return out
+}
+
+// CheckTags normalizes tags and returns them if AddTags would accept them
+// for the file, or an error wrapping ErrInvalidTag
+func (s *FileService) CheckTags(ctx context.Context, fileID uuid.UUID, tags []string) ([]string, error) {
+	tags = NormalizeTags(tags)
+	if len(tags) == 0 {
+		return nil, fmt.Errorf("%w: at least one non-empty tag is required", ErrInvalidTag)
+	}
+	for _, tag := range tags {
+		if len(tag) > MaxTagLength {
+			return nil, fmt.Errorf("%w: %q is longer than %d characters", ErrInvalidTag, tag, MaxTagLength)
+		}
+	}
+
+	existing, err := s.store.ListFileTags(ctx, fileID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load tags: %w", err)
+	}
+	if n := len(NormalizeTags(append(existing, tags...))); n > MaxTagsPerFile {
+		return nil, fmt.Errorf("%w: a file can have at most %d tags", ErrInvalidTag, MaxTagsPerFile)
+	}
+	return tags, nil
+}
+
+// AddTags tags a file and returns its full tag list
+func (s *FileService) AddTags(ctx context.Context, fileID uuid.UUID, tags []string) ([]string, error) {
+	tags, err := s.CheckTags(ctx, fileID, tags)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
+	if err := s.store.AddFileTags(ctx, fileID, tags); err != nil {
+		return nil, fmt.Errorf("failed to add tags: %w", err)
+	}
+	return s.store.ListFileTags(ctx, fileID)
+}
 
-	var files []models.File
-	for rows.Next() {
-		var f models.File
-		err := rows.Scan(
-			&f.ID, &f.UserID, &f.Filename, &f.SizeBytes, &f.MimeType,
-			&f.Status, &f.ChunkCount, &f.CreatedAt, &f.UpdatedAt)
-		if err != nil {
-			return nil, err
+// HasTag reports whether a file carries tag
+func (s *FileService) HasTag(ctx context.Context, fileID uuid.UUID, tag string) (bool, error) {
+	tags, err := s.store.ListFileTags(ctx, fileID)
+	if err != nil {
+		return false, fmt.Errorf("failed to load tags: %w", err)
+	}
+	return slices.Contains(tags, strings.ToLower(strings.TrimSpace(tag))), nil
+}
+
+// RemoveTag removes a tag from a file
+func (s *FileService) RemoveTag(ctx context.Context, fileID uuid.UUID, tag string) error {
+	err := s.store.RemoveFileTag(ctx, fileID, strings.ToLower(strings.TrimSpace(tag)))
+	if errors.Is(err, storage.ErrNotFound) {
+		return ErrTagNotFound
+	}
+	return err
+}
+
+// MissingChunks returns the indices in 0..chunkCount-1 that have no stored chunk, in order
+func (s *FileService) MissingChunks(ctx context.Context, fileID uuid.UUID, chunkCount int) ([]int, error) {
+	chunks, err := s.store.ListChunks(ctx, fileID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list chunks: %w", err)
+	}
+	stored := make(map[int]bool, len(chunks))
+	for _, chunk := range chunks {
+		stored[chunk.ChunkIndex] = true
+	}
+
+	missing := []int{}
+	for i := 0; i < chunkCount; i++ {
+		if !stored[i] {
+			missing = append(missing, i)
 		}
-		files = append(files, f)
 	}
-	return files, nil
+	return missing, nil
 }
 
-// MarkFileComplete marks a file as ready
+// MarkFileComplete records the file's plaintext hash and marks it ready.
+// A file whose chunks cannot be assembled is left without a hash; downloads
+// then compute it from the bytes they serve.
 func (s *FileService) MarkFileComplete(ctx context.Context, fileID uuid.UUID) error {
-	_, err := s.db.Pool.Exec(ctx,
-		"UPDATE files SET status = 'ready', updated_at = $1 WHERE id = $2",
-		time.Now(), fileID)
-	return err
+	if sum, err := s.plaintextHash(ctx, fileID); err == nil {
+		if err := s.store.SetFileContentHash(ctx, fileID, sum); err != nil {
+			return fmt.Errorf("failed to record content hash: %w", err)
+		}
+	}
+	if err := s.store.SetFileStatus(ctx, fileID, "ready"); err != nil {
+		return err
+	}
+	if s.webhooks != nil {
+		if file, err := s.store.GetFile(ctx, fileID); err == nil {
+			s.notify(ctx, EventFileUploaded, file, "")
+		}
+	}
+	return nil
+}
+
+// ReopenFile returns a file marked complete to "uploading", for a completion
+// that failed after the file was marked
+func (s *FileService) ReopenFile(ctx context.Context, fileID uuid.UUID) error {
+	return s.store.SetFileStatus(ctx, fileID, "uploading")
+}
+
+// SetReplicas records how many replicas a file was charged for
+func (s *FileService) SetReplicas(ctx context.Context, fileID uuid.UUID, replicas int) error {
+	return s.store.SetFileReplicas(ctx, fileID, replicas)
+}
+
+func (s *FileService) plaintextHash(ctx context.Context, fileID uuid.UUID) (string, error) {
+	file, err := s.store.GetFile(ctx, fileID)
+	if err != nil {
+		return "", err
+	}
+	chunks, err := s.store.ListChunkData(ctx, fileID)
+	if err != nil {
+		return "", err
+	}
+	key, err := s.FileKey(file)
+	if err != nil {
+		return "", err
+	}
+	data, err := AssembleFile(chunks, file.ChunkCount, Cipher(file.Cipher), key)
+	if err != nil {
+		return "", err
+	}
+	return ContentSHA256(data), nil
+}
+
+// ContentSHA256 returns the hex-encoded SHA-256 of data
+func ContentSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
 }
 
 // DeleteFile deletes a file and its chunks
 func (s *FileService) DeleteFile(ctx context.Context, fileID uuid.UUID) error {
-	_, err := s.db.Pool.Exec(ctx, "DELETE FROM files WHERE id = $1", fileID)
-	return err
+	var file *models.File
+	if s.webhooks != nil {
+		file, _ = s.store.GetFile(ctx, fileID)
+	}
+	if err := s.store.DeleteFile(ctx, fileID); err != nil {
+		return err
+	}
+	// Unfinished uploads being cleaned up were never announced, so their removal isn't either
+	if file != nil && file.Status == "ready" {
+		s.notify(ctx, EventFileDeleted, file, "deleted")
+	}
+	return nil
+}
+
+// SetExpiry schedules a file for deletion at expiresAt; nil keeps it indefinitely
+func (s *FileService) SetExpiry(ctx context.Context, fileID uuid.UUID, expiresAt *time.Time) error {
+	if err := s.store.SetFileExpiry(ctx, fileID, expiresAt); err != nil {
+		return fmt.Errorf("failed to set file expiry: %w", err)
+	}
+	return nil
+}
+
+// FileExpired reports whether a file's retention period has passed
+func FileExpired(file *models.File, now time.Time) bool {
+	return file.ExpiresAt != nil && !file.ExpiresAt.After(now)
+}
+
+// ExpiryRefund returns the credits for the part of the storage period a file
+// will not use because it expires early. Only paid-for (ready) files are
+// refunded, for the replicas they were charged for; replicaCount applies to
+// files completed before that was recorded.
+func (s *FileService) ExpiryRefund(file *models.File, replicaCount int) int64 {
+	if file.Status != "ready" || file.ExpiresAt == nil {
+		return 0
+	}
+	lifetime := file.ExpiresAt.Sub(file.CreatedAt)
+	if lifetime >= StoragePeriod {
+		return 0
+	}
+	if lifetime < 0 {
+		lifetime = 0
+	}
+	if file.Replicas > 0 {
+		replicaCount = file.Replicas
+	}
+	cost := s.CalculateStorageCost(file.SizeBytes, replicaCount)
+	return int64(float64(cost) * float64(StoragePeriod-lifetime) / float64(StoragePeriod))
+}
+
+// PurgeExpired deletes every file whose expiry is at or before now, refunding
+// owners for unused storage. It returns the files it deleted; failures on
+// individual files are joined into the error without stopping the sweep.
+func (s *FileService) PurgeExpired(ctx context.Context, now time.Time, replicaCount int) ([]models.File, error) {
+	expired, err := s.store.ListExpiredFiles(ctx, now)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list expired files: %w", err)
+	}
+
+	var purged []models.File
+	var errs []error
+	for i := range expired {
+		file := &expired[i]
+		// Delete before refunding so a failed delete can never be refunded twice
+		if err := s.store.DeleteFile(ctx, file.ID); err != nil {
+			errs = append(errs, fmt.Errorf("failed to delete file %s: %w", file.ID, err))
+			continue
+		}
+		purged = append(purged, *file)
+		if file.Status == "ready" {
+			s.notify(ctx, EventFileDeleted, file, "expired")
+		}
+
+		refund := s.ExpiryRefund(file, replicaCount)
+		if refund <= 0 {
+			continue
+		}
+		err := s.store.AddCredits(ctx, file.UserID, refund, "credit", "Unused storage refund for expired "+file.Filename)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to refund %d credits for file %s: %w", refund, file.ID, err))
+		}
+	}
+	return purged, errors.Join(errs...)
+}
+
+// DiscardSessionFile deletes the file an upload session created, along with
+// the chunks stored for it so far, once the session has ended without
+// completing. The file takes the session's ID, so it is found even if the
+// session was never linked to it. A file that has been completed is left
+// alone. It returns the ID of the file deleted, or uuid.Nil if there was none.
+func (s *FileService) DiscardSessionFile(ctx context.Context, session *UploadSession) (uuid.UUID, error) {
+	fileID := session.ID
+	if session.FileID != nil {
+		fileID = *session.FileID
+	}
+	file, err := s.store.GetFile(ctx, fileID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return uuid.Nil, nil
+	}
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if file.Status != "uploading" {
+		return uuid.Nil, nil
+	}
+	if err := s.store.DeleteFile(ctx, fileID); err != nil {
+		return uuid.Nil, fmt.Errorf("failed to delete file %s: %w", fileID, err)
+	}
+	return fileID, nil
+}
+
+// PurgeAbandonedUploads deletes the unfinished files, and their chunks, of
+// upload sessions that were canceled, expired or failed, including one a
+// first chunk racing the cancel created. Their credit holds were
+// settled when the sessions closed. It returns the files deleted; failures
+// are joined into the error without stopping the purge.
+func (s *FileService) PurgeAbandonedUploads(ctx context.Context) ([]models.File, error) {
+	abandoned, err := s.store.ListAbandonedUploadFiles(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list abandoned uploads: %w", err)
+	}
+
+	var purged []models.File
+	var errs []error
+	for _, file := range abandoned {
+		if err := s.store.DeleteFile(ctx, file.ID); err != nil {
+			errs = append(errs, fmt.Errorf("failed to delete file %s: %w", file.ID, err))
+			continue
+		}
+		purged = append(purged, file)
+	}
+	return purged, errors.Join(errs...)
+}
+
+// RotateKey re-encrypts every chunk of a file under a freshly generated key.
+// The file is marked "rotating" for the duration so concurrent rotations and
+// downloads are refused; chunk data and the file key are swapped atomically.
+// A file's ID can only derive one key, so the new key is random and stored
+// with the file whichever key provider is in use. Files uploaded straight to
+// the nodes are refused with ErrRotationUnsupported. Replicas on the nodes
+// go stale until ChunkService.RefreshStaleReplicas sends them the new
+// ciphertext.
+func (s *FileService) RotateKey(ctx context.Context, fileID uuid.UUID) error {
+	locked, err := s.store.SwapFileStatus(ctx, fileID, "ready", "rotating")
+	if err != nil {
+		return fmt.Errorf("failed to lock file: %w", err)
+	}
+	if !locked {
+		return ErrFileBusy
+	}
+	// Release the busy flag; on failure the old key and ciphertext are still in place
+	defer s.store.SetFileStatus(context.Background(), fileID, "ready")
+
+	// The file keeps its cipher; only the key changes
+	file, err := s.store.GetFile(ctx, fileID)
+	if err != nil {
+		return fmt.Errorf("failed to load file: %w", err)
+	}
+	cipher := Cipher(file.Cipher)
+	newKey, err := cipher.NewKey()
+	if err != nil {
+		return err
+	}
+
+	return s.store.RekeyFile(ctx, fileID, func(oldKey []byte, chunks map[int][]byte) ([]byte, map[int][]byte, error) {
+		// Even an empty chunk carries the cipher's overhead, so no data
+		// means the coordinator holds no copy of it
+		for chunkIndex, data := range chunks {
+			if len(data) == 0 {
+				return nil, nil, fmt.Errorf("%w: chunk %d", ErrRotationUnsupported, chunkIndex)
+			}
+		}
+		oldKey, err := s.keys.FileKey(cipher, fileID, oldKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		reencrypted, err := ReencryptChunks(chunks, cipher, oldKey, newKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		return newKey, reencrypted, nil
+	})
+}
+
+// ReencryptChunks decrypts each chunk with oldKey and re-encrypts it with newKey
+func ReencryptChunks(chunks map[int][]byte, cipher Cipher, oldKey, newKey []byte) (map[int][]byte, error) {
+	out := make(map[int][]byte, len(chunks))
+	for chunkIndex, data := range chunks {
+		plaintext, err := OpenChunk(cipher, data, oldKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt chunk %d: %w", chunkIndex, err)
+		}
+		ciphertext, err := SealChunk(cipher, plaintext, newKey, 0)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt chunk %d: %w", chunkIndex, err)
+		}
+		out[chunkIndex] = ciphertext
+	}
+	return out, nil
+}
+
+// AssembleFile decrypts chunks 0..chunkCount-1 and concatenates them
+func AssembleFile(chunks map[int][]byte, chunkCount int, cipher Cipher, key []byte) ([]byte, error) {
+	data, _, err := AssembleFileWithOffsets(chunks, chunkCount, cipher, key)
+	return data, err
+}
+
+// AssembleFileWithOffsets is AssembleFile that also returns the byte offset
+// at which each chunk starts in the assembled plaintext
+func AssembleFileWithOffsets(chunks map[int][]byte, chunkCount int, cipher Cipher, key []byte) ([]byte, []int64, error) {
+	var data []byte
+	offsets := make([]int64, chunkCount)
+	for i := 0; i < chunkCount; i++ {
+		chunkData, ok := chunks[i]
+		if !ok {
+			return nil, nil, fmt.Errorf("missing chunk %d", i)
+		}
+
+		decrypted, err := OpenChunk(cipher, chunkData, key)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to decrypt chunk %d", i)
+		}
+		offsets[i] = int64(len(data))
+		data = append(data, decrypted...)
+	}
+	return data, offsets, nil
 }
 
 // CalculateStorageCost calculates the storage cost for a file
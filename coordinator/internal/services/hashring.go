@@ -0,0 +1,107 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/federated-storage/coordinator/internal/models"
+	"github.com/google/uuid"
+)
+
+// Placement names how SelectNodesForChunks orders the nodes a chunk's
+// replicas are taken from
+type Placement string
+
+// Supported placements
+const (
+	// PlacementReputation takes the most reputable nodes first
+	PlacementReputation Placement = "reputation"
+	// PlacementConsistentHash takes nodes in hash ring order from the chunk's
+	// position, so a chunk maps to the same nodes every time it is placed
+	PlacementConsistentHash Placement = "consistent-hash"
+)
+
+// DefaultVirtualNodes is how many points each node gets on the hash ring
+// when none is configured
+const DefaultVirtualNodes = 100
+
+// ParsePlacement validates a placement name; an empty name is PlacementReputation
+func ParsePlacement(name string) (Placement, error) {
+	switch p := Placement(name); p {
+	case "":
+		return PlacementReputation, nil
+	case PlacementReputation, PlacementConsistentHash:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown placement %q (supported: %s, %s)", name, PlacementReputation, PlacementConsistentHash)
+	}
+}
+
+// ChunkPlacementKey identifies a chunk on the hash ring. A chunk's row ID is
+// only minted when it is stored, so chunks are keyed by their place in their
+// file, which stays the same when the chunk is uploaded again.
+func ChunkPlacementKey(fileID uuid.UUID, chunkIndex int) string {
+	return fileID.String() + "/" + strconv.Itoa(chunkIndex)
+}
+
+// ringPoint is one virtual node: a position on the ring owned by a node
+type ringPoint struct {
+	hash uint64
+	node int
+}
+
+// HashRing places keys on nodes by consistent hashing. Each node owns many
+// points on the ring so keys spread evenly, and a node joining or leaving
+// only moves the keys next to its own points.
+type HashRing struct {
+	nodes  []models.StorageNode
+	points []ringPoint // sorted by hash
+}
+
+// ringHash maps a string to a position on the ring
+func ringHash(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// NewHashRing builds a ring giving each node virtualNodes points (at least one)
+func NewHashRing(nodes []models.StorageNode, virtualNodes int) *HashRing {
+	virtualNodes = max(virtualNodes, 1)
+	r := &HashRing{nodes: nodes, points: make([]ringPoint, 0, len(nodes)*virtualNodes)}
+	for i, node := range nodes {
+		for v := 0; v < virtualNodes; v++ {
+			r.points = append(r.points, ringPoint{hash: ringHash(node.ID.String() + "#" + strconv.Itoa(v)), node: i})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash != r.points[j].hash {
+			return r.points[i].hash < r.points[j].hash
+		}
+		return r.nodes[r.points[i].node].ID.String() < r.nodes[r.points[j].node].ID.String()
+	})
+	return r
+}
+
+// Candidates returns every node on the ring, ordered by the first of its
+// points met walking clockwise from key's position
+func (r *HashRing) Candidates(key string) []models.StorageNode {
+	if len(r.points) == 0 {
+		return nil
+	}
+	h := ringHash(key)
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+
+	ordered := make([]models.StorageNode, 0, len(r.nodes))
+	seen := make([]bool, len(r.nodes))
+	for i := 0; i < len(r.points) && len(ordered) < len(r.nodes); i++ {
+		p := r.points[(start+i)%len(r.points)]
+		if !seen[p.node] {
+			seen[p.node] = true
+			ordered = append(ordered, r.nodes[p.node])
+		}
+	}
+	return ordered
+}
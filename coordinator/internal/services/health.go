@@ -0,0 +1,148 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/federated-storage/coordinator/internal/models"
+	"github.com/google/uuid"
+)
+
+// Health classifications of a chunk or file, from best to worst
+const (
+	HealthHealthy  = "healthy"
+	HealthDegraded = "degraded"
+	HealthAtRisk   = "at-risk"
+	HealthLost     = "lost"
+)
+
+// healthRank orders classifications so the worst of several can be picked
+var healthRank = map[string]int{HealthHealthy: 0, HealthDegraded: 1, HealthAtRisk: 2, HealthLost: 3}
+
+// ChunkHealth is how safely one chunk of a file is stored
+type ChunkHealth struct {
+	ChunkID        uuid.UUID  `json:"chunk_id"`
+	ChunkIndex     int        `json:"chunk_index"`
+	Replicas       int        `json:"replicas"` // active replicas on active nodes
+	TargetReplicas int        `json:"target_replicas"`
+	LastProofAt    *time.Time `json:"last_proof_at,omitempty"` // most recent successful proof of any replica
+	Health         string     `json:"health"`
+	Score          float64    `json:"score"`
+}
+
+// FileHealth is how safely a file is stored: its worst chunk's classification
+// and score, with the detail per chunk
+type FileHealth struct {
+	FileID uuid.UUID     `json:"file_id"`
+	Health string        `json:"health"`
+	Score  float64       `json:"score"` // 0 (lost) to 1 (every chunk fully replicated and recently proven)
+	Chunks []ChunkHealth `json:"chunks"`
+}
+
+// SetHealthPolicy sets the replicas a chunk should have and how long it may
+// go without a successful proof before its health is degraded
+func (s *ProofService) SetHealthPolicy(targetReplicas int, proofMaxAge time.Duration) {
+	s.targetReplicas = targetReplicas
+	s.healthProofMaxAge = proofMaxAge
+}
+
+// proofStale reports whether a chunk has gone longer than maxAge without a
+// successful proof. A chunk never proven is measured from its file's
+// creation, so new uploads aren't stale before their first proof is due.
+func proofStale(lastProof *time.Time, created, now time.Time, maxAge time.Duration) bool {
+	if maxAge <= 0 {
+		return false
+	}
+	since := created
+	if lastProof != nil {
+		since = *lastProof
+	}
+	return now.Sub(since) > maxAge
+}
+
+// classifyChunk grades a chunk with replicas of target replicas:
+//   - lost: no replica left
+//   - at-risk: a single replica left of several wanted, one node failure from lost
+//   - degraded: fewer replicas than wanted, or no recent successful proof
+//   - healthy: fully replicated and recently proven
+//
+// Its score is the share of the target replicas present, halved when the
+// chunk's proofs are stale.
+func classifyChunk(replicas, target int, stale bool) (string, float64) {
+	if target < 1 {
+		target = 1
+	}
+	score := float64(min(replicas, target)) / float64(target)
+	if stale {
+		score /= 2
+	}
+	score = math.Round(score*100) / 100
+
+	switch {
+	case replicas == 0:
+		return HealthLost, 0
+	case replicas == 1 && target > 1:
+		return HealthAtRisk, score
+	case replicas < target || stale:
+		return HealthDegraded, score
+	default:
+		return HealthHealthy, score
+	}
+}
+
+// aggregateHealth grades a file by its worst chunk: it can only be read back
+// if every chunk can. A file without chunks is healthy.
+func aggregateHealth(fileID uuid.UUID, chunks []ChunkHealth) *FileHealth {
+	result := &FileHealth{FileID: fileID, Health: HealthHealthy, Score: 1, Chunks: chunks}
+	for _, chunk := range chunks {
+		if healthRank[chunk.Health] > healthRank[result.Health] {
+			result.Health = chunk.Health
+		}
+		if chunk.Score < result.Score {
+			result.Score = chunk.Score
+		}
+	}
+	return result
+}
+
+// FileHealth reports, per chunk of file, its active replicas against the
+// target and its last successful proof, classified and aggregated into the
+// file's health. The target is the file's charged replicas, or the
+// configured default if not recorded.
+func (s *ProofService) FileHealth(ctx context.Context, file *models.File, now time.Time) (*FileHealth, error) {
+	target := file.Replicas
+	if target <= 0 {
+		target = s.targetReplicas
+	}
+
+	rows, err := s.db.Pool.Query(ctx,
+		`SELECT c.id, c.chunk_index,
+		 (SELECT COUNT(*) FROM chunk_assignments ca JOIN storage_nodes sn ON sn.id = ca.node_id
+		  WHERE ca.chunk_id = c.id AND ca.status = 'active' AND sn.status = 'active'),
+		 (SELECT MAX(pc.verified_at) FROM proof_challenges pc WHERE pc.chunk_id = c.id AND pc.status = 'verified')
+		 FROM chunks c
+		 WHERE c.file_id = $1
+		 ORDER BY c.chunk_index`,
+		file.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get chunk replicas: %w", err)
+	}
+	defer rows.Close()
+
+	chunks := []ChunkHealth{}
+	for rows.Next() {
+		chunk := ChunkHealth{TargetReplicas: target}
+		if err := rows.Scan(&chunk.ChunkID, &chunk.ChunkIndex, &chunk.Replicas, &chunk.LastProofAt); err != nil {
+			return nil, err
+		}
+		stale := proofStale(chunk.LastProofAt, file.CreatedAt, now, s.healthProofMaxAge)
+		chunk.Health, chunk.Score = classifyChunk(chunk.Replicas, target, stale)
+		chunks = append(chunks, chunk)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get chunk replicas: %w", err)
+	}
+	return aggregateHealth(file.ID, chunks), nil
+}
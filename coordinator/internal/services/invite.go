@@ -0,0 +1,79 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/federated-storage/coordinator/internal/models"
+	"github.com/federated-storage/coordinator/internal/storage"
+	"github.com/google/uuid"
+)
+
+// ErrInvalidInvite is returned when an invite token is unknown, already used or expired
+var ErrInvalidInvite = errors.New("invalid or expired invite token")
+
+// InviteService issues and redeems the one-time tokens that admit storage
+// nodes when open registration is disabled
+type InviteService struct {
+	store storage.Store
+}
+
+// NewInviteService creates a new invite service
+func NewInviteService(store storage.Store) *InviteService {
+	return &InviteService{store: store}
+}
+
+// CreateInvite mints a token valid for ttl (forever if ttl <= 0). Only the
+// token's hash is stored, so the returned token cannot be retrieved later.
+func (s *InviteService) CreateInvite(ctx context.Context, note string, ttl time.Duration) (string, *models.NodeInvite, error) {
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		return "", nil, fmt.Errorf("failed to generate invite token: %w", err)
+	}
+	token := "fsi_" + hex.EncodeToString(raw)
+
+	invite := &models.NodeInvite{
+		ID:        uuid.New(),
+		TokenHash: hashInviteToken(token),
+		Note:      note,
+	}
+	if ttl > 0 {
+		expiresAt := time.Now().Add(ttl)
+		invite.ExpiresAt = &expiresAt
+	}
+
+	if err := s.store.CreateNodeInvite(ctx, invite); err != nil {
+		return "", nil, fmt.Errorf("failed to create invite: %w", err)
+	}
+	return token, invite, nil
+}
+
+// Redeem spends a token, returning ErrInvalidInvite if it can't be used
+func (s *InviteService) Redeem(ctx context.Context, token string) (*models.NodeInvite, error) {
+	if token == "" {
+		return nil, ErrInvalidInvite
+	}
+	invite, err := s.store.RedeemNodeInvite(ctx, hashInviteToken(token), time.Now())
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, ErrInvalidInvite
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to redeem invite: %w", err)
+	}
+	return invite, nil
+}
+
+// Restore makes a redeemed invite usable again, for when the registration it admitted failed
+func (s *InviteService) Restore(ctx context.Context, invite *models.NodeInvite) error {
+	return s.store.RestoreNodeInvite(ctx, invite.ID)
+}
+
+func hashInviteToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,143 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Supported key providers
+const (
+	// KeyProviderRandom gives every file a random key, stored with the file
+	KeyProviderRandom = "random"
+	// KeyProviderDerived derives every file's key from a master key and the
+	// file's ID, so no key is stored
+	KeyProviderDerived = "derived"
+)
+
+// MinMasterKeySize is the shortest master key derived keys are made from, in bytes
+const MinMasterKeySize = 32
+
+// ErrNoFileKey is returned for a file stored without a key that its key
+// provider cannot derive either
+var ErrNoFileKey = errors.New("file has no encryption key")
+
+// KeyProvider supplies the keys files are encrypted with. Keys are looked up
+// by the file's ID and cipher together with whatever key was stored for it,
+// so files keyed under another provider stay readable after a switch; files
+// keyed by derivation stay readable only while the master key is configured.
+type KeyProvider interface {
+	// NewKey returns the key for a new file, and whether it has to be stored
+	// with the file to be found again
+	NewKey(c Cipher, fileID uuid.UUID) (key []byte, store bool, err error)
+	// FileKey returns the key of a file given the key stored with it, if any
+	FileKey(c Cipher, fileID uuid.UUID, stored []byte) ([]byte, error)
+}
+
+// ParseKeyProvider builds the named key provider; masterKeyHex is the
+// hex-encoded master key the derived provider needs. An empty name is
+// KeyProviderRandom, which uses a master key, if given, to read files keyed
+// while derived keys were enabled.
+func ParseKeyProvider(name, masterKeyHex string) (KeyProvider, error) {
+	switch name {
+	case "", KeyProviderRandom:
+		if masterKeyHex == "" {
+			return RandomKeys{}, nil
+		}
+		derived, err := parseDerivedKeys(masterKeyHex)
+		if err != nil {
+			return nil, err
+		}
+		return RandomKeys{Derived: derived}, nil
+	case KeyProviderDerived:
+		return parseDerivedKeys(masterKeyHex)
+	default:
+		return nil, fmt.Errorf("unknown key provider %q (supported: %s, %s)", name, KeyProviderRandom, KeyProviderDerived)
+	}
+}
+
+func parseDerivedKeys(masterKeyHex string) (*DerivedKeys, error) {
+	masterKey, err := hex.DecodeString(masterKeyHex)
+	if err != nil {
+		return nil, fmt.Errorf("master key is not hex: %w", err)
+	}
+	return NewDerivedKeys(masterKey)
+}
+
+// RandomKeys generates a random key for every file. The key is the only copy,
+// so it is stored with the file.
+type RandomKeys struct {
+	// Derived finds the keys of files stored without one, keyed while
+	// derived keys were enabled; nil leaves those files unreadable
+	Derived *DerivedKeys
+}
+
+// NewKey returns a random key of the cipher's size
+func (RandomKeys) NewKey(c Cipher, fileID uuid.UUID) ([]byte, bool, error) {
+	key, err := c.NewKey()
+	return key, true, err
+}
+
+// FileKey returns the stored key, or derives the key of a file stored
+// without one if a master key was kept
+func (r RandomKeys) FileKey(c Cipher, fileID uuid.UUID, stored []byte) ([]byte, error) {
+	if len(stored) > 0 {
+		return stored, nil
+	}
+	if r.Derived == nil {
+		return nil, fmt.Errorf("%w: %s was keyed by derivation and storage.master_key is not set", ErrNoFileKey, fileID)
+	}
+	return r.Derived.derive(c, fileID)
+}
+
+// DerivedKeys derives each file's key from a master key and the file's ID
+// with HKDF-SHA256, so the key is recomputed whenever it is needed instead of
+// being stored. Losing the master key loses every file keyed with it.
+type DerivedKeys struct {
+	masterKey []byte
+}
+
+// NewDerivedKeys creates a provider deriving keys from masterKey, which must
+// be at least MinMasterKeySize bytes
+func NewDerivedKeys(masterKey []byte) (*DerivedKeys, error) {
+	if len(masterKey) < MinMasterKeySize {
+		return nil, fmt.Errorf("master key must be at least %d bytes, got %d", MinMasterKeySize, len(masterKey))
+	}
+	return &DerivedKeys{masterKey: append([]byte(nil), masterKey...)}, nil
+}
+
+// NewKey derives the file's key; it is not stored
+func (d *DerivedKeys) NewKey(c Cipher, fileID uuid.UUID) ([]byte, bool, error) {
+	key, err := d.derive(c, fileID)
+	return key, false, err
+}
+
+// FileKey returns the stored key of a file keyed before derived keys were
+// enabled, or since rotated, and derives the key of any other
+func (d *DerivedKeys) FileKey(c Cipher, fileID uuid.UUID, stored []byte) ([]byte, error) {
+	if len(stored) > 0 {
+		return stored, nil
+	}
+	return d.derive(c, fileID)
+}
+
+// derive expands the master key into a key of the cipher's size. The cipher
+// is part of the context, so ciphers sharing a key size still get unrelated
+// keys for the same file.
+func (d *DerivedKeys) derive(c Cipher, fileID uuid.UUID) ([]byte, error) {
+	size := c.KeySize()
+	if size == 0 {
+		return nil, fmt.Errorf("%w %q", ErrUnknownCipher, string(c))
+	}
+	info := append([]byte("de-store file key "+string(c.orDefault())+" "), fileID[:]...)
+	key := make([]byte, size)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, d.masterKey, nil, info), key); err != nil {
+		return nil, fmt.Errorf("failed to derive encryption key: %w", err)
+	}
+	return key, nil
+}
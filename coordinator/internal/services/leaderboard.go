@@ -0,0 +1,133 @@
+package services
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ErrInvalidPeriod is returned for a leaderboard period that is not recognized
+var ErrInvalidPeriod = errors.New("invalid period")
+
+// LeaderboardPeriods lists the periods a leaderboard can cover
+var LeaderboardPeriods = []string{"day", "week", "month", "all"}
+
+// LeaderboardSince returns the start of a leaderboard period ending at now.
+// An empty period is "month"; "all" returns the zero time.
+func LeaderboardSince(period string, now time.Time) (time.Time, error) {
+	switch period {
+	case "day":
+		return now.AddDate(0, 0, -1), nil
+	case "week":
+		return now.AddDate(0, 0, -7), nil
+	case "", "month":
+		return now.AddDate(0, -1, 0), nil
+	case "all":
+		return time.Time{}, nil
+	default:
+		return time.Time{}, fmt.Errorf("%w %q (use one of %v)", ErrInvalidPeriod, period, LeaderboardPeriods)
+	}
+}
+
+// LeaderboardEntry is one node's standing over a period
+type LeaderboardEntry struct {
+	Rank             int     `json:"rank"`
+	NodeID           string  `json:"node_id,omitempty"`
+	Name             string  `json:"name"`
+	EarnedCredits    int64   `json:"earned_credits"`
+	UptimePercentage float64 `json:"uptime_percentage"`
+	ProofsVerified   int     `json:"proofs_verified"`
+	ProofsFailed     int     `json:"proofs_failed"`
+	ProofSuccessRate float64 `json:"proof_success_rate"`
+}
+
+// RankLeaderboard orders entries by credits earned, then proof success rate,
+// then uptime, and numbers them from 1. Remaining ties are broken by node ID
+// so the order is stable between requests.
+func RankLeaderboard(entries []LeaderboardEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.EarnedCredits != b.EarnedCredits {
+			return a.EarnedCredits > b.EarnedCredits
+		}
+		if a.ProofSuccessRate != b.ProofSuccessRate {
+			return a.ProofSuccessRate > b.ProofSuccessRate
+		}
+		if a.UptimePercentage != b.UptimePercentage {
+			return a.UptimePercentage > b.UptimePercentage
+		}
+		return a.NodeID < b.NodeID
+	})
+	for i := range entries {
+		entries[i].Rank = i + 1
+	}
+}
+
+// AnonymizeLeaderboard replaces node names and IDs with a pseudonym keyed by
+// secret, so it can't be matched against the public node IDs. It is stable
+// for as long as the secret is, so operators can still find their own node.
+func AnonymizeLeaderboard(entries []LeaderboardEntry, secret []byte) {
+	for i := range entries {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(entries[i].NodeID))
+		entries[i].Name = "node-" + hex.EncodeToString(mac.Sum(nil)[:4])
+		entries[i].NodeID = ""
+	}
+}
+
+// SetLeaderboardSecret sets the key leaderboard pseudonyms are derived from.
+// Without one, a random key is used and pseudonyms change on every restart.
+func (s *NodeService) SetLeaderboardSecret(secret []byte) {
+	s.leaderboardSecret = secret
+}
+
+// Leaderboard ranks active nodes over the period starting at since and
+// returns the top limit. Credits come from daily earnings in the period, or
+// the node's running total for an all-time board (zero since). Unless named,
+// entries are anonymized.
+func (s *NodeService) Leaderboard(ctx context.Context, since time.Time, limit int, named bool) ([]LeaderboardEntry, error) {
+	rows, err := s.db.Pool.Query(ctx,
+		`SELECT sn.id, sn.name, sn.uptime_percentage,
+		 CASE WHEN $2 THEN sn.earned_credits
+		      ELSE COALESCE((SELECT SUM(e.total_earnings) FROM node_earnings e WHERE e.node_id = sn.id AND e.date >= $1::date), 0)
+		 END,
+		 (SELECT COUNT(*) FROM proof_challenges pc WHERE pc.node_id = sn.id AND pc.status = 'verified' AND pc.verified_at >= $1),
+		 (SELECT COUNT(*) FROM proof_challenges pc WHERE pc.node_id = sn.id AND pc.status = 'failed' AND pc.verified_at >= $1)
+		 FROM storage_nodes sn WHERE sn.status = 'active'`,
+		since, since.IsZero())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load leaderboard: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []LeaderboardEntry{}
+	for rows.Next() {
+		var e LeaderboardEntry
+		var id uuid.UUID
+		if err := rows.Scan(&id, &e.Name, &e.UptimePercentage, &e.EarnedCredits, &e.ProofsVerified, &e.ProofsFailed); err != nil {
+			return nil, err
+		}
+		e.NodeID = id.String()
+		e.ProofSuccessRate = proofSuccessRate(e.ProofsVerified, e.ProofsFailed)
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	RankLeaderboard(entries)
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	if !named {
+		AnonymizeLeaderboard(entries, s.leaderboardSecret)
+	}
+	return entries, nil
+}
@@ -0,0 +1,78 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"github.com/federated-storage/coordinator/internal/models"
+	"github.com/google/uuid"
+)
+
+// NodeLocation is a node holding a copy of a chunk
+type NodeLocation struct {
+	NodeID uuid.UUID `json:"node_id"`
+	PeerID string    `json:"peer_id"`
+	Name   string    `json:"name"`
+	Region string    `json:"region,omitempty"`
+}
+
+// ChunkLocation lists the nodes holding one chunk of a file
+type ChunkLocation struct {
+	ChunkID    uuid.UUID      `json:"chunk_id"`
+	ChunkIndex int            `json:"chunk_index"`
+	Nodes      []NodeLocation `json:"nodes"`
+}
+
+// SetOfflineAfter leaves nodes that have not sent a heartbeat for d out of
+// file locations; d <= 0 keeps every active node
+func (s *ChunkService) SetOfflineAfter(d time.Duration) {
+	s.offlineAfter = d
+}
+
+// FileLocations returns, for each of a file's chunks as returned by
+// GetChunksByFile, the nodes actively assigned it. Nodes that are not active,
+// or have gone quiet for longer than the offline threshold, can't serve the
+// chunk and are left out. The assignments of every chunk are read at once.
+func (s *ChunkService) FileLocations(ctx context.Context, fileID uuid.UUID, chunks []models.Chunk, now time.Time) ([]ChunkLocation, error) {
+	online := make(map[uuid.UUID]models.StorageNode)
+	if s.nodeService != nil {
+		nodes, err := s.nodeService.GetAllNodes(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, node := range nodes {
+			if s.offlineAfter > 0 && node.LastHeartbeat != nil && now.Sub(*node.LastHeartbeat) > s.offlineAfter {
+				continue
+			}
+			online[node.ID] = node
+		}
+	}
+
+	assignments, err := s.store.ListFileAssignments(ctx, fileID)
+	if err != nil {
+		return nil, err
+	}
+	byChunk := make(map[uuid.UUID][]models.ChunkAssignment)
+	for _, assignment := range assignments {
+		byChunk[assignment.ChunkID] = append(byChunk[assignment.ChunkID], assignment)
+	}
+
+	locations := make([]ChunkLocation, 0, len(chunks))
+	for _, chunk := range chunks {
+		location := ChunkLocation{ChunkID: chunk.ID, ChunkIndex: chunk.ChunkIndex, Nodes: []NodeLocation{}}
+		for _, assignment := range byChunk[chunk.ID] {
+			node, ok := online[assignment.NodeID]
+			if !ok {
+				continue
+			}
+			location.Nodes = append(location.Nodes, NodeLocation{
+				NodeID: node.ID,
+				PeerID: node.PeerID,
+				Name:   node.Name,
+				Region: node.Region,
+			})
+		}
+		locations = append(locations, location)
+	}
+	return locations, nil
+}
@@ -0,0 +1,288 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/federated-storage/coordinator/internal/models"
+	"github.com/google/uuid"
+)
+
+// MaxMaintenanceWindow bounds how long a node may schedule itself offline
+const MaxMaintenanceWindow = 7 * 24 * time.Hour
+
+// ErrInvalidMaintenanceWindow is returned for a window that is inverted, already over or too long
+var ErrInvalidMaintenanceWindow = errors.New("invalid maintenance window")
+
+// ValidateMaintenanceWindow checks a window a node asks for at time now
+func ValidateMaintenanceWindow(start, end, now time.Time) error {
+	switch {
+	case !end.After(start):
+		return fmt.Errorf("%w: end must be after start", ErrInvalidMaintenanceWindow)
+	case !end.After(now):
+		return fmt.Errorf("%w: window has already ended", ErrInvalidMaintenanceWindow)
+	case end.Sub(start) > MaxMaintenanceWindow:
+		return fmt.Errorf("%w: windows may last at most %s", ErrInvalidMaintenanceWindow, MaxMaintenanceWindow)
+	}
+	return nil
+}
+
+// Draining reports whether a node is in, or within lead of, its maintenance
+// window. Draining nodes get no new chunks and have their chunks copied
+// elsewhere; once the window ends they are eligible again without any action.
+func Draining(node models.StorageNode, now time.Time, lead time.Duration) bool {
+	if node.MaintenanceStart == nil || node.MaintenanceEnd == nil {
+		return false
+	}
+	return !now.Before(node.MaintenanceStart.Add(-lead)) && now.Before(*node.MaintenanceEnd)
+}
+
+// ExcludeDraining returns the nodes that are not draining at now
+func ExcludeDraining(nodes []models.StorageNode, now time.Time, lead time.Duration) []models.StorageNode {
+	eligible := make([]models.StorageNode, 0, len(nodes))
+	for _, n := range nodes {
+		if !Draining(n, now, lead) {
+			eligible = append(eligible, n)
+		}
+	}
+	return eligible
+}
+
+// SetMaintenanceWindow schedules a node's maintenance window, replacing any earlier one
+func (s *NodeService) SetMaintenanceWindow(ctx context.Context, nodeID uuid.UUID, start, end time.Time) error {
+	if err := ValidateMaintenanceWindow(start, end, time.Now()); err != nil {
+		return err
+	}
+	tag, err := s.db.Pool.Exec(ctx,
+		"UPDATE storage_nodes SET maintenance_start = $1, maintenance_end = $2, updated_at = $3 WHERE id = $4",
+		start, end, time.Now(), nodeID)
+	if err != nil {
+		return fmt.Errorf("failed to schedule maintenance: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("node not found")
+	}
+	return nil
+}
+
+// ClearMaintenanceWindow cancels a node's maintenance window, returning it to placement immediately
+func (s *NodeService) ClearMaintenanceWindow(ctx context.Context, nodeID uuid.UUID) error {
+	tag, err := s.db.Pool.Exec(ctx,
+		"UPDATE storage_nodes SET maintenance_start = NULL, maintenance_end = NULL, updated_at = $1 WHERE id = $2",
+		time.Now(), nodeID)
+	if err != nil {
+		return fmt.Errorf("failed to cancel maintenance: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("node not found")
+	}
+	return nil
+}
+
+// PlanDrain picks copies that keep replicas chunks' worth of redundancy on
+// nodes outside maintenance. For every chunk held by a draining node, it
+// counts the holders that are not draining and plans copies to the least
+// utilized other nodes until there are replicas of them. At most maxCopies
+// copies are planned. Draining nodes keep their own replicas, which serve
+// reads again once their window ends.
+func PlanDrain(nodes []models.StorageNode, holdings map[uuid.UUID][]models.Chunk, draining map[uuid.UUID]bool, replicas, maxCopies int) []ChunkMove {
+	used := make(map[uuid.UUID]int64)
+	var targets []models.StorageNode
+	for _, n := range nodes {
+		used[n.ID] = n.UsedStorageBytes
+		if !draining[n.ID] && n.TotalStorageBytes > 0 {
+			targets = append(targets, n)
+		}
+	}
+	util := func(n models.StorageNode) float64 {
+		return float64(used[n.ID]) / float64(n.TotalStorageBytes)
+	}
+
+	holders := make(map[uuid.UUID]map[uuid.UUID]bool)
+	for nodeID, chunks := range holdings {
+		for _, c := range chunks {
+			if holders[c.ID] == nil {
+				holders[c.ID] = make(map[uuid.UUID]bool)
+			}
+			holders[c.ID][nodeID] = true
+		}
+	}
+	available := func(chunkID uuid.UUID) int {
+		count := 0
+		for nodeID := range holders[chunkID] {
+			if !draining[nodeID] {
+				count++
+			}
+		}
+		return count
+	}
+
+	// Visit draining nodes in a fixed order so repeated passes plan alike
+	var sources []models.StorageNode
+	for _, n := range nodes {
+		if draining[n.ID] {
+			sources = append(sources, n)
+		}
+	}
+	sort.Slice(sources, func(i, j int) bool { return sources[i].ID.String() < sources[j].ID.String() })
+
+	var moves []ChunkMove
+	for _, src := range sources {
+		for _, chunk := range holdings[src.ID] {
+			for available(chunk.ID) < replicas && len(moves) < maxCopies {
+				var target *models.StorageNode
+				for i := range targets {
+					t := &targets[i]
+					if holders[chunk.ID][t.ID] || used[t.ID]+int64(chunk.SizeBytes) > t.TotalStorageBytes {
+						continue
+					}
+					if target == nil || util(*t) < util(*target) {
+						target = t
+					}
+				}
+				if target == nil {
+					break
+				}
+
+				moves = append(moves, ChunkMove{
+					ChunkID:    chunk.ID,
+					SizeBytes:  chunk.SizeBytes,
+					FromNodeID: src.ID,
+					ToNodeID:   target.ID,
+					ToPeerID:   target.PeerID,
+				})
+				used[target.ID] += int64(chunk.SizeBytes)
+				holders[chunk.ID][target.ID] = true
+			}
+		}
+	}
+	return moves
+}
+
+// DrainReport summarizes one drain pass
+type DrainReport struct {
+	Draining int                `json:"draining"`
+	Planned  int                `json:"planned"`
+	Copied   []ChunkMove        `json:"copied"`
+	Failed   []RebalanceFailure `json:"failed"`
+	// Retired are copies made while a node drained, retired now that it is back
+	Retired []models.DrainCopy `json:"retired"`
+}
+
+// backFromMaintenance reports whether a node no longer draining is active
+// and has sent a heartbeat since its window ended, so it serves its own
+// replicas again
+func (s *ChunkService) backFromMaintenance(node models.StorageNode, now time.Time) bool {
+	switch {
+	case Draining(node, now, s.maintenanceLead), node.Status != "active", node.LastHeartbeat == nil:
+		return false
+	case node.MaintenanceEnd != nil && !node.LastHeartbeat.After(*node.MaintenanceEnd):
+		return false
+	}
+	return s.offlineAfter <= 0 || now.Sub(*node.LastHeartbeat) <= s.offlineAfter
+}
+
+// retireDrainCopies retires the copies made while node drained, now that it
+// is back. A copy whose source no longer actively holds the chunk stays on
+// as a regular replica; either way it stops being tracked.
+func (s *ChunkService) retireDrainCopies(ctx context.Context, node models.StorageNode, report *DrainReport) error {
+	copies, err := s.store.ListDrainCopies(ctx, node.ID)
+	if err != nil {
+		return fmt.Errorf("failed to list drain copies of node %s: %w", node.ID, err)
+	}
+	for _, c := range copies {
+		assignments, err := s.store.ListChunkAssignments(ctx, c.ChunkID)
+		if err != nil {
+			return fmt.Errorf("failed to list assignments of chunk %s: %w", c.ChunkID, err)
+		}
+		holds := func(nodeID uuid.UUID) bool {
+			return slices.ContainsFunc(assignments, func(a models.ChunkAssignment) bool { return a.NodeID == nodeID })
+		}
+		if holds(c.SourceNodeID) && holds(c.NodeID) {
+			if err := s.store.SetChunkAssignment(ctx, c.ChunkID, c.NodeID, "retired"); err != nil {
+				return fmt.Errorf("failed to retire drain copy of chunk %s: %w", c.ChunkID, err)
+			}
+			report.Retired = append(report.Retired, c)
+		}
+		if err := s.store.DeleteDrainCopy(ctx, c.ChunkID, c.NodeID); err != nil {
+			return fmt.Errorf("failed to forget drain copy of chunk %s: %w", c.ChunkID, err)
+		}
+	}
+	return nil
+}
+
+// DrainMaintenanceNodes re-replicates the chunks of nodes in or near their
+// maintenance window so each keeps replicas copies elsewhere. Copies that
+// fail are retried by the next pass. Nodes excluded from placement receive
+// no copies, though their replicas still count. Once a drained node is back
+// the copies made for it are retired, so the extra replicas don't outlive
+// the window.
+func (s *ChunkService) DrainMaintenanceNodes(ctx context.Context, transfer ChunkTransfer, replicas, maxCopies int) (*DrainReport, error) {
+	nodes, err := s.nodeService.GetAllNodes(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list nodes: %w", err)
+	}
+
+	now := time.Now()
+	report := &DrainReport{Copied: []ChunkMove{}, Failed: []RebalanceFailure{}, Retired: []models.DrainCopy{}}
+	draining := make(map[uuid.UUID]bool)
+	for _, n := range nodes {
+		if Draining(n, now, s.maintenanceLead) {
+			draining[n.ID] = true
+			continue
+		}
+		if s.backFromMaintenance(n, now) {
+			if err := s.retireDrainCopies(ctx, n, report); err != nil {
+				return nil, err
+			}
+		}
+	}
+	report.Draining = len(draining)
+	if len(draining) == 0 {
+		return report, nil
+	}
+
+	holdings := make(map[uuid.UUID][]models.Chunk, len(nodes))
+	for _, n := range nodes {
+		chunks, err := s.store.ListNodeChunks(ctx, n.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list chunks of node %s: %w", n.ID, err)
+		}
+		holdings[n.ID] = chunks
+	}
+
+	// Draining nodes stay in even when excluded, as the sources of copies
+	eligible, err := s.excludeListed(ctx, nodes)
+	if err != nil {
+		return nil, err
+	}
+	candidates := make([]models.StorageNode, 0, len(nodes))
+	for _, n := range nodes {
+		if draining[n.ID] || slices.ContainsFunc(eligible, func(e models.StorageNode) bool { return e.ID == n.ID }) {
+			candidates = append(candidates, n)
+		}
+	}
+
+	moves := PlanDrain(candidates, holdings, draining, replicas, maxCopies)
+	report.Planned = len(moves)
+	for _, move := range moves {
+		if ctx.Err() != nil {
+			break
+		}
+		if err := s.CopyChunk(ctx, transfer, move); err != nil {
+			report.Failed = append(report.Failed, RebalanceFailure{ChunkMove: move, Error: err.Error()})
+			continue
+		}
+		// Untracked, the copy simply stays on as a regular replica
+		if err := s.store.RecordDrainCopy(ctx, move.ChunkID, move.ToNodeID, move.FromNodeID); err != nil {
+			report.Failed = append(report.Failed, RebalanceFailure{ChunkMove: move, Error: fmt.Sprintf("copied but not tracked for retirement: %v", err)})
+			continue
+		}
+		report.Copied = append(report.Copied, move)
+	}
+	return report, nil
+}
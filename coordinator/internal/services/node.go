@@ -2,22 +2,46 @@ package services
 
 import (
 	"context"
+	"crypto/rand"
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/federated-storage/coordinator/internal/models"
 	"github.com/federated-storage/coordinator/internal/storage"
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgconn"
 )
 
+// ErrCapacityBelowUsage is returned when a node reports less capacity than it already uses
+var ErrCapacityBelowUsage = errors.New("capacity is below used storage")
+
+// ErrNodeVersionTooOld is returned when a node runs software older than the configured minimum
+var ErrNodeVersionTooOld = errors.New("node version too old")
+
 // NodeService handles storage node operations
 type NodeService struct {
-	db *storage.DB
+	db                 *storage.DB
+	minVersion         string
+	unverifiedCapacity int64 // capacity trusted until a capacity proof passes; 0 trusts claims
+	earningsRates      EarningsRates
+	leaderboardSecret  []byte
+	offlineAfter       time.Duration // heartbeat silence after which a node isn't counted active; 0 counts every active node
 }
 
 // NewNodeService creates a new node service
-func NewNodeService(db *storage.DB) *NodeService {
-	return &NodeService{db: db}
+func NewNodeService(db *storage.DB, minVersion string) *NodeService {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	return &NodeService{db: db, minVersion: minVersion, leaderboardSecret: secret}
+}
+
+// SetOfflineAfter leaves nodes that have not sent a heartbeat for d out of
+// network statistics; d <= 0 counts every active node
+func (s *NodeService) SetOfflineAfter(d time.Duration) {
+	s.offlineAfter = d
 }
 
 // RegisterNodeRequest represents a node registration request
@@ -27,16 +51,26 @@ type RegisterNodeRequest struct {
 	PublicKey      []byte `json:"public_key" binding:"required"`
 	Address        string `json:"address"`
 	TotalStorageGB int    `json:"total_storage_gb"`
+	Version        string `json:"version"`
+	// OperatorID identifies who runs the node; replicas are spread across operators
+	OperatorID string `json:"operator_id"`
+	// Region is where the node runs, as its operator describes it
+	Region string `json:"region" binding:"max=64"`
 }
 
 // RegisterNodeResponse represents a node registration response
 type RegisterNodeResponse struct {
-	NodeID string `json:"node_id"`
-	APIKey string `json:"api_key"`
+	NodeID            string `json:"node_id"`
+	APIKey            string `json:"api_key"`
+	CoordinatorPeerID string `json:"coordinator_peer_id,omitempty"`
 }
 
 // RegisterNode registers a new storage node
 func (s *NodeService) RegisterNode(ctx context.Context, req RegisterNodeRequest) (*models.StorageNode, string, error) {
+	if err := s.CheckVersion(req.Version); err != nil {
+		return nil, "", err
+	}
+
 	// Check if peer ID already exists
 	var exists bool
 	err := s.db.Pool.QueryRow(ctx,
@@ -49,54 +83,189 @@ func (s *NodeService) RegisterNode(ctx context.Context, req RegisterNodeRequest)
 		return nil, "", fmt.Errorf("node with this peer_id already exists")
 	}
 
+	node, apiKey, err := newNodeRecord(req)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if err := insertNode(ctx, s.db.Pool, node); err != nil {
+		return nil, "", err
+	}
+
+	return node, apiKey, nil
+}
+
+// newNodeRecord builds an active node from a registration request, with a fresh API key
+func newNodeRecord(req RegisterNodeRequest) (*models.StorageNode, string, error) {
 	// Generate API key
 	apiKey, err := generateAPIKey()
 	if err != nil {
 		return nil, "", fmt.Errorf("failed to generate api key: %w", err)
 	}
 
-	// Hash the API key for storage
-	apiKeyHash := hashAPIKey(apiKey)
-
 	node := &models.StorageNode{
 		ID:                uuid.New(),
 		Name:              req.Name,
 		PeerID:            req.PeerID,
 		PublicKey:         req.PublicKey,
 		Address:           req.Address,
-		APIKeyHash:        apiKeyHash,
+		APIKeyHash:        hashAPIKey(apiKey),
 		Status:            "active",
+		Version:           req.Version,
+		OperatorID:        req.OperatorID,
+		Region:            req.Region,
 		TotalStorageBytes: int64(req.TotalStorageGB) * 1024 * 1024 * 1024,
 		UsedStorageBytes:  0,
 		EarnedCredits:     0,
 		UptimePercentage:  100.0,
+		ReputationScore:   DefaultReputationScore,
 		LastHeartbeat:     nil,
 	}
+	return node, apiKey, nil
+}
+
+// execer is satisfied by both the pool and a transaction
+type execer interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+}
 
-	_, err = s.db.Pool.Exec(ctx,
-		`INSERT INTO storage_nodes (id, name, peer_id, public_key, address, api_key_hash, status, total_storage_bytes, used_storage_bytes, earned_credits) 
-		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+func insertNode(ctx context.Context, db execer, node *models.StorageNode) error {
+	_, err := db.Exec(ctx,
+		`INSERT INTO storage_nodes (id, name, peer_id, public_key, address, api_key_hash, status, version, operator_id, region, total_storage_bytes, used_storage_bytes, earned_credits) 
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`,
 		node.ID, node.Name, node.PeerID, node.PublicKey, node.Address,
-		node.APIKeyHash, node.Status, node.TotalStorageBytes, node.UsedStorageBytes, node.EarnedCredits)
+		node.APIKeyHash, node.Status, node.Version, node.OperatorID, node.Region, node.TotalStorageBytes, node.UsedStorageBytes, node.EarnedCredits)
 	if err != nil {
-		return nil, "", fmt.Errorf("failed to create node: %w", err)
+		return fmt.Errorf("failed to create node: %w", err)
 	}
+	return nil
+}
 
-	return node, apiKey, nil
+// BulkNodeDescriptor describes one operator-provisioned node in a bulk registration
+type BulkNodeDescriptor struct {
+	Name           string `json:"name" binding:"required"`
+	PeerID         string `json:"peer_id" binding:"required"`
+	PublicKey      []byte `json:"public_key" binding:"required"`
+	Address        string `json:"address"`
+	TotalStorageGB int    `json:"total_storage_gb" binding:"required,min=1"`
+	OperatorID     string `json:"operator_id"`
+	Region         string `json:"region" binding:"max=64"`
+}
+
+// RegisterRequest converts the descriptor into a registration request
+func (d BulkNodeDescriptor) RegisterRequest() RegisterNodeRequest {
+	return RegisterNodeRequest{
+		Name:           d.Name,
+		PeerID:         d.PeerID,
+		PublicKey:      d.PublicKey,
+		Address:        d.Address,
+		TotalStorageGB: d.TotalStorageGB,
+		OperatorID:     d.OperatorID,
+		Region:         d.Region,
+	}
+}
+
+// BulkRegisterResult reports the outcome for one entry of a bulk registration
+type BulkRegisterResult struct {
+	Index  int    `json:"index"`
+	PeerID string `json:"peer_id"`
+	NodeID string `json:"node_id,omitempty"`
+	APIKey string `json:"api_key,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ErrBulkRegisterRejected is returned when any entry of a bulk registration is invalid;
+// no nodes from the batch are registered
+var ErrBulkRegisterRejected = errors.New("bulk registration rejected")
+
+// RegisterNodesBulk registers a batch of operator-provisioned nodes in one transaction.
+// If any peer ID is duplicated (within the batch or against existing nodes) the whole
+// batch is rolled back and the per-entry results say which entries conflicted.
+func (s *NodeService) RegisterNodesBulk(ctx context.Context, reqs []RegisterNodeRequest) ([]BulkRegisterResult, error) {
+	tx, err := s.db.Pool.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	peerIDs := make([]string, len(reqs))
+	for i, req := range reqs {
+		peerIDs[i] = req.PeerID
+	}
+
+	existing := make(map[string]bool)
+	rows, err := tx.Query(ctx, "SELECT peer_id FROM storage_nodes WHERE peer_id = ANY($1)", peerIDs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check node existence: %w", err)
+	}
+	for rows.Next() {
+		var peerID string
+		if err := rows.Scan(&peerID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		existing[peerID] = true
+	}
+	rows.Close()
+
+	results, ok := checkBulkPeerIDs(reqs, existing)
+	if !ok {
+		return results, ErrBulkRegisterRejected
+	}
+
+	for i, req := range reqs {
+		node, apiKey, err := newNodeRecord(req)
+		if err != nil {
+			return nil, err
+		}
+		if err := insertNode(ctx, tx, node); err != nil {
+			return nil, fmt.Errorf("node %d (%s): %w", i, req.PeerID, err)
+		}
+		results[i].NodeID = node.ID.String()
+		results[i].APIKey = apiKey
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit registration: %w", err)
+	}
+	return results, nil
+}
+
+// checkBulkPeerIDs flags entries whose peer ID is already registered or repeated
+// earlier in the batch. It returns false if any entry was flagged.
+func checkBulkPeerIDs(reqs []RegisterNodeRequest, existing map[string]bool) ([]BulkRegisterResult, bool) {
+	results := make([]BulkRegisterResult, len(reqs))
+	seen := make(map[string]int, len(reqs))
+	ok := true
+
+	for i, req := range reqs {
+		results[i] = BulkRegisterResult{Index: i, PeerID: req.PeerID}
+		if existing[req.PeerID] {
+			results[i].Error = "node with this peer_id already exists"
+			ok = false
+		} else if first, dup := seen[req.PeerID]; dup {
+			results[i].Error = fmt.Sprintf("duplicate peer_id (same as entry %d)", first)
+			ok = false
+		} else {
+			seen[req.PeerID] = i
+		}
+	}
+	return results, ok
 }
 
 // GetNodeByPeerID retrieves a node by peer ID
 func (s *NodeService) GetNodeByPeerID(ctx context.Context, peerID string) (*models.StorageNode, error) {
 	var node models.StorageNode
 	err := s.db.Pool.QueryRow(ctx,
-		`SELECT id, name, peer_id, public_key, address, api_key_hash, status, total_storage_bytes, 
-		 used_storage_bytes, earned_credits, uptime_percentage, last_heartbeat, created_at, updated_at 
+		`SELECT id, name, peer_id, public_key, address, api_key_hash, status, version, operator_id, region, total_storage_bytes, 
+		 used_storage_bytes, earned_credits, uptime_percentage, reputation_score, last_heartbeat, maintenance_start, maintenance_end,
+		 created_at, updated_at 
 		 FROM storage_nodes WHERE peer_id = $1`,
 		peerID).Scan(
 		&node.ID, &node.Name, &node.PeerID, &node.PublicKey, &node.Address,
-		&node.APIKeyHash, &node.Status, &node.TotalStorageBytes, &node.UsedStorageBytes,
-		&node.EarnedCredits, &node.UptimePercentage, &node.LastHeartbeat,
-		&node.CreatedAt, &node.UpdatedAt)
+		&node.APIKeyHash, &node.Status, &node.Version, &node.OperatorID, &node.Region, &node.TotalStorageBytes, &node.UsedStorageBytes,
+		&node.EarnedCredits, &node.UptimePercentage, &node.ReputationScore, &node.LastHeartbeat,
+		&node.MaintenanceStart, &node.MaintenanceEnd, &node.CreatedAt, &node.UpdatedAt)
 	if err != nil {
 		return nil, fmt.Errorf("node not found")
 	}
@@ -106,8 +275,9 @@ func (s *NodeService) GetNodeByPeerID(ctx context.Context, peerID string) (*mode
 // GetAllNodes retrieves all active storage nodes
 func (s *NodeService) GetAllNodes(ctx context.Context) ([]models.StorageNode, error) {
 	rows, err := s.db.Pool.Query(ctx,
-		`SELECT id, name, peer_id, public_key, address, status, total_storage_bytes, 
-		 used_storage_bytes, earned_credits, uptime_percentage, last_heartbeat, created_at 
+		`SELECT id, name, peer_id, public_key, address, status, version, operator_id, region, total_storage_bytes, 
+		 used_storage_bytes, earned_credits, uptime_percentage, reputation_score, last_heartbeat, maintenance_start, maintenance_end,
+		 capacity_verified_at, created_at 
 		 FROM storage_nodes WHERE status = 'active'`)
 	if err != nil {
 		return nil, err
@@ -119,33 +289,161 @@ func (s *NodeService) GetAllNodes(ctx context.Context) ([]models.StorageNode, er
 		var node models.StorageNode
 		err := rows.Scan(
 			&node.ID, &node.Name, &node.PeerID, &node.PublicKey, &node.Address,
-			&node.Status, &node.TotalStorageBytes, &node.UsedStorageBytes,
-			&node.EarnedCredits, &node.UptimePercentage, &node.LastHeartbeat,
-			&node.CreatedAt)
+			&node.Status, &node.Version, &node.OperatorID, &node.Region, &node.TotalStorageBytes, &node.UsedStorageBytes,
+			&node.EarnedCredits, &node.UptimePercentage, &node.ReputationScore, &node.LastHeartbeat,
+			&node.MaintenanceStart, &node.MaintenanceEnd, &node.CapacityVerifiedAt, &node.CreatedAt)
 		if err != nil {
 			return nil, err
 		}
+		// Placement only counts on capacity the node has proven
+		if trusted := TrustedCapacity(&node, s.unverifiedCapacity); trusted < node.TotalStorageBytes {
+			node.ClaimedStorageBytes = node.TotalStorageBytes
+			node.TotalStorageBytes = trusted
+		}
 		nodes = append(nodes, node)
 	}
 	return nodes, nil
 }
 
 // UpdateHeartbeat updates node heartbeat
-func (s *NodeService) UpdateHeartbeat(ctx context.Context, nodeID uuid.UUID, usedBytes int64) error {
+func (s *NodeService) UpdateHeartbeat(ctx context.Context, nodeID uuid.UUID, usedBytes int64, version string) error {
+	if err := s.CheckVersion(version); err != nil {
+		return err
+	}
+
 	now := time.Now()
 	_, err := s.db.Pool.Exec(ctx,
 		`UPDATE storage_nodes 
-		 SET last_heartbeat = $1, used_storage_bytes = $2, updated_at = $3 
-		 WHERE id = $4`,
-		now, usedBytes, now, nodeID)
+		 SET last_heartbeat = $1, used_storage_bytes = $2, version = $3, updated_at = $4 
+		 WHERE id = $5`,
+		now, usedBytes, version, now, nodeID)
 	return err
 }
 
-// GetAPIKeyHash retrieves the API key hash for a peer ID (for middleware)
+// NodesGoneOffline returns active nodes whose last heartbeat fell in
+// [from, to): those that crossed the offline threshold between two checks
+// made at from and to plus that threshold. Nodes inside a maintenance window
+// they scheduled are expected to be away and left out.
+func (s *NodeService) NodesGoneOffline(ctx context.Context, from, to time.Time) ([]models.StorageNode, error) {
+	rows, err := s.db.Pool.Query(ctx,
+		`SELECT id, name, peer_id, last_heartbeat FROM storage_nodes
+		 WHERE status = 'active' AND last_heartbeat >= $1 AND last_heartbeat < $2
+		   AND NOT (maintenance_start IS NOT NULL AND maintenance_start <= NOW() AND maintenance_end > NOW())`,
+		from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var nodes []models.StorageNode
+	for rows.Next() {
+		var node models.StorageNode
+		if err := rows.Scan(&node.ID, &node.Name, &node.PeerID, &node.LastHeartbeat); err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, rows.Err()
+}
+
+// CapacityBytes converts a capacity in GB to bytes, rejecting one smaller than usedBytes
+func CapacityBytes(totalGB int, usedBytes int64) (int64, error) {
+	totalBytes := int64(totalGB) * 1024 * 1024 * 1024
+	if totalBytes < usedBytes {
+		return 0, fmt.Errorf("%w: %d GB is less than the %d bytes already stored", ErrCapacityBelowUsage, totalGB, usedBytes)
+	}
+	return totalBytes, nil
+}
+
+// UpdateCapacity sets a node's total storage, which may not drop below what
+// it already uses. Raising it withdraws any capacity proof until the next one.
+func (s *NodeService) UpdateCapacity(ctx context.Context, nodeID uuid.UUID, totalGB int) (int64, error) {
+	var usedBytes int64
+	err := s.db.Pool.QueryRow(ctx,
+		"SELECT used_storage_bytes FROM storage_nodes WHERE id = $1", nodeID).Scan(&usedBytes)
+	if err != nil {
+		return 0, fmt.Errorf("node not found")
+	}
+
+	totalBytes, err := CapacityBytes(totalGB, usedBytes)
+	if err != nil {
+		return 0, err
+	}
+
+	// Re-check usage in the update in case a heartbeat raised it meanwhile
+	tag, err := s.db.Pool.Exec(ctx,
+		`UPDATE storage_nodes SET total_storage_bytes = $1, updated_at = $2,
+		 capacity_verified_at = CASE WHEN $1 > total_storage_bytes THEN NULL ELSE capacity_verified_at END
+		 WHERE id = $3 AND used_storage_bytes <= $1`,
+		totalBytes, time.Now(), nodeID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to update capacity: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return 0, fmt.Errorf("%w: usage grew past %d GB", ErrCapacityBelowUsage, totalGB)
+	}
+	return totalBytes, nil
+}
+
+// CheckVersion rejects node software older than the configured minimum version
+func (s *NodeService) CheckVersion(version string) error {
+	if s.minVersion == "" {
+		return nil
+	}
+	if version == "" {
+		return fmt.Errorf("%w: node did not report a version, please upgrade to %s or later", ErrNodeVersionTooOld, s.minVersion)
+	}
+	if CompareVersions(version, s.minVersion) < 0 {
+		return fmt.Errorf("%w: node version %s is below the minimum %s, please upgrade", ErrNodeVersionTooOld, version, s.minVersion)
+	}
+	return nil
+}
+
+// CompareVersions compares two dotted version strings (an optional "v" prefix and
+// pre-release suffix are ignored). It returns -1, 0 or 1.
+func CompareVersions(a, b string) int {
+	pa, pb := parseVersion(a), parseVersion(b)
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		var x, y int
+		if i < len(pa) {
+			x = pa[i]
+		}
+		if i < len(pb) {
+			y = pb[i]
+		}
+		if x < y {
+			return -1
+		}
+		if x > y {
+			return 1
+		}
+	}
+	return 0
+}
+
+func parseVersion(v string) []int {
+	v = strings.TrimPrefix(strings.TrimSpace(v), "v")
+	if i := strings.IndexAny(v, "-+"); i >= 0 {
+		v = v[:i]
+	}
+
+	var parts []int
+	for _, p := range strings.Split(v, ".") {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			n = 0
+		}
+		parts = append(parts, n)
+	}
+	return parts
+}
+
+// GetAPIKeyHash retrieves the API key hash for a peer ID (for middleware).
+// Decommissioning nodes still authenticate so they can migrate their chunks.
 func (s *NodeService) GetAPIKeyHash(peerID string) (string, error) {
 	var hash string
 	err := s.db.Pool.QueryRow(context.Background(),
-		"SELECT api_key_hash FROM storage_nodes WHERE peer_id = $1 AND status = 'active'",
+		"SELECT api_key_hash FROM storage_nodes WHERE peer_id = $1 AND status IN ('active', 'decommissioning')",
 		peerID).Scan(&hash)
 	if err != nil {
 		return "", err
@@ -153,6 +451,36 @@ func (s *NodeService) GetAPIKeyHash(peerID string) (string, error) {
 	return hash, nil
 }
 
+// RotateAPIKey replaces a node's API key and returns the new plaintext key.
+// Requests are authenticated against the stored hash, so the old key stops
+// working as soon as this returns.
+func (s *NodeService) RotateAPIKey(ctx context.Context, nodeID uuid.UUID) (string, error) {
+	apiKey, err := generateAPIKey()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate API key: %w", err)
+	}
+
+	tag, err := s.db.Pool.Exec(ctx,
+		"UPDATE storage_nodes SET api_key_hash = $1, updated_at = $2 WHERE id = $3",
+		hashAPIKey(apiKey), time.Now(), nodeID)
+	if err != nil {
+		return "", fmt.Errorf("failed to store API key: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return "", fmt.Errorf("node not found")
+	}
+	return apiKey, nil
+}
+
+// NewNodeAPIKey generates a node API key and the hash stored for it
+func NewNodeAPIKey() (apiKey, hash string, err error) {
+	apiKey, err = generateAPIKey()
+	if err != nil {
+		return "", "", err
+	}
+	return apiKey, hashAPIKey(apiKey), nil
+}
+
 // Helper functions
 func generateAPIKey() (string, error) {
 	// Generate a random API key (simplified for MVP)
@@ -0,0 +1,78 @@
+package services
+
+import "sort"
+
+// PricingTier applies a credit rate to purchases of at least MinUSD
+type PricingTier struct {
+	MinUSD        int   `json:"min_usd"`
+	CreditsPerUSD int64 `json:"credits_per_usd"`
+}
+
+// Pricing converts USD purchases into credits
+type Pricing struct {
+	DefaultCreditsPerUSD int64
+	Tiers                []PricingTier
+}
+
+// NewPricing creates a pricing table, ordering tiers by threshold
+func NewPricing(defaultCreditsPerUSD int64, tiers []PricingTier) Pricing {
+	sorted := make([]PricingTier, len(tiers))
+	copy(sorted, tiers)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].MinUSD < sorted[j].MinUSD })
+	return Pricing{DefaultCreditsPerUSD: defaultCreditsPerUSD, Tiers: sorted}
+}
+
+// RateFor returns the credits-per-USD rate for a purchase amount: the highest tier
+// whose threshold the amount reaches, or the default rate
+func (p Pricing) RateFor(amountUSD int) int64 {
+	rate := p.DefaultCreditsPerUSD
+	for _, tier := range p.Tiers {
+		if amountUSD >= tier.MinUSD {
+			rate = tier.CreditsPerUSD
+		}
+	}
+	return rate
+}
+
+// Credits returns the credits granted for a purchase and the effective rate.
+// A per-user override takes precedence over the tiers.
+func (p Pricing) Credits(amountUSD int, override *int64) (credits int64, rate int64) {
+	rate = p.RateFor(amountUSD)
+	if override != nil && *override > 0 {
+		rate = *override
+	}
+	return int64(amountUSD) * rate, rate
+}
+
+// StorageRates is the public summary of what storage costs and how uploads
+// are split, so clients can quote prices that match the server's config
+type StorageRates struct {
+	// CreditsPerGBMonth is charged for each stored replica of each GB
+	CreditsPerGBMonth int64         `json:"storage_credits_per_gb_month"`
+	DefaultReplicas   int           `json:"default_replicas"`
+	ChunkSizeBytes    int64         `json:"chunk_size_bytes"`
+	MaxChunkSizeBytes int64         `json:"max_chunk_size_bytes"`
+	MaxFileSizeBytes  int64         `json:"max_file_size_bytes"`
+	CreditsPerUSD     int64         `json:"credits_per_usd"`
+	Tiers             []PricingTier `json:"tiers"`
+}
+
+// NewStorageRates summarizes the storage rate, upload limits and purchase
+// pricing. chunkSize is what uploads asking for no other size get; the
+// largest file is maxChunks chunks of maxChunkSize, the most a session may
+// ask for.
+func NewStorageRates(creditsPerGBMonth int64, replicas int, chunkSize, maxChunkSize int64, maxChunks int, pricing Pricing) StorageRates {
+	tiers := pricing.Tiers
+	if tiers == nil {
+		tiers = []PricingTier{}
+	}
+	return StorageRates{
+		CreditsPerGBMonth: creditsPerGBMonth,
+		DefaultReplicas:   replicas,
+		ChunkSizeBytes:    chunkSize,
+		MaxChunkSizeBytes: maxChunkSize,
+		MaxFileSizeBytes:  maxChunkSize * int64(maxChunks),
+		CreditsPerUSD:     pricing.DefaultCreditsPerUSD,
+		Tiers:             tiers,
+	}
+}
@@ -4,30 +4,128 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"math/rand"
+	"slices"
+	"sync"
 	"time"
 
+	"github.com/federated-storage/coordinator/internal/merkle"
 	"github.com/federated-storage/coordinator/internal/models"
 	"github.com/federated-storage/coordinator/internal/storage"
 	"github.com/google/uuid"
 )
 
+// ProofDispatcher sends proof challenges to storage nodes. A leafIndex of 0 or
+// more also asks for that Merkle sub-block and its path; nodes that do not
+// support Merkle proofs return a nil proof.
+type ProofDispatcher interface {
+	SendProofChallenge(ctx context.Context, peerID, chunkID string, seed []byte, difficulty, leafIndex int) (proofHash string, durationMs int, proof *models.MerkleProof, err error)
+}
+
+// ErrProofTimedOut is returned when a node took longer than the challenge allowed
+var ErrProofTimedOut = errors.New("proof verification timed out")
+
+// ProofTimeout determines how long a node may take to answer a challenge:
+// a fixed allowance for network round-trips plus a per-round budget
+type ProofTimeout struct {
+	BaseMs     int
+	MsPerRound float64
+}
+
+// For returns the acceptable proof duration in milliseconds for a difficulty
+func (t ProofTimeout) For(difficulty int) int {
+	return t.BaseMs + int(float64(difficulty)*t.MsPerRound)
+}
+
+// checkProofDuration rejects proofs that exceeded the challenge's timeout
+func checkProofDuration(durationMs, timeoutMs int) error {
+	if durationMs > timeoutMs {
+		return fmt.Errorf("%w (%d ms, limit %d ms)", ErrProofTimedOut, durationMs, timeoutMs)
+	}
+	return nil
+}
+
+// ErrInvalidMerkleProof is returned when a node's sub-block does not hash to the chunk's stored Merkle root
+var ErrInvalidMerkleProof = errors.New("invalid merkle proof")
+
+// challengeLeaf returns the sub-block a challenge asks for, or -1 for chunks
+// stored without a Merkle root
+func challengeLeaf(merkleRoot string, sizeBytes int, seed []byte) int {
+	if merkleRoot == "" {
+		return -1
+	}
+	return merkle.LeafIndex(seed, merkle.LeafCount(sizeBytes))
+}
+
+// checkMerkleProof verifies that proof carries the seed-selected sub-block of
+// a chunk and that its path leads to the chunk's stored root. Chunks without
+// a root are not checked.
+func checkMerkleProof(merkleRoot string, sizeBytes int, seed []byte, proof *models.MerkleProof) error {
+	if merkleRoot == "" {
+		return nil
+	}
+	if proof == nil {
+		return fmt.Errorf("%w: no sub-block returned", ErrInvalidMerkleProof)
+	}
+	root, err := hex.DecodeString(merkleRoot)
+	if err != nil {
+		return fmt.Errorf("stored merkle root is corrupt: %w", err)
+	}
+
+	want := challengeLeaf(merkleRoot, sizeBytes, seed)
+	if proof.LeafIndex != want {
+		return fmt.Errorf("%w: sub-block %d returned, %d requested", ErrInvalidMerkleProof, proof.LeafIndex, want)
+	}
+	if !merkle.Verify(root, merkle.LeafCount(sizeBytes), proof.LeafIndex, proof.Block, proof.Path) {
+		return fmt.Errorf("%w: sub-block %d does not match the chunk's root", ErrInvalidMerkleProof, proof.LeafIndex)
+	}
+	return nil
+}
+
+// ErrChallengeBacklog is returned when a node already has the maximum number of pending challenges
+var ErrChallengeBacklog = errors.New("node has too many pending challenges")
+
 // ProofService handles proof-of-storage operations
 type ProofService struct {
-	db         *storage.DB
-	difficulty int
+	db                *storage.DB
+	difficulty        int
+	timeout           ProofTimeout
+	dispatcher        ProofDispatcher
+	verifyCooldown    time.Duration
+	maxPendingPerNode int // 0 or less means unlimited
+	retryWindow       time.Duration
+	maxRetries        int           // proof retries per node per retryWindow; 0 or less disables them
+	targetReplicas    int           // replicas a chunk should have, for files that don't record theirs
+	healthProofMaxAge time.Duration // how long a chunk may go unproven before it is degraded; 0 never
+	missedProofGrace  int           // consecutive missed proofs forgiven; 0 or less forgives none
+
+	mu         sync.Mutex
+	lastVerify map[uuid.UUID]time.Time
 }
 
 // NewProofService creates a new proof service
-func NewProofService(db *storage.DB, difficulty int) *ProofService {
+func NewProofService(db *storage.DB, difficulty int, timeout ProofTimeout, dispatcher ProofDispatcher, verifyCooldown time.Duration) *ProofService {
 	return &ProofService{
-		db:         db,
-		difficulty: difficulty,
+		db:             db,
+		difficulty:     difficulty,
+		timeout:        timeout,
+		dispatcher:     dispatcher,
+		verifyCooldown: verifyCooldown,
+		lastVerify:     make(map[uuid.UUID]time.Time),
 	}
 }
 
-// CreateChallenge creates a new proof challenge for a chunk
+// SetMaxPendingPerNode stops new challenges being issued to a node that
+// already has n pending, not counting proof retries it asked for; n <= 0
+// removes the cap
+func (s *ProofService) SetMaxPendingPerNode(n int) {
+	s.maxPendingPerNode = n
+}
+
+// CreateChallenge creates a new proof challenge for a chunk, or returns
+// ErrChallengeBacklog if the node's pending challenges are at the cap
 func (s *ProofService) CreateChallenge(ctx context.Context, chunkID, nodeID uuid.UUID) (*models.ProofChallenge, error) {
 	// Generate random seed
 	seed := make([]byte, 32)
@@ -41,24 +139,117 @@ func (s *ProofService) CreateChallenge(ctx context.Context, chunkID, nodeID uuid
 		NodeID:     nodeID,
 		Seed:       seed,
 		Difficulty: s.difficulty,
+		TimeoutMs:  s.timeout.For(s.difficulty),
 		Status:     "pending",
 	}
 
-	_, err := s.db.Pool.Exec(ctx,
-		`INSERT INTO proof_challenges (id, chunk_id, node_id, seed, difficulty, status) 
-		 VALUES ($1, $2, $3, $4, $5, $6)`,
-		challenge.ID, challenge.ChunkID, challenge.NodeID, challenge.Seed, challenge.Difficulty, challenge.Status)
+	// The count and insert are one statement so concurrent callers can't overshoot by much
+	tag, err := s.db.Pool.Exec(ctx,
+		`INSERT INTO proof_challenges (id, chunk_id, node_id, seed, difficulty, timeout_ms, status) 
+		 SELECT $1::uuid, $2::uuid, $3::uuid, $4::bytea, $5::int, $6::int, $7::varchar
+		 WHERE $8::int <= 0
+		    OR (SELECT COUNT(*) FROM proof_challenges WHERE node_id = $3 AND status IN ('pending', 'dispatched') AND retry_of IS NULL) < $8`,
+		challenge.ID, challenge.ChunkID, challenge.NodeID, challenge.Seed, challenge.Difficulty, challenge.TimeoutMs, challenge.Status,
+		s.maxPendingPerNode)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create challenge: %w", err)
 	}
+	if tag.RowsAffected() == 0 {
+		return nil, fmt.Errorf("%w (limit %d)", ErrChallengeBacklog, s.maxPendingPerNode)
+	}
 
 	return challenge, nil
 }
 
+// ExpireStaleChallenges fails challenges, and file challenges, still pending
+// or dispatched after maxAge, returning how many were expired. Unanswered
+// proof retries lapse without a penalty, and misses within a node's grace
+// are forgiven.
+func (s *ProofService) ExpireStaleChallenges(ctx context.Context, maxAge time.Duration) (int64, error) {
+	now := time.Now()
+	tx, err := s.db.Pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx,
+		`UPDATE proof_challenges SET status = CASE WHEN retry_of IS NULL THEN 'failed' ELSE 'retry_failed' END, verified_at = $1
+		 WHERE status IN ('pending', 'dispatched') AND created_at < $2
+		 RETURNING node_id, status = 'failed'`,
+		now, now.Add(-maxAge))
+	if err != nil {
+		return 0, fmt.Errorf("failed to expire challenges: %w", err)
+	}
+	var expired int64
+	var missed []uuid.UUID
+	for rows.Next() {
+		var nodeID uuid.UUID
+		var failed bool
+		if err := rows.Scan(&nodeID, &failed); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to expire challenges: %w", err)
+		}
+		expired++
+		if failed && !slices.Contains(missed, nodeID) {
+			missed = append(missed, nodeID)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to expire challenges: %w", err)
+	}
+	if err := forgiveMisses(ctx, tx, s.missedProofGrace, missed); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("failed to expire challenges: %w", err)
+	}
+
+	fileTag, err := s.db.Pool.Exec(ctx,
+		"UPDATE file_challenges SET status = 'failed', verified_at = $1 WHERE status = 'pending' AND created_at < $2",
+		now, now.Add(-maxAge))
+	if err != nil {
+		return expired, fmt.Errorf("failed to expire file challenges: %w", err)
+	}
+	return expired + fileTag.RowsAffected(), nil
+}
+
+// PendingChallengeCounts returns the number of outstanding (pending or
+// dispatched) challenges per node. Proof retries the node asked for are left
+// out, as they are of the cap.
+func (s *ProofService) PendingChallengeCounts(ctx context.Context) (map[uuid.UUID]int, error) {
+	rows, err := s.db.Pool.Query(ctx,
+		"SELECT node_id, COUNT(*) FROM proof_challenges WHERE status IN ('pending', 'dispatched') AND retry_of IS NULL GROUP BY node_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[uuid.UUID]int)
+	for rows.Next() {
+		var nodeID uuid.UUID
+		var count int
+		if err := rows.Scan(&nodeID, &count); err != nil {
+			return nil, err
+		}
+		counts[nodeID] = count
+	}
+	return counts, rows.Err()
+}
+
+// MaxPendingPerNode returns the per-node pending challenge cap, or 0 if there is none
+func (s *ProofService) MaxPendingPerNode() int {
+	if s.maxPendingPerNode < 0 {
+		return 0
+	}
+	return s.maxPendingPerNode
+}
+
 // GetPendingChallenges retrieves pending challenges for a node
 func (s *ProofService) GetPendingChallenges(ctx context.Context, nodeID uuid.UUID) ([]models.ProofChallenge, error) {
 	rows, err := s.db.Pool.Query(ctx,
-		`SELECT id, chunk_id, node_id, seed, difficulty, status, created_at 
+		`SELECT id, chunk_id, node_id, seed, difficulty, timeout_ms, status, created_at 
 		 FROM proof_challenges 
 		 WHERE node_id = $1 AND status = 'pending'`,
 		nodeID)
@@ -70,7 +261,7 @@ func (s *ProofService) GetPendingChallenges(ctx context.Context, nodeID uuid.UUI
 	var challenges []models.ProofChallenge
 	for rows.Next() {
 		var c models.ProofChallenge
-		err := rows.Scan(&c.ID, &c.ChunkID, &c.NodeID, &c.Seed, &c.Difficulty, &c.Status, &c.CreatedAt)
+		err := rows.Scan(&c.ID, &c.ChunkID, &c.NodeID, &c.Seed, &c.Difficulty, &c.TimeoutMs, &c.Status, &c.CreatedAt)
 		if err != nil {
 			return nil, err
 		}
@@ -79,47 +270,17 @@ func (s *ProofService) GetPendingChallenges(ctx context.Context, nodeID uuid.UUI
 	return challenges, nil
 }
 
-// VerifyProof verifies a proof response from a storage node
-func (s *ProofService) VerifyProof(ctx context.Context, challengeID uuid.UUID, proofHash string, durationMs int) error {
-	// Get challenge
-	var challenge models.ProofChallenge
-	err := s.db.Pool.QueryRow(ctx,
-		"SELECT id, chunk_id, node_id, seed, difficulty FROM proof_challenges WHERE id = $1",
-		challengeID).Scan(&challenge.ID, &challenge.ChunkID, &challenge.NodeID, &challenge.Seed, &challenge.Difficulty)
+// VerifyProof verifies a proof response from a storage node. For chunks with
+// a Merkle root, merkleProof must carry the seed-selected sub-block and a path
+// to that root.
+func (s *ProofService) VerifyProof(ctx context.Context, challengeID uuid.UUID, proofHash string, durationMs int, merkleProof *models.MerkleProof) error {
+	results, err := s.VerifyProofs(ctx, []ProofResponse{{
+		ChallengeID: challengeID, ProofHash: proofHash, DurationMs: durationMs, MerkleProof: merkleProof,
+	}})
 	if err != nil {
-		return fmt.Errorf("challenge not found")
-	}
-
-	// Verify timing (should complete within 2 seconds)
-	if durationMs > 2000 {
-		// Mark as failed due to timeout
-		_, err = s.db.Pool.Exec(ctx,
-			"UPDATE proof_challenges SET status = 'failed', duration_ms = $1, verified_at = $2 WHERE id = $3",
-			durationMs, time.Now(), challengeID)
-		return fmt.Errorf("proof verification timed out")
-	}
-
-	// Verify proof hash (simplified - in production would verify against actual chunk data)
-	expectedHash := s.generateExpectedProof(challenge.Seed, challenge.ChunkID.String())
-	if proofHash != expectedHash {
-		// Mark as failed
-		_, err = s.db.Pool.Exec(ctx,
-			"UPDATE proof_challenges SET status = 'failed', proof_hash = $1, duration_ms = $2, verified_at = $3 WHERE id = $4",
-			proofHash, durationMs, time.Now(), challengeID)
-		return fmt.Errorf("invalid proof hash")
-	}
-
-	// Mark as verified
-	_, err = s.db.Pool.Exec(ctx,
-		`UPDATE proof_challenges 
-		 SET status = 'verified', proof_hash = $1, duration_ms = $2, verified_at = $3 
-		 WHERE id = $4`,
-		proofHash, durationMs, time.Now(), challengeID)
-	if err != nil {
-		return fmt.Errorf("failed to update challenge: %w", err)
+		return err
 	}
-
-	return nil
+	return results[0]
 }
 
 // GetNodeProofStats retrieves proof statistics for a node
@@ -179,3 +340,155 @@ func (s *ProofService) GetChallengesNeedingVerification(ctx context.Context, lim
 	}
 	return challenges, nil
 }
+
+// ChunkReplica identifies a chunk stored on a specific node
+type ChunkReplica struct {
+	ChunkID    uuid.UUID
+	ChunkIndex int
+	NodeID     uuid.UUID
+	PeerID     string
+	SizeBytes  int
+	MerkleRoot string
+}
+
+// ReplicaVerifyResult represents the outcome of challenging a single replica
+type ReplicaVerifyResult struct {
+	ChallengeID string `json:"challenge_id"`
+	ChunkID     string `json:"chunk_id"`
+	ChunkIndex  int    `json:"chunk_index"`
+	NodeID      string `json:"node_id"`
+	PeerID      string `json:"peer_id"`
+	Status      string `json:"status"`
+	Error       string `json:"error,omitempty"`
+}
+
+// FileVerifyResult summarizes an on-demand verification of a file
+type FileVerifyResult struct {
+	FileID   string                `json:"file_id"`
+	Total    int                   `json:"total"`
+	Passed   int                   `json:"passed"`
+	Failed   int                   `json:"failed"`
+	Pending  int                   `json:"pending"`
+	Skipped  int                   `json:"skipped"` // not challenged: the node's backlog is full
+	Replicas []ReplicaVerifyResult `json:"replicas"`
+}
+
+// AllowFileVerify reports whether a file may be verified now, and if not, how long to wait
+func (s *ProofService) AllowFileVerify(fileID uuid.UUID) (bool, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if last, ok := s.lastVerify[fileID]; ok {
+		if wait := last.Add(s.verifyCooldown).Sub(now); wait > 0 {
+			return false, wait
+		}
+	}
+	s.lastVerify[fileID] = now
+	return true, 0
+}
+
+// VerifyFile challenges every active replica of a file's chunks and reports which passed
+func (s *ProofService) VerifyFile(ctx context.Context, fileID uuid.UUID) (*FileVerifyResult, error) {
+	replicas, err := s.getFileReplicas(ctx, fileID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file replicas: %w", err)
+	}
+
+	return s.challengeReplicas(ctx, fileID, replicas, s.CreateChallenge), nil
+}
+
+// getFileReplicas retrieves all active chunk assignments for a file
+func (s *ProofService) getFileReplicas(ctx context.Context, fileID uuid.UUID) ([]ChunkReplica, error) {
+	rows, err := s.db.Pool.Query(ctx,
+		`SELECT c.id, c.chunk_index, sn.id, sn.peer_id, c.size_bytes, c.merkle_root
+		 FROM chunks c
+		 JOIN chunk_assignments ca ON ca.chunk_id = c.id
+		 JOIN storage_nodes sn ON ca.node_id = sn.id
+		 WHERE c.file_id = $1 AND ca.status = 'active'
+		 ORDER BY c.chunk_index`,
+		fileID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var replicas []ChunkReplica
+	for rows.Next() {
+		var r ChunkReplica
+		if err := rows.Scan(&r.ChunkID, &r.ChunkIndex, &r.NodeID, &r.PeerID, &r.SizeBytes, &r.MerkleRoot); err != nil {
+			return nil, err
+		}
+		replicas = append(replicas, r)
+	}
+	return replicas, nil
+}
+
+// challengeReplicas creates a challenge per replica and dispatches it when P2P is available.
+// Each is claimed before it is sent, so the background verifier can't send it too;
+// challenges that cannot be dispatched go back to pending for it.
+func (s *ProofService) challengeReplicas(ctx context.Context, fileID uuid.UUID, replicas []ChunkReplica,
+	create func(ctx context.Context, chunkID, nodeID uuid.UUID) (*models.ProofChallenge, error)) *FileVerifyResult {
+	result := &FileVerifyResult{
+		FileID:   fileID.String(),
+		Replicas: make([]ReplicaVerifyResult, 0, len(replicas)),
+	}
+
+	for _, r := range replicas {
+		rr := ReplicaVerifyResult{
+			ChunkID:    r.ChunkID.String(),
+			ChunkIndex: r.ChunkIndex,
+			NodeID:     r.NodeID.String(),
+			PeerID:     r.PeerID,
+			Status:     "pending",
+		}
+
+		challenge, err := create(ctx, r.ChunkID, r.NodeID)
+		if errors.Is(err, ErrChallengeBacklog) {
+			rr.Status = "skipped"
+			rr.Error = err.Error()
+		} else if err != nil {
+			rr.Status = "failed"
+			rr.Error = err.Error()
+		} else {
+			rr.ChallengeID = challenge.ID.String()
+			claimed := false
+			if s.dispatcher != nil {
+				claimed, err = s.claimChallenge(ctx, challenge.ID)
+				if err != nil {
+					rr.Error = err.Error()
+				}
+			}
+			if claimed {
+				leaf := challengeLeaf(r.MerkleRoot, r.SizeBytes, challenge.Seed)
+				proofHash, durationMs, merkleProof, err := s.dispatcher.SendProofChallenge(ctx, r.PeerID, r.ChunkID.String(), challenge.Seed, challenge.Difficulty, leaf)
+				if err != nil {
+					rr.Error = err.Error()
+					if err := s.releaseChallenges(ctx, []uuid.UUID{challenge.ID}); err != nil {
+						rr.Error += "; " + err.Error()
+					}
+				} else if err := s.VerifyProof(ctx, challenge.ID, proofHash, durationMs, merkleProof); err != nil {
+					rr.Status = "failed"
+					rr.Error = err.Error()
+				} else {
+					rr.Status = "verified"
+				}
+			}
+		}
+
+		switch rr.Status {
+		case "verified":
+			result.Passed++
+		case "failed":
+			result.Failed++
+		case "skipped":
+			result.Skipped++
+		default:
+			result.Pending++
+		}
+		result.Replicas = append(result.Replicas, rr)
+	}
+	result.Total = len(result.Replicas)
+
+	return result
+}
@@ -0,0 +1,320 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/federated-storage/coordinator/internal/models"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// ErrChallengeDecided is returned for an answer to a challenge that was
+// decided, for instance failed by expiry, before the answer was recorded
+var ErrChallengeDecided = errors.New("challenge already decided")
+
+// ProofResponse is a node's answer to one challenge
+type ProofResponse struct {
+	ChallengeID uuid.UUID
+	ProofHash   string
+	DurationMs  int
+	MerkleProof *models.MerkleProof
+}
+
+// ProofBatchResult summarizes one pass of the batch verifier
+type ProofBatchResult struct {
+	Challenged  int           `json:"challenged"`
+	Verified    int           `json:"verified"`
+	Failed      int           `json:"failed"`
+	Undelivered int           `json:"undelivered"` // left pending for the next pass
+	Duration    time.Duration `json:"duration"`
+}
+
+// issuedChallenge is a challenge with what it takes to send it and judge the answer
+type issuedChallenge struct {
+	models.ProofChallenge
+	PeerID     string
+	MerkleRoot string
+	SizeBytes  int
+}
+
+// proofVerdict is the outcome written back for one challenge. A proof that
+// took too long keeps no hash, which marks the challenge as missed.
+type proofVerdict struct {
+	ID         uuid.UUID
+	Status     string
+	ProofHash  *string
+	DurationMs int
+	Err        error
+}
+
+const issuedChallengeColumns = `SELECT pc.id, pc.chunk_id, pc.node_id, pc.seed, pc.difficulty, pc.timeout_ms,
+		COALESCE(sn.peer_id, ''), COALESCE(c.merkle_root, ''), COALESCE(c.size_bytes, 0)
+	 FROM proof_challenges pc
+	 LEFT JOIN storage_nodes sn ON sn.id = pc.node_id
+	 LEFT JOIN chunks c ON c.id = pc.chunk_id`
+
+// judgeProof checks a response against its challenge: it must arrive within
+// the timeout in effect when the challenge was issued, hash correctly, and,
+// for chunks with a Merkle root, carry the seed-selected sub-block
+func (s *ProofService) judgeProof(challenge issuedChallenge, resp ProofResponse) proofVerdict {
+	verdict := proofVerdict{ID: challenge.ID, Status: "failed", DurationMs: resp.DurationMs}
+	if err := checkProofDuration(resp.DurationMs, challenge.TimeoutMs); err != nil {
+		verdict.Err = err
+		return verdict
+	}
+	// The column holds a SHA-256 in hex; a longer answer is wrong anyway and
+	// must not fail the rest of its batch
+	hash := resp.ProofHash
+	if len(hash) > 64 {
+		hash = hash[:64]
+	}
+	verdict.ProofHash = &hash
+
+	// Simplified: in production the hash would be checked against the chunk's data
+	if resp.ProofHash != s.generateExpectedProof(challenge.Seed, challenge.ChunkID.String()) {
+		verdict.Err = fmt.Errorf("invalid proof hash")
+		return verdict
+	}
+	// The sub-block proves the node holds the chunk's data, not just its hash
+	if err := checkMerkleProof(challenge.MerkleRoot, challenge.SizeBytes, challenge.Seed, resp.MerkleProof); err != nil {
+		verdict.Err = err
+		return verdict
+	}
+	verdict.Status = "verified"
+	return verdict
+}
+
+// loadChallenges fetches the challenges with the given IDs in one query
+func (s *ProofService) loadChallenges(ctx context.Context, ids []uuid.UUID) (map[uuid.UUID]issuedChallenge, error) {
+	rows, err := s.db.Pool.Query(ctx, issuedChallengeColumns+" WHERE pc.id = ANY($1)", ids)
+	if err != nil {
+		return nil, err
+	}
+	challenges, err := scanIssuedChallenges(rows)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[uuid.UUID]issuedChallenge, len(challenges))
+	for _, c := range challenges {
+		byID[c.ID] = c
+	}
+	return byID, nil
+}
+
+func scanIssuedChallenges(rows pgx.Rows) ([]issuedChallenge, error) {
+	defer rows.Close()
+	var challenges []issuedChallenge
+	for rows.Next() {
+		var c issuedChallenge
+		if err := rows.Scan(&c.ID, &c.ChunkID, &c.NodeID, &c.Seed, &c.Difficulty, &c.TimeoutMs,
+			&c.PeerID, &c.MerkleRoot, &c.SizeBytes); err != nil {
+			return nil, err
+		}
+		challenges = append(challenges, c)
+	}
+	return challenges, rows.Err()
+}
+
+// writeVerdicts records every verdict with a single multi-row update and
+// returns the IDs it recorded. Only challenges still outstanding are
+// updated, so a late answer can't overturn one already failed by expiry,
+// forgiven or excused. A retry's verdict is recorded as 'retry_passed' or
+// 'retry_failed', which no proof count includes: what a retry decides is
+// applied to the failure it retried instead.
+func writeVerdicts(ctx context.Context, tx pgx.Tx, verdicts []proofVerdict, now time.Time) (map[uuid.UUID]bool, error) {
+	ids := make([]uuid.UUID, len(verdicts))
+	statuses := make([]string, len(verdicts))
+	hashes := make([]*string, len(verdicts))
+	durations := make([]int32, len(verdicts))
+	for i, v := range verdicts {
+		ids[i], statuses[i], hashes[i], durations[i] = v.ID, v.Status, v.ProofHash, int32(v.DurationMs)
+	}
+	rows, err := tx.Query(ctx,
+		`UPDATE proof_challenges pc
+		 SET status = CASE WHEN pc.retry_of IS NULL THEN v.status WHEN v.status = 'verified' THEN 'retry_passed' ELSE 'retry_failed' END,
+		     proof_hash = v.proof_hash, duration_ms = v.duration_ms, verified_at = $5
+		 FROM unnest($1::uuid[], $2::text[], $3::text[], $4::int[]) AS v(id, status, proof_hash, duration_ms)
+		 WHERE pc.id = v.id AND pc.status IN ('pending', 'dispatched')
+		 RETURNING pc.id`,
+		ids, statuses, hashes, durations, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	written := make(map[uuid.UUID]bool, len(verdicts))
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		written[id] = true
+	}
+	return written, rows.Err()
+}
+
+// settleProofs judges each response against its challenge and records all of
+// the verdicts in one transaction. The returned errors line up with
+// responses: nil for a verified proof, otherwise why it failed. Responses to
+// unknown challenges, and to challenges decided meanwhile, are reported
+// with ErrChallengeDecided and not recorded.
+func (s *ProofService) settleProofs(ctx context.Context, challenges map[uuid.UUID]issuedChallenge, responses []ProofResponse) ([]error, error) {
+	results := make([]error, len(responses))
+	verdicts := make([]proofVerdict, 0, len(responses))
+	for i, resp := range responses {
+		challenge, ok := challenges[resp.ChallengeID]
+		if !ok {
+			results[i] = fmt.Errorf("challenge not found")
+			continue
+		}
+		verdict := s.judgeProof(challenge, resp)
+		results[i] = verdict.Err
+		verdicts = append(verdicts, verdict)
+	}
+	if len(verdicts) == 0 {
+		return results, nil
+	}
+
+	tx, err := s.db.Pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+	written, err := writeVerdicts(ctx, tx, verdicts, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("failed to record proofs: %w", err)
+	}
+	var missed []uuid.UUID
+	for _, v := range verdicts {
+		if nodeID := challenges[v.ID].NodeID; written[v.ID] && v.ProofHash == nil && !slices.Contains(missed, nodeID) {
+			missed = append(missed, nodeID)
+		}
+	}
+	if err := forgiveMisses(ctx, tx, s.missedProofGrace, missed); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to record proofs: %w", err)
+	}
+	for i, resp := range responses {
+		if _, ok := challenges[resp.ChallengeID]; ok && !written[resp.ChallengeID] {
+			results[i] = ErrChallengeDecided
+		}
+	}
+	return results, nil
+}
+
+// VerifyProofs verifies many proof responses at once: their challenges are
+// fetched in one query and the verdicts written in one update, so a batch
+// costs the same few round-trips as a single proof. The returned errors line
+// up with responses, nil for each verified proof; the error is for a batch
+// that could not be recorded at all.
+func (s *ProofService) VerifyProofs(ctx context.Context, responses []ProofResponse) ([]error, error) {
+	ids := make([]uuid.UUID, len(responses))
+	for i, resp := range responses {
+		ids[i] = resp.ChallengeID
+	}
+	challenges, err := s.loadChallenges(ctx, ids)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load challenges: %w", err)
+	}
+	return s.settleProofs(ctx, challenges, responses)
+}
+
+// VerifyPendingChallenges claims up to limit of the oldest pending
+// challenges, sends them to their nodes and verifies the answers as one
+// batch. Claimed challenges are 'dispatched', so no other verifier sends
+// them meanwhile. Retries are left to the nodes that asked for them, and a
+// challenge whose node can't be reached goes back to pending for a later
+// pass or for expiry.
+func (s *ProofService) VerifyPendingChallenges(ctx context.Context, limit int) (*ProofBatchResult, error) {
+	start := time.Now()
+	result := &ProofBatchResult{}
+	if s.dispatcher == nil {
+		return result, nil
+	}
+
+	rows, err := s.db.Pool.Query(ctx,
+		`UPDATE proof_challenges SET status = 'dispatched'
+		 WHERE id IN (
+		     SELECT id FROM proof_challenges
+		     WHERE status = 'pending' AND retry_of IS NULL
+		     ORDER BY created_at
+		     LIMIT $1
+		     FOR UPDATE SKIP LOCKED)
+		 RETURNING id`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim pending challenges: %w", err)
+	}
+	ids, err := pgx.CollectRows(rows, pgx.RowTo[uuid.UUID])
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim pending challenges: %w", err)
+	}
+	claimed, err := s.loadChallenges(ctx, ids)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load pending challenges: %w", err)
+	}
+
+	challenges := make(map[uuid.UUID]issuedChallenge, len(claimed))
+	var responses []ProofResponse
+	var undelivered []uuid.UUID
+	for _, c := range claimed {
+		result.Challenged++
+		leaf := challengeLeaf(c.MerkleRoot, c.SizeBytes, c.Seed)
+		proofHash, durationMs, merkleProof, err := s.dispatcher.SendProofChallenge(ctx, c.PeerID, c.ChunkID.String(), c.Seed, c.Difficulty, leaf)
+		if err != nil {
+			result.Undelivered++
+			undelivered = append(undelivered, c.ID)
+			continue
+		}
+		challenges[c.ID] = c
+		responses = append(responses, ProofResponse{ChallengeID: c.ID, ProofHash: proofHash, DurationMs: durationMs, MerkleProof: merkleProof})
+	}
+
+	if err := s.releaseChallenges(ctx, undelivered); err != nil {
+		return nil, err
+	}
+	verdicts, err := s.settleProofs(ctx, challenges, responses)
+	if err != nil {
+		return nil, err
+	}
+	for _, verdict := range verdicts {
+		switch {
+		case verdict == nil:
+			result.Verified++
+		case errors.Is(verdict, ErrChallengeDecided):
+		default:
+			result.Failed++
+		}
+	}
+	result.Duration = time.Since(start)
+	return result, nil
+}
+
+// claimChallenge marks a pending challenge dispatched, reporting false if
+// another verifier claimed or decided it first
+func (s *ProofService) claimChallenge(ctx context.Context, id uuid.UUID) (bool, error) {
+	tag, err := s.db.Pool.Exec(ctx,
+		"UPDATE proof_challenges SET status = 'dispatched' WHERE id = $1 AND status = 'pending'", id)
+	if err != nil {
+		return false, fmt.Errorf("failed to claim challenge: %w", err)
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// releaseChallenges puts dispatched challenges that never reached their
+// nodes back to pending
+func (s *ProofService) releaseChallenges(ctx context.Context, ids []uuid.UUID) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	_, err := s.db.Pool.Exec(ctx,
+		"UPDATE proof_challenges SET status = 'pending' WHERE id = ANY($1) AND status = 'dispatched'", ids)
+	if err != nil {
+		return fmt.Errorf("failed to release challenges: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,293 @@
+package services
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/federated-storage/coordinator/internal/models"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// ErrNoChallengeableChunks is returned when a node holds no chunk of a file
+// the coordinator has data to check a proof against
+var ErrNoChallengeableChunks = errors.New("node holds no chunks of the file that can be challenged")
+
+// ErrChallengeNotPending is returned for a proof of a challenge that is
+// unknown or was already answered
+var ErrChallengeNotPending = errors.New("challenge not found or already answered")
+
+// SampleChunkIndices picks min(k, n) distinct positions out of n, derived
+// from seed alone so the node can find the same ones, in ascending order.
+// The i-th draw takes the first eight bytes of SHA-256(seed || i) modulo the
+// positions not yet picked.
+func SampleChunkIndices(seed []byte, n, k int) []int {
+	k = min(k, n)
+	if k <= 0 {
+		return nil
+	}
+	positions := make([]int, n)
+	for i := range positions {
+		positions[i] = i
+	}
+	// A partial Fisher-Yates shuffle: the first k positions end up sampled
+	counter := make([]byte, len(seed)+4)
+	copy(counter, seed)
+	for i := 0; i < k; i++ {
+		binary.BigEndian.PutUint32(counter[len(seed):], uint32(i))
+		sum := sha256.Sum256(counter)
+		j := i + int(binary.BigEndian.Uint64(sum[:8])%uint64(n-i))
+		positions[i], positions[j] = positions[j], positions[i]
+	}
+	sampled := positions[:k]
+	sort.Ints(sampled)
+	return sampled
+}
+
+// AggregateProof combines proofs of several chunks into one: the hex SHA-256
+// of the seed followed by SHA-256(seed || chunk) for each chunk in order.
+// Every chunk's full content goes into the result, so it can't be produced
+// without holding all of them.
+func AggregateProof(seed []byte, chunks [][]byte) string {
+	combined := sha256.New()
+	combined.Write(seed)
+	for _, data := range chunks {
+		chunk := sha256.New()
+		chunk.Write(seed)
+		chunk.Write(data)
+		combined.Write(chunk.Sum(nil))
+	}
+	return hex.EncodeToString(combined.Sum(nil))
+}
+
+// CreateFileChallenge challenges a node to prove it holds a file with one
+// proof over up to k of the file's chunks it actively holds, sampled by
+// SampleChunkIndices from a fresh seed. Only chunks the coordinator keeps
+// data for can be checked, so chunks stored only on nodes are not sampled.
+// The node has the usual per-round budget for each sampled chunk.
+func (s *ProofService) CreateFileChallenge(ctx context.Context, fileID, nodeID uuid.UUID, k int) (*models.FileChallenge, error) {
+	rows, err := s.db.Pool.Query(ctx,
+		`SELECT c.id FROM chunks c
+		 JOIN chunk_assignments ca ON ca.chunk_id = c.id
+		 WHERE c.file_id = $1 AND ca.node_id = $2 AND ca.status = 'active' AND length(c.data) > 0
+		 ORDER BY c.chunk_index`,
+		fileID, nodeID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list chunks: %w", err)
+	}
+	var held []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		held = append(held, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list chunks: %w", err)
+	}
+	if len(held) == 0 {
+		return nil, ErrNoChallengeableChunks
+	}
+
+	seed := make([]byte, 32)
+	if _, err := rand.Read(seed); err != nil {
+		return nil, fmt.Errorf("failed to generate seed: %w", err)
+	}
+	indices := SampleChunkIndices(seed, len(held), k)
+	challenge := &models.FileChallenge{
+		ID:        uuid.New(),
+		FileID:    fileID,
+		NodeID:    nodeID,
+		Seed:      seed,
+		ChunkIDs:  make([]uuid.UUID, len(indices)),
+		TimeoutMs: s.timeout.For(s.difficulty * len(indices)),
+		Status:    "pending",
+	}
+	for i, index := range indices {
+		challenge.ChunkIDs[i] = held[index]
+	}
+
+	err = s.db.Pool.QueryRow(ctx,
+		`INSERT INTO file_challenges (id, file_id, node_id, seed, chunk_ids, timeout_ms, status)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING created_at`,
+		challenge.ID, challenge.FileID, challenge.NodeID, challenge.Seed, challenge.ChunkIDs, challenge.TimeoutMs, challenge.Status,
+	).Scan(&challenge.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create challenge: %w", err)
+	}
+	return challenge, nil
+}
+
+// FileProver sends file challenges to storage nodes. The duration it returns
+// runs from sending the challenge to reading the answer, as the coordinator
+// measures it; nodeError is set when the node answered with an error.
+type FileProver interface {
+	SendFileChallenge(ctx context.Context, peerID string, seed []byte, chunkIDs []string) (proofHash, nodeError string, took time.Duration, err error)
+}
+
+// FileProofResult reports a file challenge put to a node
+type FileProofResult struct {
+	ChallengeID uuid.UUID `json:"challenge_id"`
+	FileID      uuid.UUID `json:"file_id"`
+	NodeID      uuid.UUID `json:"node_id"`
+	Chunks      int       `json:"chunks"`
+	TimeoutMs   int       `json:"timeout_ms"`
+	DurationMs  int       `json:"duration_ms"`
+	Verified    bool      `json:"verified"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// ProveFile challenges a node to prove it holds up to k chunks of a file with
+// one aggregate proof, and records the verdict, which counts towards the
+// node's reputation like any other proof. An error means the node could not
+// be challenged; the challenge is then recorded as undelivered, which counts
+// nowhere.
+func (s *ProofService) ProveFile(ctx context.Context, prover FileProver, fileID, nodeID uuid.UUID, k int) (*FileProofResult, error) {
+	var peerID string
+	err := s.db.Pool.QueryRow(ctx,
+		"SELECT peer_id FROM storage_nodes WHERE id = $1 AND status = 'active'", nodeID).Scan(&peerID)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownNode, nodeID)
+	}
+	challenge, err := s.CreateFileChallenge(ctx, fileID, nodeID, k)
+	if err != nil {
+		return nil, err
+	}
+	result := &FileProofResult{
+		ChallengeID: challenge.ID,
+		FileID:      fileID,
+		NodeID:      nodeID,
+		Chunks:      len(challenge.ChunkIDs),
+		TimeoutMs:   challenge.TimeoutMs,
+	}
+
+	chunkIDs := make([]string, len(challenge.ChunkIDs))
+	for i, id := range challenge.ChunkIDs {
+		chunkIDs[i] = id.String()
+	}
+	proofHash, nodeError, took, err := prover.SendFileChallenge(ctx, peerID, challenge.Seed, chunkIDs)
+	if err != nil {
+		if _, releaseErr := s.db.Pool.Exec(ctx,
+			"UPDATE file_challenges SET status = 'undelivered' WHERE id = $1 AND status = 'pending'", challenge.ID); releaseErr != nil {
+			return nil, fmt.Errorf("failed to challenge node: %w (and to release the challenge: %v)", err, releaseErr)
+		}
+		return nil, fmt.Errorf("failed to challenge node: %w", err)
+	}
+	result.DurationMs = int(took.Milliseconds())
+
+	verdict, err := s.settleFileChallenge(ctx, challenge.ID, proofHash, took)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case verdict.Err == nil:
+		result.Verified = true
+	case nodeError != "":
+		result.Error = "node returned error: " + nodeError
+	default:
+		result.Error = verdict.Err.Error()
+	}
+	return result, nil
+}
+
+// VerifyFileChallenge checks a node's answer to a file challenge against the
+// AggregateProof of the coordinator's copies of the sampled chunks, and
+// records the verdict. took is how long the answer took as the coordinator
+// measured it, never what the node reports. It returns nil for a verified
+// proof, otherwise why it failed; a challenge is answered once.
+func (s *ProofService) VerifyFileChallenge(ctx context.Context, challengeID uuid.UUID, proofHash string, took time.Duration) error {
+	verdict, err := s.settleFileChallenge(ctx, challengeID, proofHash, took)
+	if err != nil {
+		return err
+	}
+	return verdict.Err
+}
+
+// settleFileChallenge judges an answer to a file challenge and records the
+// verdict; the error is for failing to judge or record it
+func (s *ProofService) settleFileChallenge(ctx context.Context, challengeID uuid.UUID, proofHash string, took time.Duration) (proofVerdict, error) {
+	verdict := proofVerdict{ID: challengeID, Status: "verified", DurationMs: int(took.Milliseconds())}
+	var challenge models.FileChallenge
+	err := s.db.Pool.QueryRow(ctx,
+		"SELECT seed, chunk_ids, timeout_ms FROM file_challenges WHERE id = $1 AND status = 'pending'",
+		challengeID).Scan(&challenge.Seed, &challenge.ChunkIDs, &challenge.TimeoutMs)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return verdict, ErrChallengeNotPending
+	}
+	if err != nil {
+		return verdict, fmt.Errorf("failed to load challenge: %w", err)
+	}
+
+	verdict.Err = checkProofDuration(verdict.DurationMs, challenge.TimeoutMs)
+	if verdict.Err == nil {
+		expected, err := s.aggregateChunkProof(ctx, challenge.Seed, challenge.ChunkIDs)
+		if err != nil {
+			return verdict, err
+		}
+		if !hmac.Equal([]byte(proofHash), []byte(expected)) {
+			verdict.Err = fmt.Errorf("invalid aggregate proof over %d chunks", len(challenge.ChunkIDs))
+		}
+	}
+	if verdict.Err != nil {
+		verdict.Status = "failed"
+	}
+
+	// The column holds a SHA-256 in hex; a longer answer is wrong anyway
+	if len(proofHash) > 64 {
+		proofHash = proofHash[:64]
+	}
+	tag, err := s.db.Pool.Exec(ctx,
+		`UPDATE file_challenges SET status = $1, proof_hash = $2, duration_ms = $3, verified_at = $4
+		 WHERE id = $5 AND status = 'pending'`,
+		verdict.Status, proofHash, verdict.DurationMs, time.Now(), challengeID)
+	if err != nil {
+		return verdict, fmt.Errorf("failed to record proof: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return verdict, ErrChallengeNotPending
+	}
+	return verdict, nil
+}
+
+// aggregateChunkProof computes the AggregateProof of the stored data of
+// chunkIDs, in that order
+func (s *ProofService) aggregateChunkProof(ctx context.Context, seed []byte, chunkIDs []uuid.UUID) (string, error) {
+	rows, err := s.db.Pool.Query(ctx, "SELECT id, data FROM chunks WHERE id = ANY($1)", chunkIDs)
+	if err != nil {
+		return "", fmt.Errorf("failed to read chunks: %w", err)
+	}
+	defer rows.Close()
+	stored := make(map[uuid.UUID][]byte, len(chunkIDs))
+	for rows.Next() {
+		var id uuid.UUID
+		var data []byte
+		if err := rows.Scan(&id, &data); err != nil {
+			return "", err
+		}
+		stored[id] = data
+	}
+	if err := rows.Err(); err != nil {
+		return "", fmt.Errorf("failed to read chunks: %w", err)
+	}
+
+	chunks := make([][]byte, len(chunkIDs))
+	for i, id := range chunkIDs {
+		data, ok := stored[id]
+		if !ok {
+			return "", fmt.Errorf("challenged chunk %s no longer exists", id)
+		}
+		chunks[i] = data
+	}
+	return AggregateProof(seed, chunks), nil
+}
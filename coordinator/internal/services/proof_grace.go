@@ -0,0 +1,104 @@
+package services
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// proofOutcome is a decided proof as far as missed-proof grace is concerned
+type proofOutcome struct {
+	ID       uuid.UUID
+	Verified bool
+	Missed   bool // failed without a proof: never answered, or answered too late
+}
+
+// SetMissedProofGrace forgives a node up to grace consecutive missed proofs
+// as they are recorded, so they count against neither its reputation nor
+// its earnings; grace <= 0 counts every miss
+func (s *ProofService) SetMissedProofGrace(grace int) {
+	s.missedProofGrace = grace
+}
+
+// forgiveMissedProofs counts the verified and failed proofs among outcomes,
+// oldest first, for a node that had already missed streak proofs in a row.
+// A miss is forgiven while the node's run of consecutive misses is at most
+// grace, and a verified proof ends the run. Wrong answers always count: a
+// network blip can't produce one.
+func forgiveMissedProofs(streak, grace int, outcomes []proofOutcome) (verified, failed int, forgiven []uuid.UUID) {
+	for _, outcome := range outcomes {
+		switch {
+		case outcome.Verified:
+			verified++
+			streak = 0
+		case outcome.Missed:
+			streak++
+			if streak <= grace {
+				forgiven = append(forgiven, outcome.ID)
+				continue
+			}
+			failed++
+		default:
+			failed++
+		}
+	}
+	return verified, failed, forgiven
+}
+
+// forgiveMisses marks 'forgiven' the misses of the given nodes that fall
+// within the grace of their current run, those decided since each node's
+// last verified proof. It runs in the transaction recording the misses, so
+// no count ever sees them as failures.
+func forgiveMisses(ctx context.Context, tx pgx.Tx, grace int, nodeIDs []uuid.UUID) error {
+	if grace <= 0 || len(nodeIDs) == 0 {
+		return nil
+	}
+	runs, err := missedProofRuns(ctx, tx, nodeIDs)
+	if err != nil {
+		return err
+	}
+	var forgiven []uuid.UUID
+	for _, run := range runs {
+		_, _, ids := forgiveMissedProofs(0, grace, run)
+		forgiven = append(forgiven, ids...)
+	}
+	if len(forgiven) == 0 {
+		return nil
+	}
+	_, err = tx.Exec(ctx,
+		"UPDATE proof_challenges SET status = 'forgiven' WHERE id = ANY($1) AND status = 'failed'", forgiven)
+	if err != nil {
+		return fmt.Errorf("failed to forgive missed proofs: %w", err)
+	}
+	return nil
+}
+
+// missedProofRuns lists each node's current run of missed proofs, forgiven
+// or not, oldest first
+func missedProofRuns(ctx context.Context, tx pgx.Tx, nodeIDs []uuid.UUID) (map[uuid.UUID][]proofOutcome, error) {
+	rows, err := tx.Query(ctx,
+		`SELECT pc.node_id, pc.id FROM proof_challenges pc
+		 WHERE pc.node_id = ANY($1)
+		   AND (pc.status = 'forgiven' OR (pc.status = 'failed' AND pc.proof_hash IS NULL))
+		   AND pc.verified_at > COALESCE((SELECT MAX(v.verified_at) FROM proof_challenges v
+		                                  WHERE v.node_id = pc.node_id AND v.status = 'verified'), '-infinity')
+		 ORDER BY pc.verified_at, pc.id`,
+		nodeIDs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list missed proofs: %w", err)
+	}
+	defer rows.Close()
+
+	runs := make(map[uuid.UUID][]proofOutcome)
+	for rows.Next() {
+		var nodeID uuid.UUID
+		outcome := proofOutcome{Missed: true}
+		if err := rows.Scan(&nodeID, &outcome.ID); err != nil {
+			return nil, err
+		}
+		runs[nodeID] = append(runs[nodeID], outcome)
+	}
+	return runs, rows.Err()
+}
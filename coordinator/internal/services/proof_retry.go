@@ -0,0 +1,235 @@
+package services
+
+import (
+	"context"
+	crand "crypto/rand"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/federated-storage/coordinator/internal/models"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// ErrProofRetryLimit is returned when a node has used up its proof retries for the window
+var ErrProofRetryLimit = errors.New("proof retry limit reached")
+
+// ErrUnknownRetry is returned when a retry answer names no pending retry challenge of the node
+var ErrUnknownRetry = errors.New("no such pending proof retry")
+
+// ErrProofRetryFailed is returned when a node's answer to a proof retry does not verify
+var ErrProofRetryFailed = errors.New("proof retry failed")
+
+// ProofRetry is a failed challenge re-issued to the node that failed it
+type ProofRetry struct {
+	ChallengeID uuid.UUID `json:"challenge_id"`
+	RetryOf     uuid.UUID `json:"retry_of"`
+	ChunkID     uuid.UUID `json:"chunk_id"`
+	Seed        []byte    `json:"seed"`
+	Difficulty  int       `json:"difficulty"`
+	TimeoutMs   int       `json:"timeout_ms"`
+	LeafIndex   int       `json:"leaf_index"` // sub-block to return with the proof; -1 for none
+}
+
+// SetProofRetries lets nodes retry proofs failed within window, up to
+// maxRetries per window; maxRetries <= 0 disables retries
+func (s *ProofService) SetProofRetries(window time.Duration, maxRetries int) {
+	s.retryWindow = window
+	s.maxRetries = maxRetries
+}
+
+// proofRetryAllowance is how many more retries a node that has used used of
+// maxRetries may be issued
+func proofRetryAllowance(maxRetries, used int) int {
+	if maxRetries <= 0 {
+		return 0
+	}
+	return max(maxRetries-used, 0)
+}
+
+// ReissueFailedChallenges re-issues a node's challenges that failed within
+// the retry window for chunks it still holds (held) and is still assigned.
+// Each failure can be retried once, most recent first, and only as many as
+// the node's remaining allowance for the window.
+func (s *ProofService) ReissueFailedChallenges(ctx context.Context, nodeID uuid.UUID, held []uuid.UUID) ([]ProofRetry, error) {
+	since := time.Now().Add(-s.retryWindow)
+
+	tx, err := s.db.Pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	// Serialize a node's retry requests so they can't overshoot the allowance together
+	if _, err := tx.Exec(ctx, "SELECT id FROM storage_nodes WHERE id = $1 FOR UPDATE", nodeID); err != nil {
+		return nil, fmt.Errorf("failed to lock node: %w", err)
+	}
+	var used int
+	err = tx.QueryRow(ctx,
+		"SELECT COUNT(*) FROM proof_challenges WHERE node_id = $1 AND retry_of IS NOT NULL AND created_at >= $2",
+		nodeID, since).Scan(&used)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count retries: %w", err)
+	}
+	allowance := proofRetryAllowance(s.maxRetries, used)
+	if allowance == 0 {
+		return nil, fmt.Errorf("%w (%d per %s)", ErrProofRetryLimit, max(s.maxRetries, 0), s.retryWindow)
+	}
+
+	rows, err := tx.Query(ctx,
+		`SELECT pc.id, pc.chunk_id, COALESCE(c.merkle_root, ''), c.size_bytes
+		 FROM proof_challenges pc
+		 JOIN chunks c ON c.id = pc.chunk_id
+		 JOIN chunk_assignments ca ON ca.chunk_id = pc.chunk_id AND ca.node_id = pc.node_id AND ca.status = 'active'
+		 WHERE pc.node_id = $1 AND pc.status = 'failed' AND pc.verified_at >= $2 AND pc.chunk_id = ANY($3)
+		   AND NOT EXISTS (SELECT 1 FROM proof_challenges r WHERE r.retry_of = pc.id)
+		 ORDER BY pc.verified_at DESC
+		 LIMIT $4`,
+		nodeID, since, held, allowance)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find failed challenges: %w", err)
+	}
+	var retries []ProofRetry
+	var sizes []int
+	var roots []string
+	for rows.Next() {
+		var r ProofRetry
+		var root string
+		var size int
+		if err := rows.Scan(&r.RetryOf, &r.ChunkID, &root, &size); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		retries = append(retries, r)
+		roots = append(roots, root)
+		sizes = append(sizes, size)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	timeoutMs := s.timeout.For(s.difficulty)
+	for i := range retries {
+		r := &retries[i]
+		r.ChallengeID = uuid.New()
+		r.Seed = make([]byte, 32)
+		if _, err := crand.Read(r.Seed); err != nil {
+			return nil, fmt.Errorf("failed to generate seed: %w", err)
+		}
+		r.Difficulty = s.difficulty
+		r.TimeoutMs = timeoutMs
+		r.LeafIndex = challengeLeaf(roots[i], sizes[i], r.Seed)
+
+		_, err := tx.Exec(ctx,
+			`INSERT INTO proof_challenges (id, chunk_id, node_id, seed, difficulty, timeout_ms, status, retry_of)
+			 VALUES ($1, $2, $3, $4, $5, $6, 'pending', $7)`,
+			r.ChallengeID, r.ChunkID, nodeID, r.Seed, r.Difficulty, r.TimeoutMs, r.RetryOf)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create retry: %w", err)
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return retries, nil
+}
+
+// AnswerRetry verifies a node's answer to one of its proof retries. Passing
+// excuses the failure it retried: the failure stops counting against the
+// node, including in the reputation snapshot that recorded it, and the node's
+// score is recomputed. A failed retry does not count against the node again.
+func (s *ProofService) AnswerRetry(ctx context.Context, nodeID, challengeID uuid.UUID, proofHash string, durationMs int, merkleProof *models.MerkleProof) error {
+	var retryOf uuid.UUID
+	err := s.db.Pool.QueryRow(ctx,
+		"SELECT retry_of FROM proof_challenges WHERE id = $1 AND node_id = $2 AND status = 'pending' AND retry_of IS NOT NULL",
+		challengeID, nodeID).Scan(&retryOf)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrUnknownRetry, challengeID)
+	}
+
+	// The verdict is recorded as 'retry_passed' or 'retry_failed', so the
+	// retry itself counts neither for nor against the node
+	if err := s.VerifyProof(ctx, challengeID, proofHash, durationMs, merkleProof); err != nil {
+		// The original failure stands
+		return fmt.Errorf("%w: %v", ErrProofRetryFailed, err)
+	}
+	return s.excuseFailure(ctx, nodeID, retryOf)
+}
+
+// excuseFailure marks a failed challenge excused and takes it out of the
+// reputation snapshot that counted it
+func (s *ProofService) excuseFailure(ctx context.Context, nodeID, challengeID uuid.UUID) error {
+	tx, err := s.db.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var failedAt time.Time
+	err = tx.QueryRow(ctx,
+		"UPDATE proof_challenges SET status = 'excused' WHERE id = $1 AND status = 'failed' RETURNING verified_at",
+		challengeID).Scan(&failedAt)
+	if err != nil {
+		return fmt.Errorf("failed to excuse challenge: %w", err)
+	}
+
+	// Snapshots count proofs decided before they were recorded; with no
+	// snapshot yet, the next one simply won't see the failure
+	var snapshot models.NodeReputation
+	err = tx.QueryRow(ctx,
+		`SELECT id, uptime_percentage, proofs_verified, proofs_failed, availability
+		 FROM node_reputation WHERE node_id = $1 AND recorded_at >= $2
+		 ORDER BY recorded_at LIMIT 1`,
+		nodeID, failedAt).Scan(&snapshot.ID, &snapshot.UptimePercentage, &snapshot.ProofsVerified, &snapshot.ProofsFailed, &snapshot.Availability)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return tx.Commit(ctx)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load reputation snapshot: %w", err)
+	}
+
+	snapshot = excuseFailedProof(snapshot)
+	_, err = tx.Exec(ctx,
+		"UPDATE node_reputation SET proofs_verified = $1, proofs_failed = $2, proof_pass_rate = $3, score = $4 WHERE id = $5",
+		snapshot.ProofsVerified, snapshot.ProofsFailed, snapshot.ProofPassRate, snapshot.Score, snapshot.ID)
+	if err != nil {
+		return fmt.Errorf("failed to update reputation snapshot: %w", err)
+	}
+	if err := rescoreNode(ctx, tx, nodeID); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// rescoreNode recomputes a node's reputation score from its recent snapshots
+func rescoreNode(ctx context.Context, tx pgx.Tx, nodeID uuid.UUID) error {
+	rows, err := tx.Query(ctx,
+		`SELECT uptime_percentage, proof_pass_rate, availability
+		 FROM node_reputation WHERE node_id = $1
+		 ORDER BY recorded_at DESC LIMIT $2`,
+		nodeID, reputationWindow)
+	if err != nil {
+		return fmt.Errorf("failed to load reputation history: %w", err)
+	}
+	var history []models.NodeReputation
+	for rows.Next() {
+		var r models.NodeReputation
+		if err := rows.Scan(&r.UptimePercentage, &r.ProofPassRate, &r.Availability); err != nil {
+			rows.Close()
+			return err
+		}
+		history = append(history, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(ctx, "UPDATE storage_nodes SET reputation_score = $1 WHERE id = $2",
+		ReputationScore(history), nodeID); err != nil {
+		return fmt.Errorf("failed to update score: %w", err)
+	}
+	return nil
+}
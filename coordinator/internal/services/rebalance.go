@@ -0,0 +1,311 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/federated-storage/coordinator/internal/models"
+	"github.com/google/uuid"
+)
+
+// ChunkTransfer copies chunk data to and from storage nodes
+type ChunkTransfer interface {
+	SendChunk(ctx context.Context, peerID, chunkID string, data []byte) error
+	RetrieveChunk(ctx context.Context, peerID, chunkID string) ([]byte, error)
+}
+
+// A node over its store rate turns chunks away with an error that has a
+// RetryAfter method. Copies wait that long, at least minBusyWait, and try
+// again up to maxBusyRetries times before giving up on the target.
+const (
+	maxBusyRetries = 3
+	minBusyWait    = 10 * time.Millisecond
+)
+
+// busyRetryAfter reports how long a node that turned a chunk away for being
+// busy asked to be left alone, and whether err is such a refusal
+func busyRetryAfter(err error) (time.Duration, bool) {
+	var busy interface{ RetryAfter() time.Duration }
+	if !errors.As(err, &busy) {
+		return 0, false
+	}
+	return max(busy.RetryAfter(), minBusyWait), true
+}
+
+// ErrChunkVerifyFailed is returned when a node does not return the chunk it was sent
+var ErrChunkVerifyFailed = errors.New("chunk verification failed")
+
+// ChunkMove relocates one replica of a chunk from one node to another
+type ChunkMove struct {
+	ChunkID    uuid.UUID `json:"chunk_id"`
+	SizeBytes  int       `json:"size_bytes"`
+	FromNodeID uuid.UUID `json:"from_node_id"`
+	ToNodeID   uuid.UUID `json:"to_node_id"`
+	ToPeerID   string    `json:"-"`
+}
+
+// RebalanceFailure records a move that was rolled back
+type RebalanceFailure struct {
+	ChunkMove
+	Error string `json:"error"`
+}
+
+// RebalanceReport summarizes one rebalance pass
+type RebalanceReport struct {
+	Planned  int                `json:"planned"`
+	Moved    []ChunkMove        `json:"moved"`
+	Failed   []RebalanceFailure `json:"failed"`
+	Canceled bool               `json:"canceled"`
+}
+
+// PlanRebalance picks chunk moves from nodes above the network's average
+// utilization to nodes below it. Each over-full node gives up at most
+// fraction of its chunks, and at most maxMoves moves are planned in total.
+// Targets never receive a chunk they already hold or more than they can fit.
+func PlanRebalance(nodes []models.StorageNode, holdings map[uuid.UUID][]models.Chunk, fraction float64, maxMoves int) []ChunkMove {
+	var totalUsed, totalCap int64
+	used := make(map[uuid.UUID]int64)
+	var candidates []models.StorageNode
+	for _, n := range nodes {
+		if n.TotalStorageBytes <= 0 {
+			continue
+		}
+		candidates = append(candidates, n)
+		used[n.ID] = n.UsedStorageBytes
+		totalUsed += n.UsedStorageBytes
+		totalCap += n.TotalStorageBytes
+	}
+	if totalCap == 0 {
+		return nil
+	}
+	mean := float64(totalUsed) / float64(totalCap)
+	util := func(n models.StorageNode) float64 {
+		return float64(used[n.ID]) / float64(n.TotalStorageBytes)
+	}
+
+	holders := make(map[uuid.UUID]map[uuid.UUID]bool)
+	for nodeID, chunks := range holdings {
+		for _, c := range chunks {
+			if holders[c.ID] == nil {
+				holders[c.ID] = make(map[uuid.UUID]bool)
+			}
+			holders[c.ID][nodeID] = true
+		}
+	}
+
+	sources := append([]models.StorageNode(nil), candidates...)
+	sort.Slice(sources, func(i, j int) bool { return util(sources[i]) > util(sources[j]) })
+
+	var moves []ChunkMove
+	for _, src := range sources {
+		budget := int(math.Ceil(fraction * float64(len(holdings[src.ID]))))
+		for _, chunk := range holdings[src.ID] {
+			if budget == 0 || len(moves) >= maxMoves || util(src) <= mean {
+				break
+			}
+
+			var target *models.StorageNode
+			for i := range candidates {
+				t := &candidates[i]
+				if t.ID == src.ID || holders[chunk.ID][t.ID] || util(*t) >= mean ||
+					used[t.ID]+int64(chunk.SizeBytes) > t.TotalStorageBytes {
+					continue
+				}
+				if target == nil || util(*t) < util(*target) {
+					target = t
+				}
+			}
+			if target == nil {
+				continue
+			}
+
+			moves = append(moves, ChunkMove{
+				ChunkID:    chunk.ID,
+				SizeBytes:  chunk.SizeBytes,
+				FromNodeID: src.ID,
+				ToNodeID:   target.ID,
+				ToPeerID:   target.PeerID,
+			})
+			used[src.ID] -= int64(chunk.SizeBytes)
+			used[target.ID] += int64(chunk.SizeBytes)
+			holders[chunk.ID][target.ID] = true
+			budget--
+		}
+	}
+	return moves
+}
+
+// MoveChunk copies a chunk to the move's target, verifies the target returns
+// it intact, then activates the new assignment and retires the old one. On
+// any failure the pending assignment is removed and the source is untouched.
+func (s *ChunkService) MoveChunk(ctx context.Context, transfer ChunkTransfer, move ChunkMove) error {
+	if err := s.CopyChunk(ctx, transfer, move); err != nil {
+		return err
+	}
+	if err := s.store.SetChunkAssignment(ctx, move.ChunkID, move.FromNodeID, "retired"); err != nil {
+		return fmt.Errorf("failed to retire old assignment: %w", err)
+	}
+	return nil
+}
+
+// CopyChunk adds a verified replica of a chunk on the move's target, leaving
+// the source's replica in place. On failure the pending assignment is removed.
+func (s *ChunkService) CopyChunk(ctx context.Context, transfer ChunkTransfer, move ChunkMove) error {
+	chunk, data, err := s.store.GetChunk(ctx, move.ChunkID)
+	if err != nil {
+		return fmt.Errorf("failed to load chunk: %w", err)
+	}
+	// Direct uploads leave no coordinator copy; one of the replicas is copied
+	if len(data) == 0 && chunk.SizeBytes > 0 {
+		if data, err = s.fetchFromNodes(ctx, *chunk); err != nil {
+			return fmt.Errorf("failed to load chunk: %w", err)
+		}
+	}
+	return s.copyChunkData(ctx, transfer, move, chunk.Hash, data)
+}
+
+// copyChunkData sends data to the move's target and activates the replica
+// once the target returns bytes matching hash
+func (s *ChunkService) copyChunkData(ctx context.Context, transfer ChunkTransfer, move ChunkMove, hash string, data []byte) error {
+	if err := s.store.SetChunkAssignment(ctx, move.ChunkID, move.ToNodeID, "pending"); err != nil {
+		return fmt.Errorf("failed to create assignment: %w", err)
+	}
+	rollback := func(cause error) error {
+		s.store.DeleteChunkAssignment(context.Background(), move.ChunkID, move.ToNodeID)
+		return cause
+	}
+
+	if err := sendVerified(ctx, transfer, move.ToPeerID, move.ChunkID, hash, data); err != nil {
+		return rollback(err)
+	}
+	if err := s.store.SetChunkAssignment(ctx, move.ChunkID, move.ToNodeID, "active"); err != nil {
+		return rollback(fmt.Errorf("failed to activate assignment: %w", err))
+	}
+	return nil
+}
+
+// sendVerified sends data to a node, waiting out busy answers, and checks
+// the node returns bytes matching hash
+func sendVerified(ctx context.Context, transfer ChunkTransfer, peerID string, chunkID uuid.UUID, hash string, data []byte) error {
+	for attempt := 0; ; attempt++ {
+		err := transfer.SendChunk(ctx, peerID, chunkID.String(), data)
+		if err == nil {
+			break
+		}
+		wait, busy := busyRetryAfter(err)
+		if !busy || attempt == maxBusyRetries {
+			return fmt.Errorf("failed to send chunk: %w", err)
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("failed to send chunk: %w", ctx.Err())
+		case <-time.After(wait):
+		}
+	}
+	stored, err := transfer.RetrieveChunk(ctx, peerID, chunkID.String())
+	if err != nil {
+		return fmt.Errorf("failed to read back chunk: %w", err)
+	}
+	sum := sha256.Sum256(stored)
+	if hex.EncodeToString(sum[:]) != hash {
+		return fmt.Errorf("%w: target returned different data", ErrChunkVerifyFailed)
+	}
+	return nil
+}
+
+// RefreshStaleReplicas sends the coordinator's copy of a chunk to each node
+// whose replica went stale when its file's key was rotated, for one file or
+// for every file if fileID is uuid.Nil. A replica the node returns intact is
+// active again; the rest stay stale, out of challenges and reads, for a later
+// call to retry. Once a node fails, its other replicas wait for the next call.
+// It returns how many replicas were refreshed and how many are still stale.
+func (s *ChunkService) RefreshStaleReplicas(ctx context.Context, fileID uuid.UUID) (refreshed, stale int, err error) {
+	assignments, err := s.store.ListStaleAssignments(ctx, fileID)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to list stale replicas: %w", err)
+	}
+	if len(assignments) == 0 {
+		return 0, 0, nil
+	}
+	if s.transfer == nil || s.nodeService == nil {
+		return 0, len(assignments), nil
+	}
+	nodes, err := s.nodeService.GetAllNodes(ctx)
+	if err != nil {
+		return 0, len(assignments), fmt.Errorf("failed to list nodes: %w", err)
+	}
+	peerIDs := make(map[uuid.UUID]string, len(nodes))
+	for _, node := range nodes {
+		peerIDs[node.ID] = node.PeerID
+	}
+
+	failed := make(map[uuid.UUID]bool)
+	for i, a := range assignments {
+		if ctx.Err() != nil {
+			return refreshed, len(assignments) - i + stale, nil
+		}
+		peerID, ok := peerIDs[a.NodeID]
+		if !ok || failed[a.NodeID] {
+			stale++
+			continue
+		}
+		chunk, data, err := s.store.GetChunk(ctx, a.ChunkID)
+		if err != nil {
+			return refreshed, len(assignments) - i + stale, fmt.Errorf("failed to read chunk %s: %w", a.ChunkID, err)
+		}
+		if sendVerified(ctx, s.transfer, peerID, a.ChunkID, chunk.Hash, data) != nil {
+			failed[a.NodeID] = true
+			stale++
+			continue
+		}
+		if err := s.store.SetChunkAssignment(ctx, a.ChunkID, a.NodeID, "active"); err != nil {
+			return refreshed, len(assignments) - i + stale, fmt.Errorf("failed to activate refreshed replica: %w", err)
+		}
+		refreshed++
+	}
+	return refreshed, stale, nil
+}
+
+// Rebalance plans and performs up to maxMoves chunk moves. It stops early,
+// reporting Canceled, once ctx is done; completed moves are kept, so repeated
+// calls make incremental progress. Nodes draining for maintenance or
+// excluded from placement are left out.
+func (s *ChunkService) Rebalance(ctx context.Context, transfer ChunkTransfer, fraction float64, maxMoves int) (*RebalanceReport, error) {
+	nodes, err := s.nodeService.GetAllNodes(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list nodes: %w", err)
+	}
+	if nodes, err = s.excludeListed(ctx, nodes); err != nil {
+		return nil, err
+	}
+	nodes = ExcludeDraining(nodes, time.Now(), s.maintenanceLead)
+	holdings := make(map[uuid.UUID][]models.Chunk, len(nodes))
+	for _, n := range nodes {
+		chunks, err := s.store.ListNodeChunks(ctx, n.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list chunks of node %s: %w", n.ID, err)
+		}
+		holdings[n.ID] = chunks
+	}
+
+	moves := PlanRebalance(nodes, holdings, fraction, maxMoves)
+	report := &RebalanceReport{Planned: len(moves), Moved: []ChunkMove{}, Failed: []RebalanceFailure{}}
+	for _, move := range moves {
+		if ctx.Err() != nil {
+			report.Canceled = true
+			break
+		}
+		if err := s.MoveChunk(ctx, transfer, move); err != nil {
+			report.Failed = append(report.Failed, RebalanceFailure{ChunkMove: move, Error: err.Error()})
+			continue
+		}
+		report.Moved = append(report.Moved, move)
+	}
+	return report, nil
+}
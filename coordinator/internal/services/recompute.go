@@ -0,0 +1,138 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// NodeDerivedStats are the node statistics kept on storage_nodes that can
+// be derived again from the data behind them
+type NodeDerivedStats struct {
+	EarnedCredits    int64   `json:"earned_credits"`     // sum of the node's daily earnings
+	UsedStorageBytes int64   `json:"used_storage_bytes"` // size of the chunks actively assigned to it
+	UptimePercentage float64 `json:"uptime_percentage"`  // share of recent reputation snapshots it was available in
+}
+
+// NodeRecompute is the outcome of recomputing one node's derived statistics
+type NodeRecompute struct {
+	NodeID  uuid.UUID        `json:"node_id"`
+	Before  NodeDerivedStats `json:"before"`
+	After   NodeDerivedStats `json:"after"`
+	Changed []string         `json:"changed"` // the fields that were corrected
+}
+
+// changedStats names the fields that differ between before and after
+func changedStats(before, after NodeDerivedStats) []string {
+	changed := []string{}
+	if before.EarnedCredits != after.EarnedCredits {
+		changed = append(changed, "earned_credits")
+	}
+	if before.UsedStorageBytes != after.UsedStorageBytes {
+		changed = append(changed, "used_storage_bytes")
+	}
+	if before.UptimePercentage != after.UptimePercentage {
+		changed = append(changed, "uptime_percentage")
+	}
+	return changed
+}
+
+// RecomputeNodeStats recalculates a node's earned credits from its earnings
+// history, its used storage from its active assignments and its uptime from
+// the availability recorded in its last reputation snapshots, and stores
+// the results. A node without snapshots keeps its uptime.
+func (s *NodeService) RecomputeNodeStats(ctx context.Context, nodeID uuid.UUID) (*NodeRecompute, error) {
+	tx, err := s.db.Pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	result := &NodeRecompute{NodeID: nodeID}
+	err = tx.QueryRow(ctx,
+		`SELECT earned_credits, used_storage_bytes, uptime_percentage FROM storage_nodes WHERE id = $1 FOR UPDATE`,
+		nodeID).Scan(&result.Before.EarnedCredits, &result.Before.UsedStorageBytes, &result.Before.UptimePercentage)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownNode, nodeID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load node: %w", err)
+	}
+
+	var uptime *float64
+	err = tx.QueryRow(ctx,
+		`SELECT
+		 COALESCE((SELECT SUM(total_earnings) FROM node_earnings WHERE node_id = $1), 0),
+		 COALESCE((SELECT SUM(c.size_bytes) FROM chunk_assignments ca JOIN chunks c ON c.id = ca.chunk_id
+		           WHERE ca.node_id = $1 AND ca.status = 'active'), 0),
+		 (SELECT ROUND(AVG(availability)::numeric * 100, 2) FROM
+		  (SELECT availability FROM node_reputation WHERE node_id = $1 ORDER BY recorded_at DESC LIMIT $2) recent)`,
+		nodeID, reputationWindow).Scan(&result.After.EarnedCredits, &result.After.UsedStorageBytes, &uptime)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive node statistics: %w", err)
+	}
+	result.After.UptimePercentage = result.Before.UptimePercentage
+	if uptime != nil {
+		result.After.UptimePercentage = *uptime
+	}
+
+	result.Changed = changedStats(result.Before, result.After)
+	if len(result.Changed) == 0 {
+		return result, nil
+	}
+	_, err = tx.Exec(ctx,
+		`UPDATE storage_nodes SET earned_credits = $1, used_storage_bytes = $2, uptime_percentage = $3, updated_at = NOW()
+		 WHERE id = $4`,
+		result.After.EarnedCredits, result.After.UsedStorageBytes, result.After.UptimePercentage, nodeID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store node statistics: %w", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// RecomputeAllNodeStats recomputes the derived statistics of every node,
+// returning how many were checked and the outcome for those corrected
+func (s *NodeService) RecomputeAllNodeStats(ctx context.Context) (int, []NodeRecompute, error) {
+	rows, err := s.db.Pool.Query(ctx, "SELECT id FROM storage_nodes ORDER BY created_at")
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to list nodes: %w", err)
+	}
+	var nodeIDs []uuid.UUID
+	for rows.Next() {
+		var nodeID uuid.UUID
+		if err := rows.Scan(&nodeID); err != nil {
+			rows.Close()
+			return 0, nil, err
+		}
+		nodeIDs = append(nodeIDs, nodeID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, nil, fmt.Errorf("failed to list nodes: %w", err)
+	}
+
+	checked := 0
+	corrected := []NodeRecompute{}
+	var errs []error
+	for _, nodeID := range nodeIDs {
+		result, err := s.RecomputeNodeStats(ctx, nodeID)
+		if errors.Is(err, ErrUnknownNode) {
+			continue // removed meanwhile
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("node %s: %w", nodeID, err))
+			continue
+		}
+		checked++
+		if len(result.Changed) > 0 {
+			corrected = append(corrected, *result)
+		}
+	}
+	return checked, corrected, errors.Join(errs...)
+}
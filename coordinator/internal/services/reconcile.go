@@ -0,0 +1,106 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"sort"
+
+	"github.com/google/uuid"
+)
+
+// ChunkDiff is the result of reconciling a node's chunk inventory with its assignments
+type ChunkDiff struct {
+	// Missing are chunks the coordinator expects on the node but the node lacks (re-fetch)
+	Missing []uuid.UUID
+	// Extra are chunks the node holds but is not assigned (safe to delete)
+	Extra []uuid.UUID
+}
+
+// DiffChunkSets compares the expected and held chunk sets. Results are sorted.
+func DiffChunkSets(expected, held []uuid.UUID) ChunkDiff {
+	expectedSet := make(map[uuid.UUID]struct{}, len(expected))
+	for _, id := range expected {
+		expectedSet[id] = struct{}{}
+	}
+	heldSet := make(map[uuid.UUID]struct{}, len(held))
+	for _, id := range held {
+		heldSet[id] = struct{}{}
+	}
+
+	var diff ChunkDiff
+	for id := range expectedSet {
+		if _, ok := heldSet[id]; !ok {
+			diff.Missing = append(diff.Missing, id)
+		}
+	}
+	for id := range heldSet {
+		if _, ok := expectedSet[id]; !ok {
+			diff.Extra = append(diff.Extra, id)
+		}
+	}
+	sortChunkIDs(diff.Missing)
+	sortChunkIDs(diff.Extra)
+	return diff
+}
+
+func sortChunkIDs(ids []uuid.UUID) {
+	sort.Slice(ids, func(i, j int) bool { return bytes.Compare(ids[i][:], ids[j][:]) < 0 })
+}
+
+// PackChunkIDs encodes chunk IDs compactly as base64 of their concatenated 16-byte forms
+func PackChunkIDs(ids []uuid.UUID) string {
+	buf := make([]byte, 0, len(ids)*16)
+	for _, id := range ids {
+		buf = append(buf, id[:]...)
+	}
+	return base64.StdEncoding.EncodeToString(buf)
+}
+
+// UnpackChunkIDs decodes chunk IDs produced by PackChunkIDs
+func UnpackChunkIDs(packed string) ([]uuid.UUID, error) {
+	buf, err := base64.StdEncoding.DecodeString(packed)
+	if err != nil {
+		return nil, fmt.Errorf("invalid packed chunk ids: %w", err)
+	}
+	if len(buf)%16 != 0 {
+		return nil, fmt.Errorf("invalid packed chunk ids: length %d is not a multiple of 16", len(buf))
+	}
+
+	ids := make([]uuid.UUID, len(buf)/16)
+	for i := range ids {
+		copy(ids[i][:], buf[i*16:(i+1)*16])
+	}
+	return ids, nil
+}
+
+// GetAssignedChunkIDs returns the chunks the coordinator expects a node to hold
+func (s *NodeService) GetAssignedChunkIDs(ctx context.Context, nodeID uuid.UUID) ([]uuid.UUID, error) {
+	rows, err := s.db.Pool.Query(ctx,
+		"SELECT chunk_id FROM chunk_assignments WHERE node_id = $1 AND status = 'active'",
+		nodeID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// Reconcile diffs the chunks a node reports holding against its active assignments
+func (s *NodeService) Reconcile(ctx context.Context, nodeID uuid.UUID, held []uuid.UUID) (ChunkDiff, error) {
+	expected, err := s.GetAssignedChunkIDs(ctx, nodeID)
+	if err != nil {
+		return ChunkDiff{}, fmt.Errorf("failed to load chunk assignments: %w", err)
+	}
+	return DiffChunkSets(expected, held), nil
+}
@@ -0,0 +1,104 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/federated-storage/coordinator/internal/models"
+	"github.com/google/uuid"
+)
+
+// Outcomes of repairing one chunk
+const (
+	// RepairIntact is a chunk whose coordinator copy matches its hash
+	RepairIntact = "ok"
+	// RepairRepaired is a corrupt chunk rewritten from a healthy replica
+	RepairRepaired = "repaired"
+	// RepairLost is a corrupt chunk no replica returned a good copy of
+	RepairLost = "lost"
+	// RepairRemote is a chunk the coordinator holds no copy of, as direct
+	// uploads leave them; reads fetch and verify it from its nodes instead
+	RepairRemote = "remote"
+)
+
+// ChunkRepair is the outcome of repairing one chunk of a file
+type ChunkRepair struct {
+	ChunkID    uuid.UUID `json:"chunk_id"`
+	ChunkIndex int       `json:"chunk_index"`
+	Status     string    `json:"status"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// FileRepairResult reports the repair of every chunk of a file
+type FileRepairResult struct {
+	FileID   uuid.UUID     `json:"file_id"`
+	Chunks   []ChunkRepair `json:"chunks"`
+	Repaired int           `json:"repaired"`
+	Lost     int           `json:"lost"`
+}
+
+// RepairFile checks the coordinator's copy of each of a file's chunks against
+// the chunk's hash. A corrupt copy is replaced by the first replica whose
+// node returns data matching the hash, and read back to make sure it took;
+// with no such replica the chunk is reported lost and left as it was.
+func (s *ChunkService) RepairFile(ctx context.Context, fileID uuid.UUID) (*FileRepairResult, error) {
+	chunks, err := s.store.ListChunks(ctx, fileID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list chunks: %w", err)
+	}
+
+	result := &FileRepairResult{FileID: fileID, Chunks: make([]ChunkRepair, 0, len(chunks))}
+	for _, chunk := range chunks {
+		repair := ChunkRepair{ChunkID: chunk.ID, ChunkIndex: chunk.ChunkIndex, Status: RepairIntact}
+		_, data, err := s.store.GetChunk(ctx, chunk.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read chunk %d: %w", chunk.ChunkIndex, err)
+		}
+
+		switch {
+		case len(data) == 0 && chunk.SizeBytes > 0:
+			repair.Status = RepairRemote
+		case chunkHash(data) != chunk.Hash:
+			if err := s.repairChunk(ctx, chunk); err != nil {
+				repair.Status, repair.Error = RepairLost, err.Error()
+				result.Lost++
+			} else {
+				repair.Status = RepairRepaired
+				result.Repaired++
+			}
+		}
+		result.Chunks = append(result.Chunks, repair)
+	}
+
+	if result.Repaired > 0 {
+		s.InvalidateFile(fileID)
+	}
+	return result, nil
+}
+
+// repairChunk replaces a chunk's data with a verified copy from its nodes and
+// checks the stored copy now matches the chunk's hash
+func (s *ChunkService) repairChunk(ctx context.Context, chunk models.Chunk) error {
+	good, err := s.fetchFromNodes(ctx, chunk)
+	if err != nil {
+		return err
+	}
+	if err := s.store.SetChunkData(ctx, chunk.ID, good); err != nil {
+		return fmt.Errorf("failed to rewrite chunk %d: %w", chunk.ChunkIndex, err)
+	}
+	_, stored, err := s.store.GetChunk(ctx, chunk.ID)
+	if err != nil {
+		return fmt.Errorf("failed to read back chunk %d: %w", chunk.ChunkIndex, err)
+	}
+	if chunkHash(stored) != chunk.Hash {
+		return fmt.Errorf("%w: rewritten chunk %d does not match its hash", ErrChunkVerifyFailed, chunk.ChunkIndex)
+	}
+	return nil
+}
+
+func chunkHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
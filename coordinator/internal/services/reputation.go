@@ -0,0 +1,191 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/federated-storage/coordinator/internal/models"
+	"github.com/google/uuid"
+)
+
+// DefaultReputationScore is the score of a node with no recorded history:
+// neutral, so a newcomer ranks below nodes with a proven record and above
+// those with a poor one until its own snapshots say otherwise
+const DefaultReputationScore = 0.5
+
+// reputationDecay weights each older snapshot this much less than the one after it
+const reputationDecay = 0.9
+
+// reputationWindow is how many recent snapshots feed a node's score
+const reputationWindow = 30
+
+// heartbeatStaleAfter is how long since its last heartbeat a node still counts as available
+const heartbeatStaleAfter = 2 * time.Minute
+
+// snapshotScore rates a single snapshot between 0 and 1, weighting proofs
+// most since they are the only direct evidence the data is still held
+func snapshotScore(r models.NodeReputation) float64 {
+	return 0.3*r.UptimePercentage/100 + 0.5*r.ProofPassRate + 0.2*r.Availability
+}
+
+// ReputationScore combines snapshots, newest first, into one score between 0
+// and 1. Recent behavior counts most, but a long good record is not erased by
+// one bad period. The neutral DefaultReputationScore counts as one snapshot
+// older than any recorded, so a node earns its score over several snapshots
+// rather than from its first one.
+func ReputationScore(history []models.NodeReputation) float64 {
+	var weighted, total float64
+	weight := 1.0
+	for _, r := range history {
+		weighted += weight * snapshotScore(r)
+		total += weight
+		weight *= reputationDecay
+	}
+	weighted += weight * DefaultReputationScore
+	total += weight
+	return weighted / total
+}
+
+// newReputationSnapshot builds a snapshot from a node's state and the proofs decided since the last one.
+// A node with no decided proofs in the period keeps a perfect pass rate.
+func newReputationSnapshot(nodeID uuid.UUID, uptime float64, lastHeartbeat *time.Time, verified, failed int, now time.Time) models.NodeReputation {
+	passRate := 1.0
+	if verified+failed > 0 {
+		passRate = float64(verified) / float64(verified+failed)
+	}
+	availability := 0.0
+	if lastHeartbeat != nil && now.Sub(*lastHeartbeat) <= heartbeatStaleAfter {
+		availability = 1.0
+	}
+	return models.NodeReputation{
+		ID:               uuid.New(),
+		NodeID:           nodeID,
+		UptimePercentage: uptime,
+		ProofsVerified:   verified,
+		ProofsFailed:     failed,
+		ProofPassRate:    passRate,
+		Availability:     availability,
+		RecordedAt:       now,
+	}
+}
+
+// RankByReputation orders nodes from most to least trusted, keeping the
+// existing order among equals
+func RankByReputation(nodes []models.StorageNode) {
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return nodes[i].ReputationScore > nodes[j].ReputationScore
+	})
+}
+
+// excuseFailedProof moves one of a snapshot's failed proofs to the verified
+// count, rescoring it, for a failure the node later made good on
+func excuseFailedProof(r models.NodeReputation) models.NodeReputation {
+	if r.ProofsFailed == 0 {
+		return r
+	}
+	r.ProofsFailed--
+	r.ProofsVerified++
+	r.ProofPassRate = float64(r.ProofsVerified) / float64(r.ProofsVerified+r.ProofsFailed)
+	r.Score = snapshotScore(r)
+	return r
+}
+
+// RecordReputationSnapshots stores a snapshot for every active node covering
+// proofs decided since the given time, and refreshes each node's score
+func (s *NodeService) RecordReputationSnapshots(ctx context.Context, since time.Time) (int, error) {
+	nodes, err := s.GetAllNodes(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list nodes: %w", err)
+	}
+
+	now := time.Now()
+	recorded := 0
+	var errs []error
+	for _, node := range nodes {
+		if err := s.recordReputation(ctx, node, since, now); err != nil {
+			errs = append(errs, fmt.Errorf("node %s: %w", node.ID, err))
+			continue
+		}
+		recorded++
+	}
+	return recorded, errors.Join(errs...)
+}
+
+// recordReputation snapshots a node's proofs decided since the given time.
+// Misses forgiven as they were recorded count nowhere.
+func (s *NodeService) recordReputation(ctx context.Context, node models.StorageNode, since, now time.Time) error {
+	tx, err := s.db.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var verified, failed int
+	err = tx.QueryRow(ctx,
+		`SELECT COUNT(*) FILTER (WHERE status = 'verified'), COUNT(*) FILTER (WHERE status = 'failed')
+		 FROM proof_challenges WHERE node_id = $1 AND verified_at >= $2`,
+		node.ID, since).Scan(&verified, &failed)
+	if err != nil {
+		return fmt.Errorf("failed to count proofs: %w", err)
+	}
+	var fileVerified, fileFailed int
+	err = tx.QueryRow(ctx,
+		`SELECT COUNT(*) FILTER (WHERE status = 'verified'), COUNT(*) FILTER (WHERE status = 'failed')
+		 FROM file_challenges WHERE node_id = $1 AND verified_at >= $2`,
+		node.ID, since).Scan(&fileVerified, &fileFailed)
+	if err != nil {
+		return fmt.Errorf("failed to count file proofs: %w", err)
+	}
+	verified += fileVerified
+	failed += fileFailed
+
+	history, err := s.GetReputationHistory(ctx, node.ID, reputationWindow-1)
+	if err != nil {
+		return err
+	}
+	snapshot := newReputationSnapshot(node.ID, node.UptimePercentage, node.LastHeartbeat, verified, failed, now)
+	snapshot.Score = snapshotScore(snapshot)
+	score := ReputationScore(append([]models.NodeReputation{snapshot}, history...))
+
+	_, err = tx.Exec(ctx,
+		`INSERT INTO node_reputation (id, node_id, uptime_percentage, proofs_verified, proofs_failed, proof_pass_rate, availability, score, recorded_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		snapshot.ID, snapshot.NodeID, snapshot.UptimePercentage, snapshot.ProofsVerified, snapshot.ProofsFailed,
+		snapshot.ProofPassRate, snapshot.Availability, snapshot.Score, snapshot.RecordedAt)
+	if err != nil {
+		return fmt.Errorf("failed to record snapshot: %w", err)
+	}
+	if _, err := tx.Exec(ctx,
+		"UPDATE storage_nodes SET reputation_score = $1 WHERE id = $2",
+		score, node.ID); err != nil {
+		return fmt.Errorf("failed to update score: %w", err)
+	}
+	return tx.Commit(ctx)
+}
+
+// GetReputationHistory returns a node's most recent reputation snapshots, newest first
+func (s *NodeService) GetReputationHistory(ctx context.Context, nodeID uuid.UUID, limit int) ([]models.NodeReputation, error) {
+	rows, err := s.db.Pool.Query(ctx,
+		`SELECT id, node_id, uptime_percentage, proofs_verified, proofs_failed, proof_pass_rate, availability, score, recorded_at
+		 FROM node_reputation WHERE node_id = $1
+		 ORDER BY recorded_at DESC LIMIT $2`,
+		nodeID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load reputation history: %w", err)
+	}
+	defer rows.Close()
+
+	var history []models.NodeReputation
+	for rows.Next() {
+		var r models.NodeReputation
+		if err := rows.Scan(&r.ID, &r.NodeID, &r.UptimePercentage, &r.ProofsVerified, &r.ProofsFailed,
+			&r.ProofPassRate, &r.Availability, &r.Score, &r.RecordedAt); err != nil {
+			return nil, err
+		}
+		history = append(history, r)
+	}
+	return history, rows.Err()
+}
@@ -1,10 +1,30 @@
 package services
 
 import (
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/federated-storage/coordinator/internal/chunkformat"
+	"github.com/federated-storage/coordinator/internal/merkle"
 	"github.com/federated-storage/coordinator/internal/models"
+	"github.com/federated-storage/coordinator/internal/storage"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 )
@@ -286,6 +306,56 @@ func TestChunkService_EncryptDecrypt(t *testing.T) {
 	}
 }
 
+func TestOpenChunk_LegacyAndHeaderedChunks(t *testing.T) {
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	data := []byte(strings.Repeat("compressible chunk data ", 50))
+
+	// Chunks stored before headers were written are the sealed data alone
+	legacy, err := DefaultCipher.Encrypt(data, key)
+	assert.NoError(t, err)
+	assert.Equal(t, chunkformat.Legacy, chunkformat.Version(legacy))
+	decrypted, err := DecryptChunk(legacy, key)
+	assert.NoError(t, err)
+	assert.Equal(t, data, decrypted)
+
+	plain, err := EncryptChunk(data, key)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{'D', 'S', 'C', 'K', chunkformat.V1, 0}, plain[:chunkformat.HeaderSize])
+	assert.Equal(t, len(data), PlaintextSize(DefaultCipher, models.Chunk{SizeBytes: len(plain), Format: chunkformat.Version(plain)}))
+	decrypted, err = DecryptChunk(plain, key)
+	assert.NoError(t, err)
+	assert.Equal(t, data, decrypted)
+
+	for _, c := range []Cipher{CipherAES256GCM, CipherAES128GCM, CipherChaCha20Poly1305} {
+		cipherKey := key[:c.KeySize()]
+		flagged, err := SealChunk(c, data, cipherKey, chunkformat.FlagCompressed)
+		assert.NoError(t, err)
+		assert.Equal(t, chunkformat.FlagCompressed, flagged[chunkformat.HeaderSize-1])
+		assert.Less(t, len(flagged), len(legacy), "%s: the compressed chunk should be smaller", c)
+		decrypted, err := OpenChunk(c, flagged, cipherKey)
+		assert.NoError(t, err)
+		assert.Equal(t, data, decrypted, c)
+	}
+
+	// The header is authenticated: clearing a flag breaks the chunk
+	flagged, err := SealChunk(DefaultCipher, data, key, chunkformat.FlagCompressed)
+	assert.NoError(t, err)
+	flagged[chunkformat.HeaderSize-1] = 0
+	_, err = DecryptChunk(flagged, key)
+	assert.Error(t, err)
+
+	// Versions and flags from a newer coordinator are refused, not misread
+	future := append([]byte(nil), plain...)
+	future[chunkformat.HeaderSize-2] = 9
+	_, err = DecryptChunk(future, key)
+	assert.ErrorIs(t, err, ErrUnsupportedChunk)
+	_, err = SealChunk(DefaultCipher, data, key, 0x80)
+	assert.ErrorIs(t, err, ErrUnsupportedChunk)
+}
+
 func TestProofService_generateExpectedProof(t *testing.T) {
 	service := &ProofService{
 		difficulty: 1000,
@@ -429,3 +499,3964 @@ func TestUploadSession_Expiry(t *testing.T) {
 	session.ExpiresAt = time.Now().Add(-1 * time.Hour)
 	assert.True(t, time.Now().After(session.ExpiresAt), "Session should be expired")
 }
+
+func TestProofService_VerifyFileEnqueuesEveryReplica(t *testing.T) {
+	service := NewProofService(nil, 1000, ProofTimeout{BaseMs: 1000, MsPerRound: 1}, nil, 5*time.Minute)
+
+	fileID := uuid.New()
+	chunk0, chunk1 := uuid.New(), uuid.New()
+	nodeA, nodeB, nodeC := uuid.New(), uuid.New(), uuid.New()
+	replicas := []ChunkReplica{
+		{ChunkID: chunk0, ChunkIndex: 0, NodeID: nodeA, PeerID: "peer-a"},
+		{ChunkID: chunk0, ChunkIndex: 0, NodeID: nodeB, PeerID: "peer-b"},
+		{ChunkID: chunk0, ChunkIndex: 0, NodeID: nodeC, PeerID: "peer-c"},
+		{ChunkID: chunk1, ChunkIndex: 1, NodeID: nodeA, PeerID: "peer-a"},
+		{ChunkID: chunk1, ChunkIndex: 1, NodeID: nodeB, PeerID: "peer-b"},
+		{ChunkID: chunk1, ChunkIndex: 1, NodeID: nodeC, PeerID: "peer-c"},
+	}
+
+	type enqueued struct{ chunkID, nodeID uuid.UUID }
+	var created []enqueued
+	create := func(ctx context.Context, chunkID, nodeID uuid.UUID) (*models.ProofChallenge, error) {
+		created = append(created, enqueued{chunkID, nodeID})
+		return &models.ProofChallenge{ID: uuid.New(), ChunkID: chunkID, NodeID: nodeID, Status: "pending"}, nil
+	}
+
+	result := service.challengeReplicas(context.Background(), fileID, replicas, create)
+
+	assert.Len(t, created, len(replicas), "Should enqueue one challenge per chunk assignment")
+	for i, r := range replicas {
+		assert.Equal(t, r.ChunkID, created[i].chunkID)
+		assert.Equal(t, r.NodeID, created[i].nodeID)
+	}
+
+	assert.Equal(t, fileID.String(), result.FileID)
+	assert.Equal(t, len(replicas), result.Total)
+	assert.Equal(t, len(replicas), result.Pending, "Without P2P, challenges stay pending")
+	assert.Equal(t, 0, result.Passed)
+	assert.Equal(t, 0, result.Failed)
+}
+
+func TestProofService_AllowFileVerify(t *testing.T) {
+	service := NewProofService(nil, 1000, ProofTimeout{BaseMs: 1000, MsPerRound: 1}, nil, time.Minute)
+	fileID := uuid.New()
+
+	ok, _ := service.AllowFileVerify(fileID)
+	assert.True(t, ok, "First verification should be allowed")
+
+	ok, wait := service.AllowFileVerify(fileID)
+	assert.False(t, ok, "Second verification within cooldown should be rejected")
+	assert.Greater(t, wait, time.Duration(0))
+	assert.LessOrEqual(t, wait, time.Minute)
+
+	ok, _ = service.AllowFileVerify(uuid.New())
+	assert.True(t, ok, "Cooldown is tracked per file")
+}
+
+func TestUploadService_ChunkCountFor(t *testing.T) {
+	service := NewUploadService(nil, 1024, 3, 10)
+
+	tests := []struct {
+		name       string
+		sizeBytes  int64
+		wantChunks int
+		wantErr    bool
+	}{
+		{
+			name:       "well under the cap",
+			sizeBytes:  2048,
+			wantChunks: 2,
+		},
+		{
+			name:       "exactly at the cap",
+			sizeBytes:  10 * 1024,
+			wantChunks: 10,
+		},
+		{
+			name:      "one byte over the cap",
+			sizeBytes: 10*1024 + 1,
+			wantErr:   true,
+		},
+		{
+			name:      "huge file with tiny chunks",
+			sizeBytes: 1024 * 1024 * 1024,
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := service.ChunkCountFor(tt.sizeBytes)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrTooManyChunks)
+				assert.Contains(t, err.Error(), "chunk size")
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantChunks, got)
+		})
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.0.0", "1.0.0", 0},
+		{"v1.2.0", "1.2", 0},
+		{"0.9.9", "1.0.0", -1},
+		{"1.10.0", "1.9.3", 1},
+		{"2.0.0-rc1", "2.0.0", 0},
+		{"1.2", "1.2.1", -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.a+"_vs_"+tt.b, func(t *testing.T) {
+			assert.Equal(t, tt.want, CompareVersions(tt.a, tt.b))
+		})
+	}
+}
+
+func TestNodeService_CheckVersion(t *testing.T) {
+	service := NewNodeService(nil, "0.2.0")
+
+	assert.NoError(t, service.CheckVersion("0.2.0"))
+	assert.NoError(t, service.CheckVersion("1.0.0"))
+
+	err := service.CheckVersion("0.1.5")
+	assert.ErrorIs(t, err, ErrNodeVersionTooOld, "Outdated node should be rejected")
+	assert.Contains(t, err.Error(), "upgrade")
+
+	err = service.CheckVersion("")
+	assert.ErrorIs(t, err, ErrNodeVersionTooOld, "Node without a version should be rejected")
+
+	unrestricted := NewNodeService(nil, "")
+	assert.NoError(t, unrestricted.CheckVersion(""), "No minimum configured accepts any node")
+}
+
+func TestPricing_RateFor(t *testing.T) {
+	pricing := NewPricing(1000, []PricingTier{
+		{MinUSD: 1000, CreditsPerUSD: 1250},
+		{MinUSD: 100, CreditsPerUSD: 1100},
+	})
+
+	tests := []struct {
+		name      string
+		amountUSD int
+		want      int64
+	}{
+		{"default rate", 1, 1000},
+		{"just below first tier", 99, 1000},
+		{"first tier boundary", 100, 1100},
+		{"between tiers", 999, 1100},
+		{"second tier boundary", 1000, 1250},
+		{"above top tier", 5000, 1250},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, pricing.RateFor(tt.amountUSD))
+		})
+	}
+}
+
+func TestPricing_Credits(t *testing.T) {
+	pricing := NewPricing(1000, nil)
+
+	credits, rate := pricing.Credits(50, nil)
+	assert.Equal(t, int64(1000), rate, "No tiers should use the default rate")
+	assert.Equal(t, int64(50000), credits)
+
+	override := int64(2000)
+	credits, rate = pricing.Credits(50, &override)
+	assert.Equal(t, int64(2000), rate, "User override should take precedence")
+	assert.Equal(t, int64(100000), credits)
+}
+
+func TestCipher_RoundTrip(t *testing.T) {
+	plaintext := []byte("the quick brown fox jumps over the lazy dog")
+
+	for _, c := range []Cipher{CipherAES256GCM, CipherAES128GCM, CipherChaCha20Poly1305} {
+		t.Run(string(c), func(t *testing.T) {
+			key, err := c.NewKey()
+			assert.NoError(t, err)
+			assert.Len(t, key, c.KeySize())
+
+			ciphertext, err := c.Encrypt(plaintext, key)
+			assert.NoError(t, err)
+			assert.NotContains(t, string(ciphertext), "quick brown fox")
+
+			decrypted, err := c.Decrypt(ciphertext, key)
+			assert.NoError(t, err)
+			assert.Equal(t, plaintext, decrypted)
+
+			// The wrong key, or a key of the wrong size, fails clearly
+			other, err := c.NewKey()
+			assert.NoError(t, err)
+			_, err = c.Decrypt(ciphertext, other)
+			assert.Error(t, err)
+			_, err = c.Encrypt(plaintext, make([]byte, 24))
+			assert.ErrorIs(t, err, ErrInvalidKeySize)
+			assert.Contains(t, err.Error(), fmt.Sprintf("needs a %d-byte key, got 24 bytes", c.KeySize()))
+		})
+	}
+
+	// Ciphers are not interchangeable even with a key of the right size
+	key, err := CipherChaCha20Poly1305.NewKey()
+	assert.NoError(t, err)
+	ciphertext, err := CipherChaCha20Poly1305.Encrypt(plaintext, key)
+	assert.NoError(t, err)
+	_, err = CipherAES256GCM.Decrypt(ciphertext, key)
+	assert.Error(t, err)
+}
+
+func TestEncryptChunk_RejectsInvalidKeyLengths(t *testing.T) {
+	sealed, err := EncryptChunk([]byte("chunk"), make([]byte, 32))
+	assert.NoError(t, err)
+
+	// 16 and 24 bytes are valid AES keys, just not for aes-256-gcm
+	for _, size := range []int{0, 1, 15, 16, 24, 31, 33, 64} {
+		t.Run(fmt.Sprintf("%d bytes", size), func(t *testing.T) {
+			want := fmt.Sprintf("aes-256-gcm needs a 32-byte key, got %d bytes", size)
+
+			_, err := EncryptChunk([]byte("chunk"), make([]byte, size))
+			assert.ErrorIs(t, err, ErrInvalidKeySize)
+			assert.ErrorContains(t, err, want)
+
+			_, err = DecryptChunk(sealed, make([]byte, size))
+			assert.ErrorIs(t, err, ErrInvalidKeySize)
+			assert.ErrorContains(t, err, want)
+		})
+	}
+}
+
+// shortKeys is a key provider handing out keys one byte short of the cipher's size
+type shortKeys struct{}
+
+func (shortKeys) NewKey(c Cipher, fileID uuid.UUID) ([]byte, bool, error) {
+	return make([]byte, c.KeySize()-1), true, nil
+}
+
+func (shortKeys) FileKey(c Cipher, fileID uuid.UUID, stored []byte) ([]byte, error) {
+	return stored, nil
+}
+
+func TestUploadService_InitiateRejectsKeyOfWrongSize(t *testing.T) {
+	store := storage.NewMemoryStore()
+	uploads := NewUploadService(store, 8, 1, 100)
+	uploads.SetKeyProvider(shortKeys{})
+	userID := uuid.New()
+
+	_, err := uploads.InitiateUpload(context.Background(), userID, InitiateUploadRequest{Filename: "a.txt", SizeBytes: 5}, 0)
+	assert.ErrorIs(t, err, ErrInvalidKeySize)
+	assert.ErrorContains(t, err, "aes-256-gcm needs a 32-byte key, got 31 bytes")
+	active, err := store.CountActiveUploadSessions(context.Background(), userID, time.Now())
+	assert.NoError(t, err)
+	assert.Zero(t, active, "No session should be left behind")
+
+	files := NewFileService(store, 8, 100)
+	files.SetKeyProvider(shortKeys{})
+	_, _, err = files.CreateEncryptedFile(context.Background(), userID, "a.txt", 5, "", CipherChaCha20Poly1305, 1)
+	assert.ErrorIs(t, err, ErrInvalidKeySize)
+}
+
+func TestParseCipher(t *testing.T) {
+	c, err := ParseCipher("")
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultCipher, c)
+
+	c, err = ParseCipher("chacha20-poly1305")
+	assert.NoError(t, err)
+	assert.Equal(t, CipherChaCha20Poly1305, c)
+
+	_, err = ParseCipher("aes-192-gcm")
+	assert.ErrorIs(t, err, ErrUnknownCipher)
+}
+
+// slowKeys hands out valid keys after a delay, as a remote key service would
+type slowKeys struct{}
+
+func (slowKeys) NewKey(c Cipher, fileID uuid.UUID) ([]byte, bool, error) {
+	time.Sleep(10 * time.Millisecond)
+	return make([]byte, c.KeySize()), true, nil
+}
+
+func (slowKeys) FileKey(c Cipher, fileID uuid.UUID, stored []byte) ([]byte, error) {
+	return stored, nil
+}
+
+func TestUploadService_ConcurrentInitiationsKeepTheCap(t *testing.T) {
+	store := storage.NewMemoryStore()
+	uploads := NewUploadService(store, 8, 1, 100)
+	uploads.SetKeyProvider(slowKeys{})
+	uploads.SetMaxActiveSessions(2)
+	userID := uuid.New()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := uploads.InitiateUpload(context.Background(), userID, InitiateUploadRequest{Filename: "a.txt", SizeBytes: 5}, 0)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	created := 0
+	for err := range errs {
+		if err == nil {
+			created++
+		} else {
+			assert.ErrorIs(t, err, ErrTooManyUploads)
+		}
+	}
+	assert.Equal(t, 2, created)
+	active, err := store.CountActiveUploadSessions(context.Background(), userID, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, active)
+}
+
+func TestUploadService_SessionKeyMatchesCipher(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	uploads := NewUploadService(store, 8, 1, 100)
+	files := NewFileService(store, 8, 100)
+	uploads.SetCipher(CipherAES128GCM)
+
+	session, err := uploads.InitiateUpload(ctx, uuid.New(), InitiateUploadRequest{Filename: "a.txt", SizeBytes: 5}, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "aes-128-gcm", session.Cipher)
+	assert.Len(t, session.EncryptionKey, 16)
+
+	// Files record the session's cipher, so later config changes don't break decryption
+	uploads.SetCipher(CipherChaCha20Poly1305)
+	file, err := files.CreateFile(ctx, session.UserID, session.Filename, session.SizeBytes, "", session.EncryptionKey, Cipher(session.Cipher), 1)
+	assert.NoError(t, err)
+	encrypted, err := Cipher(session.Cipher).Encrypt([]byte("hello"), session.EncryptionKey)
+	assert.NoError(t, err)
+	stored, err := files.GetFile(ctx, file.ID)
+	assert.NoError(t, err)
+	data, err := AssembleFile(map[int][]byte{0: encrypted}, 1, Cipher(stored.Cipher), stored.EncryptionKey)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+}
+
+func TestDerivedKeys_ReproducibleFromFileIDAndMasterKey(t *testing.T) {
+	masterKey := make([]byte, 32)
+	for i := range masterKey {
+		masterKey[i] = byte(i)
+	}
+	keys, err := NewDerivedKeys(masterKey)
+	assert.NoError(t, err)
+	fileID := uuid.New()
+
+	key, store, err := keys.NewKey(DefaultCipher, fileID)
+	assert.NoError(t, err)
+	assert.False(t, store, "Derived keys are not stored")
+	assert.Len(t, key, DefaultCipher.KeySize())
+
+	// A provider built later from the same master key finds the same key
+	again, err := ParseKeyProvider(KeyProviderDerived, hex.EncodeToString(masterKey))
+	assert.NoError(t, err)
+	found, err := again.FileKey(DefaultCipher, fileID, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, key, found)
+
+	other, _, err := keys.NewKey(DefaultCipher, uuid.New())
+	assert.NoError(t, err)
+	assert.NotEqual(t, key, other, "Each file gets its own key")
+
+	otherMaster := append([]byte(nil), masterKey...)
+	otherMaster[0] ^= 1
+	otherKeys, err := NewDerivedKeys(otherMaster)
+	assert.NoError(t, err)
+	other, _, err = otherKeys.NewKey(DefaultCipher, fileID)
+	assert.NoError(t, err)
+	assert.NotEqual(t, key, other, "Another master key derives another key")
+
+	short, _, err := keys.NewKey(CipherAES128GCM, fileID)
+	assert.NoError(t, err)
+	assert.Len(t, short, 16)
+	assert.NotEqual(t, key[:16], short, "Ciphers get unrelated keys for the same file")
+
+	// Files keyed before the switch keep their stored key
+	stored := make([]byte, 32)
+	found, err = keys.FileKey(DefaultCipher, fileID, stored)
+	assert.NoError(t, err)
+	assert.Equal(t, stored, found)
+
+	_, err = NewDerivedKeys(masterKey[:16])
+	assert.Error(t, err)
+	_, err = ParseKeyProvider(KeyProviderDerived, "not hex")
+	assert.Error(t, err)
+	_, err = ParseKeyProvider("vault", "")
+	assert.Error(t, err)
+	_, err = RandomKeys{}.FileKey(DefaultCipher, fileID, nil)
+	assert.ErrorIs(t, err, ErrNoFileKey)
+
+	// Switching back to random keys keeps derived files readable while the
+	// master key is still configured
+	random, err := ParseKeyProvider(KeyProviderRandom, hex.EncodeToString(masterKey))
+	assert.NoError(t, err)
+	found, err = random.FileKey(DefaultCipher, fileID, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, key, found)
+	newKey, store, err := random.NewKey(DefaultCipher, uuid.New())
+	assert.NoError(t, err)
+	assert.True(t, store, "New files still get stored random keys")
+	assert.Len(t, newKey, DefaultCipher.KeySize())
+	_, err = ParseKeyProvider(KeyProviderRandom, "not hex")
+	assert.Error(t, err)
+}
+
+func TestFileService_DerivedKeysAreNotStored(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	keys, err := NewDerivedKeys(make([]byte, 32))
+	assert.NoError(t, err)
+	uploads := NewUploadService(store, 8, 1, 100)
+	uploads.SetKeyProvider(keys)
+	files := NewFileService(store, 8, 100)
+	files.SetKeyProvider(keys)
+	chunkService := NewChunkService(store, nil, nil)
+
+	session, err := uploads.InitiateUpload(ctx, uuid.New(), InitiateUploadRequest{Filename: "a.txt", SizeBytes: 5}, 0)
+	assert.NoError(t, err)
+	assert.Nil(t, session.EncryptionKey)
+	sessionKey, err := uploads.SessionKey(session)
+	assert.NoError(t, err)
+
+	file, err := files.CreateSessionFile(ctx, session)
+	assert.NoError(t, err)
+	assert.Equal(t, session.ID, file.ID, "The file takes the ID its session's key was derived from")
+	encrypted, err := DefaultCipher.Encrypt([]byte("hello"), sessionKey)
+	assert.NoError(t, err)
+	_, err = chunkService.StoreChunk(ctx, file.ID, 0, encrypted, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, files.MarkFileComplete(ctx, file.ID))
+
+	stored, err := files.GetFile(ctx, file.ID)
+	assert.NoError(t, err)
+	assert.Nil(t, stored.EncryptionKey)
+	key, err := files.FileKey(stored)
+	assert.NoError(t, err)
+	data, err := AssembleFile(map[int][]byte{0: encrypted}, 1, DefaultCipher, key)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+
+	// Rotation moves the file to a stored random key
+	assert.NoError(t, files.RotateKey(ctx, file.ID))
+	rotated, err := files.GetFile(ctx, file.ID)
+	assert.NoError(t, err)
+	assert.Len(t, rotated.EncryptionKey, 32)
+	chunks, err := chunkService.GetChunksByFileWithData(ctx, file.ID)
+	assert.NoError(t, err)
+	key, err = files.FileKey(rotated)
+	assert.NoError(t, err)
+	data, err = AssembleFile(chunks, 1, DefaultCipher, key)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+}
+
+func TestReencryptChunks_RoundTrip(t *testing.T) {
+	oldKey := make([]byte, 32)
+	newKey := make([]byte, 32)
+	for i := range newKey {
+		newKey[i] = byte(i + 1)
+	}
+
+	parts := [][]byte{[]byte("first chunk "), []byte("second chunk "), []byte("last")}
+	chunks := make(map[int][]byte)
+	for i, part := range parts {
+		encrypted, err := EncryptChunk(part, oldKey)
+		assert.NoError(t, err)
+		chunks[i] = encrypted
+	}
+
+	rotated, err := ReencryptChunks(chunks, DefaultCipher, oldKey, newKey)
+	assert.NoError(t, err)
+	assert.Len(t, rotated, len(parts))
+
+	data, err := AssembleFile(rotated, len(parts), DefaultCipher, newKey)
+	assert.NoError(t, err)
+	assert.Equal(t, "first chunk second chunk last", string(data), "File should download intact after rotation")
+
+	_, err = AssembleFile(rotated, len(parts), DefaultCipher, oldKey)
+	assert.Error(t, err, "Old key should no longer decrypt the file")
+
+	_, err = ReencryptChunks(chunks, DefaultCipher, newKey, oldKey)
+	assert.Error(t, err, "Rotation with the wrong current key should fail")
+}
+
+func TestDiffChunkSets(t *testing.T) {
+	a, b, c, d := uuid.New(), uuid.New(), uuid.New(), uuid.New()
+
+	tests := []struct {
+		name        string
+		expected    []uuid.UUID
+		held        []uuid.UUID
+		wantMissing []uuid.UUID
+		wantExtra   []uuid.UUID
+	}{
+		{"in sync", []uuid.UUID{a, b}, []uuid.UUID{b, a}, nil, nil},
+		{"node lacks chunks", []uuid.UUID{a, b, c}, []uuid.UUID{a}, []uuid.UUID{b, c}, nil},
+		{"node holds unassigned chunks", []uuid.UUID{a}, []uuid.UUID{a, d}, nil, []uuid.UUID{d}},
+		{"both directions", []uuid.UUID{a, b}, []uuid.UUID{b, c, c}, []uuid.UUID{a}, []uuid.UUID{c}},
+		{"empty node", []uuid.UUID{a}, nil, []uuid.UUID{a}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diff := DiffChunkSets(tt.expected, tt.held)
+			assert.ElementsMatch(t, tt.wantMissing, diff.Missing)
+			assert.ElementsMatch(t, tt.wantExtra, diff.Extra)
+		})
+	}
+}
+
+func TestPackChunkIDs_RoundTrip(t *testing.T) {
+	ids := []uuid.UUID{uuid.New(), uuid.New(), uuid.New()}
+
+	packed := PackChunkIDs(ids)
+	assert.Less(t, len(packed), len(ids)*36, "Packed form should be smaller than UUID strings")
+
+	unpacked, err := UnpackChunkIDs(packed)
+	assert.NoError(t, err)
+	assert.Equal(t, ids, unpacked)
+
+	empty, err := UnpackChunkIDs("")
+	assert.NoError(t, err)
+	assert.Empty(t, empty)
+
+	_, err = UnpackChunkIDs("AAEC")
+	assert.Error(t, err, "Truncated input should be rejected")
+}
+
+func TestProofTimeout_ScalesWithDifficulty(t *testing.T) {
+	timeout := ProofTimeout{BaseMs: 1000, MsPerRound: 1.5}
+
+	assert.Equal(t, 2500, timeout.For(1000))
+	assert.Equal(t, 16000, timeout.For(10000))
+
+	// A slow-but-honest node on a hard challenge passes
+	assert.NoError(t, checkProofDuration(12000, timeout.For(10000)))
+
+	// The same response time fails an easy challenge
+	err := checkProofDuration(12000, timeout.For(1000))
+	assert.ErrorIs(t, err, ErrProofTimedOut)
+
+	// A genuinely slow response fails even on a hard challenge
+	err = checkProofDuration(20000, timeout.For(10000))
+	assert.ErrorIs(t, err, ErrProofTimedOut)
+	assert.Contains(t, err.Error(), "limit 16000 ms")
+}
+
+func TestCheckMerkleProof(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	chunkService := NewChunkService(store, nil, nil)
+
+	data := make([]byte, 5*merkle.BlockSize+100)
+	for i := range data {
+		data[i] = byte(i / 3)
+	}
+	chunk, err := chunkService.StoreChunk(ctx, uuid.New(), 0, data, nil)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, chunk.MerkleRoot, "Stored chunks record their Merkle root")
+
+	seed := []byte("challenge-seed")
+	leaf := challengeLeaf(chunk.MerkleRoot, chunk.SizeBytes, seed)
+	block, path, err := merkle.Prove(data, leaf)
+	assert.NoError(t, err)
+	valid := &models.MerkleProof{LeafIndex: leaf, Block: block, Path: path}
+	assert.NoError(t, checkMerkleProof(chunk.MerkleRoot, chunk.SizeBytes, seed, valid))
+
+	tampered := &models.MerkleProof{LeafIndex: leaf, Block: append([]byte{block[0] ^ 0xff}, block[1:]...), Path: path}
+	assert.ErrorIs(t, checkMerkleProof(chunk.MerkleRoot, chunk.SizeBytes, seed, tampered), ErrInvalidMerkleProof)
+
+	// A node may not pick a block it happens to hold instead of the requested one
+	other := (leaf + 1) % merkle.LeafCount(len(data))
+	block, path, err = merkle.Prove(data, other)
+	assert.NoError(t, err)
+	wrongLeaf := &models.MerkleProof{LeafIndex: other, Block: block, Path: path}
+	assert.ErrorIs(t, checkMerkleProof(chunk.MerkleRoot, chunk.SizeBytes, seed, wrongLeaf), ErrInvalidMerkleProof)
+
+	assert.ErrorIs(t, checkMerkleProof(chunk.MerkleRoot, chunk.SizeBytes, seed, nil), ErrInvalidMerkleProof)
+
+	// Chunks stored before roots were recorded are not checked
+	assert.NoError(t, checkMerkleProof("", chunk.SizeBytes, seed, nil))
+	assert.Equal(t, -1, challengeLeaf("", chunk.SizeBytes, seed))
+}
+
+func TestCheckBulkPeerIDs_MixedBatch(t *testing.T) {
+	reqs := []RegisterNodeRequest{
+		{Name: "node-a", PeerID: "peer-a"},
+		{Name: "node-b", PeerID: "peer-b"},
+		{Name: "node-a-again", PeerID: "peer-a"},
+		{Name: "node-c", PeerID: "peer-c"},
+	}
+	existing := map[string]bool{"peer-c": true}
+
+	results, ok := checkBulkPeerIDs(reqs, existing)
+
+	assert.False(t, ok, "Batch with duplicates should be rejected")
+	assert.Len(t, results, len(reqs))
+	assert.Empty(t, results[0].Error)
+	assert.Empty(t, results[1].Error)
+	assert.Contains(t, results[2].Error, "same as entry 0")
+	assert.Contains(t, results[3].Error, "already exists")
+	for i, r := range results {
+		assert.Equal(t, i, r.Index)
+		assert.Equal(t, reqs[i].PeerID, r.PeerID)
+		assert.Empty(t, r.APIKey, "No keys should be issued for a rejected batch")
+	}
+
+	results, ok = checkBulkPeerIDs(reqs[:2], existing)
+	assert.True(t, ok, "Batch without duplicates should be accepted")
+	assert.Len(t, results, 2)
+}
+
+func TestAuthService_RegisterThenLogin(t *testing.T) {
+	ctx := context.Background()
+	service := NewAuthService(storage.NewMemoryStore(), NewPricing(1000, nil))
+
+	user, err := service.Register(ctx, RegisterRequest{Email: "alice@example.com", Password: "correct-horse"})
+	assert.NoError(t, err)
+	assert.NotEqual(t, "correct-horse", user.PasswordHash, "Password should be stored hashed")
+
+	_, err = service.Register(ctx, RegisterRequest{Email: "alice@example.com", Password: "another-pass"})
+	assert.EqualError(t, err, "user already exists")
+
+	loggedIn, err := service.Login(ctx, LoginRequest{Email: "alice@example.com", Password: "correct-horse"})
+	assert.NoError(t, err)
+	assert.Equal(t, user.ID, loggedIn.ID)
+
+	_, err = service.Login(ctx, LoginRequest{Email: "alice@example.com", Password: "wrong-pass"})
+	assert.EqualError(t, err, "invalid credentials")
+
+	_, err = service.Login(ctx, LoginRequest{Email: "bob@example.com", Password: "correct-horse"})
+	assert.EqualError(t, err, "invalid credentials", "Unknown email should look like a bad password")
+}
+
+func TestAuthService_PurchaseCreditsRecordsRate(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	service := NewAuthService(store, NewPricing(1000, []PricingTier{{MinUSD: 100, CreditsPerUSD: 1100}}))
+
+	user, err := service.Register(ctx, RegisterRequest{Email: "carol@example.com", Password: "password123"})
+	assert.NoError(t, err)
+
+	credits, rate, err := service.PurchaseCredits(ctx, user.ID, 100)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1100), rate)
+	assert.Equal(t, int64(110000), credits)
+
+	current, err := service.GetUser(ctx, user.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(110000), current.Credits)
+
+	transactions := store.Transactions(user.ID)
+	assert.Len(t, transactions, 1)
+	assert.Equal(t, "credit", transactions[0].TransactionType)
+	assert.Contains(t, transactions[0].Description, "1100 credits/USD")
+}
+
+func TestAuthService_CreditChain(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	service := NewAuthService(store, NewPricing(1000, nil))
+
+	user, err := service.Register(ctx, RegisterRequest{Email: "dana@example.com", Password: "password123"})
+	assert.NoError(t, err)
+	other, err := service.Register(ctx, RegisterRequest{Email: "erin@example.com", Password: "password123"})
+	assert.NoError(t, err)
+	assert.NoError(t, service.UpdateCredits(ctx, user.ID, 500, "top-up"))
+	assert.NoError(t, service.UpdateCredits(ctx, other.ID, 70, "top-up"))
+	assert.NoError(t, service.UpdateCredits(ctx, user.ID, -120, "download"))
+	assert.NoError(t, service.HoldCredits(ctx, user.ID, 100))
+	assert.NoError(t, service.CaptureCredits(ctx, user.ID, 100, "upload"))
+
+	// Each transaction names the one before it for the same user
+	transactions := store.Transactions(user.ID)
+	assert.Len(t, transactions, 3)
+	assert.Empty(t, transactions[0].PrevHash)
+	for i := 1; i < len(transactions); i++ {
+		assert.Equal(t, transactions[i-1].RowHash, transactions[i].PrevHash)
+	}
+	assert.NoError(t, service.VerifyCreditChain(ctx, user.ID))
+	assert.NoError(t, service.VerifyCreditChain(ctx, other.ID))
+
+	altered := append([]models.CreditTransaction(nil), transactions...)
+	altered[1].Amount = -1
+	assert.ErrorIs(t, storage.VerifyCreditChain(altered), storage.ErrCreditChainBroken)
+
+	removed := []models.CreditTransaction{transactions[0], transactions[2]}
+	assert.ErrorIs(t, storage.VerifyCreditChain(removed), storage.ErrCreditChainBroken)
+
+	// Rows from before the chain existed are not covered
+	legacy := append([]models.CreditTransaction{{ID: uuid.New(), Amount: 5}}, transactions...)
+	assert.NoError(t, storage.VerifyCreditChain(legacy))
+}
+
+func TestFileService_CreateThenGetFile(t *testing.T) {
+	ctx := context.Background()
+	service := NewFileService(storage.NewMemoryStore(), 256*1024, 100)
+	userID := uuid.New()
+	key := make([]byte, 32)
+
+	created, err := service.CreateFile(ctx, userID, "report.pdf", 1024, "application/pdf", key, DefaultCipher, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "uploading", created.Status)
+
+	file, err := service.GetFile(ctx, created.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "report.pdf", file.Filename)
+	assert.Equal(t, userID, file.UserID)
+	assert.Equal(t, key, file.EncryptionKey)
+
+	assert.NoError(t, service.MarkFileComplete(ctx, created.ID))
+	files, err := service.GetUserFiles(ctx, userID, nil)
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+	assert.Equal(t, "ready", files[0].Status)
+
+	_, err = service.GetFile(ctx, uuid.New())
+	assert.EqualError(t, err, "file not found")
+}
+
+func TestFileService_RotateKeyKeepsFileReadable(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	fileService := NewFileService(store, 8, 100)
+	chunkService := NewChunkService(store, nil, nil)
+
+	oldKey := make([]byte, 32)
+	parts := []string{"rotate m", "e please"}
+	file, err := fileService.CreateFile(ctx, uuid.New(), "notes.txt", 16, "", oldKey, DefaultCipher, len(parts))
+	assert.NoError(t, err)
+	for i, part := range parts {
+		encrypted, err := EncryptChunk([]byte(part), oldKey)
+		assert.NoError(t, err)
+		_, err = chunkService.StoreChunk(ctx, file.ID, i, encrypted, nil)
+		assert.NoError(t, err)
+	}
+
+	err = fileService.RotateKey(ctx, file.ID)
+	assert.ErrorIs(t, err, ErrFileBusy, "Files still uploading cannot be rotated")
+
+	assert.NoError(t, fileService.MarkFileComplete(ctx, file.ID))
+	assert.NoError(t, fileService.RotateKey(ctx, file.ID))
+
+	rotated, err := fileService.GetFile(ctx, file.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "ready", rotated.Status, "Busy flag should be cleared after rotation")
+	assert.NotEqual(t, oldKey, rotated.EncryptionKey)
+
+	chunks, err := chunkService.GetChunksByFileWithData(ctx, file.ID)
+	assert.NoError(t, err)
+	data, err := AssembleFile(chunks, rotated.ChunkCount, DefaultCipher, rotated.EncryptionKey)
+	assert.NoError(t, err)
+	assert.Equal(t, "rotate me please", string(data))
+}
+
+func TestFileService_RotateKeyRefreshesReplicas(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	online := models.StorageNode{ID: uuid.New(), PeerID: "online"}
+	gone := uuid.New() // a node no longer registered, which can't be sent the new copy
+	fileService := NewFileService(store, 8, 100)
+	chunkService := NewChunkService(store, staticNodes{online}, nil)
+	transfer := &fakeTransfer{}
+	chunkService.SetTransfer(transfer)
+
+	key := make([]byte, 32)
+	file, err := fileService.CreateFile(ctx, uuid.New(), "notes.txt", 8, "", key, DefaultCipher, 1)
+	assert.NoError(t, err)
+	encrypted, err := EncryptChunk([]byte("rotate m"), key)
+	assert.NoError(t, err)
+	chunk, err := chunkService.StoreChunk(ctx, file.ID, 0, encrypted, []uuid.UUID{online.ID, gone})
+	assert.NoError(t, err)
+	assert.NoError(t, fileService.MarkFileComplete(ctx, file.ID))
+	assert.NoError(t, fileService.RotateKey(ctx, file.ID))
+
+	assignments, err := store.ListChunkAssignments(ctx, chunk.ID)
+	assert.NoError(t, err)
+	assert.Empty(t, assignments, "Replicas holding the old ciphertext are stale until refreshed")
+
+	refreshed, stale, err := chunkService.RefreshStaleReplicas(ctx, file.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, refreshed)
+	assert.Equal(t, 1, stale)
+	rotated, data, err := store.GetChunk(ctx, chunk.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, data, transfer.stored["online/"+chunk.ID.String()], "The node gets the new ciphertext")
+	assignments, err = store.ListChunkAssignments(ctx, chunk.ID)
+	assert.NoError(t, err)
+	if assert.Len(t, assignments, 1) {
+		assert.Equal(t, online.ID, assignments[0].NodeID)
+	}
+	assert.NotEqual(t, chunk.Hash, rotated.Hash)
+	pending, err := store.ListStaleAssignments(ctx, uuid.Nil)
+	assert.NoError(t, err)
+	if assert.Len(t, pending, 1, "A node that can't take the new copy keeps its replica for a retry") {
+		assert.Equal(t, gone, pending[0].NodeID)
+	}
+
+	// The retry activates the replica once the node is reachable
+	chunkService = NewChunkService(store, staticNodes{online, {ID: gone, PeerID: "back"}}, nil)
+	chunkService.SetTransfer(transfer)
+	refreshed, stale, err = chunkService.RefreshStaleReplicas(ctx, uuid.Nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, refreshed)
+	assert.Equal(t, 0, stale)
+	assignments, err = store.ListChunkAssignments(ctx, chunk.ID)
+	assert.NoError(t, err)
+	assert.Len(t, assignments, 2)
+
+	// Chunks uploaded straight to the nodes have no copy here to re-encrypt
+	direct, err := fileService.CreateFile(ctx, uuid.New(), "direct.txt", 8, "", key, DefaultCipher, 1)
+	assert.NoError(t, err)
+	assert.NoError(t, chunkService.RecordChunk(ctx, &models.Chunk{
+		ID: uuid.New(), FileID: direct.ID, Hash: chunk.Hash, SizeBytes: len(encrypted),
+	}, []uuid.UUID{online.ID}))
+	assert.NoError(t, fileService.MarkFileComplete(ctx, direct.ID))
+	assert.ErrorIs(t, fileService.RotateKey(ctx, direct.ID), ErrRotationUnsupported)
+	unchanged, err := fileService.GetFile(ctx, direct.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, key, unchanged.EncryptionKey)
+	assert.Equal(t, "ready", unchanged.Status)
+}
+
+func TestFileService_TagsAndFilter(t *testing.T) {
+	ctx := context.Background()
+	service := NewFileService(storage.NewMemoryStore(), 256*1024, 100)
+	userID := uuid.New()
+
+	report, err := service.CreateFile(ctx, userID, "report.pdf", 10, "", nil, DefaultCipher, 1)
+	assert.NoError(t, err)
+	photo, err := service.CreateFile(ctx, userID, "photo.jpg", 10, "", nil, DefaultCipher, 1)
+	assert.NoError(t, err)
+	_, err = service.CreateFile(ctx, userID, "untagged.txt", 10, "", nil, DefaultCipher, 1)
+	assert.NoError(t, err)
+
+	tags, err := service.AddTags(ctx, report.ID, []string{" Work ", "2024", "work"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"2024", "work"}, tags, "Tags should be normalized and deduplicated")
+
+	_, err = service.AddTags(ctx, photo.ID, []string{"2024", "personal"})
+	assert.NoError(t, err)
+
+	files, err := service.GetUserFiles(ctx, userID, nil)
+	assert.NoError(t, err)
+	assert.Len(t, files, 3, "No filter should list every file")
+
+	files, err = service.GetUserFiles(ctx, userID, []string{"2024"})
+	assert.NoError(t, err)
+	assert.Len(t, files, 2)
+
+	files, err = service.GetUserFiles(ctx, userID, []string{"2024", "WORK"})
+	assert.NoError(t, err)
+	assert.Len(t, files, 1, "Multiple tags should match files carrying all of them")
+	assert.Equal(t, report.ID, files[0].ID)
+	assert.Equal(t, []string{"2024", "work"}, files[0].Tags)
+
+	assert.NoError(t, service.RemoveTag(ctx, report.ID, "work"))
+	assert.ErrorIs(t, service.RemoveTag(ctx, report.ID, "work"), ErrTagNotFound)
+
+	file, err := service.GetFile(ctx, report.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"2024"}, file.Tags)
+}
+
+func TestFileService_TagLimits(t *testing.T) {
+	ctx := context.Background()
+	service := NewFileService(storage.NewMemoryStore(), 256*1024, 100)
+	file, err := service.CreateFile(ctx, uuid.New(), "a.txt", 10, "", nil, DefaultCipher, 1)
+	assert.NoError(t, err)
+
+	_, err = service.AddTags(ctx, file.ID, []string{strings.Repeat("x", MaxTagLength+1)})
+	assert.ErrorIs(t, err, ErrInvalidTag, "Overlong tag should be rejected")
+
+	_, err = service.AddTags(ctx, file.ID, []string{"  "})
+	assert.ErrorIs(t, err, ErrInvalidTag, "Blank tag should be rejected")
+
+	many := make([]string, MaxTagsPerFile)
+	for i := range many {
+		many[i] = fmt.Sprintf("tag-%d", i)
+	}
+	_, err = service.AddTags(ctx, file.ID, many)
+	assert.NoError(t, err)
+
+	_, err = service.AddTags(ctx, file.ID, []string{"one-too-many"})
+	assert.ErrorIs(t, err, ErrInvalidTag, "Tag count limit should be enforced")
+
+	_, err = service.AddTags(ctx, file.ID, []string{"tag-0"})
+	assert.NoError(t, err, "Re-adding an existing tag does not count against the limit")
+}
+
+// countingStore counts chunk data reads against the wrapped store
+type countingStore struct {
+	storage.Store
+	dataReads int
+}
+
+func (s *countingStore) ListChunkData(ctx context.Context, fileID uuid.UUID) (map[int][]byte, error) {
+	s.dataReads++
+	return s.Store.ListChunkData(ctx, fileID)
+}
+
+func TestChunkService_SecondDownloadServedFromCache(t *testing.T) {
+	ctx := context.Background()
+	store := &countingStore{Store: storage.NewMemoryStore()}
+	fileService := NewFileService(store, 8, 100)
+	chunkService := NewChunkService(store, nil, NewChunkCache(1024))
+
+	key := make([]byte, 32)
+	parts := []string{"cache me", " twice"}
+	file, err := fileService.CreateFile(ctx, uuid.New(), "hot.txt", 14, "", key, DefaultCipher, len(parts))
+	assert.NoError(t, err)
+	for i, part := range parts {
+		encrypted, err := EncryptChunk([]byte(part), key)
+		assert.NoError(t, err)
+		_, err = chunkService.StoreChunk(ctx, file.ID, i, encrypted, nil)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, fileService.MarkFileComplete(ctx, file.ID))
+	store.dataReads = 0
+
+	first, err := chunkService.GetChunksByFileWithData(ctx, file.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, store.dataReads)
+
+	second, err := chunkService.GetChunksByFileWithData(ctx, file.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, store.dataReads, "Second download should not read chunk data from the store")
+	assert.Equal(t, first, second)
+
+	// Rotation rewrites chunk data; the cache must not serve the old ciphertext
+	assert.NoError(t, fileService.RotateKey(ctx, file.ID))
+	chunkService.InvalidateFile(file.ID)
+	rotated, err := fileService.GetFile(ctx, file.ID)
+	assert.NoError(t, err)
+	chunks, err := chunkService.GetChunksByFileWithData(ctx, file.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, store.dataReads)
+	data, err := AssembleFile(chunks, rotated.ChunkCount, DefaultCipher, rotated.EncryptionKey)
+	assert.NoError(t, err)
+	assert.Equal(t, "cache me twice", string(data))
+}
+
+func TestChunkCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	cache := NewChunkCache(10)
+	fileID := uuid.New()
+	a, b, c := uuid.New(), uuid.New(), uuid.New()
+
+	cache.Put(fileID, a, "ha", []byte("aaaa"))
+	cache.Put(fileID, b, "hb", []byte("bbbb"))
+	_, ok := cache.Get(a, "ha") // a is now most recently used
+	assert.True(t, ok)
+
+	cache.Put(fileID, c, "hc", []byte("cccc"))
+	assert.Equal(t, int64(8), cache.Size())
+	_, ok = cache.Get(b, "hb")
+	assert.False(t, ok, "Least recently used chunk should be evicted")
+	_, ok = cache.Get(a, "ha")
+	assert.True(t, ok)
+
+	_, ok = cache.Get(a, "stale")
+	assert.False(t, ok, "Hash mismatch should be a miss")
+	_, ok = cache.Get(a, "ha")
+	assert.False(t, ok, "Stale entry should be dropped")
+
+	cache.Put(fileID, uuid.New(), "big", make([]byte, 11))
+	assert.Equal(t, int64(4), cache.Size(), "Oversized chunks are not cached")
+
+	cache.RemoveFile(fileID)
+	assert.Equal(t, int64(0), cache.Size())
+}
+
+func TestFileService_MissingChunks(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	fileService := NewFileService(store, 8, 100)
+	chunkService := NewChunkService(store, nil, nil)
+
+	tests := []struct {
+		name     string
+		stored   []int
+		expected []int
+	}{
+		{name: "complete set", stored: []int{0, 1, 2, 3}, expected: []int{}},
+		{name: "out of order complete set", stored: []int{3, 1, 0, 2}, expected: []int{}},
+		{name: "gap in the middle", stored: []int{0, 1, 3}, expected: []int{2}},
+		{name: "missing first and last", stored: []int{1, 2}, expected: []int{0, 3}},
+		{name: "nothing stored", stored: nil, expected: []int{0, 1, 2, 3}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file, err := fileService.CreateFile(ctx, uuid.New(), "gaps.bin", 32, "", make([]byte, 32), DefaultCipher, 4)
+			assert.NoError(t, err)
+			for _, i := range tt.stored {
+				_, err := chunkService.StoreChunk(ctx, file.ID, i, []byte{byte(i)}, nil)
+				assert.NoError(t, err)
+			}
+
+			missing, err := fileService.MissingChunks(ctx, file.ID, 4)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, missing)
+		})
+	}
+}
+
+func TestCapacityBytes(t *testing.T) {
+	const gb = int64(1024 * 1024 * 1024)
+	tests := []struct {
+		name      string
+		totalGB   int
+		usedBytes int64
+		expected  int64
+		wantErr   bool
+	}{
+		{name: "increase on empty node", totalGB: 200, usedBytes: 0, expected: 200 * gb},
+		{name: "increase above usage", totalGB: 500, usedBytes: 150 * gb, expected: 500 * gb},
+		{name: "shrink exactly to usage", totalGB: 10, usedBytes: 10 * gb, expected: 10 * gb},
+		{name: "shrink below usage", totalGB: 10, usedBytes: 10*gb + 1, wantErr: true},
+		{name: "shrink far below usage", totalGB: 1, usedBytes: 80 * gb, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			totalBytes, err := CapacityBytes(tt.totalGB, tt.usedBytes)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrCapacityBelowUsage)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, totalBytes)
+		})
+	}
+}
+
+func TestChunkService_StoreChunkFailedAssignmentLeavesNothing(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	chunkService := NewChunkService(store, nil, nil)
+	fileID, node := uuid.New(), uuid.New()
+
+	// The second assignment to the same node fails after the first succeeded
+	_, err := chunkService.StoreChunk(ctx, fileID, 0, []byte("data"), []uuid.UUID{node, node})
+	assert.Error(t, err)
+
+	chunks, err := store.ListChunks(ctx, fileID)
+	assert.NoError(t, err)
+	assert.Empty(t, chunks, "No chunk row should survive a failed assignment")
+	held, err := store.ListNodeChunks(ctx, node)
+	assert.NoError(t, err)
+	assert.Empty(t, held, "No assignment should survive either")
+
+	// The same chunk can be stored once the failure is fixed
+	_, err = chunkService.StoreChunk(ctx, fileID, 0, []byte("data"), []uuid.UUID{node})
+	assert.NoError(t, err)
+}
+
+// fakeTransfer records chunks sent to peers and can corrupt or refuse them
+type fakeTransfer struct {
+	stored  map[string][]byte
+	sendErr error
+	corrupt bool
+	busy    int // stores turned away as busy before any is accepted
+}
+
+// fakeBusyError is how a node over its store rate turns a chunk away
+type fakeBusyError struct{}
+
+func (fakeBusyError) Error() string             { return "storage node busy" }
+func (fakeBusyError) RetryAfter() time.Duration { return time.Millisecond }
+
+func (f *fakeTransfer) SendChunk(ctx context.Context, peerID, chunkID string, data []byte) error {
+	if f.sendErr != nil {
+		return f.sendErr
+	}
+	if f.busy > 0 {
+		f.busy--
+		return fmt.Errorf("failed to store: %w", fakeBusyError{})
+	}
+	if f.stored == nil {
+		f.stored = make(map[string][]byte)
+	}
+	f.stored[peerID+"/"+chunkID] = append([]byte(nil), data...)
+	return nil
+}
+
+func (f *fakeTransfer) RetrieveChunk(ctx context.Context, peerID, chunkID string) ([]byte, error) {
+	data, ok := f.stored[peerID+"/"+chunkID]
+	if !ok {
+		return nil, fmt.Errorf("chunk not held")
+	}
+	if f.corrupt {
+		data = append([]byte("x"), data...)
+	}
+	return data, nil
+}
+
+func TestChunkService_MoveChunk(t *testing.T) {
+	tests := []struct {
+		name        string
+		transfer    *fakeTransfer
+		wantErr     error
+		targetHolds bool
+	}{
+		{name: "verified move retires source", transfer: &fakeTransfer{}, targetHolds: true},
+		{name: "send failure keeps source", transfer: &fakeTransfer{sendErr: fmt.Errorf("connection refused")}},
+		{name: "corrupted copy keeps source", transfer: &fakeTransfer{corrupt: true}, wantErr: ErrChunkVerifyFailed},
+		{name: "busy target is retried", transfer: &fakeTransfer{busy: maxBusyRetries}, targetHolds: true},
+		{name: "target busy throughout keeps source", transfer: &fakeTransfer{busy: maxBusyRetries + 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := storage.NewMemoryStore()
+			chunkService := NewChunkService(store, nil, nil)
+			from, to := uuid.New(), uuid.New()
+
+			chunk, err := chunkService.StoreChunk(ctx, uuid.New(), 0, []byte("replica"), []uuid.UUID{from})
+			assert.NoError(t, err)
+
+			err = chunkService.MoveChunk(ctx, tt.transfer, ChunkMove{ChunkID: chunk.ID, FromNodeID: from, ToNodeID: to, ToPeerID: "peer-to"})
+			if tt.targetHolds {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			}
+
+			assignments, err := chunkService.GetChunkAssignments(ctx, chunk.ID)
+			assert.NoError(t, err)
+			assert.Len(t, assignments, 1, "Exactly one active replica should remain")
+			expected := from
+			if tt.targetHolds {
+				expected = to
+			}
+			assert.Equal(t, expected, assignments[0].NodeID)
+
+			toChunks, err := store.ListNodeChunks(ctx, to)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.targetHolds, len(toChunks) == 1, "Target should hold the chunk only after a verified move")
+		})
+	}
+}
+
+// staticNodes is a NodeLister over a fixed set of nodes
+type staticNodes []models.StorageNode
+
+func (n staticNodes) GetAllNodes(ctx context.Context) ([]models.StorageNode, error) {
+	return n, nil
+}
+
+func maintenanceWindow(node models.StorageNode, start, end time.Time) models.StorageNode {
+	node.MaintenanceStart, node.MaintenanceEnd = &start, &end
+	return node
+}
+
+func TestSelectNodesForChunks_SkipsNodesInMaintenance(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	a := models.StorageNode{ID: uuid.New(), PeerID: "a", ReputationScore: 90}
+	b := models.StorageNode{ID: uuid.New(), PeerID: "b", ReputationScore: 80}
+	c := models.StorageNode{ID: uuid.New(), PeerID: "c", ReputationScore: 70}
+
+	peers := func(nodes []models.StorageNode) []string {
+		var out []string
+		for _, n := range nodes {
+			out = append(out, n.PeerID)
+		}
+		return out
+	}
+
+	tests := []struct {
+		name string
+		a    models.StorageNode
+		want []string
+	}{
+		{name: "no window", a: a, want: []string{"a", "b"}},
+		{name: "in window", a: maintenanceWindow(a, now.Add(-10*time.Minute), now.Add(time.Hour)), want: []string{"b", "c"}},
+		{name: "window starts within lead", a: maintenanceWindow(a, now.Add(30*time.Minute), now.Add(2*time.Hour)), want: []string{"b", "c"}},
+		{name: "window beyond lead", a: maintenanceWindow(a, now.Add(2*time.Hour), now.Add(3*time.Hour)), want: []string{"a", "b"}},
+		{name: "window over, node restored", a: maintenanceWindow(a, now.Add(-2*time.Hour), now.Add(-time.Hour)), want: []string{"a", "b"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunkService := NewChunkService(storage.NewMemoryStore(), staticNodes{tt.a, b, c}, nil)
+			chunkService.SetMaintenanceLead(time.Hour)
+
+			selected, err := chunkService.SelectNodesForChunks(ctx, "", 2)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, peers(selected))
+		})
+	}
+
+	// With a node in maintenance there are too few left for three replicas
+	chunkService := NewChunkService(storage.NewMemoryStore(),
+		staticNodes{maintenanceWindow(a, now.Add(-time.Minute), now.Add(time.Hour)), b, c}, nil)
+	_, err := chunkService.SelectNodesForChunks(ctx, "", 3)
+	assert.Error(t, err)
+}
+
+func TestSelectNodesForChunks_SkipsExcludedNodes(t *testing.T) {
+	ctx := context.Background()
+	// The excluded node is the most reputable and leads the ring for some keys
+	bad := models.StorageNode{ID: uuid.New(), PeerID: "bad", ReputationScore: 99}
+	good := models.StorageNode{ID: uuid.New(), PeerID: "good", ReputationScore: 50}
+	chunkService := NewChunkService(storage.NewMemoryStore(), staticNodes{bad, good}, nil)
+
+	selected, err := chunkService.SelectNodesForChunks(ctx, "", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "bad", selected[0].PeerID)
+
+	exclusion, err := chunkService.ExcludeNode(ctx, "bad", "under investigation")
+	assert.NoError(t, err)
+	assert.Equal(t, "under investigation", exclusion.Reason)
+	for _, placement := range []Placement{PlacementReputation, PlacementConsistentHash} {
+		chunkService.SetPlacement(placement, DefaultVirtualNodes)
+		for i := 0; i < 50; i++ {
+			selected, err := chunkService.SelectNodesForChunks(ctx, ChunkPlacementKey(uuid.New(), i), 1)
+			assert.NoError(t, err)
+			assert.Equal(t, "good", selected[0].PeerID, "%s placement picked an excluded node", placement)
+		}
+	}
+	_, err = chunkService.SelectNodesForChunks(ctx, "", 2)
+	assert.Error(t, err, "The excluded node does not count towards the replicas")
+
+	excluded, err := chunkService.ListExcludedNodes(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, excluded, 1)
+
+	assert.NoError(t, chunkService.IncludeNode(ctx, "bad"))
+	assert.ErrorIs(t, chunkService.IncludeNode(ctx, "bad"), ErrExclusionNotFound)
+	selected, err = chunkService.SelectNodesForChunks(ctx, "", 2)
+	assert.NoError(t, err)
+	assert.Len(t, selected, 2)
+}
+
+func TestValidateMaintenanceWindow(t *testing.T) {
+	now := time.Now()
+	assert.NoError(t, ValidateMaintenanceWindow(now.Add(time.Hour), now.Add(2*time.Hour), now))
+	assert.NoError(t, ValidateMaintenanceWindow(now.Add(-time.Hour), now.Add(time.Hour), now), "a window already underway is fine")
+	assert.ErrorIs(t, ValidateMaintenanceWindow(now.Add(time.Hour), now, now), ErrInvalidMaintenanceWindow)
+	assert.ErrorIs(t, ValidateMaintenanceWindow(now.Add(-2*time.Hour), now.Add(-time.Hour), now), ErrInvalidMaintenanceWindow)
+	assert.ErrorIs(t, ValidateMaintenanceWindow(now, now.Add(MaxMaintenanceWindow+time.Hour), now), ErrInvalidMaintenanceWindow)
+}
+
+func TestChunkService_DrainMaintenanceNodes(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	now := time.Now()
+	a := maintenanceWindow(models.StorageNode{ID: uuid.New(), PeerID: "a", TotalStorageBytes: 1000},
+		now.Add(-time.Minute), now.Add(time.Hour))
+	b := models.StorageNode{ID: uuid.New(), PeerID: "b", TotalStorageBytes: 1000}
+	c := models.StorageNode{ID: uuid.New(), PeerID: "c", TotalStorageBytes: 1000, UsedStorageBytes: 500}
+	d := models.StorageNode{ID: uuid.New(), PeerID: "d", TotalStorageBytes: 1000}
+	chunkService := NewChunkService(store, staticNodes{a, b, c, d}, nil)
+
+	onA, err := chunkService.StoreChunk(ctx, uuid.New(), 0, []byte("held by a and b"), []uuid.UUID{a.ID, b.ID})
+	assert.NoError(t, err)
+	onB, err := chunkService.StoreChunk(ctx, uuid.New(), 0, []byte("held by b and c"), []uuid.UUID{b.ID, c.ID})
+	assert.NoError(t, err)
+
+	transfer := &fakeTransfer{}
+	report, err := chunkService.DrainMaintenanceNodes(ctx, transfer, 2, 100)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, report.Draining)
+	if assert.Len(t, report.Copied, 1, "Only the chunk on the draining node needs another replica") {
+		assert.Equal(t, onA.ID, report.Copied[0].ChunkID)
+		assert.Equal(t, d.ID, report.Copied[0].ToNodeID, "The least utilized node not already holding it receives the copy")
+	}
+
+	assignments, err := store.ListChunkAssignments(ctx, onA.ID)
+	assert.NoError(t, err)
+	assert.Len(t, assignments, 3, "The draining node keeps its replica for after the window")
+	assignments, err = store.ListChunkAssignments(ctx, onB.ID)
+	assert.NoError(t, err)
+	assert.Len(t, assignments, 2)
+
+	// A second pass finds nothing left to do
+	report, err = chunkService.DrainMaintenanceNodes(ctx, transfer, 2, 100)
+	assert.NoError(t, err)
+	assert.Zero(t, report.Planned)
+	assert.Empty(t, report.Retired, "The node is still in its window")
+
+	// Back from the window, the copy made for it is retired
+	heartbeat := now.Add(time.Minute)
+	back := a
+	back.Status, back.LastHeartbeat, back.MaintenanceStart = "active", &heartbeat, nil
+	back.MaintenanceEnd = &now
+	chunkService = NewChunkService(store, staticNodes{back, b, c, d}, nil)
+	report, err = chunkService.DrainMaintenanceNodes(ctx, transfer, 2, 100)
+	assert.NoError(t, err)
+	if assert.Len(t, report.Retired, 1) {
+		assert.Equal(t, onA.ID, report.Retired[0].ChunkID)
+		assert.Equal(t, d.ID, report.Retired[0].NodeID)
+	}
+	assignments, err = store.ListChunkAssignments(ctx, onA.ID)
+	assert.NoError(t, err)
+	assert.Len(t, assignments, 2, "Only the original replicas remain")
+	copies, err := store.ListDrainCopies(ctx, a.ID)
+	assert.NoError(t, err)
+	assert.Empty(t, copies)
+}
+
+func TestChunkService_DrainAndRebalanceSkipExcludedNodes(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	now := time.Now()
+	a := maintenanceWindow(models.StorageNode{ID: uuid.New(), PeerID: "a", TotalStorageBytes: 1000, UsedStorageBytes: 900},
+		now.Add(-time.Minute), now.Add(time.Hour))
+	b := models.StorageNode{ID: uuid.New(), PeerID: "b", TotalStorageBytes: 1000, UsedStorageBytes: 900}
+	c := models.StorageNode{ID: uuid.New(), PeerID: "c", TotalStorageBytes: 1000, UsedStorageBytes: 400}
+	bad := models.StorageNode{ID: uuid.New(), PeerID: "bad", TotalStorageBytes: 1000}
+	chunkService := NewChunkService(store, staticNodes{a, b, c, bad}, nil)
+	_, err := chunkService.ExcludeNode(ctx, "bad", "under investigation")
+	assert.NoError(t, err)
+
+	onA, err := chunkService.StoreChunk(ctx, uuid.New(), 0, []byte("held by a"), []uuid.UUID{a.ID})
+	assert.NoError(t, err)
+	for i := 0; i < 4; i++ {
+		_, err := chunkService.StoreChunk(ctx, uuid.New(), i, []byte("held by b"), []uuid.UUID{b.ID})
+		assert.NoError(t, err)
+	}
+
+	transfer := &fakeTransfer{}
+	drained, err := chunkService.DrainMaintenanceNodes(ctx, transfer, 1, 100)
+	assert.NoError(t, err)
+	if assert.Len(t, drained.Copied, 1) {
+		assert.Equal(t, onA.ID, drained.Copied[0].ChunkID)
+		assert.Equal(t, c.ID, drained.Copied[0].ToNodeID, "The emptier excluded node gets no copy")
+	}
+
+	rebalanced, err := chunkService.Rebalance(ctx, transfer, 1, 100)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, rebalanced.Moved)
+	for _, m := range append(rebalanced.Moved, drained.Copied...) {
+		assert.NotEqual(t, bad.ID, m.ToNodeID, "Excluded nodes receive no chunks")
+	}
+}
+
+func TestPlanRebalance(t *testing.T) {
+	full := models.StorageNode{ID: uuid.New(), PeerID: "full", TotalStorageBytes: 1000, UsedStorageBytes: 900}
+	empty := models.StorageNode{ID: uuid.New(), PeerID: "empty", TotalStorageBytes: 1000, UsedStorageBytes: 0}
+	half := models.StorageNode{ID: uuid.New(), PeerID: "half", TotalStorageBytes: 1000, UsedStorageBytes: 450}
+
+	var fullChunks []models.Chunk
+	for i := 0; i < 9; i++ {
+		fullChunks = append(fullChunks, models.Chunk{ID: uuid.New(), SizeBytes: 100})
+	}
+	holdings := map[uuid.UUID][]models.Chunk{full.ID: fullChunks, half.ID: fullChunks[:4]}
+
+	moves := PlanRebalance([]models.StorageNode{full, empty, half}, holdings, 0.5, 100)
+	assert.Len(t, moves, 5, "Half of the full node's chunks, rounded up")
+	for _, m := range moves {
+		assert.Equal(t, full.ID, m.FromNodeID)
+		assert.Equal(t, empty.ID, m.ToNodeID, "Only the node below average utilization receives chunks")
+		assert.Equal(t, "empty", m.ToPeerID)
+	}
+
+	assert.Len(t, PlanRebalance([]models.StorageNode{full, empty, half}, holdings, 0.5, 2), 2, "maxMoves caps the plan")
+
+	balanced := []models.StorageNode{
+		{ID: uuid.New(), TotalStorageBytes: 1000, UsedStorageBytes: 500},
+		{ID: uuid.New(), TotalStorageBytes: 1000, UsedStorageBytes: 500},
+	}
+	assert.Empty(t, PlanRebalance(balanced, map[uuid.UUID][]models.Chunk{}, 1, 100))
+}
+
+func TestFileService_PurgeExpired(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	const gb = int64(1024 * 1024 * 1024)
+	fileService := NewFileService(store, 256*1024, 100)
+	chunkService := NewChunkService(store, nil, nil)
+
+	user := &models.User{ID: uuid.New(), Email: "ttl@example.com", Credits: 0}
+	assert.NoError(t, store.CreateUser(ctx, user))
+
+	newFile := func(name string, expiresAt *time.Time) *models.File {
+		file, err := fileService.CreateFile(ctx, user.ID, name, gb, "", make([]byte, 32), DefaultCipher, 1)
+		assert.NoError(t, err)
+		_, err = chunkService.StoreChunk(ctx, file.ID, 0, []byte("data"), nil)
+		assert.NoError(t, err)
+		assert.NoError(t, store.SetFileStatus(ctx, file.ID, "ready"))
+		assert.NoError(t, fileService.SetExpiry(ctx, file.ID, expiresAt))
+		return file
+	}
+
+	now := time.Now()
+	past, future := now.Add(-time.Minute), now.Add(time.Hour)
+	expired := newFile("ci-artifact.zip", &past)
+	pending := newFile("share.zip", &future)
+	permanent := newFile("archive.zip", nil)
+
+	purged, err := fileService.PurgeExpired(ctx, now, 1)
+	assert.NoError(t, err)
+	assert.Len(t, purged, 1)
+	assert.Equal(t, expired.ID, purged[0].ID)
+
+	_, err = fileService.GetFile(ctx, expired.ID)
+	assert.Error(t, err, "Expired file should be deleted")
+	chunks, err := store.ListChunks(ctx, expired.ID)
+	assert.NoError(t, err)
+	assert.Empty(t, chunks, "Expired file's chunks should be deleted")
+
+	for _, id := range []uuid.UUID{pending.ID, permanent.ID} {
+		_, err := fileService.GetFile(ctx, id)
+		assert.NoError(t, err)
+	}
+
+	// The file lived for no time at all, so the whole month's payment comes back
+	refreshed, err := store.GetUserByID(ctx, user.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(100), refreshed.Credits)
+
+	purged, err = fileService.PurgeExpired(ctx, now, 1)
+	assert.NoError(t, err)
+	assert.Empty(t, purged, "A second sweep should find nothing")
+}
+
+func TestFileService_ExpiryRefund(t *testing.T) {
+	const gb = int64(1024 * 1024 * 1024)
+	service := NewFileService(storage.NewMemoryStore(), 256*1024, 100)
+	created := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) *time.Time {
+		expiresAt := created.Add(d)
+		return &expiresAt
+	}
+
+	tests := []struct {
+		name      string
+		status    string
+		expiresAt *time.Time
+		expected  int64
+	}{
+		{name: "no expiry", status: "ready", expiresAt: nil, expected: 0},
+		{name: "expires immediately", status: "ready", expiresAt: at(0), expected: 200},
+		{name: "expires a quarter in", status: "ready", expiresAt: at(StoragePeriod / 4), expected: 150},
+		{name: "outlives the period", status: "ready", expiresAt: at(2 * StoragePeriod), expected: 0},
+		{name: "never paid for", status: "uploading", expiresAt: at(0), expected: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := &models.File{SizeBytes: gb, Status: tt.status, CreatedAt: created, ExpiresAt: tt.expiresAt}
+			assert.Equal(t, tt.expected, service.ExpiryRefund(file, 2))
+		})
+	}
+}
+
+func TestFileService_CreateVersionedFile(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	fileService := NewFileService(store, 256*1024, 100)
+	userID := uuid.New()
+	key := make([]byte, 32)
+
+	first, err := fileService.CreateVersionedFile(ctx, userID, "report.pdf", 10, "", key, DefaultCipher, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, first.Version)
+	assert.Nil(t, first.ParentFileID, "First upload should start a new history")
+
+	second, err := fileService.CreateVersionedFile(ctx, userID, "report.pdf", 20, "", key, DefaultCipher, 1)
+	assert.NoError(t, err)
+	third, err := fileService.CreateVersionedFile(ctx, userID, "report.pdf", 30, "", key, DefaultCipher, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, second.Version)
+	assert.Equal(t, 3, third.Version)
+	assert.Equal(t, first.ID, *second.ParentFileID)
+	assert.Equal(t, first.ID, *third.ParentFileID)
+
+	// Other users and other names have their own histories
+	other, err := fileService.CreateVersionedFile(ctx, uuid.New(), "report.pdf", 10, "", key, DefaultCipher, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, other.Version)
+	renamed, err := fileService.CreateVersionedFile(ctx, userID, "report-final.pdf", 10, "", key, DefaultCipher, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, renamed.Version)
+
+	// Non-versioned uploads of the same name stay independent
+	plain, err := fileService.CreateFile(ctx, userID, "report.pdf", 10, "", key, DefaultCipher, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, plain.Version)
+	assert.Nil(t, plain.ParentFileID)
+
+	versions, err := fileService.ListVersions(ctx, third)
+	assert.NoError(t, err)
+	assert.Len(t, versions, 3)
+	for i, v := range versions {
+		assert.Equal(t, i+1, v.Version)
+	}
+
+	// Latest only considers ready versions
+	assert.NoError(t, store.SetFileStatus(ctx, second.ID, "ready"))
+	latest, err := fileService.ResolveVersion(ctx, first, "latest")
+	assert.NoError(t, err)
+	assert.Equal(t, second.ID, latest.ID)
+
+	older, err := fileService.ResolveVersion(ctx, third, "1")
+	assert.NoError(t, err)
+	assert.Equal(t, first.ID, older.ID)
+
+	_, err = fileService.ResolveVersion(ctx, first, "7")
+	assert.ErrorIs(t, err, ErrVersionNotFound)
+	_, err = fileService.ResolveVersion(ctx, first, "newest")
+	assert.ErrorIs(t, err, ErrVersionNotFound)
+}
+
+func TestFileService_DeleteRootVersionKeepsHistory(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	fileService := NewFileService(store, 256*1024, 100)
+	userID := uuid.New()
+	key := make([]byte, 32)
+
+	first, err := fileService.CreateVersionedFile(ctx, userID, "notes.txt", 10, "", key, DefaultCipher, 1)
+	assert.NoError(t, err)
+	second, err := fileService.CreateVersionedFile(ctx, userID, "notes.txt", 10, "", key, DefaultCipher, 1)
+	assert.NoError(t, err)
+	third, err := fileService.CreateVersionedFile(ctx, userID, "notes.txt", 10, "", key, DefaultCipher, 1)
+	assert.NoError(t, err)
+
+	assert.NoError(t, fileService.DeleteFile(ctx, first.ID))
+
+	third, err = fileService.GetFile(ctx, third.ID)
+	assert.NoError(t, err)
+	versions, err := fileService.ListVersions(ctx, third)
+	assert.NoError(t, err)
+	assert.Len(t, versions, 2)
+	assert.Equal(t, second.ID, versions[0].ID)
+	assert.Nil(t, versions[0].ParentFileID, "Oldest remaining version should become the root")
+	assert.Equal(t, second.ID, *versions[1].ParentFileID)
+
+	next, err := fileService.CreateVersionedFile(ctx, userID, "notes.txt", 10, "", key, DefaultCipher, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, next.Version)
+	assert.Equal(t, second.ID, *next.ParentFileID)
+}
+
+func TestPlaceReplicas_SpreadsAcrossOperators(t *testing.T) {
+	node := func(operator string) models.StorageNode {
+		return models.StorageNode{ID: uuid.New(), OperatorID: operator}
+	}
+	operatorsOf := func(nodes []models.StorageNode) []string {
+		var ops []string
+		for _, n := range nodes {
+			ops = append(ops, n.OperatorID)
+		}
+		return ops
+	}
+
+	// One operator runs most of the network and is listed first
+	nodes := []models.StorageNode{node("big"), node("big"), node("big"), node("big"), node("big"), node("alice"), node("bob")}
+
+	selected, err := PlaceReplicas(nodes, 3, 1)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"big", "alice", "bob"}, operatorsOf(selected))
+
+	// Only two operators for three replicas: fall back to doubling up
+	twoOperators := []models.StorageNode{node("big"), node("big"), node("big"), node("alice")}
+	selected, err = PlaceReplicas(twoOperators, 3, 1)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"big", "alice", "big"}, operatorsOf(selected))
+
+	// ...unless config demands more diversity than is available
+	_, err = PlaceReplicas(twoOperators, 3, 3)
+	assert.ErrorIs(t, err, ErrInsufficientOperators)
+	_, err = PlaceReplicas(twoOperators, 3, 2)
+	assert.NoError(t, err)
+
+	// The requirement is capped at the replica count
+	_, err = PlaceReplicas(nodes, 2, 5)
+	assert.NoError(t, err)
+
+	// Nodes without an operator count as independently operated
+	anonymous := []models.StorageNode{node(""), node(""), node("")}
+	selected, err = PlaceReplicas(anonymous, 3, 3)
+	assert.NoError(t, err)
+	assert.Len(t, selected, 3)
+
+	_, err = PlaceReplicas(nodes[:2], 3, 1)
+	assert.Error(t, err, "Fewer nodes than replicas")
+}
+
+func TestProofService_VerifyFileSkipsBackloggedNodes(t *testing.T) {
+	service := NewProofService(nil, 1000, ProofTimeout{BaseMs: 1000, MsPerRound: 1}, nil, 5*time.Minute)
+
+	chunkID, busyNode, idleNode := uuid.New(), uuid.New(), uuid.New()
+	replicas := []ChunkReplica{
+		{ChunkID: chunkID, NodeID: busyNode, PeerID: "peer-busy"},
+		{ChunkID: chunkID, NodeID: idleNode, PeerID: "peer-idle"},
+	}
+	create := func(ctx context.Context, chunkID, nodeID uuid.UUID) (*models.ProofChallenge, error) {
+		if nodeID == busyNode {
+			return nil, fmt.Errorf("%w (limit %d)", ErrChallengeBacklog, 100)
+		}
+		return &models.ProofChallenge{ID: uuid.New(), ChunkID: chunkID, NodeID: nodeID, Status: "pending"}, nil
+	}
+
+	result := service.challengeReplicas(context.Background(), uuid.New(), replicas, create)
+	assert.Equal(t, 1, result.Skipped)
+	assert.Equal(t, 1, result.Pending)
+	assert.Equal(t, 0, result.Failed, "A full backlog is not the node failing a proof")
+	assert.Equal(t, "skipped", result.Replicas[0].Status)
+}
+
+// TestProofService_PendingBacklog runs against a scratch database named by TEST_DATABASE_URL
+func TestProofService_PendingBacklog(t *testing.T) {
+	databaseURL := os.Getenv("TEST_DATABASE_URL")
+	if databaseURL == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	ctx := context.Background()
+	db, err := storage.New(databaseURL)
+	assert.NoError(t, err)
+	defer db.Close()
+	assert.NoError(t, db.Migrate("../../migrations"))
+
+	store := storage.NewPgStore(db)
+	user := &models.User{ID: uuid.New(), Email: uuid.NewString() + "@example.com"}
+	assert.NoError(t, store.CreateUser(ctx, user))
+	node, _, err := NewNodeService(db, "").RegisterNode(ctx, RegisterNodeRequest{
+		Name: "backlog", PeerID: "peer-" + uuid.NewString(), PublicKey: []byte("pk"), TotalStorageGB: 1,
+	})
+	assert.NoError(t, err)
+	file, err := NewFileService(store, 8, 100).CreateFile(ctx, user.ID, "backlog.bin", 8, "", make([]byte, 32), DefaultCipher, 1)
+	assert.NoError(t, err)
+	chunk, err := NewChunkService(store, nil, nil).StoreChunk(ctx, file.ID, 0, []byte("data"), []uuid.UUID{node.ID})
+	assert.NoError(t, err)
+
+	service := NewProofService(db, 10, ProofTimeout{BaseMs: 1000}, nil, time.Minute)
+	service.SetMaxPendingPerNode(2)
+
+	for i := 0; i < 2; i++ {
+		_, err := service.CreateChallenge(ctx, chunk.ID, node.ID)
+		assert.NoError(t, err)
+	}
+	_, err = service.CreateChallenge(ctx, chunk.ID, node.ID)
+	assert.ErrorIs(t, err, ErrChallengeBacklog)
+
+	counts, err := service.PendingChallengeCounts(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, counts[node.ID])
+
+	// Age one challenge past the limit; expiring it frees a slot
+	_, err = db.Pool.Exec(ctx,
+		`UPDATE proof_challenges SET created_at = NOW() - INTERVAL '2 hours'
+		 WHERE id = (SELECT id FROM proof_challenges WHERE node_id = $1 LIMIT 1)`, node.ID)
+	assert.NoError(t, err)
+	expired, err := service.ExpireStaleChallenges(ctx, time.Hour)
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, expired, int64(1))
+
+	var failed int
+	assert.NoError(t, db.Pool.QueryRow(ctx,
+		"SELECT COUNT(*) FROM proof_challenges WHERE node_id = $1 AND status = 'failed'", node.ID).Scan(&failed))
+	assert.Equal(t, 1, failed)
+
+	_, err = service.CreateChallenge(ctx, chunk.ID, node.ID)
+	assert.NoError(t, err)
+}
+
+func TestReputationScore_FromHistory(t *testing.T) {
+	nodeID := uuid.New()
+	now := time.Now()
+	heartbeat := now.Add(-30 * time.Second)
+	stale := now.Add(-time.Hour)
+
+	healthy := newReputationSnapshot(nodeID, 100, &heartbeat, 10, 0, now)
+	assert.Equal(t, 1.0, healthy.ProofPassRate)
+	assert.Equal(t, 1.0, healthy.Availability)
+	assert.InDelta(t, 1.0, snapshotScore(healthy), 1e-9)
+
+	quiet := newReputationSnapshot(nodeID, 100, &heartbeat, 0, 0, now)
+	assert.Equal(t, 1.0, quiet.ProofPassRate, "No decided proofs is not evidence of failure")
+
+	failing := newReputationSnapshot(nodeID, 100, &stale, 1, 3, now)
+	assert.Equal(t, 0.25, failing.ProofPassRate)
+	assert.Equal(t, 0.0, failing.Availability)
+	assert.InDelta(t, 0.3+0.5*0.25, snapshotScore(failing), 1e-9)
+
+	neverSeen := newReputationSnapshot(nodeID, 100, nil, 0, 0, now)
+	assert.Equal(t, 0.0, neverSeen.Availability)
+
+	assert.Equal(t, DefaultReputationScore, ReputationScore(nil))
+	assert.Equal(t, 0.5, DefaultReputationScore, "A node with no history starts neutral")
+	// Trust is earned over several snapshots, not granted by the first
+	one := ReputationScore([]models.NodeReputation{healthy})
+	assert.Greater(t, one, DefaultReputationScore)
+	assert.Less(t, one, ReputationScore([]models.NodeReputation{healthy, healthy, healthy}))
+	assert.Less(t, ReputationScore([]models.NodeReputation{failing}), DefaultReputationScore,
+		"A newcomer outranks a node with a poor record")
+
+	// Newest first: a recent failure hurts more than an old one
+	recentFailure := ReputationScore([]models.NodeReputation{failing, healthy, healthy})
+	oldFailure := ReputationScore([]models.NodeReputation{healthy, healthy, failing})
+	assert.Less(t, recentFailure, oldFailure)
+	assert.Less(t, oldFailure, 1.0)
+
+	// A long good record softens one bad period
+	longRecord := []models.NodeReputation{failing}
+	for i := 0; i < 20; i++ {
+		longRecord = append(longRecord, healthy)
+	}
+	assert.Greater(t, ReputationScore(longRecord), recentFailure)
+}
+
+func TestProofSuccessRate(t *testing.T) {
+	assert.Equal(t, 1.0, proofSuccessRate(0, 0), "No decided proofs is not evidence of failure")
+	assert.Equal(t, 0.75, proofSuccessRate(3, 1))
+	assert.Equal(t, 0.0, proofSuccessRate(0, 2))
+}
+
+// TestNodeService_NetworkStats runs against a scratch database named by TEST_DATABASE_URL
+func TestNodeService_NetworkStats(t *testing.T) {
+	databaseURL := os.Getenv("TEST_DATABASE_URL")
+	if databaseURL == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	ctx := context.Background()
+	db, err := storage.New(databaseURL)
+	assert.NoError(t, err)
+	defer db.Close()
+	assert.NoError(t, db.Migrate("../../migrations"))
+
+	// The database may hold other tests' data, so compare against a baseline
+	nodeService := NewNodeService(db, "")
+	nodeService.SetOfflineAfter(time.Hour)
+	before, err := nodeService.NetworkStats(ctx)
+	assert.NoError(t, err)
+
+	register := func(name string, usedBytes int64) *models.StorageNode {
+		node, _, err := nodeService.RegisterNode(ctx, RegisterNodeRequest{
+			Name: name, PeerID: "peer-" + uuid.NewString(), PublicKey: []byte("pk"), TotalStorageGB: 1,
+		})
+		assert.NoError(t, err)
+		_, err = db.Pool.Exec(ctx, "UPDATE storage_nodes SET used_storage_bytes = $1 WHERE id = $2", usedBytes, node.ID)
+		assert.NoError(t, err)
+		return node
+	}
+	a := register("stats-a", 100)
+	register("stats-b", 50)
+	// Nodes that have left the network don't count
+	gone := register("stats-gone", 1000)
+	_, err = db.Pool.Exec(ctx, "UPDATE storage_nodes SET status = 'deregistered' WHERE id = $1", gone.ID)
+	assert.NoError(t, err)
+	// Nor do active nodes whose heartbeats stopped
+	quiet := register("stats-quiet", 1000)
+	_, err = db.Pool.Exec(ctx, "UPDATE storage_nodes SET last_heartbeat = $1 WHERE id = $2", time.Now().Add(-2*time.Hour), quiet.ID)
+	assert.NoError(t, err)
+
+	store := storage.NewPgStore(db)
+	user := &models.User{ID: uuid.New(), Email: uuid.NewString() + "@example.com"}
+	assert.NoError(t, store.CreateUser(ctx, user))
+	files := NewFileService(store, 8, 100)
+	chunks := NewChunkService(store, nil, nil)
+	ready, err := files.CreateFile(ctx, user.ID, "ready.bin", 12, "", make([]byte, 32), DefaultCipher, 2)
+	assert.NoError(t, err)
+	var chunkIDs []uuid.UUID
+	for i := 0; i < 2; i++ {
+		chunk, err := chunks.StoreChunk(ctx, ready.ID, i, []byte("data"), []uuid.UUID{a.ID})
+		assert.NoError(t, err)
+		chunkIDs = append(chunkIDs, chunk.ID)
+	}
+	assert.NoError(t, files.MarkFileComplete(ctx, ready.ID))
+	// Uploads still in progress are not yet under management
+	uploading, err := files.CreateFile(ctx, user.ID, "uploading.bin", 8, "", make([]byte, 32), DefaultCipher, 1)
+	assert.NoError(t, err)
+	_, err = chunks.StoreChunk(ctx, uploading.ID, 0, []byte("data"), []uuid.UUID{a.ID})
+	assert.NoError(t, err)
+
+	// Three passed proofs and one failure; a pending one is undecided and an old one out of the window
+	proofs := NewProofService(db, 10, ProofTimeout{BaseMs: 1000}, nil, time.Minute)
+	decide := func(status string, at time.Time) {
+		challenge, err := proofs.CreateChallenge(ctx, chunkIDs[0], a.ID)
+		assert.NoError(t, err)
+		_, err = db.Pool.Exec(ctx, "UPDATE proof_challenges SET status = $1, verified_at = $2 WHERE id = $3", status, at, challenge.ID)
+		assert.NoError(t, err)
+	}
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		decide("verified", now)
+	}
+	decide("failed", now)
+	decide("failed", now.Add(-2*statsProofWindow))
+	_, err = proofs.CreateChallenge(ctx, chunkIDs[1], a.ID)
+	assert.NoError(t, err)
+
+	after, err := nodeService.NetworkStats(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, before.ActiveNodes+2, after.ActiveNodes)
+	assert.Equal(t, before.CapacityBytes+2<<30, after.CapacityBytes)
+	assert.Equal(t, before.UsedBytes+150, after.UsedBytes)
+	assert.Equal(t, before.Files+1, after.Files)
+	assert.Equal(t, before.Chunks+2, after.Chunks)
+	assert.Equal(t, before.ManagedBytes+12, after.ManagedBytes)
+	assert.Equal(t, before.ProofsVerified+3, after.ProofsVerified)
+	assert.Equal(t, before.ProofsFailed+1, after.ProofsFailed)
+	assert.Equal(t, proofSuccessRate(after.ProofsVerified, after.ProofsFailed), after.ProofSuccessRate)
+}
+
+// TestNodeService_RecomputeNodeStats runs against a scratch database named by TEST_DATABASE_URL
+func TestNodeService_RecomputeNodeStats(t *testing.T) {
+	databaseURL := os.Getenv("TEST_DATABASE_URL")
+	if databaseURL == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	ctx := context.Background()
+	db, err := storage.New(databaseURL)
+	assert.NoError(t, err)
+	defer db.Close()
+	assert.NoError(t, db.Migrate("../../migrations"))
+
+	nodeService := NewNodeService(db, "")
+	node, _, err := nodeService.RegisterNode(ctx, RegisterNodeRequest{
+		Name: "recompute", PeerID: "peer-" + uuid.NewString(), PublicKey: []byte("pk"), TotalStorageGB: 1,
+	})
+	assert.NoError(t, err)
+
+	store := storage.NewPgStore(db)
+	user := &models.User{ID: uuid.New(), Email: uuid.NewString() + "@example.com"}
+	assert.NoError(t, store.CreateUser(ctx, user))
+	files := NewFileService(store, 8, 100)
+	chunks := NewChunkService(store, nil, nil)
+	file, err := files.CreateFile(ctx, user.ID, "recompute.bin", 10, "", make([]byte, 32), DefaultCipher, 3)
+	assert.NoError(t, err)
+	var stored []*models.Chunk
+	for i, data := range []string{"four", "three", "xyz"} {
+		chunk, err := chunks.StoreChunk(ctx, file.ID, i, []byte(data), []uuid.UUID{node.ID})
+		assert.NoError(t, err)
+		stored = append(stored, chunk)
+	}
+	// A chunk moved off the node no longer counts against it
+	assert.NoError(t, store.SetChunkAssignment(ctx, stored[2].ID, node.ID, "retired"))
+	wantUsed := int64(stored[0].SizeBytes + stored[1].SizeBytes)
+
+	for i, earned := range []int64{40, 2} {
+		_, err = db.Pool.Exec(ctx,
+			`INSERT INTO node_earnings (node_id, date, storage_bytes, storage_credits, total_earnings) VALUES ($1, $2, 0, $3, $3)`,
+			node.ID, time.Now().AddDate(0, 0, -i), earned)
+		assert.NoError(t, err)
+	}
+	for _, availability := range []float64{1, 0, 1, 1} {
+		_, err = db.Pool.Exec(ctx,
+			`INSERT INTO node_reputation (node_id, uptime_percentage, proof_pass_rate, availability, score) VALUES ($1, 100, 1, $2, 1)`,
+			node.ID, availability)
+		assert.NoError(t, err)
+	}
+
+	// Corrupt the node's statistics, as a bug or manual edit might
+	_, err = db.Pool.Exec(ctx,
+		"UPDATE storage_nodes SET used_storage_bytes = 999999, earned_credits = 7, uptime_percentage = 12.5 WHERE id = $1", node.ID)
+	assert.NoError(t, err)
+
+	result, err := nodeService.RecomputeNodeStats(ctx, node.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, NodeDerivedStats{EarnedCredits: 7, UsedStorageBytes: 999999, UptimePercentage: 12.5}, result.Before)
+	assert.Equal(t, NodeDerivedStats{EarnedCredits: 42, UsedStorageBytes: wantUsed, UptimePercentage: 75}, result.After)
+	assert.Equal(t, []string{"earned_credits", "used_storage_bytes", "uptime_percentage"}, result.Changed)
+
+	var used, earned int64
+	var uptime float64
+	err = db.Pool.QueryRow(ctx, "SELECT used_storage_bytes, earned_credits, uptime_percentage FROM storage_nodes WHERE id = $1",
+		node.ID).Scan(&used, &earned, &uptime)
+	assert.NoError(t, err)
+	assert.Equal(t, wantUsed, used, "The corrected values are persisted")
+	assert.Equal(t, int64(42), earned)
+	assert.Equal(t, 75.0, uptime)
+
+	// Once corrected there is nothing left to fix
+	result, err = nodeService.RecomputeNodeStats(ctx, node.ID)
+	assert.NoError(t, err)
+	assert.Empty(t, result.Changed)
+	assert.Equal(t, result.Before, result.After)
+
+	// The bulk variant reports only the nodes it corrected
+	_, err = db.Pool.Exec(ctx, "UPDATE storage_nodes SET used_storage_bytes = 1 WHERE id = $1", node.ID)
+	assert.NoError(t, err)
+	checked, corrected, err := nodeService.RecomputeAllNodeStats(ctx)
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, checked, 1)
+	var found bool
+	for _, r := range corrected {
+		assert.NotEmpty(t, r.Changed)
+		if r.NodeID == node.ID {
+			found = true
+			assert.Equal(t, int64(1), r.Before.UsedStorageBytes)
+			assert.Equal(t, wantUsed, r.After.UsedStorageBytes)
+		}
+	}
+	assert.True(t, found)
+
+	_, err = nodeService.RecomputeNodeStats(ctx, uuid.New())
+	assert.ErrorIs(t, err, ErrUnknownNode)
+}
+
+func TestClassifyChunk(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		replicas  int
+		target    int
+		stale     bool
+		want      string
+		wantScore float64
+	}{
+		{name: "fully replicated and proven", replicas: 3, target: 3, want: HealthHealthy, wantScore: 1},
+		{name: "more than the target", replicas: 4, target: 3, want: HealthHealthy, wantScore: 1},
+		{name: "one replica missing", replicas: 2, target: 3, want: HealthDegraded, wantScore: 0.67},
+		{name: "replicated but unproven", replicas: 3, target: 3, stale: true, want: HealthDegraded, wantScore: 0.5},
+		{name: "single replica left", replicas: 1, target: 3, want: HealthAtRisk, wantScore: 0.33},
+		{name: "single replica wanted", replicas: 1, target: 1, want: HealthHealthy, wantScore: 1},
+		{name: "no replicas", replicas: 0, target: 3, want: HealthLost, wantScore: 0},
+		{name: "no replicas and unproven", replicas: 0, target: 3, stale: true, want: HealthLost, wantScore: 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			health, score := classifyChunk(tt.replicas, tt.target, tt.stale)
+			assert.Equal(t, tt.want, health)
+			assert.Equal(t, tt.wantScore, score)
+		})
+	}
+}
+
+func TestProofStale(t *testing.T) {
+	now := time.Now()
+	created := now.Add(-48 * time.Hour)
+	recent := now.Add(-time.Hour)
+	old := now.Add(-13 * time.Hour)
+
+	assert.False(t, proofStale(&recent, created, now, 12*time.Hour))
+	assert.True(t, proofStale(&old, created, now, 12*time.Hour))
+	assert.True(t, proofStale(nil, created, now, 12*time.Hour), "A chunk never proven is measured from its file's creation")
+	assert.False(t, proofStale(nil, now.Add(-time.Hour), now, 12*time.Hour), "A new upload isn't stale before its first proof is due")
+	assert.False(t, proofStale(nil, created, now, 0), "A zero max age disables staleness")
+}
+
+func TestAggregateHealth(t *testing.T) {
+	fileID := uuid.New()
+	result := aggregateHealth(fileID, []ChunkHealth{
+		{ChunkIndex: 0, Health: HealthHealthy, Score: 1},
+		{ChunkIndex: 1, Health: HealthAtRisk, Score: 0.33},
+		{ChunkIndex: 2, Health: HealthDegraded, Score: 0.5},
+	})
+	assert.Equal(t, HealthAtRisk, result.Health, "A file is as healthy as its worst chunk")
+	assert.Equal(t, 0.33, result.Score)
+	assert.Len(t, result.Chunks, 3)
+
+	result = aggregateHealth(fileID, []ChunkHealth{})
+	assert.Equal(t, HealthHealthy, result.Health)
+	assert.Equal(t, 1.0, result.Score)
+}
+
+// TestProofService_FileHealth runs against a scratch database named by TEST_DATABASE_URL
+func TestProofService_FileHealth(t *testing.T) {
+	databaseURL := os.Getenv("TEST_DATABASE_URL")
+	if databaseURL == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	ctx := context.Background()
+	db, err := storage.New(databaseURL)
+	assert.NoError(t, err)
+	defer db.Close()
+	assert.NoError(t, db.Migrate("../../migrations"))
+
+	nodeService := NewNodeService(db, "")
+	var nodeIDs []uuid.UUID
+	for i := 0; i < 3; i++ {
+		node, _, err := nodeService.RegisterNode(ctx, RegisterNodeRequest{
+			Name: "health", PeerID: "peer-" + uuid.NewString(), PublicKey: []byte("pk"), TotalStorageGB: 1,
+		})
+		assert.NoError(t, err)
+		nodeIDs = append(nodeIDs, node.ID)
+	}
+
+	store := storage.NewPgStore(db)
+	user := &models.User{ID: uuid.New(), Email: uuid.NewString() + "@example.com"}
+	assert.NoError(t, store.CreateUser(ctx, user))
+	files := NewFileService(store, 8, 100)
+	chunks := NewChunkService(store, nil, nil)
+	file, err := files.CreateFile(ctx, user.ID, "health.bin", 16, "", make([]byte, 32), DefaultCipher, 3)
+	assert.NoError(t, err)
+	file.Replicas = 3
+
+	// Chunk 0 is on all three nodes, chunk 1 on two, chunk 2 on one and
+	// chunk 3 on none that still holds it
+	placements := [][]uuid.UUID{nodeIDs, nodeIDs[:2], nodeIDs[:1], nodeIDs[2:]}
+	var stored []*models.Chunk
+	for i, nodes := range placements {
+		chunk, err := chunks.StoreChunk(ctx, file.ID, i, []byte("data"), nodes)
+		assert.NoError(t, err)
+		stored = append(stored, chunk)
+	}
+	assert.NoError(t, store.SetChunkAssignment(ctx, stored[3].ID, nodeIDs[2], "retired"))
+
+	proven := time.Now().Add(-time.Hour).UTC().Truncate(time.Microsecond)
+	// A later failed proof doesn't count as the last successful one
+	for status, at := range map[string]time.Time{"verified": proven, "failed": proven.Add(30 * time.Minute)} {
+		_, err = db.Pool.Exec(ctx,
+			`INSERT INTO proof_challenges (chunk_id, node_id, seed, status, verified_at) VALUES ($1, $2, 'seed', $3, $4)`,
+			stored[0].ID, nodeIDs[0], status, at)
+		assert.NoError(t, err)
+	}
+
+	proofs := NewProofService(db, 1, ProofTimeout{}, nil, 0)
+	proofs.SetHealthPolicy(3, 12*time.Hour)
+	health, err := proofs.FileHealth(ctx, file, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, HealthLost, health.Health)
+	assert.Equal(t, 0.0, health.Score)
+
+	var states []string
+	for _, chunk := range health.Chunks {
+		states = append(states, chunk.Health)
+		assert.Equal(t, 3, chunk.TargetReplicas)
+	}
+	assert.Equal(t, []string{HealthHealthy, HealthDegraded, HealthAtRisk, HealthLost}, states)
+	assert.Equal(t, []int{3, 2, 1, 0}, []int{health.Chunks[0].Replicas, health.Chunks[1].Replicas,
+		health.Chunks[2].Replicas, health.Chunks[3].Replicas})
+	if assert.NotNil(t, health.Chunks[0].LastProofAt) {
+		assert.True(t, health.Chunks[0].LastProofAt.Equal(proven))
+	}
+	assert.Nil(t, health.Chunks[1].LastProofAt)
+
+	// A node that leaves takes its replicas out of the count
+	_, err = db.Pool.Exec(ctx, "UPDATE storage_nodes SET status = 'deregistered' WHERE id = $1", nodeIDs[2])
+	assert.NoError(t, err)
+	health, err = proofs.FileHealth(ctx, file, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, health.Chunks[0].Replicas)
+	assert.Equal(t, HealthDegraded, health.Chunks[0].Health)
+}
+
+func TestRankByReputation(t *testing.T) {
+	a := models.StorageNode{ID: uuid.New(), ReputationScore: 0.5}
+	b := models.StorageNode{ID: uuid.New(), ReputationScore: 1.0}
+	c := models.StorageNode{ID: uuid.New(), ReputationScore: 0.9}
+	d := models.StorageNode{ID: uuid.New(), ReputationScore: 1.0}
+
+	nodes := []models.StorageNode{a, b, c, d}
+	RankByReputation(nodes)
+	assert.Equal(t, []uuid.UUID{b.ID, d.ID, c.ID, a.ID}, []uuid.UUID{nodes[0].ID, nodes[1].ID, nodes[2].ID, nodes[3].ID})
+}
+
+// TestNodeService_ReputationSnapshots runs against a scratch database named by TEST_DATABASE_URL
+func TestNodeService_ReputationSnapshots(t *testing.T) {
+	databaseURL := os.Getenv("TEST_DATABASE_URL")
+	if databaseURL == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	ctx := context.Background()
+	db, err := storage.New(databaseURL)
+	assert.NoError(t, err)
+	defer db.Close()
+	assert.NoError(t, db.Migrate("../../migrations"))
+
+	nodeService := NewNodeService(db, "")
+	node, _, err := nodeService.RegisterNode(ctx, RegisterNodeRequest{
+		Name: "reputation", PeerID: "peer-" + uuid.NewString(), PublicKey: []byte("pk"), TotalStorageGB: 1,
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, nodeService.UpdateHeartbeat(ctx, node.ID, 0, ""))
+
+	since := time.Now().Add(-time.Hour)
+	for i := 0; i < 3; i++ {
+		_, err := nodeService.RecordReputationSnapshots(ctx, since)
+		assert.NoError(t, err)
+	}
+
+	history, err := nodeService.GetReputationHistory(ctx, node.ID, 10)
+	assert.NoError(t, err)
+	assert.Len(t, history, 3)
+	for i := 1; i < len(history); i++ {
+		assert.False(t, history[i].RecordedAt.After(history[i-1].RecordedAt), "History should be newest first")
+	}
+
+	// Scores survive a restart because they live in the database
+	reloaded, err := NewNodeService(db, "").GetNodeByPeerID(ctx, node.PeerID)
+	assert.NoError(t, err)
+	assert.InDelta(t, ReputationScore(history), reloaded.ReputationScore, 1e-9)
+}
+
+func TestAuthService_HoldCaptureRelease(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	service := NewAuthService(store, NewPricing(1000, nil))
+
+	user := &models.User{ID: uuid.New(), Email: "hold@example.com", Credits: 100}
+	assert.NoError(t, store.CreateUser(ctx, user))
+	balance := func() (int64, int64) {
+		u, err := service.GetUser(ctx, user.ID)
+		assert.NoError(t, err)
+		return u.Credits, u.HeldCredits
+	}
+
+	assert.NoError(t, service.HoldCredits(ctx, user.ID, 60))
+	credits, held := balance()
+	assert.Equal(t, int64(40), credits, "Held credits leave the spendable balance")
+	assert.Equal(t, int64(60), held)
+
+	// The held credits can't back a second hold
+	err := service.HoldCredits(ctx, user.ID, 50)
+	assert.ErrorIs(t, err, ErrInsufficientCredits)
+	credits, held = balance()
+	assert.Equal(t, int64(40), credits)
+	assert.Equal(t, int64(60), held)
+
+	assert.NoError(t, service.CaptureCredits(ctx, user.ID, 45, "Storage payment for a.txt"))
+	assert.NoError(t, service.ReleaseCredits(ctx, user.ID, 15))
+	credits, held = balance()
+	assert.Equal(t, int64(55), credits)
+	assert.Equal(t, int64(0), held)
+
+	// Only the capture is a transaction; holds and releases just move credits around
+	transactions := store.Transactions(user.ID)
+	assert.Len(t, transactions, 1)
+	assert.Equal(t, "debit", transactions[0].TransactionType)
+	assert.Equal(t, int64(-45), transactions[0].Amount)
+
+	// Nothing is left to capture or release
+	assert.ErrorIs(t, service.CaptureCredits(ctx, user.ID, 1, "overdraw"), storage.ErrInsufficientCredits)
+	assert.ErrorIs(t, service.ReleaseCredits(ctx, user.ID, 1), storage.ErrInsufficientCredits)
+}
+
+func TestUploadService_ExpireSessionsReleasesHolds(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	authService := NewAuthService(store, NewPricing(1000, nil))
+	uploadService := NewUploadService(store, 256*1024, 1, 100)
+
+	user := &models.User{ID: uuid.New(), Email: "abandon@example.com", Credits: 100}
+	assert.NoError(t, store.CreateUser(ctx, user))
+
+	assert.NoError(t, authService.HoldCredits(ctx, user.ID, 30))
+	abandoned, err := uploadService.InitiateUpload(ctx, user.ID, InitiateUploadRequest{Filename: "abandoned.txt", SizeBytes: 1024}, 30)
+	assert.NoError(t, err)
+
+	assert.NoError(t, authService.HoldCredits(ctx, user.ID, 20))
+	live := &models.UploadSession{
+		ID: uuid.New(), UserID: user.ID, Filename: "live.txt", SizeBytes: 1024, ChunkCount: 1,
+		Status: "active", ExpiresAt: abandoned.ExpiresAt.Add(time.Hour), HeldCredits: 20,
+	}
+	assert.NoError(t, store.CreateUploadSession(ctx, live))
+
+	expired, err := uploadService.ExpireSessions(ctx, abandoned.ExpiresAt.Add(-time.Second))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, expired, "Nothing has expired yet")
+
+	expired, err = uploadService.ExpireSessions(ctx, abandoned.ExpiresAt)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, expired)
+
+	stored, err := uploadService.GetSession(ctx, abandoned.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "expired", stored.Status)
+
+	current, err := authService.GetUser(ctx, user.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(80), current.Credits, "The expired session's hold is returned")
+	assert.Equal(t, int64(20), current.HeldCredits, "The live session keeps its hold")
+
+	// An expired session can't be completed, and a second sweep releases nothing
+	closed, err := uploadService.CloseSession(ctx, abandoned.ID, "completed")
+	assert.NoError(t, err)
+	assert.False(t, closed)
+	expired, err = uploadService.ExpireSessions(ctx, abandoned.ExpiresAt)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, expired)
+}
+
+func TestInviteService_RedeemOnceBeforeExpiry(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	service := NewInviteService(store)
+
+	token, invite, err := service.CreateInvite(ctx, "", time.Hour)
+	assert.NoError(t, err)
+	assert.NotEqual(t, token, invite.TokenHash, "Only the hash is stored")
+
+	redeemed, err := service.Redeem(ctx, token)
+	assert.NoError(t, err)
+	assert.Equal(t, invite.ID, redeemed.ID)
+	_, err = service.Redeem(ctx, token)
+	assert.ErrorIs(t, err, ErrInvalidInvite)
+
+	assert.NoError(t, service.Restore(ctx, redeemed))
+	_, err = service.Redeem(ctx, token)
+	assert.NoError(t, err, "A restored invite can be used again")
+
+	// An expired invite is refused
+	expired := &models.NodeInvite{ID: uuid.New(), TokenHash: hashInviteToken("fsi_old")}
+	past := time.Now().Add(-time.Minute)
+	expired.ExpiresAt = &past
+	assert.NoError(t, store.CreateNodeInvite(ctx, expired))
+	_, err = service.Redeem(ctx, "fsi_old")
+	assert.ErrorIs(t, err, ErrInvalidInvite)
+}
+
+func TestRankLeaderboard(t *testing.T) {
+	entries := []LeaderboardEntry{
+		{NodeID: "a", EarnedCredits: 100, ProofSuccessRate: 0.5, UptimePercentage: 99},
+		{NodeID: "b", EarnedCredits: 300, ProofSuccessRate: 0.9, UptimePercentage: 90},
+		{NodeID: "c", EarnedCredits: 100, ProofSuccessRate: 1.0, UptimePercentage: 80},
+		{NodeID: "d", EarnedCredits: 100, ProofSuccessRate: 1.0, UptimePercentage: 95},
+	}
+	RankLeaderboard(entries)
+
+	var order []string
+	for i, e := range entries {
+		order = append(order, e.NodeID)
+		assert.Equal(t, i+1, e.Rank)
+	}
+	assert.Equal(t, []string{"b", "d", "c", "a"}, order, "Credits first, then proof success rate, then uptime")
+
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	AnonymizeLeaderboard(entries, secret)
+	assert.Empty(t, entries[0].NodeID)
+	assert.Regexp(t, `^node-[0-9a-f]{8}$`, entries[0].Name)
+	again := []LeaderboardEntry{{NodeID: "b"}}
+	AnonymizeLeaderboard(again, secret)
+	assert.Equal(t, entries[0].Name, again[0].Name, "Pseudonyms are stable")
+	other := []LeaderboardEntry{{NodeID: "b"}}
+	AnonymizeLeaderboard(other, []byte("another secret of thirty-two bytes"))
+	assert.NotEqual(t, entries[0].Name, other[0].Name, "Pseudonyms depend on the secret, not just the public node ID")
+}
+
+func TestLeaderboardSince(t *testing.T) {
+	now := time.Date(2024, 3, 31, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		period string
+		want   time.Time
+	}{
+		{"day", time.Date(2024, 3, 30, 12, 0, 0, 0, time.UTC)},
+		{"week", time.Date(2024, 3, 24, 12, 0, 0, 0, time.UTC)},
+		{"month", now.AddDate(0, -1, 0)},
+		{"", now.AddDate(0, -1, 0)},
+		{"all", time.Time{}},
+	}
+	for _, tt := range tests {
+		since, err := LeaderboardSince(tt.period, now)
+		assert.NoError(t, err, tt.period)
+		assert.Equal(t, tt.want, since, tt.period)
+	}
+
+	_, err := LeaderboardSince("year", now)
+	assert.ErrorIs(t, err, ErrInvalidPeriod)
+}
+
+func TestValidateFilename(t *testing.T) {
+	for _, name := range []string{"report.pdf", `say "hi".txt`, "résumé.pdf", "日本語.txt"} {
+		assert.NoError(t, ValidateFilename(name), name)
+	}
+	for _, name := range []string{"", "   ", "a\nb.txt", "a\rb", "tab\there", "bad\xff.txt", strings.Repeat("a", MaxFilenameLength+1)} {
+		assert.ErrorIs(t, ValidateFilename(name), ErrInvalidFilename, "%q", name)
+	}
+
+	uploads := NewUploadService(storage.NewMemoryStore(), 8, 1, 100)
+	_, err := uploads.InitiateUpload(context.Background(), uuid.New(), InitiateUploadRequest{Filename: "a\r\nb", SizeBytes: 5}, 0)
+	assert.ErrorIs(t, err, ErrInvalidFilename)
+}
+
+func TestFileService_ContentType(t *testing.T) {
+	files := NewFileService(storage.NewMemoryStore(), 8, 100)
+	assert.Equal(t, "image/png", files.ContentType(&models.File{MimeType: "image/png"}))
+	assert.Equal(t, DefaultMimeType, files.ContentType(&models.File{}))
+	assert.Equal(t, DefaultMimeType, files.ContentType(&models.File{MimeType: "not a type"}))
+
+	files.SetDefaultMimeType("application/x-unknown")
+	assert.Equal(t, "application/x-unknown", files.ContentType(&models.File{}))
+}
+
+func TestUploadService_CheckChunk(t *testing.T) {
+	ctx := context.Background()
+	uploads := NewUploadService(storage.NewMemoryStore(), 8, 1, 100)
+
+	tests := []struct {
+		name      string
+		sizeBytes int64
+		chunks    int
+		last      int64
+	}{
+		{name: "multiple of the chunk size", sizeBytes: 24, chunks: 3, last: 8},
+		{name: "not a multiple", sizeBytes: 20, chunks: 3, last: 4},
+		{name: "smaller than one chunk", sizeBytes: 5, chunks: 1, last: 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session, err := uploads.InitiateUpload(ctx, uuid.New(), InitiateUploadRequest{Filename: "a.bin", SizeBytes: tt.sizeBytes}, 0)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.chunks, session.ChunkCount)
+			assert.Equal(t, tt.last, session.LastChunkSize)
+
+			final := tt.chunks - 1
+			for i := 0; i < final; i++ {
+				assert.NoError(t, uploads.CheckChunk(session, i, 8))
+				assert.ErrorIs(t, uploads.CheckChunk(session, i, 7), ErrChunkTooSmall, "non-final chunks must be full")
+				assert.ErrorIs(t, uploads.CheckChunk(session, i, 9), ErrChunkTooLarge)
+			}
+			assert.NoError(t, uploads.CheckChunk(session, final, tt.last))
+			assert.ErrorIs(t, uploads.CheckChunk(session, final, tt.last+1), ErrChunkTooLarge, "the final chunk may not run past the file size")
+			assert.ErrorIs(t, uploads.CheckChunk(session, final, tt.last-1), ErrChunkTooSmall)
+			assert.ErrorIs(t, uploads.CheckChunk(session, tt.chunks, tt.last), ErrChunkIndexOutOfRange)
+
+			// Sessions created before the final size was recorded derive it
+			session.LastChunkSize = 0
+			assert.NoError(t, uploads.CheckChunk(session, final, tt.last))
+		})
+	}
+}
+
+func TestUploadService_SessionChunkSize(t *testing.T) {
+	ctx := context.Background()
+	uploads := NewUploadService(storage.NewMemoryStore(), 8, 1, 100)
+
+	// Without a configured range every session uses the server's chunk size
+	assert.Equal(t, int64(8), uploads.ClampChunkSize(0))
+	assert.Equal(t, int64(8), uploads.ClampChunkSize(3))
+
+	uploads.SetChunkSizeRange(4, 16)
+	tests := []struct {
+		requested int64
+		want      int64
+	}{
+		{requested: 0, want: 8},
+		{requested: 2, want: 4},
+		{requested: 5, want: 5},
+		{requested: 64, want: 16},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, uploads.ClampChunkSize(tt.requested), "requested %d", tt.requested)
+	}
+
+	// 12 bytes in 5-byte chunks: 5 + 5 + 2
+	session, err := uploads.InitiateUpload(ctx, uuid.New(), InitiateUploadRequest{Filename: "a.bin", SizeBytes: 12, ChunkSize: 5}, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), session.ChunkSize)
+	assert.Equal(t, 3, session.ChunkCount)
+	assert.Equal(t, int64(2), session.LastChunkSize)
+
+	stored, err := uploads.GetSession(ctx, session.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), stored.ChunkSize)
+
+	assert.NoError(t, uploads.CheckChunk(session, 0, 5))
+	assert.ErrorIs(t, uploads.CheckChunk(session, 0, 8), ErrChunkTooLarge, "the server's chunk size no longer applies")
+	assert.ErrorIs(t, uploads.CheckChunk(session, 1, 4), ErrChunkTooSmall)
+	assert.NoError(t, uploads.CheckChunk(session, 2, 2))
+
+	// Sessions stored before chunk sizes were recorded fall back to the
+	// schedule, which without tiers is the server's chunk size
+	session.ChunkSize = 0
+	assert.NoError(t, uploads.CheckChunk(session, 0, 8))
+}
+
+func TestUploadService_ChunkSizeSchedule(t *testing.T) {
+	const kb, mb, gb = int64(1024), int64(1024 * 1024), int64(1024 * 1024 * 1024)
+	ctx := context.Background()
+	uploads := NewUploadService(storage.NewMemoryStore(), 256*kb, 1, 10_000)
+	uploads.SetChunkSizeRange(64*kb, 16*mb)
+
+	// Without a schedule every file uses the server's chunk size
+	assert.Equal(t, 256*kb, uploads.ChunkSizeFor(kb))
+	assert.Equal(t, 256*kb, uploads.ChunkSizeFor(2*gb))
+
+	// Tiers may be configured in any order
+	uploads.SetChunkSizeSchedule([]ChunkSizeTier{
+		{MinFileBytes: gb, ChunkSizeBytes: 4 * mb},
+		{MinFileBytes: 0, ChunkSizeBytes: 64 * kb},
+		{MinFileBytes: mb, ChunkSizeBytes: 256 * kb},
+	})
+	tests := []struct {
+		sizeBytes int64
+		want      int64
+	}{
+		{sizeBytes: 1, want: 64 * kb},
+		{sizeBytes: 500 * kb, want: 64 * kb},
+		{sizeBytes: mb - 1, want: 64 * kb},
+		{sizeBytes: mb, want: 256 * kb},
+		{sizeBytes: 100 * mb, want: 256 * kb},
+		{sizeBytes: gb, want: 4 * mb},
+		{sizeBytes: 2 * gb, want: 4 * mb},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, uploads.ChunkSizeFor(tt.sizeBytes), "file of %d bytes", tt.sizeBytes)
+	}
+
+	// The scheduled size is stored with the session and returned
+	session, err := uploads.InitiateUpload(ctx, uuid.New(), InitiateUploadRequest{Filename: "small.bin", SizeBytes: 200 * kb}, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 64*kb, session.ChunkSize)
+	assert.Equal(t, 4, session.ChunkCount)
+	stored, err := uploads.GetSession(ctx, session.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 64*kb, stored.ChunkSize)
+
+	// Chunks are checked against the session's tier, not the server's size
+	assert.NoError(t, uploads.CheckChunk(session, 0, 64*kb))
+	assert.ErrorIs(t, uploads.CheckChunk(session, 0, 256*kb), ErrChunkTooLarge)
+	assert.NoError(t, uploads.CheckChunk(session, 3, 8*kb))
+	session.ChunkSize, session.LastChunkSize = 0, 0
+	assert.NoError(t, uploads.CheckChunk(session, 0, 64*kb), "Sessions without a recorded size use their file's tier")
+	assert.NoError(t, uploads.CheckChunk(session, 3, 8*kb))
+
+	count, err := uploads.ChunkCountFor(2 * gb)
+	assert.NoError(t, err)
+	assert.Equal(t, 512, count)
+
+	// A chunk size the client asks for still wins
+	session, err = uploads.InitiateUpload(ctx, uuid.New(), InitiateUploadRequest{Filename: "asked.bin", SizeBytes: 200 * kb, ChunkSize: 100 * kb}, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 100*kb, session.ChunkSize)
+	assert.Equal(t, 2, session.ChunkCount)
+}
+
+// ed25519Signer signs the way the coordinator's default libp2p Ed25519 identity does
+type ed25519Signer struct {
+	key ed25519.PrivateKey
+}
+
+func newEd25519Signer() *ed25519Signer {
+	_, key, _ := ed25519.GenerateKey(nil)
+	return &ed25519Signer{key: key}
+}
+
+func (s *ed25519Signer) Sign(data []byte) ([]byte, error) {
+	return ed25519.Sign(s.key, data), nil
+}
+
+func (s *ed25519Signer) Verify(data, signature []byte) (bool, error) {
+	return ed25519.Verify(s.key.Public().(ed25519.PublicKey), data, signature), nil
+}
+
+// nodeKeys stands in for storage nodes' peer keys, by peer ID
+type nodeKeys map[string]ed25519.PrivateKey
+
+func newNodeKeys(peerIDs ...string) nodeKeys {
+	keys := nodeKeys{}
+	for _, peerID := range peerIDs {
+		_, keys[peerID], _ = ed25519.GenerateKey(nil)
+	}
+	return keys
+}
+
+func (k nodeKeys) VerifyPeer(peerID string, data, signature []byte) (bool, error) {
+	key, ok := k[peerID]
+	if !ok {
+		return false, fmt.Errorf("unknown peer %s", peerID)
+	}
+	return ed25519.Verify(key.Public().(ed25519.PublicKey), data, signature), nil
+}
+
+// receipt is the receipt peerID signs for storing the chunk auth names
+func (k nodeKeys) receipt(peerID string, auth *StoreAuthorization, merkleRoot string) StoreReceipt {
+	receipt := StoreReceipt{PeerID: peerID, ChunkID: auth.ChunkID, Hash: auth.Hash, SizeBytes: auth.SizeBytes, MerkleRoot: merkleRoot}
+	receipt.Signature = ed25519.Sign(k[peerID], StoreReceiptPayload(receipt.ChunkID, receipt.Hash, receipt.SizeBytes, receipt.MerkleRoot))
+	return receipt
+}
+
+func TestStoreAuthorization_SignAndParse(t *testing.T) {
+	signer := newEd25519Signer()
+	expires := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	auth := &StoreAuthorization{
+		SessionID: uuid.New(), FileID: uuid.New(), ChunkID: uuid.New(), ChunkIndex: 2,
+		Hash: strings.Repeat("ab", 32), SizeBytes: 36,
+		NodeIDs: []uuid.UUID{uuid.New()}, PeerIDs: []string{"peer-a"}, ExpiresAt: expires,
+	}
+
+	token, err := SignStoreAuthorization(signer, auth)
+	assert.NoError(t, err)
+	parsed, err := ParseStoreAuthorization(signer, token, expires.Add(-time.Second))
+	assert.NoError(t, err)
+	assert.Equal(t, auth, parsed)
+
+	// A node can check the token with nothing but the coordinator's public key
+	payload, signature, _ := strings.Cut(token, ".")
+	rawPayload, _ := base64.RawURLEncoding.DecodeString(payload)
+	rawSignature, _ := base64.RawURLEncoding.DecodeString(signature)
+	assert.True(t, ed25519.Verify(signer.key.Public().(ed25519.PublicKey),
+		append([]byte("federated-storage store authorization\n"), rawPayload...), rawSignature))
+
+	// Raising the size the token allows breaks the signature
+	var tampered map[string]interface{}
+	assert.NoError(t, json.Unmarshal(rawPayload, &tampered))
+	tampered["size_bytes"] = 1 << 20
+	forged, _ := json.Marshal(tampered)
+	_, err = ParseStoreAuthorization(signer, base64.RawURLEncoding.EncodeToString(forged)+"."+signature, expires.Add(-time.Second))
+	assert.ErrorIs(t, err, ErrInvalidStoreAuthorization)
+
+	_, err = ParseStoreAuthorization(newEd25519Signer(), token, expires.Add(-time.Second))
+	assert.ErrorIs(t, err, ErrInvalidStoreAuthorization, "Tokens from another coordinator are refused")
+	_, err = ParseStoreAuthorization(signer, token, expires)
+	assert.ErrorIs(t, err, ErrInvalidStoreAuthorization, "Expired tokens are refused")
+	_, err = ParseStoreAuthorization(signer, "not-a-token", expires.Add(-time.Second))
+	assert.ErrorIs(t, err, ErrInvalidStoreAuthorization)
+}
+
+func TestUploadService_DirectChunkStore(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	uploads := NewUploadService(store, 8, 2, 100)
+	files := NewFileService(store, 8, 100)
+	userID := uuid.New()
+
+	req := InitiateUploadRequest{Filename: "direct.bin", SizeBytes: 12, Direct: true}
+	_, err := uploads.InitiateUpload(ctx, userID, req, 0)
+	assert.ErrorIs(t, err, ErrDirectUploadsDisabled)
+
+	signer := newEd25519Signer()
+	keys := newNodeKeys("peer-a", "peer-b", "peer-c")
+	uploads.SetDirectUploads(signer, keys, time.Minute)
+	session, err := uploads.InitiateUpload(ctx, userID, req, 0)
+	assert.NoError(t, err)
+	session, err = uploads.GetSession(ctx, session.ID)
+	assert.NoError(t, err)
+	assert.True(t, session.Direct)
+
+	file, err := files.CreateFile(ctx, userID, "direct.bin", 12, "", session.EncryptionKey, Cipher(session.Cipher), 2)
+	assert.NoError(t, err)
+	assert.NoError(t, uploads.UpdateSessionFileID(ctx, session.ID, file.ID))
+	session, err = uploads.GetSession(ctx, session.ID)
+	assert.NoError(t, err)
+
+	// The client encrypts the chunk itself; the coordinator only sees its hash and size
+	encrypted, err := Cipher(session.Cipher).Encrypt([]byte("eight b!"), session.EncryptionKey)
+	assert.NoError(t, err)
+	sum := sha256.Sum256(encrypted)
+	hash := hex.EncodeToString(sum[:])
+	size := int64(len(encrypted))
+
+	assert.ErrorIs(t, uploads.CheckDirectChunk(session, 0, "not-a-hash", size), ErrInvalidChunkHash)
+	assert.ErrorIs(t, uploads.CheckDirectChunk(session, 0, hash, 8), ErrChunkTooSmall, "Sizes are of the encrypted chunk")
+	assert.ErrorIs(t, uploads.CheckDirectChunk(session, 2, hash, size), ErrChunkIndexOutOfRange)
+	plain := *session
+	plain.Direct = false
+	assert.ErrorIs(t, uploads.CheckDirectChunk(&plain, 0, hash, size), ErrDirectUploadsDisabled)
+
+	nodes := []models.StorageNode{{ID: uuid.New(), PeerID: "peer-a"}, {ID: uuid.New(), PeerID: "peer-b"}}
+	token, auth, err := uploads.AuthorizeChunkStore(session, file.ID, 0, hash, size, nodes)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"peer-a", "peer-b"}, auth.PeerIDs)
+	assert.Equal(t, []uuid.UUID{nodes[0].ID, nodes[1].ID}, auth.NodeIDs)
+	assert.Equal(t, hash, auth.Hash)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), auth.ExpiresAt, 5*time.Second)
+
+	now := time.Now()
+	root := strings.Repeat("cd", 32)
+	receiptA, receiptB := keys.receipt("peer-a", auth, root), keys.receipt("peer-b", auth, root)
+	other := *session
+	other.ID = uuid.New()
+	_, _, _, err = uploads.VerifyChunkStored(&other, token, []StoreReceipt{receiptA}, now)
+	assert.ErrorIs(t, err, ErrInvalidStoreAuthorization, "Tokens only count for their own session")
+	_, _, _, err = uploads.VerifyChunkStored(session, token, nil, now)
+	assert.ErrorIs(t, err, ErrInvalidStoreReceipt, "The client's word that it stored the chunk isn't enough")
+
+	forged := receiptA
+	forged.MerkleRoot = strings.Repeat("ef", 32)
+	_, _, _, err = uploads.VerifyChunkStored(session, token, []StoreReceipt{forged}, now)
+	assert.ErrorIs(t, err, ErrInvalidStoreReceipt, "The client can't change the root a node signed")
+	otherContent := *auth
+	otherContent.Hash = strings.Repeat("0", 64)
+	_, _, _, err = uploads.VerifyChunkStored(session, token, []StoreReceipt{keys.receipt("peer-a", &otherContent, root)}, now)
+	assert.ErrorIs(t, err, ErrInvalidStoreReceipt, "The stored content must be what was authorized")
+	_, _, _, err = uploads.VerifyChunkStored(session, token, []StoreReceipt{keys.receipt("peer-c", auth, root)}, now)
+	assert.ErrorIs(t, err, ErrInvalidStoreReceipt, "Only the authorized nodes count")
+	_, _, _, err = uploads.VerifyChunkStored(session, token, []StoreReceipt{receiptA, receiptA}, now)
+	assert.ErrorIs(t, err, ErrInvalidStoreReceipt)
+	_, _, _, err = uploads.VerifyChunkStored(session, token, []StoreReceipt{receiptA, keys.receipt("peer-b", auth, strings.Repeat("ef", 32))}, now)
+	assert.ErrorIs(t, err, ErrInvalidStoreReceipt, "Nodes holding the same content agree on its root")
+
+	// A node that didn't acknowledge the chunk isn't recorded as holding it
+	verified, chunk, nodeIDs, err := uploads.VerifyChunkStored(session, token, []StoreReceipt{receiptB}, now)
+	assert.NoError(t, err)
+	assert.Equal(t, auth, verified)
+	assert.Equal(t, []uuid.UUID{nodes[1].ID}, nodeIDs)
+	verified, chunk, nodeIDs, err = uploads.VerifyChunkStored(session, token, []StoreReceipt{receiptA, receiptB}, now)
+	assert.NoError(t, err)
+	assert.Equal(t, verified.NodeIDs, nodeIDs)
+	assert.Equal(t, models.Chunk{ID: auth.ChunkID, FileID: file.ID, ChunkIndex: 0, Hash: hash, SizeBytes: len(encrypted), MerkleRoot: root}, *chunk)
+
+	// Only metadata and assignments reach the coordinator's store
+	chunks := NewChunkService(store, staticNodes(nodes), nil)
+	assert.NoError(t, chunks.RecordChunk(ctx, chunk, nodeIDs))
+	assert.ErrorIs(t, chunks.RecordChunk(ctx, chunk, nodeIDs), storage.ErrConflict)
+	recorded, data, err := store.GetChunk(ctx, chunk.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, chunk, recorded)
+	assert.Empty(t, data)
+	assignments, err := chunks.GetChunkAssignments(ctx, chunk.ID)
+	assert.NoError(t, err)
+	assert.Len(t, assignments, 2)
+	missing, err := files.MissingChunks(ctx, file.ID, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1}, missing)
+
+	// Reads fetch the chunk from its nodes, refusing content that doesn't match its hash
+	listed, err := chunks.GetChunksByFile(ctx, file.ID)
+	assert.NoError(t, err)
+	if assert.Len(t, listed, 1) {
+		assert.True(t, listed[0].NodeOnly)
+	}
+	assert.ErrorIs(t, chunks.CheckChunksReadable(ctx, listed, 1), ErrChunkUnavailable,
+		"Downloads are refused up front while no node can be reached")
+	_, err = chunks.ReadChunk(ctx, *chunk)
+	assert.ErrorIs(t, err, ErrChunkUnavailable)
+	transfer := &fakeTransfer{corrupt: true}
+	assert.NoError(t, transfer.SendChunk(ctx, "peer-b", chunk.ID.String(), encrypted))
+	chunks.SetTransfer(transfer)
+	assert.NoError(t, chunks.CheckChunksReadable(ctx, listed, 1))
+	_, err = chunks.ReadChunk(ctx, *chunk)
+	assert.ErrorIs(t, err, ErrChunkUnavailable)
+	transfer.corrupt = false
+	read, err := chunks.ReadChunk(ctx, *chunk)
+	assert.NoError(t, err)
+	assert.Equal(t, encrypted, read)
+
+	// Rebalancing and drains copy it from a node holding it
+	move := ChunkMove{ChunkID: chunk.ID, FromNodeID: nodes[1].ID, ToNodeID: uuid.New(), ToPeerID: "peer-c"}
+	assert.NoError(t, chunks.CopyChunk(ctx, transfer, move))
+	assert.Equal(t, encrypted, transfer.stored["peer-c/"+chunk.ID.String()])
+}
+
+func TestChunkService_DedupReport(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	chunkService := NewChunkService(store, nil, nil)
+
+	// Three files share 100 bytes of content, two share 50, one is unique,
+	// one has no recorded hash and one is still uploading. Each file is
+	// encrypted under its own key, so only the plaintext hash matches.
+	addFile := func(hash string, size int64, status string) {
+		file := &models.File{ID: uuid.New(), UserID: uuid.New(), Filename: "f", SizeBytes: size,
+			EncryptionKey: []byte("key"), Status: status, Version: 1}
+		assert.NoError(t, store.CreateFile(ctx, file))
+		if hash != "" {
+			assert.NoError(t, store.SetFileContentHash(ctx, file.ID, hash))
+		}
+	}
+	for i := 0; i < 3; i++ {
+		addFile("shared", 100, "ready")
+	}
+	for i := 0; i < 2; i++ {
+		addFile("pair", 50, "ready")
+	}
+	addFile("single", 30, "ready")
+	addFile("", 70, "ready")
+	addFile("shared", 100, "uploading")
+
+	report, err := chunkService.DedupReport(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 6, report.TotalFiles)
+	assert.Equal(t, 3, report.UniqueFiles)
+	assert.Equal(t, 1, report.UnhashedFiles)
+	assert.Equal(t, 2, report.DuplicateGroups)
+	assert.Equal(t, int64(3*100+2*50+30), report.TotalBytes)
+	assert.Equal(t, int64(100+50+30), report.UniqueBytes)
+	assert.Equal(t, int64(250), report.SavingsBytes)
+	assert.InDelta(t, 250.0/430*100, report.SavingsPercent, 0.001)
+	if assert.Len(t, report.TopGroups, 2) {
+		assert.Equal(t, 3, report.TopGroups[0].Files, "The group saving the most comes first")
+		assert.Equal(t, int64(50), report.TopGroups[1].SizeBytes)
+	}
+
+	empty := BuildDedupReport(nil)
+	assert.Zero(t, empty.SavingsPercent)
+	assert.NotNil(t, empty.TopGroups)
+}
+
+func TestAuthService_LoginLockout(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	service := NewAuthService(store, NewPricing(1000, nil))
+	service.SetLoginLockout(3, 15*time.Minute)
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	service.now = func() time.Time { return now }
+
+	_, err := service.Register(ctx, RegisterRequest{Email: "lock@example.com", Password: "correct-horse"})
+	assert.NoError(t, err)
+	wrong := LoginRequest{Email: "lock@example.com", Password: "wrong-password"}
+	right := LoginRequest{Email: "lock@example.com", Password: "correct-horse"}
+
+	// A success resets the count, so only failures in a row lock the account
+	for i := 0; i < 2; i++ {
+		_, err = service.Login(ctx, wrong)
+		assert.EqualError(t, err, "invalid credentials")
+	}
+	_, err = service.Login(ctx, right)
+	assert.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		_, err = service.Login(ctx, wrong)
+		assert.EqualError(t, err, "invalid credentials")
+	}
+	_, err = service.Login(ctx, wrong)
+	var locked *AccountLockedError
+	if assert.ErrorAs(t, err, &locked, "The third failure in a row locks the account") {
+		assert.Equal(t, now.Add(15*time.Minute), locked.Until)
+	}
+	assert.ErrorIs(t, err, ErrAccountLocked)
+
+	now = now.Add(14 * time.Minute)
+	_, err = service.Login(ctx, right)
+	assert.ErrorIs(t, err, ErrAccountLocked, "Even the right password is refused while locked")
+
+	// The lockout ends by itself and the next success clears it
+	now = now.Add(time.Minute)
+	user, err := service.Login(ctx, right)
+	assert.NoError(t, err)
+	assert.Equal(t, "lock@example.com", user.Email)
+	stored, err := store.GetUserByEmail(ctx, "lock@example.com")
+	assert.NoError(t, err)
+	assert.Nil(t, stored.LockedUntil)
+	assert.Zero(t, stored.FailedLoginAttempts)
+
+	service.SetLoginLockout(-1, 15*time.Minute)
+	for i := 0; i < 5; i++ {
+		_, err = service.Login(ctx, wrong)
+		assert.EqualError(t, err, "invalid credentials", "Lockout can be disabled")
+	}
+}
+
+func TestChunkService_MigrateChunk(t *testing.T) {
+	ctx := context.Background()
+	leaving := models.StorageNode{ID: uuid.New(), PeerID: "leaving", TotalStorageBytes: 1000}
+	b := models.StorageNode{ID: uuid.New(), PeerID: "b", TotalStorageBytes: 1000}
+	c := models.StorageNode{ID: uuid.New(), PeerID: "c", TotalStorageBytes: 1000, UsedStorageBytes: 500}
+	d := models.StorageNode{ID: uuid.New(), PeerID: "d", TotalStorageBytes: 1000}
+	data := []byte("held by leaving and b")
+
+	newService := func() (*ChunkService, *storage.MemoryStore, *models.Chunk) {
+		store := storage.NewMemoryStore()
+		chunkService := NewChunkService(store, staticNodes{b, c, d}, nil)
+		chunk, err := chunkService.StoreChunk(ctx, uuid.New(), 0, data, []uuid.UUID{leaving.ID, b.ID})
+		assert.NoError(t, err)
+		return chunkService, store, chunk
+	}
+
+	t.Run("copies the node's data and retires its replica", func(t *testing.T) {
+		chunkService, store, chunk := newService()
+		transfer := &fakeTransfer{}
+
+		result, err := chunkService.MigrateChunk(ctx, transfer, leaving.ID, chunk.ID, data, 2)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, result.Replicas)
+		assert.Equal(t, 1, result.Copied)
+		assert.Equal(t, data, transfer.stored["d/"+chunk.ID.String()], "The least utilized node not holding it receives the copy")
+
+		assignments, err := store.ListChunkAssignments(ctx, chunk.ID)
+		assert.NoError(t, err)
+		holders := map[uuid.UUID]bool{}
+		for _, a := range assignments {
+			holders[a.NodeID] = true
+		}
+		assert.Equal(t, map[uuid.UUID]bool{b.ID: true, d.ID: true}, holders)
+		remaining, err := chunkService.ListNodeChunks(ctx, leaving.ID)
+		assert.NoError(t, err)
+		assert.Empty(t, remaining, "The leaving node may now deregister")
+	})
+
+	t.Run("rejects data that does not match the chunk", func(t *testing.T) {
+		chunkService, _, chunk := newService()
+		_, err := chunkService.MigrateChunk(ctx, &fakeTransfer{}, leaving.ID, chunk.ID, []byte("bit rot"), 2)
+		assert.ErrorIs(t, err, ErrChunkDataMismatch)
+	})
+
+	t.Run("keeps the node's replica when copies fail", func(t *testing.T) {
+		chunkService, _, chunk := newService()
+		_, err := chunkService.MigrateChunk(ctx, &fakeTransfer{corrupt: true}, leaving.ID, chunk.ID, data, 2)
+		assert.ErrorIs(t, err, ErrReplicationIncomplete)
+
+		remaining, err := chunkService.ListNodeChunks(ctx, leaving.ID)
+		assert.NoError(t, err)
+		assert.Len(t, remaining, 1)
+	})
+
+	t.Run("unknown chunk", func(t *testing.T) {
+		chunkService, _, _ := newService()
+		_, err := chunkService.MigrateChunk(ctx, &fakeTransfer{}, leaving.ID, uuid.New(), data, 2)
+		assert.ErrorIs(t, err, ErrUnknownChunk)
+	})
+}
+
+func TestChunkService_ListNodeChunkPage(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	chunkService := NewChunkService(store, nil, nil)
+	node, other := uuid.New(), uuid.New()
+
+	mine := map[uuid.UUID]bool{}
+	for i := 0; i < 5; i++ {
+		chunk, err := chunkService.StoreChunk(ctx, uuid.New(), i, []byte(fmt.Sprintf("chunk %d", i)), []uuid.UUID{node})
+		assert.NoError(t, err)
+		mine[chunk.ID] = true
+	}
+	_, err := chunkService.StoreChunk(ctx, uuid.New(), 0, []byte("someone else's"), []uuid.UUID{other})
+	assert.NoError(t, err)
+	retired, err := chunkService.StoreChunk(ctx, uuid.New(), 0, []byte("moved away"), []uuid.UUID{node})
+	assert.NoError(t, err)
+	assert.NoError(t, store.SetChunkAssignment(ctx, retired.ID, node, "retired"))
+
+	seen := map[uuid.UUID]bool{}
+	after := uuid.Nil
+	var pages []int
+	for {
+		page, err := chunkService.ListNodeChunkPage(ctx, node, after, 2)
+		assert.NoError(t, err)
+		if len(page) == 0 {
+			break
+		}
+		pages = append(pages, len(page))
+		for _, c := range page {
+			assert.True(t, c.ID.String() > after.String(), "Pages are in ID order")
+			assert.False(t, seen[c.ID], "No chunk appears on two pages")
+			seen[c.ID] = true
+			after = c.ID
+		}
+	}
+	assert.Equal(t, []int{2, 2, 1}, pages)
+	assert.Equal(t, mine, seen, "Only the node's own active assignments are listed")
+}
+
+func TestNewCapacityChallenge_Sizing(t *testing.T) {
+	const block = CapacityBlockSize
+
+	// Blocks land at distinct offsets anywhere inside the claim
+	reached := int64(0)
+	for i := 0; i < 50; i++ {
+		r, err := NewCapacityChallenge(1000*block, 4*block)
+		assert.NoError(t, err)
+		assert.Equal(t, block, r.Challenge.BlockSize)
+		assert.Len(t, r.Challenge.Offsets, 4)
+		assert.Equal(t, int64(4*block), r.Bytes())
+		assert.True(t, slices.IsSorted(r.Challenge.Offsets))
+		assert.Len(t, slices.Compact(slices.Clone(r.Challenge.Offsets)), 4, "Offsets are distinct")
+		for _, offset := range r.Challenge.Offsets {
+			assert.True(t, offset >= 0 && offset < 1000, "Block %d stays within the claim", offset)
+			reached = max(reached, offset)
+		}
+	}
+	assert.Greater(t, reached, int64(500), "Blocks are spread across the claim, not packed at its start")
+
+	// A region larger than the claim shrinks to the whole claim, partial blocks dropped
+	r, err := NewCapacityChallenge(3*block+100, 64*block)
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{0, 1, 2}, r.Challenge.Offsets)
+
+	// A region under one block still asks for one
+	r, err = NewCapacityChallenge(10*block, 10)
+	assert.NoError(t, err)
+	assert.Len(t, r.Challenge.Offsets, 1)
+
+	_, err = NewCapacityChallenge(block-1, block)
+	assert.Error(t, err, "A claim under one block can't be challenged")
+
+	// What the node is sent carries nothing it could regenerate the data from
+	sent, err := json.Marshal(r.Challenge)
+	assert.NoError(t, err)
+	assert.JSONEq(t, fmt.Sprintf(`{"block_size":%d,"offsets":[%d]}`, block, r.Challenge.Offsets[0]), string(sent))
+}
+
+func TestVerifyCapacityProof(t *testing.T) {
+	region := &CapacityRegion{Challenge: models.CapacityChallenge{BlockSize: 64, Offsets: []int64{3, 17, 40}}, key: []byte("key")}
+	sample := &models.CapacitySample{Nonce: []byte("nonce"), Blocks: []int{2, 0}}
+
+	// What a node holding the blocks it was sent answers
+	stored := make([][]byte, len(region.Challenge.Offsets))
+	for i := range stored {
+		stored[i] = make([]byte, region.Challenge.BlockSize)
+		region.Block(i, stored[i])
+	}
+	assert.NotEqual(t, stored[0], stored[1], "Each block has its own data")
+	digests := make([]string, len(sample.Blocks))
+	for i, block := range sample.Blocks {
+		sum := sha256.Sum256(append(append([]byte{}, sample.Nonce...), stored[block]...))
+		digests[i] = hex.EncodeToString(sum[:])
+	}
+	assert.NoError(t, VerifyCapacityProof(region, sample, &models.CapacityProof{Digests: digests}, 10*time.Millisecond))
+
+	other, err := NewCapacityChallenge(64*CapacityBlockSize, 3*CapacityBlockSize)
+	assert.NoError(t, err)
+	other.Challenge = region.Challenge
+	timeout := time.Duration(CapacityTimeoutMs(sample, region.Challenge.BlockSize)) * time.Millisecond
+
+	tests := []struct {
+		name  string
+		proof models.CapacityProof
+		took  time.Duration
+	}{
+		{name: "blocks from another key", proof: models.CapacityProof{Digests: other.SampleDigests(sample)}},
+		{name: "stale nonce", proof: models.CapacityProof{Digests: region.SampleDigests(&models.CapacitySample{Nonce: []byte("old"), Blocks: sample.Blocks})}},
+		{name: "blocks missing", proof: models.CapacityProof{Digests: digests[:1]}},
+		{name: "too slow by the coordinator's clock", proof: models.CapacityProof{Digests: digests}, took: timeout + time.Millisecond},
+		{name: "node short of space", proof: models.CapacityProof{Error: "insufficient storage space"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.ErrorIs(t, VerifyCapacityProof(region, sample, &tt.proof, tt.took), ErrCapacityProofFailed)
+		})
+	}
+
+	assert.Equal(t, capacityProofBaseMs+4*capacityProofMsPerMB,
+		CapacityTimeoutMs(&models.CapacitySample{Blocks: []int{0, 1, 2, 3}}, CapacityBlockSize))
+}
+
+func TestTrustedCapacity_CapsUnprovenClaims(t *testing.T) {
+	verified := time.Now()
+	unproven := models.StorageNode{TotalStorageBytes: 100}
+	proven := models.StorageNode{TotalStorageBytes: 100, CapacityVerifiedAt: &verified}
+
+	assert.Equal(t, int64(10), TrustedCapacity(&unproven, 10))
+	assert.Equal(t, int64(100), TrustedCapacity(&proven, 10))
+	assert.Equal(t, int64(100), TrustedCapacity(&unproven, 0), "No cap trusts every claim")
+	assert.Equal(t, int64(100), TrustedCapacity(&unproven, 500))
+
+	full := models.StorageNode{ID: uuid.New(), TotalStorageBytes: 10, UsedStorageBytes: 10}
+	roomy := models.StorageNode{ID: uuid.New(), TotalStorageBytes: 10, UsedStorageBytes: 5}
+	unknown := models.StorageNode{ID: uuid.New()}
+	assert.Equal(t, []models.StorageNode{roomy, unknown}, ExcludeFull([]models.StorageNode{full, roomy, unknown}))
+}
+
+func ringNodes(n int) []models.StorageNode {
+	nodes := make([]models.StorageNode, n)
+	for i := range nodes {
+		nodes[i] = models.StorageNode{ID: uuid.New(), PeerID: fmt.Sprintf("peer-%d", i)}
+	}
+	return nodes
+}
+
+func TestHashRing_StablePlacement(t *testing.T) {
+	nodes := ringNodes(5)
+	ring := NewHashRing(nodes, DefaultVirtualNodes)
+
+	key := ChunkPlacementKey(uuid.New(), 3)
+	first := ring.Candidates(key)
+	assert.Len(t, first, len(nodes), "Every node is a candidate, each once")
+
+	// The same key maps to the same order, whatever order the nodes are listed in
+	reversed := make([]models.StorageNode, len(nodes))
+	for i, n := range nodes {
+		reversed[len(nodes)-1-i] = n
+	}
+	assert.Equal(t, first, NewHashRing(reversed, DefaultVirtualNodes).Candidates(key))
+	assert.Equal(t, first, ring.Candidates(key))
+
+	assert.Empty(t, NewHashRing(nil, DefaultVirtualNodes).Candidates(key))
+}
+
+func TestHashRing_MinimalReshuffling(t *testing.T) {
+	nodes := ringNodes(10)
+	before := NewHashRing(nodes, DefaultVirtualNodes)
+	joined := ringNodes(1)[0]
+	after := NewHashRing(append(append([]models.StorageNode{}, nodes...), joined), DefaultVirtualNodes)
+
+	const keys, replicas = 2000, 3
+	moved, counts := 0, make(map[uuid.UUID]int)
+	for i := 0; i < keys; i++ {
+		key := ChunkPlacementKey(uuid.New(), i)
+		was, now := before.Candidates(key)[:replicas], after.Candidates(key)[:replicas]
+		for _, n := range now {
+			counts[n.ID]++
+		}
+
+		// Only the new node can displace a replica: the rest keep their order
+		var kept []models.StorageNode
+		for _, n := range now {
+			if n.ID != joined.ID {
+				kept = append(kept, n)
+			}
+		}
+		assert.Equal(t, was[:len(kept)], kept)
+		if len(kept) < replicas {
+			moved++
+		}
+	}
+
+	// One node in eleven should take about 3/11 of the keys' replica sets
+	assert.InDelta(t, float64(keys)*replicas/11, moved, float64(keys)*0.1)
+	for _, n := range append(nodes, joined) {
+		assert.InDelta(t, keys*replicas/11, counts[n.ID], keys*replicas/11/2, "Virtual nodes keep the load balanced")
+	}
+}
+
+func TestSelectNodesForChunks_ConsistentHash(t *testing.T) {
+	ctx := context.Background()
+	nodes := ringNodes(6)
+	chunkService := NewChunkService(storage.NewMemoryStore(), staticNodes(nodes), nil)
+	chunkService.SetPlacement(PlacementConsistentHash, DefaultVirtualNodes)
+
+	key := ChunkPlacementKey(uuid.New(), 0)
+	first, err := chunkService.SelectNodesForChunks(ctx, key, 3)
+	assert.NoError(t, err)
+	assert.Len(t, first, 3)
+	again, err := chunkService.SelectNodesForChunks(ctx, key, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, first, again, "A chunk placed again lands on the same nodes")
+
+	// A node leaving only replaces itself; the other replicas stay put
+	var remaining staticNodes
+	for _, n := range nodes {
+		if n.ID != first[0].ID {
+			remaining = append(remaining, n)
+		}
+	}
+	chunkService = NewChunkService(storage.NewMemoryStore(), remaining, nil)
+	chunkService.SetPlacement(PlacementConsistentHash, DefaultVirtualNodes)
+	left, err := chunkService.SelectNodesForChunks(ctx, key, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, first[1:], left[:2])
+}
+
+func TestParsePlacement(t *testing.T) {
+	p, err := ParsePlacement("")
+	assert.NoError(t, err)
+	assert.Equal(t, PlacementReputation, p)
+	p, err = ParsePlacement("consistent-hash")
+	assert.NoError(t, err)
+	assert.Equal(t, PlacementConsistentHash, p)
+	_, err = ParsePlacement("random")
+	assert.Error(t, err)
+}
+
+func TestProofRetryAllowance(t *testing.T) {
+	assert.Equal(t, 5, proofRetryAllowance(5, 0))
+	assert.Equal(t, 2, proofRetryAllowance(5, 3))
+	assert.Equal(t, 0, proofRetryAllowance(5, 5))
+	assert.Equal(t, 0, proofRetryAllowance(5, 7), "Lowering the cap below what was used allows none")
+	assert.Equal(t, 0, proofRetryAllowance(0, 0))
+	assert.Equal(t, 0, proofRetryAllowance(-1, 0), "A negative cap disables retries")
+}
+
+func TestExcuseFailedProof(t *testing.T) {
+	now := time.Now()
+	snapshot := newReputationSnapshot(uuid.New(), 100, &now, 2, 2, now)
+	snapshot.Score = snapshotScore(snapshot)
+
+	excused := excuseFailedProof(snapshot)
+	assert.Equal(t, 3, excused.ProofsVerified)
+	assert.Equal(t, 1, excused.ProofsFailed)
+	assert.InDelta(t, 0.75, excused.ProofPassRate, 1e-9)
+	assert.Greater(t, excused.Score, snapshot.Score)
+
+	clean := excuseFailedProof(excuseFailedProof(excused))
+	assert.Equal(t, 0, clean.ProofsFailed)
+	assert.Equal(t, 4, clean.ProofsVerified, "Nothing is left to excuse once no failures remain")
+	assert.InDelta(t, 1.0, clean.ProofPassRate, 1e-9)
+}
+
+// TestProofService_RetryFailedProofs runs against a scratch database named by TEST_DATABASE_URL
+func TestProofService_RetryFailedProofs(t *testing.T) {
+	databaseURL := os.Getenv("TEST_DATABASE_URL")
+	if databaseURL == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	ctx := context.Background()
+	db, err := storage.New(databaseURL)
+	assert.NoError(t, err)
+	defer db.Close()
+	assert.NoError(t, db.Migrate("../../migrations"))
+
+	store := storage.NewPgStore(db)
+	user := &models.User{ID: uuid.New(), Email: uuid.NewString() + "@example.com"}
+	assert.NoError(t, store.CreateUser(ctx, user))
+	nodeService := NewNodeService(db, "")
+	node, _, err := nodeService.RegisterNode(ctx, RegisterNodeRequest{
+		Name: "retries", PeerID: "peer-" + uuid.NewString(), PublicKey: []byte("pk"), TotalStorageGB: 1,
+	})
+	assert.NoError(t, err)
+	file, err := NewFileService(store, 8, 100).CreateFile(ctx, user.ID, "retries.bin", 24, "", make([]byte, 32), DefaultCipher, 3)
+	assert.NoError(t, err)
+
+	service := NewProofService(db, 10, ProofTimeout{BaseMs: 1000}, nil, time.Minute)
+	service.SetProofRetries(time.Hour, 2)
+
+	// Fail a challenge on each of three chunks, and snapshot the damage
+	data := []byte("chunk data")
+	var held []uuid.UUID
+	for i := 0; i < 3; i++ {
+		chunk, err := NewChunkService(store, nil, nil).StoreChunk(ctx, file.ID, i, data, []uuid.UUID{node.ID})
+		assert.NoError(t, err)
+		held = append(held, chunk.ID)
+		challenge, err := service.CreateChallenge(ctx, chunk.ID, node.ID)
+		assert.NoError(t, err)
+		assert.Error(t, service.VerifyProof(ctx, challenge.ID, "wrong", 1, nil))
+	}
+	_, err = nodeService.RecordReputationSnapshots(ctx, time.Now().Add(-time.Hour))
+	assert.NoError(t, err)
+	history, err := nodeService.GetReputationHistory(ctx, node.ID, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, history[0].ProofsFailed)
+
+	// Only chunks the node still holds are retried, and no more than the cap
+	retries, err := service.ReissueFailedChallenges(ctx, node.ID, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, retries)
+	retries, err = service.ReissueFailedChallenges(ctx, node.ID, held)
+	assert.NoError(t, err)
+	assert.Len(t, retries, 2)
+	_, err = service.ReissueFailedChallenges(ctx, node.ID, held)
+	assert.ErrorIs(t, err, ErrProofRetryLimit)
+
+	// Retries the node asked for don't hold back the challenges it is due
+	service.SetMaxPendingPerNode(1)
+	_, err = service.CreateChallenge(ctx, held[0], node.ID)
+	assert.NoError(t, err)
+	_, err = service.CreateChallenge(ctx, held[0], node.ID)
+	assert.ErrorIs(t, err, ErrChallengeBacklog)
+	service.SetMaxPendingPerNode(0)
+
+	status := func(id uuid.UUID) string {
+		var s string
+		assert.NoError(t, db.Pool.QueryRow(ctx, "SELECT status FROM proof_challenges WHERE id = $1", id).Scan(&s))
+		return s
+	}
+
+	// A correct answer excuses the failure it retried
+	passed := retries[0]
+	block, path, err := merkle.Prove(data, passed.LeafIndex)
+	assert.NoError(t, err)
+	proof := &models.MerkleProof{LeafIndex: passed.LeafIndex, Block: block, Path: path}
+	assert.NoError(t, service.AnswerRetry(ctx, node.ID, passed.ChallengeID,
+		service.generateExpectedProof(passed.Seed, passed.ChunkID.String()), 1, proof))
+	assert.Equal(t, "excused", status(passed.RetryOf))
+	assert.Equal(t, "retry_passed", status(passed.ChallengeID))
+	err = service.AnswerRetry(ctx, node.ID, passed.ChallengeID, "again", 1, proof)
+	assert.ErrorIs(t, err, ErrUnknownRetry, "A retry is answered once")
+
+	// A wrong answer leaves the failure standing without adding another
+	failed := retries[1]
+	err = service.AnswerRetry(ctx, node.ID, failed.ChallengeID, "wrong", 1, nil)
+	assert.ErrorIs(t, err, ErrProofRetryFailed)
+	assert.Equal(t, "failed", status(failed.RetryOf))
+	assert.Equal(t, "retry_failed", status(failed.ChallengeID))
+
+	// The snapshot that counted the excused failure no longer does, and the score follows
+	history, err = nodeService.GetReputationHistory(ctx, node.ID, reputationWindow)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, history[0].ProofsFailed)
+	assert.Equal(t, 1, history[0].ProofsVerified)
+	rescored, err := nodeService.GetNodeByPeerID(ctx, node.PeerID)
+	assert.NoError(t, err)
+	assert.InDelta(t, ReputationScore(history), rescored.ReputationScore, 1e-9)
+
+	// A later snapshot doesn't count the retries themselves: the excused
+	// failure already became the pass
+	_, err = nodeService.RecordReputationSnapshots(ctx, time.Now().Add(-time.Hour))
+	assert.NoError(t, err)
+	history, err = nodeService.GetReputationHistory(ctx, node.ID, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, history[0].ProofsFailed)
+	assert.Equal(t, 0, history[0].ProofsVerified)
+}
+
+func TestForgiveMissedProofs(t *testing.T) {
+	pass := proofOutcome{ID: uuid.New(), Verified: true}
+	miss := func() proofOutcome { return proofOutcome{ID: uuid.New(), Missed: true} }
+	wrong := proofOutcome{ID: uuid.New()}
+
+	for _, tt := range []struct {
+		name         string
+		streak       int
+		grace        int
+		outcomes     []proofOutcome
+		wantVerified int
+		wantFailed   int
+		wantForgiven int
+	}{
+		{name: "isolated misses", grace: 2, outcomes: []proofOutcome{miss(), pass, miss(), miss(), pass, miss()},
+			wantVerified: 2, wantForgiven: 4},
+		{name: "sustained misses", grace: 2, outcomes: []proofOutcome{pass, miss(), miss(), miss(), miss()},
+			wantVerified: 1, wantFailed: 2, wantForgiven: 2},
+		{name: "streak carried in", streak: 2, grace: 2, outcomes: []proofOutcome{miss(), pass, miss()},
+			wantVerified: 1, wantFailed: 1, wantForgiven: 1},
+		{name: "wrong answers always count", grace: 2, outcomes: []proofOutcome{wrong, miss(), wrong},
+			wantFailed: 2, wantForgiven: 1},
+		{name: "no grace", outcomes: []proofOutcome{miss(), pass, miss()}, wantVerified: 1, wantFailed: 2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			verified, failed, forgiven := forgiveMissedProofs(tt.streak, tt.grace, tt.outcomes)
+			assert.Equal(t, tt.wantVerified, verified)
+			assert.Equal(t, tt.wantFailed, failed)
+			assert.Len(t, forgiven, tt.wantForgiven)
+		})
+	}
+}
+
+func TestDailyEarnings(t *testing.T) {
+	rates := EarningsRates{CreditsPerGBMonth: 30, MissedProofPenalty: 4}
+	gb := int64(1024 * 1024 * 1024)
+
+	storage, penalty, total := dailyEarnings(10*gb, 0, rates)
+	assert.Equal(t, int64(10), storage, "A month's rate is spread over 30 days")
+	assert.Zero(t, penalty)
+	assert.Equal(t, int64(10), total)
+
+	_, penalty, total = dailyEarnings(10*gb, 2, rates)
+	assert.Equal(t, int64(8), penalty)
+	assert.Equal(t, int64(2), total)
+
+	_, _, total = dailyEarnings(gb, 5, rates)
+	assert.Zero(t, total, "Penalties never take a day below nothing")
+	_, penalty, _ = dailyEarnings(gb, 5, EarningsRates{CreditsPerGBMonth: 30, MissedProofPenalty: -1})
+	assert.Zero(t, penalty, "A negative penalty withholds nothing")
+}
+
+// TestProofService_MissedProofGrace runs against a scratch database named by TEST_DATABASE_URL
+func TestProofService_MissedProofGrace(t *testing.T) {
+	databaseURL := os.Getenv("TEST_DATABASE_URL")
+	if databaseURL == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	ctx := context.Background()
+	db, err := storage.New(databaseURL)
+	assert.NoError(t, err)
+	defer db.Close()
+	assert.NoError(t, db.Migrate("../../migrations"))
+
+	store := storage.NewPgStore(db)
+	user := &models.User{ID: uuid.New(), Email: uuid.NewString() + "@example.com"}
+	assert.NoError(t, store.CreateUser(ctx, user))
+	nodeService := NewNodeService(db, "")
+	nodeService.SetEarningsRates(EarningsRates{CreditsPerGBMonth: 10, MissedProofPenalty: 3})
+	proofService := NewProofService(db, 10, ProofTimeout{BaseMs: 1000}, nil, time.Minute)
+	proofService.SetMissedProofGrace(2)
+	node, _, err := nodeService.RegisterNode(ctx, RegisterNodeRequest{
+		Name: "grace", PeerID: "peer-" + uuid.NewString(), PublicKey: []byte("pk"), TotalStorageGB: 1,
+	})
+	assert.NoError(t, err)
+	file, err := NewFileService(store, 8, 100).CreateFile(ctx, user.ID, "grace.bin", 8, "", make([]byte, 32), DefaultCipher, 3)
+	assert.NoError(t, err)
+	chunk, err := NewChunkService(store, nil, nil).StoreChunk(ctx, file.ID, 0, []byte("data"), []uuid.UUID{node.ID})
+	assert.NoError(t, err)
+
+	// Challenges issued long ago and never answered are missed on expiry
+	miss := func(n int) {
+		for i := 0; i < n; i++ {
+			_, err := db.Pool.Exec(ctx,
+				`INSERT INTO proof_challenges (chunk_id, node_id, seed, status, created_at) VALUES ($1, $2, 'seed', 'pending', NOW() - INTERVAL '2 hours')`,
+				chunk.ID, node.ID)
+			assert.NoError(t, err)
+		}
+		_, err := proofService.ExpireStaleChallenges(ctx, time.Hour)
+		assert.NoError(t, err)
+	}
+	counts := func() map[string]int {
+		rows, err := db.Pool.Query(ctx, "SELECT status, COUNT(*) FROM proof_challenges WHERE node_id = $1 GROUP BY status", node.ID)
+		assert.NoError(t, err)
+		defer rows.Close()
+		out := make(map[string]int)
+		for rows.Next() {
+			var status string
+			var n int
+			assert.NoError(t, rows.Scan(&status, &n))
+			out[status] = n
+		}
+		return out
+	}
+	start := time.Now()
+
+	// A blip costs two missed proofs, forgiven as soon as they are recorded
+	miss(2)
+	assert.Equal(t, map[string]int{"forgiven": 2}, counts())
+
+	// A pass resets the count; a sustained outage is penalized past the grace
+	_, err = db.Pool.Exec(ctx,
+		`INSERT INTO proof_challenges (chunk_id, node_id, seed, status, verified_at) VALUES ($1, $2, 'seed', 'verified', NOW())`,
+		chunk.ID, node.ID)
+	assert.NoError(t, err)
+	miss(2)
+	miss(1)
+	assert.Equal(t, map[string]int{"forgiven": 4, "verified": 1, "failed": 1}, counts(), "The third miss in a row counts")
+
+	// Everything counting proofs sees only the miss past the grace
+	_, err = nodeService.RecordReputationSnapshots(ctx, start.Add(-time.Minute))
+	assert.NoError(t, err)
+	history, err := nodeService.GetReputationHistory(ctx, node.ID, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, history[0].ProofsVerified)
+	assert.Equal(t, 1, history[0].ProofsFailed)
+	entries, err := nodeService.Leaderboard(ctx, start.Add(-time.Minute), 100000, true)
+	assert.NoError(t, err)
+	for _, e := range entries {
+		if e.NodeID == node.ID.String() {
+			assert.Equal(t, 1, e.ProofsFailed, "Forgiven misses are not failures on the leaderboard")
+		}
+	}
+
+	// The day's earnings lose the penalty for that one miss only
+	_, err = db.Pool.Exec(ctx, "UPDATE storage_nodes SET used_storage_bytes = $1 WHERE id = $2", int64(30)*1024*1024*1024, node.ID)
+	assert.NoError(t, err)
+	_, err = nodeService.RecordDailyEarnings(ctx, time.Now())
+	assert.NoError(t, err)
+	var storageCredits, penalty, total, earned int64
+	assert.NoError(t, db.Pool.QueryRow(ctx,
+		`SELECT e.storage_credits, e.missed_proof_penalty, e.total_earnings, sn.earned_credits
+		 FROM node_earnings e JOIN storage_nodes sn ON sn.id = e.node_id WHERE e.node_id = $1`,
+		node.ID).Scan(&storageCredits, &penalty, &total, &earned))
+	assert.Equal(t, int64(10), storageCredits)
+	assert.Equal(t, int64(3), penalty)
+	assert.Equal(t, int64(7), total)
+	assert.Equal(t, int64(7), earned)
+
+	// A day is credited once
+	_, err = nodeService.RecordDailyEarnings(ctx, time.Now())
+	assert.NoError(t, err)
+	assert.NoError(t, db.Pool.QueryRow(ctx, "SELECT earned_credits FROM storage_nodes WHERE id = $1", node.ID).Scan(&earned))
+	assert.Equal(t, int64(7), earned)
+}
+
+func TestWebhookMatches(t *testing.T) {
+	alice, bob := uuid.New(), uuid.New()
+	userHook := &models.Webhook{UserID: &alice, Events: []string{EventFileUploaded}}
+	operatorHook := &models.Webhook{Events: []string{EventFileDeleted, EventNodeOffline}}
+
+	assert.True(t, webhookMatches(userHook, EventFileUploaded, &alice))
+	assert.False(t, webhookMatches(userHook, EventFileUploaded, &bob), "Users only hear of their own files")
+	assert.False(t, webhookMatches(userHook, EventFileDeleted, &alice), "Only subscribed events match")
+	assert.False(t, webhookMatches(userHook, EventNodeOffline, nil))
+
+	assert.True(t, webhookMatches(operatorHook, EventFileDeleted, &bob), "Operator webhooks see every user's events")
+	assert.True(t, webhookMatches(operatorHook, EventNodeOffline, nil))
+	assert.False(t, webhookMatches(operatorHook, EventFileUploaded, &alice))
+
+	assert.NoError(t, ValidateWebhook("https://example.com/hook", []string{EventFileUploaded}, false))
+	assert.ErrorIs(t, ValidateWebhook("ftp://example.com", []string{EventFileUploaded}, false), ErrInvalidWebhook)
+	assert.ErrorIs(t, ValidateWebhook("https://example.com", []string{"file.renamed"}, false), ErrInvalidWebhook)
+	assert.ErrorIs(t, ValidateWebhook("https://example.com", []string{EventNodeOffline}, false), ErrInvalidWebhook,
+		"Node events are for the operator")
+	assert.NoError(t, ValidateWebhook("https://example.com", []string{EventNodeOffline}, true))
+}
+
+func TestSignWebhookPayload(t *testing.T) {
+	body := []byte(`{"event":"file.uploaded"}`)
+	sig := SignWebhookPayload("whsec_test", body)
+
+	mac := hmac.New(sha256.New, []byte("whsec_test"))
+	mac.Write(body)
+	assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), sig)
+	assert.NotEqual(t, sig, SignWebhookPayload("whsec_other", body), "The signature depends on the secret")
+	assert.NotEqual(t, sig, SignWebhookPayload("whsec_test", []byte(`{"event":"file.deleted"}`)))
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	assert.Equal(t, 30*time.Second, webhookBackoff(30*time.Second, 1))
+	assert.Equal(t, 60*time.Second, webhookBackoff(30*time.Second, 2))
+	assert.Equal(t, 4*time.Minute, webhookBackoff(30*time.Second, 4))
+	assert.Equal(t, time.Hour, webhookBackoff(30*time.Second, 40), "Backoff is capped")
+}
+
+func TestWebhookService_DeliversSignedAndRetries(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	service := NewWebhookService(store)
+	service.SetRetries(3, time.Minute)
+	service.AllowPrivateTargets(true) // the test server listens on loopback
+
+	var mu sync.Mutex
+	var bodies [][]byte
+	var signatures []string
+	failing := 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		bodies = append(bodies, body)
+		signatures = append(signatures, r.Header.Get(WebhookSignatureHeader))
+		if failing > 0 {
+			failing--
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	userID, stranger := uuid.New(), uuid.New()
+	hook, secret, err := service.Register(ctx, &userID, server.URL, []string{EventFileUploaded})
+	assert.NoError(t, err)
+	_, _, err = service.Register(ctx, &userID, server.URL, []string{EventFileDeleted})
+	assert.NoError(t, err)
+
+	assert.NoError(t, service.Notify(ctx, EventFileUploaded, &userID, FileEvent{FileID: uuid.New(), Filename: "a.txt"}))
+	assert.NoError(t, service.Notify(ctx, EventFileUploaded, &stranger, FileEvent{Filename: "other.txt"}))
+
+	// The one matching delivery fails at first and is held back for the backoff
+	now := time.Now()
+	report, err := service.DeliverDue(ctx, now, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, WebhookReport{Retrying: 1}, report)
+	report, err = service.DeliverDue(ctx, now.Add(30*time.Second), 10)
+	assert.NoError(t, err)
+	assert.Equal(t, WebhookReport{}, report, "Nothing is due before the backoff passes")
+
+	report, err = service.DeliverDue(ctx, now.Add(time.Minute), 10)
+	assert.NoError(t, err)
+	assert.Equal(t, WebhookReport{Delivered: 1}, report)
+
+	mu.Lock()
+	assert.Len(t, bodies, 2)
+	assert.Equal(t, bodies[0], bodies[1], "A retry resends the same payload")
+	assert.Equal(t, SignWebhookPayload(secret, bodies[1]), signatures[1])
+	var payload WebhookPayload
+	assert.NoError(t, json.Unmarshal(bodies[1], &payload))
+	assert.Equal(t, EventFileUploaded, payload.Event)
+	mu.Unlock()
+
+	// A delivery that keeps failing is given up after max attempts
+	mu.Lock()
+	failing = 100
+	mu.Unlock()
+	assert.NoError(t, service.Notify(ctx, EventFileUploaded, &userID, FileEvent{Filename: "b.txt"}))
+	at := now.Add(2 * time.Minute)
+	for i := 0; i < 2; i++ {
+		report, err = service.DeliverDue(ctx, at, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, WebhookReport{Retrying: 1}, report)
+		at = at.Add(time.Hour)
+	}
+	report, err = service.DeliverDue(ctx, at, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, WebhookReport{Failed: 1}, report)
+
+	// Deleting a webhook drops what is still queued for it
+	assert.NoError(t, service.Notify(ctx, EventFileUploaded, &userID, FileEvent{Filename: "c.txt"}))
+	assert.ErrorIs(t, service.Delete(ctx, hook.ID, &stranger), ErrWebhookNotFound, "Only the owner can delete")
+	assert.NoError(t, service.Delete(ctx, hook.ID, &userID))
+	report, err = service.DeliverDue(ctx, at.Add(time.Hour), 10)
+	assert.NoError(t, err)
+	assert.Equal(t, WebhookReport{}, report)
+}
+
+func TestWebhookService_RefusesInternalTargets(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1", "10.1.2.3", "192.168.0.1", "169.254.169.254", "100.64.0.1", "0.0.0.0", "::1", "fd00:ec2::254", "fe80::1", "::ffff:127.0.0.1"} {
+		assert.False(t, isPublicAddr(netip.MustParseAddr(addr)), addr)
+	}
+	for _, addr := range []string{"93.184.216.34", "2606:2800:220:1::1"} {
+		assert.True(t, isPublicAddr(netip.MustParseAddr(addr)), addr)
+	}
+
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	service := NewWebhookService(store)
+	service.SetRetries(1, time.Minute)
+
+	var internalHits atomic.Int32
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		internalHits.Add(1)
+	}))
+	defer internal.Close()
+	redirect := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, internal.URL, http.StatusTemporaryRedirect)
+	}))
+	defer redirect.Close()
+
+	userID := uuid.New()
+	_, _, err := service.Register(ctx, &userID, internal.URL, []string{EventFileUploaded})
+	assert.NoError(t, err)
+	assert.NoError(t, service.Notify(ctx, EventFileUploaded, &userID, FileEvent{Filename: "a.txt"}))
+	report, err := service.DeliverDue(ctx, time.Now(), 10)
+	assert.NoError(t, err)
+	assert.Equal(t, WebhookReport{Failed: 1}, report, "A loopback target is refused at dial time")
+	assert.Zero(t, internalHits.Load())
+
+	// Even where private targets are allowed, a redirect is not followed
+	service.AllowPrivateTargets(true)
+	hooks, err := service.List(ctx, &userID)
+	assert.NoError(t, err)
+	assert.NoError(t, service.Delete(ctx, hooks[0].ID, &userID))
+	_, _, err = service.Register(ctx, &userID, redirect.URL, []string{EventFileUploaded})
+	assert.NoError(t, err)
+	assert.NoError(t, service.Notify(ctx, EventFileUploaded, &userID, FileEvent{Filename: "b.txt"}))
+	report, err = service.DeliverDue(ctx, time.Now(), 10)
+	assert.NoError(t, err)
+	assert.Equal(t, WebhookReport{Failed: 1}, report)
+	assert.Zero(t, internalHits.Load(), "The redirect's target is never contacted")
+}
+
+func TestWebhookService_CapsWebhooksAndPrunesDeliveries(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	service := NewWebhookService(store)
+	service.SetLimits(2, time.Hour)
+
+	userID, other := uuid.New(), uuid.New()
+	for i := 0; i < 2; i++ {
+		_, _, err := service.Register(ctx, &userID, "https://example.com/hook", []string{EventFileUploaded})
+		assert.NoError(t, err)
+	}
+	_, _, err := service.Register(ctx, &userID, "https://example.com/hook", []string{EventFileUploaded})
+	assert.ErrorIs(t, err, ErrWebhookLimit)
+	_, _, err = service.Register(ctx, &other, "https://example.com/hook", []string{EventFileUploaded})
+	assert.NoError(t, err, "The cap is per user")
+	_, _, err = service.Register(ctx, nil, "https://example.com/hook", []string{EventFileUploaded})
+	assert.NoError(t, err, "Operator webhooks are not capped")
+
+	assert.NoError(t, service.Notify(ctx, EventFileUploaded, &other, FileEvent{Filename: "a.txt"}))
+	due, err := store.ListDueWebhookDeliveries(ctx, time.Now(), 10)
+	assert.NoError(t, err)
+	assert.Len(t, due, 2)
+	due[0].Status = "delivered"
+	assert.NoError(t, store.UpdateWebhookDelivery(ctx, &due[0]))
+
+	pruned, err := service.PruneDeliveries(ctx, time.Now())
+	assert.NoError(t, err)
+	assert.Zero(t, pruned, "Deliveries are kept for the retention")
+	pruned, err = service.PruneDeliveries(ctx, time.Now().Add(2*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), pruned, "Only the settled delivery goes")
+	due, err = store.ListDueWebhookDeliveries(ctx, time.Now(), 10)
+	assert.NoError(t, err)
+	assert.Len(t, due, 1, "The pending delivery stays")
+}
+
+func TestFileService_NotifiesWebhooks(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	webhooks := NewWebhookService(store)
+	fileService := NewFileService(store, 1024, 100)
+	fileService.SetWebhooks(webhooks)
+
+	userID := uuid.New()
+	_, _, err := webhooks.Register(ctx, &userID, "https://example.com/hook", []string{EventFileUploaded, EventFileDeleted})
+	assert.NoError(t, err)
+	queued := func() []string {
+		due, err := store.ListDueWebhookDeliveries(ctx, time.Now(), 100)
+		assert.NoError(t, err)
+		var events []string
+		for _, d := range due {
+			events = append(events, d.Event)
+		}
+		return events
+	}
+
+	// An upload abandoned before completing comes and goes unannounced
+	abandoned, err := fileService.CreateFile(ctx, userID, "draft.txt", 0, "", nil, DefaultCipher, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fileService.DeleteFile(ctx, abandoned.ID))
+	assert.Empty(t, queued())
+
+	file, err := fileService.CreateFile(ctx, userID, "a.txt", 0, "", nil, DefaultCipher, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fileService.MarkFileComplete(ctx, file.ID))
+	assert.Equal(t, []string{EventFileUploaded}, queued())
+	assert.NoError(t, fileService.DeleteFile(ctx, file.ID))
+	assert.ElementsMatch(t, []string{EventFileUploaded, EventFileDeleted}, queued())
+}
+
+func TestJudgeProof(t *testing.T) {
+	service := &ProofService{}
+	data := make([]byte, 3*merkle.BlockSize)
+	challenge := issuedChallenge{
+		ProofChallenge: models.ProofChallenge{ID: uuid.New(), ChunkID: uuid.New(), Seed: []byte("seed"), TimeoutMs: 100},
+		MerkleRoot:     hex.EncodeToString(merkle.Root(data)),
+		SizeBytes:      len(data),
+	}
+	expected := service.generateExpectedProof(challenge.Seed, challenge.ChunkID.String())
+	leaf := challengeLeaf(challenge.MerkleRoot, challenge.SizeBytes, challenge.Seed)
+	block, path, err := merkle.Prove(data, leaf)
+	assert.NoError(t, err)
+	proof := &models.MerkleProof{LeafIndex: leaf, Block: block, Path: path}
+
+	verdict := service.judgeProof(challenge, ProofResponse{ChallengeID: challenge.ID, ProofHash: expected, DurationMs: 50, MerkleProof: proof})
+	assert.Equal(t, "verified", verdict.Status)
+	assert.NoError(t, verdict.Err)
+	assert.Equal(t, expected, *verdict.ProofHash)
+
+	verdict = service.judgeProof(challenge, ProofResponse{ProofHash: expected, DurationMs: 150, MerkleProof: proof})
+	assert.Equal(t, "failed", verdict.Status)
+	assert.ErrorIs(t, verdict.Err, ErrProofTimedOut)
+	assert.Nil(t, verdict.ProofHash, "A late proof is recorded as missed")
+
+	verdict = service.judgeProof(challenge, ProofResponse{ProofHash: expected, DurationMs: 50})
+	assert.Equal(t, "failed", verdict.Status)
+	assert.ErrorIs(t, verdict.Err, ErrInvalidMerkleProof)
+
+	verdict = service.judgeProof(challenge, ProofResponse{ProofHash: strings.Repeat("f", 100), DurationMs: 50, MerkleProof: proof})
+	assert.Equal(t, "failed", verdict.Status)
+	assert.Len(t, *verdict.ProofHash, 64, "An oversized answer is cut to fit its column")
+}
+
+// proofAnswers answers each chunk's challenges with a fixed hash, or fails to
+// reach the node when none is set
+type proofAnswers map[string]string
+
+func (a proofAnswers) SendProofChallenge(ctx context.Context, peerID, chunkID string, seed []byte, difficulty, leafIndex int) (string, int, *models.MerkleProof, error) {
+	hash, ok := a[chunkID]
+	if !ok {
+		return "", 0, nil, fmt.Errorf("node unreachable")
+	}
+	if hash == "" {
+		hash = (&ProofService{}).generateExpectedProof(seed, chunkID)
+	}
+	return hash, 1, nil, nil
+}
+
+// TestProofService_VerifyProofsBatch runs against a scratch database named by TEST_DATABASE_URL
+func TestProofService_VerifyProofsBatch(t *testing.T) {
+	databaseURL := os.Getenv("TEST_DATABASE_URL")
+	if databaseURL == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	ctx := context.Background()
+	db, err := storage.New(databaseURL)
+	assert.NoError(t, err)
+	defer db.Close()
+	assert.NoError(t, db.Migrate("../../migrations"))
+
+	store := storage.NewPgStore(db)
+	user := &models.User{ID: uuid.New(), Email: uuid.NewString() + "@example.com"}
+	assert.NoError(t, store.CreateUser(ctx, user))
+	node, _, err := NewNodeService(db, "").RegisterNode(ctx, RegisterNodeRequest{
+		Name: "batch", PeerID: "peer-" + uuid.NewString(), PublicKey: []byte("pk"), TotalStorageGB: 1,
+	})
+	assert.NoError(t, err)
+	file, err := NewFileService(store, 8, 100).CreateFile(ctx, user.ID, "batch.bin", 32, "", make([]byte, 32), DefaultCipher, 4)
+	assert.NoError(t, err)
+	// Chunks without a Merkle root are judged on their hash alone
+	var chunks []*models.Chunk
+	for i := 0; i < 4; i++ {
+		chunk, err := NewChunkService(store, nil, nil).StoreChunk(ctx, file.ID, i, []byte("data"), []uuid.UUID{node.ID})
+		assert.NoError(t, err)
+		chunks = append(chunks, chunk)
+	}
+	_, err = db.Pool.Exec(ctx, "UPDATE chunks SET merkle_root = NULL WHERE file_id = $1", file.ID)
+	assert.NoError(t, err)
+
+	service := NewProofService(db, 10, ProofTimeout{BaseMs: 1000}, nil, time.Minute)
+	var challenges []*models.ProofChallenge
+	for _, chunk := range chunks {
+		challenge, err := service.CreateChallenge(ctx, chunk.ID, node.ID)
+		assert.NoError(t, err)
+		challenges = append(challenges, challenge)
+	}
+	type row struct {
+		Status    string
+		ProofHash *string
+		Duration  int
+	}
+	read := func(id uuid.UUID) row {
+		var r row
+		assert.NoError(t, db.Pool.QueryRow(ctx,
+			"SELECT status, proof_hash, COALESCE(duration_ms, 0) FROM proof_challenges WHERE id = $1", id).Scan(&r.Status, &r.ProofHash, &r.Duration))
+		return r
+	}
+
+	pass := service.generateExpectedProof(challenges[0].Seed, challenges[0].ChunkID.String())
+	results, err := service.VerifyProofs(ctx, []ProofResponse{
+		{ChallengeID: challenges[0].ID, ProofHash: pass, DurationMs: 10},
+		{ChallengeID: challenges[1].ID, ProofHash: "wrong", DurationMs: 20},
+		{ChallengeID: challenges[2].ID, ProofHash: pass, DurationMs: 5000},
+		{ChallengeID: uuid.New(), ProofHash: pass, DurationMs: 10},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, results, 4)
+	assert.NoError(t, results[0])
+	assert.Error(t, results[1])
+	assert.ErrorIs(t, results[2], ErrProofTimedOut)
+	assert.Error(t, results[3], "An unknown challenge is reported")
+
+	assert.Equal(t, row{"verified", &pass, 10}, read(challenges[0].ID))
+	wrong := "wrong"
+	assert.Equal(t, row{"failed", &wrong, 20}, read(challenges[1].ID))
+	assert.Equal(t, row{"failed", nil, 5000}, read(challenges[2].ID), "A late proof is recorded as missed")
+	assert.Equal(t, "pending", read(challenges[3].ID).Status, "Challenges not in the batch are untouched")
+
+	// An answer arriving after its challenge was decided leaves the verdict alone
+	late := service.generateExpectedProof(challenges[1].Seed, challenges[1].ChunkID.String())
+	results, err = service.VerifyProofs(ctx, []ProofResponse{{ChallengeID: challenges[1].ID, ProofHash: late, DurationMs: 10}})
+	assert.NoError(t, err)
+	assert.ErrorIs(t, results[0], ErrChallengeDecided)
+	assert.Equal(t, row{"failed", &wrong, 20}, read(challenges[1].ID))
+
+	// A challenge another verifier claimed is not sent again
+	claimed, err := service.claimChallenge(ctx, challenges[3].ID)
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+	claimed, err = service.claimChallenge(ctx, challenges[3].ID)
+	assert.NoError(t, err)
+	assert.False(t, claimed, "A challenge is claimed once")
+	_, err = NewProofService(db, 10, ProofTimeout{BaseMs: 1000}, proofAnswers{chunks[3].ID.String(): ""}, time.Minute).VerifyPendingChallenges(ctx, 10000)
+	assert.NoError(t, err)
+	assert.Equal(t, "dispatched", read(challenges[3].ID).Status)
+	assert.NoError(t, service.releaseChallenges(ctx, []uuid.UUID{challenges[3].ID}))
+
+	// The background pass sends what is still pending and records it the same way
+	service = NewProofService(db, 10, ProofTimeout{BaseMs: 1000}, proofAnswers{}, time.Minute)
+	result, err := service.VerifyPendingChallenges(ctx, 10000)
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, result.Undelivered, 1)
+	assert.Equal(t, "pending", read(challenges[3].ID).Status, "An unreachable node's challenge stays pending")
+
+	service = NewProofService(db, 10, ProofTimeout{BaseMs: 1000}, proofAnswers{chunks[3].ID.String(): ""}, time.Minute)
+	_, err = service.VerifyPendingChallenges(ctx, 10000)
+	assert.NoError(t, err)
+	assert.Equal(t, "verified", read(challenges[3].ID).Status)
+}
+
+// BenchmarkVerifyProofs compares recording a pass's verdicts one proof at a
+// time with recording them as one batch. It runs against the scratch
+// database named by TEST_DATABASE_URL:
+//
+//	TEST_DATABASE_URL=... go test -run '^$' -bench VerifyProofs ./internal/services
+func BenchmarkVerifyProofs(b *testing.B) {
+	databaseURL := os.Getenv("TEST_DATABASE_URL")
+	if databaseURL == "" {
+		b.Skip("TEST_DATABASE_URL not set")
+	}
+	const proofs = 500
+	ctx := context.Background()
+	db, err := storage.New(databaseURL)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Migrate("../../migrations"); err != nil {
+		b.Fatal(err)
+	}
+
+	store := storage.NewPgStore(db)
+	user := &models.User{ID: uuid.New(), Email: uuid.NewString() + "@example.com"}
+	if err := store.CreateUser(ctx, user); err != nil {
+		b.Fatal(err)
+	}
+	node, _, err := NewNodeService(db, "").RegisterNode(ctx, RegisterNodeRequest{
+		Name: "bench", PeerID: "peer-" + uuid.NewString(), PublicKey: []byte("pk"), TotalStorageGB: 1,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	file, err := NewFileService(store, 8, 100).CreateFile(ctx, user.ID, "bench.bin", 4*proofs, "", make([]byte, 32), DefaultCipher, proofs)
+	if err != nil {
+		b.Fatal(err)
+	}
+	service := NewProofService(db, 10, ProofTimeout{BaseMs: 1000}, nil, time.Minute)
+	var ids []uuid.UUID
+	var responses []ProofResponse
+	for i := 0; i < proofs; i++ {
+		chunk, err := NewChunkService(store, nil, nil).StoreChunk(ctx, file.ID, i, []byte("data"), []uuid.UUID{node.ID})
+		if err != nil {
+			b.Fatal(err)
+		}
+		challenge, err := service.CreateChallenge(ctx, chunk.ID, node.ID)
+		if err != nil {
+			b.Fatal(err)
+		}
+		ids = append(ids, challenge.ID)
+		responses = append(responses, ProofResponse{
+			ChallengeID: challenge.ID, ProofHash: service.generateExpectedProof(challenge.Seed, chunk.ID.String()), DurationMs: 10,
+		})
+	}
+	if _, err := db.Pool.Exec(ctx, "UPDATE chunks SET merkle_root = NULL WHERE file_id = $1", file.ID); err != nil {
+		b.Fatal(err)
+	}
+	reopen := func(b *testing.B) {
+		b.StopTimer()
+		defer b.StartTimer()
+		if _, err := db.Pool.Exec(ctx, "UPDATE proof_challenges SET status = 'pending' WHERE id = ANY($1)", ids); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.Run("one at a time", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			reopen(b)
+			for _, resp := range responses {
+				if err := service.VerifyProof(ctx, resp.ChallengeID, resp.ProofHash, resp.DurationMs, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+		b.ReportMetric(float64(b.Elapsed().Microseconds())/float64(b.N*proofs), "µs/proof")
+	})
+	b.Run("batched", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			reopen(b)
+			if _, err := service.VerifyProofs(ctx, responses); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(b.Elapsed().Microseconds())/float64(b.N*proofs), "µs/proof")
+	})
+}
+
+func TestSampleChunkIndices(t *testing.T) {
+	seed := []byte("sample-seed")
+	sampled := SampleChunkIndices(seed, 100, 10)
+	assert.Len(t, sampled, 10)
+	assert.Equal(t, sampled, SampleChunkIndices(seed, 100, 10), "The seed alone decides the sample")
+	assert.NotEqual(t, sampled, SampleChunkIndices([]byte("other-seed"), 100, 10))
+	seen := make(map[int]bool)
+	for i, index := range sampled {
+		assert.True(t, index >= 0 && index < 100, "index %d in range", index)
+		assert.False(t, seen[index], "index %d sampled twice", index)
+		seen[index] = true
+		if i > 0 {
+			assert.Less(t, sampled[i-1], index, "Indices are ascending")
+		}
+	}
+
+	assert.Equal(t, []int{0, 1, 2}, SampleChunkIndices(seed, 3, 10), "k is capped at the chunk count")
+	assert.Empty(t, SampleChunkIndices(seed, 0, 3))
+	assert.Empty(t, SampleChunkIndices(seed, 5, 0))
+
+	// Over many seeds every chunk gets sampled about equally often
+	counts := make([]int, 10)
+	for i := 0; i < 2000; i++ {
+		for _, index := range SampleChunkIndices([]byte(fmt.Sprintf("seed-%d", i)), 10, 3) {
+			counts[index]++
+		}
+	}
+	for index, count := range counts {
+		assert.InDelta(t, 600, count, 120, "chunk %d", index)
+	}
+}
+
+func TestAggregateProof(t *testing.T) {
+	seed := []byte("aggregate-seed")
+	chunks := [][]byte{[]byte("first chunk"), []byte("second chunk"), []byte("third chunk")}
+	proof := AggregateProof(seed, chunks)
+	assert.Len(t, proof, 64)
+	assert.Equal(t, proof, AggregateProof(seed, chunks))
+
+	assert.NotEqual(t, proof, AggregateProof([]byte("other-seed"), chunks), "A proof is bound to its seed")
+	assert.NotEqual(t, proof, AggregateProof(seed, [][]byte{chunks[1], chunks[0], chunks[2]}), "Order matters")
+	assert.NotEqual(t, proof, AggregateProof(seed, chunks[:2]), "Every chunk counts")
+	altered := [][]byte{chunks[0], []byte("second chunK"), chunks[2]}
+	assert.NotEqual(t, proof, AggregateProof(seed, altered), "Every byte counts")
+}
+
+// TestProofService_FileChallenge runs against the scratch database named by TEST_DATABASE_URL
+func TestProofService_FileChallenge(t *testing.T) {
+	databaseURL := os.Getenv("TEST_DATABASE_URL")
+	if databaseURL == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	ctx := context.Background()
+	db, err := storage.New(databaseURL)
+	assert.NoError(t, err)
+	defer db.Close()
+	assert.NoError(t, db.Migrate("../../migrations"))
+
+	nodeService := NewNodeService(db, "")
+	var nodeIDs []uuid.UUID
+	for i := 0; i < 2; i++ {
+		node, _, err := nodeService.RegisterNode(ctx, RegisterNodeRequest{
+			Name: "aggregate", PeerID: "peer-" + uuid.NewString(), PublicKey: []byte("pk"), TotalStorageGB: 1,
+		})
+		assert.NoError(t, err)
+		nodeIDs = append(nodeIDs, node.ID)
+	}
+
+	store := storage.NewPgStore(db)
+	user := &models.User{ID: uuid.New(), Email: uuid.NewString() + "@example.com"}
+	assert.NoError(t, store.CreateUser(ctx, user))
+	file, err := NewFileService(store, 8, 100).CreateFile(ctx, user.ID, "aggregate.bin", 80, "", make([]byte, 32), DefaultCipher, 10)
+	assert.NoError(t, err)
+	chunks := NewChunkService(store, nil, nil)
+	data := make(map[uuid.UUID][]byte)
+	for i := 0; i < 10; i++ {
+		content := []byte(fmt.Sprintf("chunk %d", i))
+		chunk, err := chunks.StoreChunk(ctx, file.ID, i, content, nodeIDs[:1])
+		assert.NoError(t, err)
+		data[chunk.ID] = content
+	}
+
+	proofs := NewProofService(db, 10, ProofTimeout{BaseMs: 1000, MsPerRound: 1}, nil, time.Minute)
+	_, err = proofs.CreateFileChallenge(ctx, file.ID, nodeIDs[1], 3)
+	assert.ErrorIs(t, err, ErrNoChallengeableChunks, "The second node holds none of the file")
+
+	answer := func(challenge *models.FileChallenge) string {
+		held := make([][]byte, len(challenge.ChunkIDs))
+		for i, id := range challenge.ChunkIDs {
+			held[i] = data[id]
+		}
+		return AggregateProof(challenge.Seed, held)
+	}
+
+	challenge, err := proofs.CreateFileChallenge(ctx, file.ID, nodeIDs[0], 3)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, challenge.ChunkIDs, 3)
+	assert.Equal(t, 1000+30, challenge.TimeoutMs, "Each sampled chunk adds its rounds")
+	assert.NoError(t, proofs.VerifyFileChallenge(ctx, challenge.ID, answer(challenge), 50*time.Millisecond))
+	assert.ErrorIs(t, proofs.VerifyFileChallenge(ctx, challenge.ID, answer(challenge), 50*time.Millisecond), ErrChallengeNotPending,
+		"A challenge is answered once")
+
+	// A node missing one sampled chunk can't produce the proof
+	challenge, err = proofs.CreateFileChallenge(ctx, file.ID, nodeIDs[0], 3)
+	assert.NoError(t, err)
+	data[challenge.ChunkIDs[1]] = []byte("lost")
+	assert.Error(t, proofs.VerifyFileChallenge(ctx, challenge.ID, answer(challenge), 50*time.Millisecond))
+	var status string
+	assert.NoError(t, db.Pool.QueryRow(ctx, "SELECT status FROM file_challenges WHERE id = $1", challenge.ID).Scan(&status))
+	assert.Equal(t, "failed", status)
+
+	// Nor can a slow one
+	challenge, err = proofs.CreateFileChallenge(ctx, file.ID, nodeIDs[0], 20)
+	assert.NoError(t, err)
+	assert.Len(t, challenge.ChunkIDs, 10, "k is capped at the chunks held")
+	assert.ErrorIs(t, proofs.VerifyFileChallenge(ctx, challenge.ID, "", 5*time.Second), ErrProofTimedOut)
+
+	// ProveFile sends the challenge and judges the answer by its own clock
+	prover := &fakeFileProver{answer: func(seed []byte, chunkIDs []string) string {
+		held := make([][]byte, len(chunkIDs))
+		for i, id := range chunkIDs {
+			_, held[i], _ = store.GetChunk(ctx, uuid.MustParse(id))
+		}
+		return AggregateProof(seed, held)
+	}}
+	result, err := proofs.ProveFile(ctx, prover, file.ID, nodeIDs[0], 3)
+	if assert.NoError(t, err) {
+		assert.True(t, result.Verified, result.Error)
+		assert.Equal(t, 3, result.Chunks)
+	}
+	prover.took = 5 * time.Second
+	result, err = proofs.ProveFile(ctx, prover, file.ID, nodeIDs[0], 3)
+	if assert.NoError(t, err) {
+		assert.False(t, result.Verified, "A node's own report of its speed is never asked for")
+		assert.Contains(t, result.Error, ErrProofTimedOut.Error())
+	}
+	prover.err = fmt.Errorf("unreachable")
+	_, err = proofs.ProveFile(ctx, prover, file.ID, nodeIDs[0], 3)
+	assert.Error(t, err)
+	assert.NoError(t, db.Pool.QueryRow(ctx,
+		"SELECT status FROM file_challenges WHERE node_id = $1 ORDER BY created_at DESC LIMIT 1", nodeIDs[0]).Scan(&status))
+	assert.Equal(t, "undelivered", status, "A challenge that never reached the node counts nowhere")
+
+	// Unanswered challenges expire like any other
+	challenge, err = proofs.CreateFileChallenge(ctx, file.ID, nodeIDs[0], 3)
+	assert.NoError(t, err)
+	_, err = db.Pool.Exec(ctx, "UPDATE file_challenges SET created_at = created_at - interval '2 hours' WHERE id = $1", challenge.ID)
+	assert.NoError(t, err)
+	expired, err := proofs.ExpireStaleChallenges(ctx, time.Hour)
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, expired, int64(1))
+	assert.ErrorIs(t, proofs.VerifyFileChallenge(ctx, challenge.ID, answer(challenge), time.Millisecond), ErrChallengeNotPending)
+}
+
+// fakeFileProver answers file challenges with answer, taking took
+type fakeFileProver struct {
+	answer func(seed []byte, chunkIDs []string) string
+	took   time.Duration
+	err    error
+}
+
+func (p *fakeFileProver) SendFileChallenge(ctx context.Context, peerID string, seed []byte, chunkIDs []string) (string, string, time.Duration, error) {
+	if p.err != nil {
+		return "", "", 0, p.err
+	}
+	return p.answer(seed, chunkIDs), "", p.took, nil
+}
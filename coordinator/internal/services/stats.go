@@ -0,0 +1,71 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// statsProofWindow is how far back proofs count toward the network's proof success rate
+const statsProofWindow = 30 * 24 * time.Hour
+
+// NetworkStats is an aggregate view of the network's health, the data
+// behind a network dashboard
+type NetworkStats struct {
+	ActiveNodes      int     `json:"active_nodes"`   // active nodes heard from within the offline threshold
+	CapacityBytes    int64   `json:"capacity_bytes"` // storage offered by active nodes
+	UsedBytes        int64   `json:"used_bytes"`     // storage active nodes report in use
+	Files            int     `json:"files"`          // ready files
+	Chunks           int     `json:"chunks"`         // chunks of ready files
+	ManagedBytes     int64   `json:"managed_bytes"`  // total size of ready files
+	ProofsVerified   int     `json:"proofs_verified"`
+	ProofsFailed     int     `json:"proofs_failed"`
+	ProofSuccessRate float64 `json:"proof_success_rate"` // over proofs decided in the last 30 days
+}
+
+// proofSuccessRate is the share of decided proofs that passed. As in
+// reputation snapshots, no decided proofs is a perfect record.
+func proofSuccessRate(verified, failed int) float64 {
+	if verified+failed == 0 {
+		return 1.0
+	}
+	return float64(verified) / float64(verified+failed)
+}
+
+// NetworkStats aggregates node capacity, stored files and recent proof
+// outcomes across the whole network. Like file locations, it leaves out
+// active nodes that have gone quiet for longer than the offline threshold.
+func (s *NodeService) NetworkStats(ctx context.Context) (*NetworkStats, error) {
+	var stats NetworkStats
+	var heardSince *time.Time
+	if s.offlineAfter > 0 {
+		since := time.Now().Add(-s.offlineAfter)
+		heardSince = &since
+	}
+	err := s.db.Pool.QueryRow(ctx,
+		`SELECT COUNT(*), COALESCE(SUM(total_storage_bytes), 0), COALESCE(SUM(used_storage_bytes), 0)
+		 FROM storage_nodes
+		 WHERE status = 'active' AND ($1::timestamptz IS NULL OR last_heartbeat IS NULL OR last_heartbeat >= $1)`,
+		heardSince).Scan(&stats.ActiveNodes, &stats.CapacityBytes, &stats.UsedBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to aggregate nodes: %w", err)
+	}
+
+	err = s.db.Pool.QueryRow(ctx,
+		`SELECT COUNT(*), COALESCE(SUM(size_bytes), 0),
+		 (SELECT COUNT(*) FROM chunks c JOIN files f ON f.id = c.file_id WHERE f.status = 'ready')
+		 FROM files WHERE status = 'ready'`).Scan(&stats.Files, &stats.ManagedBytes, &stats.Chunks)
+	if err != nil {
+		return nil, fmt.Errorf("failed to aggregate files: %w", err)
+	}
+
+	err = s.db.Pool.QueryRow(ctx,
+		`SELECT COUNT(*) FILTER (WHERE status = 'verified'), COUNT(*) FILTER (WHERE status = 'failed')
+		 FROM proof_challenges WHERE verified_at >= $1`,
+		time.Now().Add(-statsProofWindow)).Scan(&stats.ProofsVerified, &stats.ProofsFailed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to aggregate proofs: %w", err)
+	}
+	stats.ProofSuccessRate = proofSuccessRate(stats.ProofsVerified, stats.ProofsFailed)
+	return &stats, nil
+}
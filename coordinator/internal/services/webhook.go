@@ -0,0 +1,440 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"syscall"
+	"time"
+
+	"github.com/federated-storage/coordinator/internal/models"
+	"github.com/federated-storage/coordinator/internal/storage"
+	"github.com/google/uuid"
+)
+
+// Events a webhook can subscribe to
+const (
+	EventFileUploaded = "file.uploaded" // an upload completed and the file is ready
+	EventFileDeleted  = "file.deleted"  // a ready file was deleted or expired
+	EventNodeOffline  = "node.offline"  // a node stopped sending heartbeats; operator webhooks only
+)
+
+// WebhookEvents lists every event, in the order they are documented
+var WebhookEvents = []string{EventFileUploaded, EventFileDeleted, EventNodeOffline}
+
+// Headers sent with every webhook delivery
+const (
+	WebhookEventHeader     = "X-Webhook-Event"
+	WebhookDeliveryHeader  = "X-Webhook-Delivery"
+	WebhookSignatureHeader = "X-Webhook-Signature"
+)
+
+const (
+	// DefaultWebhookMaxAttempts is how often a delivery is tried before it is given up
+	DefaultWebhookMaxAttempts = 8
+	// DefaultWebhookBackoff is the wait after the first failed attempt; it doubles after each one
+	DefaultWebhookBackoff = 30 * time.Second
+	// DefaultMaxWebhooksPerUser is how many webhooks a user may register
+	DefaultMaxWebhooksPerUser = 10
+	// DefaultWebhookRetention is how long delivered and given-up deliveries are kept
+	DefaultWebhookRetention = 30 * 24 * time.Hour
+
+	maxWebhookBackoff = time.Hour
+	webhookTimeout    = 10 * time.Second
+)
+
+// ErrInvalidWebhook is returned when a webhook's URL or events are unusable
+var ErrInvalidWebhook = errors.New("invalid webhook")
+
+// ErrWebhookNotFound is returned when a webhook does not exist or belongs to someone else
+var ErrWebhookNotFound = errors.New("webhook not found")
+
+// ErrWebhookLimit is returned when a user already has as many webhooks as allowed
+var ErrWebhookLimit = errors.New("webhook limit reached")
+
+// errWebhookTarget is returned when a delivery would connect to an address
+// that is not on the public internet
+var errWebhookTarget = errors.New("webhook target not allowed")
+
+// nonPublicPrefixes are ranges outside the public internet that
+// netip.Addr's predicates don't cover
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"), // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+}
+
+// WebhookPayload is the JSON body POSTed to a webhook
+type WebhookPayload struct {
+	ID        uuid.UUID   `json:"id"` // the same for every webhook notified of the event
+	Event     string      `json:"event"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+// FileEvent is the data of file.* events
+type FileEvent struct {
+	FileID    uuid.UUID `json:"file_id"`
+	UserID    uuid.UUID `json:"user_id"`
+	Filename  string    `json:"filename"`
+	SizeBytes int64     `json:"size_bytes"`
+	Reason    string    `json:"reason,omitempty"` // for file.deleted: "deleted" or "expired"
+}
+
+// NodeEvent is the data of node.* events
+type NodeEvent struct {
+	NodeID        uuid.UUID  `json:"node_id"`
+	PeerID        string     `json:"peer_id"`
+	Name          string     `json:"name"`
+	LastHeartbeat *time.Time `json:"last_heartbeat"`
+}
+
+// WebhookReport summarizes a delivery pass
+type WebhookReport struct {
+	Delivered int
+	Retrying  int // failed attempts that will be tried again
+	Failed    int // deliveries that ran out of attempts
+}
+
+// WebhookService registers webhooks, queues a delivery for every webhook
+// subscribed to an event, and POSTs queued deliveries, retrying failures
+// with exponential backoff
+type WebhookService struct {
+	store       storage.Store
+	client      *http.Client
+	maxAttempts int
+	backoff     time.Duration
+	maxPerUser  int           // 0 or less means unlimited
+	retention   time.Duration // 0 or less keeps deliveries forever
+}
+
+// NewWebhookService creates a new webhook service. Deliveries only go to
+// public addresses unless AllowPrivateTargets says otherwise.
+func NewWebhookService(store storage.Store) *WebhookService {
+	return &WebhookService{
+		store:       store,
+		client:      newWebhookClient(false),
+		maxAttempts: DefaultWebhookMaxAttempts,
+		backoff:     DefaultWebhookBackoff,
+		maxPerUser:  DefaultMaxWebhooksPerUser,
+		retention:   DefaultWebhookRetention,
+	}
+}
+
+// newWebhookClient returns the client deliveries are POSTed with. It follows
+// no redirects, since one could point a delivery anywhere, and unless
+// allowPrivate it refuses to connect to loopback, private, link-local (cloud
+// metadata included) and other non-public addresses. The check runs on the
+// address actually dialed, after DNS resolution, so a public name resolving
+// to an internal address is refused too.
+func newWebhookClient(allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: webhookTimeout}
+	if !allowPrivate {
+		dialer.Control = refuseNonPublic
+	}
+	return &http.Client{
+		Timeout: webhookTimeout,
+		// No Proxy: a proxy would make the connection the check can't see
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: webhookTimeout,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+}
+
+// refuseNonPublic is a net.Dialer Control function refusing non-public addresses
+func refuseNonPublic(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return fmt.Errorf("%w: unexpected address %q", errWebhookTarget, address)
+	}
+	if !isPublicAddr(ip) {
+		return fmt.Errorf("%w: %s is not a public address", errWebhookTarget, ip)
+	}
+	return nil
+}
+
+// isPublicAddr reports whether ip is on the public internet
+func isPublicAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// AllowPrivateTargets lets deliveries go to loopback and private addresses,
+// for coordinators whose integrators run on the same network
+func (s *WebhookService) AllowPrivateTargets(allow bool) {
+	s.client = newWebhookClient(allow)
+}
+
+// SetLimits caps each user at maxPerUser webhooks (0 or less for no cap) and
+// keeps delivered and given-up deliveries for retention (0 or less forever)
+func (s *WebhookService) SetLimits(maxPerUser int, retention time.Duration) {
+	s.maxPerUser = maxPerUser
+	s.retention = retention
+}
+
+// SetRetries tries each delivery up to maxAttempts times, waiting backoff
+// after the first failure and twice as long after each further one
+func (s *WebhookService) SetRetries(maxAttempts int, backoff time.Duration) {
+	s.maxAttempts = maxAttempts
+	s.backoff = backoff
+}
+
+// ValidateWebhook checks a webhook's URL and events. Only operator webhooks
+// may subscribe to node events.
+func ValidateWebhook(rawURL string, events []string, operator bool) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%w: url must be an absolute http or https URL", ErrInvalidWebhook)
+	}
+	if len(events) == 0 {
+		return fmt.Errorf("%w: subscribe to at least one event", ErrInvalidWebhook)
+	}
+	for _, event := range events {
+		if !slices.Contains(WebhookEvents, event) {
+			return fmt.Errorf("%w: unknown event %q", ErrInvalidWebhook, event)
+		}
+		if event == EventNodeOffline && !operator {
+			return fmt.Errorf("%w: %s is only available to operator webhooks", ErrInvalidWebhook, event)
+		}
+	}
+	return nil
+}
+
+// Register creates a webhook for userID, or an operator webhook when userID
+// is nil. The secret deliveries are signed with is returned only here.
+// Users can't go over the per-user cap; operator webhooks have none.
+func (s *WebhookService) Register(ctx context.Context, userID *uuid.UUID, rawURL string, events []string) (*models.Webhook, string, error) {
+	if err := ValidateWebhook(rawURL, events, userID == nil); err != nil {
+		return nil, "", err
+	}
+	if userID != nil && s.maxPerUser > 0 {
+		existing, err := s.store.ListWebhooks(ctx, userID)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to list webhooks: %w", err)
+		}
+		if len(existing) >= s.maxPerUser {
+			return nil, "", fmt.Errorf("%w (%d per user)", ErrWebhookLimit, s.maxPerUser)
+		}
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, "", fmt.Errorf("failed to generate webhook secret: %w", err)
+	}
+	secret := "whsec_" + hex.EncodeToString(raw)
+
+	events = slices.Clone(events)
+	slices.Sort(events)
+	hook := &models.Webhook{
+		ID:     uuid.New(),
+		UserID: userID,
+		URL:    rawURL,
+		Secret: secret,
+		Events: slices.Compact(events),
+	}
+	if err := s.store.CreateWebhook(ctx, hook); err != nil {
+		return nil, "", fmt.Errorf("failed to create webhook: %w", err)
+	}
+	return hook, secret, nil
+}
+
+// List returns a user's webhooks, or every webhook when userID is nil
+func (s *WebhookService) List(ctx context.Context, userID *uuid.UUID) ([]models.Webhook, error) {
+	return s.store.ListWebhooks(ctx, userID)
+}
+
+// Delete removes a webhook and its pending deliveries. With userID set, only
+// that user's webhooks can be deleted.
+func (s *WebhookService) Delete(ctx context.Context, webhookID uuid.UUID, userID *uuid.UUID) error {
+	hook, err := s.store.GetWebhook(ctx, webhookID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return ErrWebhookNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if userID != nil && (hook.UserID == nil || *hook.UserID != *userID) {
+		return ErrWebhookNotFound
+	}
+	if err := s.store.DeleteWebhook(ctx, webhookID); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return err
+	}
+	return nil
+}
+
+// webhookMatches reports whether hook should hear of event about something
+// owned by userID (nil for events, like node ones, that belong to no user)
+func webhookMatches(hook *models.Webhook, event string, userID *uuid.UUID) bool {
+	if !slices.Contains(hook.Events, event) {
+		return false
+	}
+	if hook.UserID == nil {
+		return true
+	}
+	return userID != nil && *hook.UserID == *userID
+}
+
+// Notify queues event, with data as its payload, for every webhook
+// subscribed to it: operator webhooks, and those of userID if given
+func (s *WebhookService) Notify(ctx context.Context, event string, userID *uuid.UUID, data interface{}) error {
+	hooks, err := s.store.ListWebhooks(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to list webhooks: %w", err)
+	}
+
+	now := time.Now()
+	payload, err := json.Marshal(WebhookPayload{ID: uuid.New(), Event: event, CreatedAt: now, Data: data})
+	if err != nil {
+		return fmt.Errorf("failed to encode %s payload: %w", event, err)
+	}
+
+	var deliveries []models.WebhookDelivery
+	for i := range hooks {
+		if !webhookMatches(&hooks[i], event, userID) {
+			continue
+		}
+		deliveries = append(deliveries, models.WebhookDelivery{
+			ID:            uuid.New(),
+			WebhookID:     hooks[i].ID,
+			Event:         event,
+			Payload:       payload,
+			Status:        "pending",
+			NextAttemptAt: now,
+		})
+	}
+	if len(deliveries) == 0 {
+		return nil
+	}
+	if err := s.store.QueueWebhookDeliveries(ctx, deliveries); err != nil {
+		return fmt.Errorf("failed to queue %s deliveries: %w", event, err)
+	}
+	return nil
+}
+
+// SignWebhookPayload returns the X-Webhook-Signature value for body:
+// "sha256=" followed by the hex HMAC-SHA256 of body keyed with the secret
+func SignWebhookPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookBackoff is how long to wait after a delivery's failed-th failed
+// attempt: base, doubling each time, capped at an hour
+func webhookBackoff(base time.Duration, failed int) time.Duration {
+	wait := base
+	for i := 1; i < failed && wait < maxWebhookBackoff; i++ {
+		wait *= 2
+	}
+	return min(wait, maxWebhookBackoff)
+}
+
+// DeliverDue attempts up to limit deliveries due at now. A non-2xx response
+// or transport error is retried after a backoff until the delivery runs out
+// of attempts.
+func (s *WebhookService) DeliverDue(ctx context.Context, now time.Time, limit int) (WebhookReport, error) {
+	var report WebhookReport
+	due, err := s.store.ListDueWebhookDeliveries(ctx, now, limit)
+	if err != nil {
+		return report, fmt.Errorf("failed to list due deliveries: %w", err)
+	}
+
+	var errs []error
+	for i := range due {
+		d := &due[i]
+		hook, err := s.store.GetWebhook(ctx, d.WebhookID)
+		if errors.Is(err, storage.ErrNotFound) {
+			continue // deleted meanwhile, taking its deliveries with it
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		d.Attempts++
+		if err := s.post(ctx, hook, d); err != nil {
+			d.LastError = err.Error()
+			if d.Attempts >= s.maxAttempts {
+				d.Status = "failed"
+				report.Failed++
+			} else {
+				d.NextAttemptAt = now.Add(webhookBackoff(s.backoff, d.Attempts))
+				report.Retrying++
+			}
+		} else {
+			d.Status = "delivered"
+			d.LastError = ""
+			report.Delivered++
+		}
+		if err := s.store.UpdateWebhookDelivery(ctx, d); err != nil {
+			errs = append(errs, fmt.Errorf("failed to record delivery %s: %w", d.ID, err))
+		}
+	}
+	return report, errors.Join(errs...)
+}
+
+// PruneDeliveries removes delivered and given-up deliveries older than the
+// retention, returning how many were removed
+func (s *WebhookService) PruneDeliveries(ctx context.Context, now time.Time) (int64, error) {
+	if s.retention <= 0 {
+		return 0, nil
+	}
+	pruned, err := s.store.PruneWebhookDeliveries(ctx, now.Add(-s.retention))
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune deliveries: %w", err)
+	}
+	return pruned, nil
+}
+
+// post sends one delivery, signed with the webhook's secret
+func (s *WebhookService) post(ctx context.Context, hook *models.Webhook, d *models.WebhookDelivery) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, d.Event)
+	req.Header.Set(WebhookDeliveryHeader, d.ID.String())
+	req.Header.Set(WebhookSignatureHeader, SignWebhookPayload(hook.Secret, d.Payload))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/federated-storage/coordinator/internal/models"
+)
+
+// ErrCreditChainBroken is returned when a user's credit transactions no
+// longer hash into an unbroken chain
+var ErrCreditChainBroken = errors.New("credit transaction chain is broken")
+
+// CreditTransactionHash returns the row hash of t: a SHA-256 over its
+// PrevHash and every recorded field, so changing any of them, or the
+// transaction it follows, changes the hash. CreatedAt is hashed at the
+// microsecond precision the database keeps.
+func CreditTransactionHash(t *models.CreditTransaction) string {
+	var userID, nodeID string
+	if t.UserID != nil {
+		userID = t.UserID.String()
+	}
+	if t.NodeID != nil {
+		nodeID = t.NodeID.String()
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%s\n%s\n%q\n%d\n%q\n%s",
+		t.PrevHash, t.ID, userID, nodeID, t.TransactionType, t.Amount, t.Description,
+		t.CreatedAt.UTC().Truncate(time.Microsecond).Format(time.RFC3339Nano))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// chainTransaction links t to the transaction before it, whose row hash is
+// prevHash ("" for the first), and fills in its own hash
+func chainTransaction(t *models.CreditTransaction, prevHash string) {
+	t.CreatedAt = t.CreatedAt.UTC().Truncate(time.Microsecond)
+	t.PrevHash = prevHash
+	t.RowHash = CreditTransactionHash(t)
+}
+
+// VerifyCreditChain checks that one user's transactions form a single chain:
+// starting from the first, each one's hash matches its contents and the next
+// one names it as its predecessor. An edited row fails its hash, and a
+// deleted one leaves its successor unreachable. Rows recorded before
+// transactions were chained carry no hash and are skipped; removing the
+// newest rows can only be noticed against another record, such as the
+// balance.
+func VerifyCreditChain(transactions []models.CreditTransaction) error {
+	byPrev := make(map[string]models.CreditTransaction, len(transactions))
+	for _, t := range transactions {
+		if t.RowHash == "" {
+			continue
+		}
+		if other, ok := byPrev[t.PrevHash]; ok {
+			return fmt.Errorf("%w: transactions %s and %s follow the same one", ErrCreditChainBroken, other.ID, t.ID)
+		}
+		byPrev[t.PrevHash] = t
+	}
+
+	prev, linked := "", 0
+	for {
+		t, ok := byPrev[prev]
+		if !ok {
+			break
+		}
+		if CreditTransactionHash(&t) != t.RowHash {
+			return fmt.Errorf("%w: transaction %s does not match its hash", ErrCreditChainBroken, t.ID)
+		}
+		prev = t.RowHash
+		linked++
+	}
+	if linked != len(byPrev) {
+		return fmt.Errorf("%w: %d of %d transactions are not linked from the first", ErrCreditChainBroken, len(byPrev)-linked, len(byPrev))
+	}
+	return nil
+}
@@ -0,0 +1,1280 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/federated-storage/coordinator/internal/chunkformat"
+	"github.com/federated-storage/coordinator/internal/merkle"
+	"github.com/federated-storage/coordinator/internal/models"
+	"github.com/google/uuid"
+)
+
+// MemoryStore is an in-memory Store for tests
+type MemoryStore struct {
+	mu           sync.Mutex
+	users        map[uuid.UUID]models.User
+	transactions []models.CreditTransaction
+	files        map[uuid.UUID]models.File
+	tags         map[uuid.UUID]map[string]bool
+	chunks       map[uuid.UUID]memoryChunk
+	assignments  []models.ChunkAssignment
+	sessions     map[uuid.UUID]models.UploadSession
+	invites      map[uuid.UUID]models.NodeInvite
+	exclusions   map[string]models.NodeExclusion
+	webhooks     map[uuid.UUID]models.Webhook
+	deliveries   map[uuid.UUID]models.WebhookDelivery
+	readOnly     *models.ReadOnlyMode
+	drainCopies  []models.DrainCopy
+}
+
+type memoryChunk struct {
+	chunk models.Chunk
+	data  []byte
+}
+
+// NewMemoryStore creates an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:      make(map[uuid.UUID]models.User),
+		files:      make(map[uuid.UUID]models.File),
+		tags:       make(map[uuid.UUID]map[string]bool),
+		chunks:     make(map[uuid.UUID]memoryChunk),
+		sessions:   make(map[uuid.UUID]models.UploadSession),
+		invites:    make(map[uuid.UUID]models.NodeInvite),
+		exclusions: make(map[string]models.NodeExclusion),
+		webhooks:   make(map[uuid.UUID]models.Webhook),
+		deliveries: make(map[uuid.UUID]models.WebhookDelivery),
+	}
+}
+
+// CreateUser stores a user, returning ErrConflict if the email is taken
+func (s *MemoryStore) CreateUser(ctx context.Context, user *models.User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, u := range s.users {
+		if u.Email == user.Email {
+			return ErrConflict
+		}
+	}
+	now := time.Now()
+	u := *user
+	u.CreatedAt, u.UpdatedAt = now, now
+	s.users[u.ID] = u
+	return nil
+}
+
+// GetUserByID retrieves a user by ID
+func (s *MemoryStore) GetUserByID(ctx context.Context, userID uuid.UUID) (*models.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[userID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &u, nil
+}
+
+// GetUserByEmail retrieves a user by email
+func (s *MemoryStore) GetUserByEmail(ctx context.Context, email string) (*models.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, u := range s.users {
+		if u.Email == email {
+			return &u, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// RecordLoginFailure counts a failed login, locking the account on the maxAttempts-th in a row
+func (s *MemoryStore) RecordLoginFailure(ctx context.Context, userID uuid.UUID, maxAttempts int, lockUntil time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[userID]
+	if !ok {
+		return false, ErrNotFound
+	}
+	u.FailedLoginAttempts++
+	locked := u.FailedLoginAttempts >= maxAttempts
+	if locked {
+		u.FailedLoginAttempts = 0
+		u.LockedUntil = &lockUntil
+	}
+	s.users[userID] = u
+	return locked, nil
+}
+
+// ResetLoginFailures clears the failure count and any lockout
+func (s *MemoryStore) ResetLoginFailures(ctx context.Context, userID uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[userID]
+	if !ok {
+		return ErrNotFound
+	}
+	u.FailedLoginAttempts = 0
+	u.LockedUntil = nil
+	s.users[userID] = u
+	return nil
+}
+
+// AddCredits adjusts a user's balance and records the transaction
+func (s *MemoryStore) AddCredits(ctx context.Context, userID uuid.UUID, amount int64, transactionType, description string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[userID]
+	if !ok {
+		return ErrNotFound
+	}
+	u.Credits += amount
+	u.UpdatedAt = time.Now()
+	s.users[userID] = u
+
+	s.recordTransaction(models.CreditTransaction{
+		UserID:          &userID,
+		TransactionType: transactionType,
+		Amount:          amount,
+		Description:     description,
+	})
+	return nil
+}
+
+// HoldCredits moves credits into the user's held balance if enough are available
+func (s *MemoryStore) HoldCredits(ctx context.Context, userID uuid.UUID, amount int64) error {
+	return s.adjustBalance(userID, func(u *models.User) bool {
+		if u.Credits < amount {
+			return false
+		}
+		u.Credits -= amount
+		u.HeldCredits += amount
+		return true
+	})
+}
+
+// ReleaseCredits returns held credits to the user's spendable balance
+func (s *MemoryStore) ReleaseCredits(ctx context.Context, userID uuid.UUID, amount int64) error {
+	return s.adjustBalance(userID, func(u *models.User) bool {
+		if u.HeldCredits < amount {
+			return false
+		}
+		u.HeldCredits -= amount
+		u.Credits += amount
+		return true
+	})
+}
+
+// CaptureCredits spends held credits and records the debit
+func (s *MemoryStore) CaptureCredits(ctx context.Context, userID uuid.UUID, amount int64, description string) error {
+	err := s.adjustBalance(userID, func(u *models.User) bool {
+		if u.HeldCredits < amount {
+			return false
+		}
+		u.HeldCredits -= amount
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.recordTransaction(models.CreditTransaction{
+		UserID:          &userID,
+		TransactionType: "debit",
+		Amount:          -amount,
+		Description:     description,
+	})
+	return nil
+}
+
+// recordTransaction appends t to its user's chain; the caller holds s.mu
+func (s *MemoryStore) recordTransaction(t models.CreditTransaction) {
+	var prevHash string
+	for _, prev := range s.transactions {
+		if prev.UserID != nil && *prev.UserID == *t.UserID {
+			prevHash = prev.RowHash
+		}
+	}
+	t.ID = uuid.New()
+	t.CreatedAt = time.Now()
+	chainTransaction(&t, prevHash)
+	s.transactions = append(s.transactions, t)
+}
+
+// adjustBalance applies change to a user, returning ErrInsufficientCredits if it declines
+func (s *MemoryStore) adjustBalance(userID uuid.UUID, change func(u *models.User) bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[userID]
+	if !ok {
+		return ErrNotFound
+	}
+	if !change(&u) {
+		return ErrInsufficientCredits
+	}
+	u.UpdatedAt = time.Now()
+	s.users[userID] = u
+	return nil
+}
+
+// ListCreditTransactions returns a user's credit transactions, oldest first
+func (s *MemoryStore) ListCreditTransactions(ctx context.Context, userID uuid.UUID) ([]models.CreditTransaction, error) {
+	return s.Transactions(userID), nil
+}
+
+// DeleteUser removes a user who owns no files, with their sessions and
+// webhooks; their credit transactions are kept without the user
+func (s *MemoryStore) DeleteUser(ctx context.Context, userID uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[userID]; !ok {
+		return ErrNotFound
+	}
+	for _, f := range s.files {
+		if f.UserID == userID {
+			return ErrConflict
+		}
+	}
+	delete(s.users, userID)
+	for id, session := range s.sessions {
+		if session.UserID == userID {
+			delete(s.sessions, id)
+		}
+	}
+	for id, w := range s.webhooks {
+		if w.UserID != nil && *w.UserID == userID {
+			delete(s.webhooks, id)
+			for deliveryID, d := range s.deliveries {
+				if d.WebhookID == id {
+					delete(s.deliveries, deliveryID)
+				}
+			}
+		}
+	}
+	for i, t := range s.transactions {
+		if t.UserID != nil && *t.UserID == userID {
+			s.transactions[i].UserID = nil
+		}
+	}
+	return nil
+}
+
+// Transactions returns the credit transactions recorded for a user
+func (s *MemoryStore) Transactions(userID uuid.UUID) []models.CreditTransaction {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var out []models.CreditTransaction
+	for _, t := range s.transactions {
+		if t.UserID != nil && *t.UserID == userID {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// CreateFile stores a file record
+func (s *MemoryStore) CreateFile(ctx context.Context, file *models.File) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.files[file.ID]; ok {
+		return ErrConflict
+	}
+	if file.ParentFileID != nil {
+		for _, f := range s.files {
+			if f.ParentFileID != nil && *f.ParentFileID == *file.ParentFileID && f.Version == file.Version {
+				return ErrConflict
+			}
+		}
+	}
+	now := time.Now()
+	f := *file
+	f.Revision = 1
+	f.CreatedAt, f.UpdatedAt = now, now
+	s.files[f.ID] = f
+	return nil
+}
+
+// GetFile retrieves a file by ID
+func (s *MemoryStore) GetFile(ctx context.Context, fileID uuid.UUID) (*models.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, ok := s.files[fileID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	f.Tags = s.sortedTags(fileID)
+	return &f, nil
+}
+
+func (s *MemoryStore) sortedTags(fileID uuid.UUID) []string {
+	tags := []string{}
+	for tag := range s.tags[fileID] {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// ListFilesByUser retrieves a user's files with their tags, newest first
+func (s *MemoryStore) ListFilesByUser(ctx context.Context, userID uuid.UUID, tags []string) ([]models.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var files []models.File
+	for _, f := range s.files {
+		if f.UserID != userID {
+			continue
+		}
+		hasAll := true
+		for _, tag := range tags {
+			if !s.tags[f.ID][tag] {
+				hasAll = false
+				break
+			}
+		}
+		if hasAll {
+			f.EncryptionKey = nil
+			f.Tags = s.sortedTags(f.ID)
+			files = append(files, f)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].CreatedAt.After(files[j].CreatedAt) })
+	return files, nil
+}
+
+// LatestFileByName returns the user's highest-versioned file with this name
+func (s *MemoryStore) LatestFileByName(ctx context.Context, userID uuid.UUID, filename string) (*models.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var latest *models.File
+	for _, f := range s.files {
+		if f.UserID != userID || f.Filename != filename {
+			continue
+		}
+		if latest == nil || f.Version > latest.Version ||
+			(f.Version == latest.Version && f.CreatedAt.After(latest.CreatedAt)) {
+			f := f
+			latest = &f
+		}
+	}
+	if latest == nil {
+		return nil, ErrNotFound
+	}
+	latest.EncryptionKey = nil
+	return latest, nil
+}
+
+// ListFileVersions returns a file's version history, oldest version first
+func (s *MemoryStore) ListFileVersions(ctx context.Context, rootID uuid.UUID) ([]models.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var files []models.File
+	for _, f := range s.files {
+		if f.ID == rootID || (f.ParentFileID != nil && *f.ParentFileID == rootID) {
+			f.EncryptionKey = nil
+			files = append(files, f)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Version < files[j].Version })
+	return files, nil
+}
+
+// SetFileStatus updates a file's status
+func (s *MemoryStore) SetFileStatus(ctx context.Context, fileID uuid.UUID, status string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if f, ok := s.files[fileID]; ok {
+		f.Status = status
+		f.Revision++
+		f.UpdatedAt = time.Now()
+		s.files[fileID] = f
+	}
+	return nil
+}
+
+// SwapFileStatus moves a file from one status to another if it is currently in from
+func (s *MemoryStore) SwapFileStatus(ctx context.Context, fileID uuid.UUID, from, to string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, ok := s.files[fileID]
+	if !ok || f.Status != from {
+		return false, nil
+	}
+	f.Status = to
+	f.Revision++
+	f.UpdatedAt = time.Now()
+	s.files[fileID] = f
+	return true, nil
+}
+
+// SetFileContentHash records the SHA-256 of a file's plaintext
+func (s *MemoryStore) SetFileContentHash(ctx context.Context, fileID uuid.UUID, sha256Hex string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if f, ok := s.files[fileID]; ok {
+		f.ContentSHA256 = sha256Hex
+		f.Revision++
+		f.UpdatedAt = time.Now()
+		s.files[fileID] = f
+	}
+	return nil
+}
+
+// SetFileReplicas records how many replicas a file was charged for
+func (s *MemoryStore) SetFileReplicas(ctx context.Context, fileID uuid.UUID, replicas int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if f, ok := s.files[fileID]; ok {
+		f.Replicas = replicas
+		f.Revision++
+		f.UpdatedAt = time.Now()
+		s.files[fileID] = f
+	}
+	return nil
+}
+
+// SetFileExpiry sets or, with nil, clears a file's expiry
+func (s *MemoryStore) SetFileExpiry(ctx context.Context, fileID uuid.UUID, expiresAt *time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if f, ok := s.files[fileID]; ok {
+		f.ExpiresAt = expiresAt
+		f.Revision++
+		f.UpdatedAt = time.Now()
+		s.files[fileID] = f
+	}
+	return nil
+}
+
+// ListExpiredFiles returns files whose expiry is at or before now, oldest first
+func (s *MemoryStore) ListExpiredFiles(ctx context.Context, now time.Time) ([]models.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var files []models.File
+	for _, f := range s.files {
+		if f.ExpiresAt != nil && !f.ExpiresAt.After(now) {
+			f.EncryptionKey = nil
+			files = append(files, f)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ExpiresAt.Before(*files[j].ExpiresAt) })
+	return files, nil
+}
+
+// DeleteFile deletes a file along with its chunks and their assignments.
+// Deleting the first version of a history promotes the next version.
+func (s *MemoryStore) DeleteFile(ctx context.Context, fileID uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Promote the next version to anchor the rest of the history
+	var newRoot *models.File
+	for _, f := range s.files {
+		if f.ParentFileID != nil && *f.ParentFileID == fileID && (newRoot == nil || f.Version < newRoot.Version) {
+			f := f
+			newRoot = &f
+		}
+	}
+	if newRoot != nil {
+		for id, f := range s.files {
+			if f.ParentFileID == nil || *f.ParentFileID != fileID {
+				continue
+			}
+			if id == newRoot.ID {
+				f.ParentFileID = nil
+			} else {
+				f.ParentFileID = &newRoot.ID
+			}
+			s.files[id] = f
+		}
+	}
+
+	delete(s.files, fileID)
+	delete(s.tags, fileID)
+	removed := make(map[uuid.UUID]bool)
+	for id, c := range s.chunks {
+		if c.chunk.FileID == fileID {
+			removed[id] = true
+			delete(s.chunks, id)
+		}
+	}
+	kept := s.assignments[:0]
+	for _, a := range s.assignments {
+		if !removed[a.ChunkID] {
+			kept = append(kept, a)
+		}
+	}
+	s.assignments = kept
+	return nil
+}
+
+// SetChunkData replaces a chunk's stored data
+func (s *MemoryStore) SetChunkData(ctx context.Context, chunkID uuid.UUID, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.chunks[chunkID]
+	if !ok {
+		return ErrNotFound
+	}
+	c.data = append([]byte(nil), data...)
+	s.chunks[chunkID] = c
+	return nil
+}
+
+// RekeyFile replaces a file's key and chunk data; nothing changes if rekey fails
+func (s *MemoryStore) RekeyFile(ctx context.Context, fileID uuid.UUID, rekey func(oldKey []byte, chunks map[int][]byte) ([]byte, map[int][]byte, error)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, ok := s.files[fileID]
+	if !ok {
+		return ErrNotFound
+	}
+
+	chunks := make(map[int][]byte)
+	ids := make(map[int]uuid.UUID)
+	for id, c := range s.chunks {
+		if c.chunk.FileID == fileID {
+			chunks[c.chunk.ChunkIndex] = c.data
+			ids[c.chunk.ChunkIndex] = id
+		}
+	}
+
+	newKey, updated, err := rekey(f.EncryptionKey, chunks)
+	if err != nil {
+		return err
+	}
+
+	for chunkIndex, data := range updated {
+		id, ok := ids[chunkIndex]
+		if !ok {
+			continue
+		}
+		c := s.chunks[id]
+		hash := sha256.Sum256(data)
+		c.chunk.Hash = hex.EncodeToString(hash[:])
+		c.chunk.SizeBytes = len(data)
+		c.chunk.MerkleRoot = hex.EncodeToString(merkle.Root(data))
+		c.chunk.Format = chunkformat.Version(data)
+		c.data = data
+		s.chunks[id] = c
+	}
+	for i, a := range s.assignments {
+		if c, ok := s.chunks[a.ChunkID]; ok && c.chunk.FileID == fileID && a.Status == "active" {
+			s.assignments[i].Status = "stale"
+		}
+	}
+	f.EncryptionKey = newKey
+	f.Revision++
+	f.UpdatedAt = time.Now()
+	s.files[fileID] = f
+	return nil
+}
+
+// AddFileTags adds tags to a file, ignoring ones it already has
+func (s *MemoryStore) AddFileTags(ctx context.Context, fileID uuid.UUID, tags []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.files[fileID]; !ok {
+		return ErrNotFound
+	}
+	if s.tags[fileID] == nil {
+		s.tags[fileID] = make(map[string]bool)
+	}
+	added := false
+	for _, tag := range tags {
+		if !s.tags[fileID][tag] {
+			s.tags[fileID][tag] = true
+			added = true
+		}
+	}
+	if added {
+		s.bumpFileRevision(fileID)
+	}
+	return nil
+}
+
+// RemoveFileTag deletes a tag from a file
+func (s *MemoryStore) RemoveFileTag(ctx context.Context, fileID uuid.UUID, tag string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.tags[fileID][tag] {
+		return ErrNotFound
+	}
+	delete(s.tags[fileID], tag)
+	s.bumpFileRevision(fileID)
+	return nil
+}
+
+// bumpFileRevision records a change to a file held outside its record; callers hold s.mu
+func (s *MemoryStore) bumpFileRevision(fileID uuid.UUID) {
+	if f, ok := s.files[fileID]; ok {
+		f.Revision++
+		f.UpdatedAt = time.Now()
+		s.files[fileID] = f
+	}
+}
+
+// ClaimFileRevision advances a file's revision if it currently equals revision
+func (s *MemoryStore) ClaimFileRevision(ctx context.Context, fileID uuid.UUID, revision int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, ok := s.files[fileID]
+	if !ok || f.Revision != revision {
+		return false, nil
+	}
+	s.bumpFileRevision(fileID)
+	return true, nil
+}
+
+// ListFileTags retrieves a file's tags in alphabetical order
+func (s *MemoryStore) ListFileTags(ctx context.Context, fileID uuid.UUID) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.sortedTags(fileID), nil
+}
+
+// CreateChunk stores a chunk and its assignments
+func (s *MemoryStore) CreateChunk(ctx context.Context, chunk *models.Chunk, data []byte, nodeIDs []uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, c := range s.chunks {
+		if c.chunk.FileID == chunk.FileID && c.chunk.ChunkIndex == chunk.ChunkIndex {
+			return ErrConflict
+		}
+	}
+	// Like the unique (chunk, node) constraint, a repeated node fails the
+	// whole insert and leaves nothing behind
+	seen := make(map[uuid.UUID]bool, len(nodeIDs))
+	for _, nodeID := range nodeIDs {
+		if seen[nodeID] {
+			return ErrConflict
+		}
+		seen[nodeID] = true
+	}
+	s.chunks[chunk.ID] = memoryChunk{chunk: *chunk, data: data}
+	for _, nodeID := range nodeIDs {
+		s.assignments = append(s.assignments, models.ChunkAssignment{
+			ID:        uuid.New(),
+			ChunkID:   chunk.ID,
+			NodeID:    nodeID,
+			Status:    "active",
+			CreatedAt: time.Now(),
+		})
+	}
+	return nil
+}
+
+// ListChunks retrieves all chunks for a file, ordered by index
+func (s *MemoryStore) ListChunks(ctx context.Context, fileID uuid.UUID) ([]models.Chunk, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var chunks []models.Chunk
+	for _, c := range s.chunks {
+		if c.chunk.FileID == fileID {
+			chunk := c.chunk
+			chunk.NodeOnly = chunk.SizeBytes > 0 && len(c.data) == 0
+			chunks = append(chunks, chunk)
+		}
+	}
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].ChunkIndex < chunks[j].ChunkIndex })
+	return chunks, nil
+}
+
+// ListChunkData retrieves the stored data of every chunk of a file, keyed by index
+func (s *MemoryStore) ListChunkData(ctx context.Context, fileID uuid.UUID) (map[int][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	chunks := make(map[int][]byte)
+	for _, c := range s.chunks {
+		if c.chunk.FileID == fileID {
+			chunks[c.chunk.ChunkIndex] = c.data
+		}
+	}
+	return chunks, nil
+}
+
+// ListContentHashGroups groups ready files by plaintext hash. Files without
+// a recorded hash make up the group with an empty hash.
+func (s *MemoryStore) ListContentHashGroups(ctx context.Context) ([]models.ContentHashGroup, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	byHash := make(map[string]*models.ContentHashGroup)
+	for _, f := range s.files {
+		if f.Status != "ready" {
+			continue
+		}
+		g, ok := byHash[f.ContentSHA256]
+		if !ok {
+			g = &models.ContentHashGroup{Hash: f.ContentSHA256}
+			byHash[f.ContentSHA256] = g
+		}
+		g.Files++
+		if f.SizeBytes > g.SizeBytes {
+			g.SizeBytes = f.SizeBytes
+		}
+	}
+
+	groups := make([]models.ContentHashGroup, 0, len(byHash))
+	for _, g := range byHash {
+		groups = append(groups, *g)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Hash < groups[j].Hash })
+	return groups, nil
+}
+
+// ListChunkAssignments retrieves active assignments of a chunk
+func (s *MemoryStore) ListChunkAssignments(ctx context.Context, chunkID uuid.UUID) ([]models.ChunkAssignment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var out []models.ChunkAssignment
+	for _, a := range s.assignments {
+		if a.ChunkID == chunkID && a.Status == "active" {
+			out = append(out, a)
+		}
+	}
+	return out, nil
+}
+
+// ListFileAssignments retrieves active assignments of every chunk of a file
+func (s *MemoryStore) ListFileAssignments(ctx context.Context, fileID uuid.UUID) ([]models.ChunkAssignment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var out []models.ChunkAssignment
+	for _, a := range s.assignments {
+		if c, ok := s.chunks[a.ChunkID]; ok && c.chunk.FileID == fileID && a.Status == "active" {
+			out = append(out, a)
+		}
+	}
+	return out, nil
+}
+
+// GetChunk retrieves a chunk's metadata and data
+func (s *MemoryStore) GetChunk(ctx context.Context, chunkID uuid.UUID) (*models.Chunk, []byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.chunks[chunkID]
+	if !ok {
+		return nil, nil, ErrNotFound
+	}
+	chunk := c.chunk
+	return &chunk, c.data, nil
+}
+
+// ListNodeChunks retrieves the chunks actively assigned to a node
+func (s *MemoryStore) ListNodeChunks(ctx context.Context, nodeID uuid.UUID) ([]models.Chunk, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var chunks []models.Chunk
+	for _, a := range s.assignments {
+		if a.NodeID == nodeID && a.Status == "active" {
+			if c, ok := s.chunks[a.ChunkID]; ok {
+				chunks = append(chunks, c.chunk)
+			}
+		}
+	}
+	return chunks, nil
+}
+
+// ListNodeChunkPage retrieves one page of the chunks actively assigned to a node, in ID order
+func (s *MemoryStore) ListNodeChunkPage(ctx context.Context, nodeID, after uuid.UUID, limit int) ([]models.Chunk, error) {
+	chunks, err := s.ListNodeChunks(ctx, nodeID)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].ID.String() < chunks[j].ID.String() })
+
+	page := []models.Chunk{}
+	for _, c := range chunks {
+		if c.ID.String() > after.String() && len(page) < limit {
+			page = append(page, c)
+		}
+	}
+	return page, nil
+}
+
+// SetChunkAssignment creates or updates the assignment of a chunk to a node
+func (s *MemoryStore) SetChunkAssignment(ctx context.Context, chunkID, nodeID uuid.UUID, status string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, a := range s.assignments {
+		if a.ChunkID == chunkID && a.NodeID == nodeID {
+			s.assignments[i].Status = status
+			return nil
+		}
+	}
+	s.assignments = append(s.assignments, models.ChunkAssignment{
+		ID:        uuid.New(),
+		ChunkID:   chunkID,
+		NodeID:    nodeID,
+		Status:    status,
+		CreatedAt: time.Now(),
+	})
+	return nil
+}
+
+// ListStaleAssignments retrieves stale assignments of a file's chunks, or of
+// every file's when fileID is uuid.Nil, oldest first
+func (s *MemoryStore) ListStaleAssignments(ctx context.Context, fileID uuid.UUID) ([]models.ChunkAssignment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var out []models.ChunkAssignment
+	for _, a := range s.assignments {
+		if a.Status != "stale" {
+			continue
+		}
+		if c, ok := s.chunks[a.ChunkID]; ok && (fileID == uuid.Nil || c.chunk.FileID == fileID) {
+			out = append(out, a)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	return out, nil
+}
+
+// RecordDrainCopy notes a copy made while sourceNodeID drained
+func (s *MemoryStore) RecordDrainCopy(ctx context.Context, chunkID, nodeID, sourceNodeID uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, c := range s.drainCopies {
+		if c.ChunkID == chunkID && c.NodeID == nodeID {
+			s.drainCopies[i].SourceNodeID = sourceNodeID
+			return nil
+		}
+	}
+	s.drainCopies = append(s.drainCopies, models.DrainCopy{
+		ChunkID:      chunkID,
+		NodeID:       nodeID,
+		SourceNodeID: sourceNodeID,
+		CreatedAt:    time.Now(),
+	})
+	return nil
+}
+
+// ListDrainCopies returns the copies made while sourceNodeID drained, oldest first
+func (s *MemoryStore) ListDrainCopies(ctx context.Context, sourceNodeID uuid.UUID) ([]models.DrainCopy, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var out []models.DrainCopy
+	for _, c := range s.drainCopies {
+		if c.SourceNodeID == sourceNodeID {
+			out = append(out, c)
+		}
+	}
+	return out, nil
+}
+
+// DeleteDrainCopy forgets a drain copy
+func (s *MemoryStore) DeleteDrainCopy(ctx context.Context, chunkID, nodeID uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	kept := s.drainCopies[:0]
+	for _, c := range s.drainCopies {
+		if c.ChunkID != chunkID || c.NodeID != nodeID {
+			kept = append(kept, c)
+		}
+	}
+	s.drainCopies = kept
+	return nil
+}
+
+// DeleteChunkAssignment removes the assignment of a chunk to a node
+func (s *MemoryStore) DeleteChunkAssignment(ctx context.Context, chunkID, nodeID uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	kept := s.assignments[:0]
+	for _, a := range s.assignments {
+		if a.ChunkID != chunkID || a.NodeID != nodeID {
+			kept = append(kept, a)
+		}
+	}
+	s.assignments = kept
+	return nil
+}
+
+// CreateUploadSession stores an upload session
+func (s *MemoryStore) CreateUploadSession(ctx context.Context, session *models.UploadSession) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess := *session
+	sess.CreatedAt = time.Now()
+	s.sessions[sess.ID] = sess
+	return nil
+}
+
+// GetUploadSession retrieves an upload session
+func (s *MemoryStore) GetUploadSession(ctx context.Context, sessionID uuid.UUID) (*models.UploadSession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess, ok := s.sessions[sessionID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &sess, nil
+}
+
+// SetUploadSessionStatus updates an upload session's status
+func (s *MemoryStore) SetUploadSessionStatus(ctx context.Context, sessionID uuid.UUID, status string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sess, ok := s.sessions[sessionID]; ok {
+		sess.Status = status
+		s.sessions[sessionID] = sess
+	}
+	return nil
+}
+
+// SwapUploadSessionStatus moves a session from one status to another if it is currently in from
+func (s *MemoryStore) SwapUploadSessionStatus(ctx context.Context, sessionID uuid.UUID, from, to string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess, ok := s.sessions[sessionID]
+	if !ok || sess.Status != from {
+		return false, nil
+	}
+	sess.Status = to
+	s.sessions[sessionID] = sess
+	return true, nil
+}
+
+// ListExpiredUploadSessions returns active sessions whose expiry is at or before now
+func (s *MemoryStore) ListExpiredUploadSessions(ctx context.Context, now time.Time) ([]models.UploadSession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var out []models.UploadSession
+	for _, sess := range s.sessions {
+		if sess.Status == "active" && !sess.ExpiresAt.After(now) {
+			out = append(out, sess)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ExpiresAt.Before(out[j].ExpiresAt) })
+	return out, nil
+}
+
+// ListAbandonedUploadFiles returns the files, still uploading, of sessions
+// closed without completing. A session's file takes its ID if it was never linked.
+func (s *MemoryStore) ListAbandonedUploadFiles(ctx context.Context) ([]models.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var files []models.File
+	for _, sess := range s.sessions {
+		if sess.Status == "active" || sess.Status == "completed" {
+			continue
+		}
+		fileID := sess.ID
+		if sess.FileID != nil {
+			fileID = *sess.FileID
+		}
+		if f, ok := s.files[fileID]; ok && f.Status == "uploading" {
+			f.EncryptionKey = nil
+			files = append(files, f)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].CreatedAt.Before(files[j].CreatedAt) })
+	return files, nil
+}
+
+// SetUploadSessionFile links an upload session to the file it is creating
+func (s *MemoryStore) SetUploadSessionFile(ctx context.Context, sessionID, fileID uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sess, ok := s.sessions[sessionID]; ok {
+		id := fileID
+		sess.FileID = &id
+		s.sessions[sessionID] = sess
+	}
+	return nil
+}
+
+// CountActiveUploadSessions counts a user's active sessions that expire after now
+func (s *MemoryStore) CountActiveUploadSessions(ctx context.Context, userID uuid.UUID, now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := 0
+	for _, sess := range s.sessions {
+		if sess.UserID == userID && sess.Status == "active" && sess.ExpiresAt.After(now) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// CreateNodeInvite stores a node invite
+func (s *MemoryStore) CreateNodeInvite(ctx context.Context, invite *models.NodeInvite) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, inv := range s.invites {
+		if inv.TokenHash == invite.TokenHash {
+			return ErrConflict
+		}
+	}
+	invite.CreatedAt = time.Now()
+	s.invites[invite.ID] = *invite
+	return nil
+}
+
+// RedeemNodeInvite marks a usable invite as used
+func (s *MemoryStore) RedeemNodeInvite(ctx context.Context, tokenHash string, now time.Time) (*models.NodeInvite, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, inv := range s.invites {
+		if inv.TokenHash != tokenHash || inv.UsedAt != nil || (inv.ExpiresAt != nil && !inv.ExpiresAt.After(now)) {
+			continue
+		}
+		usedAt := now
+		inv.UsedAt = &usedAt
+		s.invites[id] = inv
+		return &inv, nil
+	}
+	return nil, ErrNotFound
+}
+
+// RestoreNodeInvite clears an invite's use
+func (s *MemoryStore) RestoreNodeInvite(ctx context.Context, inviteID uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if inv, ok := s.invites[inviteID]; ok {
+		inv.UsedAt = nil
+		s.invites[inviteID] = inv
+	}
+	return nil
+}
+
+// AddNodeExclusion stores an exclusion or updates the reason of an existing one
+func (s *MemoryStore) AddNodeExclusion(ctx context.Context, exclusion *models.NodeExclusion) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.exclusions[exclusion.PeerID]; ok {
+		exclusion.CreatedAt = existing.CreatedAt
+	} else {
+		exclusion.CreatedAt = time.Now()
+	}
+	s.exclusions[exclusion.PeerID] = *exclusion
+	return nil
+}
+
+// RemoveNodeExclusion deletes a peer's exclusion
+func (s *MemoryStore) RemoveNodeExclusion(ctx context.Context, peerID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.exclusions[peerID]; !ok {
+		return ErrNotFound
+	}
+	delete(s.exclusions, peerID)
+	return nil
+}
+
+// ListNodeExclusions returns every exclusion, oldest first
+func (s *MemoryStore) ListNodeExclusions(ctx context.Context) ([]models.NodeExclusion, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	exclusions := make([]models.NodeExclusion, 0, len(s.exclusions))
+	for _, e := range s.exclusions {
+		exclusions = append(exclusions, e)
+	}
+	sort.Slice(exclusions, func(i, j int) bool {
+		if !exclusions[i].CreatedAt.Equal(exclusions[j].CreatedAt) {
+			return exclusions[i].CreatedAt.Before(exclusions[j].CreatedAt)
+		}
+		return exclusions[i].PeerID < exclusions[j].PeerID
+	})
+	return exclusions, nil
+}
+
+// CreateWebhook stores a webhook
+func (s *MemoryStore) CreateWebhook(ctx context.Context, hook *models.Webhook) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hook.CreatedAt = time.Now()
+	h := *hook
+	h.Events = append([]string(nil), hook.Events...)
+	s.webhooks[h.ID] = h
+	return nil
+}
+
+// GetWebhook retrieves a webhook by ID
+func (s *MemoryStore) GetWebhook(ctx context.Context, webhookID uuid.UUID) (*models.Webhook, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, ok := s.webhooks[webhookID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &h, nil
+}
+
+// ListWebhooks returns a user's webhooks, or all of them, oldest first
+func (s *MemoryStore) ListWebhooks(ctx context.Context, userID *uuid.UUID) ([]models.Webhook, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var hooks []models.Webhook
+	for _, h := range s.webhooks {
+		if userID != nil && (h.UserID == nil || *h.UserID != *userID) {
+			continue
+		}
+		hooks = append(hooks, h)
+	}
+	sort.Slice(hooks, func(i, j int) bool { return hooks[i].CreatedAt.Before(hooks[j].CreatedAt) })
+	return hooks, nil
+}
+
+// DeleteWebhook removes a webhook along with its deliveries
+func (s *MemoryStore) DeleteWebhook(ctx context.Context, webhookID uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.webhooks[webhookID]; !ok {
+		return ErrNotFound
+	}
+	delete(s.webhooks, webhookID)
+	for id, d := range s.deliveries {
+		if d.WebhookID == webhookID {
+			delete(s.deliveries, id)
+		}
+	}
+	return nil
+}
+
+// QueueWebhookDeliveries stores deliveries for their first attempt
+func (s *MemoryStore) QueueWebhookDeliveries(ctx context.Context, deliveries []models.WebhookDelivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for _, d := range deliveries {
+		d.CreatedAt = now
+		s.deliveries[d.ID] = d
+	}
+	return nil
+}
+
+// ListDueWebhookDeliveries returns pending deliveries due by now
+func (s *MemoryStore) ListDueWebhookDeliveries(ctx context.Context, now time.Time, limit int) ([]models.WebhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var due []models.WebhookDelivery
+	for _, d := range s.deliveries {
+		if d.Status == "pending" && !d.NextAttemptAt.After(now) {
+			due = append(due, d)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].NextAttemptAt.Before(due[j].NextAttemptAt) })
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	return due, nil
+}
+
+// UpdateWebhookDelivery records a delivery attempt
+func (s *MemoryStore) UpdateWebhookDelivery(ctx context.Context, delivery *models.WebhookDelivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, ok := s.deliveries[delivery.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	d.Status = delivery.Status
+	d.Attempts = delivery.Attempts
+	d.NextAttemptAt = delivery.NextAttemptAt
+	d.LastError = delivery.LastError
+	s.deliveries[d.ID] = d
+	return nil
+}
+
+// PruneWebhookDeliveries removes settled deliveries queued before before
+func (s *MemoryStore) PruneWebhookDeliveries(ctx context.Context, before time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var pruned int64
+	for id, d := range s.deliveries {
+		if d.Status != "pending" && d.CreatedAt.Before(before) {
+			delete(s.deliveries, id)
+			pruned++
+		}
+	}
+	return pruned, nil
+}
+
+// GetReadOnlyMode returns the read-only mode last saved, or nil if none was
+func (s *MemoryStore) GetReadOnlyMode(ctx context.Context) (*models.ReadOnlyMode, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.readOnly == nil {
+		return nil, nil
+	}
+	mode := *s.readOnly
+	return &mode, nil
+}
+
+// SetReadOnlyMode saves the read-only mode
+func (s *MemoryStore) SetReadOnlyMode(ctx context.Context, mode *models.ReadOnlyMode) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	saved := *mode
+	s.readOnly = &saved
+	return nil
+}
@@ -0,0 +1,1268 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/federated-storage/coordinator/internal/chunkformat"
+	"github.com/federated-storage/coordinator/internal/merkle"
+	"github.com/federated-storage/coordinator/internal/models"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// PgStore implements Store on PostgreSQL
+type PgStore struct {
+	db *DB
+}
+
+// NewPgStore creates a PostgreSQL-backed store
+func NewPgStore(db *DB) *PgStore {
+	return &PgStore{db: db}
+}
+
+// isUniqueViolation reports whether err is a PostgreSQL unique constraint violation
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
+
+// CreateUser inserts a user, returning ErrConflict if the email is taken
+func (s *PgStore) CreateUser(ctx context.Context, user *models.User) error {
+	_, err := s.db.Pool.Exec(ctx,
+		`INSERT INTO users (id, email, password_hash, credits)
+		 VALUES ($1, $2, $3, $4)`,
+		user.ID, user.Email, user.PasswordHash, user.Credits)
+	if isUniqueViolation(err) {
+		return ErrConflict
+	}
+	return err
+}
+
+// GetUserByID retrieves a user by ID
+func (s *PgStore) GetUserByID(ctx context.Context, userID uuid.UUID) (*models.User, error) {
+	var user models.User
+	err := s.db.Pool.QueryRow(ctx,
+		"SELECT id, email, credits, held_credits, credits_per_usd, created_at, updated_at FROM users WHERE id = $1",
+		userID).Scan(&user.ID, &user.Email, &user.Credits, &user.HeldCredits, &user.CreditsPerUSD, &user.CreatedAt, &user.UpdatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// GetUserByEmail retrieves a user, including the password hash, by email
+func (s *PgStore) GetUserByEmail(ctx context.Context, email string) (*models.User, error) {
+	var user models.User
+	err := s.db.Pool.QueryRow(ctx,
+		"SELECT id, email, password_hash, credits, failed_login_attempts, locked_until FROM users WHERE email = $1",
+		email).Scan(&user.ID, &user.Email, &user.PasswordHash, &user.Credits, &user.FailedLoginAttempts, &user.LockedUntil)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// RecordLoginFailure counts a failed login, locking the account on the maxAttempts-th in a row
+func (s *PgStore) RecordLoginFailure(ctx context.Context, userID uuid.UUID, maxAttempts int, lockUntil time.Time) (bool, error) {
+	var locked bool
+	err := s.db.Pool.QueryRow(ctx,
+		`UPDATE users SET
+		   failed_login_attempts = CASE WHEN failed_login_attempts + 1 >= $2 THEN 0 ELSE failed_login_attempts + 1 END,
+		   locked_until = CASE WHEN failed_login_attempts + 1 >= $2 THEN $3 ELSE locked_until END
+		 WHERE id = $1
+		 RETURNING failed_login_attempts = 0`,
+		userID, maxAttempts, lockUntil).Scan(&locked)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, ErrNotFound
+	}
+	return locked, err
+}
+
+// ResetLoginFailures clears the failure count and any lockout
+func (s *PgStore) ResetLoginFailures(ctx context.Context, userID uuid.UUID) error {
+	_, err := s.db.Pool.Exec(ctx,
+		"UPDATE users SET failed_login_attempts = 0, locked_until = NULL WHERE id = $1",
+		userID)
+	return err
+}
+
+// AddCredits updates user credits and records the transaction
+func (s *PgStore) AddCredits(ctx context.Context, userID uuid.UUID, amount int64, transactionType, description string) error {
+	tx, err := s.db.Pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx,
+		"UPDATE users SET credits = credits + $1, updated_at = $2 WHERE id = $3",
+		amount, time.Now(), userID)
+	if err != nil {
+		return fmt.Errorf("failed to update credits: %w", err)
+	}
+
+	err = recordTransaction(ctx, tx, &models.CreditTransaction{
+		UserID:          &userID,
+		TransactionType: transactionType,
+		Amount:          amount,
+		Description:     description,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record transaction: %w", err)
+	}
+
+	return tx.Commit(ctx)
+}
+
+// recordTransaction appends t to its user's chain of credit transactions.
+// The caller has already updated the user's row in tx, which keeps other
+// transactions for the same user from reading the same predecessor.
+func recordTransaction(ctx context.Context, tx pgx.Tx, t *models.CreditTransaction) error {
+	var prevHash string
+	err := tx.QueryRow(ctx,
+		`SELECT row_hash FROM credit_transactions
+		 WHERE user_id = $1 AND row_hash IS NOT NULL
+		 ORDER BY created_at DESC, id DESC LIMIT 1`,
+		t.UserID).Scan(&prevHash)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return err
+	}
+
+	t.ID = uuid.New()
+	t.CreatedAt = time.Now()
+	chainTransaction(t, prevHash)
+	_, err = tx.Exec(ctx,
+		`INSERT INTO credit_transactions (id, user_id, node_id, transaction_type, amount, description, created_at, prev_hash, row_hash)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		t.ID, t.UserID, t.NodeID, t.TransactionType, t.Amount, t.Description, t.CreatedAt, t.PrevHash, t.RowHash)
+	return err
+}
+
+// ListCreditTransactions returns a user's credit transactions, oldest first
+func (s *PgStore) ListCreditTransactions(ctx context.Context, userID uuid.UUID) ([]models.CreditTransaction, error) {
+	rows, err := s.db.Pool.Query(ctx,
+		`SELECT id, user_id, node_id, transaction_type, amount, COALESCE(description, ''), created_at,
+		        COALESCE(prev_hash, ''), COALESCE(row_hash, '')
+		 FROM credit_transactions WHERE user_id = $1
+		 ORDER BY created_at, id`,
+		userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var transactions []models.CreditTransaction
+	for rows.Next() {
+		var t models.CreditTransaction
+		if err := rows.Scan(&t.ID, &t.UserID, &t.NodeID, &t.TransactionType, &t.Amount, &t.Description, &t.CreatedAt,
+			&t.PrevHash, &t.RowHash); err != nil {
+			return nil, err
+		}
+		transactions = append(transactions, t)
+	}
+	return transactions, rows.Err()
+}
+
+// DeleteUser removes a user who owns no files; sessions and webhooks go by
+// cascade and credit transactions lose their user
+func (s *PgStore) DeleteUser(ctx context.Context, userID uuid.UUID) error {
+	tag, err := s.db.Pool.Exec(ctx,
+		"DELETE FROM users WHERE id = $1 AND NOT EXISTS (SELECT 1 FROM files WHERE user_id = $1)",
+		userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete user: %w", err)
+	}
+	if tag.RowsAffected() > 0 {
+		return nil
+	}
+	if _, err := s.GetUserByID(ctx, userID); err != nil {
+		return err
+	}
+	return ErrConflict
+}
+
+// HoldCredits moves credits into the user's held balance if enough are available
+func (s *PgStore) HoldCredits(ctx context.Context, userID uuid.UUID, amount int64) error {
+	tag, err := s.db.Pool.Exec(ctx,
+		`UPDATE users SET credits = credits - $1, held_credits = held_credits + $1, updated_at = $2
+		 WHERE id = $3 AND credits >= $1`,
+		amount, time.Now(), userID)
+	if err != nil {
+		return fmt.Errorf("failed to hold credits: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return s.balanceError(ctx, userID)
+	}
+	return nil
+}
+
+// ReleaseCredits returns held credits to the user's spendable balance
+func (s *PgStore) ReleaseCredits(ctx context.Context, userID uuid.UUID, amount int64) error {
+	tag, err := s.db.Pool.Exec(ctx,
+		`UPDATE users SET credits = credits + $1, held_credits = held_credits - $1, updated_at = $2
+		 WHERE id = $3 AND held_credits >= $1`,
+		amount, time.Now(), userID)
+	if err != nil {
+		return fmt.Errorf("failed to release credits: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return s.balanceError(ctx, userID)
+	}
+	return nil
+}
+
+// CaptureCredits spends held credits and records the debit
+func (s *PgStore) CaptureCredits(ctx context.Context, userID uuid.UUID, amount int64, description string) error {
+	tx, err := s.db.Pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx,
+		"UPDATE users SET held_credits = held_credits - $1, updated_at = $2 WHERE id = $3 AND held_credits >= $1",
+		amount, time.Now(), userID)
+	if err != nil {
+		return fmt.Errorf("failed to capture credits: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return s.balanceError(ctx, userID)
+	}
+
+	err = recordTransaction(ctx, tx, &models.CreditTransaction{
+		UserID:          &userID,
+		TransactionType: "debit",
+		Amount:          -amount,
+		Description:     description,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record transaction: %w", err)
+	}
+
+	return tx.Commit(ctx)
+}
+
+// balanceError explains why a conditional balance update matched no row
+func (s *PgStore) balanceError(ctx context.Context, userID uuid.UUID) error {
+	if _, err := s.GetUserByID(ctx, userID); err != nil {
+		return err
+	}
+	return ErrInsufficientCredits
+}
+
+// CreateFile inserts a file record
+func (s *PgStore) CreateFile(ctx context.Context, file *models.File) error {
+	_, err := s.db.Pool.Exec(ctx,
+		`INSERT INTO files (id, user_id, filename, size_bytes, mime_type, encryption_key, cipher, status, chunk_count, expires_at, version, parent_file_id)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`,
+		file.ID, file.UserID, file.Filename, file.SizeBytes, file.MimeType,
+		file.EncryptionKey, file.Cipher, file.Status, file.ChunkCount, file.ExpiresAt, file.Version, file.ParentFileID)
+	if isUniqueViolation(err) {
+		return ErrConflict
+	}
+	return err
+}
+
+// GetFile retrieves a file by ID
+func (s *PgStore) GetFile(ctx context.Context, fileID uuid.UUID) (*models.File, error) {
+	var file models.File
+	err := s.db.Pool.QueryRow(ctx,
+		`SELECT id, user_id, filename, size_bytes, mime_type, encryption_key, cipher, status, chunk_count,
+		        COALESCE(content_sha256, ''), expires_at, version, parent_file_id, revision, replicas,
+		        ARRAY(SELECT tag FROM file_tags WHERE file_id = files.id ORDER BY tag), created_at, updated_at
+		 FROM files WHERE id = $1`,
+		fileID).Scan(
+		&file.ID, &file.UserID, &file.Filename, &file.SizeBytes, &file.MimeType,
+		&file.EncryptionKey, &file.Cipher, &file.Status, &file.ChunkCount, &file.ContentSHA256, &file.ExpiresAt,
+		&file.Version, &file.ParentFileID, &file.Revision, &file.Replicas, &file.Tags, &file.CreatedAt, &file.UpdatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+// ListFilesByUser retrieves a user's files with their tags, newest first
+func (s *PgStore) ListFilesByUser(ctx context.Context, userID uuid.UUID, tags []string) ([]models.File, error) {
+	if tags == nil {
+		tags = []string{}
+	}
+	rows, err := s.db.Pool.Query(ctx,
+		`SELECT f.id, f.user_id, f.filename, f.size_bytes, f.mime_type, f.cipher, f.status, f.chunk_count,
+		        COALESCE(f.content_sha256, ''), f.expires_at, f.version, f.parent_file_id, f.revision, f.replicas,
+		        COALESCE(array_agg(ft.tag ORDER BY ft.tag) FILTER (WHERE ft.tag IS NOT NULL), '{}')::text[],
+		        f.created_at, f.updated_at
+		 FROM files f
+		 LEFT JOIN file_tags ft ON ft.file_id = f.id
+		 WHERE f.user_id = $1
+		 GROUP BY f.id
+		 HAVING COALESCE(array_agg(ft.tag) FILTER (WHERE ft.tag IS NOT NULL), '{}')::text[] @> $2::text[]
+		 ORDER BY f.created_at DESC`,
+		userID, tags)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []models.File
+	for rows.Next() {
+		var f models.File
+		err := rows.Scan(
+			&f.ID, &f.UserID, &f.Filename, &f.SizeBytes, &f.MimeType,
+			&f.Cipher, &f.Status, &f.ChunkCount, &f.ContentSHA256, &f.ExpiresAt, &f.Version, &f.ParentFileID,
+			&f.Revision, &f.Replicas, &f.Tags, &f.CreatedAt, &f.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, rows.Err()
+}
+
+// LatestFileByName returns the user's highest-versioned file with this name
+func (s *PgStore) LatestFileByName(ctx context.Context, userID uuid.UUID, filename string) (*models.File, error) {
+	var f models.File
+	err := s.db.Pool.QueryRow(ctx,
+		`SELECT id, user_id, filename, size_bytes, mime_type, status, chunk_count, version, parent_file_id, created_at, updated_at
+		 FROM files WHERE user_id = $1 AND filename = $2
+		 ORDER BY version DESC, created_at DESC LIMIT 1`,
+		userID, filename).Scan(
+		&f.ID, &f.UserID, &f.Filename, &f.SizeBytes, &f.MimeType, &f.Status, &f.ChunkCount,
+		&f.Version, &f.ParentFileID, &f.CreatedAt, &f.UpdatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// ListFileVersions returns a file's version history, oldest version first
+func (s *PgStore) ListFileVersions(ctx context.Context, rootID uuid.UUID) ([]models.File, error) {
+	rows, err := s.db.Pool.Query(ctx,
+		`SELECT id, user_id, filename, size_bytes, mime_type, cipher, status, chunk_count,
+		        COALESCE(content_sha256, ''), expires_at, version, parent_file_id, revision, replicas, created_at, updated_at
+		 FROM files WHERE id = $1 OR parent_file_id = $1
+		 ORDER BY version`,
+		rootID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []models.File
+	for rows.Next() {
+		var f models.File
+		err := rows.Scan(&f.ID, &f.UserID, &f.Filename, &f.SizeBytes, &f.MimeType, &f.Cipher, &f.Status, &f.ChunkCount,
+			&f.ContentSHA256, &f.ExpiresAt, &f.Version, &f.ParentFileID, &f.Revision, &f.Replicas, &f.CreatedAt, &f.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, rows.Err()
+}
+
+// SetFileStatus updates a file's status
+func (s *PgStore) SetFileStatus(ctx context.Context, fileID uuid.UUID, status string) error {
+	_, err := s.db.Pool.Exec(ctx,
+		"UPDATE files SET status = $1, revision = revision + 1, updated_at = $2 WHERE id = $3",
+		status, time.Now(), fileID)
+	return err
+}
+
+// SwapFileStatus moves a file from one status to another if it is currently in from
+func (s *PgStore) SwapFileStatus(ctx context.Context, fileID uuid.UUID, from, to string) (bool, error) {
+	tag, err := s.db.Pool.Exec(ctx,
+		"UPDATE files SET status = $1, revision = revision + 1, updated_at = $2 WHERE id = $3 AND status = $4",
+		to, time.Now(), fileID, from)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// SetFileContentHash records the SHA-256 of a file's plaintext
+func (s *PgStore) SetFileContentHash(ctx context.Context, fileID uuid.UUID, sha256Hex string) error {
+	_, err := s.db.Pool.Exec(ctx,
+		"UPDATE files SET content_sha256 = $1, revision = revision + 1, updated_at = $2 WHERE id = $3",
+		sha256Hex, time.Now(), fileID)
+	return err
+}
+
+// SetFileReplicas records how many replicas a file was charged for
+func (s *PgStore) SetFileReplicas(ctx context.Context, fileID uuid.UUID, replicas int) error {
+	_, err := s.db.Pool.Exec(ctx,
+		"UPDATE files SET replicas = $1, revision = revision + 1, updated_at = $2 WHERE id = $3",
+		replicas, time.Now(), fileID)
+	return err
+}
+
+// SetFileExpiry sets or, with nil, clears a file's expiry
+func (s *PgStore) SetFileExpiry(ctx context.Context, fileID uuid.UUID, expiresAt *time.Time) error {
+	_, err := s.db.Pool.Exec(ctx,
+		"UPDATE files SET expires_at = $1, revision = revision + 1, updated_at = $2 WHERE id = $3",
+		expiresAt, time.Now(), fileID)
+	return err
+}
+
+// ListExpiredFiles returns files whose expiry is at or before now, oldest first
+func (s *PgStore) ListExpiredFiles(ctx context.Context, now time.Time) ([]models.File, error) {
+	rows, err := s.db.Pool.Query(ctx,
+		`SELECT id, user_id, filename, size_bytes, mime_type, status, chunk_count, expires_at, replicas, created_at, updated_at
+		 FROM files WHERE expires_at IS NOT NULL AND expires_at <= $1
+		 ORDER BY expires_at`,
+		now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []models.File
+	for rows.Next() {
+		var f models.File
+		err := rows.Scan(&f.ID, &f.UserID, &f.Filename, &f.SizeBytes, &f.MimeType,
+			&f.Status, &f.ChunkCount, &f.ExpiresAt, &f.Replicas, &f.CreatedAt, &f.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, rows.Err()
+}
+
+// DeleteFile deletes a file and, by cascade, its chunks. Deleting the first
+// version of a history promotes the next version to anchor the rest.
+func (s *PgStore) DeleteFile(ctx context.Context, fileID uuid.UUID) error {
+	tx, err := s.db.Pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var newRoot uuid.UUID
+	err = tx.QueryRow(ctx,
+		"SELECT id FROM files WHERE parent_file_id = $1 ORDER BY version LIMIT 1",
+		fileID).Scan(&newRoot)
+	if err == nil {
+		if _, err := tx.Exec(ctx, "UPDATE files SET parent_file_id = NULL WHERE id = $1", newRoot); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, "UPDATE files SET parent_file_id = $1 WHERE parent_file_id = $2", newRoot, fileID); err != nil {
+			return err
+		}
+	} else if !errors.Is(err, pgx.ErrNoRows) {
+		return err
+	}
+
+	if _, err := tx.Exec(ctx, "DELETE FROM files WHERE id = $1", fileID); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// SetChunkData replaces a chunk's stored data
+func (s *PgStore) SetChunkData(ctx context.Context, chunkID uuid.UUID, data []byte) error {
+	result, err := s.db.Pool.Exec(ctx, "UPDATE chunks SET data = $1 WHERE id = $2", data, chunkID)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// RekeyFile replaces a file's key and chunk data in one transaction
+func (s *PgStore) RekeyFile(ctx context.Context, fileID uuid.UUID, rekey func(oldKey []byte, chunks map[int][]byte) ([]byte, map[int][]byte, error)) error {
+	tx, err := s.db.Pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var oldKey []byte
+	err = tx.QueryRow(ctx, "SELECT encryption_key FROM files WHERE id = $1 FOR UPDATE", fileID).Scan(&oldKey)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(ctx,
+		"SELECT chunk_index, data FROM chunks WHERE file_id = $1 ORDER BY chunk_index FOR UPDATE",
+		fileID)
+	if err != nil {
+		return fmt.Errorf("failed to read chunks: %w", err)
+	}
+	chunks := make(map[int][]byte)
+	for rows.Next() {
+		var chunkIndex int
+		var data []byte
+		if err := rows.Scan(&chunkIndex, &data); err != nil {
+			rows.Close()
+			return err
+		}
+		chunks[chunkIndex] = data
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	newKey, updated, err := rekey(oldKey, chunks)
+	if err != nil {
+		return err
+	}
+
+	for chunkIndex, data := range updated {
+		hash := sha256.Sum256(data)
+		_, err := tx.Exec(ctx,
+			"UPDATE chunks SET data = $1, hash = $2, size_bytes = $3, merkle_root = $4, format = $5 WHERE file_id = $6 AND chunk_index = $7",
+			data, hex.EncodeToString(hash[:]), len(data), hex.EncodeToString(merkle.Root(data)), chunkformat.Version(data), fileID, chunkIndex)
+		if err != nil {
+			return fmt.Errorf("failed to update chunk %d: %w", chunkIndex, err)
+		}
+	}
+
+	_, err = tx.Exec(ctx,
+		`UPDATE chunk_assignments SET status = 'stale'
+		 WHERE status = 'active' AND chunk_id IN (SELECT id FROM chunks WHERE file_id = $1)`,
+		fileID)
+	if err != nil {
+		return fmt.Errorf("failed to mark replicas stale: %w", err)
+	}
+
+	_, err = tx.Exec(ctx,
+		"UPDATE files SET encryption_key = $1, revision = revision + 1, updated_at = $2 WHERE id = $3",
+		newKey, time.Now(), fileID)
+	if err != nil {
+		return fmt.Errorf("failed to update file key: %w", err)
+	}
+
+	return tx.Commit(ctx)
+}
+
+// AddFileTags adds tags to a file, ignoring ones it already has
+func (s *PgStore) AddFileTags(ctx context.Context, fileID uuid.UUID, tags []string) error {
+	tagResult, err := s.db.Pool.Exec(ctx,
+		`INSERT INTO file_tags (file_id, tag)
+		 SELECT $1, unnest($2::text[])
+		 ON CONFLICT DO NOTHING`,
+		fileID, tags)
+	if err != nil {
+		return err
+	}
+	if tagResult.RowsAffected() == 0 {
+		return nil
+	}
+	return s.bumpFileRevision(ctx, fileID)
+}
+
+// RemoveFileTag deletes a tag from a file
+func (s *PgStore) RemoveFileTag(ctx context.Context, fileID uuid.UUID, tag string) error {
+	tagResult, err := s.db.Pool.Exec(ctx,
+		"DELETE FROM file_tags WHERE file_id = $1 AND tag = $2",
+		fileID, tag)
+	if err != nil {
+		return err
+	}
+	if tagResult.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return s.bumpFileRevision(ctx, fileID)
+}
+
+// bumpFileRevision records a change to a file held outside its row, such as its tags
+func (s *PgStore) bumpFileRevision(ctx context.Context, fileID uuid.UUID) error {
+	_, err := s.db.Pool.Exec(ctx,
+		"UPDATE files SET revision = revision + 1, updated_at = $1 WHERE id = $2",
+		time.Now(), fileID)
+	return err
+}
+
+// ClaimFileRevision advances a file's revision if it currently equals revision
+func (s *PgStore) ClaimFileRevision(ctx context.Context, fileID uuid.UUID, revision int) (bool, error) {
+	tag, err := s.db.Pool.Exec(ctx,
+		"UPDATE files SET revision = revision + 1, updated_at = $1 WHERE id = $2 AND revision = $3",
+		time.Now(), fileID, revision)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// ListFileTags retrieves a file's tags in alphabetical order
+func (s *PgStore) ListFileTags(ctx context.Context, fileID uuid.UUID) ([]string, error) {
+	tags := []string{}
+	rows, err := s.db.Pool.Query(ctx,
+		"SELECT tag FROM file_tags WHERE file_id = $1 ORDER BY tag",
+		fileID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+// CreateChunk stores a chunk and its assignments in one transaction, so a
+// failed assignment leaves neither the chunk nor any of its assignments.
+// A second chunk at the same index is ErrConflict.
+func (s *PgStore) CreateChunk(ctx context.Context, chunk *models.Chunk, data []byte, nodeIDs []uuid.UUID) error {
+	tx, err := s.db.Pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx,
+		"INSERT INTO chunks (id, file_id, chunk_index, hash, size_bytes, merkle_root, format, data) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
+		chunk.ID, chunk.FileID, chunk.ChunkIndex, chunk.Hash, chunk.SizeBytes, chunk.MerkleRoot, chunk.Format, data)
+	if isUniqueViolation(err) {
+		return ErrConflict
+	}
+	if err != nil {
+		return fmt.Errorf("failed to insert chunk: %w", err)
+	}
+
+	for _, nodeID := range nodeIDs {
+		_, err := tx.Exec(ctx,
+			"INSERT INTO chunk_assignments (id, chunk_id, node_id) VALUES ($1, $2, $3)",
+			uuid.New(), chunk.ID, nodeID)
+		if err != nil {
+			return fmt.Errorf("failed to create chunk assignment: %w", err)
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+// ListChunks retrieves all chunks for a file, ordered by index
+func (s *PgStore) ListChunks(ctx context.Context, fileID uuid.UUID) ([]models.Chunk, error) {
+	rows, err := s.db.Pool.Query(ctx,
+		`SELECT id, file_id, chunk_index, hash, size_bytes, merkle_root, format, size_bytes > 0 AND COALESCE(length(data), 0) = 0
+		 FROM chunks WHERE file_id = $1 ORDER BY chunk_index`,
+		fileID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var chunks []models.Chunk
+	for rows.Next() {
+		var chunk models.Chunk
+		err := rows.Scan(&chunk.ID, &chunk.FileID, &chunk.ChunkIndex, &chunk.Hash, &chunk.SizeBytes, &chunk.MerkleRoot, &chunk.Format, &chunk.NodeOnly)
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, chunk)
+	}
+	return chunks, rows.Err()
+}
+
+// ListChunkData retrieves the stored data of every chunk of a file, keyed by index
+func (s *PgStore) ListChunkData(ctx context.Context, fileID uuid.UUID) (map[int][]byte, error) {
+	rows, err := s.db.Pool.Query(ctx,
+		"SELECT chunk_index, data FROM chunks WHERE file_id = $1 ORDER BY chunk_index",
+		fileID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	chunks := make(map[int][]byte)
+	for rows.Next() {
+		var chunkIndex int
+		var data []byte
+		err := rows.Scan(&chunkIndex, &data)
+		if err != nil {
+			return nil, err
+		}
+		chunks[chunkIndex] = data
+	}
+	return chunks, rows.Err()
+}
+
+// ListContentHashGroups groups ready files by plaintext hash. Files without
+// a recorded hash make up the group with an empty hash.
+func (s *PgStore) ListContentHashGroups(ctx context.Context) ([]models.ContentHashGroup, error) {
+	rows, err := s.db.Pool.Query(ctx,
+		`SELECT COALESCE(content_sha256, ''), COUNT(*), MAX(size_bytes) FROM files
+		 WHERE status = 'ready' GROUP BY COALESCE(content_sha256, '') ORDER BY 1`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	groups := []models.ContentHashGroup{}
+	for rows.Next() {
+		var g models.ContentHashGroup
+		if err := rows.Scan(&g.Hash, &g.Files, &g.SizeBytes); err != nil {
+			return nil, err
+		}
+		groups = append(groups, g)
+	}
+	return groups, rows.Err()
+}
+
+// ListChunkAssignments retrieves active assignments of a chunk to active nodes
+func (s *PgStore) ListChunkAssignments(ctx context.Context, chunkID uuid.UUID) ([]models.ChunkAssignment, error) {
+	rows, err := s.db.Pool.Query(ctx,
+		`SELECT ca.id, ca.chunk_id, ca.node_id, ca.status, ca.created_at
+		 FROM chunk_assignments ca
+		 JOIN storage_nodes sn ON ca.node_id = sn.id
+		 WHERE ca.chunk_id = $1 AND ca.status = 'active' AND sn.status = 'active'`,
+		chunkID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var assignments []models.ChunkAssignment
+	for rows.Next() {
+		var ca models.ChunkAssignment
+		err := rows.Scan(&ca.ID, &ca.ChunkID, &ca.NodeID, &ca.Status, &ca.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		assignments = append(assignments, ca)
+	}
+	return assignments, rows.Err()
+}
+
+// ListFileAssignments retrieves active assignments of every chunk of a file
+func (s *PgStore) ListFileAssignments(ctx context.Context, fileID uuid.UUID) ([]models.ChunkAssignment, error) {
+	rows, err := s.db.Pool.Query(ctx,
+		`SELECT ca.id, ca.chunk_id, ca.node_id, ca.status, ca.created_at
+		 FROM chunk_assignments ca
+		 JOIN chunks c ON ca.chunk_id = c.id
+		 JOIN storage_nodes sn ON ca.node_id = sn.id
+		 WHERE c.file_id = $1 AND ca.status = 'active' AND sn.status = 'active'`,
+		fileID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var assignments []models.ChunkAssignment
+	for rows.Next() {
+		var ca models.ChunkAssignment
+		err := rows.Scan(&ca.ID, &ca.ChunkID, &ca.NodeID, &ca.Status, &ca.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		assignments = append(assignments, ca)
+	}
+	return assignments, rows.Err()
+}
+
+// GetChunk retrieves a chunk's metadata and data
+func (s *PgStore) GetChunk(ctx context.Context, chunkID uuid.UUID) (*models.Chunk, []byte, error) {
+	var chunk models.Chunk
+	var data []byte
+	err := s.db.Pool.QueryRow(ctx,
+		"SELECT id, file_id, chunk_index, hash, size_bytes, merkle_root, format, data FROM chunks WHERE id = $1",
+		chunkID).Scan(&chunk.ID, &chunk.FileID, &chunk.ChunkIndex, &chunk.Hash, &chunk.SizeBytes, &chunk.MerkleRoot, &chunk.Format, &data)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return &chunk, data, nil
+}
+
+// ListNodeChunks retrieves the chunks actively assigned to a node
+func (s *PgStore) ListNodeChunks(ctx context.Context, nodeID uuid.UUID) ([]models.Chunk, error) {
+	rows, err := s.db.Pool.Query(ctx,
+		`SELECT c.id, c.file_id, c.chunk_index, c.hash, c.size_bytes, c.merkle_root, c.format
+		 FROM chunks c
+		 JOIN chunk_assignments ca ON ca.chunk_id = c.id
+		 WHERE ca.node_id = $1 AND ca.status = 'active'
+		 ORDER BY ca.created_at`,
+		nodeID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var chunks []models.Chunk
+	for rows.Next() {
+		var chunk models.Chunk
+		err := rows.Scan(&chunk.ID, &chunk.FileID, &chunk.ChunkIndex, &chunk.Hash, &chunk.SizeBytes, &chunk.MerkleRoot, &chunk.Format)
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, chunk)
+	}
+	return chunks, rows.Err()
+}
+
+// ListNodeChunkPage retrieves one page of the chunks actively assigned to a node, in ID order
+func (s *PgStore) ListNodeChunkPage(ctx context.Context, nodeID, after uuid.UUID, limit int) ([]models.Chunk, error) {
+	rows, err := s.db.Pool.Query(ctx,
+		`SELECT c.id, c.file_id, c.chunk_index, c.hash, c.size_bytes, c.merkle_root, c.format
+		 FROM chunks c
+		 JOIN chunk_assignments ca ON ca.chunk_id = c.id
+		 WHERE ca.node_id = $1 AND ca.status = 'active' AND c.id > $2
+		 ORDER BY c.id
+		 LIMIT $3`,
+		nodeID, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var chunks []models.Chunk
+	for rows.Next() {
+		var chunk models.Chunk
+		err := rows.Scan(&chunk.ID, &chunk.FileID, &chunk.ChunkIndex, &chunk.Hash, &chunk.SizeBytes, &chunk.MerkleRoot, &chunk.Format)
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, chunk)
+	}
+	return chunks, rows.Err()
+}
+
+// SetChunkAssignment creates or updates the assignment of a chunk to a node
+func (s *PgStore) SetChunkAssignment(ctx context.Context, chunkID, nodeID uuid.UUID, status string) error {
+	_, err := s.db.Pool.Exec(ctx,
+		`INSERT INTO chunk_assignments (id, chunk_id, node_id, status) VALUES ($1, $2, $3, $4)
+		 ON CONFLICT (chunk_id, node_id) DO UPDATE SET status = excluded.status`,
+		uuid.New(), chunkID, nodeID, status)
+	return err
+}
+
+// DeleteChunkAssignment removes the assignment of a chunk to a node
+func (s *PgStore) DeleteChunkAssignment(ctx context.Context, chunkID, nodeID uuid.UUID) error {
+	_, err := s.db.Pool.Exec(ctx,
+		"DELETE FROM chunk_assignments WHERE chunk_id = $1 AND node_id = $2",
+		chunkID, nodeID)
+	return err
+}
+
+// ListStaleAssignments retrieves stale assignments of a file's chunks, or of
+// every file's when fileID is uuid.Nil, oldest first
+func (s *PgStore) ListStaleAssignments(ctx context.Context, fileID uuid.UUID) ([]models.ChunkAssignment, error) {
+	rows, err := s.db.Pool.Query(ctx,
+		`SELECT ca.id, ca.chunk_id, ca.node_id, ca.status, ca.created_at
+		 FROM chunk_assignments ca JOIN chunks c ON ca.chunk_id = c.id
+		 WHERE ca.status = 'stale' AND ($1 = '00000000-0000-0000-0000-000000000000'::uuid OR c.file_id = $1)
+		 ORDER BY ca.created_at`,
+		fileID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var assignments []models.ChunkAssignment
+	for rows.Next() {
+		var ca models.ChunkAssignment
+		if err := rows.Scan(&ca.ID, &ca.ChunkID, &ca.NodeID, &ca.Status, &ca.CreatedAt); err != nil {
+			return nil, err
+		}
+		assignments = append(assignments, ca)
+	}
+	return assignments, rows.Err()
+}
+
+// RecordDrainCopy notes a copy made while sourceNodeID drained
+func (s *PgStore) RecordDrainCopy(ctx context.Context, chunkID, nodeID, sourceNodeID uuid.UUID) error {
+	_, err := s.db.Pool.Exec(ctx,
+		`INSERT INTO drain_copies (chunk_id, node_id, source_node_id) VALUES ($1, $2, $3)
+		 ON CONFLICT (chunk_id, node_id) DO UPDATE SET source_node_id = excluded.source_node_id`,
+		chunkID, nodeID, sourceNodeID)
+	return err
+}
+
+// ListDrainCopies returns the copies made while sourceNodeID drained, oldest first
+func (s *PgStore) ListDrainCopies(ctx context.Context, sourceNodeID uuid.UUID) ([]models.DrainCopy, error) {
+	rows, err := s.db.Pool.Query(ctx,
+		`SELECT chunk_id, node_id, source_node_id, created_at FROM drain_copies
+		 WHERE source_node_id = $1 ORDER BY created_at, chunk_id`,
+		sourceNodeID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var copies []models.DrainCopy
+	for rows.Next() {
+		var c models.DrainCopy
+		if err := rows.Scan(&c.ChunkID, &c.NodeID, &c.SourceNodeID, &c.CreatedAt); err != nil {
+			return nil, err
+		}
+		copies = append(copies, c)
+	}
+	return copies, rows.Err()
+}
+
+// DeleteDrainCopy forgets a drain copy
+func (s *PgStore) DeleteDrainCopy(ctx context.Context, chunkID, nodeID uuid.UUID) error {
+	_, err := s.db.Pool.Exec(ctx,
+		"DELETE FROM drain_copies WHERE chunk_id = $1 AND node_id = $2",
+		chunkID, nodeID)
+	return err
+}
+
+// CreateUploadSession inserts an upload session
+func (s *PgStore) CreateUploadSession(ctx context.Context, session *models.UploadSession) error {
+	_, err := s.db.Pool.Exec(ctx,
+		`INSERT INTO upload_sessions (id, user_id, filename, size_bytes, encryption_key, cipher, chunk_count, chunk_size, last_chunk_size, received_chunks, status, expires_at, file_expires_at, versioned, direct, held_credits)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)`,
+		session.ID, session.UserID, session.Filename, session.SizeBytes,
+		session.EncryptionKey, session.Cipher, session.ChunkCount, session.ChunkSize, session.LastChunkSize, session.ReceivedChunks,
+		session.Status, session.ExpiresAt, session.FileExpiresAt, session.Versioned, session.Direct, session.HeldCredits)
+	return err
+}
+
+// GetUploadSession retrieves an upload session
+func (s *PgStore) GetUploadSession(ctx context.Context, sessionID uuid.UUID) (*models.UploadSession, error) {
+	var session models.UploadSession
+	err := s.db.Pool.QueryRow(ctx,
+		`SELECT id, user_id, file_id, filename, size_bytes, encryption_key, cipher, chunk_count, chunk_size, last_chunk_size, received_chunks, status, expires_at, file_expires_at, versioned, direct, held_credits
+		 FROM upload_sessions WHERE id = $1`,
+		sessionID).Scan(
+		&session.ID, &session.UserID, &session.FileID, &session.Filename,
+		&session.SizeBytes, &session.EncryptionKey, &session.Cipher, &session.ChunkCount, &session.ChunkSize, &session.LastChunkSize,
+		&session.ReceivedChunks, &session.Status, &session.ExpiresAt, &session.FileExpiresAt, &session.Versioned,
+		&session.Direct, &session.HeldCredits)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// SetUploadSessionStatus updates an upload session's status
+func (s *PgStore) SetUploadSessionStatus(ctx context.Context, sessionID uuid.UUID, status string) error {
+	_, err := s.db.Pool.Exec(ctx,
+		"UPDATE upload_sessions SET status = $1 WHERE id = $2",
+		status, sessionID)
+	return err
+}
+
+// SwapUploadSessionStatus moves a session from one status to another if it is currently in from
+func (s *PgStore) SwapUploadSessionStatus(ctx context.Context, sessionID uuid.UUID, from, to string) (bool, error) {
+	tag, err := s.db.Pool.Exec(ctx,
+		"UPDATE upload_sessions SET status = $1 WHERE id = $2 AND status = $3",
+		to, sessionID, from)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// ListExpiredUploadSessions returns active sessions whose expiry is at or before now
+func (s *PgStore) ListExpiredUploadSessions(ctx context.Context, now time.Time) ([]models.UploadSession, error) {
+	rows, err := s.db.Pool.Query(ctx,
+		`SELECT id, user_id, file_id, filename, size_bytes, status, expires_at, held_credits, created_at
+		 FROM upload_sessions WHERE status = 'active' AND expires_at <= $1
+		 ORDER BY expires_at`,
+		now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []models.UploadSession
+	for rows.Next() {
+		var sess models.UploadSession
+		err := rows.Scan(&sess.ID, &sess.UserID, &sess.FileID, &sess.Filename, &sess.SizeBytes,
+			&sess.Status, &sess.ExpiresAt, &sess.HeldCredits, &sess.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, sess)
+	}
+	return sessions, rows.Err()
+}
+
+// ListAbandonedUploadFiles returns the files, still uploading, of sessions
+// closed without completing. A session's file takes its ID if it was never linked.
+func (s *PgStore) ListAbandonedUploadFiles(ctx context.Context) ([]models.File, error) {
+	rows, err := s.db.Pool.Query(ctx,
+		`SELECT id, user_id, filename, size_bytes, mime_type, status, chunk_count, expires_at, replicas, created_at, updated_at
+		 FROM files WHERE status = 'uploading' AND id IN (
+		     SELECT COALESCE(file_id, id) FROM upload_sessions WHERE status NOT IN ('active', 'completed'))
+		 ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []models.File
+	for rows.Next() {
+		var f models.File
+		err := rows.Scan(&f.ID, &f.UserID, &f.Filename, &f.SizeBytes, &f.MimeType,
+			&f.Status, &f.ChunkCount, &f.ExpiresAt, &f.Replicas, &f.CreatedAt, &f.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, rows.Err()
+}
+
+// SetUploadSessionFile links an upload session to the file it is creating
+func (s *PgStore) SetUploadSessionFile(ctx context.Context, sessionID, fileID uuid.UUID) error {
+	_, err := s.db.Pool.Exec(ctx,
+		"UPDATE upload_sessions SET file_id = $1 WHERE id = $2",
+		fileID, sessionID)
+	return err
+}
+
+// CountActiveUploadSessions counts a user's active sessions that expire after now
+func (s *PgStore) CountActiveUploadSessions(ctx context.Context, userID uuid.UUID, now time.Time) (int, error) {
+	var count int
+	err := s.db.Pool.QueryRow(ctx,
+		"SELECT COUNT(*) FROM upload_sessions WHERE user_id = $1 AND status = 'active' AND expires_at > $2",
+		userID, now).Scan(&count)
+	return count, err
+}
+
+// CreateNodeInvite inserts a node invite
+func (s *PgStore) CreateNodeInvite(ctx context.Context, invite *models.NodeInvite) error {
+	err := s.db.Pool.QueryRow(ctx,
+		`INSERT INTO node_invites (id, token_hash, note, expires_at)
+		 VALUES ($1, $2, $3, $4)
+		 RETURNING created_at`,
+		invite.ID, invite.TokenHash, invite.Note, invite.ExpiresAt).Scan(&invite.CreatedAt)
+	if isUniqueViolation(err) {
+		return ErrConflict
+	}
+	return err
+}
+
+// RedeemNodeInvite marks a usable invite as used in a single statement, so
+// concurrent registrations can't both redeem it
+func (s *PgStore) RedeemNodeInvite(ctx context.Context, tokenHash string, now time.Time) (*models.NodeInvite, error) {
+	var invite models.NodeInvite
+	err := s.db.Pool.QueryRow(ctx,
+		`UPDATE node_invites SET used_at = $2
+		 WHERE token_hash = $1 AND used_at IS NULL AND (expires_at IS NULL OR expires_at > $2)
+		 RETURNING id, token_hash, note, expires_at, used_at, created_at`,
+		tokenHash, now).Scan(&invite.ID, &invite.TokenHash, &invite.Note, &invite.ExpiresAt, &invite.UsedAt, &invite.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &invite, nil
+}
+
+// RestoreNodeInvite clears an invite's use
+func (s *PgStore) RestoreNodeInvite(ctx context.Context, inviteID uuid.UUID) error {
+	_, err := s.db.Pool.Exec(ctx,
+		"UPDATE node_invites SET used_at = NULL WHERE id = $1",
+		inviteID)
+	return err
+}
+
+// AddNodeExclusion inserts an exclusion or updates the reason of an existing one
+func (s *PgStore) AddNodeExclusion(ctx context.Context, exclusion *models.NodeExclusion) error {
+	return s.db.Pool.QueryRow(ctx,
+		`INSERT INTO node_exclusions (peer_id, reason) VALUES ($1, $2)
+		 ON CONFLICT (peer_id) DO UPDATE SET reason = EXCLUDED.reason
+		 RETURNING created_at`,
+		exclusion.PeerID, exclusion.Reason).Scan(&exclusion.CreatedAt)
+}
+
+// RemoveNodeExclusion deletes a peer's exclusion
+func (s *PgStore) RemoveNodeExclusion(ctx context.Context, peerID string) error {
+	tag, err := s.db.Pool.Exec(ctx, "DELETE FROM node_exclusions WHERE peer_id = $1", peerID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ListNodeExclusions returns every exclusion, oldest first
+func (s *PgStore) ListNodeExclusions(ctx context.Context) ([]models.NodeExclusion, error) {
+	rows, err := s.db.Pool.Query(ctx,
+		"SELECT peer_id, reason, created_at FROM node_exclusions ORDER BY created_at, peer_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var exclusions []models.NodeExclusion
+	for rows.Next() {
+		var e models.NodeExclusion
+		if err := rows.Scan(&e.PeerID, &e.Reason, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		exclusions = append(exclusions, e)
+	}
+	return exclusions, rows.Err()
+}
+
+// CreateWebhook inserts a webhook
+func (s *PgStore) CreateWebhook(ctx context.Context, hook *models.Webhook) error {
+	return s.db.Pool.QueryRow(ctx,
+		`INSERT INTO webhooks (id, user_id, url, secret, events)
+		 VALUES ($1, $2, $3, $4, $5)
+		 RETURNING created_at`,
+		hook.ID, hook.UserID, hook.URL, hook.Secret, hook.Events).Scan(&hook.CreatedAt)
+}
+
+// GetWebhook retrieves a webhook by ID
+func (s *PgStore) GetWebhook(ctx context.Context, webhookID uuid.UUID) (*models.Webhook, error) {
+	var hook models.Webhook
+	err := s.db.Pool.QueryRow(ctx,
+		"SELECT id, user_id, url, secret, events, created_at FROM webhooks WHERE id = $1",
+		webhookID).Scan(&hook.ID, &hook.UserID, &hook.URL, &hook.Secret, &hook.Events, &hook.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &hook, nil
+}
+
+// ListWebhooks returns a user's webhooks, or all of them, oldest first
+func (s *PgStore) ListWebhooks(ctx context.Context, userID *uuid.UUID) ([]models.Webhook, error) {
+	rows, err := s.db.Pool.Query(ctx,
+		`SELECT id, user_id, url, secret, events, created_at FROM webhooks
+		 WHERE $1::uuid IS NULL OR user_id = $1
+		 ORDER BY created_at`,
+		userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hooks []models.Webhook
+	for rows.Next() {
+		var hook models.Webhook
+		if err := rows.Scan(&hook.ID, &hook.UserID, &hook.URL, &hook.Secret, &hook.Events, &hook.CreatedAt); err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks, rows.Err()
+}
+
+// DeleteWebhook removes a webhook; its deliveries go with it by cascade
+func (s *PgStore) DeleteWebhook(ctx context.Context, webhookID uuid.UUID) error {
+	tag, err := s.db.Pool.Exec(ctx, "DELETE FROM webhooks WHERE id = $1", webhookID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// QueueWebhookDeliveries inserts deliveries in one batch
+func (s *PgStore) QueueWebhookDeliveries(ctx context.Context, deliveries []models.WebhookDelivery) error {
+	batch := &pgx.Batch{}
+	for _, d := range deliveries {
+		batch.Queue(
+			`INSERT INTO webhook_deliveries (id, webhook_id, event, payload, status, next_attempt_at)
+			 VALUES ($1, $2, $3, $4, $5, $6)`,
+			d.ID, d.WebhookID, d.Event, d.Payload, d.Status, d.NextAttemptAt)
+	}
+	return s.db.Pool.SendBatch(ctx, batch).Close()
+}
+
+// ListDueWebhookDeliveries returns pending deliveries due by now
+func (s *PgStore) ListDueWebhookDeliveries(ctx context.Context, now time.Time, limit int) ([]models.WebhookDelivery, error) {
+	rows, err := s.db.Pool.Query(ctx,
+		`SELECT id, webhook_id, event, payload, status, attempts, next_attempt_at, last_error, created_at
+		 FROM webhook_deliveries WHERE status = 'pending' AND next_attempt_at <= $1
+		 ORDER BY next_attempt_at
+		 LIMIT $2`,
+		now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []models.WebhookDelivery
+	for rows.Next() {
+		var d models.WebhookDelivery
+		err := rows.Scan(&d.ID, &d.WebhookID, &d.Event, &d.Payload, &d.Status, &d.Attempts,
+			&d.NextAttemptAt, &d.LastError, &d.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// UpdateWebhookDelivery records a delivery attempt
+func (s *PgStore) UpdateWebhookDelivery(ctx context.Context, delivery *models.WebhookDelivery) error {
+	_, err := s.db.Pool.Exec(ctx,
+		`UPDATE webhook_deliveries SET status = $1, attempts = $2, next_attempt_at = $3, last_error = $4
+		 WHERE id = $5`,
+		delivery.Status, delivery.Attempts, delivery.NextAttemptAt, delivery.LastError, delivery.ID)
+	return err
+}
+
+// PruneWebhookDeliveries removes settled deliveries queued before before
+func (s *PgStore) PruneWebhookDeliveries(ctx context.Context, before time.Time) (int64, error) {
+	tag, err := s.db.Pool.Exec(ctx,
+		"DELETE FROM webhook_deliveries WHERE status <> 'pending' AND created_at < $1", before)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// GetReadOnlyMode returns the read-only mode last saved, or nil if none was
+func (s *PgStore) GetReadOnlyMode(ctx context.Context) (*models.ReadOnlyMode, error) {
+	var mode models.ReadOnlyMode
+	err := s.db.Pool.QueryRow(ctx, "SELECT enabled, reason, since FROM read_only_mode").
+		Scan(&mode.Enabled, &mode.Reason, &mode.Since)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &mode, nil
+}
+
+// SetReadOnlyMode saves the read-only mode
+func (s *PgStore) SetReadOnlyMode(ctx context.Context, mode *models.ReadOnlyMode) error {
+	_, err := s.db.Pool.Exec(ctx,
+		`INSERT INTO read_only_mode (enabled, reason, since) VALUES ($1, $2, $3)
+		 ON CONFLICT (id) DO UPDATE SET enabled = EXCLUDED.enabled, reason = EXCLUDED.reason, since = EXCLUDED.since`,
+		mode.Enabled, mode.Reason, mode.Since)
+	return err
+}
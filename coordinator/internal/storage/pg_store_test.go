@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/federated-storage/coordinator/internal/models"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestPgStore_CreateChunkRollsBack runs against the scratch database named by TEST_DATABASE_URL
+func TestPgStore_CreateChunkRollsBack(t *testing.T) {
+	databaseURL := os.Getenv("TEST_DATABASE_URL")
+	if databaseURL == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+
+	db, err := New(databaseURL)
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.Migrate(migrationsDir))
+
+	ctx := context.Background()
+	store := NewPgStore(db)
+	user := &models.User{ID: uuid.New(), Email: uuid.NewString() + "@example.com", PasswordHash: "x"}
+	require.NoError(t, store.CreateUser(ctx, user))
+	file := &models.File{ID: uuid.New(), UserID: user.ID, Filename: "f", EncryptionKey: []byte("k"), Cipher: "aes-256-gcm", Status: "uploading", Version: 1}
+	require.NoError(t, store.CreateFile(ctx, file))
+
+	nodeID := uuid.New()
+	_, err = db.Pool.Exec(ctx,
+		"INSERT INTO storage_nodes (id, name, peer_id, public_key, api_key_hash) VALUES ($1, 'n', $2, 'pk', 'key')",
+		nodeID, uuid.NewString())
+	require.NoError(t, err)
+
+	// The first assignment inserts, the second references a node that does not exist
+	chunk := &models.Chunk{ID: uuid.New(), FileID: file.ID, ChunkIndex: 0, Hash: "h", SizeBytes: 4}
+	err = store.CreateChunk(ctx, chunk, []byte("data"), []uuid.UUID{nodeID, uuid.New()})
+	require.Error(t, err)
+
+	chunks, err := store.ListChunks(ctx, file.ID)
+	require.NoError(t, err)
+	assert.Empty(t, chunks, "No chunk row should survive a failed assignment")
+	held, err := store.ListNodeChunks(ctx, nodeID)
+	require.NoError(t, err)
+	assert.Empty(t, held)
+}
+
+// TestPgStore_CreditChain runs against the scratch database named by TEST_DATABASE_URL
+func TestPgStore_CreditChain(t *testing.T) {
+	databaseURL := os.Getenv("TEST_DATABASE_URL")
+	if databaseURL == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+
+	db, err := New(databaseURL)
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.Migrate(migrationsDir))
+
+	ctx := context.Background()
+	store := NewPgStore(db)
+	user := &models.User{ID: uuid.New(), Email: uuid.NewString() + "@example.com", PasswordHash: "x"}
+	require.NoError(t, store.CreateUser(ctx, user))
+	require.NoError(t, store.AddCredits(ctx, user.ID, 1000, "credit", "purchase"))
+	require.NoError(t, store.HoldCredits(ctx, user.ID, 300))
+	require.NoError(t, store.CaptureCredits(ctx, user.ID, 300, "upload"))
+	require.NoError(t, store.AddCredits(ctx, user.ID, -50, "debit", "download"))
+
+	transactions, err := store.ListCreditTransactions(ctx, user.ID)
+	require.NoError(t, err)
+	require.Len(t, transactions, 3)
+	assert.NoError(t, VerifyCreditChain(transactions), "Hashes must survive the round trip through the database")
+
+	_, err = db.Pool.Exec(ctx, "UPDATE credit_transactions SET amount = -30 WHERE id = $1", transactions[1].ID)
+	require.NoError(t, err)
+	transactions, err = store.ListCreditTransactions(ctx, user.ID)
+	require.NoError(t, err)
+	assert.ErrorIs(t, VerifyCreditChain(transactions), ErrCreditChainBroken)
+}
@@ -2,12 +2,14 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 
 	"github.com/golang-migrate/migrate/v4"
 	_ "github.com/golang-migrate/migrate/v4/database/postgres"
+	"github.com/golang-migrate/migrate/v4/source"
 	_ "github.com/golang-migrate/migrate/v4/source/file"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
@@ -42,22 +44,118 @@ func (db *DB) Close() {
 	db.Pool.Close()
 }
 
+// Migration is one migration file, identified by its version
+type Migration struct {
+	Version uint   `json:"version"`
+	Name    string `json:"name"` // the file name between the version and .up.sql
+}
+
+// MigrationStatus is the schema's version and the migrations not yet applied to it
+type MigrationStatus struct {
+	Version uint        `json:"version"` // 0 when no migration has been applied
+	Dirty   bool        `json:"dirty"`   // a migration failed partway and needs repair by hand
+	Pending []Migration `json:"pending"` // in the order they would be applied
+}
+
 // Migrate runs database migrations
 func (db *DB) Migrate(migrationsPath string) error {
+	m, err := db.migrator(migrationsPath)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	if err := m.Up(); err != nil && err != migrate.ErrNoChange {
+		return fmt.Errorf("failed to run migrations: %w", err)
+	}
+
+	return nil
+}
+
+// MigrationStatus reports the schema's version and the migrations Migrate
+// would apply, without applying any
+func (db *DB) MigrationStatus(migrationsPath string) (*MigrationStatus, error) {
+	available, err := ListMigrations(migrationsPath)
+	if err != nil {
+		return nil, err
+	}
+	m, err := db.migrator(migrationsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer m.Close()
+
+	status := &MigrationStatus{}
+	status.Version, status.Dirty, err = m.Version()
+	if err != nil && !errors.Is(err, migrate.ErrNilVersion) {
+		return nil, fmt.Errorf("failed to read schema version: %w", err)
+	}
+	status.Pending = PendingMigrations(available, status.Version)
+	return status, nil
+}
+
+// ListMigrations returns the migrations in migrationsPath, oldest first
+func ListMigrations(migrationsPath string) ([]Migration, error) {
+	absPath, err := resolveMigrationsPath(migrationsPath)
+	if err != nil {
+		return nil, err
+	}
+	src, err := source.Open("file://" + absPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open migrations: %w", err)
+	}
+	defer src.Close()
+
+	var migrations []Migration
+	version, err := src.First()
+	for err == nil {
+		r, name, readErr := src.ReadUp(version)
+		if readErr != nil {
+			return nil, fmt.Errorf("failed to read migration %d: %w", version, readErr)
+		}
+		r.Close()
+		migrations = append(migrations, Migration{Version: version, Name: name})
+		version, err = src.Next(version)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to list migrations: %w", err)
+	}
+	return migrations, nil
+}
+
+// PendingMigrations returns the migrations newer than version
+func PendingMigrations(migrations []Migration, version uint) []Migration {
+	pending := []Migration{}
+	for _, m := range migrations {
+		if m.Version > version {
+			pending = append(pending, m)
+		}
+	}
+	return pending
+}
+
+// resolveMigrationsPath resolves migrationsPath, checking that it exists
+func resolveMigrationsPath(migrationsPath string) (string, error) {
+	absPath, err := filepath.Abs(migrationsPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to get absolute path: %w", err)
+	}
+	if _, err := os.Stat(absPath); os.IsNotExist(err) {
+		return "", fmt.Errorf("migrations directory does not exist: %s", absPath)
+	}
+	return absPath, nil
+}
+
+// migrator connects golang-migrate to the database and migrationsPath
+func (db *DB) migrator(migrationsPath string) (*migrate.Migrate, error) {
 	// Get database URL from pool config
 	config := db.Pool.Config().ConnConfig
 	databaseURL := fmt.Sprintf("postgres://%s:%s@%s:%d/%s?sslmode=%s",
 		config.User, config.Password, config.Host, config.Port, config.Database, "disable")
 
-	// Convert to absolute path
-	absPath, err := filepath.Abs(migrationsPath)
+	absPath, err := resolveMigrationsPath(migrationsPath)
 	if err != nil {
-		return fmt.Errorf("failed to get absolute path: %w", err)
-	}
-
-	// Check if migrations directory exists
-	if _, err := os.Stat(absPath); os.IsNotExist(err) {
-		return fmt.Errorf("migrations directory does not exist: %s", absPath)
+		return nil, err
 	}
 
 	// Use file source with file:// URL scheme
@@ -66,12 +164,7 @@ func (db *DB) Migrate(migrationsPath string) error {
 		databaseURL,
 	)
 	if err != nil {
-		return fmt.Errorf("failed to create migrate instance: %w", err)
+		return nil, fmt.Errorf("failed to create migrate instance: %w", err)
 	}
-
-	if err := m.Up(); err != nil && err != migrate.ErrNoChange {
-		return fmt.Errorf("failed to run migrations: %w", err)
-	}
-
-	return nil
+	return m, nil
 }
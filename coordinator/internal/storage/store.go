@@ -0,0 +1,183 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/federated-storage/coordinator/internal/models"
+	"github.com/google/uuid"
+)
+
+// ErrNotFound is returned when a requested record does not exist
+var ErrNotFound = errors.New("not found")
+
+// ErrConflict is returned when a record violates a uniqueness constraint
+var ErrConflict = errors.New("already exists")
+
+// ErrInsufficientCredits is returned when a balance is too low for a hold or capture
+var ErrInsufficientCredits = errors.New("insufficient credits")
+
+// Store abstracts the queries the services need. PgStore implements it for
+// production and MemoryStore for exercising service logic in tests.
+type Store interface {
+	// Users
+	CreateUser(ctx context.Context, user *models.User) error
+	GetUserByID(ctx context.Context, userID uuid.UUID) (*models.User, error)
+	GetUserByEmail(ctx context.Context, email string) (*models.User, error)
+	// RecordLoginFailure counts a failed login. The maxAttempts-th consecutive
+	// failure locks the account until lockUntil, restarts the count and
+	// reports true.
+	RecordLoginFailure(ctx context.Context, userID uuid.UUID, maxAttempts int, lockUntil time.Time) (bool, error)
+	// ResetLoginFailures clears the failure count and any lockout after a successful login
+	ResetLoginFailures(ctx context.Context, userID uuid.UUID) error
+	// AddCredits adjusts a user's balance and records the transaction atomically
+	AddCredits(ctx context.Context, userID uuid.UUID, amount int64, transactionType, description string) error
+	// HoldCredits moves amount from the user's balance into their held balance,
+	// returning ErrInsufficientCredits if the balance is too low
+	HoldCredits(ctx context.Context, userID uuid.UUID, amount int64) error
+	// ReleaseCredits returns amount from the held balance to the spendable one
+	ReleaseCredits(ctx context.Context, userID uuid.UUID, amount int64) error
+	// CaptureCredits spends amount from the held balance and records the debit atomically
+	CaptureCredits(ctx context.Context, userID uuid.UUID, amount int64, description string) error
+	// ListCreditTransactions returns a user's credit transactions, oldest first
+	ListCreditTransactions(ctx context.Context, userID uuid.UUID) ([]models.CreditTransaction, error)
+	// DeleteUser removes a user with their upload sessions and webhooks,
+	// keeping their credit transactions without the user. It returns
+	// ErrConflict while the user still owns files and ErrNotFound for an
+	// unknown user.
+	DeleteUser(ctx context.Context, userID uuid.UUID) error
+
+	// Files
+	CreateFile(ctx context.Context, file *models.File) error
+	GetFile(ctx context.Context, fileID uuid.UUID) (*models.File, error)
+	// ListFilesByUser returns a user's files; when tags are given, only files carrying all of them
+	ListFilesByUser(ctx context.Context, userID uuid.UUID, tags []string) ([]models.File, error)
+	// LatestFileByName returns the user's highest-versioned file with this name, or ErrNotFound
+	LatestFileByName(ctx context.Context, userID uuid.UUID, filename string) (*models.File, error)
+	// ListFileVersions returns a version history (the root file and every file
+	// whose parent is rootID), oldest version first
+	ListFileVersions(ctx context.Context, rootID uuid.UUID) ([]models.File, error)
+	SetFileStatus(ctx context.Context, fileID uuid.UUID, status string) error
+	// SwapFileStatus sets the status only if it currently equals from, reporting whether it did
+	SwapFileStatus(ctx context.Context, fileID uuid.UUID, from, to string) (bool, error)
+	// ClaimFileRevision increments a file's revision only if it currently equals revision, reporting whether it did
+	ClaimFileRevision(ctx context.Context, fileID uuid.UUID, revision int) (bool, error)
+	SetFileContentHash(ctx context.Context, fileID uuid.UUID, sha256Hex string) error
+	// SetFileReplicas records how many replicas a file was charged for
+	SetFileReplicas(ctx context.Context, fileID uuid.UUID, replicas int) error
+	SetFileExpiry(ctx context.Context, fileID uuid.UUID, expiresAt *time.Time) error
+	// ListExpiredFiles returns files whose expiry is at or before now
+	ListExpiredFiles(ctx context.Context, now time.Time) ([]models.File, error)
+	DeleteFile(ctx context.Context, fileID uuid.UUID) error
+	// RekeyFile atomically replaces a file's key and every chunk's data with the
+	// output of rekey, which receives the current key and chunk data by index.
+	// The active assignments of the file's chunks become "stale" in the same
+	// step, since the nodes still hold the old ciphertext.
+	RekeyFile(ctx context.Context, fileID uuid.UUID, rekey func(oldKey []byte, chunks map[int][]byte) ([]byte, map[int][]byte, error)) error
+
+	// File tags
+	AddFileTags(ctx context.Context, fileID uuid.UUID, tags []string) error
+	// RemoveFileTag deletes a tag from a file, returning ErrNotFound if it was not set
+	RemoveFileTag(ctx context.Context, fileID uuid.UUID, tag string) error
+	ListFileTags(ctx context.Context, fileID uuid.UUID) ([]string, error)
+
+	// Chunks
+	// CreateChunk stores a chunk's data and assigns it to the given nodes,
+	// all or nothing. data is nil for chunks held only by the nodes. It
+	// returns ErrConflict if the file already has a chunk at that index.
+	CreateChunk(ctx context.Context, chunk *models.Chunk, data []byte, nodeIDs []uuid.UUID) error
+	// ListChunks returns a file's chunks in index order, with NodeOnly set on
+	// those the coordinator holds no copy of
+	ListChunks(ctx context.Context, fileID uuid.UUID) ([]models.Chunk, error)
+	ListChunkData(ctx context.Context, fileID uuid.UUID) (map[int][]byte, error)
+	ListChunkAssignments(ctx context.Context, chunkID uuid.UUID) ([]models.ChunkAssignment, error)
+	// ListFileAssignments returns the active assignments of every chunk of a
+	// file, as ListChunkAssignments would for each, in a single query
+	ListFileAssignments(ctx context.Context, fileID uuid.UUID) ([]models.ChunkAssignment, error)
+	// GetChunk returns a chunk's metadata and data, or ErrNotFound
+	GetChunk(ctx context.Context, chunkID uuid.UUID) (*models.Chunk, []byte, error)
+	// SetChunkData replaces the coordinator's copy of a chunk's data, leaving
+	// its metadata as is; it returns ErrNotFound for an unknown chunk
+	SetChunkData(ctx context.Context, chunkID uuid.UUID, data []byte) error
+	// ListNodeChunks returns the chunks actively assigned to a node
+	ListNodeChunks(ctx context.Context, nodeID uuid.UUID) ([]models.Chunk, error)
+	// ListNodeChunkPage returns up to limit chunks actively assigned to a node
+	// with IDs after after (uuid.Nil for the first page), in ID order
+	ListNodeChunkPage(ctx context.Context, nodeID, after uuid.UUID, limit int) ([]models.Chunk, error)
+	// SetChunkAssignment creates or updates the assignment of a chunk to a node
+	SetChunkAssignment(ctx context.Context, chunkID, nodeID uuid.UUID, status string) error
+	DeleteChunkAssignment(ctx context.Context, chunkID, nodeID uuid.UUID) error
+	// ListStaleAssignments returns the stale assignments, oldest first, of one
+	// file's chunks or of every file's if fileID is uuid.Nil
+	ListStaleAssignments(ctx context.Context, fileID uuid.UUID) ([]models.ChunkAssignment, error)
+	// RecordDrainCopy notes that a chunk was copied to nodeID while
+	// sourceNodeID drained for maintenance
+	RecordDrainCopy(ctx context.Context, chunkID, nodeID, sourceNodeID uuid.UUID) error
+	// ListDrainCopies returns the copies made while sourceNodeID drained, oldest first
+	ListDrainCopies(ctx context.Context, sourceNodeID uuid.UUID) ([]models.DrainCopy, error)
+	// DeleteDrainCopy forgets a drain copy, leaving its assignment as it is
+	DeleteDrainCopy(ctx context.Context, chunkID, nodeID uuid.UUID) error
+	// ListContentHashGroups groups ready files by plaintext hash, with files
+	// that have none under the empty hash
+	ListContentHashGroups(ctx context.Context) ([]models.ContentHashGroup, error)
+
+	// Upload sessions
+	CreateUploadSession(ctx context.Context, session *models.UploadSession) error
+	GetUploadSession(ctx context.Context, sessionID uuid.UUID) (*models.UploadSession, error)
+	SetUploadSessionStatus(ctx context.Context, sessionID uuid.UUID, status string) error
+	// SwapUploadSessionStatus sets the status only if it currently equals from, reporting whether it did
+	SwapUploadSessionStatus(ctx context.Context, sessionID uuid.UUID, from, to string) (bool, error)
+	// ListExpiredUploadSessions returns active sessions whose expiry is at or before now
+	ListExpiredUploadSessions(ctx context.Context, now time.Time) ([]models.UploadSession, error)
+	SetUploadSessionFile(ctx context.Context, sessionID, fileID uuid.UUID) error
+	// ListAbandonedUploadFiles returns the files, still uploading, of sessions
+	// closed without completing; completed and ready files are never listed
+	ListAbandonedUploadFiles(ctx context.Context) ([]models.File, error)
+	// CountActiveUploadSessions counts a user's active sessions that expire after now
+	CountActiveUploadSessions(ctx context.Context, userID uuid.UUID, now time.Time) (int, error)
+
+	// Node invites
+	CreateNodeInvite(ctx context.Context, invite *models.NodeInvite) error
+	// RedeemNodeInvite marks the unused, unexpired invite with this token hash
+	// as used and returns it, or returns ErrNotFound
+	RedeemNodeInvite(ctx context.Context, tokenHash string, now time.Time) (*models.NodeInvite, error)
+	// RestoreNodeInvite makes a redeemed invite usable again
+	RestoreNodeInvite(ctx context.Context, inviteID uuid.UUID) error
+
+	// Node exclusions
+	// AddNodeExclusion excludes a peer, replacing the reason of an existing exclusion
+	AddNodeExclusion(ctx context.Context, exclusion *models.NodeExclusion) error
+	// RemoveNodeExclusion lifts a peer's exclusion, returning ErrNotFound if there was none
+	RemoveNodeExclusion(ctx context.Context, peerID string) error
+	// ListNodeExclusions returns every exclusion, oldest first
+	ListNodeExclusions(ctx context.Context) ([]models.NodeExclusion, error)
+
+	// Webhooks
+	CreateWebhook(ctx context.Context, hook *models.Webhook) error
+	// GetWebhook returns a webhook, or ErrNotFound
+	GetWebhook(ctx context.Context, webhookID uuid.UUID) (*models.Webhook, error)
+	// ListWebhooks returns a user's webhooks, or every webhook when userID is nil
+	ListWebhooks(ctx context.Context, userID *uuid.UUID) ([]models.Webhook, error)
+	// DeleteWebhook removes a webhook and its queued deliveries, returning ErrNotFound if there was none
+	DeleteWebhook(ctx context.Context, webhookID uuid.UUID) error
+	QueueWebhookDeliveries(ctx context.Context, deliveries []models.WebhookDelivery) error
+	// ListDueWebhookDeliveries returns up to limit pending deliveries whose
+	// next attempt is at or before now, earliest first
+	ListDueWebhookDeliveries(ctx context.Context, now time.Time, limit int) ([]models.WebhookDelivery, error)
+	// UpdateWebhookDelivery records the outcome of an attempt: status, attempts, next attempt and last error
+	UpdateWebhookDelivery(ctx context.Context, delivery *models.WebhookDelivery) error
+	// PruneWebhookDeliveries removes delivered and failed deliveries queued
+	// before before, returning how many were removed
+	PruneWebhookDeliveries(ctx context.Context, before time.Time) (int64, error)
+
+	// GetReadOnlyMode returns the read-only mode last saved, or nil if none was
+	GetReadOnlyMode(ctx context.Context) (*models.ReadOnlyMode, error)
+	// SetReadOnlyMode saves the read-only mode, replacing any saved before
+	SetReadOnlyMode(ctx context.Context, mode *models.ReadOnlyMode) error
+}
+
+var (
+	_ Store = (*PgStore)(nil)
+	_ Store = (*MemoryStore)(nil)
+)
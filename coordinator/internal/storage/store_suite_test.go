@@ -0,0 +1,564 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/federated-storage/coordinator/internal/models"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newNodeFunc returns the ID of a node chunks can be assigned to
+type newNodeFunc func(t *testing.T) uuid.UUID
+
+func anyNode(t *testing.T) uuid.UUID { return uuid.New() }
+
+func TestStoreSuite_Memory(t *testing.T) {
+	runStoreSuite(t, NewMemoryStore(), anyNode)
+}
+
+// TestStoreSuite_Postgres runs against the scratch database named by TEST_DATABASE_URL
+func TestStoreSuite_Postgres(t *testing.T) {
+	databaseURL := os.Getenv("TEST_DATABASE_URL")
+	if databaseURL == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+
+	db, err := New(databaseURL)
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.Migrate(migrationsDir))
+
+	runStoreSuite(t, NewPgStore(db), func(t *testing.T) uuid.UUID {
+		nodeID := uuid.New()
+		_, err := db.Pool.Exec(context.Background(),
+			"INSERT INTO storage_nodes (id, name, peer_id, public_key, api_key_hash) VALUES ($1, 'n', $2, 'pk', 'key')",
+			nodeID, uuid.NewString())
+		require.NoError(t, err)
+		return nodeID
+	})
+}
+
+// runStoreSuite checks that store behaves as the Store interface documents.
+// The database may be shared, so every record is new and listings of every
+// user's records are only checked for the ones the suite created.
+func runStoreSuite(t *testing.T, store Store, newNode newNodeFunc) {
+	ctx := context.Background()
+	newUser := func(t *testing.T) *models.User {
+		user := &models.User{ID: uuid.New(), Email: uuid.NewString() + "@example.com", PasswordHash: "hash"}
+		require.NoError(t, store.CreateUser(ctx, user))
+		return user
+	}
+	newFile := func(t *testing.T, userID uuid.UUID, name string) *models.File {
+		file := &models.File{ID: uuid.New(), UserID: userID, Filename: name, SizeBytes: 10, MimeType: "text/plain",
+			EncryptionKey: []byte("key"), Cipher: "aes-256-gcm", Status: "uploading", ChunkCount: 2, Version: 1}
+		require.NoError(t, store.CreateFile(ctx, file))
+		return file
+	}
+
+	t.Run("users and credits", func(t *testing.T) {
+		user := newUser(t)
+		err := store.CreateUser(ctx, &models.User{ID: uuid.New(), Email: user.Email, PasswordHash: "x"})
+		assert.ErrorIs(t, err, ErrConflict, "Emails are unique")
+
+		byEmail, err := store.GetUserByEmail(ctx, user.Email)
+		require.NoError(t, err)
+		assert.Equal(t, user.ID, byEmail.ID)
+		assert.Equal(t, "hash", byEmail.PasswordHash)
+		_, err = store.GetUserByID(ctx, uuid.New())
+		assert.ErrorIs(t, err, ErrNotFound)
+
+		require.NoError(t, store.AddCredits(ctx, user.ID, 1000, "credit", "purchase"))
+		require.NoError(t, store.HoldCredits(ctx, user.ID, 300))
+		assert.ErrorIs(t, store.HoldCredits(ctx, user.ID, 10000), ErrInsufficientCredits)
+		assert.ErrorIs(t, store.HoldCredits(ctx, uuid.New(), 1), ErrNotFound)
+		require.NoError(t, store.ReleaseCredits(ctx, user.ID, 100))
+		assert.ErrorIs(t, store.CaptureCredits(ctx, user.ID, 500, "upload"), ErrInsufficientCredits)
+		require.NoError(t, store.CaptureCredits(ctx, user.ID, 200, "upload"))
+
+		got, err := store.GetUserByID(ctx, user.ID)
+		require.NoError(t, err)
+		assert.Equal(t, int64(800), got.Credits)
+		assert.Equal(t, int64(0), got.HeldCredits)
+
+		transactions, err := store.ListCreditTransactions(ctx, user.ID)
+		require.NoError(t, err)
+		require.Len(t, transactions, 2)
+		assert.Equal(t, int64(1000), transactions[0].Amount)
+		assert.Equal(t, int64(-200), transactions[1].Amount)
+		assert.NoError(t, VerifyCreditChain(transactions))
+
+		lockUntil := time.Now().Add(time.Hour)
+		locked, err := store.RecordLoginFailure(ctx, user.ID, 2, lockUntil)
+		require.NoError(t, err)
+		assert.False(t, locked)
+		locked, err = store.RecordLoginFailure(ctx, user.ID, 2, lockUntil)
+		require.NoError(t, err)
+		assert.True(t, locked, "The second failure in a row locks the account")
+		byEmail, err = store.GetUserByEmail(ctx, user.Email)
+		require.NoError(t, err)
+		require.NotNil(t, byEmail.LockedUntil)
+		assert.WithinDuration(t, lockUntil, *byEmail.LockedUntil, time.Millisecond)
+		require.NoError(t, store.ResetLoginFailures(ctx, user.ID))
+		byEmail, err = store.GetUserByEmail(ctx, user.Email)
+		require.NoError(t, err)
+		assert.Nil(t, byEmail.LockedUntil)
+	})
+
+	t.Run("files and versions", func(t *testing.T) {
+		user := newUser(t)
+		first := newFile(t, user.ID, "notes.txt")
+		assert.ErrorIs(t, store.CreateFile(ctx, first), ErrConflict)
+
+		got, err := store.GetFile(ctx, first.ID)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("key"), got.EncryptionKey)
+		assert.Equal(t, 1, got.Revision)
+		assert.Empty(t, got.Tags)
+		assert.Nil(t, got.ParentFileID)
+
+		second := &models.File{ID: uuid.New(), UserID: user.ID, Filename: "notes.txt", SizeBytes: 12, MimeType: "text/plain",
+			Cipher: "aes-256-gcm", Status: "ready", ChunkCount: 1, Version: 2, ParentFileID: &first.ID}
+		require.NoError(t, store.CreateFile(ctx, second))
+		clash := *second
+		clash.ID = uuid.New()
+		assert.ErrorIs(t, store.CreateFile(ctx, &clash), ErrConflict, "A version number is used once per history")
+
+		latest, err := store.LatestFileByName(ctx, user.ID, "notes.txt")
+		require.NoError(t, err)
+		assert.Equal(t, second.ID, latest.ID)
+		_, err = store.LatestFileByName(ctx, user.ID, "other.txt")
+		assert.ErrorIs(t, err, ErrNotFound)
+		versions, err := store.ListFileVersions(ctx, first.ID)
+		require.NoError(t, err)
+		require.Len(t, versions, 2)
+		assert.Equal(t, []int{1, 2}, []int{versions[0].Version, versions[1].Version})
+
+		require.NoError(t, store.SetFileStatus(ctx, first.ID, "ready"))
+		swapped, err := store.SwapFileStatus(ctx, first.ID, "uploading", "deleting")
+		require.NoError(t, err)
+		assert.False(t, swapped, "The status no longer matches")
+		swapped, err = store.SwapFileStatus(ctx, first.ID, "ready", "archived")
+		require.NoError(t, err)
+		assert.True(t, swapped)
+		claimed, err := store.ClaimFileRevision(ctx, first.ID, 1)
+		require.NoError(t, err)
+		assert.False(t, claimed, "Every change bumps the revision")
+		claimed, err = store.ClaimFileRevision(ctx, first.ID, 3)
+		require.NoError(t, err)
+		assert.True(t, claimed)
+
+		require.NoError(t, store.SetFileContentHash(ctx, first.ID, "abc123"))
+		require.NoError(t, store.SetFileReplicas(ctx, first.ID, 3))
+		expiry := time.Now().Add(-time.Minute)
+		require.NoError(t, store.SetFileExpiry(ctx, first.ID, &expiry))
+		got, err = store.GetFile(ctx, first.ID)
+		require.NoError(t, err)
+		assert.Equal(t, "archived", got.Status)
+		assert.Equal(t, "abc123", got.ContentSHA256)
+		assert.Equal(t, 3, got.Replicas)
+		assert.Equal(t, 7, got.Revision)
+		require.NotNil(t, got.ExpiresAt)
+		assert.WithinDuration(t, expiry, *got.ExpiresAt, time.Millisecond)
+
+		expiredIDs := func() []uuid.UUID {
+			expired, err := store.ListExpiredFiles(ctx, time.Now())
+			require.NoError(t, err)
+			var ids []uuid.UUID
+			for _, f := range expired {
+				if f.UserID == user.ID {
+					ids = append(ids, f.ID)
+				}
+			}
+			return ids
+		}
+		assert.Equal(t, []uuid.UUID{first.ID}, expiredIDs())
+		require.NoError(t, store.SetFileExpiry(ctx, first.ID, nil))
+		assert.Empty(t, expiredIDs())
+
+		require.NoError(t, store.AddFileTags(ctx, first.ID, []string{"work", "draft"}))
+		require.NoError(t, store.AddFileTags(ctx, first.ID, []string{"draft"}))
+		tags, err := store.ListFileTags(ctx, first.ID)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"draft", "work"}, tags)
+		assert.ErrorIs(t, store.RemoveFileTag(ctx, first.ID, "missing"), ErrNotFound)
+		require.NoError(t, store.RemoveFileTag(ctx, first.ID, "work"))
+
+		files, err := store.ListFilesByUser(ctx, user.ID, nil)
+		require.NoError(t, err)
+		require.Len(t, files, 2)
+		assert.Equal(t, second.ID, files[0].ID, "Newest first")
+		assert.Nil(t, files[0].EncryptionKey, "Listings leave out keys")
+		assert.Equal(t, []string{"draft"}, files[1].Tags)
+		files, err = store.ListFilesByUser(ctx, user.ID, []string{"draft"})
+		require.NoError(t, err)
+		require.Len(t, files, 1)
+		assert.Equal(t, first.ID, files[0].ID)
+		files, err = store.ListFilesByUser(ctx, user.ID, []string{"draft", "work"})
+		require.NoError(t, err)
+		assert.Empty(t, files, "Only files with every tag match")
+
+		require.NoError(t, store.DeleteFile(ctx, first.ID))
+		_, err = store.GetFile(ctx, first.ID)
+		assert.ErrorIs(t, err, ErrNotFound)
+		got, err = store.GetFile(ctx, second.ID)
+		require.NoError(t, err, "Deleting the first version keeps the rest")
+		assert.Nil(t, got.ParentFileID, "The next version anchors the history")
+	})
+
+	t.Run("chunks and assignments", func(t *testing.T) {
+		file := newFile(t, newUser(t).ID, "data.bin")
+		nodeA, nodeB := newNode(t), newNode(t)
+		hash := uuid.NewString()
+		first := &models.Chunk{ID: uuid.New(), FileID: file.ID, ChunkIndex: 0, Hash: hash, SizeBytes: 4}
+		second := &models.Chunk{ID: uuid.New(), FileID: file.ID, ChunkIndex: 1, Hash: hash, SizeBytes: 4}
+		require.NoError(t, store.CreateChunk(ctx, first, []byte("data"), []uuid.UUID{nodeA, nodeB}))
+		require.NoError(t, store.CreateChunk(ctx, second, nil, []uuid.UUID{nodeA}))
+		dup := &models.Chunk{ID: uuid.New(), FileID: file.ID, ChunkIndex: 0, Hash: "h", SizeBytes: 1}
+		assert.ErrorIs(t, store.CreateChunk(ctx, dup, []byte("x"), nil), ErrConflict)
+
+		chunks, err := store.ListChunks(ctx, file.ID)
+		require.NoError(t, err)
+		require.Len(t, chunks, 2)
+		assert.Equal(t, first.ID, chunks[0].ID)
+		data, err := store.ListChunkData(ctx, file.ID)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("data"), data[0])
+		assert.Empty(t, data[1], "Chunks held only by nodes have no data")
+
+		ready := newFile(t, newUser(t).ID, "ready.bin")
+		copied := newFile(t, newUser(t).ID, "copy.bin")
+		for _, f := range []*models.File{ready, copied} {
+			require.NoError(t, store.SetFileContentHash(ctx, f.ID, hash))
+			require.NoError(t, store.SetFileStatus(ctx, f.ID, "ready"))
+		}
+		groups, err := store.ListContentHashGroups(ctx)
+		require.NoError(t, err)
+		assert.Contains(t, groups, models.ContentHashGroup{Hash: hash, Files: 2, SizeBytes: 10},
+			"Files group by plaintext hash; the uploading file is left out")
+
+		require.NoError(t, store.SetChunkData(ctx, first.ID, []byte("DATA")))
+		assert.ErrorIs(t, store.SetChunkData(ctx, uuid.New(), []byte("x")), ErrNotFound)
+		chunk, stored, err := store.GetChunk(ctx, first.ID)
+		require.NoError(t, err)
+		assert.Equal(t, hash, chunk.Hash, "Only the data is replaced")
+		assert.Equal(t, []byte("DATA"), stored)
+		_, _, err = store.GetChunk(ctx, uuid.New())
+		assert.ErrorIs(t, err, ErrNotFound)
+
+		assignments, err := store.ListChunkAssignments(ctx, first.ID)
+		require.NoError(t, err)
+		assert.Len(t, assignments, 2)
+		require.NoError(t, store.SetChunkAssignment(ctx, first.ID, nodeB, "migrating"))
+		assignments, err = store.ListChunkAssignments(ctx, first.ID)
+		require.NoError(t, err)
+		require.Len(t, assignments, 1, "Only active assignments are listed")
+		assert.Equal(t, nodeA, assignments[0].NodeID)
+		assignments, err = store.ListFileAssignments(ctx, file.ID)
+		require.NoError(t, err)
+		require.Len(t, assignments, 2, "One query covers every chunk of the file")
+		assert.ElementsMatch(t, []uuid.UUID{first.ID, second.ID}, []uuid.UUID{assignments[0].ChunkID, assignments[1].ChunkID})
+		assignments, err = store.ListFileAssignments(ctx, uuid.New())
+		require.NoError(t, err)
+		assert.Empty(t, assignments)
+
+		held, err := store.ListNodeChunks(ctx, nodeA)
+		require.NoError(t, err)
+		assert.Len(t, held, 2)
+		page, err := store.ListNodeChunkPage(ctx, nodeA, uuid.Nil, 1)
+		require.NoError(t, err)
+		require.Len(t, page, 1)
+		rest, err := store.ListNodeChunkPage(ctx, nodeA, page[0].ID, 10)
+		require.NoError(t, err)
+		require.Len(t, rest, 1)
+		assert.Less(t, page[0].ID.String(), rest[0].ID.String(), "Pages run in ID order")
+
+		require.NoError(t, store.DeleteChunkAssignment(ctx, first.ID, nodeA))
+		held, err = store.ListNodeChunks(ctx, nodeA)
+		require.NoError(t, err)
+		require.Len(t, held, 1)
+		assert.Equal(t, second.ID, held[0].ID)
+
+		err = store.RekeyFile(ctx, file.ID, func(oldKey []byte, chunks map[int][]byte) ([]byte, map[int][]byte, error) {
+			assert.Equal(t, []byte("key"), oldKey)
+			return []byte("new key"), map[int][]byte{0: append(chunks[0], '!')}, nil
+		})
+		require.NoError(t, err)
+		got, err := store.GetFile(ctx, file.ID)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("new key"), got.EncryptionKey)
+		chunk, stored, err = store.GetChunk(ctx, first.ID)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("DATA!"), stored)
+		assert.Equal(t, 5, chunk.SizeBytes)
+		assert.NotEqual(t, hash, chunk.Hash, "Rekeyed chunks are rehashed")
+		assert.ErrorIs(t, store.RekeyFile(ctx, uuid.New(), nil), ErrNotFound)
+
+		held, err = store.ListNodeChunks(ctx, nodeA)
+		require.NoError(t, err)
+		assert.Empty(t, held, "Replicas of rekeyed chunks are no longer active")
+		stale, err := store.ListStaleAssignments(ctx, file.ID)
+		require.NoError(t, err)
+		require.Len(t, stale, 1, "Only active assignments become stale")
+		assert.Equal(t, second.ID, stale[0].ChunkID)
+		assert.Equal(t, nodeA, stale[0].NodeID)
+		stale, err = store.ListStaleAssignments(ctx, uuid.Nil)
+		require.NoError(t, err)
+		assert.Len(t, stale, 1)
+		stale, err = store.ListStaleAssignments(ctx, uuid.New())
+		require.NoError(t, err)
+		assert.Empty(t, stale)
+		require.NoError(t, store.SetChunkAssignment(ctx, second.ID, nodeA, "active"))
+		stale, err = store.ListStaleAssignments(ctx, file.ID)
+		require.NoError(t, err)
+		assert.Empty(t, stale)
+	})
+
+	t.Run("drain copies", func(t *testing.T) {
+		file := newFile(t, newUser(t).ID, "drained.bin")
+		source, nodeA, nodeB := newNode(t), newNode(t), newNode(t)
+		first := &models.Chunk{ID: uuid.New(), FileID: file.ID, ChunkIndex: 0, Hash: "h0", SizeBytes: 1}
+		second := &models.Chunk{ID: uuid.New(), FileID: file.ID, ChunkIndex: 1, Hash: "h1", SizeBytes: 1}
+		require.NoError(t, store.CreateChunk(ctx, first, nil, []uuid.UUID{source, nodeA}))
+		require.NoError(t, store.CreateChunk(ctx, second, nil, []uuid.UUID{source, nodeB}))
+
+		require.NoError(t, store.RecordDrainCopy(ctx, first.ID, nodeA, source))
+		require.NoError(t, store.RecordDrainCopy(ctx, second.ID, nodeB, source))
+		require.NoError(t, store.RecordDrainCopy(ctx, first.ID, nodeA, source), "Recording a copy again is harmless")
+
+		copies, err := store.ListDrainCopies(ctx, source)
+		require.NoError(t, err)
+		require.Len(t, copies, 2)
+		assert.Equal(t, first.ID, copies[0].ChunkID, "Oldest first")
+		assert.Equal(t, nodeA, copies[0].NodeID)
+		assert.Equal(t, source, copies[0].SourceNodeID)
+		copies, err = store.ListDrainCopies(ctx, nodeA)
+		require.NoError(t, err)
+		assert.Empty(t, copies)
+
+		require.NoError(t, store.DeleteDrainCopy(ctx, first.ID, nodeA))
+		copies, err = store.ListDrainCopies(ctx, source)
+		require.NoError(t, err)
+		require.Len(t, copies, 1)
+		assert.Equal(t, second.ID, copies[0].ChunkID)
+	})
+
+	t.Run("upload sessions", func(t *testing.T) {
+		user := newUser(t)
+		newSession := func(expiresAt time.Time) *models.UploadSession {
+			session := &models.UploadSession{ID: uuid.New(), UserID: user.ID, Filename: "up.bin", SizeBytes: 10,
+				EncryptionKey: []byte("key"), Cipher: "aes-256-gcm", ChunkCount: 2, ChunkSize: 8, LastChunkSize: 2,
+				Status: "active", ExpiresAt: expiresAt, Versioned: true, HeldCredits: 5}
+			require.NoError(t, store.CreateUploadSession(ctx, session))
+			return session
+		}
+		live := newSession(time.Now().Add(time.Hour))
+		stale := newSession(time.Now().Add(-time.Minute))
+
+		got, err := store.GetUploadSession(ctx, live.ID)
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), got.LastChunkSize)
+		assert.True(t, got.Versioned)
+		assert.False(t, got.Direct)
+		assert.Equal(t, int64(5), got.HeldCredits)
+		assert.Nil(t, got.FileID)
+		_, err = store.GetUploadSession(ctx, uuid.New())
+		assert.ErrorIs(t, err, ErrNotFound)
+
+		count, err := store.CountActiveUploadSessions(ctx, user.ID, time.Now())
+		require.NoError(t, err)
+		assert.Equal(t, 1, count, "Expired sessions don't count")
+		expired, err := store.ListExpiredUploadSessions(ctx, time.Now())
+		require.NoError(t, err)
+		var expiredIDs []uuid.UUID
+		for _, s := range expired {
+			if s.UserID == user.ID {
+				expiredIDs = append(expiredIDs, s.ID)
+			}
+		}
+		assert.Equal(t, []uuid.UUID{stale.ID}, expiredIDs)
+
+		swapped, err := store.SwapUploadSessionStatus(ctx, stale.ID, "completed", "expired")
+		require.NoError(t, err)
+		assert.False(t, swapped)
+		swapped, err = store.SwapUploadSessionStatus(ctx, stale.ID, "active", "expired")
+		require.NoError(t, err)
+		assert.True(t, swapped)
+
+		file := newFile(t, user.ID, "up.bin")
+		require.NoError(t, store.SetUploadSessionFile(ctx, live.ID, file.ID))
+		require.NoError(t, store.SetUploadSessionStatus(ctx, live.ID, "completed"))
+		got, err = store.GetUploadSession(ctx, live.ID)
+		require.NoError(t, err)
+		require.NotNil(t, got.FileID)
+		assert.Equal(t, file.ID, *got.FileID)
+		assert.Equal(t, "completed", got.Status)
+
+		// Unfinished files of sessions closed without completing are
+		// abandoned, found through the session's link or, unlinked, its ID
+		canceled := newSession(time.Now().Add(time.Hour))
+		linked := newFile(t, user.ID, "canceled.bin")
+		require.NoError(t, store.SetUploadSessionFile(ctx, canceled.ID, linked.ID))
+		require.NoError(t, store.SetUploadSessionStatus(ctx, canceled.ID, "canceled"))
+		unlinked := &models.File{ID: stale.ID, UserID: user.ID, Filename: "up.bin", SizeBytes: 10,
+			Cipher: "aes-256-gcm", Status: "uploading", ChunkCount: 2, Version: 1}
+		require.NoError(t, store.CreateFile(ctx, unlinked))
+		failed := newSession(time.Now().Add(time.Hour))
+		ready := newFile(t, user.ID, "ready.bin")
+		require.NoError(t, store.SetFileStatus(ctx, ready.ID, "ready"))
+		require.NoError(t, store.SetUploadSessionFile(ctx, failed.ID, ready.ID))
+		require.NoError(t, store.SetUploadSessionStatus(ctx, failed.ID, "failed"))
+
+		abandoned, err := store.ListAbandonedUploadFiles(ctx)
+		require.NoError(t, err)
+		var abandonedIDs []uuid.UUID
+		for _, f := range abandoned {
+			if f.UserID == user.ID {
+				abandonedIDs = append(abandonedIDs, f.ID)
+			}
+		}
+		assert.ElementsMatch(t, []uuid.UUID{linked.ID, unlinked.ID}, abandonedIDs,
+			"Files of completed sessions and ready files are never abandoned")
+	})
+
+	t.Run("node invites", func(t *testing.T) {
+		invite := &models.NodeInvite{ID: uuid.New(), TokenHash: uuid.NewString(), Note: "rack 4"}
+		require.NoError(t, store.CreateNodeInvite(ctx, invite))
+		assert.False(t, invite.CreatedAt.IsZero())
+		assert.ErrorIs(t, store.CreateNodeInvite(ctx, &models.NodeInvite{ID: uuid.New(), TokenHash: invite.TokenHash}), ErrConflict)
+
+		redeemed, err := store.RedeemNodeInvite(ctx, invite.TokenHash, time.Now())
+		require.NoError(t, err)
+		assert.Equal(t, invite.ID, redeemed.ID)
+		assert.Equal(t, "rack 4", redeemed.Note)
+		assert.NotNil(t, redeemed.UsedAt)
+		_, err = store.RedeemNodeInvite(ctx, invite.TokenHash, time.Now())
+		assert.ErrorIs(t, err, ErrNotFound, "An invite is used once")
+		require.NoError(t, store.RestoreNodeInvite(ctx, invite.ID))
+		_, err = store.RedeemNodeInvite(ctx, invite.TokenHash, time.Now())
+		assert.NoError(t, err)
+
+		past := time.Now().Add(-time.Minute)
+		expired := &models.NodeInvite{ID: uuid.New(), TokenHash: uuid.NewString(), ExpiresAt: &past}
+		require.NoError(t, store.CreateNodeInvite(ctx, expired))
+		_, err = store.RedeemNodeInvite(ctx, expired.TokenHash, time.Now())
+		assert.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("node exclusions", func(t *testing.T) {
+		peerID := uuid.NewString()
+		require.NoError(t, store.AddNodeExclusion(ctx, &models.NodeExclusion{PeerID: peerID, Reason: "flaky"}))
+		require.NoError(t, store.AddNodeExclusion(ctx, &models.NodeExclusion{PeerID: peerID, Reason: "under investigation"}))
+
+		exclusions, err := store.ListNodeExclusions(ctx)
+		require.NoError(t, err)
+		var reasons []string
+		for _, e := range exclusions {
+			if e.PeerID == peerID {
+				reasons = append(reasons, e.Reason)
+			}
+		}
+		assert.Equal(t, []string{"under investigation"}, reasons, "Excluding a peer again replaces the reason")
+
+		require.NoError(t, store.RemoveNodeExclusion(ctx, peerID))
+		assert.ErrorIs(t, store.RemoveNodeExclusion(ctx, peerID), ErrNotFound)
+	})
+
+	t.Run("webhooks", func(t *testing.T) {
+		user := newUser(t)
+		hook := &models.Webhook{ID: uuid.New(), UserID: &user.ID, URL: "https://example.com/hook", Secret: "s",
+			Events: []string{"file.uploaded", "file.deleted"}}
+		require.NoError(t, store.CreateWebhook(ctx, hook))
+		operator := &models.Webhook{ID: uuid.New(), URL: "https://example.com/ops", Secret: "s", Events: []string{"node.offline"}}
+		require.NoError(t, store.CreateWebhook(ctx, operator))
+
+		got, err := store.GetWebhook(ctx, hook.ID)
+		require.NoError(t, err)
+		assert.Equal(t, hook.Events, got.Events)
+		require.NotNil(t, got.UserID)
+		assert.Equal(t, user.ID, *got.UserID)
+		hooks, err := store.ListWebhooks(ctx, &user.ID)
+		require.NoError(t, err)
+		require.Len(t, hooks, 1)
+		assert.Equal(t, hook.ID, hooks[0].ID)
+		hooks, err = store.ListWebhooks(ctx, nil)
+		require.NoError(t, err)
+		var ids []uuid.UUID
+		for _, h := range hooks {
+			ids = append(ids, h.ID)
+		}
+		assert.Contains(t, ids, hook.ID)
+		assert.Contains(t, ids, operator.ID, "Every webhook is listed without a user")
+
+		due := models.WebhookDelivery{ID: uuid.New(), WebhookID: hook.ID, Event: "file.uploaded", Payload: []byte(`{}`),
+			Status: "pending", NextAttemptAt: time.Now().Add(-time.Second)}
+		later := models.WebhookDelivery{ID: uuid.New(), WebhookID: hook.ID, Event: "file.deleted", Payload: []byte(`{}`),
+			Status: "pending", NextAttemptAt: time.Now().Add(time.Hour)}
+		require.NoError(t, store.QueueWebhookDeliveries(ctx, []models.WebhookDelivery{due, later}))
+		dueIDs := func() []uuid.UUID {
+			deliveries, err := store.ListDueWebhookDeliveries(ctx, time.Now(), 1000)
+			require.NoError(t, err)
+			var ids []uuid.UUID
+			for _, d := range deliveries {
+				if d.WebhookID == hook.ID {
+					ids = append(ids, d.ID)
+				}
+			}
+			return ids
+		}
+		assert.Equal(t, []uuid.UUID{due.ID}, dueIDs())
+
+		due.Status, due.Attempts, due.LastError = "delivered", 1, ""
+		require.NoError(t, store.UpdateWebhookDelivery(ctx, &due))
+		assert.Empty(t, dueIDs())
+
+		require.NoError(t, store.DeleteWebhook(ctx, hook.ID))
+		_, err = store.GetWebhook(ctx, hook.ID)
+		assert.ErrorIs(t, err, ErrNotFound)
+		assert.ErrorIs(t, store.DeleteWebhook(ctx, hook.ID), ErrNotFound)
+		require.NoError(t, store.DeleteWebhook(ctx, operator.ID))
+	})
+
+	t.Run("deleting users", func(t *testing.T) {
+		user := newUser(t)
+		require.NoError(t, store.AddCredits(ctx, user.ID, 1000, "credit", "purchase"))
+		hook := &models.Webhook{ID: uuid.New(), UserID: &user.ID, URL: "https://example.com/hook", Secret: "s",
+			Events: []string{"file.uploaded"}}
+		require.NoError(t, store.CreateWebhook(ctx, hook))
+		file := newFile(t, user.ID, "kept.txt")
+
+		assert.ErrorIs(t, store.DeleteUser(ctx, user.ID), ErrConflict, "A user who still owns files is kept")
+		require.NoError(t, store.DeleteFile(ctx, file.ID))
+		require.NoError(t, store.DeleteUser(ctx, user.ID))
+
+		_, err := store.GetUserByID(ctx, user.ID)
+		assert.ErrorIs(t, err, ErrNotFound)
+		_, err = store.GetWebhook(ctx, hook.ID)
+		assert.ErrorIs(t, err, ErrNotFound, "The user's webhooks go with them")
+		transactions, err := store.ListCreditTransactions(ctx, user.ID)
+		require.NoError(t, err)
+		assert.Empty(t, transactions)
+		assert.ErrorIs(t, store.DeleteUser(ctx, user.ID), ErrNotFound)
+	})
+
+	t.Run("read-only mode", func(t *testing.T) {
+		since := time.Now().UTC().Truncate(time.Second)
+		require.NoError(t, store.SetReadOnlyMode(ctx, &models.ReadOnlyMode{Enabled: true, Reason: "migration", Since: since}))
+		mode, err := store.GetReadOnlyMode(ctx)
+		require.NoError(t, err)
+		require.NotNil(t, mode)
+		assert.True(t, mode.Enabled)
+		assert.Equal(t, "migration", mode.Reason)
+		assert.True(t, since.Equal(mode.Since))
+
+		require.NoError(t, store.SetReadOnlyMode(ctx, &models.ReadOnlyMode{Since: since.Add(time.Minute)}))
+		mode, err = store.GetReadOnlyMode(ctx)
+		require.NoError(t, err)
+		assert.False(t, mode.Enabled, "Saving again replaces the mode")
+		assert.Empty(t, mode.Reason)
+	})
+}
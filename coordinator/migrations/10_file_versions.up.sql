@@ -0,0 +1,8 @@
+-- Same-name uploads can become versions of an existing file. Every later
+-- version points at the first one, which anchors the version history.
+ALTER TABLE files ADD COLUMN IF NOT EXISTS version INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE files ADD COLUMN IF NOT EXISTS parent_file_id UUID REFERENCES files(id) ON DELETE CASCADE;
+ALTER TABLE upload_sessions ADD COLUMN IF NOT EXISTS versioned BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_files_parent_version ON files(parent_file_id, version) WHERE parent_file_id IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_files_user_filename ON files(user_id, filename);
@@ -0,0 +1,2 @@
+-- Operator running each node, so replicas can be spread across operators
+ALTER TABLE storage_nodes ADD COLUMN IF NOT EXISTS operator_id VARCHAR(255) NOT NULL DEFAULT '';
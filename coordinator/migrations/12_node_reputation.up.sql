@@ -0,0 +1,17 @@
+-- Periodic snapshots of each node's behavior, kept as long-term trust history
+CREATE TABLE IF NOT EXISTS node_reputation (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    node_id UUID NOT NULL REFERENCES storage_nodes(id) ON DELETE CASCADE,
+    uptime_percentage DECIMAL(5,2) NOT NULL,
+    proofs_verified INTEGER NOT NULL DEFAULT 0,
+    proofs_failed INTEGER NOT NULL DEFAULT 0,
+    proof_pass_rate DOUBLE PRECISION NOT NULL,
+    availability DOUBLE PRECISION NOT NULL,
+    score DOUBLE PRECISION NOT NULL,
+    recorded_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_node_reputation_node_recorded ON node_reputation(node_id, recorded_at DESC);
+
+-- Score derived from the history, used to prefer trustworthy nodes for placement
+ALTER TABLE storage_nodes ADD COLUMN IF NOT EXISTS reputation_score DOUBLE PRECISION NOT NULL DEFAULT 1.0;
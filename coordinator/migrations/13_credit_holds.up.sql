@@ -0,0 +1,4 @@
+-- Credits reserved for uploads in progress: moved out of the spendable balance
+-- at initiation, then captured on completion or returned on cancel/expiry
+ALTER TABLE users ADD COLUMN IF NOT EXISTS held_credits BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE upload_sessions ADD COLUMN IF NOT EXISTS held_credits BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,3 @@
+-- Merkle root over each chunk's 1 KiB sub-blocks, checked against the paths
+-- nodes return for proof challenges. Empty for chunks stored before roots existed.
+ALTER TABLE chunks ADD COLUMN IF NOT EXISTS merkle_root VARCHAR(64) NOT NULL DEFAULT '';
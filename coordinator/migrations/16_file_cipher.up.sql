@@ -0,0 +1,3 @@
+-- Cipher each file's chunks are encrypted with; existing files used AES-256-GCM
+ALTER TABLE files ADD COLUMN IF NOT EXISTS cipher VARCHAR(32) NOT NULL DEFAULT 'aes-256-gcm';
+ALTER TABLE upload_sessions ADD COLUMN IF NOT EXISTS cipher VARCHAR(32) NOT NULL DEFAULT 'aes-256-gcm';
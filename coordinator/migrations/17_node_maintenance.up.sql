@@ -0,0 +1,4 @@
+-- Scheduled maintenance windows; nodes are drained ahead of the start and
+-- left out of new placements until the end
+ALTER TABLE storage_nodes ADD COLUMN IF NOT EXISTS maintenance_start TIMESTAMP WITH TIME ZONE;
+ALTER TABLE storage_nodes ADD COLUMN IF NOT EXISTS maintenance_end TIMESTAMP WITH TIME ZONE;
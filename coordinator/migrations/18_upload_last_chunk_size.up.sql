@@ -0,0 +1,3 @@
+-- Expected size of a session's final chunk, which is usually shorter than the
+-- rest; 0 for sessions created before it was recorded
+ALTER TABLE upload_sessions ADD COLUMN IF NOT EXISTS last_chunk_size BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,4 @@
+-- Consecutive failed logins since the last success, and when a lockout
+-- triggered by them ends
+ALTER TABLE users ADD COLUMN IF NOT EXISTS failed_login_attempts INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS locked_until TIMESTAMP;
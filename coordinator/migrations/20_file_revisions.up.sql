@@ -0,0 +1,3 @@
+-- Counts changes to a file (status, key, expiry, tags) so clients can make
+-- conditional updates with If-Match
+ALTER TABLE files ADD COLUMN IF NOT EXISTS revision INTEGER NOT NULL DEFAULT 1;
@@ -0,0 +1,3 @@
+-- Replicas a file's upload was charged for: the fewest any of its chunks
+-- was stored with. 0 for files completed before this was recorded.
+ALTER TABLE files ADD COLUMN IF NOT EXISTS replicas INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,3 @@
+-- When a node last passed a capacity proof; NULL until it does, and reset
+-- when it raises its claimed capacity
+ALTER TABLE storage_nodes ADD COLUMN IF NOT EXISTS capacity_verified_at TIMESTAMP WITH TIME ZONE;
@@ -0,0 +1,5 @@
+-- Challenges re-issued at a node's request point at the failed challenge they
+-- retry. Passing the retry marks that challenge 'excused'; a retry that fails
+-- or lapses becomes 'retry_failed', which counts against no one
+ALTER TABLE proof_challenges ADD COLUMN IF NOT EXISTS retry_of UUID REFERENCES proof_challenges(id) ON DELETE CASCADE;
+CREATE INDEX IF NOT EXISTS idx_proof_challenges_retry_of ON proof_challenges(retry_of);
@@ -0,0 +1,4 @@
+-- Chunk size an upload session was split into, chosen by the client within
+-- the server's bounds; 0 for sessions from before it was recorded, which use
+-- the server's chunk size
+ALTER TABLE upload_sessions ADD COLUMN IF NOT EXISTS chunk_size BIGINT NOT NULL DEFAULT 0;
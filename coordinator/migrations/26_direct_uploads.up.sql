@@ -0,0 +1,3 @@
+-- Whether an upload session's chunks go straight from the client to the
+-- storage nodes, leaving the coordinator only their metadata
+ALTER TABLE upload_sessions ADD COLUMN IF NOT EXISTS direct BOOLEAN NOT NULL DEFAULT FALSE;
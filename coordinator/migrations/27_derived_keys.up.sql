@@ -0,0 +1,4 @@
+-- Files keyed from the coordinator's master key store no key of their own;
+-- their key is derived from the file ID whenever it is needed
+ALTER TABLE files ALTER COLUMN encryption_key DROP NOT NULL;
+ALTER TABLE upload_sessions ALTER COLUMN encryption_key DROP NOT NULL;
@@ -0,0 +1,3 @@
+-- Where a storage node runs, as its operator describes it (e.g. "eu-west");
+-- shown to users auditing where their data is held
+ALTER TABLE storage_nodes ADD COLUMN IF NOT EXISTS region VARCHAR(64) NOT NULL DEFAULT '';
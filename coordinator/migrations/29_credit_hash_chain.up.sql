@@ -0,0 +1,5 @@
+-- Each credit transaction hashes its own contents together with the hash of
+-- the user's previous transaction, so editing or deleting a row breaks the
+-- chain. Rows recorded before this migration carry no hash.
+ALTER TABLE credit_transactions ADD COLUMN IF NOT EXISTS prev_hash VARCHAR(64);
+ALTER TABLE credit_transactions ADD COLUMN IF NOT EXISTS row_hash VARCHAR(64);
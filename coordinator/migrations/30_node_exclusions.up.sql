@@ -0,0 +1,7 @@
+-- Nodes operators keep out of new chunk placements without changing their
+-- status, e.g. while investigating them; they keep serving what they hold
+CREATE TABLE IF NOT EXISTS node_exclusions (
+    peer_id VARCHAR(255) PRIMARY KEY,
+    reason TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,4 @@
+-- Chunks now start with a versioned header; those stored before, and direct
+-- uploads, have none (format 0). Downloads need the format to place chunks
+-- in the file without reading them.
+ALTER TABLE chunks ADD COLUMN IF NOT EXISTS format SMALLINT NOT NULL DEFAULT 0;
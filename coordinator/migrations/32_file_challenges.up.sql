@@ -0,0 +1,17 @@
+-- Aggregate proof challenges: a single proof covering a seed-sampled set of
+-- the chunks of one file a node holds
+CREATE TABLE IF NOT EXISTS file_challenges (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    file_id UUID NOT NULL REFERENCES files(id) ON DELETE CASCADE,
+    node_id UUID NOT NULL REFERENCES storage_nodes(id) ON DELETE CASCADE,
+    seed BYTEA NOT NULL,
+    chunk_ids UUID[] NOT NULL,
+    timeout_ms INTEGER NOT NULL,
+    status VARCHAR(50) NOT NULL DEFAULT 'pending',
+    proof_hash VARCHAR(64),
+    duration_ms INTEGER,
+    verified_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_file_challenges_node_status ON file_challenges(node_id, status);
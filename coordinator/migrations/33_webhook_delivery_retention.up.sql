@@ -0,0 +1,2 @@
+-- Delivered and given-up deliveries are pruned once past the retention
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_settled ON webhook_deliveries(created_at) WHERE status <> 'pending';
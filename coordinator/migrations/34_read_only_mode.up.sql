@@ -0,0 +1,8 @@
+-- Read-only mode as last set by an operator, so it survives restarts. The
+-- single row is keyed by a constant.
+CREATE TABLE IF NOT EXISTS read_only_mode (
+    id BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (id),
+    enabled BOOLEAN NOT NULL,
+    reason TEXT NOT NULL DEFAULT '',
+    since TIMESTAMP WITH TIME ZONE NOT NULL
+);
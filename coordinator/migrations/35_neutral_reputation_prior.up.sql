@@ -0,0 +1,5 @@
+-- Nodes without a reputation history start at a neutral score rather than a
+-- perfect one, so placement doesn't favor them over nodes with a proven record.
+ALTER TABLE storage_nodes ALTER COLUMN reputation_score SET DEFAULT 0.5;
+UPDATE storage_nodes SET reputation_score = 0.5
+WHERE NOT EXISTS (SELECT 1 FROM node_reputation r WHERE r.node_id = storage_nodes.id);
@@ -0,0 +1,10 @@
+-- Replicas copied off a node draining for maintenance, so they can be
+-- retired once the node is back and holds its own replicas again.
+CREATE TABLE IF NOT EXISTS drain_copies (
+    chunk_id UUID NOT NULL REFERENCES chunks(id) ON DELETE CASCADE,
+    node_id UUID NOT NULL REFERENCES storage_nodes(id) ON DELETE CASCADE,
+    source_node_id UUID NOT NULL REFERENCES storage_nodes(id) ON DELETE CASCADE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (chunk_id, node_id)
+);
+CREATE INDEX IF NOT EXISTS idx_drain_copies_source ON drain_copies(source_node_id);
@@ -0,0 +1,2 @@
+-- Track the software version each storage node reports
+ALTER TABLE storage_nodes ADD COLUMN IF NOT EXISTS version VARCHAR(50) NOT NULL DEFAULT '';
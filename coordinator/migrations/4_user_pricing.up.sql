@@ -0,0 +1,2 @@
+-- Per-user credit rate override for enterprise accounts (NULL uses the configured tiers)
+ALTER TABLE users ADD COLUMN IF NOT EXISTS credits_per_usd BIGINT;
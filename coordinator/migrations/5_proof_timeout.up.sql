@@ -0,0 +1,2 @@
+-- Acceptable proof duration, fixed when the challenge is issued
+ALTER TABLE proof_challenges ADD COLUMN IF NOT EXISTS timeout_ms INTEGER NOT NULL DEFAULT 2000;
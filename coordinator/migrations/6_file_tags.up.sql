@@ -0,0 +1,9 @@
+-- User-defined tags for organizing files
+CREATE TABLE IF NOT EXISTS file_tags (
+    file_id UUID NOT NULL REFERENCES files(id) ON DELETE CASCADE,
+    tag VARCHAR(64) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (file_id, tag)
+);
+
+CREATE INDEX IF NOT EXISTS idx_file_tags_tag ON file_tags(tag);
@@ -0,0 +1,2 @@
+-- SHA-256 of a file's full plaintext, recorded when the upload completes
+ALTER TABLE files ADD COLUMN IF NOT EXISTS content_sha256 VARCHAR(64);
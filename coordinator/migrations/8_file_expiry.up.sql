@@ -0,0 +1,5 @@
+-- Optional retention deadline; expired files are purged by the coordinator
+ALTER TABLE files ADD COLUMN IF NOT EXISTS expires_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE upload_sessions ADD COLUMN IF NOT EXISTS file_expires_at TIMESTAMP WITH TIME ZONE;
+
+CREATE INDEX IF NOT EXISTS idx_files_expires_at ON files(expires_at) WHERE expires_at IS NOT NULL;
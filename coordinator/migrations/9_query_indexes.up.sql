@@ -0,0 +1,21 @@
+-- Composite indexes for the hot node/challenge/assignment filters. The
+-- single-column indexes they supersede are dropped to save write overhead.
+
+-- Pending challenges per node, and proof stats over a time window
+CREATE INDEX IF NOT EXISTS idx_proof_challenges_node_status ON proof_challenges(node_id, status);
+CREATE INDEX IF NOT EXISTS idx_proof_challenges_node_created ON proof_challenges(node_id, created_at);
+DROP INDEX IF EXISTS idx_proof_challenges_node_id;
+
+-- Cascading chunk deletes look up challenges by chunk
+CREATE INDEX IF NOT EXISTS idx_proof_challenges_chunk_id ON proof_challenges(chunk_id);
+
+-- Active assignments per node (inventory, rebalancing, reconciliation)
+CREATE INDEX IF NOT EXISTS idx_chunk_assignments_node_status ON chunk_assignments(node_id, status);
+DROP INDEX IF EXISTS idx_chunk_assignments_node_id;
+
+-- A user's files, newest first
+CREATE INDEX IF NOT EXISTS idx_files_user_created ON files(user_id, created_at DESC);
+DROP INDEX IF EXISTS idx_files_user_id;
+
+-- Deleting a file nulls out its upload sessions
+CREATE INDEX IF NOT EXISTS idx_upload_sessions_file_id ON upload_sessions(file_id);
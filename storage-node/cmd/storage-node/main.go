@@ -1,17 +1,22 @@
 package main
 
 import (
+	"bufio"
 	"crypto/rand"
 	"encoding/base64"
 	"fmt"
-	"log"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/federated-storage/storage-node/internal/config"
+	"github.com/federated-storage/storage-node/internal/logging"
 	"github.com/federated-storage/storage-node/internal/p2p"
 	"github.com/federated-storage/storage-node/internal/services"
 	"github.com/federated-storage/storage-node/internal/storage"
@@ -37,6 +42,14 @@ func main() {
 	rootCmd.AddCommand(startCmd())
 	rootCmd.AddCommand(chunksCmd())
 	rootCmd.AddCommand(drainCmd())
+	rootCmd.AddCommand(doctorCmd())
+	rootCmd.AddCommand(setCapacityCmd())
+	rootCmd.AddCommand(rotateKeyCmd())
+	rootCmd.AddCommand(maintenanceCmd())
+	rootCmd.AddCommand(decommissionCmd())
+	rootCmd.AddCommand(retryProofsCmd())
+	rootCmd.AddCommand(exportConfigCmd())
+	rootCmd.AddCommand(importConfigCmd())
 
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
@@ -55,6 +68,12 @@ func initCmd() *cobra.Command {
 	cmd.Flags().String("name", "", "Node name (required)")
 	cmd.Flags().String("coordinator-url", "http://localhost:8080", "Coordinator API URL")
 	cmd.Flags().Int("max-storage", 100, "Maximum storage in GB")
+	cmd.Flags().String("coordinator-peer-id", "", "Coordinator peer ID allowed to open P2P streams (defaults to the one reported at registration)")
+	cmd.Flags().String("operator-id", "", "Operator or account running this node; nodes sharing one are not given replicas of the same chunk")
+	cmd.Flags().String("region", "", "Where this node runs, e.g. eu-west; shown to users auditing where their files are held")
+	cmd.Flags().String("external-address", "", "Multiaddr other peers reach this node on, e.g. /ip4/203.0.113.7/tcp/4001 (defaults to the best listen address)")
+	cmd.Flags().String("invite-token", "", "One-time invite token, required when the coordinator disallows open registration")
+	cmd.Flags().String("migrations", "", "Migrations directory (default $"+storage.MigrationsEnv+", then migrations/ next to the binary, then ./migrations)")
 	cmd.MarkFlagRequired("name")
 
 	return cmd
@@ -64,6 +83,19 @@ func runInit(cmd *cobra.Command, args []string) error {
 	name, _ := cmd.Flags().GetString("name")
 	coordinatorURL, _ := cmd.Flags().GetString("coordinator-url")
 	maxStorage, _ := cmd.Flags().GetInt("max-storage")
+	coordinatorPeerID, _ := cmd.Flags().GetString("coordinator-peer-id")
+	operatorID, _ := cmd.Flags().GetString("operator-id")
+	region, _ := cmd.Flags().GetString("region")
+	inviteToken, _ := cmd.Flags().GetString("invite-token")
+	externalAddress, _ := cmd.Flags().GetString("external-address")
+	migrationsFlag, _ := cmd.Flags().GetString("migrations")
+
+	// Find migrations before touching anything, so a bad path fails cleanly
+	executable, _ := os.Executable()
+	migrationsPath, err := storage.ResolveMigrationsPath(migrationsFlag, os.Getenv(storage.MigrationsEnv), executable)
+	if err != nil {
+		return err
+	}
 
 	// Create data directory
 	dataDir := "data"
@@ -88,6 +120,12 @@ func runInit(cmd *cobra.Command, args []string) error {
 			Host: "127.0.0.1",
 			Port: 8090,
 		},
+		P2P: config.P2PConfig{
+			ExternalAddress: externalAddress,
+		},
+	}
+	if externalAddress != "" && !strings.HasPrefix(externalAddress, "/") {
+		return fmt.Errorf("--external-address %q is not a multiaddr such as /ip4/203.0.113.7/tcp/4001", externalAddress)
 	}
 
 	// Ensure directories
@@ -97,7 +135,6 @@ func runInit(cmd *cobra.Command, args []string) error {
 
 	// Initialize database
 	dbPath := filepath.Join(dataDir, "storage.db")
-	var err error
 	db, err = storage.New(dbPath)
 	if err != nil {
 		return fmt.Errorf("failed to initialize database: %w", err)
@@ -105,12 +142,8 @@ func runInit(cmd *cobra.Command, args []string) error {
 	defer db.Close()
 
 	// Run migrations
-	migrationsPath := "./migrations"
-	if _, err := os.Stat(migrationsPath); os.IsNotExist(err) {
-		migrationsPath = filepath.Join(os.Getenv("GOPATH"), "src/github.com/federated-storage/storage-node/migrations")
-	}
 	if err := db.Migrate(migrationsPath); err != nil {
-		log.Printf("Warning: migrations failed: %v", err)
+		return fmt.Errorf("failed to migrate database: %w", err)
 	}
 
 	// Generate key pair for P2P
@@ -124,7 +157,7 @@ func runInit(cmd *cobra.Command, args []string) error {
 	}
 
 	// Initialize P2P node to get peer ID
-	p2pNode, err := p2p.NewNode(nil)
+	p2pNode, err := p2p.NewNode(nil, cfg.P2P.EnableTCP, cfg.P2P.EnableQUIC)
 	if err != nil {
 		return fmt.Errorf("failed to create P2P node: %w", err)
 	}
@@ -132,7 +165,8 @@ func runInit(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("failed to start P2P node: %w", err)
 	}
 	peerID := p2pNode.IDString()
-	addrs := p2pNode.Addrs()
+	// The first listen address may be loopback or link-local, which other peers can't reach
+	address := p2p.BestAddr(p2pNode.Addrs(), cfg.P2P.ExternalAddress, peerID)
 	p2pNode.Close()
 
 	// Register with coordinator
@@ -141,8 +175,12 @@ func runInit(cmd *cobra.Command, args []string) error {
 		Name:           name,
 		PeerID:         peerID,
 		PublicKey:      pubKey,
-		Address:        addrs[0],
+		Address:        address,
 		TotalStorageGB: maxStorage,
+		Version:        services.NodeVersion,
+		OperatorID:     operatorID,
+		Region:         region,
+		InviteToken:    inviteToken,
 	})
 	if err != nil {
 		return fmt.Errorf("failed to register with coordinator: %w", err)
@@ -151,6 +189,10 @@ func runInit(cmd *cobra.Command, args []string) error {
 	// Save config with API key
 	cfg.Coordinator.PeerID = peerID
 	cfg.Coordinator.APIKey = regResp.APIKey
+	if coordinatorPeerID == "" {
+		coordinatorPeerID = regResp.CoordinatorPeerID
+	}
+	cfg.Coordinator.AuthorizedPeerID = coordinatorPeerID
 
 	// Save private key
 	keyFile := filepath.Join(dataDir, "private.key")
@@ -167,7 +209,13 @@ func runInit(cmd *cobra.Command, args []string) error {
 	fmt.Printf("Storage node initialized successfully!\n")
 	fmt.Printf("Node ID: %s\n", regResp.NodeID)
 	fmt.Printf("Peer ID: %s\n", peerID)
+	fmt.Printf("Version: %s\n", services.NodeVersion)
 	fmt.Printf("API Key: %s\n", regResp.APIKey)
+	if coordinatorPeerID == "" {
+		fmt.Printf("Warning: coordinator peer ID unknown; set coordinator.authorized_peer_id before starting\n")
+	} else {
+		fmt.Printf("Coordinator Peer ID: %s\n", coordinatorPeerID)
+	}
 	fmt.Printf("Config saved to: %s\n", configPath)
 
 	return nil
@@ -194,6 +242,12 @@ func runStart(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("failed to load config: %w", err)
 	}
 
+	logCloser, err := logging.Setup(cfg.Node.LogLevel, cfg.Node.LogFile, cfg.Node.LogMaxSizeMB)
+	if err != nil {
+		return fmt.Errorf("failed to set up logging: %w", err)
+	}
+	defer logCloser.Close()
+
 	// Initialize database
 	dbPath := filepath.Join(cfg.Node.DataDir, "storage.db")
 	db, err = storage.New(dbPath)
@@ -203,15 +257,52 @@ func runStart(cmd *cobra.Command, args []string) error {
 	defer db.Close()
 
 	// Initialize services
-	chunkService := services.NewChunkService(db, cfg.Storage.ChunkDir)
+	chunkService := services.NewChunkService(db, cfg.Storage.ChunkDir, storageLimits(cfg))
+	chunkService.SetStoreConcurrency(cfg.Storage.MaxConcurrentStores, time.Duration(cfg.Storage.StoreQueueWaitMs)*time.Millisecond)
+	chunkService.SetDedup(cfg.Storage.Dedup)
 	coordinatorClient := services.NewCoordinatorClient(&cfg.Coordinator)
 	proofEngine := services.NewProofEngine(chunkService)
+	proofEngine.SetMaxDifficulty(cfg.Storage.MaxProofDifficulty)
+	proofEngine.SetCacheSize(cfg.Storage.ProofCacheEntries)
+	var metrics *services.Metrics
+	if cfg.API.MetricsEnabled {
+		metrics = services.NewMetrics()
+		proofEngine.SetMetrics(metrics)
+	}
+
+	// Preflight checks
+	results := services.RunPreflight(cfg.Storage.ChunkDir, db, coordinatorClient)
+	printPreflightReport(results)
+	if services.HasCriticalFailure(results) {
+		return fmt.Errorf("preflight checks failed, run 'storage-node doctor' for details")
+	}
+
+	// Clean up after writes interrupted by a crash
+	recovery, err := chunkService.RecoverChunks()
+	if err != nil {
+		return fmt.Errorf("failed to recover chunk store: %w", err)
+	}
+	if recovery.TempFilesRemoved > 0 || recovery.OrphansQuarantined > 0 || len(recovery.MissingChunks) > 0 {
+		logging.Warnf("Chunk recovery: removed %d temp files, moved %d orphaned chunks to %s, marked %d chunks corrupt",
+			recovery.TempFilesRemoved, recovery.OrphansQuarantined, filepath.Join(cfg.Storage.ChunkDir, services.QuarantineDir), len(recovery.MissingChunks))
+	}
+	if metrics != nil {
+		chunkService.SetMetrics(metrics)
+		server := startMetricsServer(cfg.API, metrics)
+		defer server.Close()
+	}
 
 	// Initialize P2P node
-	p2pNode, err := p2p.NewNode(cfg.P2P.ListenAddresses)
+	p2pNode, err := p2p.NewNode(cfg.P2P.ListenAddresses, cfg.P2P.EnableTCP, cfg.P2P.EnableQUIC)
 	if err != nil {
 		return fmt.Errorf("failed to create P2P node: %w", err)
 	}
+	p2pNode.SetStreamTimeout(time.Duration(cfg.P2P.StreamTimeoutSeconds) * time.Second)
+	if err := p2pNode.SetSecurity(cfg.P2P.Security); err != nil {
+		return fmt.Errorf("invalid p2p.security: %w", err)
+	}
+	p2pNode.SetConnectionLimits(cfg.P2P.MaxPeers, cfg.P2P.MaxStreams)
+	p2pNode.SetStoreRate(cfg.P2P.StoreRatePerSecond, cfg.P2P.StoreBurst)
 
 	// Start P2P node first (this creates the host)
 	if err := p2pNode.Start(); err != nil {
@@ -219,49 +310,77 @@ func runStart(cmd *cobra.Command, args []string) error {
 	}
 	defer p2pNode.Close()
 
+	// Only the coordinator may open chunk and proof streams
+	if cfg.Coordinator.AuthorizedPeerID == "" {
+		logging.Warnf("coordinator.authorized_peer_id is not set; all P2P chunk and proof requests will be rejected")
+	} else if err := p2pNode.SetAuthorizedPeer(cfg.Coordinator.AuthorizedPeerID); err != nil {
+		return err
+	}
+
 	// Set up P2P handlers (must be after Start())
-	p2pNode.SetChunkStoreHandler(func(chunkID string, data []byte) error {
-		log.Printf("Storing chunk: %s", chunkID)
-		// In full implementation, validate hash and store data
-		return nil
+	p2pNode.SetChunkStoreHandler(func(req *p2p.StoreRequest, data []byte) error {
+		logging.Debugf("Storing chunk: %s", req.ChunkID)
+		return chunkService.StoreChunk(req.ChunkID, req.FileID, req.ChunkIndex, req.Hash, data)
 	})
 
 	p2pNode.SetChunkRetrieveHandler(func(chunkID string) ([]byte, error) {
-		log.Printf("Retrieving chunk: %s", chunkID)
-		// In full implementation, read from disk
-		return []byte{}, nil
+		logging.Debugf("Retrieving chunk: %s", chunkID)
+		return chunkService.GetChunkData(chunkID)
 	})
 
+	p2pNode.SetMerkleProofHandler(proofEngine.MerkleProof)
 	p2pNode.SetProofChallengeHandler(func(chunkID string, seed []byte, difficulty int) (string, int64, error) {
-		log.Printf("Processing proof challenge for chunk: %s", chunkID)
+		logging.Debugf("Processing proof challenge for chunk: %s", chunkID)
 		result, err := proofEngine.GenerateProof(chunkID, seed, difficulty)
 		if err != nil {
 			return "", 0, err
 		}
+		if result.Cached {
+			logging.Debugf("Proof for chunk %s served from cache", chunkID)
+		}
 		return result.ProofHash, result.DurationMs, nil
 	})
+	p2pNode.SetFileProofHandler(func(seed []byte, chunkIDs []string) (string, error) {
+		logging.Debugf("Processing file challenge over %d chunks", len(chunkIDs))
+		return proofEngine.FileProof(seed, chunkIDs)
+	})
+
+	capacityProver := services.NewCapacityProver(cfg.Node.DataDir)
+	p2pNode.SetCapacityProofHandler(func(blockSize int, offsets []int64) (p2p.CapacityRegion, error) {
+		logging.Infof("Processing capacity challenge for %d blocks of %d bytes", len(offsets), blockSize)
+		region, err := capacityProver.Begin(blockSize, offsets)
+		if err != nil {
+			return nil, err
+		}
+		return region, nil
+	})
 
-	log.Printf("Storage node started with Peer ID: %s", p2pNode.IDString())
-	log.Printf("Listening on:")
+	logging.Infof("Storage node started with Peer ID: %s", p2pNode.IDString())
+	logging.Infof("Listening on:")
 	for _, addr := range p2pNode.Addrs() {
-		log.Printf("  %s", addr)
+		logging.Infof("  %s", addr)
 	}
 
-	// Start heartbeat loop
+	// Start heartbeat loop, staggered so a fleet restarted together does not beat in lockstep
 	go func() {
-		ticker := time.NewTicker(30 * time.Second)
-		defer ticker.Stop()
+		schedule := services.NewHeartbeatScheduler(30*time.Second,
+			time.Duration(cfg.Node.HeartbeatJitterSeconds)*time.Second, time.Now().UnixNano())
+		timer := time.NewTimer(schedule.Initial())
+		defer timer.Stop()
 
 		for {
 			select {
-			case <-ticker.C:
+			case <-timer.C:
 				totalStorage, _ := chunkService.GetTotalStorage()
 				resp, err := coordinatorClient.SendHeartbeat(totalStorage)
+				metrics.RecordHeartbeat(err)
 				if err != nil {
-					log.Printf("Heartbeat failed: %v", err)
+					logging.Warnf("Heartbeat failed: %v", err)
 				} else {
-					log.Printf("Heartbeat sent. Earned credits: %d", resp.EarnedCredits)
+					logging.Debugf("Heartbeat sent. Earned credits: %d", resp.EarnedCredits)
+					followCoordinatorIdentity(cfg, cfgFile, p2pNode, resp)
 				}
+				timer.Reset(schedule.Next())
 			}
 		}
 	}()
@@ -271,10 +390,64 @@ func runStart(cmd *cobra.Command, args []string) error {
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	<-sigChan
 
-	log.Println("Shutting down storage node...")
+	stats := proofEngine.CacheStats()
+	logging.Infof("Proof cache: %d hits, %d misses, %d entries", stats.Hits, stats.Misses, stats.Entries)
+	logging.Infof("Shutting down storage node...")
 	return nil
 }
 
+// followCoordinatorIdentity switches the peer allowed to open chunk and proof
+// streams to the coordinator's current peer ID when it has been rotated, and
+// saves it so a restart keeps accepting the coordinator. The heartbeat comes
+// over plain HTTP as often as not, so a pinned peer ID is only replaced by a
+// rotation the pinned peer signed. A node with none pinned takes the peer ID
+// as it would from registration.
+func followCoordinatorIdentity(cfg *config.Config, cfgFile string, p2pNode *p2p.Node, resp *services.HeartbeatResponse) {
+	peerID := resp.CoordinatorPeerID
+	if peerID == "" || peerID == cfg.Coordinator.AuthorizedPeerID {
+		return
+	}
+	if cfg.Coordinator.AuthorizedPeerID == "" {
+		if err := p2pNode.SetAuthorizedPeer(peerID); err != nil {
+			logging.Warnf("Ignoring coordinator peer ID from heartbeat: %v", err)
+			return
+		}
+	} else {
+		rotation := resp.CoordinatorRotation
+		if rotation == nil || rotation.PeerID != peerID || rotation.PreviousPeerID != cfg.Coordinator.AuthorizedPeerID {
+			logging.Warnf("Ignoring coordinator peer ID %s from heartbeat: no rotation from %s to it", peerID, cfg.Coordinator.AuthorizedPeerID)
+			return
+		}
+		if err := p2pNode.FollowRotation(peerID, rotation.Signature); err != nil {
+			logging.Warnf("Ignoring coordinator peer ID %s from heartbeat: %v", peerID, err)
+			return
+		}
+	}
+	logging.Infof("Coordinator peer ID changed from %q to %s", cfg.Coordinator.AuthorizedPeerID, peerID)
+	cfg.Coordinator.AuthorizedPeerID = peerID
+	if err := cfg.Save(cfgFile); err != nil {
+		logging.Warnf("Failed to save coordinator peer ID to %s: %v", cfgFile, err)
+	}
+}
+
+// startMetricsServer serves metrics at /metrics on the admin API address
+func startMetricsServer(api config.APIConfig, metrics *services.Metrics) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	server := &http.Server{
+		Addr:              net.JoinHostPort(api.Host, strconv.Itoa(api.Port)),
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logging.Errorf("Metrics server stopped: %v", err)
+		}
+	}()
+	logging.Infof("Serving metrics at http://%s/metrics", server.Addr)
+	return server
+}
+
 func chunksCmd() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "chunks",
@@ -302,7 +475,7 @@ func chunksCmd() *cobra.Command {
 			}
 			defer db.Close()
 
-			chunkService := services.NewChunkService(db, cfg.Storage.ChunkDir)
+			chunkService := services.NewChunkService(db, cfg.Storage.ChunkDir, storageLimits(cfg))
 			chunks, err := chunkService.ListChunks()
 			if err != nil {
 				return fmt.Errorf("failed to list chunks: %w", err)
@@ -338,3 +511,405 @@ func drainCmd() *cobra.Command {
 		},
 	}
 }
+
+func doctorCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "doctor",
+		Short: "Check that the node is ready to run",
+		Long:  `Verify the chunk directory is writable, the database is migrated and the coordinator is reachable.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if cfgFile == "" {
+				cfgFile = "config.toml"
+			}
+
+			cfg, err := config.Load(cfgFile)
+			if err != nil {
+				return fmt.Errorf("failed to load config: %w", err)
+			}
+
+			dbPath := filepath.Join(cfg.Node.DataDir, "storage.db")
+			db, err := storage.New(dbPath)
+			if err != nil {
+				return fmt.Errorf("failed to initialize database: %w", err)
+			}
+			defer db.Close()
+
+			results := services.RunPreflight(cfg.Storage.ChunkDir, db, services.NewCoordinatorClient(&cfg.Coordinator))
+			printPreflightReport(results)
+			if services.HasCriticalFailure(results) {
+				return fmt.Errorf("critical checks failed")
+			}
+			return nil
+		},
+	}
+}
+
+func setCapacityCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "set-capacity <gb>",
+		Short: "Update the node's total storage capacity",
+		Long:  `Report a new total capacity to the coordinator (e.g. after adding disks) and save it as max_storage_gb. The coordinator refuses a capacity below the storage already in use.`,
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			totalGB, err := strconv.Atoi(args[0])
+			if err != nil || totalGB < 1 {
+				return fmt.Errorf("capacity must be a positive number of GB, got %q", args[0])
+			}
+
+			if cfgFile == "" {
+				cfgFile = "config.toml"
+			}
+			cfg, err := config.Load(cfgFile)
+			if err != nil {
+				return fmt.Errorf("failed to load config: %w", err)
+			}
+
+			totalBytes, err := services.NewCoordinatorClient(&cfg.Coordinator).UpdateCapacity(totalGB)
+			if err != nil {
+				return err
+			}
+
+			cfg.Node.MaxStorageGB = totalGB
+			if err := cfg.Save(cfgFile); err != nil {
+				return fmt.Errorf("capacity updated on coordinator but failed to save config: %w", err)
+			}
+
+			fmt.Printf("Capacity set to %d GB (%d bytes)\n", totalGB, totalBytes)
+			return nil
+		},
+	}
+}
+
+func rotateKeyCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "rotate-key",
+		Short: "Replace the node's coordinator API key",
+		Long:  `Obtain a new API key from the coordinator and save it to the config file. The old key stops working immediately.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if cfgFile == "" {
+				cfgFile = "config.toml"
+			}
+			cfg, err := config.Load(cfgFile)
+			if err != nil {
+				return fmt.Errorf("failed to load config: %w", err)
+			}
+
+			apiKey, err := services.NewCoordinatorClient(&cfg.Coordinator).RotateAPIKey()
+			if err != nil {
+				return err
+			}
+
+			cfg.Coordinator.APIKey = apiKey
+			if err := cfg.Save(cfgFile); err != nil {
+				// The old key is already revoked; make sure the operator can recover the new one
+				return fmt.Errorf("failed to save config, new API key is %s: %w", apiKey, err)
+			}
+
+			fmt.Println("API key rotated and saved to", cfgFile)
+			return nil
+		},
+	}
+}
+
+func maintenanceCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "maintenance",
+		Short: "Schedule a maintenance window with the coordinator",
+		Long:  `Tell the coordinator when the node will be offline. Ahead of the window the coordinator copies the node's chunks to other nodes and stops placing new chunks on it; once the window ends the node is used again automatically.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if cfgFile == "" {
+				cfgFile = "config.toml"
+			}
+			cfg, err := config.Load(cfgFile)
+			if err != nil {
+				return fmt.Errorf("failed to load config: %w", err)
+			}
+			client := services.NewCoordinatorClient(&cfg.Coordinator)
+
+			if cancel, _ := cmd.Flags().GetBool("cancel"); cancel {
+				if err := client.CancelMaintenance(); err != nil {
+					return err
+				}
+				fmt.Println("Maintenance window canceled")
+				return nil
+			}
+
+			start := time.Now()
+			if s, _ := cmd.Flags().GetString("start"); s != "" {
+				start, err = time.Parse(time.RFC3339, s)
+				if err != nil {
+					return fmt.Errorf("start must be an RFC 3339 time such as 2025-01-01T02:00:00Z, got %q", s)
+				}
+			}
+			duration, _ := cmd.Flags().GetDuration("duration")
+			if duration <= 0 {
+				return fmt.Errorf("duration must be positive")
+			}
+
+			end := start.Add(duration)
+			if err := client.ScheduleMaintenance(start, end); err != nil {
+				return err
+			}
+			fmt.Printf("Maintenance scheduled from %s to %s\n", start.Format(time.RFC3339), end.Format(time.RFC3339))
+			return nil
+		},
+	}
+
+	cmd.Flags().String("start", "", "Window start as an RFC 3339 time (default now)")
+	cmd.Flags().Duration("duration", 2*time.Hour, "Window length, e.g. 90m")
+	cmd.Flags().Bool("cancel", false, "Cancel the scheduled window instead")
+
+	return cmd
+}
+
+func decommissionCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "decommission",
+		Short: "Permanently retire the node, handing its chunks to other nodes",
+		Long: `Stop the coordinator placing chunks on this node, then send each stored chunk to the coordinator.
+A local copy is deleted only once the coordinator confirms the chunk is re-replicated on other nodes.
+When every chunk has been handed off the node is deregistered and its API key stops working.
+An interrupted run can be repeated; it continues with the chunks still held.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if yes, _ := cmd.Flags().GetBool("yes"); !yes {
+				return fmt.Errorf("decommissioning deletes local chunks and retires the node for good; pass --yes to proceed")
+			}
+			if cfgFile == "" {
+				cfgFile = "config.toml"
+			}
+			cfg, err := config.Load(cfgFile)
+			if err != nil {
+				return fmt.Errorf("failed to load config: %w", err)
+			}
+
+			db, err := storage.New(filepath.Join(cfg.Node.DataDir, "storage.db"))
+			if err != nil {
+				return fmt.Errorf("failed to initialize database: %w", err)
+			}
+			defer db.Close()
+			chunkService := services.NewChunkService(db, cfg.Storage.ChunkDir, storageLimits(cfg))
+			client := services.NewCoordinatorClient(&cfg.Coordinator)
+
+			assigned, err := client.StartDecommission()
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Node marked as decommissioning; the coordinator lists %d chunks on it\n", assigned)
+
+			ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			report, err := services.Decommission(ctx, chunkService, client, func(p services.DecommissionProgress) {
+				if p.Err != nil {
+					fmt.Printf("[%d/%d] %s kept: %v\n", p.Done, p.Total, p.ChunkID, p.Err)
+					return
+				}
+				fmt.Printf("[%d/%d] %s migrated\n", p.Done, p.Total, p.ChunkID)
+			})
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("Migrated %d of %d chunks", report.Migrated, report.Total)
+			if len(report.Unknown) > 0 {
+				fmt.Printf(", %d unknown to the coordinator kept", len(report.Unknown))
+			}
+			fmt.Println()
+			if !report.Complete() {
+				if report.Canceled {
+					return fmt.Errorf("interrupted; run decommission again to continue")
+				}
+				return fmt.Errorf("%d chunks could not be migrated; run decommission again to retry", len(report.Failed))
+			}
+
+			if err := client.Deregister(); err != nil {
+				return err
+			}
+			fmt.Println("Node deregistered; it can now be shut down for good")
+			return nil
+		},
+	}
+
+	cmd.Flags().Bool("yes", false, "Confirm the node is to be retired")
+
+	return cmd
+}
+
+func retryProofsCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "retry-proofs",
+		Short: "Replay recently failed proofs to reverse their penalty",
+		Long: `Ask the coordinator to re-issue the proof challenges this node failed recently, e.g. while it was down,
+for chunks it still holds, and answer each one. A passing retry reverses the failure's penalty.
+Each failure can be retried once, and the coordinator caps how many retries a node gets per window.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if cfgFile == "" {
+				cfgFile = "config.toml"
+			}
+			cfg, err := config.Load(cfgFile)
+			if err != nil {
+				return fmt.Errorf("failed to load config: %w", err)
+			}
+
+			db, err := storage.New(filepath.Join(cfg.Node.DataDir, "storage.db"))
+			if err != nil {
+				return fmt.Errorf("failed to initialize database: %w", err)
+			}
+			defer db.Close()
+			chunkService := services.NewChunkService(db, cfg.Storage.ChunkDir, storageLimits(cfg))
+			proofEngine := services.NewProofEngine(chunkService)
+			proofEngine.SetMaxDifficulty(cfg.Storage.MaxProofDifficulty)
+			client := services.NewCoordinatorClient(&cfg.Coordinator)
+
+			ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			report, err := services.RetryProofs(ctx, chunkService, proofEngine, client, func(p services.RetryProgress) {
+				if p.Err != nil {
+					fmt.Printf("[%d/%d] %s failed: %v\n", p.Done, p.Total, p.ChunkID, p.Err)
+					return
+				}
+				fmt.Printf("[%d/%d] %s proven, failure excused\n", p.Done, p.Total, p.ChunkID)
+			})
+			if err != nil {
+				return err
+			}
+
+			if report.Issued == 0 {
+				fmt.Println("No failed proofs to retry")
+				return nil
+			}
+			fmt.Printf("Excused %d of %d failed proofs\n", report.Excused, report.Issued)
+			if report.Canceled {
+				return fmt.Errorf("interrupted; unanswered retries lapse and are not re-issued")
+			}
+			if len(report.Failed) > 0 {
+				return fmt.Errorf("%d retries did not pass", len(report.Failed))
+			}
+			return nil
+		},
+	}
+}
+
+// readPassphrase takes the archive passphrase from STORAGE_NODE_PASSPHRASE or,
+// failing that, the first line of stdin
+func readPassphrase() (string, error) {
+	if p := os.Getenv("STORAGE_NODE_PASSPHRASE"); p != "" {
+		return p, nil
+	}
+	fmt.Fprint(os.Stderr, "Passphrase: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("failed to read passphrase: %w", err)
+	}
+	passphrase := strings.TrimRight(line, "\r\n")
+	if passphrase == "" {
+		return "", fmt.Errorf("passphrase must not be empty")
+	}
+	return passphrase, nil
+}
+
+func exportConfigCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "export-config <file>",
+		Short: "Export the node's identity to an encrypted archive",
+		Long:  `Bundle the config, private key and coordinator credentials into a passphrase-protected archive, so the node can be redeployed without losing its identity or chunks. The passphrase is read from STORAGE_NODE_PASSPHRASE or stdin.`,
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if cfgFile == "" {
+				cfgFile = "config.toml"
+			}
+			cfg, err := config.Load(cfgFile)
+			if err != nil {
+				return fmt.Errorf("failed to load config: %w", err)
+			}
+			privKey, err := os.ReadFile(filepath.Join(cfg.Node.DataDir, "private.key"))
+			if err != nil {
+				return fmt.Errorf("failed to read private key: %w", err)
+			}
+
+			passphrase, err := readPassphrase()
+			if err != nil {
+				return err
+			}
+			archive, err := config.ExportBundle(&config.Bundle{Config: cfg, PrivateKey: privKey}, passphrase)
+			if err != nil {
+				return err
+			}
+			if err := os.WriteFile(args[0], archive, 0600); err != nil {
+				return fmt.Errorf("failed to write archive: %w", err)
+			}
+
+			fmt.Printf("Exported node %s to %s\n", cfg.Coordinator.PeerID, args[0])
+			return nil
+		},
+	}
+}
+
+func importConfigCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "import-config <file>",
+		Short: "Restore the node's identity from an archive",
+		Long:  `Decrypt an archive made by export-config and restore its config and private key. The passphrase is read from STORAGE_NODE_PASSPHRASE or stdin.`,
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			force, _ := cmd.Flags().GetBool("force")
+			if cfgFile == "" {
+				cfgFile = "config.toml"
+			}
+			if _, err := os.Stat(cfgFile); err == nil && !force {
+				return fmt.Errorf("%s already exists; use --force to overwrite it", cfgFile)
+			}
+
+			archive, err := os.ReadFile(args[0])
+			if err != nil {
+				return fmt.Errorf("failed to read archive: %w", err)
+			}
+			passphrase, err := readPassphrase()
+			if err != nil {
+				return err
+			}
+			bundle, err := config.ImportBundle(archive, passphrase)
+			if err != nil {
+				return err
+			}
+
+			if err := bundle.Config.EnsureDirs(); err != nil {
+				return err
+			}
+			keyFile := filepath.Join(bundle.Config.Node.DataDir, "private.key")
+			if err := os.WriteFile(keyFile, bundle.PrivateKey, 0600); err != nil {
+				return fmt.Errorf("failed to save private key: %w", err)
+			}
+			if err := bundle.Config.Save(cfgFile); err != nil {
+				return err
+			}
+
+			fmt.Printf("Restored node %s; config saved to %s\n", bundle.Config.Coordinator.PeerID, cfgFile)
+			return nil
+		},
+	}
+
+	cmd.Flags().Bool("force", false, "Overwrite an existing config file")
+	return cmd
+}
+
+func printPreflightReport(results []services.CheckResult) {
+	fmt.Println("Preflight checks:")
+	for _, r := range results {
+		switch {
+		case r.Passed():
+			fmt.Printf("  [PASS] %s\n", r.Name)
+		case r.Critical:
+			fmt.Printf("  [FAIL] %s: %v\n", r.Name, r.Err)
+		default:
+			fmt.Printf("  [WARN] %s: %v\n", r.Name, r.Err)
+		}
+	}
+}
+
+// storageLimits derives the chunk store's size limits from the node config
+func storageLimits(cfg *config.Config) services.StorageLimits {
+	return services.StorageLimits{
+		MaxBytes:           int64(cfg.Node.MaxStorageGB) * 1024 * 1024 * 1024,
+		ReserveFreePercent: cfg.Storage.ReserveFreePercent,
+	}
+}
@@ -0,0 +1,154 @@
+package config
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/pelletier/go-toml/v2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// bundleVersion is the format version written into exported archives
+const bundleVersion = 1
+
+// scrypt parameters for deriving the archive key from a passphrase
+const (
+	scryptN      = 1 << 15
+	scryptR      = 8
+	scryptP      = 1
+	bundleKeyLen = 32
+)
+
+// ErrBadPassphrase is returned when an archive cannot be decrypted, either
+// because the passphrase is wrong or the archive was altered
+var ErrBadPassphrase = errors.New("wrong passphrase or corrupted archive")
+
+// Bundle is everything needed to bring a node back up elsewhere under the same
+// identity: its config (including peer ID and coordinator API key) and its
+// private key
+type Bundle struct {
+	Config     *Config
+	PrivateKey []byte
+}
+
+// bundleEnvelope is the on-disk archive: the encrypted payload plus what is
+// needed to derive its key
+type bundleEnvelope struct {
+	Version    int         `json:"version"`
+	Salt       strictBytes `json:"salt"`
+	Nonce      strictBytes `json:"nonce"`
+	Ciphertext strictBytes `json:"ciphertext"`
+}
+
+// strictBytes is base64 that only decodes from its canonical encoding, so an
+// edited archive can't decode to the same bytes through unused padding bits
+type strictBytes []byte
+
+// UnmarshalJSON decodes a base64 string, rejecting non-canonical encodings
+func (b *strictBytes) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	decoded, err := base64.StdEncoding.Strict().DecodeString(s)
+	if err != nil {
+		return err
+	}
+	*b = decoded
+	return nil
+}
+
+// bundlePayload is the plaintext sealed inside an envelope
+type bundlePayload struct {
+	Config     string `json:"config"`
+	PrivateKey []byte `json:"private_key"`
+}
+
+// ExportBundle serializes b and encrypts it with a key derived from passphrase
+func ExportBundle(b *Bundle, passphrase string) ([]byte, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("passphrase must not be empty")
+	}
+
+	cfgData, err := toml.Marshal(b.Config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal config: %w", err)
+	}
+	plaintext, err := json.Marshal(bundlePayload{Config: string(cfgData), PrivateKey: b.PrivateKey})
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+	gcm, err := bundleCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	return json.Marshal(bundleEnvelope{
+		Version:    bundleVersion,
+		Salt:       salt,
+		Nonce:      nonce,
+		Ciphertext: gcm.Seal(nil, nonce, plaintext, nil),
+	})
+}
+
+// ImportBundle decrypts an archive produced by ExportBundle
+func ImportBundle(data []byte, passphrase string) (*Bundle, error) {
+	var env bundleEnvelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, fmt.Errorf("not a node config archive: %w", err)
+	}
+	if env.Version != bundleVersion {
+		return nil, fmt.Errorf("unsupported archive version %d", env.Version)
+	}
+
+	gcm, err := bundleCipher(passphrase, env.Salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(env.Nonce) != gcm.NonceSize() {
+		return nil, ErrBadPassphrase
+	}
+	plaintext, err := gcm.Open(nil, env.Nonce, env.Ciphertext, nil)
+	if err != nil {
+		return nil, ErrBadPassphrase
+	}
+
+	var payload bundlePayload
+	if err := json.Unmarshal(plaintext, &payload); err != nil {
+		return nil, fmt.Errorf("failed to decode archive: %w", err)
+	}
+	var cfg Config
+	if err := decodeStrict([]byte(payload.Config), &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse archived config: %w", err)
+	}
+	cfg.setDefaults()
+
+	return &Bundle{Config: &cfg, PrivateKey: payload.PrivateKey}, nil
+}
+
+// bundleCipher derives the archive key from passphrase and salt
+func bundleCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, bundleKeyLen)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,69 @@
+package config
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBundle_RoundTrip(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Node.Name = "rack-7"
+	cfg.Node.DataDir = "/srv/node"
+	cfg.Coordinator.URL = "https://coordinator.example.com"
+	cfg.Coordinator.PeerID = "12D3KooWExamplePeer"
+	cfg.Coordinator.APIKey = "fsn_secret"
+	cfg.Coordinator.AuthorizedPeerID = "12D3KooWCoordinator"
+	privKey := []byte("base64-private-key-bytes")
+
+	archive, err := ExportBundle(&Bundle{Config: cfg, PrivateKey: privKey}, "correct horse")
+	require.NoError(t, err)
+	assert.NotContains(t, string(archive), "fsn_secret", "Archive must not leak credentials")
+	assert.NotContains(t, string(archive), "12D3KooWExamplePeer")
+
+	restored, err := ImportBundle(archive, "correct horse")
+	require.NoError(t, err)
+	assert.Equal(t, privKey, restored.PrivateKey)
+	assert.Equal(t, cfg.Coordinator, restored.Config.Coordinator, "Peer ID and API key must survive the round trip")
+	assert.Equal(t, cfg.Node, restored.Config.Node)
+	assert.Equal(t, cfg.Storage, restored.Config.Storage)
+}
+
+func TestBundle_RejectsWrongPassphraseAndTampering(t *testing.T) {
+	archive, err := ExportBundle(&Bundle{Config: DefaultConfig(), PrivateKey: []byte("key")}, "right")
+	require.NoError(t, err)
+
+	_, err = ImportBundle(archive, "wrong")
+	assert.ErrorIs(t, err, ErrBadPassphrase)
+
+	tampered := append([]byte(nil), archive...)
+	// Flip a character inside the base64 ciphertext near the end of the JSON
+	i := len(tampered) - 5
+	if tampered[i] == 'A' {
+		tampered[i] = 'B'
+	} else {
+		tampered[i] = 'A'
+	}
+	_, err = ImportBundle(tampered, "right")
+	assert.Error(t, err)
+
+	_, err = ExportBundle(&Bundle{Config: DefaultConfig()}, "")
+	assert.Error(t, err, "Empty passphrase should be refused")
+}
+
+func TestBundle_RejectsTamperedCiphertext(t *testing.T) {
+	archive, err := ExportBundle(&Bundle{Config: DefaultConfig(), PrivateKey: []byte("key")}, "right")
+	require.NoError(t, err)
+
+	// Flip a bit of the ciphertext itself; editing its base64 text can land
+	// on padding bits that decode to the same bytes
+	var envelope bundleEnvelope
+	require.NoError(t, json.Unmarshal(archive, &envelope))
+	envelope.Ciphertext[len(envelope.Ciphertext)-1] ^= 0x01
+	tampered, err := json.Marshal(envelope)
+	require.NoError(t, err)
+	_, err = ImportBundle(tampered, "right")
+	assert.Error(t, err)
+}
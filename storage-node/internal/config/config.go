@@ -15,6 +15,8 @@ type Config struct {
 	Storage     StorageConfig     `toml:"storage"`
 	API         APIConfig         `toml:"api"`
 	P2P         P2PConfig         `toml:"p2p"`
+
+	overrides []envOverride // values taken from the environment, kept out of Save
 }
 
 // NodeConfig holds node identity and settings
@@ -23,6 +25,11 @@ type NodeConfig struct {
 	DataDir      string `toml:"data_dir"`
 	MaxStorageGB int    `toml:"max_storage_gb"`
 	APIKey       string `toml:"api_key"`
+	LogLevel     string `toml:"log_level"`       // debug, info, warn or error
+	LogFile      string `toml:"log_file"`        // stdout, stderr or a file path
+	LogMaxSizeMB int    `toml:"log_max_size_mb"` // rotate log_file past this size
+	// HeartbeatJitterSeconds shifts each heartbeat by up to this much either way; negative disables
+	HeartbeatJitterSeconds int `toml:"heartbeat_jitter_seconds"`
 }
 
 // CoordinatorConfig holds coordinator connection info
@@ -31,23 +38,61 @@ type CoordinatorConfig struct {
 	AuthToken string `toml:"auth_token"`
 	PeerID    string `toml:"peer_id"`
 	APIKey    string `toml:"api_key"`
+	// AuthorizedPeerID is the coordinator's libp2p peer ID; only it may open chunk and proof streams
+	AuthorizedPeerID string `toml:"authorized_peer_id"`
 }
 
 // StorageConfig holds storage settings
 type StorageConfig struct {
 	ChunkDir string `toml:"chunk_dir"`
+	// ReserveFreePercent is the share of the chunk volume kept free; writes that would dip below it are refused
+	ReserveFreePercent float64 `toml:"reserve_free_percent"`
+	// MaxProofDifficulty refuses proof challenges needing more hashing rounds; 0 means no cap
+	MaxProofDifficulty int `toml:"max_proof_difficulty"`
+	// ProofCacheEntries is how many computed proofs are kept for re-issued challenges; negative disables
+	ProofCacheEntries int `toml:"proof_cache_entries"`
+	// MaxConcurrentStores bounds chunk writes in flight; negative disables
+	MaxConcurrentStores int `toml:"max_concurrent_stores"`
+	// StoreQueueWaitMs is how long a write waits for a free slot before being refused; negative refuses at once
+	StoreQueueWaitMs int `toml:"store_queue_wait_ms"`
+	// Dedup stores content already held under another chunk ID as a hard
+	// link to the existing file instead of a second copy
+	Dedup bool `toml:"dedup"`
 }
 
 // APIConfig holds admin API settings
 type APIConfig struct {
 	Host string `toml:"host"`
 	Port int    `toml:"port"`
+	// MetricsEnabled serves Prometheus metrics at /metrics on host:port
+	MetricsEnabled bool `toml:"metrics_enabled"`
 }
 
 // P2PConfig holds libp2p configuration
 type P2PConfig struct {
 	ListenAddresses []string `toml:"listen_addresses"`
 	BootstrapPeers  []string `toml:"bootstrap_peers"`
+	// EnableTCP and EnableQUIC choose the transports the node listens on;
+	// listen addresses for a disabled one are ignored. Both unset enables both.
+	EnableTCP  bool `toml:"enable_tcp"`
+	EnableQUIC bool `toml:"enable_quic"`
+	// ExternalAddress is the multiaddr registered with the coordinator, for
+	// nodes behind NAT or port forwarding; empty picks the best listen address
+	ExternalAddress string `toml:"external_address"`
+	// StreamTimeoutSeconds bounds how long an inbound stream may take, so a stuck peer cannot hold it open; negative disables
+	StreamTimeoutSeconds int `toml:"stream_timeout_seconds"`
+	// Security requires "noise" or "tls" on TCP connections, refusing peers
+	// that offer only the other; empty accepts either. QUIC always uses TLS.
+	Security string `toml:"security"`
+	// MaxPeers and MaxStreams cap connections and open streams; 0 keeps
+	// libp2p's defaults, which scale with the machine
+	MaxPeers   int `toml:"max_peers"`
+	MaxStreams int `toml:"max_streams"`
+	// StoreRatePerSecond caps chunk stores accepted over P2P, in bursts of up
+	// to StoreBurst (0 for a second's worth); senders beyond it are told to
+	// back off. Negative disables.
+	StoreRatePerSecond int `toml:"store_rate_per_second"`
+	StoreBurst         int `toml:"store_burst"`
 }
 
 // Load loads configuration from TOML file
@@ -58,19 +103,29 @@ func Load(path string) (*Config, error) {
 	}
 
 	var config Config
-	if err := toml.Unmarshal(data, &config); err != nil {
-		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	if err := decodeStrict(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	// Environment variables override the file, e.g. STORAGE_NODE_COORDINATOR_API_KEY
+	if err := config.applyEnv(); err != nil {
+		return nil, fmt.Errorf("invalid environment override: %w", err)
 	}
 
 	// Set defaults
 	config.setDefaults()
 
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+
 	return &config, nil
 }
 
-// Save saves configuration to TOML file
+// Save saves configuration to TOML file. Values overridden from the
+// environment are saved as the file had them, unless changed since.
 func (c *Config) Save(path string) error {
-	data, err := toml.Marshal(c)
+	data, err := toml.Marshal(c.withoutEnv())
 	if err != nil {
 		return fmt.Errorf("failed to marshal config: %w", err)
 	}
@@ -100,9 +155,43 @@ func (c *Config) setDefaults() {
 	if c.Node.MaxStorageGB == 0 {
 		c.Node.MaxStorageGB = 100
 	}
+	if c.Node.LogLevel == "" {
+		c.Node.LogLevel = "info"
+	}
+	if c.Node.LogFile == "" {
+		c.Node.LogFile = "stderr"
+	}
+	if c.Node.LogMaxSizeMB == 0 {
+		c.Node.LogMaxSizeMB = 100
+	}
+	if c.Node.HeartbeatJitterSeconds == 0 {
+		c.Node.HeartbeatJitterSeconds = 5
+	}
 	if c.Storage.ChunkDir == "" {
 		c.Storage.ChunkDir = filepath.Join(c.Node.DataDir, "chunks")
 	}
+	if c.Storage.ReserveFreePercent == 0 {
+		c.Storage.ReserveFreePercent = 10
+	}
+	if c.Storage.ProofCacheEntries == 0 {
+		c.Storage.ProofCacheEntries = 1024
+	}
+	if c.Storage.MaxConcurrentStores == 0 {
+		c.Storage.MaxConcurrentStores = 4
+	}
+	if c.Storage.StoreQueueWaitMs == 0 {
+		c.Storage.StoreQueueWaitMs = 5000
+	}
+	if !c.P2P.EnableTCP && !c.P2P.EnableQUIC {
+		c.P2P.EnableTCP = true
+		c.P2P.EnableQUIC = true
+	}
+	if c.P2P.StreamTimeoutSeconds == 0 {
+		c.P2P.StreamTimeoutSeconds = 120
+	}
+	if c.P2P.StoreRatePerSecond == 0 {
+		c.P2P.StoreRatePerSecond = 100
+	}
 	if c.API.Host == "" {
 		c.API.Host = "127.0.0.1"
 	}
@@ -0,0 +1,128 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.toml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestLoad_ExampleConfigs(t *testing.T) {
+	paths, err := filepath.Glob("../../config*.toml")
+	require.NoError(t, err)
+	require.NotEmpty(t, paths)
+	for _, path := range paths {
+		_, err := Load(path)
+		assert.NoError(t, err, path)
+	}
+}
+
+func TestLoad_RejectsUnknownKey(t *testing.T) {
+	path := writeConfig(t, `
+[node]
+name = "typo"
+max_storage_gigabytes = 500
+`)
+
+	_, err := Load(path)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unknown config key: node.max_storage_gigabytes (line 4)")
+}
+
+func TestLoad_RejectsInvalidValues(t *testing.T) {
+	path := writeConfig(t, `
+[coordinator]
+url = "localhost:8080"
+
+[storage]
+reserve_free_percent = 150
+
+[api]
+port = -1
+
+[p2p]
+external_address = "203.0.113.7:4001"
+security = "plaintext"
+max_peers = -1
+`)
+
+	_, err := Load(path)
+	require.Error(t, err)
+	for _, want := range []string{
+		`coordinator.url: "localhost:8080" is not an http(s) URL`,
+		"storage.reserve_free_percent: must be below 100, got 150",
+		"api.port: must be between 1 and 65535, got -1",
+		`p2p.external_address: "203.0.113.7:4001" is not a multiaddr`,
+		`p2p.security: must be noise, tls or empty for either, got "plaintext"`,
+		"p2p.max_peers: must not be negative, got -1",
+	} {
+		assert.Contains(t, err.Error(), want)
+	}
+}
+
+func TestConfig_SaveThenLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	cfg := DefaultConfig()
+	cfg.Node.Name = "round-trip"
+	cfg.Coordinator.URL = "http://localhost:8080"
+	require.NoError(t, cfg.Save(path))
+
+	loaded, err := Load(path)
+	require.NoError(t, err, "A saved config must load under strict decoding")
+	assert.Equal(t, cfg.Node, loaded.Node)
+	assert.Equal(t, cfg.Coordinator, loaded.Coordinator)
+	assert.Equal(t, cfg.Storage, loaded.Storage)
+}
+
+func TestLoad_EnvOverridesFile(t *testing.T) {
+	path := writeConfig(t, `
+[node]
+name = "from-file"
+
+[coordinator]
+url = "http://localhost:8080"
+api_key = "file-key"
+
+[api]
+port = 8081
+`)
+	t.Setenv("STORAGE_NODE_COORDINATOR_API_KEY", "env-key")
+	t.Setenv("STORAGE_NODE_API_PORT", "9091")
+	t.Setenv("STORAGE_NODE_P2P_LISTEN_ADDRESSES", "/ip4/0.0.0.0/tcp/4001, /ip4/0.0.0.0/udp/4001/quic-v1")
+	t.Setenv("STORAGE_NODE_NODE_NAME", "")
+
+	cfg, err := Load(path)
+	require.NoError(t, err)
+	assert.Equal(t, "env-key", cfg.Coordinator.APIKey)
+	assert.Equal(t, 9091, cfg.API.Port)
+	assert.Equal(t, []string{"/ip4/0.0.0.0/tcp/4001", "/ip4/0.0.0.0/udp/4001/quic-v1"}, cfg.P2P.ListenAddresses)
+	assert.Equal(t, "from-file", cfg.Node.Name, "An empty variable must not override the file")
+
+	// Saving keeps overridden values out of the file but keeps later changes
+	cfg.API.Port = 9092
+	require.NoError(t, cfg.Save(path))
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "file-key")
+	assert.NotContains(t, string(data), "env-key")
+	assert.Equal(t, "env-key", cfg.Coordinator.APIKey, "Saving must not change the loaded config")
+
+	t.Setenv("STORAGE_NODE_API_PORT", "")
+	saved, err := Load(path)
+	require.NoError(t, err)
+	assert.Equal(t, 9092, saved.API.Port)
+
+	t.Setenv("STORAGE_NODE_API_PORT", "eighty")
+	_, err = Load(path)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `STORAGE_NODE_API_PORT: "eighty" is not an integer`)
+}
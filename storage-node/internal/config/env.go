@@ -0,0 +1,114 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// envPrefix starts the name of every environment variable overriding a config value
+const envPrefix = "STORAGE_NODE"
+
+// EnvName returns the environment variable that overrides a config key,
+// e.g. STORAGE_NODE_COORDINATOR_API_KEY for coordinator.api_key
+func EnvName(key string) string {
+	return envPrefix + "_" + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+// envOverride remembers a value taken from the environment so Save can put
+// the file's value back instead of persisting it
+type envOverride struct {
+	section, field int
+	file, env      reflect.Value
+}
+
+// applyEnv overrides config values with the environment variables named by
+// EnvName. It runs after the file is parsed and before defaults are filled
+// in, so the environment beats the file, which beats the defaults. Empty
+// variables are ignored and lists are comma-separated.
+func (c *Config) applyEnv() error {
+	sections := reflect.ValueOf(c).Elem()
+	for i := 0; i < sections.NumField(); i++ {
+		sectionType := sections.Type().Field(i)
+		if !sectionType.IsExported() {
+			continue
+		}
+		fields := sections.Field(i)
+		for j := 0; j < fields.NumField(); j++ {
+			key := sectionType.Tag.Get("toml") + "." + fields.Type().Field(j).Tag.Get("toml")
+			raw, ok := os.LookupEnv(EnvName(key))
+			if !ok || raw == "" {
+				continue
+			}
+
+			field := fields.Field(j)
+			file := reflect.New(field.Type()).Elem()
+			file.Set(field)
+			if err := setFromEnv(field, raw); err != nil {
+				return fmt.Errorf("%s: %w", EnvName(key), err)
+			}
+			env := reflect.New(field.Type()).Elem()
+			env.Set(field)
+			c.overrides = append(c.overrides, envOverride{section: i, field: j, file: file, env: env})
+		}
+	}
+	return nil
+}
+
+// withoutEnv returns a copy of the config holding the file's values wherever
+// an environment override is still in effect; values changed since loading
+// are kept
+func (c *Config) withoutEnv() *Config {
+	out := *c
+	out.overrides = nil
+	sections := reflect.ValueOf(&out).Elem()
+	for _, o := range c.overrides {
+		field := sections.Field(o.section).Field(o.field)
+		if reflect.DeepEqual(field.Interface(), o.env.Interface()) {
+			field.Set(o.file)
+		}
+	}
+	return &out
+}
+
+// setFromEnv parses raw as the type of field and stores it there
+func setFromEnv(field reflect.Value, raw string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(raw)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", raw)
+		}
+		field.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", raw)
+		}
+		field.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("%q is not true or false", raw)
+		}
+		field.SetBool(b)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("can only be set in the config file")
+		}
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("can only be set in the config file")
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/federated-storage/storage-node/internal/logging"
+	"github.com/pelletier/go-toml/v2"
+)
+
+// decodeStrict parses data into v, rejecting keys v has no field for so that
+// typos are reported instead of silently ignored
+func decodeStrict(data []byte, v interface{}) error {
+	dec := toml.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+
+	var strict *toml.StrictMissingError
+	if errors.As(err, &strict) {
+		keys := make([]string, len(strict.Errors))
+		for i, e := range strict.Errors {
+			row, _ := e.Position()
+			keys[i] = fmt.Sprintf("%s (line %d)", strings.Join(e.Key(), "."), row)
+		}
+		return fmt.Errorf("unknown config key: %s", strings.Join(keys, ", "))
+	}
+	return err
+}
+
+// Validate checks values that parse but make no sense, alone or together.
+// Every problem is reported, each prefixed with its config key.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, key, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: %s", key, fmt.Sprintf(format, args...)))
+		}
+	}
+
+	check(c.Node.MaxStorageGB > 0, "node.max_storage_gb", "must be positive, got %d", c.Node.MaxStorageGB)
+	if _, err := logging.ParseLevel(c.Node.LogLevel); err != nil {
+		check(false, "node.log_level", "%v", err)
+	}
+	if c.Coordinator.URL != "" {
+		u, err := url.Parse(c.Coordinator.URL)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "",
+			"coordinator.url", "%q is not an http(s) URL", c.Coordinator.URL)
+	}
+	check(c.Storage.ReserveFreePercent < 100, "storage.reserve_free_percent", "must be below 100, got %g", c.Storage.ReserveFreePercent)
+	check(c.Storage.MaxProofDifficulty >= 0, "storage.max_proof_difficulty", "must not be negative, got %d", c.Storage.MaxProofDifficulty)
+	check(c.API.Port > 0 && c.API.Port <= 65535, "api.port", "must be between 1 and 65535, got %d", c.API.Port)
+	check(c.P2P.ExternalAddress == "" || strings.HasPrefix(c.P2P.ExternalAddress, "/"),
+		"p2p.external_address", "%q is not a multiaddr such as /ip4/203.0.113.7/tcp/4001", c.P2P.ExternalAddress)
+	check(c.P2P.Security == "" || c.P2P.Security == "noise" || c.P2P.Security == "tls",
+		"p2p.security", "must be noise, tls or empty for either, got %q", c.P2P.Security)
+	check(c.P2P.MaxPeers >= 0, "p2p.max_peers", "must not be negative, got %d", c.P2P.MaxPeers)
+	check(c.P2P.MaxStreams >= 0, "p2p.max_streams", "must not be negative, got %d", c.P2P.MaxStreams)
+	check(c.P2P.StoreBurst >= 0, "p2p.store_burst", "must not be negative, got %d", c.P2P.StoreBurst)
+
+	return errors.Join(errs...)
+}
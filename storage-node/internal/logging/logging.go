@@ -0,0 +1,158 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Level is a log severity
+type Level int
+
+// Log levels, from most to least verbose
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "DEBUG",
+	LevelInfo:  "INFO",
+	LevelWarn:  "WARN",
+	LevelError: "ERROR",
+}
+
+// ParseLevel parses debug, info, warn or error (case-insensitive); empty means info
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "debug":
+		return LevelDebug, nil
+	case "", "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q (want debug, info, warn or error)", s)
+}
+
+// Logger writes messages at or above its level
+type Logger struct {
+	mu    sync.RWMutex
+	level Level
+	out   *log.Logger
+}
+
+// New creates a logger writing to w
+func New(w io.Writer, level Level) *Logger {
+	return &Logger{level: level, out: log.New(w, "", log.LstdFlags)}
+}
+
+// SetLevel changes the minimum level that is written
+func (l *Logger) SetLevel(level Level) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.level = level
+}
+
+// Enabled reports whether messages at level are written
+func (l *Logger) Enabled(level Level) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return level >= l.level
+}
+
+func (l *Logger) logf(level Level, format string, args ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	l.out.Output(3, levelNames[level]+" "+fmt.Sprintf(format, args...))
+}
+
+// Debugf logs at debug level
+func (l *Logger) Debugf(format string, args ...interface{}) { l.logf(LevelDebug, format, args...) }
+
+// Infof logs at info level
+func (l *Logger) Infof(format string, args ...interface{}) { l.logf(LevelInfo, format, args...) }
+
+// Warnf logs at warn level
+func (l *Logger) Warnf(format string, args ...interface{}) { l.logf(LevelWarn, format, args...) }
+
+// Errorf logs at error level
+func (l *Logger) Errorf(format string, args ...interface{}) { l.logf(LevelError, format, args...) }
+
+var std = New(os.Stderr, LevelInfo)
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
+
+// Setup points the package logger at the configured level and destination:
+// "stdout", "stderr" (the default when empty) or a file path, which is
+// rotated once it grows past maxSizeMB (0 disables rotation). The returned
+// closer releases the log file, if any.
+func Setup(level, file string, maxSizeMB int) (io.Closer, error) {
+	lvl, err := ParseLevel(level)
+	if err != nil {
+		return nil, err
+	}
+
+	var w io.Writer
+	var closer io.Closer = nopCloser{}
+	switch file {
+	case "", "stderr":
+		w = os.Stderr
+	case "stdout":
+		w = os.Stdout
+	default:
+		f, err := NewRotatingFile(file, int64(maxSizeMB)*1024*1024)
+		if err != nil {
+			return nil, err
+		}
+		w, closer = f, f
+	}
+
+	std = New(w, lvl)
+	// Route stray stdlib log calls (e.g. from dependencies) to the same place
+	log.SetOutput(w)
+	return closer, nil
+}
+
+// Writer returns a writer that passes output through to the package logger's
+// destination when level is enabled, for libraries that log to an io.Writer
+func Writer(level Level) io.Writer {
+	return levelWriter(level)
+}
+
+type levelWriter Level
+
+func (w levelWriter) Write(p []byte) (int, error) {
+	if !std.Enabled(Level(w)) {
+		return len(p), nil
+	}
+	return std.out.Writer().Write(p)
+}
+
+// Debugf logs at debug level with the package logger
+func Debugf(format string, args ...interface{}) { std.logf(LevelDebug, format, args...) }
+
+// Infof logs at info level with the package logger
+func Infof(format string, args ...interface{}) { std.logf(LevelInfo, format, args...) }
+
+// Warnf logs at warn level with the package logger
+func Warnf(format string, args ...interface{}) { std.logf(LevelWarn, format, args...) }
+
+// Errorf logs at error level with the package logger
+func Errorf(format string, args ...interface{}) { std.logf(LevelError, format, args...) }
+
+// Fatalf logs at error level and exits
+func Fatalf(format string, args ...interface{}) {
+	std.logf(LevelError, format, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,75 @@
+package logging
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogger_SuppressesBelowLevel(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, LevelInfo)
+
+	logger.Debugf("debug %d", 1)
+	assert.Empty(t, buf.String(), "Debug logs should be suppressed at info level")
+
+	logger.Infof("info %d", 2)
+	logger.Errorf("error %d", 3)
+	assert.Contains(t, buf.String(), "INFO info 2")
+	assert.Contains(t, buf.String(), "ERROR error 3")
+
+	buf.Reset()
+	logger.SetLevel(LevelDebug)
+	logger.Debugf("debug %d", 4)
+	assert.Contains(t, buf.String(), "DEBUG debug 4")
+}
+
+func TestParseLevel(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected Level
+		wantErr  bool
+	}{
+		{input: "debug", expected: LevelDebug},
+		{input: "", expected: LevelInfo},
+		{input: "INFO", expected: LevelInfo},
+		{input: "warn", expected: LevelWarn},
+		{input: "error", expected: LevelError},
+		{input: "verbose", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			level, err := ParseLevel(tt.input)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, level)
+		})
+	}
+}
+
+func TestRotatingFile_RotatesAtMaxSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	f, err := NewRotatingFile(path, 10)
+	require.NoError(t, err)
+	defer f.Close()
+
+	_, err = f.Write([]byte("12345678\n"))
+	require.NoError(t, err)
+	_, err = f.Write([]byte("abc\n"))
+	require.NoError(t, err)
+
+	current, err := os.ReadFile(path)
+	require.NoError(t, err)
+	backup, err := os.ReadFile(path + ".1")
+	require.NoError(t, err)
+	assert.Equal(t, "abc\n", string(current))
+	assert.Equal(t, "12345678\n", string(backup))
+}
@@ -0,0 +1,86 @@
+package p2p
+
+import (
+	"net"
+	"sort"
+	"strings"
+)
+
+// Reachability classes for advertised addresses, most useful to remote peers first
+const (
+	addrPublic    = iota // public IPv4 or a DNS name
+	addrLAN              // private IPv4
+	addrPublicV6         // global IPv6
+	addrPrivateV6        // unique-local IPv6
+	addrLocal            // loopback, link-local or unspecified; only reachable from this host
+)
+
+// RankAddrs orders multiaddrs by how likely other peers are to reach them:
+// public before LAN, IPv4 before IPv6, loopback and link-local last, and TCP
+// before QUIC within a class. Ties keep a fixed order so the choice does not
+// depend on the order the host reported its addresses in.
+func RankAddrs(addrs []string) []string {
+	ranked := append([]string(nil), addrs...)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		ci, cj := addrClass(ranked[i]), addrClass(ranked[j])
+		if ci != cj {
+			return ci < cj
+		}
+		qi, qj := isQUIC(ranked[i]), isQUIC(ranked[j])
+		if qi != qj {
+			return !qi
+		}
+		return ranked[i] < ranked[j]
+	})
+	return ranked
+}
+
+// BestAddr returns the address to register with the coordinator: external
+// when the operator configured one, otherwise the best-ranked listen address.
+// The result carries the /p2p/<peerID> suffix.
+func BestAddr(addrs []string, external, peerID string) string {
+	if external != "" {
+		if strings.Contains(external, "/p2p/") || peerID == "" {
+			return external
+		}
+		return strings.TrimSuffix(external, "/") + "/p2p/" + peerID
+	}
+	ranked := RankAddrs(addrs)
+	if len(ranked) == 0 {
+		return ""
+	}
+	return ranked[0]
+}
+
+// addrClass returns the reachability class of a multiaddr such as /ip4/1.2.3.4/tcp/4001
+func addrClass(addr string) int {
+	parts := strings.Split(addr, "/")
+	if len(parts) < 3 {
+		return addrLocal
+	}
+	switch parts[1] {
+	case "dns", "dns4", "dns6":
+		return addrPublic
+	case "ip4", "ip6":
+	default:
+		return addrLocal
+	}
+
+	ip := net.ParseIP(parts[2])
+	switch {
+	case ip == nil, ip.IsLoopback(), ip.IsLinkLocalUnicast(), ip.IsUnspecified():
+		return addrLocal
+	case ip.To4() != nil && ip.IsPrivate():
+		return addrLAN
+	case ip.To4() != nil:
+		return addrPublic
+	case ip.IsPrivate():
+		return addrPrivateV6
+	default:
+		return addrPublicV6
+	}
+}
+
+func isQUIC(addr string) bool {
+	return strings.Contains(addr, "/quic")
+}
@@ -0,0 +1,57 @@
+package p2p
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRankAddrs_PrefersReachableAddresses(t *testing.T) {
+	addrs := []string{
+		"/ip4/127.0.0.1/tcp/4001",
+		"/ip6/::1/tcp/4001",
+		"/ip6/fe80::1/tcp/4001",
+		"/ip4/169.254.10.1/tcp/4001",
+		"/ip6/2001:db8::7/tcp/4001",
+		"/ip4/192.168.1.20/udp/4001/quic-v1",
+		"/ip4/192.168.1.20/tcp/4001",
+		"/ip4/203.0.113.7/udp/4001/quic-v1",
+		"/ip4/203.0.113.7/tcp/4001",
+		"/ip6/fd00::5/tcp/4001",
+	}
+
+	assert.Equal(t, []string{
+		"/ip4/203.0.113.7/tcp/4001",
+		"/ip4/203.0.113.7/udp/4001/quic-v1",
+		"/ip4/192.168.1.20/tcp/4001",
+		"/ip4/192.168.1.20/udp/4001/quic-v1",
+		"/ip6/2001:db8::7/tcp/4001",
+		"/ip6/fd00::5/tcp/4001",
+		"/ip4/127.0.0.1/tcp/4001",
+		"/ip4/169.254.10.1/tcp/4001",
+		"/ip6/::1/tcp/4001",
+		"/ip6/fe80::1/tcp/4001",
+	}, RankAddrs(addrs))
+
+	// The host's reporting order does not change the choice
+	reversed := make([]string, len(addrs))
+	for i, a := range addrs {
+		reversed[len(addrs)-1-i] = a
+	}
+	assert.Equal(t, RankAddrs(addrs), RankAddrs(reversed))
+}
+
+func TestBestAddr(t *testing.T) {
+	listen := []string{
+		"/ip4/127.0.0.1/tcp/4001/p2p/12D3KooWpeer",
+		"/ip4/10.0.0.4/tcp/4001/p2p/12D3KooWpeer",
+	}
+
+	assert.Equal(t, "/ip4/10.0.0.4/tcp/4001/p2p/12D3KooWpeer", BestAddr(listen, "", "12D3KooWpeer"))
+	assert.Equal(t, "/ip4/127.0.0.1/tcp/4001/p2p/12D3KooWpeer", BestAddr(listen[:1], "", "12D3KooWpeer"),
+		"Loopback is used when nothing better exists")
+	assert.Equal(t, "/dns4/node.example.com/tcp/4001/p2p/12D3KooWpeer", BestAddr(listen, "/dns4/node.example.com/tcp/4001", "12D3KooWpeer"),
+		"A configured external address wins and gains the peer ID")
+	assert.Equal(t, "/ip4/203.0.113.7/tcp/4001/p2p/other", BestAddr(listen, "/ip4/203.0.113.7/tcp/4001/p2p/other", "12D3KooWpeer"))
+	assert.Equal(t, "", BestAddr(nil, "", "12D3KooWpeer"))
+}
@@ -0,0 +1,58 @@
+package p2p
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultStoreRatePerSecond bounds inbound chunk stores unless SetStoreRate changes it
+const DefaultStoreRatePerSecond = 100
+
+// storeResponseMessage answers every store on the store-chunk protocol:
+// with the node's receipt once the chunk is stored, otherwise with why not
+type storeResponseMessage struct {
+	Error        string               `json:"error,omitempty"`
+	Busy         bool                 `json:"busy,omitempty"`           // the sender should back off and retry
+	RetryAfterMs int64                `json:"retry_after_ms,omitempty"` // how long to back off
+	Receipt      *storeReceiptMessage `json:"receipt,omitempty"`
+}
+
+// storeLimiter is a token bucket admitting stores at rate per second, in
+// bursts of up to burst
+type storeLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+}
+
+func newStoreLimiter(ratePerSecond, burst int, now func() time.Time) *storeLimiter {
+	if burst <= 0 {
+		burst = ratePerSecond
+	}
+	return &storeLimiter{
+		rate:   float64(ratePerSecond),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   now(),
+		now:    now,
+	}
+}
+
+// allow admits one store, or reports how long until the next one would be
+func (l *storeLimiter) allow() (retryAfter time.Duration, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	if l.tokens < 1 {
+		wait := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+		return max(wait, time.Millisecond), false
+	}
+	l.tokens--
+	return 0, true
+}
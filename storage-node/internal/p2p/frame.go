@@ -0,0 +1,69 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Chunk streams carry length-prefixed frames: a 4-byte big-endian payload
+// length followed by that many bytes.
+const frameHeaderSize = 4
+
+// maxFrameSize bounds a frame's payload; it comfortably holds any chunk
+const maxFrameSize = 16 << 20
+
+var (
+	// errFrameTooLarge is returned for a frame declaring more than maxFrameSize bytes
+	errFrameTooLarge = errors.New("frame too large")
+	// errIncompleteFrame is returned when the stream ends partway through a frame
+	errIncompleteFrame = errors.New("incomplete frame")
+)
+
+// parseFrame reads one frame from r and returns its payload. It returns
+// io.EOF only when r ends cleanly before a frame starts. The payload is read
+// as it arrives rather than allocated up front, so a peer declaring a large
+// frame and sending little costs only what it sent.
+func parseFrame(r io.Reader) ([]byte, error) {
+	var header [frameHeaderSize]byte
+	if n, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("%w: %d of %d header bytes", errIncompleteFrame, n, frameHeaderSize)
+		}
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[:])
+	if size > maxFrameSize {
+		return nil, fmt.Errorf("%w: %d bytes declared, limit is %d", errFrameTooLarge, size, maxFrameSize)
+	}
+
+	var payload bytes.Buffer
+	n, err := io.CopyN(&payload, r, int64(size))
+	if err == io.EOF {
+		return nil, fmt.Errorf("%w: %d of %d payload bytes", errIncompleteFrame, n, size)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return payload.Bytes(), nil
+}
+
+// writeFrame writes payload to w as one frame
+func writeFrame(w io.Writer, payload []byte) error {
+	if len(payload) > maxFrameSize {
+		return fmt.Errorf("%w: %d bytes, limit is %d", errFrameTooLarge, len(payload), maxFrameSize)
+	}
+	var header [frameHeaderSize]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(payload)))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
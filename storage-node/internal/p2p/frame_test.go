@@ -0,0 +1,101 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// frameHeader returns a frame header declaring size payload bytes
+func frameHeader(size uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, size)
+}
+
+func TestParseFrame(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   []byte
+		payload []byte
+		err     error
+	}{
+		{name: "payload", input: append(frameHeader(5), "hello"...), payload: []byte("hello")},
+		{name: "empty payload", input: frameHeader(0), payload: []byte{}},
+		{name: "trailing bytes left for the next frame", input: append(frameHeader(2), "hi there"...), payload: []byte("hi")},
+		{name: "clean end of stream", input: nil, err: io.EOF},
+		{name: "truncated header", input: []byte{0, 0}, err: errIncompleteFrame},
+		{name: "truncated payload", input: append(frameHeader(10), "short"...), err: errIncompleteFrame},
+		{name: "header only", input: frameHeader(1), err: errIncompleteFrame},
+		{name: "oversized length", input: frameHeader(maxFrameSize + 1), err: errFrameTooLarge},
+		{name: "maximum declared length", input: frameHeader(0xFFFFFFFF), err: errFrameTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, err := parseFrame(bytes.NewReader(tt.input))
+			if tt.err != nil {
+				assert.ErrorIs(t, err, tt.err)
+				assert.Nil(t, payload)
+				return
+			}
+			require.NoError(t, err)
+			assert.True(t, bytes.Equal(tt.payload, payload), "got payload %q", payload)
+		})
+	}
+}
+
+func TestParseFrame_RoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, writeFrame(&buf, []byte("chunk-1")))
+	require.NoError(t, writeFrame(&buf, bytes.Repeat([]byte{0xAB}, 256*1024)))
+
+	id, err := parseFrame(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, "chunk-1", string(id))
+	data, err := parseFrame(&buf)
+	require.NoError(t, err)
+	assert.Len(t, data, 256*1024)
+	_, err = parseFrame(&buf)
+	assert.Equal(t, io.EOF, err, "A drained stream ends cleanly")
+
+	assert.ErrorIs(t, writeFrame(io.Discard, make([]byte, maxFrameSize+1)), errFrameTooLarge)
+}
+
+func FuzzParseFrame(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{0})
+	f.Add([]byte{0, 0, 0})
+	f.Add(frameHeader(0))
+	f.Add(append(frameHeader(5), "hello"...))
+	f.Add(append(frameHeader(5), "hel"...))
+	f.Add(append(frameHeader(3), "abcdef"...))
+	f.Add(frameHeader(maxFrameSize))
+	f.Add(frameHeader(maxFrameSize + 1))
+	f.Add(frameHeader(0xFFFFFFFF))
+
+	f.Fuzz(func(t *testing.T, input []byte) {
+		payload, err := parseFrame(bytes.NewReader(input))
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, errIncompleteFrame) && !errors.Is(err, errFrameTooLarge) {
+				t.Fatalf("unexpected error type: %v", err)
+			}
+			if payload != nil {
+				t.Fatalf("payload %q returned with error %v", payload, err)
+			}
+			return
+		}
+
+		// A parsed frame re-encodes to exactly the bytes it was read from
+		var buf bytes.Buffer
+		if err := writeFrame(&buf, payload); err != nil {
+			t.Fatalf("parsed payload does not re-encode: %v", err)
+		}
+		if !bytes.HasPrefix(input, buf.Bytes()) {
+			t.Fatalf("frame re-encodes to %x, not a prefix of the input %x", buf.Bytes(), input)
+		}
+	})
+}
@@ -2,8 +2,14 @@ package p2p
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"sync"
+	"time"
 
+	"github.com/federated-storage/storage-node/internal/logging"
+	"github.com/google/uuid"
 	"github.com/libp2p/go-libp2p"
 	dht "github.com/libp2p/go-libp2p-kad-dht"
 	"github.com/libp2p/go-libp2p/core/host"
@@ -12,34 +18,69 @@ import (
 	"github.com/libp2p/go-libp2p/core/protocol"
 )
 
+// Protocol names served by the storage node, one stream handler per supported version
+const (
+	storeChunkProtocol     = "store-chunk"
+	retrieveChunkProtocol  = "retrieve-chunk"
+	proofChallengeProtocol = "proof-challenge"
+	capacityProofProtocol  = "capacity-proof"
+	fileProofProtocol      = "file-proof"
+)
+
 // Node represents a libp2p storage node
 type Node struct {
-	host   host.Host
-	dht    *dht.IpfsDHT
-	config NodeConfig
+	host           host.Host
+	dht            *dht.IpfsDHT
+	config         NodeConfig
+	authMu         sync.RWMutex // guards authorizedPeer, which changes when the coordinator rotates its identity
+	authorizedPeer peer.ID
+
+	// merkleProofs answers challenges that ask for a Merkle sub-block; nil if unsupported
+	merkleProofs func(chunkID string, leafIndex int) ([]byte, [][]byte, error)
+
+	// supportedVersions overrides SupportedVersions when set
+	supportedVersions []string
+
+	// streamTimeout is the deadline set on each inbound stream; 0 means none
+	streamTimeout time.Duration
+
+	// storeLimit turns away store streams beyond its rate; nil admits every one
+	storeLimit *storeLimiter
 }
 
+// DefaultStreamTimeout bounds inbound streams unless SetStreamTimeout changes it
+const DefaultStreamTimeout = 2 * time.Minute
+
 // NodeConfig holds P2P node configuration
 type NodeConfig struct {
 	ListenAddresses []string
+	EnableTCP       bool
+	EnableQUIC      bool
 	BootstrapPeers  []string
+	Security        string // required security transport; "" for libp2p's defaults
+	MaxPeers        int    // 0 for libp2p's default
+	MaxStreams      int    // 0 for libp2p's default
 }
 
-// NewNode creates a new libp2p node
-func NewNode(listenAddresses []string) (*Node, error) {
-	if len(listenAddresses) == 0 {
-		listenAddresses = []string{
-			"/ip4/0.0.0.0/tcp/0",
-			"/ip4/0.0.0.0/udp/0/quic-v1",
-		}
+// NewNode creates a new libp2p node listening over the enabled transports.
+// Listen addresses using a disabled transport are dropped; with none given,
+// the node listens on all interfaces for each enabled transport.
+func NewNode(listenAddresses []string, enableTCP, enableQUIC bool) (*Node, error) {
+	listenAddresses, err := listenAddrs(listenAddresses, enableTCP, enableQUIC)
+	if err != nil {
+		return nil, err
 	}
 
 	config := NodeConfig{
 		ListenAddresses: listenAddresses,
+		EnableTCP:       enableTCP,
+		EnableQUIC:      enableQUIC,
 	}
 
 	return &Node{
-		config: config,
+		config:        config,
+		streamTimeout: DefaultStreamTimeout,
+		storeLimit:    newStoreLimiter(DefaultStoreRatePerSecond, 0, time.Now),
 	}, nil
 }
 
@@ -49,6 +90,17 @@ func (n *Node) Start() error {
 	opts := []libp2p.Option{
 		libp2p.ListenAddrStrings(n.config.ListenAddresses...),
 	}
+	opts = append(opts, transportOptions(n.config.EnableTCP, n.config.EnableQUIC)...)
+	security, err := securityOptions(n.config.Security)
+	if err != nil {
+		return err
+	}
+	opts = append(opts, security...)
+	limits, err := limitOptions(n.config.MaxPeers, n.config.MaxStreams)
+	if err != nil {
+		return err
+	}
+	opts = append(opts, limits...)
 
 	// Create host
 	h, err := libp2p.New(opts...)
@@ -65,6 +117,8 @@ func (n *Node) Start() error {
 	}
 	n.dht = kadDHT
 
+	n.setHandshakeHandler()
+
 	// Bootstrap DHT
 	if err := kadDHT.Bootstrap(ctx); err != nil {
 		return fmt.Errorf("failed to bootstrap DHT: %w", err)
@@ -136,34 +190,396 @@ func (n *Node) Connect(ctx context.Context, peerAddr string) error {
 	return nil
 }
 
+// SetAuthorizedPeer sets the coordinator peer allowed to open chunk and proof streams.
+// Until it is set, those streams are rejected. It may be called while the
+// node runs, replacing the previous peer.
+func (n *Node) SetAuthorizedPeer(peerID string) error {
+	id, err := peer.Decode(peerID)
+	if err != nil {
+		return fmt.Errorf("invalid coordinator peer ID: %w", err)
+	}
+	n.authMu.Lock()
+	n.authorizedPeer = id
+	n.authMu.Unlock()
+	return nil
+}
+
+// rotationContext prefixes what a coordinator rotation's signature covers; the
+// coordinator uses the same value
+const rotationContext = "federated-storage coordinator rotation\n"
+
+// errRotationNotSigned is returned by FollowRotation for a rotation the
+// authorized coordinator didn't sign
+var errRotationNotSigned = errors.New("rotation not signed by the authorized coordinator")
+
+// FollowRotation switches the authorized coordinator to peerID, but only if
+// signature is the currently authorized coordinator's signature of the
+// rotation to it; whoever relays the rotation can't choose the new peer
+func (n *Node) FollowRotation(peerID string, signature []byte) error {
+	next, err := peer.Decode(peerID)
+	if err != nil {
+		return fmt.Errorf("invalid coordinator peer ID: %w", err)
+	}
+
+	n.authMu.Lock()
+	defer n.authMu.Unlock()
+	if n.authorizedPeer == "" {
+		return errRotationNotSigned
+	}
+	key, err := n.authorizedPeer.ExtractPublicKey()
+	if err != nil {
+		return fmt.Errorf("failed to read coordinator key: %w", err)
+	}
+	payload := []byte(rotationContext + n.authorizedPeer.String() + "\n" + next.String())
+	if valid, err := key.Verify(payload, signature); err != nil || !valid {
+		return errRotationNotSigned
+	}
+	n.authorizedPeer = next
+	return nil
+}
+
+func (n *Node) isAuthorized(remote peer.ID) bool {
+	n.authMu.RLock()
+	defer n.authMu.RUnlock()
+	return n.authorizedPeer != "" && remote == n.authorizedPeer
+}
+
+// SetSecurity requires security, SecurityNoise or SecurityTLS, on every TCP
+// connection; "" offers libp2p's defaults. Must be called before Start.
+func (n *Node) SetSecurity(security string) error {
+	if _, err := securityOptions(security); err != nil {
+		return err
+	}
+	n.config.Security = security
+	return nil
+}
+
+// SetConnectionLimits caps the node's connections at maxPeers and its open
+// streams at maxStreams; 0 keeps libp2p's default for either. Must be called
+// before Start.
+func (n *Node) SetConnectionLimits(maxPeers, maxStreams int) {
+	n.config.MaxPeers = maxPeers
+	n.config.MaxStreams = maxStreams
+}
+
+// SetStreamTimeout sets how long an inbound stream may take before reads and
+// writes on it fail, so a slow or stuck peer cannot hold its handler
+// goroutine forever; d <= 0 removes the deadline. Must be called before Start.
+func (n *Node) SetStreamTimeout(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	n.streamTimeout = d
+}
+
+// SetStoreRate caps inbound chunk stores at ratePerSecond, in bursts of up
+// to burst (0 for a second's worth); ratePerSecond <= 0 lifts the cap.
+// Stores beyond it are answered, before any of their data is read, with a
+// busy response telling the sender how long to back off.
+func (n *Node) SetStoreRate(ratePerSecond, burst int) {
+	n.storeLimit = nil
+	if ratePerSecond > 0 {
+		n.storeLimit = newStoreLimiter(ratePerSecond, burst, time.Now)
+	}
+}
+
+// authorized wraps a stream handler so streams from any peer other than the
+// authorized coordinator are reset without being read. Each stream runs on
+// its own goroutine, so handlers must be safe to call concurrently.
+func (n *Node) authorized(handler network.StreamHandler) network.StreamHandler {
+	return func(s network.Stream) {
+		remote := s.Conn().RemotePeer()
+		if !n.isAuthorized(remote) {
+			logging.Warnf("Rejected %s stream from unauthorized peer %s", s.Protocol(), remote)
+			s.Reset()
+			return
+		}
+		n.withDeadline(handler)(s)
+	}
+}
+
+// withDeadline wraps a stream handler so each stream gets the node's stream timeout
+func (n *Node) withDeadline(handler network.StreamHandler) network.StreamHandler {
+	return func(s network.Stream) {
+		if n.streamTimeout > 0 {
+			s.SetDeadline(time.Now().Add(n.streamTimeout))
+		}
+		handler(s)
+	}
+}
+
 // SetStreamHandler sets a handler for a protocol
 func (n *Node) SetStreamHandler(protocolID string, handler network.StreamHandler) {
 	n.host.SetStreamHandler(protocol.ID(protocolID), handler)
 }
 
-// SetChunkStoreHandler sets up the handler for storing chunks
-func (n *Node) SetChunkStoreHandler(handler func(chunkID string, data []byte) error) {
-	n.host.SetStreamHandler("/federated-storage/1.0.0/store-chunk", func(s network.Stream) {
+// SetChunkStoreHandler sets up the handler for storing chunks. The
+// coordinator may store any chunk; other peers, clients uploading directly,
+// only the one chunk a store authorization from the coordinator names, with
+// exactly the content it names. Each stored chunk is answered with a receipt
+// signed by the node, which the coordinator requires before recording it.
+func (n *Node) SetChunkStoreHandler(handler func(req *StoreRequest, data []byte) error) {
+	n.serveAnyPeer(storeChunkProtocol, func(s network.Stream) {
 		defer s.Close()
-		// In a full implementation, read chunk ID and data from stream
-		// For MVP, simplified
+		remote := s.Conn().RemotePeer()
+
+		if n.storeLimit != nil {
+			if retryAfter, ok := n.storeLimit.allow(); !ok {
+				logging.Warnf("Turned away chunk store from %s: over the store rate", remote)
+				json.NewEncoder(s).Encode(storeResponseMessage{
+					Error:        "node busy: too many chunk stores",
+					Busy:         true,
+					RetryAfterMs: retryAfter.Milliseconds(),
+				})
+				return
+			}
+		}
+
+		req, data, err := n.receiveStore(s, remote)
+		if err != nil {
+			if errors.Is(err, errStoreNotAuthorized) {
+				logging.Warnf("Refused chunk store from %s: %v", remote, err)
+			}
+			json.NewEncoder(s).Encode(storeResponseMessage{Error: err.Error()})
+			return
+		}
+		if err := handler(req, data); err != nil {
+			json.NewEncoder(s).Encode(storeResponseMessage{Error: err.Error()})
+			return
+		}
+		receipt, err := n.signStoreReceipt(req, data)
+		if err != nil {
+			json.NewEncoder(s).Encode(storeResponseMessage{Error: err.Error()})
+			return
+		}
+		json.NewEncoder(s).Encode(storeResponseMessage{Receipt: receipt})
 	})
 }
 
-// SetChunkRetrieveHandler sets up the handler for retrieving chunks
+// A retrieve stream carries one frame, a retrieveRequestMessage. The node
+// answers with a retrieveResponseMessage frame and, unless it carries an
+// error, a second frame holding the chunk.
+
+// retrieveRequestMessage is the frame read on the retrieve-chunk protocol
+type retrieveRequestMessage struct {
+	ChunkID string `json:"chunk_id"`
+}
+
+// retrieveResponseMessage is the first frame written on the retrieve-chunk protocol
+type retrieveResponseMessage struct {
+	Error string `json:"error,omitempty"`
+}
+
+// SetChunkRetrieveHandler sets up the handler for retrieving chunks, which
+// the coordinator uses to copy, repair and read chunks it holds no copy of
 func (n *Node) SetChunkRetrieveHandler(handler func(chunkID string) ([]byte, error)) {
-	n.host.SetStreamHandler("/federated-storage/1.0.0/retrieve-chunk", func(s network.Stream) {
+	n.serve(retrieveChunkProtocol, func(s network.Stream) {
 		defer s.Close()
-		// In a full implementation, read chunk ID and return data
-		// For MVP, simplified
+		respond := func(resp retrieveResponseMessage) error {
+			header, err := json.Marshal(resp)
+			if err != nil {
+				return err
+			}
+			return writeFrame(s, header)
+		}
+
+		header, err := parseFrame(s)
+		if err != nil {
+			return
+		}
+		var req retrieveRequestMessage
+		if err := json.Unmarshal(header, &req); err != nil {
+			respond(retrieveResponseMessage{Error: fmt.Sprintf("malformed retrieve request: %v", err)})
+			return
+		}
+		if _, err := uuid.Parse(req.ChunkID); err != nil {
+			respond(retrieveResponseMessage{Error: fmt.Sprintf("invalid chunk ID %q", req.ChunkID)})
+			return
+		}
+		data, err := handler(req.ChunkID)
+		if err != nil {
+			respond(retrieveResponseMessage{Error: err.Error()})
+			return
+		}
+		if err := respond(retrieveResponseMessage{}); err != nil {
+			return
+		}
+		if err := writeFrame(s, data); err != nil {
+			logging.Warnf("Failed to send chunk %s: %v", req.ChunkID, err)
+		}
 	})
 }
 
+// proofChallengeMessage is the request read on the proof-challenge protocol
+type proofChallengeMessage struct {
+	ChunkID    string `json:"chunk_id"`
+	Seed       []byte `json:"seed"`
+	Difficulty int    `json:"difficulty"`
+	LeafIndex  *int   `json:"leaf_index,omitempty"` // Merkle sub-block to return, if any
+}
+
+// merkleProofMessage is a chunk sub-block and its path to the chunk's Merkle root
+type merkleProofMessage struct {
+	LeafIndex int      `json:"leaf_index"`
+	Block     []byte   `json:"block"`
+	Path      [][]byte `json:"path"`
+}
+
+// proofResponseMessage is the response written on the proof-challenge protocol
+type proofResponseMessage struct {
+	ProofHash  string              `json:"proof_hash"`
+	DurationMs int64               `json:"duration_ms"`
+	Merkle     *merkleProofMessage `json:"merkle,omitempty"`
+	Error      string              `json:"error,omitempty"`
+}
+
+// SetMerkleProofHandler sets how sub-blocks requested by proof challenges are
+// produced. Must be called before SetProofChallengeHandler.
+func (n *Node) SetMerkleProofHandler(handler func(chunkID string, leafIndex int) (block []byte, path [][]byte, err error)) {
+	n.merkleProofs = handler
+}
+
 // SetProofChallengeHandler sets up the handler for proof challenges
 func (n *Node) SetProofChallengeHandler(handler func(chunkID string, seed []byte, difficulty int) (string, int64, error)) {
-	n.host.SetStreamHandler("/federated-storage/1.0.0/proof-challenge", func(s network.Stream) {
+	n.serve(proofChallengeProtocol, func(s network.Stream) {
+		defer s.Close()
+
+		var req proofChallengeMessage
+		if err := json.NewDecoder(s).Decode(&req); err != nil {
+			return
+		}
+
+		proofHash, durationMs, err := handler(req.ChunkID, req.Seed, req.Difficulty)
+		resp := proofResponseMessage{ProofHash: proofHash, DurationMs: durationMs}
+		if err == nil && req.LeafIndex != nil && n.merkleProofs != nil {
+			var block []byte
+			var path [][]byte
+			block, path, err = n.merkleProofs(req.ChunkID, *req.LeafIndex)
+			resp.Merkle = &merkleProofMessage{LeafIndex: *req.LeafIndex, Block: block, Path: path}
+		}
+		if err != nil {
+			resp.Error = err.Error()
+		}
+		json.NewEncoder(s).Encode(resp)
+	})
+}
+
+// fileChallengeMessage is the request read on the file-proof protocol
+type fileChallengeMessage struct {
+	Seed     []byte   `json:"seed"`
+	ChunkIDs []string `json:"chunk_ids"`
+}
+
+// fileProofMessage is the response written on the file-proof protocol
+type fileProofMessage struct {
+	ProofHash string `json:"proof_hash"`
+	Error     string `json:"error,omitempty"`
+}
+
+// SetFileProofHandler sets up the handler for file challenges, which ask for
+// one proof over several chunks. The coordinator times the answer itself.
+func (n *Node) SetFileProofHandler(handler func(seed []byte, chunkIDs []string) (string, error)) {
+	n.serve(fileProofProtocol, func(s network.Stream) {
+		defer s.Close()
+
+		var req fileChallengeMessage
+		if err := json.NewDecoder(s).Decode(&req); err != nil {
+			return
+		}
+
+		proofHash, err := handler(req.Seed, req.ChunkIDs)
+		resp := fileProofMessage{ProofHash: proofHash}
+		if err != nil {
+			resp.Error = err.Error()
+		}
+		json.NewEncoder(s).Encode(resp)
+	})
+}
+
+// A capacity-proof stream carries a capacityChallengeMessage frame, then one
+// frame per block. Once the blocks are on disk the node acknowledges with an
+// empty capacityProofMessage, reads a capacitySampleMessage and answers it
+// with the sampled blocks' digests. Errors end the stream with Error set.
+
+// capacityChallengeMessage is the first frame of a capacity-proof stream
+type capacityChallengeMessage struct {
+	BlockSize int     `json:"block_size"`
+	Offsets   []int64 `json:"offsets"`
+}
+
+// capacitySampleMessage names the blocks, by position in the challenge, the
+// coordinator wants hashed
+type capacitySampleMessage struct {
+	Nonce  []byte `json:"nonce"`
+	Blocks []int  `json:"blocks"`
+}
+
+// capacityProofMessage is written on the capacity-proof protocol
+type capacityProofMessage struct {
+	Digests []string `json:"digests,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// CapacityRegion holds a capacity challenge's blocks while it is answered
+type CapacityRegion interface {
+	WriteBlock(i int, data []byte) error
+	Sync() error
+	Answer(nonce []byte, blocks []int) ([]string, error)
+	Close() error
+}
+
+// SetCapacityProofHandler sets up the handler for capacity challenges, which
+// have the node store blocks across its claimed capacity and hash a sample of
+// them. begin takes a challenge, or refuses it before any block is read.
+func (n *Node) SetCapacityProofHandler(begin func(blockSize int, offsets []int64) (CapacityRegion, error)) {
+	n.serve(capacityProofProtocol, func(s network.Stream) {
 		defer s.Close()
-		// In a full implementation, read challenge and return proof
-		// For MVP, simplified
+		fail := func(err error) { json.NewEncoder(s).Encode(capacityProofMessage{Error: err.Error()}) }
+
+		header, err := parseFrame(s)
+		if err != nil {
+			return
+		}
+		var req capacityChallengeMessage
+		if err := json.Unmarshal(header, &req); err != nil {
+			fail(fmt.Errorf("malformed capacity challenge: %w", err))
+			return
+		}
+		region, err := begin(req.BlockSize, req.Offsets)
+		if err != nil {
+			fail(err)
+			return
+		}
+		defer region.Close()
+
+		for i := range req.Offsets {
+			data, err := parseFrame(s)
+			if err != nil {
+				fail(fmt.Errorf("failed to read block %d: %w", i, err))
+				return
+			}
+			if err := region.WriteBlock(i, data); err != nil {
+				fail(err)
+				return
+			}
+		}
+		if err := region.Sync(); err != nil {
+			fail(err)
+			return
+		}
+		if err := json.NewEncoder(s).Encode(capacityProofMessage{}); err != nil {
+			return
+		}
+
+		var sample capacitySampleMessage
+		if err := json.NewDecoder(s).Decode(&sample); err != nil {
+			return
+		}
+		digests, err := region.Answer(sample.Nonce, sample.Blocks)
+		if err != nil {
+			fail(err)
+			return
+		}
+		json.NewEncoder(s).Encode(capacityProofMessage{Digests: digests})
 	})
 }
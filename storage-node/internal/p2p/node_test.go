@@ -0,0 +1,483 @@
+package p2p
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/federated-storage/storage-node/internal/merkle"
+	"github.com/google/uuid"
+	"github.com/libp2p/go-libp2p/core/host"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func sendProofChallenge(t *testing.T, from host.Host, to host.Host) (proofResponseMessage, error) {
+	t.Helper()
+	return sendProofChallengeAt(t, from, to, "1.0.0")
+}
+
+func sendProofChallengeAt(t *testing.T, from host.Host, to host.Host, version string) (proofResponseMessage, error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var resp proofResponseMessage
+	s, err := from.NewStream(ctx, to.ID(), protocolID(version, proofChallengeProtocol))
+	if err != nil {
+		return resp, err
+	}
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(5 * time.Second))
+
+	req := proofChallengeMessage{ChunkID: "chunk-1", Seed: []byte("seed"), Difficulty: 1}
+	if err := json.NewEncoder(s).Encode(req); err != nil {
+		return resp, err
+	}
+	s.CloseWrite()
+
+	err = json.NewDecoder(s).Decode(&resp)
+	return resp, err
+}
+
+func TestNode_RejectsStreamsFromUnauthorizedPeers(t *testing.T) {
+	mn := mocknet.New()
+	defer mn.Close()
+
+	nodeHost, err := mn.GenPeer()
+	require.NoError(t, err)
+	coordinator, err := mn.GenPeer()
+	require.NoError(t, err)
+	stranger, err := mn.GenPeer()
+	require.NoError(t, err)
+	require.NoError(t, mn.LinkAll())
+	require.NoError(t, mn.ConnectAllButSelf())
+
+	n := &Node{host: nodeHost}
+	require.NoError(t, n.SetAuthorizedPeer(coordinator.ID().String()))
+
+	var calls int32
+	n.SetProofChallengeHandler(func(chunkID string, seed []byte, difficulty int) (string, int64, error) {
+		atomic.AddInt32(&calls, 1)
+		return "proof", 1, nil
+	})
+
+	_, err = sendProofChallenge(t, stranger, nodeHost)
+	assert.Error(t, err, "Stream from an unknown peer should be closed without a response")
+	assert.Equal(t, int32(0), atomic.LoadInt32(&calls), "Handler should not run for an unknown peer")
+
+	resp, err := sendProofChallenge(t, coordinator, nodeHost)
+	assert.NoError(t, err)
+	assert.Equal(t, "proof", resp.ProofHash)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestNode_FollowsRotatedCoordinator(t *testing.T) {
+	mn := mocknet.New()
+	defer mn.Close()
+
+	nodeHost, err := mn.GenPeer()
+	require.NoError(t, err)
+	previous, err := mn.GenPeer()
+	require.NoError(t, err)
+	rotated, err := mn.GenPeer()
+	require.NoError(t, err)
+	require.NoError(t, mn.LinkAll())
+	require.NoError(t, mn.ConnectAllButSelf())
+
+	n := &Node{host: nodeHost}
+	require.NoError(t, n.SetAuthorizedPeer(previous.ID().String()))
+	n.SetProofChallengeHandler(func(chunkID string, seed []byte, difficulty int) (string, int64, error) {
+		return "proof", 1, nil
+	})
+
+	sign := func(signer host.Host) []byte {
+		signature, err := signer.Peerstore().PrivKey(signer.ID()).Sign(
+			[]byte(rotationContext + previous.ID().String() + "\n" + rotated.ID().String()))
+		require.NoError(t, err)
+		return signature
+	}
+	assert.ErrorIs(t, n.FollowRotation(rotated.ID().String(), sign(rotated)), errRotationNotSigned,
+		"Only the pinned coordinator can hand its place to another peer")
+	_, err = sendProofChallenge(t, previous, nodeHost)
+	assert.NoError(t, err, "A refused rotation leaves the pinned coordinator in place")
+
+	require.NoError(t, n.FollowRotation(rotated.ID().String(), sign(previous)))
+	_, err = sendProofChallenge(t, previous, nodeHost)
+	assert.Error(t, err, "The coordinator's previous peer ID should no longer be accepted")
+	resp, err := sendProofChallenge(t, rotated, nodeHost)
+	assert.NoError(t, err)
+	assert.Equal(t, "proof", resp.ProofHash)
+}
+
+func TestNode_RejectsAllStreamsWithoutAuthorizedPeer(t *testing.T) {
+	mn := mocknet.New()
+	defer mn.Close()
+
+	nodeHost, err := mn.GenPeer()
+	require.NoError(t, err)
+	coordinator, err := mn.GenPeer()
+	require.NoError(t, err)
+	require.NoError(t, mn.LinkAll())
+	require.NoError(t, mn.ConnectAllButSelf())
+
+	n := &Node{host: nodeHost}
+
+	var calls int32
+	n.SetProofChallengeHandler(func(chunkID string, seed []byte, difficulty int) (string, int64, error) {
+		atomic.AddInt32(&calls, 1)
+		return "proof", 1, nil
+	})
+
+	_, err = sendProofChallenge(t, coordinator, nodeHost)
+	assert.Error(t, err)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&calls))
+}
+
+func TestSelectVersion(t *testing.T) {
+	tests := []struct {
+		name     string
+		local    []string
+		remote   []string
+		expected string
+		wantErr  bool
+	}{
+		{name: "newer local, older remote", local: []string{"1.0.0", "1.1.0"}, remote: []string{"1.0.0"}, expected: "1.0.0"},
+		{name: "both upgraded", local: []string{"1.0.0", "1.1.0"}, remote: []string{"1.1.0", "1.0.0"}, expected: "1.1.0"},
+		{name: "numeric ordering", local: []string{"1.2.0", "1.10.0"}, remote: []string{"1.10.0", "1.2.0"}, expected: "1.10.0"},
+		{name: "malformed ignored", local: []string{"1.0.0", "2"}, remote: []string{"2", "1.0.0"}, expected: "1.0.0"},
+		{name: "disjoint", local: []string{"2.0.0"}, remote: []string{"1.0.0"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			version, err := SelectVersion(tt.local, tt.remote)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrNoCommonVersion)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, version)
+		})
+	}
+}
+
+func handshake(t *testing.T, from host.Host, to host.Host, versions []string) handshakeMessage {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	s, err := from.NewStream(ctx, to.ID(), handshakeProtocol)
+	require.NoError(t, err)
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(5 * time.Second))
+
+	require.NoError(t, json.NewEncoder(s).Encode(handshakeMessage{Versions: versions}))
+	s.CloseWrite()
+
+	var resp handshakeMessage
+	require.NoError(t, json.NewDecoder(s).Decode(&resp))
+	return resp
+}
+
+func TestNode_NegotiatesVersionWithOlderPeer(t *testing.T) {
+	mn := mocknet.New()
+	defer mn.Close()
+
+	nodeHost, err := mn.GenPeer()
+	require.NoError(t, err)
+	coordinator, err := mn.GenPeer()
+	require.NoError(t, err)
+	require.NoError(t, mn.LinkAll())
+	require.NoError(t, mn.ConnectAllButSelf())
+
+	n := &Node{host: nodeHost, supportedVersions: []string{"1.0.0", "1.1.0"}}
+	require.NoError(t, n.SetAuthorizedPeer(coordinator.ID().String()))
+	n.setHandshakeHandler()
+
+	n.SetProofChallengeHandler(func(chunkID string, seed []byte, difficulty int) (string, int64, error) {
+		return "proof", 1, nil
+	})
+
+	resp := handshake(t, coordinator, nodeHost, []string{"1.0.0"})
+	assert.Empty(t, resp.Error)
+	assert.Equal(t, "1.0.0", resp.Version, "A 1.0-only peer should be offered 1.0")
+
+	resp = handshake(t, coordinator, nodeHost, []string{"1.1.0", "1.0.0"})
+	assert.Equal(t, "1.1.0", resp.Version, "Peers that both speak 1.1 should use it")
+
+	resp = handshake(t, coordinator, nodeHost, []string{"2.0.0"})
+	assert.Empty(t, resp.Version)
+	assert.Contains(t, resp.Error, ErrNoCommonVersion.Error())
+
+	// Handlers answer at every supported version
+	for _, version := range []string{"1.0.0", "1.1.0"} {
+		resp, err := sendProofChallengeAt(t, coordinator, nodeHost, version)
+		assert.NoError(t, err, version)
+		assert.Equal(t, "proof", resp.ProofHash)
+	}
+}
+
+func TestNode_StreamDeadlineReleasesStuckPeer(t *testing.T) {
+	mn := mocknet.New()
+	defer mn.Close()
+
+	nodeHost, err := mn.GenPeer()
+	require.NoError(t, err)
+	coordinator, err := mn.GenPeer()
+	require.NoError(t, err)
+	require.NoError(t, mn.LinkAll())
+	require.NoError(t, mn.ConnectAllButSelf())
+
+	n := &Node{host: nodeHost}
+	n.SetStreamTimeout(200 * time.Millisecond)
+	require.NoError(t, n.SetAuthorizedPeer(coordinator.ID().String()))
+	n.SetProofChallengeHandler(func(chunkID string, seed []byte, difficulty int) (string, int64, error) {
+		return "proof", 1, nil
+	})
+
+	// Open a stream and never send the challenge
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s, err := coordinator.NewStream(ctx, nodeHost.ID(), protocolID("1.0.0", proofChallengeProtocol))
+	require.NoError(t, err)
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// The node gives up on the stream, which the stuck peer sees as it closing
+	start := time.Now()
+	io.ReadAll(s)
+	assert.Less(t, time.Since(start), 2*time.Second, "Handler should not wait past its deadline")
+
+	// Well-behaved peers are still served
+	resp, err := sendProofChallenge(t, coordinator, nodeHost)
+	assert.NoError(t, err)
+	assert.Equal(t, "proof", resp.ProofHash)
+}
+
+// storeChunk sends data on the store-chunk protocol and returns the node's response
+func storeChunk(t *testing.T, from host.Host, to host.Host, data []byte) storeResponseMessage {
+	t.Helper()
+	return storeChunkAs(t, from, to, storeRequestMessage{ChunkID: uuid.NewString()}, data)
+}
+
+// storeChunkAs sends req and data on the store-chunk protocol and returns the node's response
+func storeChunkAs(t *testing.T, from host.Host, to host.Host, req storeRequestMessage, data []byte) storeResponseMessage {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	s, err := from.NewStream(ctx, to.ID(), protocolID("1.0.0", storeChunkProtocol))
+	require.NoError(t, err)
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(5 * time.Second))
+	header, err := json.Marshal(req)
+	require.NoError(t, err)
+	writeFrame(s, header)
+	writeFrame(s, data)
+	s.CloseWrite()
+
+	var resp storeResponseMessage
+	if err := json.NewDecoder(s).Decode(&resp); err != nil {
+		require.ErrorIs(t, err, io.EOF)
+	}
+	return resp
+}
+
+func TestNode_StoresBeyondRateGetBusyResponse(t *testing.T) {
+	mn := mocknet.New()
+	defer mn.Close()
+
+	nodeHost, err := mn.GenPeer()
+	require.NoError(t, err)
+	coordinator, err := mn.GenPeer()
+	require.NoError(t, err)
+	require.NoError(t, mn.LinkAll())
+	require.NoError(t, mn.ConnectAllButSelf())
+
+	n := &Node{host: nodeHost}
+	n.SetStoreRate(1, 2)
+	require.NoError(t, n.SetAuthorizedPeer(coordinator.ID().String()))
+	n.SetChunkStoreHandler(func(req *StoreRequest, data []byte) error { return nil })
+
+	// The burst is accepted
+	for i := 0; i < 2; i++ {
+		assert.False(t, storeChunk(t, coordinator, nodeHost, []byte("chunk")).Busy, "store %d", i)
+	}
+
+	resp := storeChunk(t, coordinator, nodeHost, []byte("chunk"))
+	assert.True(t, resp.Busy)
+	assert.Positive(t, resp.RetryAfterMs)
+	assert.LessOrEqual(t, resp.RetryAfterMs, int64(1000))
+	assert.NotEmpty(t, resp.Error)
+}
+
+// signedStoreAuthorization is a store authorization token signed by signer's key
+func signedStoreAuthorization(t *testing.T, signer host.Host, auth storeAuthorization) string {
+	t.Helper()
+	payload, err := json.Marshal(auth)
+	require.NoError(t, err)
+	signature, err := signer.Peerstore().PrivKey(signer.ID()).Sign(append([]byte(storeAuthorizationContext), payload...))
+	require.NoError(t, err)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestNode_StoresOnlyAuthorizedChunksFromClients(t *testing.T) {
+	mn := mocknet.New()
+	defer mn.Close()
+
+	nodeHost, err := mn.GenPeer()
+	require.NoError(t, err)
+	coordinator, err := mn.GenPeer()
+	require.NoError(t, err)
+	client, err := mn.GenPeer()
+	require.NoError(t, err)
+	require.NoError(t, mn.LinkAll())
+	require.NoError(t, mn.ConnectAllButSelf())
+
+	n := &Node{host: nodeHost}
+	require.NoError(t, n.SetAuthorizedPeer(coordinator.ID().String()))
+	var stored []StoreRequest
+	n.SetChunkStoreHandler(func(req *StoreRequest, data []byte) error {
+		stored = append(stored, *req)
+		return nil
+	})
+
+	data := []byte("an encrypted chunk")
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	auth := storeAuthorization{
+		FileID: uuid.NewString(), ChunkID: uuid.NewString(), ChunkIndex: 3, Hash: hash, SizeBytes: int64(len(data)),
+		PeerIDs: []string{nodeHost.ID().String()}, ExpiresAt: time.Now().Add(time.Minute),
+	}
+	token := signedStoreAuthorization(t, coordinator, auth)
+
+	resp := storeChunkAs(t, client, nodeHost, storeRequestMessage{ChunkID: auth.ChunkID}, data)
+	assert.NotEmpty(t, resp.Error, "Clients need an authorization")
+	resp = storeChunkAs(t, client, nodeHost, storeRequestMessage{ChunkID: auth.ChunkID, Authorization: signedStoreAuthorization(t, client, auth)}, data)
+	assert.NotEmpty(t, resp.Error, "Only the coordinator can authorize a store")
+	resp = storeChunkAs(t, client, nodeHost, storeRequestMessage{ChunkID: uuid.NewString(), Authorization: token}, data)
+	assert.NotEmpty(t, resp.Error, "An authorization covers only its own chunk")
+	resp = storeChunkAs(t, client, nodeHost, storeRequestMessage{ChunkID: auth.ChunkID, Authorization: token}, []byte("other content"))
+	assert.NotEmpty(t, resp.Error, "An authorization covers only its own content")
+	elsewhere := auth
+	elsewhere.PeerIDs = []string{coordinator.ID().String()}
+	resp = storeChunkAs(t, client, nodeHost, storeRequestMessage{ChunkID: auth.ChunkID, Authorization: signedStoreAuthorization(t, coordinator, elsewhere)}, data)
+	assert.NotEmpty(t, resp.Error, "An authorization covers only the nodes it names")
+	assert.Empty(t, stored)
+
+	resp = storeChunkAs(t, client, nodeHost, storeRequestMessage{ChunkID: auth.ChunkID, Authorization: token}, data)
+	require.Empty(t, resp.Error)
+	assert.Equal(t, []StoreRequest{{ChunkID: auth.ChunkID, FileID: auth.FileID, ChunkIndex: 3, Hash: hash}}, stored)
+
+	// The receipt carries the node's own Merkle root, signed with its peer key
+	require.NotNil(t, resp.Receipt)
+	assert.Equal(t, hex.EncodeToString(merkle.Root(data)), resp.Receipt.MerkleRoot)
+	assert.Equal(t, nodeHost.ID().String(), resp.Receipt.PeerID)
+	valid, err := nodeHost.Peerstore().PubKey(nodeHost.ID()).Verify(
+		storeReceiptPayload(auth.ChunkID, hash, int64(len(data)), resp.Receipt.MerkleRoot), resp.Receipt.Signature)
+	require.NoError(t, err)
+	assert.True(t, valid)
+}
+
+// retrieveChunk asks to on the retrieve-chunk protocol for chunkID and
+// returns its response and the chunk, if one followed
+func retrieveChunk(t *testing.T, from host.Host, to host.Host, chunkID string) (retrieveResponseMessage, []byte, error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var resp retrieveResponseMessage
+	s, err := from.NewStream(ctx, to.ID(), protocolID("1.0.0", retrieveChunkProtocol))
+	if err != nil {
+		return resp, nil, err
+	}
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(5 * time.Second))
+	header, err := json.Marshal(retrieveRequestMessage{ChunkID: chunkID})
+	require.NoError(t, err)
+	writeFrame(s, header)
+	s.CloseWrite()
+
+	frame, err := parseFrame(s)
+	if err != nil {
+		return resp, nil, err
+	}
+	require.NoError(t, json.Unmarshal(frame, &resp))
+	if resp.Error != "" {
+		return resp, nil, nil
+	}
+	data, err := parseFrame(s)
+	return resp, data, err
+}
+
+func TestNode_ServesStoredChunksToCoordinator(t *testing.T) {
+	mn := mocknet.New()
+	defer mn.Close()
+
+	nodeHost, err := mn.GenPeer()
+	require.NoError(t, err)
+	coordinator, err := mn.GenPeer()
+	require.NoError(t, err)
+	stranger, err := mn.GenPeer()
+	require.NoError(t, err)
+	require.NoError(t, mn.LinkAll())
+	require.NoError(t, mn.ConnectAllButSelf())
+
+	n := &Node{host: nodeHost}
+	require.NoError(t, n.SetAuthorizedPeer(coordinator.ID().String()))
+	held := map[string][]byte{uuid.NewString(): []byte("an encrypted chunk")}
+	n.SetChunkRetrieveHandler(func(chunkID string) ([]byte, error) {
+		data, ok := held[chunkID]
+		if !ok {
+			return nil, errors.New("chunk not found")
+		}
+		return data, nil
+	})
+
+	for chunkID, want := range held {
+		resp, data, err := retrieveChunk(t, coordinator, nodeHost, chunkID)
+		require.NoError(t, err)
+		assert.Empty(t, resp.Error)
+		assert.Equal(t, want, data)
+
+		_, _, err = retrieveChunk(t, stranger, nodeHost, chunkID)
+		assert.Error(t, err, "Only the coordinator may read chunks back")
+	}
+
+	resp, data, err := retrieveChunk(t, coordinator, nodeHost, uuid.NewString())
+	require.NoError(t, err)
+	assert.Equal(t, "chunk not found", resp.Error)
+	assert.Nil(t, data)
+	resp, _, err = retrieveChunk(t, coordinator, nodeHost, "../../etc/passwd")
+	require.NoError(t, err)
+	assert.Contains(t, resp.Error, "invalid chunk ID")
+}
+
+func TestStoreLimiter_RefillsAtRate(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := newStoreLimiter(10, 1, func() time.Time { return now })
+
+	_, ok := l.allow()
+	assert.True(t, ok)
+	retryAfter, ok := l.allow()
+	assert.False(t, ok)
+	assert.Equal(t, 100*time.Millisecond, retryAfter)
+
+	now = now.Add(50 * time.Millisecond)
+	retryAfter, ok = l.allow()
+	assert.False(t, ok)
+	assert.Equal(t, 50*time.Millisecond, retryAfter)
+
+	now = now.Add(50 * time.Millisecond)
+	_, ok = l.allow()
+	assert.True(t, ok, "A token is back after 1/rate seconds")
+}
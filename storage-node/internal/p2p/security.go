@@ -0,0 +1,63 @@
+package p2p
+
+import (
+	"fmt"
+
+	"github.com/libp2p/go-libp2p"
+	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
+	"github.com/libp2p/go-libp2p/p2p/security/noise"
+	libp2ptls "github.com/libp2p/go-libp2p/p2p/security/tls"
+)
+
+// Security transports a node can require on its TCP connections. QUIC always
+// secures connections with its own TLS 1.3 handshake.
+const (
+	SecurityNoise = "noise"
+	SecurityTLS   = "tls"
+)
+
+// SecurityTransports lists the security transports that can be required
+var SecurityTransports = []string{SecurityNoise, SecurityTLS}
+
+// securityOptions offers only the chosen security transport or, for "",
+// libp2p's defaults. Either way every connection is encrypted and
+// authenticated: a peer offering no security, or only another transport,
+// fails the handshake.
+func securityOptions(security string) ([]libp2p.Option, error) {
+	switch security {
+	case "":
+		return nil, nil
+	case SecurityNoise:
+		return []libp2p.Option{libp2p.Security(noise.ID, noise.New)}, nil
+	case SecurityTLS:
+		return []libp2p.Option{libp2p.Security(libp2ptls.ID, libp2ptls.New)}, nil
+	default:
+		return nil, fmt.Errorf("unknown security transport %q (want one of %v)", security, SecurityTransports)
+	}
+}
+
+// limitOptions caps the node's connections at maxPeers (a peer normally
+// holds one) and its open streams at maxStreams. Zero keeps libp2p's
+// defaults, which scale with the machine's memory and file descriptors.
+func limitOptions(maxPeers, maxStreams int) ([]libp2p.Option, error) {
+	if maxPeers <= 0 && maxStreams <= 0 {
+		return nil, nil
+	}
+
+	limits := rcmgr.DefaultLimits
+	libp2p.SetDefaultServiceLimits(&limits)
+	var system rcmgr.ResourceLimits
+	if maxPeers > 0 {
+		system.Conns = rcmgr.LimitVal(maxPeers)
+	}
+	if maxStreams > 0 {
+		system.Streams = rcmgr.LimitVal(maxStreams)
+	}
+	partial := rcmgr.PartialLimitConfig{System: system}
+
+	rm, err := rcmgr.NewResourceManager(rcmgr.NewFixedLimiter(partial.Build(limits.AutoScale())))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create resource manager: %w", err)
+	}
+	return []libp2p.Option{libp2p.ResourceManager(rm)}, nil
+}
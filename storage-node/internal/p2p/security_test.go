@@ -0,0 +1,67 @@
+package p2p
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-libp2p/p2p/security/noise"
+	libp2ptls "github.com/libp2p/go-libp2p/p2p/security/tls"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startSecured starts a TCP-only node on loopback requiring security
+func startSecured(t *testing.T, security string) *Node {
+	t.Helper()
+	n, err := NewNode([]string{"/ip4/127.0.0.1/tcp/0"}, true, false)
+	require.NoError(t, err)
+	require.NoError(t, n.SetSecurity(security))
+	require.NoError(t, n.Start())
+	t.Cleanup(func() { n.Close() })
+	return n
+}
+
+func TestNode_NegotiatesOnlyRequiredSecurity(t *testing.T) {
+	for _, tt := range []struct {
+		server, client string
+		want           protocol.ID // "" when the handshake must fail
+	}{
+		{server: SecurityNoise, client: SecurityNoise, want: noise.ID},
+		{server: SecurityTLS, client: SecurityTLS, want: libp2ptls.ID},
+		{server: SecurityNoise, client: "", want: noise.ID},
+		{server: SecurityTLS, client: "", want: libp2ptls.ID},
+		{server: SecurityNoise, client: SecurityTLS},
+		{server: SecurityTLS, client: SecurityNoise},
+	} {
+		t.Run(tt.server+"/"+tt.client, func(t *testing.T) {
+			server := startSecured(t, tt.server)
+			client := startSecured(t, tt.client)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			err := client.Host().Connect(ctx, peer.AddrInfo{ID: server.Host().ID(), Addrs: server.Host().Addrs()})
+			if tt.want == "" {
+				assert.Error(t, err, "a peer without the required security transport must be refused")
+				return
+			}
+			require.NoError(t, err)
+			conns := client.Host().Network().ConnsToPeer(server.Host().ID())
+			require.NotEmpty(t, conns)
+			for _, conn := range conns {
+				assert.Equal(t, tt.want, conn.ConnState().Security)
+			}
+		})
+	}
+}
+
+func TestSecurityOptions_RejectsUnknown(t *testing.T) {
+	_, err := securityOptions("plaintext")
+	assert.ErrorContains(t, err, "unknown security transport")
+
+	n, err := NewNode(nil, true, false)
+	require.NoError(t, err)
+	assert.Error(t, n.SetSecurity("none"))
+}
@@ -0,0 +1,189 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/federated-storage/storage-node/internal/merkle"
+	"github.com/google/uuid"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// A store stream carries two frames: a storeRequestMessage, then the chunk.
+// The node answers with a storeResponseMessage.
+
+// storeAuthorizationContext and storeReceiptContext prefix what the
+// coordinator and the node sign, so neither signature can be passed off as
+// any other made with the same key. The coordinator uses the same values.
+const (
+	storeAuthorizationContext = "federated-storage store authorization\n"
+	storeReceiptContext       = "federated-storage store receipt\n"
+)
+
+// errStoreNotAuthorized is returned for a store from a peer other than the
+// coordinator without a valid authorization for this node and chunk
+var errStoreNotAuthorized = errors.New("store not authorized")
+
+// storeRequestMessage is the first frame of a store stream
+type storeRequestMessage struct {
+	ChunkID string `json:"chunk_id"`
+	// Authorization is the coordinator's store authorization token, required
+	// from any peer other than the coordinator
+	Authorization string `json:"authorization,omitempty"`
+}
+
+// storeAuthorization is the payload of a store authorization token, as the
+// coordinator signs it
+type storeAuthorization struct {
+	SessionID  string    `json:"session_id"`
+	FileID     string    `json:"file_id"`
+	ChunkID    string    `json:"chunk_id"`
+	ChunkIndex int       `json:"chunk_index"`
+	Hash       string    `json:"hash"`
+	SizeBytes  int64     `json:"size_bytes"`
+	NodeIDs    []string  `json:"node_ids"`
+	PeerIDs    []string  `json:"peer_ids"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// StoreRequest describes a chunk the node was sent to store. FileID and
+// ChunkIndex are only known for stores a client was authorized to make; the
+// coordinator's own transfers leave them empty.
+type StoreRequest struct {
+	ChunkID    string
+	FileID     string
+	ChunkIndex int
+	Hash       string // hex SHA-256 of the data, computed by the node
+}
+
+// storeReceiptMessage is the node's signed statement that it stored a chunk.
+// A client passes it on to the coordinator unchanged, which checks the
+// signature against the node's peer ID before recording the chunk there.
+type storeReceiptMessage struct {
+	PeerID     string `json:"peer_id"`
+	ChunkID    string `json:"chunk_id"`
+	Hash       string `json:"hash"`
+	SizeBytes  int64  `json:"size_bytes"`
+	MerkleRoot string `json:"merkle_root"`
+	Signature  []byte `json:"signature"`
+}
+
+// storeReceiptPayload is what a receipt's signature covers
+func storeReceiptPayload(chunkID, hash string, sizeBytes int64, merkleRoot string) []byte {
+	return []byte(fmt.Sprintf("%s%s\n%s\n%d\n%s", storeReceiptContext, chunkID, hash, sizeBytes, merkleRoot))
+}
+
+// checkStoreAuthorization verifies token against the coordinator's key and
+// returns it if it lets this node store chunkID. The caller checks the
+// content against it.
+func (n *Node) checkStoreAuthorization(token, chunkID string, now time.Time) (*storeAuthorization, error) {
+	n.authMu.RLock()
+	coordinator := n.authorizedPeer
+	n.authMu.RUnlock()
+	if coordinator == "" || token == "" {
+		return nil, errStoreNotAuthorized
+	}
+
+	encodedPayload, encodedSignature, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, fmt.Errorf("%w: malformed token", errStoreNotAuthorized)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed token", errStoreNotAuthorized)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(encodedSignature)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed token", errStoreNotAuthorized)
+	}
+	key, err := coordinator.ExtractPublicKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read coordinator key: %w", err)
+	}
+	valid, err := key.Verify(append([]byte(storeAuthorizationContext), payload...), signature)
+	if err != nil || !valid {
+		return nil, fmt.Errorf("%w: bad signature", errStoreNotAuthorized)
+	}
+
+	var auth storeAuthorization
+	if err := json.NewDecoder(bytes.NewReader(payload)).Decode(&auth); err != nil {
+		return nil, fmt.Errorf("%w: malformed payload", errStoreNotAuthorized)
+	}
+	switch {
+	case !now.Before(auth.ExpiresAt):
+		return nil, fmt.Errorf("%w: expired at %s", errStoreNotAuthorized, auth.ExpiresAt.Format(time.RFC3339))
+	case auth.ChunkID != chunkID:
+		return nil, fmt.Errorf("%w: issued for chunk %s", errStoreNotAuthorized, auth.ChunkID)
+	case !slices.Contains(auth.PeerIDs, n.ID().String()):
+		return nil, fmt.Errorf("%w: issued for other nodes", errStoreNotAuthorized)
+	}
+	return &auth, nil
+}
+
+// receiveStore reads a store stream's request and chunk and checks the
+// sender may store it, returning what to hand the store handler. A peer
+// other than the coordinator is refused before its chunk is read unless its
+// authorization is valid.
+func (n *Node) receiveStore(r io.Reader, remote peer.ID) (*StoreRequest, []byte, error) {
+	header, err := parseFrame(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read store request: %w", err)
+	}
+	var msg storeRequestMessage
+	if err := json.Unmarshal(header, &msg); err != nil {
+		return nil, nil, fmt.Errorf("malformed store request: %w", err)
+	}
+	if _, err := uuid.Parse(msg.ChunkID); err != nil {
+		return nil, nil, fmt.Errorf("invalid chunk ID %q", msg.ChunkID)
+	}
+	var auth *storeAuthorization
+	if !n.isAuthorized(remote) {
+		if auth, err = n.checkStoreAuthorization(msg.Authorization, msg.ChunkID, time.Now()); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	data, err := parseFrame(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read chunk: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	req := &StoreRequest{ChunkID: msg.ChunkID, Hash: hex.EncodeToString(sum[:])}
+	if auth != nil {
+		if auth.SizeBytes != int64(len(data)) || auth.Hash != req.Hash {
+			return nil, nil, fmt.Errorf("%w: content differs from what was authorized", errStoreNotAuthorized)
+		}
+		req.FileID, req.ChunkIndex = auth.FileID, auth.ChunkIndex
+	}
+	return req, data, nil
+}
+
+// signStoreReceipt signs the receipt for data stored under req
+func (n *Node) signStoreReceipt(req *StoreRequest, data []byte) (*storeReceiptMessage, error) {
+	receipt := &storeReceiptMessage{
+		PeerID:     n.ID().String(),
+		ChunkID:    req.ChunkID,
+		Hash:       req.Hash,
+		SizeBytes:  int64(len(data)),
+		MerkleRoot: hex.EncodeToString(merkle.Root(data)),
+	}
+	key := n.host.Peerstore().PrivKey(n.host.ID())
+	if key == nil {
+		return nil, fmt.Errorf("no private key for %s", n.host.ID())
+	}
+	signature, err := key.Sign(storeReceiptPayload(receipt.ChunkID, receipt.Hash, receipt.SizeBytes, receipt.MerkleRoot))
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign store receipt: %w", err)
+	}
+	receipt.Signature = signature
+	return receipt, nil
+}
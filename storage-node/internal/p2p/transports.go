@@ -0,0 +1,80 @@
+package p2p
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/libp2p/go-libp2p"
+	libp2pquic "github.com/libp2p/go-libp2p/p2p/transport/quic"
+	"github.com/libp2p/go-libp2p/p2p/transport/tcp"
+)
+
+// ErrNoTransports is returned when no listen address uses an enabled transport
+var ErrNoTransports = errors.New("no listen addresses for the enabled transports")
+
+// Default wildcard listen addresses, used for each enabled transport when none are configured
+const (
+	defaultTCPAddr  = "/ip4/0.0.0.0/tcp/0"
+	defaultQUICAddr = "/ip4/0.0.0.0/udp/0/quic-v1"
+)
+
+// addrTransport names the transport a multiaddr listens on: "tcp", "quic",
+// or "" for transports the node does not run, such as websockets. Unlike
+// isQUIC it looks at the last protocol only, so /quic inside a path doesn't count.
+func addrTransport(addr string) string {
+	parts := strings.Split(strings.TrimSuffix(addr, "/"), "/")
+	if len(parts) < 3 {
+		return ""
+	}
+	switch parts[len(parts)-1] {
+	case "quic", "quic-v1":
+		return "quic"
+	}
+	if parts[len(parts)-2] == "tcp" {
+		return "tcp"
+	}
+	return ""
+}
+
+// listenAddrs keeps the configured addresses whose transport is enabled or,
+// with none configured, picks a wildcard address per enabled transport
+func listenAddrs(configured []string, enableTCP, enableQUIC bool) ([]string, error) {
+	if len(configured) == 0 {
+		if enableTCP {
+			configured = append(configured, defaultTCPAddr)
+		}
+		if enableQUIC {
+			configured = append(configured, defaultQUICAddr)
+		}
+	}
+
+	var addrs []string
+	for _, addr := range configured {
+		switch addrTransport(addr) {
+		case "tcp":
+			if enableTCP {
+				addrs = append(addrs, addr)
+			}
+		case "quic":
+			if enableQUIC {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, ErrNoTransports
+	}
+	return addrs, nil
+}
+
+// transportOptions enables exactly the chosen transports, replacing libp2p's defaults
+func transportOptions(enableTCP, enableQUIC bool) []libp2p.Option {
+	var opts []libp2p.Option
+	if enableTCP {
+		opts = append(opts, libp2p.Transport(tcp.NewTCPTransport))
+	}
+	if enableQUIC {
+		opts = append(opts, libp2p.Transport(libp2pquic.NewTransport))
+	}
+	return opts
+}
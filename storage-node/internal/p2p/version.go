@@ -0,0 +1,135 @@
+package p2p
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/federated-storage/storage-node/internal/logging"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// handshakeProtocol is unversioned in spirit: its message format must never change,
+// since it is how peers find out which versioned protocols they share
+const handshakeProtocol = "/federated-storage/handshake/1.0.0"
+
+// SupportedVersions lists the wire-protocol versions this build serves
+var SupportedVersions = []string{"1.0.0"}
+
+// ErrNoCommonVersion is returned when two peers share no protocol version
+var ErrNoCommonVersion = errors.New("no common protocol version")
+
+// handshakeMessage carries a peer's supported versions in a request, or the
+// selected version in a response
+type handshakeMessage struct {
+	Versions []string `json:"versions,omitempty"`
+	Version  string   `json:"version,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// protocolID builds the stream protocol ID for a named protocol at a version
+func protocolID(version, name string) protocol.ID {
+	return protocol.ID(fmt.Sprintf("/federated-storage/%s/%s", version, name))
+}
+
+// parseVersion splits "major.minor.patch" into numbers for ordering
+func parseVersion(v string) ([3]int, bool) {
+	var out [3]int
+	parts := strings.Split(v, ".")
+	if len(parts) != 3 {
+		return out, false
+	}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return out, false
+		}
+		out[i] = n
+	}
+	return out, true
+}
+
+// versionLess reports whether a orders before b
+func versionLess(a, b [3]int) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
+
+// SelectVersion returns the highest version present in both lists.
+// Malformed entries are ignored.
+func SelectVersion(local, remote []string) (string, error) {
+	offered := make(map[string]bool, len(remote))
+	for _, v := range remote {
+		offered[v] = true
+	}
+
+	var best string
+	var bestParsed [3]int
+	for _, v := range local {
+		parsed, ok := parseVersion(v)
+		if !ok || !offered[v] {
+			continue
+		}
+		if best == "" || versionLess(bestParsed, parsed) {
+			best, bestParsed = v, parsed
+		}
+	}
+	if best == "" {
+		return "", fmt.Errorf("%w: local %v, remote %v", ErrNoCommonVersion, local, remote)
+	}
+	return best, nil
+}
+
+// versions returns the protocol versions this node serves
+func (n *Node) versions() []string {
+	if len(n.supportedVersions) > 0 {
+		return n.supportedVersions
+	}
+	return SupportedVersions
+}
+
+// serve registers handler for the named protocol at every supported version.
+// Handlers can read the version a stream was opened with from s.Protocol().
+func (n *Node) serve(name string, handler network.StreamHandler) {
+	for _, v := range n.versions() {
+		n.host.SetStreamHandler(protocolID(v, name), n.authorized(handler))
+	}
+}
+
+// serveAnyPeer is serve for protocols whose handler decides for itself which
+// peers it answers
+func (n *Node) serveAnyPeer(name string, handler network.StreamHandler) {
+	for _, v := range n.versions() {
+		n.host.SetStreamHandler(protocolID(v, name), n.withDeadline(handler))
+	}
+}
+
+// setHandshakeHandler answers version negotiation requests with the highest
+// version both sides support
+func (n *Node) setHandshakeHandler() {
+	n.host.SetStreamHandler(handshakeProtocol, n.authorized(func(s network.Stream) {
+		defer s.Close()
+
+		var req handshakeMessage
+		if err := json.NewDecoder(s).Decode(&req); err != nil {
+			return
+		}
+
+		var resp handshakeMessage
+		version, err := SelectVersion(n.versions(), req.Versions)
+		if err != nil {
+			logging.Warnf("Version negotiation with %s failed: %v", s.Conn().RemotePeer(), err)
+			resp.Error = err.Error()
+		} else {
+			resp.Version = version
+		}
+		json.NewEncoder(s).Encode(resp)
+	}))
+}
@@ -0,0 +1,120 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+)
+
+// maxCapacityBlockSize bounds the block buffer a capacity challenge can make the node allocate
+const maxCapacityBlockSize = 16 << 20
+
+// ErrInvalidCapacityChallenge is returned for capacity challenges the node can't answer as asked
+var ErrInvalidCapacityChallenge = errors.New("invalid capacity challenge")
+
+// CapacityProver answers the coordinator's capacity challenges: it stores the
+// blocks the coordinator sends at the offsets it picked across the node's
+// claimed capacity, syncs them, and hashes the ones the coordinator then
+// samples as read back from disk. The coordinator derives the blocks from a
+// secret it keeps, so the only way to answer is to hold them.
+type CapacityProver struct {
+	dir  string
+	disk func(path string) (*DiskUsage, error)
+
+	mu sync.Mutex // one challenge at a time, each needs its region's worth of disk
+}
+
+// NewCapacityProver creates a prover writing its scratch files under dir
+func NewCapacityProver(dir string) *CapacityProver {
+	return &CapacityProver{dir: dir, disk: statDisk}
+}
+
+// CapacityRegion is a capacity challenge's scratch file, held until Close
+type CapacityRegion struct {
+	prover    *CapacityProver
+	f         *os.File
+	blockSize int
+	offsets   []int64
+}
+
+// Begin takes a challenge for blocks of blockSize bytes at the given block
+// offsets, one challenge at a time. A challenge whose blocks don't fit in the
+// free space fails without writing anything.
+func (p *CapacityProver) Begin(blockSize int, offsets []int64) (*CapacityRegion, error) {
+	if blockSize <= 0 || blockSize > maxCapacityBlockSize || len(offsets) == 0 {
+		return nil, fmt.Errorf("%w: %d blocks of %d bytes", ErrInvalidCapacityChallenge, len(offsets), blockSize)
+	}
+	for _, offset := range offsets {
+		if offset < 0 || offset >= math.MaxInt64/int64(blockSize) {
+			return nil, fmt.Errorf("%w: block offset %d", ErrInvalidCapacityChallenge, offset)
+		}
+	}
+	region := int64(len(offsets)) * int64(blockSize)
+
+	p.mu.Lock()
+	// Where the volume can't be inspected, a full disk shows up as a write error
+	if disk, err := p.disk(p.dir); err == nil && disk.FreeBytes < uint64(region) {
+		p.mu.Unlock()
+		return nil, fmt.Errorf("%w: %d bytes of blocks do not fit in %d bytes free", ErrInsufficientSpace, region, disk.FreeBytes)
+	}
+	// Sparse, so only the blocks written take space
+	f, err := os.CreateTemp(p.dir, "capacity-proof-*.tmp")
+	if err != nil {
+		p.mu.Unlock()
+		return nil, fmt.Errorf("failed to create scratch file: %w", err)
+	}
+	return &CapacityRegion{prover: p, f: f, blockSize: blockSize, offsets: offsets}, nil
+}
+
+// WriteBlock stores block i of the challenge at its offset
+func (r *CapacityRegion) WriteBlock(i int, data []byte) error {
+	if i < 0 || i >= len(r.offsets) || len(data) != r.blockSize {
+		return fmt.Errorf("%w: block %d of %d bytes", ErrInvalidCapacityChallenge, i, len(data))
+	}
+	if _, err := r.f.WriteAt(data, r.offsets[i]*int64(r.blockSize)); err != nil {
+		return fmt.Errorf("failed to write block: %w", err)
+	}
+	return nil
+}
+
+// Sync flushes the written blocks to disk
+func (r *CapacityRegion) Sync() error {
+	if err := r.f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync blocks: %w", err)
+	}
+	return nil
+}
+
+// Answer returns the hex SHA-256 of nonce followed by each of the given
+// blocks, as read back from disk
+func (r *CapacityRegion) Answer(nonce []byte, blocks []int) ([]string, error) {
+	buf := make([]byte, r.blockSize)
+	digests := make([]string, len(blocks))
+	for i, block := range blocks {
+		if block < 0 || block >= len(r.offsets) {
+			return nil, fmt.Errorf("%w: no block %d", ErrInvalidCapacityChallenge, block)
+		}
+		if _, err := r.f.ReadAt(buf, r.offsets[block]*int64(r.blockSize)); err != nil {
+			return nil, fmt.Errorf("failed to read block back: %w", err)
+		}
+		h := sha256.New()
+		h.Write(nonce)
+		h.Write(buf)
+		digests[i] = hex.EncodeToString(h.Sum(nil))
+	}
+	return digests, nil
+}
+
+// Close removes the scratch file and lets the next challenge begin
+func (r *CapacityRegion) Close() error {
+	defer r.prover.mu.Unlock()
+	err := r.f.Close()
+	if removeErr := os.Remove(r.f.Name()); err == nil {
+		err = removeErr
+	}
+	return err
+}
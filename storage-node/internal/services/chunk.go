@@ -1,10 +1,13 @@
 package services
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"sync"
 	"time"
 
+	"github.com/federated-storage/storage-node/internal/logging"
 	"github.com/federated-storage/storage-node/internal/models"
 	"github.com/federated-storage/storage-node/internal/storage"
 )
@@ -13,18 +16,178 @@ import (
 type ChunkService struct {
 	db       *storage.DB
 	chunkDir string
+	limits   StorageLimits
+	// storeSlots bounds concurrent StoreChunk calls; nil means unbounded
+	storeSlots chan struct{}
+	storeWait  time.Duration
+	metrics    *Metrics // nil records nothing
+	dedup      bool     // hard-link content already stored under another chunk
+	// spaceMu serializes space checks; reserved counts bytes of stores that
+	// passed the check but are not yet in the database, so simultaneous
+	// stores cannot each fit under the cap and together exceed it
+	spaceMu  sync.Mutex
+	reserved int64
+	// failpoint, when set by tests, is called after each step of StoreChunk;
+	// an error stops the write there with no cleanup, as if the process died
+	failpoint func(step string) error
 }
 
+// Steps of StoreChunk at which a crash leaves distinct on-disk states
+const (
+	stepTempWritten = "temp-written" // synced temp file, not yet renamed
+	stepRenamed     = "renamed"      // chunk file in place, no DB row yet
+)
+
+// tempSuffix marks chunk files that have not been fully written
+const tempSuffix = ".tmp"
+
 // NewChunkService creates a new chunk service
-func NewChunkService(db *storage.DB, chunkDir string) *ChunkService {
+func NewChunkService(db *storage.DB, chunkDir string, limits StorageLimits) *ChunkService {
 	return &ChunkService{
 		db:       db,
 		chunkDir: chunkDir,
+		limits:   limits,
+	}
+}
+
+// SetMetrics reports the node's chunk count, bytes used and free disk space
+// to m, starting from what is stored now
+func (s *ChunkService) SetMetrics(m *Metrics) {
+	s.metrics = m
+	m.SetDiskStat(func() (*DiskUsage, error) { return statDisk(s.chunkDir) })
+	s.updateMetrics()
+}
+
+// updateMetrics refreshes the storage gauges after the stored chunks change
+func (s *ChunkService) updateMetrics() {
+	if s.metrics == nil {
+		return
+	}
+	count, err := s.GetChunkCount()
+	if err != nil {
+		logging.Warnf("Failed to count chunks for metrics: %v", err)
+		return
+	}
+	total, err := s.GetTotalStorage()
+	if err != nil {
+		logging.Warnf("Failed to total storage for metrics: %v", err)
+		return
+	}
+	s.metrics.SetStorage(count, total)
+}
+
+// ErrStoreBusy is returned when every store slot stayed taken for the whole queue wait
+var ErrStoreBusy = errors.New("too many concurrent chunk stores")
+
+// SetStoreConcurrency allows at most limit StoreChunk calls to run at once.
+// Further calls queue for up to wait, then fail with ErrStoreBusy; a negative
+// wait rejects them immediately. limit <= 0 removes the bound.
+func (s *ChunkService) SetStoreConcurrency(limit int, wait time.Duration) {
+	s.storeSlots = nil
+	if limit > 0 {
+		s.storeSlots = make(chan struct{}, limit)
+	}
+	s.storeWait = wait
+}
+
+// acquireStoreSlot waits for a free store slot and returns the function that releases it
+func (s *ChunkService) acquireStoreSlot() (func(), error) {
+	if s.storeSlots == nil {
+		return func() {}, nil
+	}
+	release := func() { <-s.storeSlots }
+
+	select {
+	case s.storeSlots <- struct{}{}:
+		return release, nil
+	default:
+	}
+	if s.storeWait < 0 {
+		return nil, ErrStoreBusy
+	}
+
+	timer := time.NewTimer(s.storeWait)
+	defer timer.Stop()
+	select {
+	case s.storeSlots <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+		return nil, ErrStoreBusy
+	}
+}
+
+// spaceReservation is space set aside for one store until it is recorded or abandoned
+type spaceReservation struct {
+	s     *ChunkService
+	bytes int64
+	done  bool
+}
+
+// reserveSpace sets aside incoming bytes for a store if they fit under the
+// storage cap and free-space reserve
+func (s *ChunkService) reserveSpace(incoming int64) (*spaceReservation, error) {
+	s.spaceMu.Lock()
+	defer s.spaceMu.Unlock()
+	if err := s.checkSpace(incoming); err != nil {
+		return nil, err
+	}
+	s.reserved += incoming
+	return &spaceReservation{s: s, bytes: incoming}, nil
+}
+
+// commit runs record, which adds the chunk to the database, and hands the
+// reservation over to it in one step so no space check counts the bytes twice
+func (r *spaceReservation) commit(record func() error) error {
+	r.s.spaceMu.Lock()
+	defer r.s.spaceMu.Unlock()
+	r.s.reserved -= r.bytes
+	r.done = true
+	return record()
+}
+
+// release gives back space that was never committed
+func (r *spaceReservation) release() {
+	if r.done {
+		return
+	}
+	r.s.spaceMu.Lock()
+	defer r.s.spaceMu.Unlock()
+	r.s.reserved -= r.bytes
+	r.done = true
+}
+
+// checkSpace rejects a write that would breach the storage cap or free-space
+// reserve. The caller holds spaceMu.
+func (s *ChunkService) checkSpace(incoming int64) error {
+	used, err := s.GetTotalStorage()
+	if err != nil {
+		return fmt.Errorf("failed to read storage usage: %w", err)
+	}
+	used += s.reserved
+
+	var disk *DiskUsage
+	if s.limits.ReserveFreePercent > 0 {
+		if disk, err = statDisk(s.chunkDir); err != nil {
+			logging.Warnf("Could not read free space for %s, skipping reserve check: %v", s.chunkDir, err)
+		}
 	}
+	return CheckSpace(s.limits, used, incoming, disk)
 }
 
 // StoreChunk stores a chunk on disk and in database
 func (s *ChunkService) StoreChunk(chunkID, fileID string, chunkIndex int, hash string, data []byte) error {
+	release, err := s.acquireStoreSlot()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	reservation, err := s.reserveSpace(int64(len(data)))
+	if err != nil {
+		return err
+	}
+	defer reservation.release()
+
 	// Determine file path (two-level directory structure)
 	dirPath := fmt.Sprintf("%s/%s/%s", s.chunkDir, chunkID[:2], chunkID[2:4])
 	filePath := fmt.Sprintf("%s/%s", dirPath, chunkID)
@@ -34,32 +197,80 @@ func (s *ChunkService) StoreChunk(chunkID, fileID string, chunkIndex int, hash s
 		return fmt.Errorf("failed to create chunk directory: %w", err)
 	}
 
-	// Write chunk to disk
-	if err := os.WriteFile(filePath, data, 0644); err != nil {
-		return fmt.Errorf("failed to write chunk to disk: %w", err)
+	// Write to a temp file and rename it into place, so a crash never leaves
+	// a truncated file under the chunk's name
+	tempPath := filePath + tempSuffix
+	if !s.linkDuplicate(tempPath, chunkID, hash, data) {
+		if err := writeFileSync(tempPath, data); err != nil {
+			os.Remove(tempPath)
+			return fmt.Errorf("failed to write chunk to disk: %w", err)
+		}
+	}
+	if err := s.fail(stepTempWritten); err != nil {
+		return err
+	}
+	if err := os.Rename(tempPath, filePath); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to move chunk into place: %w", err)
+	}
+	if err := syncDir(dirPath); err != nil {
+		logging.Warnf("Failed to sync chunk directory %s: %v", dirPath, err)
+	}
+	if err := s.fail(stepRenamed); err != nil {
+		return err
 	}
 
 	// Store in database
-	_, err := s.db.Conn.Exec(
-		`INSERT INTO stored_chunks (id, file_id, chunk_index, hash, size_bytes, file_path) 
-		 VALUES (?, ?, ?, ?, ?, ?) 
-		 ON CONFLICT(id) DO UPDATE SET 
-		   file_id = excluded.file_id,
-		   chunk_index = excluded.chunk_index,
-		   hash = excluded.hash,
-		   size_bytes = excluded.size_bytes,
-		   file_path = excluded.file_path,
-		   updated_at = ?`,
-		chunkID, fileID, chunkIndex, hash, len(data), filePath, time.Now())
+	err = reservation.commit(func() error {
+		_, err := s.db.Conn.Exec(
+			`INSERT INTO stored_chunks (id, file_id, chunk_index, hash, size_bytes, file_path) 
+			 VALUES (?, ?, ?, ?, ?, ?) 
+			 ON CONFLICT(id) DO UPDATE SET 
+			   file_id = excluded.file_id,
+			   chunk_index = excluded.chunk_index,
+			   hash = excluded.hash,
+			   size_bytes = excluded.size_bytes,
+			   file_path = excluded.file_path,
+			   status = 'active',
+			   updated_at = ?`,
+			chunkID, fileID, chunkIndex, hash, len(data), filePath, time.Now())
+		return err
+	})
 	if err != nil {
 		// Clean up the file if database insert fails
 		os.Remove(filePath)
 		return fmt.Errorf("failed to store chunk metadata: %w", err)
 	}
 
+	s.updateMetrics()
 	return nil
 }
 
+// fail runs the test failpoint for step, if one is set
+func (s *ChunkService) fail(step string) error {
+	if s.failpoint == nil {
+		return nil
+	}
+	return s.failpoint(step)
+}
+
+// writeFileSync writes data to path and flushes it to stable storage
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
 // GetChunk retrieves a chunk by ID (metadata only)
 func (s *ChunkService) GetChunk(chunkID string) (*models.StoredChunk, error) {
 	var chunk models.StoredChunk
@@ -117,7 +328,26 @@ func (s *ChunkService) DeleteChunk(chunkID string) error {
 	_, err := s.db.Conn.Exec(
 		"UPDATE stored_chunks SET status = 'deleted', updated_at = ? WHERE id = ?",
 		time.Now(), chunkID)
-	return err
+	if err != nil {
+		return err
+	}
+	s.updateMetrics()
+	return nil
+}
+
+// PurgeChunk marks a chunk as deleted and removes its file from disk
+func (s *ChunkService) PurgeChunk(chunkID string) error {
+	chunk, err := s.GetChunk(chunkID)
+	if err != nil {
+		return err
+	}
+	if err := s.DeleteChunk(chunkID); err != nil {
+		return err
+	}
+	if err := os.Remove(chunk.FilePath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove chunk file: %w", err)
+	}
+	return nil
 }
 
 // GetTotalStorage returns total storage used in bytes
@@ -3,16 +3,26 @@ package services
 import (
 	"bytes"
 	"context"
+	"crypto/hmac"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/federated-storage/storage-node/internal/config"
+	"github.com/federated-storage/storage-node/internal/merkle"
 )
 
+// NodeVersion is the storage node software version reported to the coordinator.
+// Release builds override it with -ldflags "-X github.com/federated-storage/storage-node/internal/services.NodeVersion=x.y.z".
+var NodeVersion = "0.1.0"
+
 // CoordinatorClient handles communication with the coordinator
 type CoordinatorClient struct {
 	config     *config.CoordinatorConfig
@@ -29,6 +39,25 @@ func NewCoordinatorClient(cfg *config.CoordinatorConfig) *CoordinatorClient {
 	}
 }
 
+// signRequest returns the hex HMAC-SHA256, keyed with the API key, of the
+// request method, path and timestamp, matching the coordinator's check
+func signRequest(apiKey, method, path, timestamp string) string {
+	mac := hmac.New(sha256.New, []byte(apiKey))
+	mac.Write([]byte(method + "\n" + path + "\n" + timestamp))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// setAuthHeaders adds the node's credentials and a request signature. The
+// signature is always sent so routes can be switched to signed mode without
+// upgrading nodes.
+func (c *CoordinatorClient) setAuthHeaders(req *http.Request) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("X-Peer-ID", c.config.PeerID)
+	req.Header.Set("X-API-Key", c.config.APIKey)
+	req.Header.Set("X-Timestamp", timestamp)
+	req.Header.Set("X-Signature", signRequest(c.config.APIKey, req.Method, req.URL.RequestURI(), timestamp))
+}
+
 // RegisterNodeRequest represents node registration request
 type RegisterNodeRequest struct {
 	Name           string `json:"name"`
@@ -36,32 +65,48 @@ type RegisterNodeRequest struct {
 	PublicKey      []byte `json:"public_key"`
 	Address        string `json:"address"`
 	TotalStorageGB int    `json:"total_storage_gb"`
+	Version        string `json:"version"`
+	OperatorID     string `json:"operator_id,omitempty"`
+	Region         string `json:"region,omitempty"`
+	// InviteToken admits the node to a coordinator that disallows open registration
+	InviteToken string `json:"-"`
 }
 
 // RegisterNodeResponse represents node registration response
 type RegisterNodeResponse struct {
-	NodeID string `json:"node_id"`
-	APIKey string `json:"api_key"`
+	NodeID            string `json:"node_id"`
+	APIKey            string `json:"api_key"`
+	CoordinatorPeerID string `json:"coordinator_peer_id,omitempty"`
 }
 
 // RegisterNode registers the node with the coordinator
 func (c *CoordinatorClient) RegisterNode(req RegisterNodeRequest) (*RegisterNodeResponse, error) {
+	if req.Version == "" {
+		req.Version = NodeVersion
+	}
+
 	data, err := json.Marshal(req)
 	if err != nil {
 		return nil, err
 	}
 
-	resp, err := c.httpClient.Post(
-		c.config.URL+"/api/v1/nodes/register",
-		"application/json",
-		bytes.NewReader(data))
+	httpReq, err := http.NewRequest("POST", c.config.URL+"/api/v1/nodes/register", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if req.InviteToken != "" {
+		httpReq.Header.Set("X-Invite-Token", req.InviteToken)
+	}
+
+	resp, err := c.httpClient.Do(httpReq)
 	if err != nil {
 		return nil, fmt.Errorf("failed to register node: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusCreated {
-		return nil, fmt.Errorf("registration failed with status: %d", resp.StatusCode)
+		return nil, fmt.Errorf("registration failed with status: %d%s", resp.StatusCode, errorDetail(resp))
 	}
 
 	var result RegisterNodeResponse
@@ -74,18 +119,31 @@ func (c *CoordinatorClient) RegisterNode(req RegisterNodeRequest) (*RegisterNode
 
 // HeartbeatRequest represents heartbeat request
 type HeartbeatRequest struct {
-	UsedStorageBytes int64 `json:"used_storage_bytes"`
+	UsedStorageBytes int64  `json:"used_storage_bytes"`
+	Version          string `json:"version"`
 }
 
 // HeartbeatResponse represents heartbeat response
 type HeartbeatResponse struct {
 	Status        string `json:"status"`
 	EarnedCredits int64  `json:"earned_credits"`
+	// CoordinatorPeerID is the coordinator's current peer ID; empty while its P2P host is down
+	CoordinatorPeerID string `json:"coordinator_peer_id,omitempty"`
+	// CoordinatorRotation is present after the coordinator's identity was rotated
+	CoordinatorRotation *CoordinatorRotation `json:"coordinator_rotation,omitempty"`
+}
+
+// CoordinatorRotation is the coordinator's previous identity's signed
+// statement that it now runs under PeerID
+type CoordinatorRotation struct {
+	PreviousPeerID string `json:"previous_peer_id"`
+	PeerID         string `json:"peer_id"`
+	Signature      []byte `json:"signature"`
 }
 
 // SendHeartbeat sends heartbeat to coordinator
 func (c *CoordinatorClient) SendHeartbeat(usedBytes int64) (*HeartbeatResponse, error) {
-	req := HeartbeatRequest{UsedStorageBytes: usedBytes}
+	req := HeartbeatRequest{UsedStorageBytes: usedBytes, Version: NodeVersion}
 	data, err := json.Marshal(req)
 	if err != nil {
 		return nil, err
@@ -96,8 +154,7 @@ func (c *CoordinatorClient) SendHeartbeat(usedBytes int64) (*HeartbeatResponse,
 		return nil, err
 	}
 	httpReq.Header.Set("Content-Type", "application/json")
-	httpReq.Header.Set("X-Peer-ID", c.config.PeerID)
-	httpReq.Header.Set("X-API-Key", c.config.APIKey)
+	c.setAuthHeaders(httpReq)
 
 	resp, err := c.httpClient.Do(httpReq)
 	if err != nil {
@@ -106,7 +163,7 @@ func (c *CoordinatorClient) SendHeartbeat(usedBytes int64) (*HeartbeatResponse,
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("heartbeat failed with status: %d", resp.StatusCode)
+		return nil, fmt.Errorf("heartbeat failed with status: %d%s", resp.StatusCode, errorDetail(resp))
 	}
 
 	var result HeartbeatResponse
@@ -117,25 +174,467 @@ func (c *CoordinatorClient) SendHeartbeat(usedBytes int64) (*HeartbeatResponse,
 	return &result, nil
 }
 
+// UpdateCapacity reports the node's new total capacity, returning it in bytes as recorded by the coordinator
+func (c *CoordinatorClient) UpdateCapacity(totalGB int) (int64, error) {
+	data, err := json.Marshal(map[string]int{"total_storage_gb": totalGB})
+	if err != nil {
+		return 0, err
+	}
+
+	httpReq, err := http.NewRequest("PUT", c.config.URL+"/api/v1/nodes/capacity", bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	c.setAuthHeaders(httpReq)
+
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return 0, fmt.Errorf("failed to update capacity: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("capacity update failed with status: %d%s", resp.StatusCode, errorDetail(resp))
+	}
+
+	var body struct {
+		TotalStorageBytes int64 `json:"total_storage_bytes"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return 0, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return body.TotalStorageBytes, nil
+}
+
+// ScheduleMaintenance announces a window in which the node will be offline.
+// The coordinator drains the node ahead of it and stops placing chunks on it
+// until end.
+func (c *CoordinatorClient) ScheduleMaintenance(start, end time.Time) error {
+	data, err := json.Marshal(map[string]time.Time{"start": start, "end": end})
+	if err != nil {
+		return err
+	}
+
+	httpReq, err := http.NewRequest("PUT", c.config.URL+"/api/v1/nodes/maintenance", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	c.setAuthHeaders(httpReq)
+
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("failed to schedule maintenance: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("maintenance scheduling failed with status: %d%s", resp.StatusCode, errorDetail(resp))
+	}
+	return nil
+}
+
+// CancelMaintenance withdraws the node's maintenance window
+func (c *CoordinatorClient) CancelMaintenance() error {
+	httpReq, err := http.NewRequest("DELETE", c.config.URL+"/api/v1/nodes/maintenance", nil)
+	if err != nil {
+		return err
+	}
+	c.setAuthHeaders(httpReq)
+
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("failed to cancel maintenance: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("maintenance cancellation failed with status: %d%s", resp.StatusCode, errorDetail(resp))
+	}
+	return nil
+}
+
+// RotateAPIKey asks the coordinator for a new API key. The old key stops
+// working immediately, so callers must persist the returned key.
+func (c *CoordinatorClient) RotateAPIKey() (string, error) {
+	httpReq, err := http.NewRequest("POST", c.config.URL+"/api/v1/nodes/rotate-key", nil)
+	if err != nil {
+		return "", err
+	}
+	c.setAuthHeaders(httpReq)
+
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return "", fmt.Errorf("failed to rotate API key: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("key rotation failed with status: %d%s", resp.StatusCode, errorDetail(resp))
+	}
+
+	var body struct {
+		APIKey string `json:"api_key"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("failed to decode response: %w", err)
+	}
+	if body.APIKey == "" {
+		return "", fmt.Errorf("coordinator returned an empty API key")
+	}
+	return body.APIKey, nil
+}
+
+// StartDecommission tells the coordinator the node is retiring for good. It
+// stops placing chunks on the node and returns how many are assigned to it.
+func (c *CoordinatorClient) StartDecommission() (int, error) {
+	httpReq, err := http.NewRequest("POST", c.config.URL+"/api/v1/nodes/decommission", nil)
+	if err != nil {
+		return 0, err
+	}
+	c.setAuthHeaders(httpReq)
+
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return 0, fmt.Errorf("failed to start decommission: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("decommission failed with status: %d%s", resp.StatusCode, errorDetail(resp))
+	}
+
+	var body struct {
+		Chunks int `json:"chunks"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return 0, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return body.Chunks, nil
+}
+
+// ErrChunkUnknown is returned when the coordinator has no record of a migrated chunk
+var ErrChunkUnknown = errors.New("chunk unknown to coordinator")
+
+// MigrateChunkResponse confirms a chunk was re-replicated away from the node
+type MigrateChunkResponse struct {
+	ChunkID  string `json:"chunk_id"`
+	Replicas int    `json:"replicas"` // verified replicas on other nodes
+	Copied   int    `json:"copied"`   // of which were made from this node's data
+}
+
+// MigrateChunk sends a chunk's data to the coordinator, which copies it to
+// other nodes and answers once enough verified replicas exist elsewhere
+func (c *CoordinatorClient) MigrateChunk(chunkID string, data []byte) (*MigrateChunkResponse, error) {
+	httpReq, err := http.NewRequest("POST", c.config.URL+"/api/v1/nodes/decommission/chunks/"+chunkID, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/octet-stream")
+	c.setAuthHeaders(httpReq)
+
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to migrate chunk: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%w%s", ErrChunkUnknown, errorDetail(resp))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("chunk migration failed with status: %d%s", resp.StatusCode, errorDetail(resp))
+	}
+
+	var result MigrateChunkResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return &result, nil
+}
+
+// Deregister removes a decommissioned node from the coordinator. It fails
+// while chunks are still assigned to the node; afterwards the API key is void.
+func (c *CoordinatorClient) Deregister() error {
+	httpReq, err := http.NewRequest("DELETE", c.config.URL+"/api/v1/nodes", nil)
+	if err != nil {
+		return err
+	}
+	c.setAuthHeaders(httpReq)
+
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("failed to deregister: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("deregistration failed with status: %d%s", resp.StatusCode, errorDetail(resp))
+	}
+	return nil
+}
+
+// ReconcileResponse is the coordinator's diff of the node's chunk inventory
+type ReconcileResponse struct {
+	Missing []string
+	Extra   []string
+}
+
+// Reconcile reports the chunks held locally and returns those the coordinator
+// expects but are missing, and those held that are no longer assigned
+func (c *CoordinatorClient) Reconcile(chunkIDs []string) (*ReconcileResponse, error) {
+	packed, err := PackChunkIDs(chunkIDs)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(map[string]string{"packed_chunk_ids": packed})
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequest("POST", c.config.URL+"/api/v1/nodes/reconcile", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	c.setAuthHeaders(httpReq)
+
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reconcile: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("reconcile failed with status: %d%s", resp.StatusCode, errorDetail(resp))
+	}
+
+	var body struct {
+		PackedMissing string `json:"packed_missing"`
+		PackedExtra   string `json:"packed_extra"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	var result ReconcileResponse
+	if result.Missing, err = UnpackChunkIDs(body.PackedMissing); err != nil {
+		return nil, err
+	}
+	if result.Extra, err = UnpackChunkIDs(body.PackedExtra); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// RetryProofs asks the coordinator to re-issue the node's recently failed
+// challenges for the chunks it holds
+func (c *CoordinatorClient) RetryProofs(chunkIDs []string) ([]ProofRetry, error) {
+	packed, err := PackChunkIDs(chunkIDs)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(map[string]string{"packed_chunk_ids": packed})
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequest("POST", c.config.URL+"/api/v1/nodes/proofs/retry", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	c.setAuthHeaders(httpReq)
+
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request proof retries: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return nil, fmt.Errorf("%w%s", ErrProofRetryLimit, errorDetail(resp))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("proof retry request failed with status: %d%s", resp.StatusCode, errorDetail(resp))
+	}
+
+	var body struct {
+		Retries []ProofRetry `json:"retries"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return body.Retries, nil
+}
+
+// AnswerRetry sends the proof for a retried challenge
+func (c *CoordinatorClient) AnswerRetry(challengeID string, answer *RetryAnswer) error {
+	data, err := json.Marshal(answer)
+	if err != nil {
+		return err
+	}
+
+	httpReq, err := http.NewRequest("POST", c.config.URL+"/api/v1/nodes/proofs/retry/"+challengeID, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	c.setAuthHeaders(httpReq)
+
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("failed to answer proof retry: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnprocessableEntity {
+		return fmt.Errorf("%w%s", ErrProofRetryRejected, errorDetail(resp))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("proof retry answer failed with status: %d%s", resp.StatusCode, errorDetail(resp))
+	}
+	return nil
+}
+
+// PackChunkIDs encodes UUID chunk IDs as base64 of their concatenated 16-byte forms
+func PackChunkIDs(chunkIDs []string) (string, error) {
+	buf := make([]byte, 0, len(chunkIDs)*16)
+	for _, id := range chunkIDs {
+		raw, err := hex.DecodeString(strings.ReplaceAll(id, "-", ""))
+		if err != nil || len(raw) != 16 {
+			return "", fmt.Errorf("invalid chunk id %q", id)
+		}
+		buf = append(buf, raw...)
+	}
+	return base64.StdEncoding.EncodeToString(buf), nil
+}
+
+// UnpackChunkIDs decodes chunk IDs produced by PackChunkIDs back into UUID strings
+func UnpackChunkIDs(packed string) ([]string, error) {
+	buf, err := base64.StdEncoding.DecodeString(packed)
+	if err != nil || len(buf)%16 != 0 {
+		return nil, fmt.Errorf("invalid packed chunk ids")
+	}
+
+	ids := make([]string, 0, len(buf)/16)
+	for i := 0; i < len(buf); i += 16 {
+		h := hex.EncodeToString(buf[i : i+16])
+		ids = append(ids, h[0:8]+"-"+h[8:12]+"-"+h[12:16]+"-"+h[16:20]+"-"+h[20:32])
+	}
+	return ids, nil
+}
+
+// errorDetail extracts the coordinator's error message from a failed response, if any
+func errorDetail(resp *http.Response) string {
+	var body struct {
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || body.Error == "" {
+		return ""
+	}
+	return " (" + body.Error + ")"
+}
+
+// Clock supplies the time used to measure proof duration
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+// ErrDifficultyTooHigh is returned for challenges above the engine's difficulty cap
+var ErrDifficultyTooHigh = errors.New("proof difficulty too high")
+
 // ProofEngine handles proof-of-storage generation
 type ProofEngine struct {
-	chunkService *ChunkService
+	chunkService  *ChunkService
+	clock         Clock
+	maxDifficulty int         // 0 means no cap
+	cache         *ProofCache // nil disables caching
+	metrics       *Metrics    // nil records nothing
 }
 
-// NewProofEngine creates a new proof engine
+// NewProofEngine creates a new proof engine timed by the wall clock
 func NewProofEngine(chunkService *ChunkService) *ProofEngine {
-	return &ProofEngine{chunkService: chunkService}
+	return &ProofEngine{chunkService: chunkService, clock: realClock{}}
+}
+
+// SetClock replaces the clock used to time proofs, e.g. with a fake in tests
+func (e *ProofEngine) SetClock(clock Clock) {
+	e.clock = clock
+}
+
+// SetMaxDifficulty refuses challenges needing more than max hashing rounds, so
+// a node is not tied up by a challenge it cannot answer within the timeout
+func (e *ProofEngine) SetMaxDifficulty(max int) {
+	e.maxDifficulty = max
+}
+
+// SetCacheSize keeps up to n computed proofs so a re-issued challenge is
+// answered without hashing again; n <= 0 disables the cache
+func (e *ProofEngine) SetCacheSize(n int) {
+	if n <= 0 {
+		e.cache = nil
+		return
+	}
+	e.cache = NewProofCache(n)
+}
+
+// SetMetrics counts proofs and their durations in m, and reports proof cache
+// reuse to it
+func (e *ProofEngine) SetMetrics(m *Metrics) {
+	e.metrics = m
+	m.SetProofCacheStats(e.CacheStats)
+}
+
+// CacheStats reports proof cache reuse; all zero when caching is disabled
+func (e *ProofEngine) CacheStats() ProofCacheStats {
+	if e.cache == nil {
+		return ProofCacheStats{}
+	}
+	return e.cache.Stats()
 }
 
 // ProofResult represents a generated proof
 type ProofResult struct {
 	ProofHash  string
 	DurationMs int64
+	Cached     bool // answered from the proof cache
+}
+
+// ComputeProof performs difficulty rounds of sequential SHA-256 over the seed
+// and chunk hash. The result depends only on its inputs, never on timing.
+func ComputeProof(seed []byte, chunkHash string, difficulty int) string {
+	data := append(append([]byte{}, seed...), []byte(chunkHash)...)
+	for i := 0; i < difficulty; i++ {
+		hash := sha256.Sum256(data)
+		data = hash[:]
+	}
+	return hex.EncodeToString(data)
 }
 
-// GenerateProof generates a storage proof for a chunk
+// GenerateProof generates a storage proof for a chunk, reporting how long it took
 func (e *ProofEngine) GenerateProof(chunkID string, seed []byte, difficulty int) (*ProofResult, error) {
-	start := time.Now()
+	start := e.clock.Now()
+	result, err := e.generateProof(chunkID, seed, difficulty)
+	elapsed := e.clock.Now().Sub(start)
+	e.metrics.RecordProof(elapsed, err)
+	if err != nil {
+		return nil, err
+	}
+	result.DurationMs = elapsed.Milliseconds()
+	return result, nil
+}
+
+// generateProof computes or looks up a proof; GenerateProof times it
+func (e *ProofEngine) generateProof(chunkID string, seed []byte, difficulty int) (*ProofResult, error) {
+	if e.maxDifficulty > 0 && difficulty > e.maxDifficulty {
+		return nil, fmt.Errorf("%w: %d rounds requested, limit is %d", ErrDifficultyTooHigh, difficulty, e.maxDifficulty)
+	}
 
 	// Get chunk metadata
 	chunk, err := e.chunkService.GetChunk(chunkID)
@@ -143,23 +642,58 @@ func (e *ProofEngine) GenerateProof(chunkID string, seed []byte, difficulty int)
 		return nil, fmt.Errorf("chunk not found: %w", err)
 	}
 
-	// Generate proof using sequential hashing
+	if e.cache != nil {
+		if proofHash, ok := e.cache.Get(chunkID, seed, difficulty, chunk.Hash); ok {
+			return &ProofResult{ProofHash: proofHash, Cached: true}, nil
+		}
+	}
+
 	// In a real implementation, this would use the actual chunk data
-	data := append(seed, []byte(chunk.Hash)...)
+	proofHash := ComputeProof(seed, chunk.Hash, difficulty)
+	if e.cache != nil {
+		e.cache.Put(chunkID, seed, difficulty, chunk.Hash, proofHash)
+	}
 
-	// Perform sequential hashing based on difficulty
-	for i := 0; i < difficulty; i++ {
-		hash := sha256.Sum256(data)
-		data = hash[:]
+	return &ProofResult{ProofHash: proofHash}, nil
+}
+
+// MerkleProof returns a chunk's sub-block at leafIndex and the sibling hashes
+// linking it to the Merkle root the coordinator recorded at upload
+func (e *ProofEngine) MerkleProof(chunkID string, leafIndex int) ([]byte, [][]byte, error) {
+	data, err := e.chunkService.GetChunkData(chunkID)
+	if err != nil {
+		return nil, nil, err
 	}
+	return merkle.Prove(data, leafIndex)
+}
 
-	duration := time.Since(start)
-	proofHash := hex.EncodeToString(data)
+// AggregateProof combines proofs of several chunks into one: the hex SHA-256
+// of the seed followed by SHA-256(seed || chunk) for each chunk in order. The
+// coordinator checks file challenges against the same computation.
+func AggregateProof(seed []byte, chunks [][]byte) string {
+	combined := sha256.New()
+	combined.Write(seed)
+	for _, data := range chunks {
+		chunk := sha256.New()
+		chunk.Write(seed)
+		chunk.Write(data)
+		combined.Write(chunk.Sum(nil))
+	}
+	return hex.EncodeToString(combined.Sum(nil))
+}
 
-	return &ProofResult{
-		ProofHash:  proofHash,
-		DurationMs: duration.Milliseconds(),
-	}, nil
+// FileProof answers a file challenge with the AggregateProof of the stored
+// data of chunkIDs, in the order given. Every chunk must be held.
+func (e *ProofEngine) FileProof(seed []byte, chunkIDs []string) (string, error) {
+	chunks := make([][]byte, len(chunkIDs))
+	for i, id := range chunkIDs {
+		data, err := e.chunkService.GetChunkData(id)
+		if err != nil {
+			return "", fmt.Errorf("chunk %s: %w", id, err)
+		}
+		chunks[i] = data
+	}
+	return AggregateProof(seed, chunks), nil
 }
 
 // RecordProof records a proof response in the database
@@ -0,0 +1,101 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ChunkMigrator hands a chunk's data to the coordinator for re-replication;
+// it is implemented by CoordinatorClient
+type ChunkMigrator interface {
+	MigrateChunk(chunkID string, data []byte) (*MigrateChunkResponse, error)
+}
+
+// errMigrationUnconfirmed is returned when the coordinator accepted a chunk
+// without confirming any replica elsewhere
+var errMigrationUnconfirmed = errors.New("coordinator did not confirm re-replication")
+
+// MigrateAndDelete sends one locally stored chunk to the coordinator and
+// deletes the local copy only after the coordinator confirms that other nodes
+// hold it. On any error the local copy is kept.
+func MigrateAndDelete(chunks *ChunkService, migrator ChunkMigrator, chunkID string) (*MigrateChunkResponse, error) {
+	data, err := chunks.GetChunkData(chunkID)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := migrator.MigrateChunk(chunkID, data)
+	if err != nil {
+		return nil, err
+	}
+	if resp.ChunkID != chunkID || resp.Replicas < 1 {
+		return nil, fmt.Errorf("%w: chunk %s", errMigrationUnconfirmed, chunkID)
+	}
+
+	if err := chunks.PurgeChunk(chunkID); err != nil {
+		return nil, fmt.Errorf("chunk %s migrated but not deleted: %w", chunkID, err)
+	}
+	return resp, nil
+}
+
+// DecommissionProgress describes one chunk handled during a decommission
+type DecommissionProgress struct {
+	Done    int // chunks handled so far, including this one
+	Total   int
+	ChunkID string
+	Err     error // nil when the chunk was migrated and deleted
+}
+
+// DecommissionFailure records a chunk that is still held locally
+type DecommissionFailure struct {
+	ChunkID string
+	Err     error
+}
+
+// DecommissionReport summarizes a decommission pass
+type DecommissionReport struct {
+	Total    int
+	Migrated int
+	Unknown  []string // chunks the coordinator has no record of; kept locally
+	Failed   []DecommissionFailure
+	Canceled bool // ctx ended before every chunk was handled
+}
+
+// Complete reports whether every chunk the coordinator knows of was migrated
+func (r *DecommissionReport) Complete() bool {
+	return !r.Canceled && len(r.Failed) == 0
+}
+
+// Decommission migrates every active local chunk to the coordinator, deleting
+// each local copy once it is confirmed re-replicated. A failed chunk does not
+// stop the pass, and a later run picks up only what is left. progress, if
+// non-nil, is called after each chunk.
+func Decommission(ctx context.Context, chunks *ChunkService, migrator ChunkMigrator, progress func(DecommissionProgress)) (*DecommissionReport, error) {
+	stored, err := chunks.ListChunks()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list chunks: %w", err)
+	}
+
+	report := &DecommissionReport{Total: len(stored)}
+	for i, chunk := range stored {
+		if ctx.Err() != nil {
+			report.Canceled = true
+			break
+		}
+
+		_, err := MigrateAndDelete(chunks, migrator, chunk.ID)
+		switch {
+		case err == nil:
+			report.Migrated++
+		case errors.Is(err, ErrChunkUnknown):
+			report.Unknown = append(report.Unknown, chunk.ID)
+		default:
+			report.Failed = append(report.Failed, DecommissionFailure{ChunkID: chunk.ID, Err: err})
+		}
+		if progress != nil {
+			progress(DecommissionProgress{Done: i + 1, Total: len(stored), ChunkID: chunk.ID, Err: err})
+		}
+	}
+	return report, nil
+}
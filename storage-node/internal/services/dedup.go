@@ -0,0 +1,63 @@
+package services
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+
+	"github.com/federated-storage/storage-node/internal/logging"
+)
+
+// SetDedup makes a store of content another active chunk already holds
+// hard-link that chunk's file instead of writing a second copy
+func (s *ChunkService) SetDedup(enabled bool) {
+	s.dedup = enabled
+}
+
+// linkDuplicate hard-links path to the file of another active chunk holding
+// exactly data, reporting whether it did. Every chunk keeps its own path, so
+// the file system's link count is the content's reference count: purging or
+// rewriting one chunk's file leaves the others intact, and the content is
+// freed with its last link. Only a hash the node computed itself is trusted
+// as a key, and a candidate's content is compared before it is shared.
+func (s *ChunkService) linkDuplicate(path, chunkID, hash string, data []byte) bool {
+	if !s.dedup {
+		return false
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != hash {
+		return false
+	}
+
+	rows, err := s.db.Conn.Query(
+		"SELECT file_path FROM stored_chunks WHERE hash = ? AND size_bytes = ? AND status = 'active' AND id != ?",
+		hash, len(data), chunkID)
+	if err != nil {
+		logging.Warnf("Failed to look up duplicates of chunk %s: %v", chunkID, err)
+		return false
+	}
+	var candidates []string
+	for rows.Next() {
+		var candidate string
+		if err := rows.Scan(&candidate); err != nil {
+			break
+		}
+		candidates = append(candidates, candidate)
+	}
+	rows.Close()
+
+	for _, candidate := range candidates {
+		existing, err := os.ReadFile(candidate)
+		if err != nil || !bytes.Equal(existing, data) {
+			continue
+		}
+		os.Remove(path)
+		if err := os.Link(candidate, path); err != nil {
+			logging.Warnf("Failed to link chunk %s to %s, writing a copy: %v", chunkID, candidate, err)
+			return false
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,52 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrInsufficientSpace is returned when storing a chunk would breach the node's storage cap or free-space reserve
+var ErrInsufficientSpace = errors.New("insufficient storage space")
+
+// DiskUsage describes the size of the volume holding the chunk directory
+type DiskUsage struct {
+	TotalBytes uint64
+	FreeBytes  uint64
+}
+
+// StorageLimits bounds how much a node may store
+type StorageLimits struct {
+	MaxBytes           int64   // cap on bytes held in chunks; 0 disables
+	ReserveFreePercent float64 // share of the volume that must stay free; 0 disables
+}
+
+// ReserveBytes returns the number of bytes the reserve keeps free on a volume of the given size
+func ReserveBytes(totalBytes uint64, reservePercent float64) uint64 {
+	if reservePercent <= 0 {
+		return 0
+	}
+	if reservePercent >= 100 {
+		return totalBytes
+	}
+	return uint64(float64(totalBytes) * reservePercent / 100)
+}
+
+// CheckSpace reports whether incoming bytes fit under both the storage cap
+// (given usedBytes already stored) and the free-space reserve. A nil disk
+// skips the reserve check, e.g. when the volume cannot be inspected.
+func CheckSpace(limits StorageLimits, usedBytes, incoming int64, disk *DiskUsage) error {
+	if limits.MaxBytes > 0 && usedBytes+incoming > limits.MaxBytes {
+		return fmt.Errorf("%w: %d bytes would exceed the %d byte storage cap (%d used)",
+			ErrInsufficientSpace, incoming, limits.MaxBytes, usedBytes)
+	}
+
+	if disk == nil || limits.ReserveFreePercent <= 0 {
+		return nil
+	}
+	reserve := ReserveBytes(disk.TotalBytes, limits.ReserveFreePercent)
+	if disk.FreeBytes < reserve || disk.FreeBytes-reserve < uint64(incoming) {
+		return fmt.Errorf("%w: %d bytes would leave less than %.1f%% of the volume free (%d of %d bytes free)",
+			ErrInsufficientSpace, incoming, limits.ReserveFreePercent, disk.FreeBytes, disk.TotalBytes)
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package services
+
+import "errors"
+
+// statDisk is not supported on this platform; the free-space reserve is skipped
+func statDisk(path string) (*DiskUsage, error) {
+	return nil, errors.New("disk usage is not supported on this platform")
+}
@@ -0,0 +1,17 @@
+//go:build unix
+
+package services
+
+import "syscall"
+
+// statDisk returns the size and free space of the volume containing path
+func statDisk(path string) (*DiskUsage, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return nil, err
+	}
+	return &DiskUsage{
+		TotalBytes: st.Blocks * uint64(st.Bsize),
+		FreeBytes:  st.Bavail * uint64(st.Bsize),
+	}, nil
+}
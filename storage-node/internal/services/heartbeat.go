@@ -0,0 +1,39 @@
+package services
+
+import (
+	"math/rand"
+	"time"
+)
+
+// HeartbeatScheduler spreads heartbeats out so that nodes started together do
+// not hit the coordinator in lockstep
+type HeartbeatScheduler struct {
+	interval  time.Duration
+	maxJitter time.Duration
+	rnd       *rand.Rand
+}
+
+// NewHeartbeatScheduler creates a scheduler for heartbeats every interval,
+// each shifted by up to maxJitter either way
+func NewHeartbeatScheduler(interval, maxJitter time.Duration, seed int64) *HeartbeatScheduler {
+	if maxJitter < 0 {
+		maxJitter = 0
+	}
+	if maxJitter > interval/2 {
+		maxJitter = interval / 2
+	}
+	return &HeartbeatScheduler{interval: interval, maxJitter: maxJitter, rnd: rand.New(rand.NewSource(seed))}
+}
+
+// Initial returns the wait before the first heartbeat, uniform over one interval
+func (s *HeartbeatScheduler) Initial() time.Duration {
+	return time.Duration(s.rnd.Int63n(int64(s.interval)))
+}
+
+// Next returns the wait until the following heartbeat
+func (s *HeartbeatScheduler) Next() time.Duration {
+	if s.maxJitter == 0 {
+		return s.interval
+	}
+	return s.interval - s.maxJitter + time.Duration(s.rnd.Int63n(int64(2*s.maxJitter)+1))
+}
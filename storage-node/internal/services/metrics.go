@@ -0,0 +1,178 @@
+package services
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics holds the node's counters and gauges and serves them in the
+// Prometheus text exposition format. A nil *Metrics records nothing, so
+// services can be used without one.
+type Metrics struct {
+	chunksStored atomic.Int64
+	bytesUsed    atomic.Int64
+
+	proofs            atomic.Int64
+	proofsFailed      atomic.Int64
+	proofDurationNsec atomic.Int64 // sum over successful proofs
+
+	heartbeats       atomic.Int64
+	heartbeatsFailed atomic.Int64
+
+	mu         sync.Mutex
+	diskStat   func() (*DiskUsage, error) // read at scrape time; nil omits the disk gauges
+	proofCache func() ProofCacheStats     // read at scrape time; nil omits the proof cache metrics
+}
+
+// NewMetrics creates an empty metrics registry
+func NewMetrics() *Metrics {
+	return &Metrics{}
+}
+
+// SetStorage records how many chunks the node holds and their total size
+func (m *Metrics) SetStorage(chunks int, bytes int64) {
+	if m == nil {
+		return
+	}
+	m.chunksStored.Store(int64(chunks))
+	m.bytesUsed.Store(bytes)
+}
+
+// SetDiskStat sets how the chunk volume's size and free space are read on each scrape
+func (m *Metrics) SetDiskStat(stat func() (*DiskUsage, error)) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.diskStat = stat
+}
+
+// SetProofCacheStats sets how the proof cache's hits, misses and size are read on each scrape
+func (m *Metrics) SetProofCacheStats(stats func() ProofCacheStats) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.proofCache = stats
+}
+
+// RecordProof counts a proof challenge answered in d, or failed if err is set
+func (m *Metrics) RecordProof(d time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	if err != nil {
+		m.proofsFailed.Add(1)
+		return
+	}
+	m.proofs.Add(1)
+	m.proofDurationNsec.Add(d.Nanoseconds())
+}
+
+// RecordHeartbeat counts a heartbeat sent to the coordinator, or failed if err is set
+func (m *Metrics) RecordHeartbeat(err error) {
+	if m == nil {
+		return
+	}
+	if err != nil {
+		m.heartbeatsFailed.Add(1)
+		return
+	}
+	m.heartbeats.Add(1)
+}
+
+// WriteTo writes every metric in the Prometheus text format
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	mw := &metricWriter{w: w}
+
+	mw.metric("storage_node_chunks_stored", "gauge", "Chunks held by this node.", float64(m.chunksStored.Load()))
+	mw.metric("storage_node_bytes_used", "gauge", "Bytes held in chunks.", float64(m.bytesUsed.Load()))
+
+	m.mu.Lock()
+	stat, proofCache := m.diskStat, m.proofCache
+	m.mu.Unlock()
+	if stat != nil {
+		// An unreadable volume leaves the gauges out rather than reporting zero free space
+		if disk, err := stat(); err == nil {
+			mw.metric("storage_node_disk_total_bytes", "gauge", "Size of the volume holding the chunk directory.", float64(disk.TotalBytes))
+			mw.metric("storage_node_disk_free_bytes", "gauge", "Free space on the volume holding the chunk directory.", float64(disk.FreeBytes))
+		}
+	}
+
+	proofs := m.proofs.Load()
+	durationSec := float64(m.proofDurationNsec.Load()) / float64(time.Second)
+	mw.header("storage_node_proofs_total", "counter", "Proof challenges answered, by result.")
+	mw.sample("storage_node_proofs_total", `result="success"`, float64(proofs))
+	mw.sample("storage_node_proofs_total", `result="failure"`, float64(m.proofsFailed.Load()))
+	mw.header("storage_node_proof_duration_seconds", "summary", "Time taken to answer successful proof challenges.")
+	mw.sample("storage_node_proof_duration_seconds_sum", "", durationSec)
+	mw.sample("storage_node_proof_duration_seconds_count", "", float64(proofs))
+	avg := 0.0
+	if proofs > 0 {
+		avg = durationSec / float64(proofs)
+	}
+	mw.metric("storage_node_proof_duration_average_seconds", "gauge", "Mean time taken to answer a successful proof challenge.", avg)
+	if proofCache != nil {
+		cache := proofCache()
+		mw.header("storage_node_proof_cache_lookups_total", "counter", "Proof cache lookups for re-issued challenges, by result.")
+		mw.sample("storage_node_proof_cache_lookups_total", `result="hit"`, float64(cache.Hits))
+		mw.sample("storage_node_proof_cache_lookups_total", `result="miss"`, float64(cache.Misses))
+		mw.metric("storage_node_proof_cache_entries", "gauge", "Computed proofs held in the proof cache.", float64(cache.Entries))
+	}
+
+	mw.header("storage_node_heartbeats_total", "counter", "Heartbeats sent to the coordinator, by result.")
+	mw.sample("storage_node_heartbeats_total", `result="success"`, float64(m.heartbeats.Load()))
+	mw.sample("storage_node_heartbeats_total", `result="failure"`, float64(m.heartbeatsFailed.Load()))
+
+	return mw.n, mw.err
+}
+
+// ServeHTTP serves the metrics to a Prometheus scrape
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// metricWriter writes exposition lines, keeping the first error and the byte count
+type metricWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (mw *metricWriter) printf(format string, args ...interface{}) {
+	if mw.err != nil {
+		return
+	}
+	n, err := fmt.Fprintf(mw.w, format, args...)
+	mw.n += int64(n)
+	mw.err = err
+}
+
+func (mw *metricWriter) header(name, kind, help string) {
+	mw.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (mw *metricWriter) sample(name, labels string, value float64) {
+	if labels != "" {
+		name += "{" + labels + "}"
+	}
+	mw.printf("%s %g\n", name, value)
+}
+
+// metric writes a metric with a single sample
+func (mw *metricWriter) metric(name, kind, help string, value float64) {
+	mw.header(name, kind, help)
+	mw.sample(name, "", value)
+}
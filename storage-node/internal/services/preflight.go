@@ -0,0 +1,122 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/federated-storage/storage-node/internal/storage"
+)
+
+// requiredTables are the tables created by the node's migrations
+var requiredTables = []string{"config", "stored_chunks", "proof_history"}
+
+// CheckResult is the outcome of a single preflight check
+type CheckResult struct {
+	Name     string
+	Critical bool
+	Err      error
+}
+
+// Passed reports whether the check succeeded
+func (r CheckResult) Passed() bool {
+	return r.Err == nil
+}
+
+// RunPreflight verifies the node can store chunks, use its database and reach the coordinator
+func RunPreflight(chunkDir string, db *storage.DB, coordinator *CoordinatorClient) []CheckResult {
+	results := []CheckResult{
+		{Name: "chunk directory writable", Critical: true, Err: CheckChunkDirWritable(chunkDir)},
+		{Name: "database migrated", Critical: true, Err: CheckDatabase(db)},
+	}
+	if coordinator != nil {
+		results = append(results, CheckResult{Name: "coordinator reachable", Critical: false, Err: coordinator.CheckHealth()})
+	}
+	return results
+}
+
+// HasCriticalFailure reports whether any critical check failed
+func HasCriticalFailure(results []CheckResult) bool {
+	for _, r := range results {
+		if r.Critical && !r.Passed() {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckChunkDirWritable writes, reads back and deletes a temporary file in the chunk directory
+func CheckChunkDirWritable(chunkDir string) error {
+	if err := os.MkdirAll(chunkDir, 0755); err != nil {
+		return fmt.Errorf("failed to create chunk directory: %w", err)
+	}
+
+	f, err := os.CreateTemp(chunkDir, ".preflight-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	path := f.Name()
+	defer os.Remove(path)
+
+	payload := []byte("federated-storage preflight")
+	if _, err := f.Write(payload); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write temp file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close temp file: %w", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read temp file: %w", err)
+	}
+	if !bytes.Equal(data, payload) {
+		return fmt.Errorf("temp file contents do not match what was written")
+	}
+
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("failed to delete temp file %s: %w", filepath.Base(path), err)
+	}
+	return nil
+}
+
+// CheckDatabase pings the database and verifies the migrations have been applied
+func CheckDatabase(db *storage.DB) error {
+	if db == nil {
+		return fmt.Errorf("database not initialized")
+	}
+	if err := db.Conn.Ping(); err != nil {
+		return fmt.Errorf("failed to ping database: %w", err)
+	}
+
+	for _, table := range requiredTables {
+		var count int
+		err := db.Conn.QueryRow(
+			"SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?",
+			table).Scan(&count)
+		if err != nil {
+			return fmt.Errorf("failed to inspect schema: %w", err)
+		}
+		if count == 0 {
+			return fmt.Errorf("table %s is missing, run migrations", table)
+		}
+	}
+	return nil
+}
+
+// CheckHealth calls the coordinator's health endpoint
+func (c *CoordinatorClient) CheckHealth() error {
+	resp, err := c.httpClient.Get(c.config.URL + "/health")
+	if err != nil {
+		return fmt.Errorf("failed to reach coordinator: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("coordinator health check returned status: %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package services
+
+import (
+	"container/list"
+	"encoding/hex"
+	"strconv"
+	"sync"
+)
+
+// ProofCache is a thread-safe LRU of computed proofs keyed by chunk, seed and
+// difficulty, so a re-issued challenge is not hashed again. Entries remember
+// the chunk hash they were computed for, so a chunk that is rewritten never
+// gets a stale proof.
+type ProofCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	order      *list.List // front is most recently used
+	entries    map[string]*list.Element
+	hits       int64
+	misses     int64
+}
+
+type proofCacheEntry struct {
+	key       string
+	chunkHash string
+	proofHash string
+}
+
+// ProofCacheStats reports how often cached proofs were reused
+type ProofCacheStats struct {
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+	Entries int   `json:"entries"`
+}
+
+// NewProofCache creates a cache holding at most maxEntries proofs
+func NewProofCache(maxEntries int) *ProofCache {
+	return &ProofCache{
+		maxEntries: maxEntries,
+		order:      list.New(),
+		entries:    make(map[string]*list.Element),
+	}
+}
+
+func proofCacheKey(chunkID string, seed []byte, difficulty int) string {
+	return chunkID + "/" + hex.EncodeToString(seed) + "/" + strconv.Itoa(difficulty)
+}
+
+// Get returns the proof cached for a challenge if it was computed for the given chunk hash
+func (c *ProofCache) Get(chunkID string, seed []byte, difficulty int, chunkHash string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[proofCacheKey(chunkID, seed, difficulty)]
+	if !ok {
+		c.misses++
+		return "", false
+	}
+	entry := el.Value.(*proofCacheEntry)
+	if entry.chunkHash != chunkHash {
+		c.order.Remove(el)
+		delete(c.entries, entry.key)
+		c.misses++
+		return "", false
+	}
+	c.order.MoveToFront(el)
+	c.hits++
+	return entry.proofHash, true
+}
+
+// Put caches a proof, evicting the least recently used ones to stay under the cap
+func (c *ProofCache) Put(chunkID string, seed []byte, difficulty int, chunkHash, proofHash string) {
+	if c.maxEntries <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := proofCacheKey(chunkID, seed, difficulty)
+	if el, ok := c.entries[key]; ok {
+		c.order.Remove(el)
+		delete(c.entries, key)
+	}
+	for len(c.entries) >= c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*proofCacheEntry).key)
+	}
+	c.entries[key] = c.order.PushFront(&proofCacheEntry{key: key, chunkHash: chunkHash, proofHash: proofHash})
+}
+
+// Stats returns the cache's hit and miss counts since it was created
+func (c *ProofCache) Stats() ProofCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return ProofCacheStats{Hits: c.hits, Misses: c.misses, Entries: len(c.entries)}
+}
@@ -0,0 +1,125 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrProofRetryLimit is returned when the coordinator refuses retries because the node used up its allowance
+var ErrProofRetryLimit = errors.New("proof retry limit reached")
+
+// ErrProofRetryRejected is returned when the coordinator did not accept a retry's proof
+var ErrProofRetryRejected = errors.New("proof retry rejected")
+
+// ProofRetry is a challenge the node failed, re-issued by the coordinator
+type ProofRetry struct {
+	ChallengeID string `json:"challenge_id"`
+	RetryOf     string `json:"retry_of"`
+	ChunkID     string `json:"chunk_id"`
+	Seed        []byte `json:"seed"`
+	Difficulty  int    `json:"difficulty"`
+	TimeoutMs   int    `json:"timeout_ms"`
+	LeafIndex   int    `json:"leaf_index"` // Merkle sub-block to return; -1 for none
+}
+
+// RetryMerkleProof is a chunk sub-block and its path to the chunk's Merkle root
+type RetryMerkleProof struct {
+	LeafIndex int      `json:"leaf_index"`
+	Block     []byte   `json:"block"`
+	Path      [][]byte `json:"path"`
+}
+
+// RetryAnswer is the node's proof for a retried challenge
+type RetryAnswer struct {
+	ProofHash   string            `json:"proof_hash"`
+	DurationMs  int64             `json:"duration_ms"`
+	MerkleProof *RetryMerkleProof `json:"merkle_proof,omitempty"`
+}
+
+// ProofRetrier fetches and answers proof retries; it is implemented by CoordinatorClient
+type ProofRetrier interface {
+	RetryProofs(chunkIDs []string) ([]ProofRetry, error)
+	AnswerRetry(challengeID string, answer *RetryAnswer) error
+}
+
+// RetryProgress describes one retried challenge
+type RetryProgress struct {
+	Done    int // retries handled so far, including this one
+	Total   int
+	ChunkID string
+	Err     error // nil when the retry passed and the failure was excused
+}
+
+// RetryFailure records a retry that did not pass
+type RetryFailure struct {
+	ChunkID string
+	Err     error
+}
+
+// RetryReport summarizes a retry-proofs pass
+type RetryReport struct {
+	Issued   int // retries the coordinator handed out
+	Excused  int // failures reversed by a passing retry
+	Failed   []RetryFailure
+	Canceled bool // ctx ended before every retry was answered
+}
+
+// answerRetry computes the proof a retry asks for, with its sub-block if requested
+func answerRetry(engine *ProofEngine, retry ProofRetry) (*RetryAnswer, error) {
+	result, err := engine.GenerateProof(retry.ChunkID, retry.Seed, retry.Difficulty)
+	if err != nil {
+		return nil, err
+	}
+	answer := &RetryAnswer{ProofHash: result.ProofHash, DurationMs: result.DurationMs}
+	if retry.LeafIndex >= 0 {
+		block, path, err := engine.MerkleProof(retry.ChunkID, retry.LeafIndex)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build merkle proof: %w", err)
+		}
+		answer.MerkleProof = &RetryMerkleProof{LeafIndex: retry.LeafIndex, Block: block, Path: path}
+	}
+	return answer, nil
+}
+
+// RetryProofs asks the coordinator to re-issue recently failed challenges for
+// the chunks held locally and answers each one. Every retry that passes
+// reverses the penalty of the failure it replays; a retry that fails is not
+// offered again. progress, if non-nil, is called after each retry.
+func RetryProofs(ctx context.Context, chunks *ChunkService, engine *ProofEngine, retrier ProofRetrier, progress func(RetryProgress)) (*RetryReport, error) {
+	stored, err := chunks.ListChunks()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list chunks: %w", err)
+	}
+	held := make([]string, len(stored))
+	for i, chunk := range stored {
+		held[i] = chunk.ID
+	}
+
+	retries, err := retrier.RetryProofs(held)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &RetryReport{Issued: len(retries)}
+	for i, retry := range retries {
+		if ctx.Err() != nil {
+			report.Canceled = true
+			break
+		}
+
+		answer, err := answerRetry(engine, retry)
+		if err == nil {
+			err = retrier.AnswerRetry(retry.ChallengeID, answer)
+		}
+		if err != nil {
+			report.Failed = append(report.Failed, RetryFailure{ChunkID: retry.ChunkID, Err: err})
+		} else {
+			report.Excused++
+		}
+		if progress != nil {
+			progress(RetryProgress{Done: i + 1, Total: len(retries), ChunkID: retry.ChunkID, Err: err})
+		}
+	}
+	return report, nil
+}
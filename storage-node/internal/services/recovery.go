@@ -0,0 +1,165 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// QuarantineDir is where RecoverChunks moves chunk files with no database
+// row, under the chunk directory, so a lost or stale database never costs
+// data that an operator could still restore
+const QuarantineDir = "quarantine"
+
+// ErrChunkDBEmpty is returned by RecoverChunks when the database knows no
+// chunks but the chunk directory holds some, as after storage.db was lost
+// or reset
+var ErrChunkDBEmpty = errors.New("storage database has no chunks but the chunk directory does")
+
+// RecoveryReport summarizes what RecoverChunks repaired
+type RecoveryReport struct {
+	TempFilesRemoved   int      // half-written temp files from interrupted writes
+	OrphansQuarantined int      // chunk files with no database row, moved to QuarantineDir
+	MissingChunks      []string // rows whose file is gone or the wrong size, now marked corrupt
+}
+
+// RecoverChunks reconciles the chunk directory with the database after an
+// unclean shutdown. It deletes temp files, moves chunk files that never got
+// a database row to QuarantineDir, and marks active rows whose file is
+// absent or truncated as corrupt so they are no longer served or reported.
+// Only files laid out as StoreChunk writes them are touched. If the database
+// has no chunks but the directory does, it changes nothing and returns
+// ErrChunkDBEmpty.
+func (s *ChunkService) RecoverChunks() (*RecoveryReport, error) {
+	report := &RecoveryReport{}
+
+	known, err := s.knownChunkIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	var temps, orphans []string
+	err = filepath.WalkDir(s.chunkDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == s.chunkDir {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if d.IsDir() {
+			if path != s.chunkDir && !isChunkLayoutDir(s.chunkDir, path) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		name := d.Name()
+		chunkID, temp := strings.CutSuffix(name, tempSuffix)
+		if !d.Type().IsRegular() || !isChunkLayoutFile(s.chunkDir, path, chunkID) {
+			return nil
+		}
+		switch {
+		case temp:
+			temps = append(temps, path)
+		case !known[chunkID]:
+			orphans = append(orphans, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan chunk directory: %w", err)
+	}
+	if len(known) == 0 && len(orphans) > 0 {
+		return nil, fmt.Errorf("%w (%d chunk files); restore storage.db or move the files out of %s before starting", ErrChunkDBEmpty, len(orphans), s.chunkDir)
+	}
+
+	for _, path := range temps {
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove temp file %s: %w", path, err)
+		}
+		report.TempFilesRemoved++
+	}
+	if len(orphans) > 0 {
+		quarantine := filepath.Join(s.chunkDir, QuarantineDir)
+		if err := os.MkdirAll(quarantine, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create quarantine directory: %w", err)
+		}
+		for _, path := range orphans {
+			if err := os.Rename(path, filepath.Join(quarantine, filepath.Base(path))); err != nil {
+				return nil, fmt.Errorf("failed to quarantine orphaned chunk %s: %w", path, err)
+			}
+			report.OrphansQuarantined++
+		}
+	}
+
+	chunks, err := s.ListChunks()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list chunks: %w", err)
+	}
+	for _, chunk := range chunks {
+		info, err := os.Stat(chunk.FilePath)
+		if err == nil && info.Size() == int64(chunk.SizeBytes) {
+			continue
+		}
+		if _, err := s.db.Conn.Exec(
+			"UPDATE stored_chunks SET status = 'corrupt', updated_at = ? WHERE id = ?",
+			time.Now(), chunk.ID); err != nil {
+			return nil, fmt.Errorf("failed to mark chunk %s corrupt: %w", chunk.ID, err)
+		}
+		report.MissingChunks = append(report.MissingChunks, chunk.ID)
+	}
+
+	return report, nil
+}
+
+// isChunkLayoutDir reports whether dir is one of the two levels of prefix
+// directories StoreChunk creates under chunkDir
+func isChunkLayoutDir(chunkDir, dir string) bool {
+	rel, err := filepath.Rel(chunkDir, dir)
+	if err != nil {
+		return false
+	}
+	parts := strings.Split(rel, string(filepath.Separator))
+	if len(parts) > 2 {
+		return false
+	}
+	for _, part := range parts {
+		if len(part) != 2 || strings.Trim(part, "0123456789abcdef") != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// isChunkLayoutFile reports whether path is where StoreChunk keeps chunkID
+func isChunkLayoutFile(chunkDir, path, chunkID string) bool {
+	if _, err := uuid.Parse(chunkID); err != nil || len(chunkID) != 36 {
+		return false
+	}
+	return filepath.Dir(path) == filepath.Join(chunkDir, chunkID[:2], chunkID[2:4])
+}
+
+// knownChunkIDs returns the IDs of every chunk with a database row, whatever its status
+func (s *ChunkService) knownChunkIDs() (map[string]bool, error) {
+	rows, err := s.db.Conn.Query("SELECT id FROM stored_chunks")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list chunk IDs: %w", err)
+	}
+	defer rows.Close()
+
+	known := make(map[string]bool)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		known[id] = true
+	}
+	return known, rows.Err()
+}
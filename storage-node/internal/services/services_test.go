@@ -1,12 +1,28 @@
 package services
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/federated-storage/storage-node/internal/config"
+	"github.com/federated-storage/storage-node/internal/merkle"
 	"github.com/federated-storage/storage-node/internal/models"
+	"github.com/federated-storage/storage-node/internal/storage"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -349,3 +365,1044 @@ func TestCoordinatorClient_HeartbeatRequest(t *testing.T) {
 		})
 	}
 }
+
+func TestCoordinatorClient_HeartbeatReportsVersion(t *testing.T) {
+	var received HeartbeatRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&received)
+		w.WriteHeader(http.StatusUpgradeRequired)
+		json.NewEncoder(w).Encode(map[string]string{"error": "node version 0.1.0 is below the minimum 0.2.0, please upgrade"})
+	}))
+	defer server.Close()
+
+	client := NewCoordinatorClient(&config.CoordinatorConfig{URL: server.URL, PeerID: "peer", APIKey: "key"})
+	_, err := client.SendHeartbeat(1024)
+
+	assert.Equal(t, NodeVersion, received.Version, "Heartbeat should carry the node version")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "please upgrade", "Coordinator's upgrade message should be surfaced")
+}
+
+func TestCoordinatorClient_RegisterSendsInviteToken(t *testing.T) {
+	var token string
+	var body map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token = r.Header.Get("X-Invite-Token")
+		json.NewDecoder(r.Body).Decode(&body)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(RegisterNodeResponse{NodeID: "node", APIKey: "key"})
+	}))
+	defer server.Close()
+
+	client := NewCoordinatorClient(&config.CoordinatorConfig{URL: server.URL})
+	_, err := client.RegisterNode(RegisterNodeRequest{Name: "n", PeerID: "peer", InviteToken: "fsi_abc"})
+	assert.NoError(t, err)
+	assert.Equal(t, "fsi_abc", token)
+	assert.NotContains(t, body, "invite_token", "The token travels only in the header")
+}
+
+func TestPreflight_CheckChunkDirWritable(t *testing.T) {
+	dir := t.TempDir()
+
+	chunkDir := filepath.Join(dir, "chunks")
+	assert.NoError(t, CheckChunkDirWritable(chunkDir), "Fresh chunk directory should be writable")
+
+	entries, err := os.ReadDir(chunkDir)
+	assert.NoError(t, err)
+	assert.Empty(t, entries, "Temp file should be cleaned up")
+
+	// A regular file where the directory should be cannot be used as a chunk directory
+	blocker := filepath.Join(dir, "not-a-dir")
+	assert.NoError(t, os.WriteFile(blocker, []byte("x"), 0644))
+	assert.Error(t, CheckChunkDirWritable(blocker))
+}
+
+func TestPreflight_CheckDatabase(t *testing.T) {
+	db, err := storage.New(filepath.Join(t.TempDir(), "storage.db"))
+	assert.NoError(t, err)
+	defer db.Close()
+
+	err = CheckDatabase(db)
+	assert.Error(t, err, "Unmigrated database should fail the check")
+	assert.Contains(t, err.Error(), "run migrations")
+
+	assert.NoError(t, db.Migrate("../../migrations"))
+	assert.NoError(t, CheckDatabase(db), "Migrated database should pass the check")
+
+	results := RunPreflight(t.TempDir(), db, nil)
+	assert.False(t, HasCriticalFailure(results))
+
+	assert.Error(t, CheckDatabase(nil))
+}
+
+func TestCoordinatorClient_ReconcileUsesPackedIDs(t *testing.T) {
+	held := []string{"0b1f6c1e-4d8a-4f6e-9a51-3c2d1e0f9a8b", "7d4e2a10-9b3c-4c55-8e21-aa0b11c2d3e4"}
+	missing := []string{"f0e1d2c3-b4a5-4968-8776-655443322110"}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v1/nodes/reconcile", r.URL.Path)
+
+		var req map[string]string
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		got, err := UnpackChunkIDs(req["packed_chunk_ids"])
+		assert.NoError(t, err)
+		assert.Equal(t, held, got)
+
+		packedMissing, _ := PackChunkIDs(missing)
+		packedExtra, _ := PackChunkIDs(held[1:])
+		json.NewEncoder(w).Encode(map[string]string{"packed_missing": packedMissing, "packed_extra": packedExtra})
+	}))
+	defer server.Close()
+
+	client := NewCoordinatorClient(&config.CoordinatorConfig{URL: server.URL})
+	resp, err := client.Reconcile(held)
+	assert.NoError(t, err)
+	assert.Equal(t, missing, resp.Missing)
+	assert.Equal(t, held[1:], resp.Extra)
+
+	_, err = PackChunkIDs([]string{"not-a-uuid"})
+	assert.Error(t, err)
+}
+
+func TestReserveBytes(t *testing.T) {
+	const gb = uint64(1024 * 1024 * 1024)
+	tests := []struct {
+		name     string
+		total    uint64
+		percent  float64
+		expected uint64
+	}{
+		{name: "disabled", total: 100 * gb, percent: 0, expected: 0},
+		{name: "negative disables", total: 100 * gb, percent: -5, expected: 0},
+		{name: "10% of 100GB", total: 100 * gb, percent: 10, expected: 10 * gb},
+		{name: "10% of 4TB", total: 4000 * gb, percent: 10, expected: 400 * gb},
+		{name: "fractional percent", total: 1000 * gb, percent: 2.5, expected: 25 * gb},
+		{name: "tiny volume", total: 1000, percent: 10, expected: 100},
+		{name: "over 100 clamps", total: 50 * gb, percent: 150, expected: 50 * gb},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, ReserveBytes(tt.total, tt.percent))
+		})
+	}
+}
+
+func TestCheckSpace(t *testing.T) {
+	const gb = int64(1024 * 1024 * 1024)
+	disk := func(totalGB, freeGB int64) *DiskUsage {
+		return &DiskUsage{TotalBytes: uint64(totalGB * gb), FreeBytes: uint64(freeGB * gb)}
+	}
+	tests := []struct {
+		name     string
+		limits   StorageLimits
+		used     int64
+		incoming int64
+		disk     *DiskUsage
+		wantErr  bool
+	}{
+		{name: "plenty of room", limits: StorageLimits{MaxBytes: 100 * gb, ReserveFreePercent: 10}, used: 0, incoming: gb, disk: disk(500, 400)},
+		{name: "reserve breached", limits: StorageLimits{ReserveFreePercent: 10}, incoming: 2 * gb, disk: disk(100, 11), wantErr: true},
+		{name: "exactly at reserve", limits: StorageLimits{ReserveFreePercent: 10}, incoming: gb, disk: disk(100, 11)},
+		{name: "already below reserve", limits: StorageLimits{ReserveFreePercent: 10}, incoming: 1, disk: disk(100, 5), wantErr: true},
+		{name: "cap stricter than reserve", limits: StorageLimits{MaxBytes: 10 * gb, ReserveFreePercent: 10}, used: 10 * gb, incoming: 1, disk: disk(1000, 900), wantErr: true},
+		{name: "reserve stricter than cap", limits: StorageLimits{MaxBytes: 100 * gb, ReserveFreePercent: 20}, used: gb, incoming: gb, disk: disk(50, 10), wantErr: true},
+		{name: "unknown disk only checks cap", limits: StorageLimits{MaxBytes: 10 * gb, ReserveFreePercent: 10}, used: gb, incoming: gb, disk: nil},
+		{name: "reserve disabled", limits: StorageLimits{}, incoming: gb, disk: disk(100, 2)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckSpace(tt.limits, tt.used, tt.incoming, tt.disk)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInsufficientSpace)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestCoordinatorClient_UpdateCapacity(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPut, r.Method)
+		assert.Equal(t, "/api/v1/nodes/capacity", r.URL.Path)
+
+		var req map[string]int
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		if req["total_storage_gb"] < 50 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "capacity is below used storage"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]int64{"total_storage_bytes": int64(req["total_storage_gb"]) << 30})
+	}))
+	defer server.Close()
+
+	client := NewCoordinatorClient(&config.CoordinatorConfig{URL: server.URL})
+
+	totalBytes, err := client.UpdateCapacity(200)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(200)<<30, totalBytes)
+
+	_, err = client.UpdateCapacity(10)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "below used storage")
+}
+
+// stepClock advances by a fixed step every time it is read
+type stepClock struct {
+	now  time.Time
+	step time.Duration
+}
+
+func (c *stepClock) Now() time.Time {
+	now := c.now
+	c.now = c.now.Add(c.step)
+	return now
+}
+
+func newProofEngineWithChunk(t *testing.T, hash string) (*ProofEngine, string) {
+	t.Helper()
+	db, err := storage.New(filepath.Join(t.TempDir(), "storage.db"))
+	assert.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	assert.NoError(t, db.Migrate("../../migrations"))
+
+	chunkService := NewChunkService(db, t.TempDir(), StorageLimits{})
+	chunkID := "0b1f6c1e-4d8a-4f6e-9a51-3c2d1e0f9a8b"
+	assert.NoError(t, chunkService.StoreChunk(chunkID, "file-1", 0, hash, []byte("chunk data")))
+	return NewProofEngine(chunkService), chunkID
+}
+
+func TestProofEngine_ProofIndependentOfTiming(t *testing.T) {
+	engine, chunkID := newProofEngineWithChunk(t, "aabbccdd")
+	seed := []byte("test-seed")
+	expected := ComputeProof(seed, "aabbccdd", 100)
+
+	tests := []struct {
+		name       string
+		step       time.Duration
+		durationMs int64
+	}{
+		{name: "instant", step: 0, durationMs: 0},
+		{name: "fast", step: 250 * time.Millisecond, durationMs: 250},
+		{name: "slow", step: 5 * time.Second, durationMs: 5000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine.SetClock(&stepClock{now: time.Unix(1700000000, 0), step: tt.step})
+
+			result, err := engine.GenerateProof(chunkID, seed, 100)
+			assert.NoError(t, err)
+			assert.Equal(t, expected, result.ProofHash, "Proof hash must not depend on timing")
+			assert.Equal(t, tt.durationMs, result.DurationMs)
+		})
+	}
+
+	assert.Equal(t, "test-seed", string(seed), "Seed must not be modified")
+	assert.NotEqual(t, expected, ComputeProof(seed, "aabbccdd", 101), "Difficulty changes the proof")
+}
+
+func TestProofEngine_FileProof(t *testing.T) {
+	engine, chunkID := newProofEngineWithChunk(t, "aabbccdd")
+	seed := []byte("file-seed")
+
+	proof, err := engine.FileProof(seed, []string{chunkID, chunkID})
+	assert.NoError(t, err)
+	assert.Equal(t, AggregateProof(seed, [][]byte{[]byte("chunk data"), []byte("chunk data")}), proof)
+	assert.NotEqual(t, proof, AggregateProof(seed, [][]byte{[]byte("chunk data")}), "Every sampled chunk counts")
+
+	_, err = engine.FileProof(seed, []string{chunkID, "5c2e7f0a-1b3d-4e6f-8a9b-0c1d2e3f4a5b"})
+	assert.Error(t, err, "A node missing a sampled chunk can't answer")
+}
+
+func TestProofEngine_MaxDifficulty(t *testing.T) {
+	engine, chunkID := newProofEngineWithChunk(t, "aabbccdd")
+	engine.SetClock(&stepClock{now: time.Unix(1700000000, 0)})
+	engine.SetMaxDifficulty(1000)
+
+	_, err := engine.GenerateProof(chunkID, []byte("seed"), 1000)
+	assert.NoError(t, err)
+
+	_, err = engine.GenerateProof(chunkID, []byte("seed"), 1001)
+	assert.ErrorIs(t, err, ErrDifficultyTooHigh)
+}
+
+func TestProofEngine_CachesRepeatedChallenges(t *testing.T) {
+	engine, chunkID := newProofEngineWithChunk(t, "aabbccdd")
+	engine.SetCacheSize(2)
+	seed := []byte("seed")
+
+	first, err := engine.GenerateProof(chunkID, seed, 200000)
+	assert.NoError(t, err)
+	assert.False(t, first.Cached)
+
+	start := time.Now()
+	second, err := engine.GenerateProof(chunkID, seed, 200000)
+	elapsed := time.Since(start)
+	assert.NoError(t, err)
+	assert.True(t, second.Cached, "Re-issued challenge should be served from the cache")
+	assert.Equal(t, first.ProofHash, second.ProofHash)
+	assert.Less(t, elapsed, 50*time.Millisecond, "Cache hit should not redo the hashing rounds")
+
+	// Any change to the challenge is a different proof
+	for _, tt := range []struct {
+		seed       []byte
+		difficulty int
+	}{
+		{seed: []byte("other-seed"), difficulty: 200000},
+		{seed: seed, difficulty: 200001},
+	} {
+		result, err := engine.GenerateProof(chunkID, tt.seed, tt.difficulty)
+		assert.NoError(t, err)
+		assert.False(t, result.Cached)
+		assert.Equal(t, ComputeProof(tt.seed, "aabbccdd", tt.difficulty), result.ProofHash)
+	}
+
+	stats := engine.CacheStats()
+	assert.Equal(t, int64(1), stats.Hits)
+	assert.Equal(t, int64(3), stats.Misses)
+	assert.Equal(t, 2, stats.Entries, "Cache stays within its size bound")
+}
+
+func TestProofCache_ChunkChangeInvalidates(t *testing.T) {
+	cache := NewProofCache(10)
+	cache.Put("chunk-1", []byte("seed"), 10, "hash-a", "proof-a")
+
+	proof, ok := cache.Get("chunk-1", []byte("seed"), 10, "hash-a")
+	assert.True(t, ok)
+	assert.Equal(t, "proof-a", proof)
+
+	_, ok = cache.Get("chunk-1", []byte("seed"), 10, "hash-b")
+	assert.False(t, ok, "Proof computed for the old chunk contents must not be reused")
+	_, ok = cache.Get("chunk-1", []byte("seed"), 10, "hash-a")
+	assert.False(t, ok, "Stale entry should have been dropped")
+	assert.Equal(t, 0, cache.Stats().Entries)
+}
+
+func TestProofEngine_MerkleProof(t *testing.T) {
+	db, err := storage.New(filepath.Join(t.TempDir(), "storage.db"))
+	assert.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	assert.NoError(t, db.Migrate("../../migrations"))
+
+	data := make([]byte, 3*merkle.BlockSize+17)
+	for i := range data {
+		data[i] = byte(i / 5)
+	}
+	chunkService := NewChunkService(db, t.TempDir(), StorageLimits{})
+	chunkID := "6a0c5d1e-2b7f-4c3a-8e91-0d4f2a6b7c8e"
+	assert.NoError(t, chunkService.StoreChunk(chunkID, "file-1", 0, "aabbccdd", data))
+	engine := NewProofEngine(chunkService)
+	root := merkle.Root(data)
+
+	for leaf := 0; leaf < merkle.LeafCount(len(data)); leaf++ {
+		block, path, err := engine.MerkleProof(chunkID, leaf)
+		assert.NoError(t, err)
+		assert.True(t, merkle.Verify(root, merkle.LeafCount(len(data)), leaf, block, path), "sub-block %d", leaf)
+	}
+
+	block, path, err := engine.MerkleProof(chunkID, 1)
+	assert.NoError(t, err)
+	tampered := append([]byte{block[0] ^ 0xff}, block[1:]...)
+	assert.False(t, merkle.Verify(root, merkle.LeafCount(len(data)), 1, tampered, path))
+
+	_, _, err = engine.MerkleProof(chunkID, merkle.LeafCount(len(data)))
+	assert.Error(t, err, "Sub-block beyond the end of the chunk")
+}
+
+func TestHeartbeatScheduler_SpreadsNodes(t *testing.T) {
+	const nodes = 1000
+	interval := 30 * time.Second
+
+	// Bucket first heartbeats of nodes all started at the same instant into 1s slots
+	buckets := make([]int, 30)
+	for i := 0; i < nodes; i++ {
+		schedule := NewHeartbeatScheduler(interval, 5*time.Second, int64(i))
+		first := schedule.Initial()
+		assert.GreaterOrEqual(t, first, time.Duration(0))
+		assert.Less(t, first, interval)
+		buckets[int(first/time.Second)]++
+	}
+
+	mean := nodes / len(buckets)
+	for slot, count := range buckets {
+		assert.Greater(t, count, 0, "slot %d should not be empty", slot)
+		assert.Less(t, count, 3*mean, "slot %d should not hold a burst (%d heartbeats)", slot, count)
+	}
+}
+
+func TestHeartbeatScheduler_NextStaysWithinJitter(t *testing.T) {
+	interval := 30 * time.Second
+	schedule := NewHeartbeatScheduler(interval, 5*time.Second, 42)
+
+	distinct := make(map[time.Duration]bool)
+	for i := 0; i < 200; i++ {
+		next := schedule.Next()
+		assert.GreaterOrEqual(t, next, 25*time.Second)
+		assert.LessOrEqual(t, next, 35*time.Second)
+		distinct[next] = true
+	}
+	assert.Greater(t, len(distinct), 100, "Intervals should vary rather than stay aligned")
+
+	assert.Equal(t, interval, NewHeartbeatScheduler(interval, -1, 1).Next(), "Negative jitter disables it")
+	capped := NewHeartbeatScheduler(interval, time.Minute, 1)
+	for i := 0; i < 50; i++ {
+		assert.Greater(t, capped.Next(), time.Duration(0), "Jitter is capped at half the interval")
+	}
+}
+
+func TestCoordinatorClient_RotateAPIKey(t *testing.T) {
+	current := "fsn_old"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-API-Key") != current {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid credentials"})
+			return
+		}
+		assert.Equal(t, "/api/v1/nodes/rotate-key", r.URL.Path)
+		current = "fsn_new"
+		json.NewEncoder(w).Encode(map[string]string{"api_key": current})
+	}))
+	defer server.Close()
+
+	cfg := &config.CoordinatorConfig{URL: server.URL, PeerID: "peer-1", APIKey: "fsn_old"}
+	apiKey, err := NewCoordinatorClient(cfg).RotateAPIKey()
+	assert.NoError(t, err)
+	assert.Equal(t, "fsn_new", apiKey)
+
+	_, err = NewCoordinatorClient(cfg).RotateAPIKey()
+	assert.Error(t, err, "Old key should be rejected after rotation")
+	assert.Contains(t, err.Error(), "401")
+
+	cfg.APIKey = apiKey
+	_, err = NewCoordinatorClient(cfg).RotateAPIKey()
+	assert.NoError(t, err, "New key should authenticate")
+}
+
+func TestSignRequest_KnownVector(t *testing.T) {
+	// Must match the coordinator's middleware.SignNodeRequest
+	assert.Equal(t, "5b1a1d63a8d1ff2413f61d15268cc6a95f73e99deb54f5fd76314e7c0301252d",
+		signRequest("fsn_test-key", "GET", "/api/v1/nodes/balance", "1700000000"))
+}
+
+func TestCoordinatorClient_SignsRequests(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timestamp := r.Header.Get("X-Timestamp")
+		assert.NotEmpty(t, timestamp)
+		assert.Equal(t, signRequest("fsn_key", r.Method, r.URL.RequestURI(), timestamp), r.Header.Get("X-Signature"))
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok"})
+	}))
+	defer server.Close()
+
+	client := NewCoordinatorClient(&config.CoordinatorConfig{URL: server.URL, PeerID: "peer-1", APIKey: "fsn_key"})
+	_, err := client.SendHeartbeat(0)
+	assert.NoError(t, err)
+}
+
+func newChunkServiceWithDB(t *testing.T) (*ChunkService, *storage.DB, string) {
+	t.Helper()
+	db, err := storage.New(filepath.Join(t.TempDir(), "storage.db"))
+	assert.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	assert.NoError(t, db.Migrate("../../migrations"))
+
+	chunkDir := t.TempDir()
+	return NewChunkService(db, chunkDir, StorageLimits{}), db, chunkDir
+}
+
+// chunkFiles lists every file under dir, relative to it
+func chunkFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	var files []string
+	assert.NoError(t, filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			rel, _ := filepath.Rel(dir, path)
+			files = append(files, rel)
+		}
+		return err
+	}))
+	return files
+}
+
+func TestChunkService_StoreChunkCrashRecovery(t *testing.T) {
+	const chunkID = "5f2a9c3e-7b1d-4e8f-a6c0-9d3b2e1f4a7c"
+	data := []byte("durable chunk data")
+	crash := errors.New("simulated crash")
+
+	tests := []struct {
+		name      string
+		crashAt   string
+		tempFiles int
+		orphans   int
+	}{
+		{name: "crash after temp file written", crashAt: stepTempWritten, tempFiles: 1},
+		{name: "crash after rename, before DB insert", crashAt: stepRenamed, orphans: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunkService, _, chunkDir := newChunkServiceWithDB(t)
+			// An earlier chunk, so the database isn't mistaken for a lost one
+			const earlier = "0e1f2a3b-4c5d-4e6f-8a9b-0c1d2e3f4a5b"
+			assert.NoError(t, chunkService.StoreChunk(earlier, "file-1", 1, "hash", data))
+			chunkService.failpoint = func(step string) error {
+				if step == tt.crashAt {
+					return crash
+				}
+				return nil
+			}
+
+			err := chunkService.StoreChunk(chunkID, "file-1", 0, "hash", data)
+			assert.ErrorIs(t, err, crash)
+			assert.Len(t, chunkFiles(t, chunkDir), 2, "The crash should leave one file behind")
+			_, err = chunkService.GetChunk(chunkID)
+			assert.Error(t, err, "No DB row should exist")
+
+			// Restart
+			chunkService.failpoint = nil
+			report, err := chunkService.RecoverChunks()
+			assert.NoError(t, err)
+			assert.Equal(t, tt.tempFiles, report.TempFilesRemoved)
+			assert.Equal(t, tt.orphans, report.OrphansQuarantined)
+			assert.Empty(t, report.MissingChunks)
+			expected := []string{filepath.Join(earlier[:2], earlier[2:4], earlier)}
+			if tt.orphans > 0 {
+				expected = append(expected, filepath.Join(QuarantineDir, chunkID))
+			}
+			assert.ElementsMatch(t, expected, chunkFiles(t, chunkDir))
+
+			// The coordinator retries and the write now completes
+			assert.NoError(t, chunkService.StoreChunk(chunkID, "file-1", 0, "hash", data))
+			stored, err := chunkService.GetChunkData(chunkID)
+			assert.NoError(t, err)
+			assert.Equal(t, data, stored)
+		})
+	}
+}
+
+func TestChunkService_StoreChunkRemovesFileOnInsertFailure(t *testing.T) {
+	chunkService, db, chunkDir := newChunkServiceWithDB(t)
+	_, err := db.Conn.Exec("DROP TABLE stored_chunks")
+	assert.NoError(t, err)
+
+	err = chunkService.StoreChunk("5f2a9c3e-7b1d-4e8f-a6c0-9d3b2e1f4a7c", "file-1", 0, "hash", []byte("data"))
+	assert.Error(t, err)
+	assert.Empty(t, chunkFiles(t, chunkDir), "Neither temp nor final file should remain")
+}
+
+func TestChunkService_DedupSharesIdenticalContent(t *testing.T) {
+	const first, second = "5f2a9c3e-7b1d-4e8f-a6c0-9d3b2e1f4a7c", "8c1d2e3f-4a5b-4c6d-9e7f-0a1b2c3d4e5f"
+	data := []byte("identical chunk content")
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	sameFile := func(t *testing.T, chunkService *ChunkService) bool {
+		a, err := chunkService.GetChunk(first)
+		assert.NoError(t, err)
+		b, err := chunkService.GetChunk(second)
+		assert.NoError(t, err)
+		infoA, err := os.Stat(a.FilePath)
+		assert.NoError(t, err)
+		infoB, err := os.Stat(b.FilePath)
+		assert.NoError(t, err)
+		return os.SameFile(infoA, infoB)
+	}
+
+	t.Run("identical content shares one file", func(t *testing.T) {
+		chunkService, _, chunkDir := newChunkServiceWithDB(t)
+		chunkService.SetDedup(true)
+		assert.NoError(t, chunkService.StoreChunk(first, "file-1", 0, hash, data))
+		assert.NoError(t, chunkService.StoreChunk(second, "file-2", 3, hash, data))
+		assert.True(t, sameFile(t, chunkService), "The second chunk should link the first one's file")
+		assert.Len(t, chunkFiles(t, chunkDir), 2, "Each chunk keeps its own path")
+
+		// Purging one reference leaves the other intact
+		assert.NoError(t, chunkService.PurgeChunk(first))
+		stored, err := chunkService.GetChunkData(second)
+		assert.NoError(t, err)
+		assert.Equal(t, data, stored)
+
+		report, err := chunkService.RecoverChunks()
+		assert.NoError(t, err)
+		assert.Empty(t, report.MissingChunks)
+		assert.Zero(t, report.OrphansQuarantined)
+	})
+
+	t.Run("disabled writes a copy", func(t *testing.T) {
+		chunkService, _, _ := newChunkServiceWithDB(t)
+		assert.NoError(t, chunkService.StoreChunk(first, "file-1", 0, hash, data))
+		assert.NoError(t, chunkService.StoreChunk(second, "file-2", 0, hash, data))
+		assert.False(t, sameFile(t, chunkService))
+	})
+
+	t.Run("an unverified hash is not a key", func(t *testing.T) {
+		chunkService, _, _ := newChunkServiceWithDB(t)
+		chunkService.SetDedup(true)
+		assert.NoError(t, chunkService.StoreChunk(first, "file-1", 0, "hash", data))
+		assert.NoError(t, chunkService.StoreChunk(second, "file-2", 0, "hash", data))
+		assert.False(t, sameFile(t, chunkService))
+	})
+
+	t.Run("different content under the same claimed hash", func(t *testing.T) {
+		chunkService, _, _ := newChunkServiceWithDB(t)
+		chunkService.SetDedup(true)
+		assert.NoError(t, chunkService.StoreChunk(first, "file-1", 0, hash, data))
+		// Corrupt the first copy in place; its content no longer matches
+		chunk, err := chunkService.GetChunk(first)
+		assert.NoError(t, err)
+		assert.NoError(t, os.WriteFile(chunk.FilePath, []byte("IDENTICAL CHUNK CONTENT"), 0644))
+		assert.NoError(t, chunkService.StoreChunk(second, "file-2", 0, hash, data))
+		assert.False(t, sameFile(t, chunkService))
+		stored, err := chunkService.GetChunkData(second)
+		assert.NoError(t, err)
+		assert.Equal(t, data, stored)
+	})
+}
+
+func TestChunkService_RecoverMarksTruncatedChunksCorrupt(t *testing.T) {
+	chunkService, _, _ := newChunkServiceWithDB(t)
+	const intact = "1a2b3c4d-0000-4000-8000-000000000001"
+	const truncated = "1a2b3c4d-0000-4000-8000-000000000002"
+	const missing = "1a2b3c4d-0000-4000-8000-000000000003"
+	for _, id := range []string{intact, truncated, missing} {
+		assert.NoError(t, chunkService.StoreChunk(id, "file-1", 0, "hash", []byte("full chunk contents")))
+	}
+
+	// Damage left by writes from before they were made durable
+	chunk, err := chunkService.GetChunk(truncated)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(chunk.FilePath, []byte("full"), 0644))
+	chunk, err = chunkService.GetChunk(missing)
+	assert.NoError(t, err)
+	assert.NoError(t, os.Remove(chunk.FilePath))
+
+	report, err := chunkService.RecoverChunks()
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{truncated, missing}, report.MissingChunks)
+	assert.Zero(t, report.OrphansQuarantined, "The truncated chunk's file has a row and is not an orphan")
+
+	chunks, err := chunkService.ListChunks()
+	assert.NoError(t, err)
+	assert.Len(t, chunks, 1)
+	assert.Equal(t, intact, chunks[0].ID)
+}
+
+func TestChunkService_RecoverLeavesUnknownFilesAndLostDatabases(t *testing.T) {
+	chunkService, db, chunkDir := newChunkServiceWithDB(t)
+	const kept, orphan = "1a2b3c4d-0000-4000-8000-000000000001", "1a2b3c4d-0000-4000-8000-000000000002"
+	for _, id := range []string{kept, orphan} {
+		assert.NoError(t, chunkService.StoreChunk(id, "file-1", 0, "hash", []byte("chunk contents")))
+	}
+	// Files the node didn't write in its chunk layout
+	assert.NoError(t, os.WriteFile(filepath.Join(chunkDir, "README"), []byte("operator notes"), 0644))
+	assert.NoError(t, os.MkdirAll(filepath.Join(chunkDir, "backup"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(chunkDir, "backup", kept), []byte("chunk contents"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(chunkDir, "1a", "2b", "notes.txt"), []byte("x"), 0644))
+	before := chunkFiles(t, chunkDir)
+
+	// A lost database: nothing is moved or deleted, and recovery refuses to go on
+	_, err := db.Conn.Exec("DELETE FROM stored_chunks")
+	assert.NoError(t, err)
+	_, err = chunkService.RecoverChunks()
+	assert.ErrorIs(t, err, ErrChunkDBEmpty)
+	assert.ElementsMatch(t, before, chunkFiles(t, chunkDir))
+
+	// An orphan next to known chunks is quarantined, not deleted
+	assert.NoError(t, chunkService.StoreChunk(kept, "file-1", 0, "hash", []byte("chunk contents")))
+	report, err := chunkService.RecoverChunks()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, report.OrphansQuarantined)
+	data, err := os.ReadFile(filepath.Join(chunkDir, QuarantineDir, orphan))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("chunk contents"), data)
+	for _, untouched := range []string{"README", filepath.Join("backup", kept), filepath.Join("1a", "2b", "notes.txt")} {
+		assert.FileExists(t, filepath.Join(chunkDir, untouched))
+	}
+}
+
+func TestChunkService_StoreConcurrencyLimit(t *testing.T) {
+	chunkService, _, _ := newChunkServiceWithDB(t)
+	const limit = 3
+	chunkService.SetStoreConcurrency(limit, time.Minute)
+
+	var inFlight, maxInFlight atomic.Int32
+	chunkService.failpoint = func(step string) error {
+		if step == stepTempWritten {
+			n := inFlight.Add(1)
+			for {
+				seen := maxInFlight.Load()
+				if n <= seen || maxInFlight.CompareAndSwap(seen, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			inFlight.Add(-1)
+		}
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- chunkService.StoreChunk(fmt.Sprintf("%08d-load-chunk", i), "file-1", i, "hash", []byte("data"))
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		assert.NoError(t, err, "Queued stores should complete once a slot frees")
+	}
+	assert.LessOrEqual(t, maxInFlight.Load(), int32(limit))
+	assert.Equal(t, int32(limit), maxInFlight.Load(), "Load should saturate the limit")
+	count, err := chunkService.GetChunkCount()
+	assert.NoError(t, err)
+	assert.Equal(t, 20, count)
+}
+
+func TestChunkService_StoreRejectedWhenBusy(t *testing.T) {
+	chunkService, _, _ := newChunkServiceWithDB(t)
+	chunkService.SetStoreConcurrency(1, -1)
+
+	// Hold the only slot with the first store
+	entered, unblock := make(chan struct{}), make(chan struct{})
+	var first sync.Once
+	chunkService.failpoint = func(step string) error {
+		first.Do(func() {
+			close(entered)
+			<-unblock
+		})
+		return nil
+	}
+	done := make(chan error)
+	go func() { done <- chunkService.StoreChunk("00000000-slow", "file-1", 0, "hash", []byte("data")) }()
+	<-entered
+
+	err := chunkService.StoreChunk("00000001-fast", "file-1", 1, "hash", []byte("data"))
+	assert.ErrorIs(t, err, ErrStoreBusy)
+
+	close(unblock)
+	assert.NoError(t, <-done)
+	assert.NoError(t, chunkService.StoreChunk("00000001-fast", "file-1", 1, "hash", []byte("data")), "The slot is free again")
+}
+
+func TestMetrics_ScrapeReportsChunksAndProofs(t *testing.T) {
+	chunkService, _, _ := newChunkServiceWithDB(t)
+	metrics := NewMetrics()
+	chunkService.SetMetrics(metrics)
+	engine := NewProofEngine(chunkService)
+	engine.SetCacheSize(8)
+	engine.SetMetrics(metrics)
+	engine.SetClock(&stepClock{now: time.Unix(1700000000, 0), step: 500 * time.Millisecond})
+
+	assert.NoError(t, chunkService.StoreChunk("00000000-first", "file-1", 0, "hash", []byte("data")))
+	assert.NoError(t, chunkService.StoreChunk("00000001-second", "file-1", 1, "hash", []byte("more data")))
+	_, err := engine.GenerateProof("00000000-first", []byte("seed"), 10)
+	assert.NoError(t, err)
+	_, err = engine.GenerateProof("missing", []byte("seed"), 10)
+	assert.Error(t, err)
+	metrics.RecordHeartbeat(nil)
+	metrics.RecordHeartbeat(errors.New("coordinator unreachable"))
+
+	server := httptest.NewServer(metrics)
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/metrics")
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("Content-Type"), "text/plain")
+	assert.Contains(t, string(body), "# TYPE storage_node_chunks_stored gauge\nstorage_node_chunks_stored 2\n")
+	assert.Contains(t, string(body), "storage_node_bytes_used 13\n")
+	assert.Contains(t, string(body), `storage_node_proofs_total{result="success"} 1`)
+	assert.Contains(t, string(body), `storage_node_proofs_total{result="failure"} 1`)
+	assert.Contains(t, string(body), "storage_node_proof_duration_average_seconds 0.5\n")
+	assert.Contains(t, string(body), `storage_node_heartbeats_total{result="failure"} 1`)
+	assert.Contains(t, string(body), `storage_node_proof_cache_lookups_total{result="miss"} 1`)
+	assert.Contains(t, string(body), "storage_node_proof_cache_entries 1\n")
+
+	assert.NoError(t, chunkService.DeleteChunk("00000001-second"))
+	var buf strings.Builder
+	_, err = metrics.WriteTo(&buf)
+	assert.NoError(t, err)
+	assert.Contains(t, buf.String(), "storage_node_chunks_stored 1\n", "Deleting a chunk updates the gauge")
+}
+
+func TestChunkService_ManySimultaneousStores(t *testing.T) {
+	chunkService, _, _ := newChunkServiceWithDB(t)
+	chunkService.SetStoreConcurrency(0, 0)
+	// Room for 40 of the 50 chunks: the cap must hold even when every store checks space at once
+	chunkService.limits.MaxBytes = 40 * 100
+
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	errs := make(chan error, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			errs <- chunkService.StoreChunk(fmt.Sprintf("%08d-concurrent", i), "file-1", i, "hash", make([]byte, 100))
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+	close(errs)
+
+	stored, refused := 0, 0
+	for err := range errs {
+		if errors.Is(err, ErrInsufficientSpace) {
+			refused++
+			continue
+		}
+		if assert.NoError(t, err) {
+			stored++
+		}
+	}
+	assert.Equal(t, 40, stored)
+	assert.Equal(t, 10, refused)
+
+	count, err := chunkService.GetChunkCount()
+	assert.NoError(t, err)
+	assert.Equal(t, 40, count)
+	total, err := chunkService.GetTotalStorage()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(40*100), total)
+}
+
+// fakeMigrator answers MigrateChunk with resp or err, recording what it was sent
+type fakeMigrator struct {
+	resp *MigrateChunkResponse
+	err  error
+	sent map[string][]byte
+}
+
+func (m *fakeMigrator) MigrateChunk(chunkID string, data []byte) (*MigrateChunkResponse, error) {
+	if m.sent == nil {
+		m.sent = make(map[string][]byte)
+	}
+	m.sent[chunkID] = data
+	if m.err != nil {
+		return nil, m.err
+	}
+	if m.resp != nil {
+		return m.resp, nil
+	}
+	return &MigrateChunkResponse{ChunkID: chunkID, Replicas: 3, Copied: 2}, nil
+}
+
+func TestMigrateAndDelete(t *testing.T) {
+	tests := []struct {
+		name     string
+		migrator *fakeMigrator
+		deleted  bool
+		err      error
+	}{
+		{name: "confirmed migration deletes the local copy", migrator: &fakeMigrator{}, deleted: true},
+		{name: "coordinator error keeps the local copy", migrator: &fakeMigrator{err: errors.New("503")}},
+		{name: "no replica elsewhere keeps the local copy", migrator: &fakeMigrator{resp: &MigrateChunkResponse{ChunkID: "chunk-1"}}, err: errMigrationUnconfirmed},
+		{name: "confirmation of another chunk keeps the local copy", migrator: &fakeMigrator{resp: &MigrateChunkResponse{ChunkID: "chunk-2", Replicas: 3}}, err: errMigrationUnconfirmed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunkService, _, chunkDir := newChunkServiceWithDB(t)
+			assert.NoError(t, chunkService.StoreChunk("chunk-1", "file-1", 0, "hash", []byte("chunk data")))
+
+			resp, err := MigrateAndDelete(chunkService, tt.migrator, "chunk-1")
+			assert.Equal(t, []byte("chunk data"), tt.migrator.sent["chunk-1"], "The chunk's data is sent")
+
+			count, countErr := chunkService.GetChunkCount()
+			assert.NoError(t, countErr)
+			if tt.deleted {
+				assert.NoError(t, err)
+				assert.Equal(t, 3, resp.Replicas)
+				assert.Equal(t, 0, count)
+				assert.Empty(t, chunkFiles(t, chunkDir), "The chunk file is removed")
+				return
+			}
+			assert.Error(t, err)
+			if tt.err != nil {
+				assert.ErrorIs(t, err, tt.err)
+			}
+			assert.Equal(t, 1, count)
+			data, dataErr := chunkService.GetChunkData("chunk-1")
+			assert.NoError(t, dataErr)
+			assert.Equal(t, []byte("chunk data"), data)
+		})
+	}
+}
+
+func TestDecommission_ReportsProgressAndKeepsFailures(t *testing.T) {
+	chunkService, _, _ := newChunkServiceWithDB(t)
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, chunkService.StoreChunk(fmt.Sprintf("chunk-%d", i), "file-1", i, "hash", []byte("data")))
+	}
+	migrator := &routingMigrator{errs: map[string]error{
+		"chunk-1": errors.New("chunk migration failed with status: 503"),
+		"chunk-2": fmt.Errorf("%w (unknown chunk)", ErrChunkUnknown),
+	}}
+
+	var progress []DecommissionProgress
+	report, err := Decommission(context.Background(), chunkService, migrator, func(p DecommissionProgress) {
+		progress = append(progress, p)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, report.Total)
+	assert.Equal(t, 1, report.Migrated)
+	assert.Equal(t, []string{"chunk-2"}, report.Unknown)
+	if assert.Len(t, report.Failed, 1) {
+		assert.Equal(t, "chunk-1", report.Failed[0].ChunkID)
+	}
+	assert.False(t, report.Complete())
+	if assert.Len(t, progress, 3) {
+		assert.Equal(t, 3, progress[2].Done)
+		assert.Equal(t, 3, progress[2].Total)
+	}
+
+	remaining, err := chunkService.ListChunks()
+	assert.NoError(t, err)
+	assert.Len(t, remaining, 2, "Only the confirmed chunk is deleted")
+}
+
+// routingMigrator fails the chunks listed in errs and confirms the rest
+type routingMigrator struct {
+	errs map[string]error
+}
+
+func (m *routingMigrator) MigrateChunk(chunkID string, data []byte) (*MigrateChunkResponse, error) {
+	if err := m.errs[chunkID]; err != nil {
+		return nil, err
+	}
+	return &MigrateChunkResponse{ChunkID: chunkID, Replicas: 3}, nil
+}
+
+func TestCapacityProver(t *testing.T) {
+	newProver := func(free uint64) (*CapacityProver, string) {
+		dir := t.TempDir()
+		p := NewCapacityProver(dir)
+		p.disk = func(string) (*DiskUsage, error) { return &DiskUsage{TotalBytes: 1 << 30, FreeBytes: free}, nil }
+		return p, dir
+	}
+	scratchLeft := func(dir string) int {
+		entries, err := os.ReadDir(dir)
+		assert.NoError(t, err)
+		return len(entries)
+	}
+
+	p, dir := newProver(1 << 20)
+	region, err := p.Begin(64, []int64{5, 1 << 20})
+	assert.NoError(t, err)
+	blocks := [][]byte{bytes.Repeat([]byte{1}, 64), bytes.Repeat([]byte{2}, 64)}
+	for i, block := range blocks {
+		assert.NoError(t, region.WriteBlock(i, block))
+	}
+	assert.Error(t, region.WriteBlock(0, []byte("short")), "Blocks must be the challenge's size")
+	assert.NoError(t, region.Sync())
+
+	got, err := region.Answer([]byte("nonce"), []int{1, 0})
+	assert.NoError(t, err)
+	for i, block := range []int{1, 0} {
+		sum := sha256.Sum256(append([]byte("nonce"), blocks[block]...))
+		assert.Equal(t, hex.EncodeToString(sum[:]), got[i], "Each digest covers the nonce and the block as stored")
+	}
+	_, err = region.Answer([]byte("nonce"), []int{2})
+	assert.ErrorIs(t, err, ErrInvalidCapacityChallenge)
+	assert.NoError(t, region.Close())
+	assert.Equal(t, 0, scratchLeft(dir), "The scratch file is removed")
+
+	// The next challenge can begin once the last is closed
+	region, err = p.Begin(64, []int64{0})
+	assert.NoError(t, err)
+	assert.NoError(t, region.Close())
+
+	tests := []struct {
+		name      string
+		free      uint64
+		blockSize int
+		offsets   []int64
+		wantErr   error
+	}{
+		{name: "not enough free space for the blocks", free: 100, blockSize: 64, offsets: []int64{0, 9}, wantErr: ErrInsufficientSpace},
+		{name: "negative offset", free: 1 << 20, blockSize: 64, offsets: []int64{-1}, wantErr: ErrInvalidCapacityChallenge},
+		{name: "offset past any file", free: 1 << 20, blockSize: 64, offsets: []int64{1 << 60}, wantErr: ErrInvalidCapacityChallenge},
+		{name: "oversized blocks", free: 1 << 40, blockSize: maxCapacityBlockSize + 1, offsets: []int64{0}, wantErr: ErrInvalidCapacityChallenge},
+		{name: "no blocks", free: 1 << 20, blockSize: 64, wantErr: ErrInvalidCapacityChallenge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, dir := newProver(tt.free)
+			region, err := p.Begin(tt.blockSize, tt.offsets)
+			assert.ErrorIs(t, err, tt.wantErr)
+			assert.Nil(t, region)
+			assert.Equal(t, 0, scratchLeft(dir), "Nothing is written for a challenge the node can't meet")
+		})
+	}
+}
+
+// fakeRetrier re-issues one retry per held chunk and rejects answers for the chunks in reject
+type fakeRetrier struct {
+	held    []string
+	reject  map[string]bool
+	answers map[string]*RetryAnswer
+}
+
+func (r *fakeRetrier) RetryProofs(chunkIDs []string) ([]ProofRetry, error) {
+	r.held = chunkIDs
+	var retries []ProofRetry
+	for i, id := range chunkIDs {
+		retries = append(retries, ProofRetry{ChallengeID: "retry-" + id, ChunkID: id, Seed: []byte("seed"), Difficulty: 3, LeafIndex: min(i-1, 0)})
+	}
+	return retries, nil
+}
+
+func (r *fakeRetrier) AnswerRetry(challengeID string, answer *RetryAnswer) error {
+	r.answers[challengeID] = answer
+	if r.reject[challengeID] {
+		return fmt.Errorf("%w (invalid proof hash)", ErrProofRetryRejected)
+	}
+	return nil
+}
+
+func TestRetryProofs_AnswersReissuedChallenges(t *testing.T) {
+	chunkService, _, _ := newChunkServiceWithDB(t)
+	data := []byte("chunk data")
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, chunkService.StoreChunk(fmt.Sprintf("chunk-%d", i), "file-1", i, "hash", data))
+	}
+	retrier := &fakeRetrier{reject: map[string]bool{"retry-chunk-2": true}, answers: map[string]*RetryAnswer{}}
+
+	var progress []RetryProgress
+	report, err := RetryProofs(context.Background(), chunkService, NewProofEngine(chunkService), retrier, func(p RetryProgress) {
+		progress = append(progress, p)
+	})
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"chunk-0", "chunk-1", "chunk-2"}, retrier.held, "Every held chunk is offered")
+	assert.Equal(t, 3, report.Issued)
+	assert.Equal(t, 2, report.Excused)
+	if assert.Len(t, report.Failed, 1) {
+		assert.Equal(t, "chunk-2", report.Failed[0].ChunkID)
+		assert.ErrorIs(t, report.Failed[0].Err, ErrProofRetryRejected)
+	}
+	assert.Len(t, progress, 3)
+
+	for _, id := range []string{"chunk-0", "chunk-1", "chunk-2"} {
+		answer := retrier.answers["retry-"+id]
+		if assert.NotNil(t, answer, id) {
+			assert.Equal(t, ComputeProof([]byte("seed"), "hash", 3), answer.ProofHash)
+		}
+	}
+	assert.Nil(t, retrier.answers["retry-chunk-0"].MerkleProof, "No sub-block unless asked for")
+	if proof := retrier.answers["retry-chunk-1"].MerkleProof; assert.NotNil(t, proof) {
+		assert.Equal(t, 0, proof.LeafIndex)
+		assert.Equal(t, data, proof.Block)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package services
+
+// syncDir is a no-op where directories cannot be synced; renames there are
+// only as durable as the filesystem makes them
+func syncDir(path string) error {
+	return nil
+}
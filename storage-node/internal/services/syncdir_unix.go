@@ -0,0 +1,15 @@
+//go:build unix
+
+package services
+
+import "os"
+
+// syncDir flushes a directory so a rename within it survives a crash
+func syncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// MigrationsEnv names the environment variable that points at the migrations directory
+const MigrationsEnv = "STORAGE_NODE_MIGRATIONS"
+
+// ResolveMigrationsPath finds the migrations directory. An explicit path
+// (the --migrations flag) wins, then the MigrationsEnv value; either must
+// exist. Otherwise a migrations directory next to the executable is used,
+// then ./migrations. It fails, naming every place it looked, when none exists.
+func ResolveMigrationsPath(explicit, env, executable string) (string, error) {
+	if explicit != "" {
+		if !isDir(explicit) {
+			return "", fmt.Errorf("migrations directory %s (from --migrations) does not exist", explicit)
+		}
+		return explicit, nil
+	}
+	if env != "" {
+		if !isDir(env) {
+			return "", fmt.Errorf("migrations directory %s (from %s) does not exist", env, MigrationsEnv)
+		}
+		return env, nil
+	}
+
+	var candidates []string
+	if executable != "" {
+		// Resolve symlinks so a linked binary finds the migrations it was installed with
+		if resolved, err := filepath.EvalSymlinks(executable); err == nil {
+			executable = resolved
+		}
+		candidates = append(candidates, filepath.Join(filepath.Dir(executable), "migrations"))
+	}
+	candidates = append(candidates, "migrations")
+	for _, path := range candidates {
+		if isDir(path) {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("no migrations directory found (looked in %s); pass --migrations or set %s",
+		strings.Join(candidates, ", "), MigrationsEnv)
+}
+
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
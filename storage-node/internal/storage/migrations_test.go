@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// chdir switches the working directory until the test ends
+func chdir(t *testing.T, dir string) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(dir))
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func TestResolveMigrationsPath_Precedence(t *testing.T) {
+	mkdir := func(path string) string {
+		require.NoError(t, os.MkdirAll(path, 0755))
+		return path
+	}
+	root := t.TempDir()
+	flagDir := mkdir(filepath.Join(root, "flag"))
+	envDir := mkdir(filepath.Join(root, "env"))
+	binDir := mkdir(filepath.Join(root, "bin"))
+	execMigrations := mkdir(filepath.Join(binDir, "migrations"))
+	executable := filepath.Join(binDir, "storage-node")
+	require.NoError(t, os.WriteFile(executable, nil, 0755))
+	bareExecutable := filepath.Join(mkdir(filepath.Join(root, "bare")), "storage-node")
+
+	workDir := mkdir(filepath.Join(root, "work"))
+	mkdir(filepath.Join(workDir, "migrations"))
+	chdir(t, workDir)
+
+	tests := []struct {
+		name       string
+		explicit   string
+		env        string
+		executable string
+		want       string
+		wantErr    string
+	}{
+		{name: "flag beats env", explicit: flagDir, env: envDir, executable: executable, want: flagDir},
+		{name: "env beats executable", env: envDir, executable: executable, want: envDir},
+		{name: "next to executable beats working dir", executable: executable, want: execMigrations},
+		{name: "working dir last", executable: bareExecutable, want: "migrations"},
+		{name: "missing flag dir fails", explicit: filepath.Join(root, "nope"), env: envDir, wantErr: "--migrations"},
+		{name: "missing env dir fails", env: filepath.Join(root, "nope"), executable: executable, wantErr: MigrationsEnv},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ResolveMigrationsPath(tt.explicit, tt.env, tt.executable)
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	// Nothing anywhere is an error naming the places searched
+	chdir(t, root)
+	_, err := ResolveMigrationsPath("", "", bareExecutable)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), filepath.Join(filepath.Dir(bareExecutable), "migrations"))
+}